@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+func (s *server) handleQueryAudit(c echo.Context) error {
+	q := exchange.AuditQuery{
+		Market: exchange.Market(c.QueryParam("market")),
+		Action: exchange.AuditAction(c.QueryParam("action")),
+		Result: exchange.AuditResult(c.QueryParam("result")),
+	}
+	if v := c.QueryParam("user"); v != "" {
+		user, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "user must be a user ID",
+			})
+		}
+		q.User = user
+	}
+	for _, bound := range []struct {
+		param string
+		dst   *int64
+	}{{"from", &q.From}, {"to", &q.To}} {
+		v := c.QueryParam(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": bound.param + " must be an RFC 3339 time",
+			})
+		}
+		*bound.dst = t.UnixNano()
+	}
+
+	// admins reading the trail see every attempt that has been answered
+	records, err := s.ex.QueryAudit(q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"records": records,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// handleGetBalances lists what the caller has free in each asset and what
+// their open orders hold.
+func (s *server) handleGetBalances(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"balances": s.ex.Balances(callerID(c)),
+		"held":     s.ex.Held(callerID(c)),
+	})
+}
+
+// depositRequest is the body of POST /admin/deposits.
+type depositRequest struct {
+	User   uint64       `json:"user"`
+	Asset  ledger.Asset `json:"asset"`
+	Amount float64      `json:"amount"`
+	// Market is the market the funds are to back, needed when markets
+	// trading the asset run on different engines.
+	Market exchange.Market `json:"market,omitempty"`
+}
+
+// handleDeposit credits a user with funds the operator has received for
+// them, and returns the ledger entry recording it.
+func (s *server) handleDeposit(c echo.Context) error {
+	var req depositRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	if _, err := s.users.Get(req.User); errors.Is(err, user.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	var entry ledger.Entry
+	var err error
+	if r, ok := s.ex.(*router); ok && req.Market != "" {
+		entry, err = r.DepositFor(req.Market, req.User, req.Asset, req.Amount)
+	} else {
+		entry, err = s.ex.Deposit(req.User, req.Asset, req.Amount)
+	}
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// handleGetFees reports the fees the exchange has charged: what is left to
+// withdraw in each asset, and what each market's trades have paid.
+func (s *server) handleGetFees(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.ex.Fees())
+}
+
+// feeWithdrawalRequest is the body of POST /admin/fees/withdraw.
+type feeWithdrawalRequest struct {
+	User   uint64       `json:"user"`
+	Asset  ledger.Asset `json:"asset"`
+	Amount float64      `json:"amount"`
+}
+
+// handleWithdrawFees pays fees collected out to the operator's user in the
+// body, and returns the ledger entry recording it.
+func (s *server) handleWithdrawFees(c echo.Context) error {
+	var req feeWithdrawalRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	if _, err := s.users.Get(req.User); errors.Is(err, user.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	entry, err := s.ex.WithdrawFees(req.User, req.Asset, req.Amount)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// movementRequest is the body of POST /users/:id/deposits and
+// /users/:id/withdrawals.
+type movementRequest struct {
+	Asset  ledger.Asset `json:"asset"`
+	Amount float64      `json:"amount"`
+}
+
+// handleUserDeposit credits the user in the path with funds received for
+// them, and returns the ledger entry recording it. Outside the sandbox only
+// operators may: a user crediting themselves would be making funds up.
+func (s *server) handleUserDeposit(c echo.Context) error {
+	if !isAdmin(c, s.adminKey) && !s.ex.Sandbox() {
+		return c.JSON(http.StatusForbidden, map[string]any{
+			"msg": "only operators may credit deposits",
+		})
+	}
+	return s.moveFunds(c, s.ex.Deposit)
+}
+
+// handleUserWithdrawal debits the user in the path with funds paid out to
+// them, and returns the ledger entry recording it. Only what they have free
+// can be withdrawn: what their open orders hold can't until they are
+// cancelled.
+func (s *server) handleUserWithdrawal(c echo.Context) error {
+	return s.moveFunds(c, s.ex.Withdraw)
+}
+
+func (s *server) moveFunds(c echo.Context, move func(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error)) error {
+	var req movementRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	id := pathUser(c)
+	if _, err := s.users.Get(id); errors.Is(err, user.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	entry, err := move(id, req.Asset, req.Amount)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// handleGetUserLedger lists every change to the free balances of the user
+// in the path the ledger keeps, oldest first, with the balance each left:
+// deposits, withdrawals, transfers, trades and their fees, and what open
+// orders hold and release.
+func (s *server) handleGetUserLedger(c echo.Context) error {
+	lines := s.ex.Statement(pathUser(c))
+	if asset := ledger.Asset(c.QueryParam("asset")); asset != "" {
+		lines = slices.DeleteFunc(lines, func(l ledger.Line) bool { return l.Asset != asset })
+	}
+	if lines == nil {
+		lines = []ledger.Line{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"entries": lines,
+	})
+}
+
+// faucetRequest is the body of POST /sandbox/faucet.
+type faucetRequest struct {
+	Asset  ledger.Asset `json:"asset"`
+	Amount float64      `json:"amount"`
+}
+
+// handleSandboxFaucet credits the caller with funds to trade in the
+// sandbox, and returns the ledger entry recording it.
+func (s *server) handleSandboxFaucet(c echo.Context) error {
+	var req faucetRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	entry, err := s.ex.SandboxFaucet(callerID(c), req.Asset, req.Amount)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, entry)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+const (
+	// defaultBodyLimit bounds request bodies on routes that take one order
+	// or a small settings document.
+	defaultBodyLimit = 64 << 10
+	// batchBodyFactor is how many times the default limit routes carrying a
+	// whole book may take.
+	batchBodyFactor = 256
+)
+
+var (
+	errBodyTooLarge = errors.New("request body is too large")
+	// errMalformedBody is all a client is told about a body that won't
+	// decode; the decoder's own errors describe our types
+	errMalformedBody = errors.New("request body is not a single JSON object of the expected shape")
+)
+
+// bodyLimit refuses request bodies larger than limit bytes. Declared lengths
+// are checked up front; anything else is cut off once limit bytes have been
+// read, which decodeBody reports as errBodyTooLarge.
+func bodyLimit(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.ContentLength > limit {
+				return bodyTooLarge(c, limit)
+			}
+			req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+			return next(c)
+		}
+	}
+}
+
+func bodyTooLarge(c echo.Context, limit int64) error {
+	return c.JSON(http.StatusRequestEntityTooLarge, &exchange.Rejection{
+		Msg:   errBodyTooLarge.Error(),
+		Code:  "BODY_TOO_LARGE",
+		Limit: float64(limit),
+	})
+}
+
+// decodeBody reads the request body and decodes it into v strictly: unknown
+// fields and anything after the first JSON value are refused with
+// errMalformedBody, and bodies over the route's limit with errBodyTooLarge.
+// It returns what it read of the body for auditing.
+func decodeBody(c echo.Context, v any) ([]byte, error) {
+	raw, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return raw, errors.Join(errBodyTooLarge, err)
+		}
+		return raw, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return raw, errMalformedBody
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return raw, errMalformedBody
+	}
+	return raw, nil
+}
+
+// bodyErrorResponse answers a request whose body decodeBody refused, in the
+// same envelope as rejections.
+func bodyErrorResponse(c echo.Context, err error) error {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return bodyTooLarge(c, tooLarge.Limit)
+	case errors.Is(err, errMalformedBody):
+		return c.JSON(http.StatusBadRequest, &exchange.Rejection{
+			Msg:  errMalformedBody.Error(),
+			Code: "MALFORMED_BODY",
+		})
+	default:
+		return err
+	}
+}
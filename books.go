@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+const defaultBooksDepth = 10
+
+// handleGetBooks snapshots the top of several markets and returns them under
+// one timestamp. A market that is unknown or doesn't answer in time gets an
+// error entry instead of failing the whole response.
+func (s *server) handleGetBooks(c echo.Context) error {
+	depth := defaultBooksDepth
+	if v := c.QueryParam("depth"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "depth must be a positive integer",
+			})
+		}
+		depth = d
+	}
+
+	var markets []exchange.Market
+	for _, m := range strings.Split(c.QueryParam("markets"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			markets = append(markets, exchange.Market(m))
+		}
+	}
+	if len(markets) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "markets is required",
+		})
+	}
+
+	books := make([]depthResponse, len(markets))
+	for i, market := range markets {
+		format, err := s.numberFormat(c, market)
+		// unknown markets are reported in their entry
+		if err != nil && !errors.Is(err, exchange.ErrMarketNotFound) {
+			return errorResponse(c, err)
+		}
+		books[i].format = format
+	}
+	for i, depth := range s.ex.GetDepths(markets, depth) {
+		books[i].MarketDepth = depth
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"timestamp": time.Now().UnixNano(),
+		"books":     books,
+	})
+}
+
+// handleStreamFeed streams a market's trades and book deltas as server-sent
+// events, one event per message. The stream ends if the client falls too far
+// behind; it should then reload the book and reconnect.
+//
+// A client reconnecting after a drop passes the last sequence number it saw
+// as since. It is first sent the book deltas it missed, if they are still
+// held, and otherwise a snapshot event: the whole book as a JSON array of
+// book messages, replacing what it had.
+func (s *server) handleStreamFeed(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	var (
+		resume      *exchange.FeedResume
+		updates     <-chan []exchange.FeedMessage
+		unsubscribe func()
+	)
+	if v := c.QueryParam("since"); v != "" {
+		since, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "since must be a sequence number",
+			})
+		}
+		var r exchange.FeedResume
+		r, updates, unsubscribe, err = s.ex.ResumeFeed(market, since)
+		resume = &r
+	} else {
+		updates, unsubscribe, err = s.ex.SubscribeFeed(market)
+	}
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	switch {
+	case resume == nil:
+	case resume.Resumed:
+		if err := writeFeedMessages(w, resume.Messages, format); err != nil {
+			return err
+		}
+	default:
+		snapshot := make([]feedMessageResponse, len(resume.Messages))
+		for i, msg := range resume.Messages {
+			snapshot[i] = feedMessageResponse{FeedMessage: msg, format: format}
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data); err != nil {
+			return nil
+		}
+	}
+	w.Flush()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msgs, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			if err := writeFeedMessages(w, msgs, format); err != nil {
+				return err
+			}
+			w.Flush()
+		}
+	}
+}
+
+// writeFeedMessages writes msgs as one event each. A client that has gone
+// away is not an error; the stream just ends on its next read of ctx.
+func writeFeedMessages(w io.Writer, msgs []exchange.FeedMessage, format numberFormat) error {
+	for _, msg := range msgs {
+		data, err := json.Marshal(feedMessageResponse{FeedMessage: msg, format: format})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// queuedOrderResponse is an order in GET /book/:market/level. Other users'
+// orders show a hash in place of their ID and no place in the queue; the
+// caller's own, and every order for an operator, show both.
+type queuedOrderResponse struct {
+	ID        uint64   `json:"id,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+	Owner     uint64   `json:"owner,omitempty"`
+	Size      decimal  `json:"size"`
+	Sequence  int64    `json:"sequence"`
+	Frozen    bool     `json:"frozen,omitempty"`
+	Own       bool     `json:"own,omitempty"`
+	Position  *int     `json:"position,omitempty"`
+	SizeAhead *decimal `json:"sizeAhead,omitempty"`
+}
+
+// handleGetLevel returns the queue of orders resting at one price, in time
+// priority, for working out why one order filled before another.
+func (s *server) handleGetLevel(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+	side := orderbook.Side(c.QueryParam("side"))
+	if side != orderbook.SideBid && side != orderbook.SideAsk {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "side must be bid or ask",
+		})
+	}
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	price, err := format.scale.ParsePrice(c.QueryParam("price"))
+	if err != nil || price <= 0 {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "price must be a positive number within the market's precision",
+		})
+	}
+	queue, err := s.ex.LevelQueue(market, side, price)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	admin, me := isAdmin(c, s.adminKey), callerID(c)
+	orders := make([]queuedOrderResponse, len(queue))
+	for i, o := range queue {
+		r := queuedOrderResponse{Size: format.size(o.Size), Sequence: o.Sequence, Frozen: o.Frozen}
+		own := me != 0 && o.Owner == me
+		if !admin && !own {
+			r.Hash = s.orderHash(o.ID)
+			orders[i] = r
+			continue
+		}
+		ahead := format.size(o.SizeAhead)
+		r.ID, r.Own, r.Position, r.SizeAhead = o.ID, own, &o.Position, &ahead
+		if admin {
+			r.Owner = o.Owner
+		}
+		orders[i] = r
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"market": market,
+		"side":   side,
+		"price":  format.price(price),
+		"orders": orders,
+	})
+}
+
+// orderHash stands in for the ID of an order the caller may not see. It is
+// keyed with the session secret, so it can't be undone by hashing every ID
+// in turn, and stays the same between requests for as long as the secret
+// does.
+func (s *server) orderHash(id uint64) string {
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write(binary.BigEndian.AppendUint64(nil, id))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
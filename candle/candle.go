@@ -0,0 +1,141 @@
+// Package candle aggregates trades into OHLCV candles: each interval's
+// opening, highest, lowest and closing prices and the volume traded.
+package candle
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// Interval is how long a candle covers.
+type Interval string
+
+const (
+	Minute      Interval = "1m"
+	FiveMinutes Interval = "5m"
+	Hour        Interval = "1h"
+	Day         Interval = "1d"
+)
+
+// Intervals are those candles are aggregated at.
+var Intervals = []Interval{Minute, FiveMinutes, Hour, Day}
+
+// ErrInterval is returned by ParseInterval for an interval candles aren't
+// aggregated at.
+var ErrInterval = errors.New("interval must be 1m, 5m, 1h or 1d")
+
+// ParseInterval returns the interval s names.
+func ParseInterval(s string) (Interval, error) {
+	i := Interval(s)
+	if i.Duration() == 0 {
+		return "", ErrInterval
+	}
+	return i, nil
+}
+
+// Duration is how long i is, or zero if candles aren't aggregated at it.
+func (i Interval) Duration() time.Duration {
+	switch i {
+	case Minute:
+		return time.Minute
+	case FiveMinutes:
+		return 5 * time.Minute
+	case Hour:
+		return time.Hour
+	case Day:
+		return 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// Start is the start of the candle covering t, in unix nanoseconds. Candles
+// are aligned to the unix epoch, so a day's starts at midnight UTC.
+func (i Interval) Start(t int64) int64 {
+	return t - t%int64(i.Duration())
+}
+
+// Candle is a market's trading over one interval from Start, in unix
+// nanoseconds, with its prices in the quote asset and its volume in the
+// base asset. Intervals without trades have none.
+type Candle struct {
+	Market   exchange.Market `json:"market"`
+	Interval Interval        `json:"interval"`
+	Start    int64           `json:"start"`
+	Open     float64         `json:"open"`
+	High     float64         `json:"high"`
+	Low      float64         `json:"low"`
+	Close    float64         `json:"close"`
+	Volume   float64         `json:"volume"`
+	Trades   int             `json:"trades"`
+	// LastTradeID is the ID of the last trade it covers; a trade with no
+	// higher ID has been added already.
+	LastTradeID uint64 `json:"-"`
+}
+
+type key struct {
+	market   exchange.Market
+	interval Interval
+}
+
+// Aggregator builds each market's live candles, the latest at every
+// interval, as trades are added. It is safe for concurrent use.
+type Aggregator struct {
+	mu   sync.Mutex
+	live map[key]Candle
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{live: make(map[key]Candle)}
+}
+
+// Seed picks up from c, a live candle kept from before, so the trades it
+// covers aren't added again and later ones in its interval are added to it.
+func (a *Aggregator) Seed(c Candle) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k := key{c.Market, c.Interval}
+	if live, ok := a.live[k]; !ok || live.Start < c.Start {
+		a.live[k] = c
+	}
+}
+
+// Add adds a trade to market's live candles, starting new ones as it falls
+// past their intervals, and appends those it changed to dst. A trade older
+// than the live candles, or added before, changes none.
+func (a *Aggregator) Add(market exchange.Market, tradeID uint64, price, size float64, timestamp int64, dst []Candle) []Candle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, interval := range Intervals {
+		k := key{market, interval}
+		start := interval.Start(timestamp)
+		c, ok := a.live[k]
+		switch {
+		case ok && (tradeID <= c.LastTradeID || start < c.Start):
+			continue
+		case !ok || start > c.Start:
+			c = Candle{Market: market, Interval: interval, Start: start, Open: price, High: price, Low: price}
+		}
+		c.High = max(c.High, price)
+		c.Low = min(c.Low, price)
+		c.Close = price
+		c.Volume = ledger.Round(c.Volume + size)
+		c.Trades++
+		c.LastTradeID = tradeID
+		a.live[k] = c
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// Live returns market's live candle at interval, if it has had a trade.
+func (a *Aggregator) Live(market exchange.Market, interval Interval) (Candle, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.live[key{market, interval}]
+	return c, ok
+}
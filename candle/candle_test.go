@@ -0,0 +1,73 @@
+package candle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator()
+	base := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) int64 { return base.Add(d).UnixNano() }
+
+	a.Add(exchange.MarketEth, 1, 100, 1, at(10*time.Second), nil)
+	a.Add(exchange.MarketEth, 2, 105, 2, at(20*time.Second), nil)
+	a.Add(exchange.MarketEth, 3, 95, 1, at(30*time.Second), nil)
+	// added again, as a replay would, it changes nothing
+	if changed := a.Add(exchange.MarketEth, 3, 95, 1, at(30*time.Second), nil); len(changed) != 0 {
+		t.Fatalf("expected a trade added before to change nothing, got %+v", changed)
+	}
+	want := Candle{Market: exchange.MarketEth, Interval: Minute, Start: at(0), Open: 100, High: 105, Low: 95, Close: 95, Volume: 4, Trades: 3, LastTradeID: 3}
+	if got, ok := a.Live(exchange.MarketEth, Minute); !ok || got != want {
+		t.Fatalf("expected\n%+v\ngot\n%+v", want, got)
+	}
+
+	// the next minute starts a candle of its own, but the hour goes on
+	changed := a.Add(exchange.MarketEth, 4, 110, 1, at(90*time.Second), nil)
+	if len(changed) != len(Intervals) {
+		t.Fatalf("expected a candle changed at each interval, got %+v", changed)
+	}
+	want = Candle{Market: exchange.MarketEth, Interval: Minute, Start: at(time.Minute), Open: 110, High: 110, Low: 110, Close: 110, Volume: 1, Trades: 1, LastTradeID: 4}
+	if changed[0] != want {
+		t.Fatalf("expected\n%+v\ngot\n%+v", want, changed[0])
+	}
+	if hour, _ := a.Live(exchange.MarketEth, Hour); hour.Start != at(0) || hour.Open != 100 || hour.High != 110 || hour.Trades != 4 {
+		t.Fatalf("expected the hour's candle to cover every trade, got %+v", hour)
+	}
+	if day, _ := a.Live(exchange.MarketEth, Day); day.Start != time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("expected the day's candle to start at midnight, got %+v", day)
+	}
+	// volume adds up as the book adds sizes, not as floats do
+	a.Add(exchange.MarketBtc, 1, 100, 0.1, at(0), nil)
+	a.Add(exchange.MarketBtc, 2, 100, 0.2, at(0), nil)
+	if c, _ := a.Live(exchange.MarketBtc, Minute); c.Volume != 0.3 {
+		t.Fatalf("expected a volume of 0.3, got %v", c.Volume)
+	}
+	if _, ok := a.Live(exchange.MarketEth+"X", Minute); ok {
+		t.Fatal("expected no candle for a market without trades")
+	}
+
+	// a seeded candle picks up where a previous process left off
+	b := NewAggregator()
+	b.Seed(want)
+	b.Add(exchange.MarketEth, 4, 110, 1, at(90*time.Second), nil)
+	b.Add(exchange.MarketEth, 5, 90, 1, at(100*time.Second), nil)
+	if got, _ := b.Live(exchange.MarketEth, Minute); got.Open != 110 || got.Low != 90 || got.Trades != 2 {
+		t.Fatalf("expected the seeded candle carried on, got %+v", got)
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	for _, s := range []string{"1m", "5m", "1h", "1d"} {
+		if i, err := ParseInterval(s); err != nil || string(i) != s {
+			t.Errorf("expected %s parsed, got %q, %v", s, i, err)
+		}
+	}
+	for _, s := range []string{"", "1s", "1w", "60m"} {
+		if _, err := ParseInterval(s); err != ErrInterval {
+			t.Errorf("expected %q refused, got %v", s, err)
+		}
+	}
+}
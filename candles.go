@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/store"
+)
+
+// resumeCandles returns an aggregator carrying on with ex's live candles as
+// repo keeps them, so trades replayed from the journal aren't counted twice
+// and later ones are added to the candles they fall in.
+func resumeCandles(ex *exchange.Exchange, repo store.Repository) *candle.Aggregator {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	agg := candle.NewAggregator()
+	for _, market := range ex.Markets() {
+		for _, interval := range candle.Intervals {
+			live, err := repo.Candles(ctx, store.CandleQuery{Market: market, Interval: interval, Limit: 1})
+			if err != nil {
+				slog.Error("failed to read candles", "market", market, "interval", interval, "error", err)
+				os.Exit(1)
+			}
+			if len(live) > 0 {
+				agg.Seed(live[0])
+			}
+		}
+	}
+	return agg
+}
+
+// withCandles serves markets' live candles from agg, which has them before
+// they are saved. Without it they are served as last saved.
+func withCandles(agg *candle.Aggregator) serverOption {
+	return func(s *server) {
+		s.candles = agg
+	}
+}
+
+// aggregateCandles has agg build ex's live candles from its trades, for a
+// process without a database to save them in, whose recorder would.
+func aggregateCandles(ex *exchange.Exchange, agg *candle.Aggregator) {
+	scales := make(map[exchange.Market]orderbook.Scale)
+	for _, market := range ex.Markets() {
+		cfg, _ := ex.Limits(market)
+		scales[market] = cfg.Scale
+	}
+	ex.HandleEvents(func(events []exchange.Event) {
+		for _, e := range events {
+			scale := scales[e.Market]
+			agg.Add(e.Market, e.TradeID, scale.PriceValue(e.Price), scale.SizeValue(e.Size), e.Timestamp, nil)
+		}
+	}, exchange.EventFill)
+}
+
+// handleGetCandles lists market's candles at the interval query parameter,
+// 1m by default, newest first. They are narrowed by from and to (RFC 3339,
+// bounding when they start) and at most limit of them. Intervals without
+// trades have no candle. The live candle comes from memory and only older
+// ones from the database, so without one only the live candle is listed.
+func (s *server) handleGetCandles(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+	if s.history == nil && s.candles == nil {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"msg": "candles are not kept",
+		})
+	}
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	q := store.CandleQuery{Market: market, Interval: candle.Minute}
+	if v := c.QueryParam("interval"); v != "" {
+		if q.Interval, err = candle.ParseInterval(v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": err.Error(),
+			})
+		}
+	}
+	limit, ok := queryLimit(c)
+	if !ok {
+		return badLimit(c)
+	}
+	q.Limit = limit
+	if err := queryBounds(c, &q.From, &q.To); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+
+	var candles []candle.Candle
+	older := q
+	if s.candles != nil {
+		// the database may have the live candle too, as last saved
+		if live, ok := s.candles.Live(q.Market, q.Interval); ok && live.Start >= q.From && (q.To == 0 || live.Start <= q.To) {
+			candles = append(candles, live)
+			older.To, older.Limit = live.Start-1, q.Limit-1
+		}
+	}
+	if s.history != nil && older.Limit > 0 && (older.To == 0 || older.To >= older.From) {
+		saved, err := s.history.Candles(c.Request().Context(), older)
+		if err != nil {
+			return historyError(c, err)
+		}
+		candles = append(candles, saved...)
+	}
+
+	resp := make([]candleResponse, len(candles))
+	for i, c := range candles {
+		resp[i] = candleResponse{Candle: c, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"candles": resp,
+	})
+}
+
+// subscribeCandles streams the live candle of key's market at its interval
+// from the market's trades, starting from the one the aggregator has, if
+// any, and closes each once its interval is over: when a trade falls past
+// it or, failing one, when the clock gets there.
+func (ws *wsSession) subscribeCandles(key wsKey) {
+	format, err := ws.s.numberFormat(ws.c, key.market)
+	if err != nil {
+		ws.send(wsMessage{Type: "error", Channel: key.channel, Market: key.market, Interval: key.interval, Msg: err.Error()})
+		return
+	}
+	updates, unsubscribe, err := ws.s.ex.SubscribeFeed(key.market)
+	if err != nil {
+		ws.send(wsMessage{Type: "error", Channel: key.channel, Market: key.market, Interval: key.interval, Msg: err.Error()})
+		return
+	}
+
+	sub := &wsSubscription{unsubscribe: unsubscribe, done: make(chan struct{})}
+	ws.mu.Lock()
+	ws.subs[key] = sub
+	ws.mu.Unlock()
+	ws.send(wsMessage{Type: "subscribed", Channel: key.channel, Market: key.market, Interval: key.interval})
+
+	clk, length := ws.s.clock, int64(key.interval.Duration())
+	send := func(typ string, c candle.Candle) {
+		ws.send(wsMessage{Type: typ, Channel: key.channel, Market: key.market, Interval: key.interval, Data: candleResponse{Candle: c, format: format}})
+	}
+	var (
+		live     candle.Candle
+		ok       bool
+		rollover clock.Timer
+	)
+	// start makes c the live candle, and has its rollover come when its
+	// interval is over
+	start := func(c candle.Candle) {
+		live, ok = c, true
+		if rollover != nil {
+			rollover.Stop()
+		}
+		rollover = clk.NewTimer(time.Duration(c.Start + length - clk.Now().UnixNano()))
+	}
+	if ws.s.candles != nil {
+		if c, found := ws.s.candles.Live(key.market, key.interval); found && c.Start == key.interval.Start(clk.Now().UnixNano()) {
+			start(c)
+			send("update", live)
+		}
+	}
+
+	go func() {
+		defer close(sub.done)
+		defer func() {
+			if rollover != nil {
+				rollover.Stop()
+			}
+		}()
+		for {
+			var tick <-chan time.Time
+			if ok {
+				tick = rollover.C()
+			}
+			select {
+			case msgs, open := <-updates:
+				if !open {
+					ws.ended(key, sub)
+					return
+				}
+				changed := false
+				for _, msg := range msgs {
+					if msg.Type != exchange.FeedTrade {
+						continue
+					}
+					begins := key.interval.Start(msg.Timestamp)
+					price, size := format.scale.PriceValue(msg.Price), format.scale.SizeValue(msg.Size)
+					switch {
+					case ok && (msg.TradeID <= live.LastTradeID || begins < live.Start):
+						continue
+					case ok && begins > live.Start:
+						send("closed", live)
+						ok = false
+					}
+					if !ok {
+						start(candle.Candle{Market: key.market, Interval: key.interval, Start: begins, Open: price, High: price, Low: price})
+					}
+					live.High = max(live.High, price)
+					live.Low = min(live.Low, price)
+					live.Close = price
+					live.Volume = ledger.Round(live.Volume + size)
+					live.Trades++
+					live.LastTradeID = msg.TradeID
+					changed = true
+				}
+				if changed {
+					send("update", live)
+				}
+			case now := <-tick:
+				// a trade may have started the next candle since the
+				// timer fired
+				if now.UnixNano() >= live.Start+length {
+					send("closed", live)
+					ok = false
+				}
+			}
+		}
+	}()
+}
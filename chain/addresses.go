@@ -0,0 +1,133 @@
+package chain
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// ErrNoAddresses is returned by AddressPool.Assign once every address in
+// the pool is taken.
+var ErrNoAddresses = errors.New("no deposit addresses left")
+
+// AddressPool hands out deposit addresses, one per user for good, from a
+// list the operator derives offline, so the exchange never holds the keys
+// to what users deposit. The exchange keeps which user has which, so the
+// list can be loaded again after a restart without any address changing
+// hands. Its methods are safe for concurrent use.
+type AddressPool struct {
+	// exchange keeps the assignments; without one they are kept in memory
+	exchange *exchange.Exchange
+
+	mu       sync.Mutex
+	free     []Address
+	assigned []Address
+	byUser   map[uint64]Address
+	owners   map[Address]uint64
+}
+
+// NewAddressPool returns a pool handing out addresses in order, keeping the
+// assignments in ex if it isn't nil. Addresses ex has given out already
+// stay with their users, and are taken from the ones left to hand out.
+// Duplicates are dropped.
+func NewAddressPool(addresses []Address, ex *exchange.Exchange) *AddressPool {
+	p := &AddressPool{
+		exchange: ex,
+		byUser:   make(map[uint64]Address),
+		owners:   make(map[Address]uint64),
+	}
+	if ex != nil {
+		for _, a := range ex.DepositAddresses() {
+			p.take(a.User, Address(a.Address))
+		}
+	}
+	seen := make(map[Address]bool)
+	for _, a := range addresses {
+		if _, ok := p.owners[a]; !ok && !seen[a] {
+			seen[a] = true
+			p.free = append(p.free, a)
+		}
+	}
+	return p
+}
+
+// LoadAddressPool reads a pool from path, one address per line, as
+// NewAddressPool does. Blank lines and lines starting with # are skipped.
+func LoadAddressPool(path string, ex *exchange.Exchange) (*AddressPool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addresses []Address
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a, err := ParseAddress(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		addresses = append(addresses, a)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewAddressPool(addresses, ex), nil
+}
+
+// Assign returns user's deposit address, taking the next free one the first
+// time.
+func (p *AddressPool) Assign(user uint64) (Address, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if a, ok := p.byUser[user]; ok {
+		return a, nil
+	}
+	if len(p.free) == 0 {
+		return "", ErrNoAddresses
+	}
+	a := p.free[0]
+	if p.exchange != nil {
+		if err := p.exchange.AssignDepositAddress(user, string(a)); err != nil {
+			return "", err
+		}
+	}
+	p.free = p.free[1:]
+	p.take(user, a)
+	return a, nil
+}
+
+// take gives a to user. The caller holds p.mu, or has p to itself.
+func (p *AddressPool) take(user uint64, a Address) {
+	p.assigned = append(p.assigned, a)
+	p.byUser[user] = a
+	p.owners[a] = user
+}
+
+// Owner returns the user a was assigned to.
+func (p *AddressPool) Owner(a Address) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	user, ok := p.owners[a]
+	return user, ok
+}
+
+// Assigned returns the addresses handed out so far, in the order they were.
+func (p *AddressPool) Assigned() []Address {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.assigned)
+}
@@ -0,0 +1,657 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// fakeNode answers the JSON-RPC calls the watcher and withdrawals make,
+// and Clef's signing call, from a chain held in memory.
+type fakeNode struct {
+	mu sync.Mutex
+	// blocks holds each block's transactions, block 0 first, and logs the
+	// events emitted in each
+	blocks [][]map[string]string
+	logs   map[uint64][]map[string]any
+	// signed holds the transactions signed, sent those broadcast and not yet
+	// mined, and mined the block each broadcast one was mined in
+	signed []map[string]any
+	sent   []string
+	mined  map[string]uint64
+	// reverts holds the raw transactions that revert when mined, and
+	// refuse the error broadcasting any fails with
+	reverts map[string]bool
+	refuse  string
+	// balances holds ether balances by address and token balances by
+	// contract/address, in their smallest amounts; mined transactions move
+	// them, gas included
+	balances map[string]*big.Int
+}
+
+// fund adds raw to key's balance.
+func (n *fakeNode) fund(key string, raw int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.add(key, big.NewInt(raw))
+}
+
+// balance returns key's balance.
+func (n *fakeNode) balance(key string) *big.Int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return new(big.Int).Set(n.get(key))
+}
+
+func (n *fakeNode) get(key string) *big.Int {
+	if b, ok := n.balances[key]; ok {
+		return b
+	}
+	return new(big.Int)
+}
+
+func (n *fakeNode) add(key string, raw *big.Int) {
+	if n.balances == nil {
+		n.balances = make(map[string]*big.Int)
+	}
+	n.balances[key] = new(big.Int).Add(n.get(key), raw)
+}
+
+// apply moves the balances a signed transaction does. The caller holds
+// n.mu.
+func (n *fakeNode) apply(tx map[string]any) {
+	from, to := tx["from"].(string), tx["to"].(string)
+	value, _ := parseBig(tx["value"].(string))
+	gas, _ := parseBig(tx["gas"].(string))
+	price, _ := parseBig(tx["gasPrice"].(string))
+	n.add(from, new(big.Int).Neg(new(big.Int).Add(value, gas.Mul(gas, price))))
+	if data, ok := tx["data"].(string); ok {
+		raw, _ := parseBig(data[74:])
+		n.add(to+"/"+from, new(big.Int).Neg(raw))
+		n.add(to+"/0x"+data[34:74], raw)
+		return
+	}
+	n.add(to, value)
+}
+
+// mine adds a block of txs, along with the transactions broadcast since the
+// last one.
+func (n *fakeNode) mine(txs ...map[string]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, raw := range n.sent {
+		if n.mined == nil {
+			n.mined = make(map[string]uint64)
+		}
+		n.mined[raw] = uint64(len(n.blocks))
+		nonce, _ := parseUint(strings.TrimPrefix(raw, "0xraw"))
+		if !n.reverts[raw] {
+			n.apply(n.signed[nonce])
+		}
+	}
+	n.sent = nil
+	n.blocks = append(n.blocks, txs)
+}
+
+// mineLogs adds a block whose transactions emitted logs.
+func (n *fakeNode) mineLogs(logs ...map[string]any) {
+	n.mine()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.logs == nil {
+		n.logs = make(map[uint64][]map[string]any)
+	}
+	number := uint64(len(n.blocks) - 1)
+	for i, l := range logs {
+		l["blockNumber"] = quantity(number)
+		l["logIndex"] = quantity(uint64(i))
+		n.logs[number] = append(n.logs[number], l)
+	}
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     uint64 `json:"id"`
+		Method string `json:"method"`
+		Params []any  `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var result any
+	switch req.Method {
+	case "eth_blockNumber":
+		result = quantity(uint64(len(n.blocks) - 1))
+	case "eth_getBlockByNumber":
+		number, _ := parseUint(req.Params[0].(string))
+		if number < uint64(len(n.blocks)) {
+			result = map[string]any{
+				"number":       quantity(number),
+				"hash":         "0xb" + strconv.FormatUint(number, 16),
+				"transactions": n.blocks[number],
+			}
+		}
+	case "eth_getLogs":
+		filter := req.Params[0].(map[string]any)
+		from, _ := parseUint(filter["fromBlock"].(string))
+		to, _ := parseUint(filter["toBlock"].(string))
+		logs := []map[string]any{}
+		for number := from; number <= to; number++ {
+			for _, l := range n.logs[number] {
+				if slices.Contains(filter["address"].([]any), l["address"]) {
+					logs = append(logs, l)
+				}
+			}
+		}
+		result = logs
+	case "account_signTransaction":
+		tx := req.Params[0].(map[string]any)
+		n.signed = append(n.signed, tx)
+		result = map[string]any{"raw": "0xraw" + strings.TrimPrefix(tx["nonce"].(string), "0x")}
+	case "eth_getTransactionCount":
+		result = quantity(uint64(len(n.signed)))
+	case "eth_getBalance":
+		result = "0x" + n.get(req.Params[0].(string)).Text(16)
+	case "eth_call":
+		call := req.Params[0].(map[string]any)
+		data := call["data"].(string)
+		result = "0x" + word(n.get(call["to"].(string)+"/0x"+data[34:]).Text(16))
+	case "eth_gasPrice":
+		result = "0x3b9aca00"
+	case "eth_sendRawTransaction":
+		if n.refuse != "" {
+			json.NewEncoder(w).Encode(map[string]any{"id": req.ID, "error": map[string]any{"code": -32000, "message": n.refuse}})
+			return
+		}
+		raw := req.Params[0].(string)
+		n.sent = append(n.sent, raw)
+		result = "0xhash" + strings.TrimPrefix(raw, "0xraw")
+	case "eth_getTransactionReceipt":
+		raw := "0xraw" + strings.TrimPrefix(req.Params[0].(string), "0xhash")
+		if block, ok := n.mined[raw]; ok {
+			status := "0x1"
+			if n.reverts[raw] {
+				status = "0x0"
+			}
+			result = map[string]any{"blockNumber": quantity(block), "status": status}
+		}
+	default:
+		json.NewEncoder(w).Encode(map[string]any{"id": req.ID, "error": map[string]any{"code": -32601, "message": "method not found"}})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": req.ID, "result": result})
+}
+
+func transfer(hash string, to Address, wei string) map[string]string {
+	value, _ := new(big.Int).SetString(wei, 10)
+	return map[string]string{"hash": hash, "from": "0x" + strings.Repeat("f", 40), "to": string(to), "value": "0x" + value.Text(16)}
+}
+
+func tokenTransfer(hash string, contract, to Address, raw int64) map[string]any {
+	return map[string]any{
+		"address":         string(contract),
+		"topics":          []string{transferTopic, "0x" + word(strings.Repeat("f", 40)), "0x" + word(strings.TrimPrefix(string(to), "0x"))},
+		"data":            "0x" + word(strconv.FormatInt(raw, 16)),
+		"transactionHash": hash,
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	want := Address("0x52908400098527886e0f7030069857d2e4169ee7")
+	for _, s := range []string{"0x52908400098527886E0F7030069857D2E4169EE7", "52908400098527886e0f7030069857d2e4169ee7"} {
+		if got, err := ParseAddress(s); err != nil || got != want {
+			t.Fatalf("expected %s, got %s, %v", want, got, err)
+		}
+	}
+	for _, s := range []string{"", "0x1234", "0x" + strings.Repeat("g", 40)} {
+		if _, err := ParseAddress(s); !errors.Is(err, ErrInvalidAddress) {
+			t.Fatalf("expected ErrInvalidAddress for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestAddressPool(t *testing.T) {
+	a, b, c := Address("0x"+strings.Repeat("a", 40)), Address("0x"+strings.Repeat("b", 40)), Address("0x"+strings.Repeat("c", 40))
+	ex := exchange.New(exchange.Config{})
+	p := NewAddressPool([]Address{a, a, b}, ex)
+	if got, err := p.Assign(7); err != nil || got != a {
+		t.Fatalf("expected %s, got %s, %v", a, got, err)
+	}
+	if got, _ := p.Assign(7); got != a {
+		t.Fatalf("expected user 7 to keep %s, got %s", a, got)
+	}
+	if got, _ := p.Assign(8); got != b {
+		t.Fatalf("expected %s, got %s", b, got)
+	}
+	if _, err := p.Assign(9); !errors.Is(err, ErrNoAddresses) {
+		t.Fatalf("expected ErrNoAddresses, got %v", err)
+	}
+	if user, ok := p.Owner(b); !ok || user != 8 {
+		t.Fatalf("expected user 8, got %d, %v", user, ok)
+	}
+
+	// the exchange keeps who has which, so a pool loaded again after a
+	// restart hands out only what is left
+	restored := exchange.New(exchange.Config{})
+	if err := restored.Restore(ex.Checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+	p = NewAddressPool([]Address{c, b, a}, restored)
+	if got, _ := p.Assign(8); got != b {
+		t.Fatalf("expected user 8 to keep %s, got %s", b, got)
+	}
+	if got, _ := p.Assign(9); got != c {
+		t.Fatalf("expected %s, got %s", c, got)
+	}
+	if got := p.Assigned(); !slices.Equal(got, []Address{a, b, c}) {
+		t.Fatalf("unexpected addresses assigned %v", got)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	node := &fakeNode{}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+	deposit, other := Address("0x"+strings.Repeat("1", 40)), Address("0x"+strings.Repeat("2", 40))
+	usdc, unknown := Address("0x"+strings.Repeat("5", 40)), Address("0x"+strings.Repeat("6", 40))
+	ex := exchange.New(exchange.Config{Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	l := ex.Ledger()
+	pool := NewAddressPool([]Address{deposit}, ex)
+	if _, err := pool.Assign(7); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := WatcherConfig{
+		Client:        NewClient(srv.URL, srv.Client()),
+		Addresses:     pool,
+		Exchange:      ex,
+		Tokens:        []Token{{Asset: "USDC", Contract: usdc, Decimals: 6}},
+		Confirmations: 3,
+		StartBlock:    1,
+	}
+	w := NewWatcher(cfg)
+	ctx := context.Background()
+
+	node.mine()
+	node.mine(
+		transfer("0x01", deposit, "1500000000000000000"),
+		transfer("0x02", other, "1000000000000000000"),
+		// below the ledger's precision
+		transfer("0x03", deposit, "9999999999"),
+	)
+	node.mine(transfer("0x04", deposit, "250000000123456789"))
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Balance(ledger.UserAccount(7), ledger.ETH); got != 0 {
+		t.Fatalf("expected nothing credited with 2 confirmations, got %v", got)
+	}
+
+	node.mine()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Balance(ledger.UserAccount(7), ledger.ETH); got != 1.5 {
+		t.Fatalf("expected 1.5 ETH credited, got %v", got)
+	}
+	node.mine()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// polling again credits nothing twice
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Balance(ledger.UserAccount(7), ledger.ETH); got != 1.75 {
+		t.Fatalf("expected 1.75 ETH credited, got %v", got)
+	}
+	deposits := w.Deposits(7)
+	if len(deposits) != 2 || deposits[0].TxHash != "0x01" || deposits[0].Block != 1 || deposits[1].Amount != 0.25 || deposits[1].Address != string(deposit) {
+		t.Fatalf("unexpected deposits %+v", deposits)
+	}
+	if scanned := ex.ScannedBlock(); scanned != 2 {
+		t.Fatalf("expected blocks up to 2 scanned, got %d", scanned)
+	}
+
+	// a watcher started again from the exchange's state picks up after the
+	// last block scanned, and a deposit seen again is not credited twice
+	restored := exchange.New(exchange.Config{})
+	if err := restored.Restore(ex.Checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+	ex, l = restored, restored.Ledger()
+	cfg.Exchange, cfg.Addresses, cfg.StartBlock = restored, NewAddressPool([]Address{deposit}, restored), 0
+	w = NewWatcher(cfg)
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Balance(ledger.UserAccount(7), ledger.ETH); got != 1.75 {
+		t.Fatalf("expected 1.75 ETH credited after the restart, got %v", got)
+	}
+	if _, err := ex.CreditDeposit(deposits[0]); !errors.Is(err, exchange.ErrDepositCredited) {
+		t.Fatalf("expected ErrDepositCredited, got %v", err)
+	}
+
+	// tokens are credited from their contracts' transfer events, each
+	// transfer in a transaction once
+	node.mineLogs(
+		tokenTransfer("0x05", usdc, deposit, 2_500_000),
+		tokenTransfer("0x05", usdc, deposit, 1),
+		tokenTransfer("0x06", unknown, deposit, 1_000_000),
+		tokenTransfer("0x07", usdc, other, 1_000_000),
+	)
+	node.mine()
+	node.mine()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Balance(ledger.UserAccount(7), "USDC"); got != 2.500001 {
+		t.Fatalf("expected 2.500001 USDC credited, got %v", got)
+	}
+	if deposits := w.Deposits(7); len(deposits) != 4 || deposits[2].Asset != "USDC" || deposits[2].TxHash != "0x05" {
+		t.Fatalf("unexpected deposits %+v", deposits)
+	}
+}
+
+func TestWithdrawals(t *testing.T) {
+	node := &fakeNode{reverts: map[string]bool{"0xraw1": true}}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+	hot, to := Address("0x"+strings.Repeat("3", 40)), Address("0x"+strings.Repeat("4", 40))
+	usdc := Address("0x" + strings.Repeat("5", 40))
+
+	ex := exchange.New(exchange.Config{Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	l := ex.Ledger()
+	if _, err := ex.Deposit(7, ledger.ETH, 2); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(srv.URL, srv.Client())
+	cfg := WithdrawalConfig{
+		Client:        client,
+		Signer:        NewClefSigner(client),
+		Exchange:      ex,
+		From:          hot,
+		ChainID:       1,
+		Tokens:        []Token{{Asset: "USDC", Contract: usdc, Decimals: 6}},
+		Confirmations: 2,
+	}
+	w := NewWithdrawals(cfg)
+	ctx := context.Background()
+	node.mine()
+
+	if _, err := w.Request(7, ledger.ETH, to, 2.5); !errors.Is(err, ledger.ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	first, err := w.Request(7, ledger.ETH, to, 1.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mined, but reverts
+	second, _ := w.Request(7, ledger.ETH, to, 0.5)
+	if got := l.Balance(ledger.HeldAccount(7), ledger.ETH); got != 1.75 {
+		t.Fatalf("expected 1.75 ETH held, got %v", got)
+	}
+
+	if err := w.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.signed) != 2 || node.signed[0]["value"] != "0x1158e460913d0000" || node.signed[0]["nonce"] != "0x0" || node.signed[1]["nonce"] != "0x1" || node.signed[0]["from"] != string(hot) {
+		t.Fatalf("unexpected transactions signed %v", node.signed)
+	}
+	if got, _ := w.Get(7, first.ID); got.Status != exchange.WithdrawalBroadcast || got.TxHash != "0xhash0" {
+		t.Fatalf("expected withdrawal broadcast as 0xhash0, got %+v", got)
+	}
+
+	node.mine()
+	if err := w.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := w.Get(7, first.ID); got.Status != exchange.WithdrawalBroadcast {
+		t.Fatalf("expected withdrawal to wait for 2 confirmations, got %+v", got)
+	}
+
+	// the withdrawals in flight outlive the process
+	restored := exchange.New(exchange.Config{})
+	if err := restored.Restore(ex.Checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+	ex, l = restored, restored.Ledger()
+	cfg.Exchange = restored
+	w = NewWithdrawals(cfg)
+	node.mine()
+	if err := w.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := w.Get(7, first.ID); got.Status != exchange.WithdrawalConfirmed {
+		t.Fatalf("expected withdrawal confirmed, got %+v", got)
+	}
+	if got, _ := w.Get(7, second.ID); got.Status != exchange.WithdrawalFailed || got.Error == "" {
+		t.Fatalf("expected reverted withdrawal failed, got %+v", got)
+	}
+	if free, held := l.Balance(ledger.UserAccount(7), ledger.ETH), l.Balance(ledger.HeldAccount(7), ledger.ETH); free != 0.75 || held != 0 {
+		t.Fatalf("expected 0.75 ETH free and none held, got %v and %v", free, held)
+	}
+
+	// a withdrawal the node refuses fails at once
+	node.mu.Lock()
+	node.refuse = "insufficient funds for gas * price + value"
+	node.mu.Unlock()
+	refused, _ := w.Request(7, ledger.ETH, to, 0.25)
+	if err := w.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := w.Get(7, refused.ID); got.Status != exchange.WithdrawalFailed || got.Error == "" {
+		t.Fatalf("expected refused withdrawal failed, got %+v", got)
+	}
+	if got := l.Balance(ledger.UserAccount(7), ledger.ETH); got != 0.75 {
+		t.Fatalf("expected refused withdrawal released, got %v free", got)
+	}
+
+	if _, err := w.Get(8, first.ID); !errors.Is(err, exchange.ErrWithdrawalNotFound) {
+		t.Fatalf("expected another user's withdrawal not found, got %v", err)
+	}
+	if list := w.List(7); len(list) != 3 || list[0].ID != first.ID {
+		t.Fatalf("unexpected withdrawals %+v", list)
+	}
+
+	// a token is withdrawn by calling its contract
+	node.mu.Lock()
+	node.refuse = ""
+	node.mu.Unlock()
+	if _, err := ex.Deposit(7, "USDC", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Request(7, "USDC", to, 0.0000001); !errors.Is(err, ledger.ErrInvalidAmount) {
+		t.Fatalf("expected ErrInvalidAmount below the token's decimals, got %v", err)
+	}
+	if _, err := w.Request(7, "DAI", to, 1); !errors.Is(err, ErrUnsupportedAsset) {
+		t.Fatalf("expected ErrUnsupportedAsset, got %v", err)
+	}
+	if _, err := w.Request(7, "USDC", to, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tx := node.signed[len(node.signed)-1]
+	data := "0x" + transferSelector + word(strings.TrimPrefix(string(to), "0x")) + word("2dc6c0")
+	if tx["to"] != string(usdc) || tx["value"] != "0x0" || tx["data"] != data || tx["gas"] != quantity(tokenTransferGas) {
+		t.Fatalf("unexpected token transfer signed %v", tx)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	node := &fakeNode{}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+	a1, a2, a3 := Address("0x"+strings.Repeat("a", 40)), Address("0x"+strings.Repeat("b", 40)), Address("0x"+strings.Repeat("c", 40))
+	hot, cold := Address("0x"+strings.Repeat("3", 40)), Address("0x"+strings.Repeat("9", 40))
+	usdc := Address("0x" + strings.Repeat("5", 40))
+	pool := NewAddressPool([]Address{a1, a2, a3}, nil)
+	for user := range uint64(3) {
+		pool.Assign(user + 1)
+	}
+	node.fund(string(a1), 600_000_000_000_000_000)
+	node.fund(string(usdc)+"/"+string(a1), 50_000_000)
+	node.fund(string(a2), 2_000_000_000_000_000_000)
+	// no ether to pay for moving it
+	node.fund(string(usdc)+"/"+string(a3), 10_000_000)
+
+	client := NewClient(srv.URL, srv.Client())
+	s := NewSweeper(SweeperConfig{
+		Client:     client,
+		Signer:     NewClefSigner(client),
+		Addresses:  pool,
+		Hot:        hot,
+		Cold:       cold,
+		ChainID:    1,
+		Tokens:     []Token{{Asset: "USDC", Contract: usdc, Decimals: 6}},
+		HotCeiling: map[ledger.Asset]float64{ledger.ETH: 0.5},
+	})
+	ctx := context.Background()
+	node.mine()
+
+	if err := s.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is swept twice while it is on its way
+	if err := s.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sweeps := s.Sweeps()
+	if len(sweeps) != 3 {
+		t.Fatalf("expected 3 sweeps, got %+v", sweeps)
+	}
+	// a1's token goes to cold storage, having no hot ceiling, and its
+	// ether, less the gas for both, tops up the hot wallet; a2's ether
+	// finds it above its ceiling and goes to cold storage
+	for i, want := range []Sweep{
+		{From: a1, To: TierCold, Asset: "USDC", Amount: 50},
+		{From: a1, To: TierHot, Asset: ledger.ETH, Amount: 0.599879},
+		{From: a2, To: TierCold, Asset: ledger.ETH, Amount: 1.999979},
+	} {
+		got := sweeps[i]
+		if got.From != want.From || got.To != want.To || got.Asset != want.Asset || got.Amount != want.Amount || got.Mined {
+			t.Fatalf("expected sweep %d to be %+v, got %+v", i, want, got)
+		}
+	}
+
+	node.mine()
+	if err := s.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sweeps := s.Sweeps(); len(sweeps) != 3 || !sweeps[2].Mined {
+		t.Fatalf("expected the 3 sweeps mined and nothing left to sweep, got %+v", sweeps)
+	}
+	balances, err := s.Balances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Tier]map[ledger.Asset]float64{
+		TierDeposit: {ledger.ETH: 0, "USDC": 10},
+		TierHot:     {ledger.ETH: 0.599879, "USDC": 0},
+		TierCold:    {ledger.ETH: 1.999979, "USDC": 50},
+	}
+	if !reflect.DeepEqual(balances, want) {
+		t.Fatalf("expected balances %v, got %v", want, balances)
+	}
+	if got := node.balance(string(a1)); got.Sign() != 0 {
+		t.Fatalf("expected a1 swept bare, got %v wei left", got)
+	}
+}
+
+func TestSettler(t *testing.T) {
+	node := &fakeNode{reverts: map[string]bool{"0xraw1": true}}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+	a1, a2 := Address("0x"+strings.Repeat("a", 40)), Address("0x"+strings.Repeat("b", 40))
+	usdc := Address("0x" + strings.Repeat("5", 40))
+	node.fund(string(a1), 1_000_000_000_000_000_000)
+	node.fund(string(a2), 100_000_000_000_000_000)
+	node.fund(string(usdc)+"/"+string(a2), 1_000_000_000)
+
+	client := NewClient(srv.URL, srv.Client())
+	s := NewSettler(SettlerConfig{
+		Client:        client,
+		Signer:        NewClefSigner(client),
+		Addresses:     NewAddressPool([]Address{a1, a2}, nil),
+		ChainID:       1,
+		Tokens:        []Token{{Asset: "USDC", Contract: usdc, Decimals: 6}},
+		MaxAttempts:   2,
+		Confirmations: 1,
+	})
+	ctx := context.Background()
+	node.mine()
+	process := func() {
+		t.Helper()
+		if err := s.Process(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func(want ...TransferStatus) {
+		t.Helper()
+		transfers := s.Transfers(7)
+		if len(transfers) != len(want) {
+			t.Fatalf("expected %d transfers, got %+v", len(want), transfers)
+		}
+		for i, tr := range transfers {
+			if tr.Status != want[i] {
+				t.Fatalf("expected transfer %d %s, got %+v", i+1, want[i], tr)
+			}
+		}
+	}
+
+	// user 7 buys 0.5 ETH from user 8 for USDC, then for USD, which isn't
+	// on chain; a trade with an anonymous side isn't either
+	s.Settle(ledger.Trade{Buyer: 7, Seller: 8, Base: ledger.ETH, Quote: "USDC", Price: 2000, Size: 0.5}, 1)
+	s.Settle(ledger.Trade{Buyer: 7, Seller: 8, Base: ledger.ETH, Quote: ledger.USD, Price: 2000, Size: 0.25}, 2)
+	s.Settle(ledger.Trade{Buyer: 0, Seller: 8, Base: ledger.ETH, Quote: "USDC", Price: 2000, Size: 0.25}, 3)
+	status(TransferPending, TransferPending, TransferPending)
+	process()
+	status(TransferBroadcast, TransferBroadcast, TransferBroadcast)
+
+	// the USDC leg reverts and is sent again
+	node.mine()
+	process()
+	status(TransferConfirmed, TransferPending, TransferConfirmed)
+	process()
+	status(TransferConfirmed, TransferBroadcast, TransferConfirmed)
+	node.mine()
+	process()
+	status(TransferConfirmed, TransferConfirmed, TransferConfirmed)
+	transfers := s.Transfers(8)
+	if tr := transfers[0]; tr.From != a1 || tr.To != a2 || tr.FromUser != 8 || tr.Entry != 1 || tr.Attempts != 0 {
+		t.Fatalf("unexpected transfer %+v", tr)
+	}
+	if tr := transfers[1]; tr.Asset != "USDC" || tr.Amount != 1000 || tr.From != a2 || tr.Attempts != 1 {
+		t.Fatalf("unexpected transfer %+v", tr)
+	}
+	if got := node.balance(string(usdc) + "/" + string(a1)); got.Int64() != 1_000_000_000 {
+		t.Fatalf("expected 1000 USDC moved to user 8's address, got %v", got)
+	}
+
+	// one that is refused every time fails
+	node.mu.Lock()
+	node.refuse = "insufficient funds for gas * price + value"
+	node.mu.Unlock()
+	s.Settle(ledger.Trade{Buyer: 7, Seller: 8, Base: ledger.ETH, Quote: ledger.USD, Price: 2000, Size: 0.25}, 4)
+	process()
+	status(TransferConfirmed, TransferConfirmed, TransferConfirmed, TransferPending)
+	process()
+	status(TransferConfirmed, TransferConfirmed, TransferConfirmed, TransferFailed)
+}
@@ -0,0 +1,323 @@
+// Package chain connects the exchange to an Ethereum node: it watches the
+// chain for deposits of ether and ERC-20 tokens to the addresses handed out
+// to users, crediting them to the ledger once they are deep enough not to be
+// undone, and sends users' withdrawals.
+package chain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Address is an Ethereum address, kept as 0x and 40 lowercase hex digits so
+// addresses compare equal however they were written.
+type Address string
+
+// ErrInvalidAddress is returned by ParseAddress for anything but 20 bytes
+// of hex.
+var ErrInvalidAddress = errors.New("invalid address")
+
+// ParseAddress normalizes s, with or without its 0x prefix or checksum
+// casing.
+func ParseAddress(s string) (Address, error) {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	if b, err := hex.DecodeString(s); err != nil || len(b) != 20 {
+		return "", fmt.Errorf("%w %q", ErrInvalidAddress, s)
+	}
+	return Address("0x" + s), nil
+}
+
+// RPCError is an error answered by the node.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("node error %d: %s", e.Code, e.Message)
+}
+
+// Client calls an Ethereum node's JSON-RPC API over HTTP.
+type Client struct {
+	url  string
+	http *http.Client
+	id   atomic.Uint64
+}
+
+// NewClient returns a client for the node at url.
+func NewClient(url string, httpClient *http.Client) *Client {
+	return &Client{url: url, http: httpClient}
+}
+
+// call runs method with params and decodes its result into result.
+func (c *Client) call(ctx context.Context, method string, result any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      c.id.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: node answered %s", method, resp.Status)
+	}
+
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+		Error  *RPCError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return fmt.Errorf("%s: decoding answer: %w", method, err)
+	}
+	if answer.Error != nil {
+		return fmt.Errorf("%s: %w", method, answer.Error)
+	}
+	if err := json.Unmarshal(answer.Result, result); err != nil {
+		return fmt.Errorf("%s: decoding result: %w", method, err)
+	}
+	return nil
+}
+
+// BlockNumber returns the number of the node's latest block.
+func (c *Client) BlockNumber(ctx context.Context) (uint64, error) {
+	var number string
+	if err := c.call(ctx, "eth_blockNumber", &number); err != nil {
+		return 0, err
+	}
+	return parseUint(number)
+}
+
+// Transaction is a transaction as the watcher needs it: who sent Value, in
+// wei, to whom. To is empty for a contract creation.
+type Transaction struct {
+	Hash  string
+	From  Address
+	To    Address
+	Value *big.Int
+}
+
+// Block is a block and the transactions in it.
+type Block struct {
+	Number       uint64
+	Hash         string
+	Transactions []Transaction
+}
+
+// BlockByNumber returns block number with its transactions.
+func (c *Client) BlockByNumber(ctx context.Context, number uint64) (Block, error) {
+	var raw *struct {
+		Number       string `json:"number"`
+		Hash         string `json:"hash"`
+		Transactions []struct {
+			Hash  string `json:"hash"`
+			From  string `json:"from"`
+			To    string `json:"to"`
+			Value string `json:"value"`
+		} `json:"transactions"`
+	}
+	if err := c.call(ctx, "eth_getBlockByNumber", &raw, quantity(number), true); err != nil {
+		return Block{}, err
+	}
+	if raw == nil {
+		return Block{}, fmt.Errorf("block %d not found", number)
+	}
+
+	block := Block{Number: number, Hash: raw.Hash}
+	for _, tx := range raw.Transactions {
+		value, err := parseBig(tx.Value)
+		if err != nil {
+			return Block{}, fmt.Errorf("transaction %s: %w", tx.Hash, err)
+		}
+		from, _ := ParseAddress(tx.From)
+		// contract creations have no recipient
+		to, _ := ParseAddress(tx.To)
+		block.Transactions = append(block.Transactions, Transaction{
+			Hash:  tx.Hash,
+			From:  from,
+			To:    to,
+			Value: value,
+		})
+	}
+	return block, nil
+}
+
+// quantity encodes n as the JSON-RPC API's hex quantities.
+func quantity(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
+
+func parseUint(s string) (uint64, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return n, nil
+}
+
+func parseBig(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid quantity %q", s)
+	}
+	return n, nil
+}
+
+// PendingNonce returns the nonce of from's next transaction, counting those
+// still waiting in the node's pool.
+func (c *Client) PendingNonce(ctx context.Context, from Address) (uint64, error) {
+	var nonce string
+	if err := c.call(ctx, "eth_getTransactionCount", &nonce, from, "pending"); err != nil {
+		return 0, err
+	}
+	return parseUint(nonce)
+}
+
+// GasPrice returns the node's suggested gas price, in wei.
+func (c *Client) GasPrice(ctx context.Context) (*big.Int, error) {
+	var price string
+	if err := c.call(ctx, "eth_gasPrice", &price); err != nil {
+		return nil, err
+	}
+	return parseBig(price)
+}
+
+// SendRawTransaction broadcasts a signed transaction and returns its hash.
+func (c *Client) SendRawTransaction(ctx context.Context, raw string) (string, error) {
+	var hash string
+	if err := c.call(ctx, "eth_sendRawTransaction", &hash, raw); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// Receipt is the outcome of a mined transaction. Success is false for one
+// that reverted.
+type Receipt struct {
+	Block   uint64
+	Success bool
+}
+
+// TransactionReceipt returns the receipt of the transaction with hash, or
+// false if it hasn't been mined.
+func (c *Client) TransactionReceipt(ctx context.Context, hash string) (Receipt, bool, error) {
+	var raw *struct {
+		BlockNumber string `json:"blockNumber"`
+		Status      string `json:"status"`
+	}
+	if err := c.call(ctx, "eth_getTransactionReceipt", &raw, hash); err != nil {
+		return Receipt{}, false, err
+	}
+	if raw == nil {
+		return Receipt{}, false, nil
+	}
+	block, err := parseUint(raw.BlockNumber)
+	if err != nil {
+		return Receipt{}, false, err
+	}
+	return Receipt{Block: block, Success: raw.Status == "0x1"}, true, nil
+}
+
+// Log is an event a contract emitted. Index is its position in its block.
+type Log struct {
+	Contract Address
+	Topics   []string
+	Data     string
+	TxHash   string
+	Block    uint64
+	Index    uint64
+}
+
+// Logs returns the events with topic that contracts emitted in blocks from
+// through to.
+func (c *Client) Logs(ctx context.Context, from, to uint64, contracts []Address, topic string) ([]Log, error) {
+	var raw []struct {
+		Address     string   `json:"address"`
+		Topics      []string `json:"topics"`
+		Data        string   `json:"data"`
+		TxHash      string   `json:"transactionHash"`
+		BlockNumber string   `json:"blockNumber"`
+		LogIndex    string   `json:"logIndex"`
+	}
+	err := c.call(ctx, "eth_getLogs", &raw, map[string]any{
+		"fromBlock": quantity(from),
+		"toBlock":   quantity(to),
+		"address":   contracts,
+		"topics":    []any{topic},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logs := make([]Log, 0, len(raw))
+	for _, l := range raw {
+		contract, err := ParseAddress(l.Address)
+		if err != nil {
+			return nil, fmt.Errorf("log in %s: %w", l.TxHash, err)
+		}
+		block, err := parseUint(l.BlockNumber)
+		if err != nil {
+			return nil, fmt.Errorf("log in %s: %w", l.TxHash, err)
+		}
+		index, err := parseUint(l.LogIndex)
+		if err != nil {
+			return nil, fmt.Errorf("log in %s: %w", l.TxHash, err)
+		}
+		logs = append(logs, Log{
+			Contract: contract,
+			Topics:   l.Topics,
+			Data:     l.Data,
+			TxHash:   l.TxHash,
+			Block:    block,
+			Index:    index,
+		})
+	}
+	return logs, nil
+}
+
+// Balance returns address's ether balance, in wei.
+func (c *Client) Balance(ctx context.Context, address Address) (*big.Int, error) {
+	var balance string
+	if err := c.call(ctx, "eth_getBalance", &balance, address, "latest"); err != nil {
+		return nil, err
+	}
+	return parseBig(balance)
+}
+
+// TokenBalance returns address's balance of the ERC-20 token at contract,
+// in the token's smallest amounts.
+func (c *Client) TokenBalance(ctx context.Context, contract, address Address) (*big.Int, error) {
+	var balance string
+	err := c.call(ctx, "eth_call", &balance, map[string]any{
+		"to":   contract,
+		"data": "0x" + balanceOfSelector + word(strings.TrimPrefix(string(address), "0x")),
+	}, "latest")
+	if err != nil {
+		return nil, err
+	}
+	return parseBig(balance)
+}
@@ -0,0 +1,351 @@
+package chain
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// DefaultSettlementAttempts is how many times a transfer is sent before it
+// is given up on when SettlerConfig.MaxAttempts is unset.
+const DefaultSettlementAttempts = 5
+
+// TransferStatus is where a settlement transfer is on its way.
+type TransferStatus string
+
+const (
+	// TransferPending: waiting to be signed and broadcast, for the first
+	// time or again after a failed attempt.
+	TransferPending TransferStatus = "PENDING"
+	// TransferBroadcast: sent to the network, waiting to be mined and
+	// confirmed.
+	TransferBroadcast TransferStatus = "BROADCAST"
+	// TransferConfirmed: mined with enough confirmations.
+	TransferConfirmed TransferStatus = "CONFIRMED"
+	// TransferFailed: refused or reverted on every attempt. The ledger
+	// still has the trade settled, so the operator must make it good.
+	TransferFailed TransferStatus = "FAILED"
+)
+
+// Transfer is one leg of a trade settled on chain: Amount of Asset moving
+// from one user's deposit address to the other's. Entry is the ledger entry
+// that settled the trade. UpdatedAt is in unix nanoseconds.
+type Transfer struct {
+	ID        uint64         `json:"id"`
+	Entry     uint64         `json:"entry"`
+	Asset     ledger.Asset   `json:"asset"`
+	Amount    float64        `json:"amount"`
+	FromUser  uint64         `json:"fromUser"`
+	ToUser    uint64         `json:"toUser"`
+	From      Address        `json:"from"`
+	To        Address        `json:"to"`
+	Status    TransferStatus `json:"status"`
+	Attempts  int            `json:"attempts"`
+	TxHash    string         `json:"txHash,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	UpdatedAt int64          `json:"updatedAt"`
+}
+
+// SettlerConfig sets up a Settler.
+type SettlerConfig struct {
+	Client    *Client
+	Signer    Signer
+	Addresses *AddressPool
+	ChainID   uint64
+	// Tokens are the ERC-20 tokens settled besides ether.
+	Tokens []Token
+	// MaxAttempts is how many times a transfer is sent before it fails. It
+	// defaults to DefaultSettlementAttempts.
+	MaxAttempts int
+	// Confirmations is how many blocks, its own included, must be mined on
+	// top of a transfer before it is confirmed. It defaults to
+	// DefaultConfirmations.
+	Confirmations uint64
+	// PollInterval is how often Run works through the queue. It defaults
+	// to DefaultPollInterval.
+	PollInterval time.Duration
+	// Clock dates transfers and paces Run. It defaults to the system clock.
+	Clock clock.Clock
+}
+
+// Settler mirrors settled trades on chain: each leg of a trade between two
+// users in ether or a token is sent from the payer's deposit address to the
+// payee's, paying its gas from the payer's ether. Legs in assets that aren't
+// on chain, and legs with an anonymous side, stay in the ledger only. A
+// transfer the signer or the node refuses, or that reverts, is sent again up
+// to MaxAttempts times; one that couldn't be sent for any other reason
+// stays queued for the next run. Its methods are safe for concurrent use.
+type Settler struct {
+	client        *Client
+	signer        Signer
+	addresses     *AddressPool
+	chainID       uint64
+	tokens        map[ledger.Asset]Token
+	maxAttempts   int
+	confirmations uint64
+	interval      time.Duration
+	clock         clock.Clock
+
+	// processMu serializes Process
+	processMu sync.Mutex
+
+	mu        sync.Mutex
+	last      uint64
+	transfers map[uint64]*Transfer
+	// queue holds the pending transfers' IDs, oldest first, and inFlight
+	// the broadcast ones'
+	queue    []uint64
+	inFlight []uint64
+}
+
+// NewSettler returns a settler configured by cfg. Nothing is sent until it
+// is processed.
+func NewSettler(cfg SettlerConfig) *Settler {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultSettlementAttempts
+	}
+	if cfg.Confirmations == 0 {
+		cfg.Confirmations = DefaultConfirmations
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	tokens := map[ledger.Asset]Token{ether.Asset: ether}
+	for _, token := range cfg.Tokens {
+		tokens[token.Asset] = token
+	}
+	return &Settler{
+		client:        cfg.Client,
+		signer:        cfg.Signer,
+		addresses:     cfg.Addresses,
+		chainID:       cfg.ChainID,
+		tokens:        tokens,
+		maxAttempts:   cfg.MaxAttempts,
+		confirmations: cfg.Confirmations,
+		interval:      cfg.PollInterval,
+		clock:         cfg.Clock,
+		transfers:     make(map[uint64]*Transfer),
+	}
+}
+
+// Settle queues the transfers settling trade, recorded by the ledger as
+// entry: the base from seller to buyer and the quote from buyer to seller,
+// each less the fee its payee pays, which stays behind in the payer's
+// deposit address. It only queues, so it may be called with a book's lock
+// held.
+func (s *Settler) Settle(trade ledger.Trade, entry uint64) {
+	if trade.Buyer == 0 || trade.Seller == 0 {
+		return
+	}
+	notional := ledger.Notional(trade.Price, trade.Size)
+	s.queueLeg(entry, trade.Base, trade.Size-trade.BuyerFee, trade.Seller, trade.Buyer)
+	s.queueLeg(entry, trade.Quote, notional-trade.SellerFee, trade.Buyer, trade.Seller)
+}
+
+// queueLeg queues amount of asset from one user to another, if asset is on
+// chain.
+func (s *Settler) queueLeg(entry uint64, asset ledger.Asset, amount float64, from, to uint64) {
+	if _, ok := s.tokens[asset]; !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last++
+	t := &Transfer{
+		ID:        s.last,
+		Entry:     entry,
+		Asset:     asset,
+		Amount:    amount,
+		FromUser:  from,
+		ToUser:    to,
+		Status:    TransferPending,
+		UpdatedAt: s.clock.Now().UnixNano(),
+	}
+	s.transfers[t.ID] = t
+	s.queue = append(s.queue, t.ID)
+}
+
+// Transfers returns the transfers to or from user, oldest first.
+func (s *Settler) Transfers(user uint64) []Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfers := []Transfer{}
+	for _, t := range s.transfers {
+		if t.FromUser == user || t.ToUser == user {
+			transfers = append(transfers, *t)
+		}
+	}
+	slices.SortFunc(transfers, func(a, b Transfer) int { return cmp.Compare(a.ID, b.ID) })
+	return transfers
+}
+
+// Run processes the queue until ctx is done.
+func (s *Settler) Run(ctx context.Context) {
+	for {
+		if err := s.Process(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("settlement processing failed", "error", err)
+		}
+		timer := s.clock.NewTimer(s.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Process broadcasts the pending transfers in the order they were queued,
+// then settles the broadcast ones that have been mined deep enough.
+func (s *Settler) Process(ctx context.Context) error {
+	s.processMu.Lock()
+	defer s.processMu.Unlock()
+
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	for i, id := range queue {
+		s.mu.Lock()
+		t := *s.transfers[id]
+		s.mu.Unlock()
+
+		hash, err := s.broadcast(ctx, t)
+		var refused *RPCError
+		if err != nil && !errors.As(err, &refused) && !errors.Is(err, ErrNoAddresses) {
+			// put back what is left, ahead of anything queued since
+			s.mu.Lock()
+			s.queue = append(slices.Clone(queue[i:]), s.queue...)
+			s.mu.Unlock()
+			return fmt.Errorf("transfer %d: %w", t.ID, err)
+		}
+
+		s.mu.Lock()
+		if err != nil {
+			s.retry(s.transfers[id], err)
+		} else {
+			s.update(id, TransferBroadcast, hash, "")
+			s.inFlight = append(s.inFlight, id)
+		}
+		s.mu.Unlock()
+	}
+	return s.confirm(ctx)
+}
+
+// broadcast signs and sends t from its payer's deposit address, handing
+// both users one if they don't have one yet.
+func (s *Settler) broadcast(ctx context.Context, t Transfer) (string, error) {
+	from, err := s.addresses.Assign(t.FromUser)
+	if err != nil {
+		return "", err
+	}
+	to, err := s.addresses.Assign(t.ToUser)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.transfers[t.ID].From, s.transfers[t.ID].To = from, to
+	s.mu.Unlock()
+
+	token := s.tokens[t.Asset]
+	raw, _ := token.fromLedger(t.Amount)
+	tx := token.transferTx(from, to, raw, s.chainID)
+	if tx.Nonce, err = s.client.PendingNonce(ctx, from); err != nil {
+		return "", err
+	}
+	if tx.GasPrice, err = s.client.GasPrice(ctx); err != nil {
+		return "", err
+	}
+	signed, err := s.signer.SignTransaction(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	hash, err := s.client.SendRawTransaction(ctx, signed)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("settlement transfer broadcast", "id", t.ID, "entry", t.Entry, "asset", t.Asset, "amount", t.Amount, "tx", hash)
+	return hash, nil
+}
+
+// confirm settles the broadcast transfers mined at least Confirmations
+// deep, sending reverted ones again.
+func (s *Settler) confirm(ctx context.Context) error {
+	s.mu.Lock()
+	inFlight := slices.Clone(s.inFlight)
+	s.mu.Unlock()
+	if len(inFlight) == 0 {
+		return nil
+	}
+
+	head, err := s.client.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range inFlight {
+		s.mu.Lock()
+		hash := s.transfers[id].TxHash
+		s.mu.Unlock()
+
+		receipt, mined, err := s.client.TransactionReceipt(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if !mined || head+1 < receipt.Block+s.confirmations {
+			continue
+		}
+
+		s.mu.Lock()
+		s.inFlight = slices.DeleteFunc(s.inFlight, func(i uint64) bool { return i == id })
+		if receipt.Success {
+			s.update(id, TransferConfirmed, "", "")
+		} else {
+			s.retry(s.transfers[id], errors.New("transaction reverted"))
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// retry queues t to be sent again after err, or fails it once it has had
+// all its attempts. The caller holds s.mu.
+func (s *Settler) retry(t *Transfer, err error) {
+	t.Attempts++
+	if t.Attempts < s.maxAttempts {
+		s.update(t.ID, TransferPending, "", err.Error())
+		s.queue = append(s.queue, t.ID)
+		slog.Warn("settlement transfer to be retried", "id", t.ID, "attempts", t.Attempts, "error", err)
+		return
+	}
+	s.update(t.ID, TransferFailed, "", err.Error())
+	slog.Error("SETTLEMENT TRANSFER FAILED: the ledger and the chain disagree until it is made good", "id", t.ID, "entry", t.Entry, "asset", t.Asset, "amount", t.Amount, "from", t.FromUser, "to", t.ToUser, "error", err)
+}
+
+// update moves the transfer with id to status, setting its transaction
+// hash or error if given. The caller holds s.mu.
+func (s *Settler) update(id uint64, status TransferStatus, hash, msg string) {
+	t := s.transfers[id]
+	t.Status = status
+	if hash != "" {
+		t.TxHash = hash
+	}
+	if msg != "" {
+		t.Error = msg
+	}
+	t.UpdatedAt = s.clock.Now().UnixNano()
+}
@@ -0,0 +1,58 @@
+package chain
+
+import (
+	"context"
+	"encoding/hex"
+	"math/big"
+)
+
+// TxRequest is a transaction to be signed: an ether transfer, or a contract
+// call with Data. Amounts are in wei.
+type TxRequest struct {
+	From     Address
+	To       Address
+	Value    *big.Int
+	Data     []byte
+	Nonce    uint64
+	Gas      uint64
+	GasPrice *big.Int
+	ChainID  uint64
+}
+
+// Signer signs transactions for the exchange's wallet and returns them
+// encoded for broadcasting. The keys stay with the signer.
+type Signer interface {
+	SignTransaction(ctx context.Context, tx TxRequest) (raw string, err error)
+}
+
+// ClefSigner signs through Clef, or another signer speaking its external
+// API, at the other end of client. Clef asks its operator, or its rules, to
+// approve each transaction.
+type ClefSigner struct {
+	client *Client
+}
+
+// NewClefSigner returns a signer using the external API behind client.
+func NewClefSigner(client *Client) *ClefSigner {
+	return &ClefSigner{client: client}
+}
+
+func (s *ClefSigner) SignTransaction(ctx context.Context, tx TxRequest) (string, error) {
+	var signed struct {
+		Raw string `json:"raw"`
+	}
+	args := map[string]any{
+		"from":     tx.From,
+		"to":       tx.To,
+		"value":    "0x" + tx.Value.Text(16),
+		"nonce":    quantity(tx.Nonce),
+		"gas":      quantity(tx.Gas),
+		"gasPrice": "0x" + tx.GasPrice.Text(16),
+		"chainId":  quantity(tx.ChainID),
+	}
+	if len(tx.Data) > 0 {
+		args["data"] = "0x" + hex.EncodeToString(tx.Data)
+	}
+	err := s.client.call(ctx, "account_signTransaction", &signed, args)
+	return signed.Raw, err
+}
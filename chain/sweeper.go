@@ -0,0 +1,335 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// DefaultSweepInterval is how often deposit addresses are swept when
+// SweeperConfig.Interval is unset.
+const DefaultSweepInterval = time.Hour
+
+// Tier is where the exchange keeps funds on chain.
+type Tier string
+
+const (
+	// TierDeposit is the deposit addresses, holding what users sent until
+	// it is swept.
+	TierDeposit Tier = "deposit"
+	// TierHot is the wallet withdrawals are paid from, whose key the signer
+	// keeps online.
+	TierHot Tier = "hot"
+	// TierCold is storage whose key is kept offline; nothing is ever sent
+	// from it automatically.
+	TierCold Tier = "cold"
+)
+
+// Sweep is a transfer of what a deposit address held to the hot or cold
+// wallet. Timestamp is when it was broadcast, in unix nanoseconds.
+type Sweep struct {
+	From      Address      `json:"from"`
+	To        Tier         `json:"to"`
+	Asset     ledger.Asset `json:"asset"`
+	Amount    float64      `json:"amount"`
+	TxHash    string       `json:"txHash"`
+	Mined     bool         `json:"mined"`
+	Timestamp int64        `json:"timestamp"`
+}
+
+// SweeperConfig sets up a Sweeper.
+type SweeperConfig struct {
+	Client    *Client
+	Signer    Signer
+	Addresses *AddressPool
+	// Hot and Cold are the wallets swept to.
+	Hot     Address
+	Cold    Address
+	ChainID uint64
+	// Tokens are the ERC-20 tokens swept besides ether.
+	Tokens []Token
+	// HotCeiling is how much of each asset the hot wallet is topped up to;
+	// the rest goes to cold storage, as does all of an asset without one.
+	HotCeiling map[ledger.Asset]float64
+	// Interval is how often Run sweeps. It defaults to
+	// DefaultSweepInterval.
+	Interval time.Duration
+	// Clock dates sweeps and paces Run. It defaults to the system clock.
+	Clock clock.Clock
+}
+
+// Sweeper moves what users deposit out of their deposit addresses into the
+// exchange's wallets: to the hot wallet while it is below its ceiling, so
+// withdrawals can be paid, and to cold storage otherwise. A deposit
+// address's whole balance goes one way, so the hot wallet may end above its
+// ceiling by one address's worth. Tokens are swept before ether, as moving
+// them is paid for in the address's ether; a token on an address without
+// the ether to move it waits for more. The signer holds the deposit
+// addresses' keys. Its methods are safe for concurrent use.
+type Sweeper struct {
+	client     *Client
+	signer     Signer
+	addresses  *AddressPool
+	wallets    map[Tier]Address
+	chainID    uint64
+	tokens     []Token
+	hotCeiling map[ledger.Asset]float64
+	interval   time.Duration
+	clock      clock.Clock
+
+	// sweepMu serializes sweeps
+	sweepMu sync.Mutex
+
+	mu     sync.Mutex
+	sweeps []Sweep
+}
+
+// NewSweeper returns a sweeper configured by cfg. It does nothing until it
+// sweeps.
+func NewSweeper(cfg SweeperConfig) *Sweeper {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultSweepInterval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	return &Sweeper{
+		client:     cfg.Client,
+		signer:     cfg.Signer,
+		addresses:  cfg.Addresses,
+		wallets:    map[Tier]Address{TierHot: cfg.Hot, TierCold: cfg.Cold},
+		chainID:    cfg.ChainID,
+		tokens:     cfg.Tokens,
+		hotCeiling: cfg.HotCeiling,
+		interval:   cfg.Interval,
+		clock:      cfg.Clock,
+	}
+}
+
+// Run sweeps until ctx is done.
+func (s *Sweeper) Run(ctx context.Context) {
+	for {
+		if err := s.Sweep(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("sweep failed", "error", err)
+		}
+		timer := s.clock.NewTimer(s.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Sweep moves the balances of the deposit addresses handed out so far to
+// the exchange's wallets. An address whose last sweep hasn't been mined is
+// left until it has.
+func (s *Sweeper) Sweep(ctx context.Context) error {
+	s.sweepMu.Lock()
+	defer s.sweepMu.Unlock()
+
+	if err := s.checkMined(ctx); err != nil {
+		return err
+	}
+	gasPrice, err := s.client.GasPrice(ctx)
+	if err != nil {
+		return err
+	}
+	// what the hot wallet will hold, counting sweeps to it on their way
+	hot, err := s.tierBalances(ctx, []Address{s.wallets[TierHot]})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, sweep := range s.sweeps {
+		if !sweep.Mined && sweep.To == TierHot {
+			hot[sweep.Asset] += sweep.Amount
+		}
+	}
+	s.mu.Unlock()
+
+	for _, address := range s.addresses.Assigned() {
+		if s.sweeping(address) {
+			continue
+		}
+		if err := s.sweepAddress(ctx, address, gasPrice, hot); err != nil {
+			return fmt.Errorf("sweeping %s: %w", address, err)
+		}
+	}
+	return nil
+}
+
+// sweepAddress sends address's tokens, then its ether less the gas, each
+// where hot says it should go, adding what goes to the hot wallet to hot.
+func (s *Sweeper) sweepAddress(ctx context.Context, address Address, gasPrice *big.Int, hot map[ledger.Asset]float64) error {
+	wei, err := s.client.Balance(ctx, address)
+	if err != nil {
+		return err
+	}
+	nonce, err := s.client.PendingNonce(ctx, address)
+	if err != nil {
+		return err
+	}
+	send := func(token Token, raw *big.Int) error {
+		amount, ok := token.toLedger(raw)
+		if !ok {
+			return nil
+		}
+		tier := TierCold
+		if hot[token.Asset] < s.hotCeiling[token.Asset] {
+			tier = TierHot
+		}
+		tx := token.transferTx(address, s.wallets[tier], raw, s.chainID)
+		tx.Nonce, tx.GasPrice = nonce, gasPrice
+		signed, err := s.signer.SignTransaction(ctx, tx)
+		if err != nil {
+			return err
+		}
+		hash, err := s.client.SendRawTransaction(ctx, signed)
+		if err != nil {
+			return err
+		}
+		nonce++
+		if tier == TierHot {
+			hot[token.Asset] += amount
+		}
+		s.mu.Lock()
+		s.sweeps = append(s.sweeps, Sweep{
+			From:      address,
+			To:        tier,
+			Asset:     token.Asset,
+			Amount:    amount,
+			TxHash:    hash,
+			Timestamp: s.clock.Now().UnixNano(),
+		})
+		s.mu.Unlock()
+		slog.Info("deposit address swept", "address", address, "to", tier, "asset", token.Asset, "amount", amount, "tx", hash)
+		return nil
+	}
+
+	tokenFee := new(big.Int).Mul(gasPrice, big.NewInt(tokenTransferGas))
+	for _, token := range s.tokens {
+		raw, err := s.client.TokenBalance(ctx, token.Contract, address)
+		if err != nil {
+			return err
+		}
+		if _, ok := token.toLedger(raw); !ok {
+			continue
+		}
+		if wei.Cmp(tokenFee) < 0 {
+			slog.Warn("deposit address lacks the ether to sweep a token", "address", address, "asset", token.Asset)
+			continue
+		}
+		if err := send(token, raw); err != nil {
+			return err
+		}
+		wei.Sub(wei, tokenFee)
+	}
+	// what is left once the gas is paid
+	wei.Sub(wei, new(big.Int).Mul(gasPrice, big.NewInt(transferGas)))
+	if wei.Sign() <= 0 {
+		return nil
+	}
+	return send(ether, wei)
+}
+
+// sweeping reports whether a sweep from address is yet to be mined.
+func (s *Sweeper) sweeping(address Address) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.ContainsFunc(s.sweeps, func(sweep Sweep) bool {
+		return sweep.From == address && !sweep.Mined
+	})
+}
+
+// checkMined marks the sweeps that have been mined.
+func (s *Sweeper) checkMined(ctx context.Context) error {
+	s.mu.Lock()
+	var pending []string
+	for _, sweep := range s.sweeps {
+		if !sweep.Mined {
+			pending = append(pending, sweep.TxHash)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, hash := range pending {
+		receipt, mined, err := s.client.TransactionReceipt(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if !mined {
+			continue
+		}
+		if !receipt.Success {
+			slog.Error("sweep reverted", "tx", hash)
+		}
+		s.mu.Lock()
+		for i := range s.sweeps {
+			if s.sweeps[i].TxHash == hash {
+				s.sweeps[i].Mined = true
+			}
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Sweeps returns the sweeps made so far, oldest first.
+func (s *Sweeper) Sweeps() []Sweep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Sweep{}, s.sweeps...)
+}
+
+// Balances returns what each tier holds on chain of ether and the tokens,
+// the deposit tier summed over the addresses handed out.
+func (s *Sweeper) Balances(ctx context.Context) (map[Tier]map[ledger.Asset]float64, error) {
+	balances := make(map[Tier]map[ledger.Asset]float64)
+	for tier, addresses := range map[Tier][]Address{
+		TierDeposit: s.addresses.Assigned(),
+		TierHot:     {s.wallets[TierHot]},
+		TierCold:    {s.wallets[TierCold]},
+	} {
+		tierBalances, err := s.tierBalances(ctx, addresses)
+		if err != nil {
+			return nil, err
+		}
+		balances[tier] = tierBalances
+	}
+	return balances, nil
+}
+
+// tierBalances sums addresses' balances of ether and the tokens.
+func (s *Sweeper) tierBalances(ctx context.Context, addresses []Address) (map[ledger.Asset]float64, error) {
+	balances := make(map[ledger.Asset]float64)
+	for _, token := range append([]Token{ether}, s.tokens...) {
+		total := new(big.Int)
+		for _, address := range addresses {
+			var raw *big.Int
+			var err error
+			if token == ether {
+				raw, err = s.client.Balance(ctx, address)
+			} else {
+				raw, err = s.client.TokenBalance(ctx, token.Contract, address)
+			}
+			if err != nil {
+				return nil, err
+			}
+			total.Add(total, raw)
+		}
+		amount, _ := token.toLedger(total)
+		balances[token.Asset] = amount
+	}
+	return balances, nil
+}
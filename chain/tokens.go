@@ -0,0 +1,111 @@
+package chain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+const (
+	// transferTopic is the topic of ERC-20 Transfer(address,address,uint256)
+	// events.
+	transferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	// transferSelector calls ERC-20 transfer(address,uint256), and
+	// balanceOfSelector balanceOf(address).
+	transferSelector  = "a9059cbb"
+	balanceOfSelector = "70a08231"
+
+	// transferGas is the gas a plain ether transfer uses, and
+	// tokenTransferGas enough for an ordinary ERC-20 transfer.
+	transferGas      = 21_000
+	tokenTransferGas = 100_000
+)
+
+// ErrUnsupportedAsset is returned for an asset that is neither ether nor
+// one of the registered tokens.
+var ErrUnsupportedAsset = errors.New("asset not supported on chain")
+
+// Token is an ERC-20 token kept on the exchange as Asset. Decimals is how
+// many decimal places its contract counts amounts in.
+type Token struct {
+	Asset    ledger.Asset
+	Contract Address
+	Decimals uint8
+}
+
+// ether is the chain's native asset, counted in wei.
+var ether = Token{Asset: ledger.ETH, Decimals: 18}
+
+// toLedger converts raw, in the token's smallest amounts, to a ledger
+// amount. What is below the ledger's precision is dropped; false means
+// nothing is left or it is more than the ledger can hold.
+func (t Token) toLedger(raw *big.Int) (float64, bool) {
+	units := new(big.Int).Set(raw)
+	if shift := int(t.Decimals) - ledger.AmountPrecision; shift > 0 {
+		units.Quo(units, pow10(shift))
+	} else {
+		units.Mul(units, pow10(-shift))
+	}
+	if units.Sign() <= 0 || !units.IsInt64() {
+		return 0, false
+	}
+	return float64(units.Int64()) / math.Pow10(ledger.AmountPrecision), true
+}
+
+// fromLedger converts a ledger amount to the token's smallest amounts. False
+// means amount is finer than the token can count.
+func (t Token) fromLedger(amount float64) (*big.Int, bool) {
+	raw := big.NewInt(int64(math.Round(amount * math.Pow10(ledger.AmountPrecision))))
+	if shift := int(t.Decimals) - ledger.AmountPrecision; shift >= 0 {
+		return raw.Mul(raw, pow10(shift)), true
+	}
+	var rem big.Int
+	raw.QuoRem(raw, pow10(ledger.AmountPrecision-int(t.Decimals)), &rem)
+	return raw, rem.Sign() == 0
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// transferTx is a transfer of raw of t from from to to: a plain one for
+// ether, a call to the contract for a token. Its nonce and gas price are
+// left to the sender.
+func (t Token) transferTx(from, to Address, raw *big.Int, chainID uint64) TxRequest {
+	if t == ether {
+		return TxRequest{From: from, To: to, Value: raw, Gas: transferGas, ChainID: chainID}
+	}
+	return TxRequest{
+		From:    from,
+		To:      t.Contract,
+		Value:   new(big.Int),
+		Data:    transferData(to, raw),
+		Gas:     tokenTransferGas,
+		ChainID: chainID,
+	}
+}
+
+// transferData is the call data of an ERC-20 transfer of raw to to.
+func transferData(to Address, raw *big.Int) []byte {
+	data, _ := hex.DecodeString(transferSelector + word(strings.TrimPrefix(string(to), "0x")) + word(raw.Text(16)))
+	return data
+}
+
+// word left-pads hex digits to one 32-byte ABI word.
+func word(digits string) string {
+	return strings.Repeat("0", 64-len(digits)) + digits
+}
+
+// topicAddress is the address in an indexed address topic.
+func topicAddress(topic string) (Address, error) {
+	topic = strings.TrimPrefix(topic, "0x")
+	if len(topic) != 64 {
+		return "", fmt.Errorf("%w topic %q", ErrInvalidAddress, topic)
+	}
+	return ParseAddress(topic[24:])
+}
@@ -0,0 +1,255 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+const (
+	// DefaultConfirmations is how many blocks deep a deposit must be before
+	// it is credited when WatcherConfig.Confirmations is unset.
+	DefaultConfirmations = 12
+	// DefaultPollInterval is how often the watcher asks the node for new
+	// blocks when WatcherConfig.PollInterval is unset.
+	DefaultPollInterval = 15 * time.Second
+)
+
+// WatcherConfig sets up a Watcher.
+type WatcherConfig struct {
+	Client    *Client
+	Addresses *AddressPool
+	// Exchange credits deposits and keeps how far the chain has been
+	// scanned and what was credited, journaling each, so a restart picks
+	// up where the watcher left off and credits nothing twice.
+	Exchange *exchange.Exchange
+	// Tokens are the ERC-20 tokens credited besides ether.
+	Tokens []Token
+	// Confirmations is how many blocks, its own included, must be mined
+	// on top of a deposit before it is credited. It defaults to
+	// DefaultConfirmations.
+	Confirmations uint64
+	// PollInterval is how often Run asks the node for new blocks. It
+	// defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	// StartBlock is the first block scanned if the exchange has scanned
+	// none yet. Zero starts from the first block confirmed when the watcher
+	// first polls.
+	StartBlock uint64
+	// Clock dates deposits and paces Run. It defaults to the system clock.
+	Clock clock.Clock
+}
+
+// Watcher scans each block once it has enough confirmations for ether and
+// token transfers to deposit addresses and credits them to the address's
+// user. Only blocks that deep are read, so a reorganization shallower than
+// Confirmations never undoes a credit. Amounts are credited to the ledger's
+// precision; what is below it is left uncredited.
+type Watcher struct {
+	client        *Client
+	addresses     *AddressPool
+	exchange      *exchange.Exchange
+	tokens        map[Address]Token
+	contracts     []Address
+	confirmations uint64
+	interval      time.Duration
+	clock         clock.Clock
+
+	// pollMu serializes polls; next is the next block to scan, zero until
+	// the first poll
+	pollMu sync.Mutex
+	next   uint64
+}
+
+// NewWatcher returns a watcher configured by cfg. It does nothing until
+// polled.
+func NewWatcher(cfg WatcherConfig) *Watcher {
+	if cfg.Confirmations == 0 {
+		cfg.Confirmations = DefaultConfirmations
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	tokens := make(map[Address]Token, len(cfg.Tokens))
+	var contracts []Address
+	for _, token := range cfg.Tokens {
+		tokens[token.Contract] = token
+		contracts = append(contracts, token.Contract)
+	}
+	next := cfg.StartBlock
+	if scanned := cfg.Exchange.ScannedBlock(); scanned > 0 {
+		next = scanned + 1
+	}
+	return &Watcher{
+		client:        cfg.Client,
+		addresses:     cfg.Addresses,
+		exchange:      cfg.Exchange,
+		tokens:        tokens,
+		contracts:     contracts,
+		confirmations: cfg.Confirmations,
+		interval:      cfg.PollInterval,
+		clock:         cfg.Clock,
+		next:          next,
+	}
+}
+
+// Run polls until ctx is done. A failed poll is logged and retried at the
+// next interval from where it stopped.
+func (w *Watcher) Run(ctx context.Context) {
+	for {
+		if err := w.Poll(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("deposit watcher poll failed", "error", err)
+		}
+		timer := w.clock.NewTimer(w.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Poll scans the blocks that have become confirmed since the last poll and
+// credits the deposits in them. The exchange is told how far it got, even
+// if it failed part way, so the next poll, in this process or the next,
+// starts from the first block not yet scanned.
+func (w *Watcher) Poll(ctx context.Context) error {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+
+	head, err := w.client.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	if head+1 < w.confirmations {
+		return nil
+	}
+	confirmed := head + 1 - w.confirmations
+	if w.next == 0 {
+		w.next = confirmed
+	}
+	start := w.next
+	err = w.scanTo(ctx, confirmed)
+	if w.next > start {
+		if scanErr := w.exchange.ScanBlocks(w.next - 1); err == nil {
+			err = scanErr
+		}
+	}
+	return err
+}
+
+// scanTo scans the blocks from w.next up to confirmed, moving w.next past
+// each once every deposit in it is credited. The caller holds w.pollMu.
+func (w *Watcher) scanTo(ctx context.Context, confirmed uint64) error {
+	for ; w.next <= confirmed; w.next++ {
+		block, err := w.client.BlockByNumber(ctx, w.next)
+		if err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions {
+			if err := w.scan(block.Number, tx); err != nil {
+				return err
+			}
+		}
+		if len(w.contracts) == 0 {
+			continue
+		}
+		logs, err := w.client.Logs(ctx, w.next, w.next, w.contracts, transferTopic)
+		if err != nil {
+			return err
+		}
+		for _, l := range logs {
+			if err := w.scanLog(l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan credits tx if it is an ether deposit. The caller holds w.pollMu.
+func (w *Watcher) scan(block uint64, tx Transaction) error {
+	return w.deposit(block, ether, tx.To, tx.Value, tx.Hash, tx.Hash)
+}
+
+// scanLog credits l if it is a transfer of one of the watched tokens to a
+// deposit address. The caller holds w.pollMu.
+func (w *Watcher) scanLog(l Log) error {
+	token, ok := w.tokens[l.Contract]
+	if !ok || len(l.Topics) != 3 || l.Topics[0] != transferTopic {
+		return nil
+	}
+	to, err := topicAddress(l.Topics[2])
+	if err != nil {
+		return nil
+	}
+	value, err := parseBig(l.Data)
+	if err != nil {
+		slog.Warn("token transfer not understood", "tx", l.TxHash, "token", token.Asset, "error", err)
+		return nil
+	}
+	// a transaction may carry more than one transfer
+	return w.deposit(l.Block, token, to, value, l.TxHash, l.TxHash+":"+strconv.FormatUint(l.Index, 10))
+}
+
+// deposit credits raw of token, in its smallest amounts, if to is a deposit
+// address and the transfer, known by reference, hasn't been credited
+// already. A transfer that can't be credited for good, being below the
+// ledger's precision, is skipped; one that can't be credited right now is
+// an error, and its block is scanned again. The caller holds w.pollMu.
+func (w *Watcher) deposit(block uint64, token Token, to Address, raw *big.Int, hash, reference string) error {
+	user, ok := w.addresses.Owner(to)
+	if !ok {
+		return nil
+	}
+	amount, ok := token.toLedger(raw)
+	if !ok {
+		slog.Warn("deposit not credited", "tx", hash, "user", user, "asset", token.Asset, "raw", raw)
+		return nil
+	}
+	_, err := w.exchange.CreditDeposit(exchange.ChainDeposit{
+		User:      user,
+		Asset:     token.Asset,
+		Amount:    amount,
+		Address:   string(to),
+		TxHash:    hash,
+		Reference: reference,
+		Block:     block,
+	})
+	if errors.Is(err, exchange.ErrDepositCredited) {
+		return nil
+	}
+	if err != nil {
+		slog.Error("deposit not credited", "tx", hash, "user", user, "asset", token.Asset, "amount", amount, "error", err)
+		return fmt.Errorf("deposit %s: %w", reference, err)
+	}
+	slog.Info("deposit credited", "tx", hash, "user", user, "asset", token.Asset, "amount", amount, "block", block)
+	return nil
+}
+
+// Deposits returns the deposits credited to user, oldest first.
+func (w *Watcher) Deposits(user uint64) []exchange.ChainDeposit {
+	return w.exchange.ChainDeposits(user)
+}
+
+// Address returns user's deposit address, assigning one the first time.
+func (w *Watcher) Address(user uint64) (Address, error) {
+	return w.addresses.Assign(user)
+}
+
+// Confirmations is how deep a deposit must be to be credited.
+func (w *Watcher) Confirmations() uint64 {
+	return w.confirmations
+}
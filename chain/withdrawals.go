@@ -0,0 +1,239 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// WithdrawalConfig sets up Withdrawals.
+type WithdrawalConfig struct {
+	Client *Client
+	Signer Signer
+	// Exchange keeps the withdrawals and the funds they hold, journaling
+	// each change, so the queue outlives the process.
+	Exchange *exchange.Exchange
+	// From is the wallet withdrawals are paid from, which Signer signs for.
+	From    Address
+	ChainID uint64
+	// Tokens are the ERC-20 tokens that may be withdrawn besides ether.
+	Tokens []Token
+	// Confirmations is how many blocks, its own included, must be mined
+	// on top of a withdrawal before it is confirmed. It defaults to
+	// DefaultConfirmations.
+	Confirmations uint64
+	// PollInterval is how often Run works through the queue. It defaults
+	// to DefaultPollInterval.
+	PollInterval time.Duration
+	// Clock dates withdrawals and paces Run. It defaults to the system
+	// clock.
+	Clock clock.Clock
+}
+
+// Withdrawals queues users' withdrawals of ether and tokens on the exchange
+// and sees them out: a request holds its amount at once, a worker signs and
+// broadcasts it in turn, and the amount leaves the ledger once the
+// transaction is confirmed, or goes back to the user if it fails. Its
+// methods are safe for concurrent use.
+type Withdrawals struct {
+	client        *Client
+	signer        Signer
+	exchange      *exchange.Exchange
+	from          Address
+	chainID       uint64
+	tokens        map[ledger.Asset]Token
+	confirmations uint64
+	interval      time.Duration
+	clock         clock.Clock
+
+	// processMu serializes Process, so nonces are taken one at a time
+	processMu sync.Mutex
+}
+
+// NewWithdrawals returns a withdrawal queue configured by cfg. Nothing goes
+// out until it is processed.
+func NewWithdrawals(cfg WithdrawalConfig) *Withdrawals {
+	if cfg.Confirmations == 0 {
+		cfg.Confirmations = DefaultConfirmations
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	tokens := map[ledger.Asset]Token{ether.Asset: ether}
+	for _, token := range cfg.Tokens {
+		tokens[token.Asset] = token
+	}
+	return &Withdrawals{
+		client:        cfg.Client,
+		signer:        cfg.Signer,
+		exchange:      cfg.Exchange,
+		from:          cfg.From,
+		chainID:       cfg.ChainID,
+		tokens:        tokens,
+		confirmations: cfg.Confirmations,
+		interval:      cfg.PollInterval,
+		clock:         cfg.Clock,
+	}
+}
+
+// Request queues a withdrawal of amount of user's asset to to, holding the
+// amount until it goes out. It returns ErrUnsupportedAsset for an asset
+// that is neither ether nor a configured token, and
+// ledger.ErrInsufficientFunds if user doesn't have that much free.
+func (w *Withdrawals) Request(user uint64, asset ledger.Asset, to Address, amount float64) (exchange.Withdrawal, error) {
+	token, ok := w.tokens[asset]
+	if !ok {
+		return exchange.Withdrawal{}, fmt.Errorf("%w: %s", ErrUnsupportedAsset, asset)
+	}
+	if _, ok := token.fromLedger(amount); !ok {
+		return exchange.Withdrawal{}, fmt.Errorf("%w: %s has %d decimals", ledger.ErrInvalidAmount, asset, token.Decimals)
+	}
+	wd, err := w.exchange.RequestWithdrawal(user, asset, string(to), amount)
+	if err != nil {
+		return exchange.Withdrawal{}, err
+	}
+	slog.Info("withdrawal requested", "id", wd.ID, "user", user, "asset", asset, "amount", amount, "to", to)
+	return wd, nil
+}
+
+// Get returns user's withdrawal with id, or exchange.ErrWithdrawalNotFound.
+func (w *Withdrawals) Get(user, id uint64) (exchange.Withdrawal, error) {
+	return w.exchange.Withdrawal(user, id)
+}
+
+// List returns user's withdrawals, oldest first.
+func (w *Withdrawals) List(user uint64) []exchange.Withdrawal {
+	return w.exchange.UserWithdrawals(user)
+}
+
+// Run processes the queue until ctx is done.
+func (w *Withdrawals) Run(ctx context.Context) {
+	for {
+		if err := w.Process(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("withdrawal processing failed", "error", err)
+		}
+		timer := w.clock.NewTimer(w.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Process broadcasts the pending withdrawals in the order they were
+// requested, then settles the broadcast ones that have been mined deep
+// enough. A withdrawal the signer or the node refuses fails; one that
+// couldn't be sent for any other reason, such as the node being down, stays
+// pending and stops the rest until the next run, so nonces stay in order.
+// Each step is kept by the exchange as it is taken, so a restart picks up
+// the queue, and the transactions in flight, where they were.
+func (w *Withdrawals) Process(ctx context.Context) error {
+	w.processMu.Lock()
+	defer w.processMu.Unlock()
+
+	var inFlight []exchange.Withdrawal
+	for _, wd := range w.exchange.OutstandingWithdrawals() {
+		if wd.Status == exchange.WithdrawalBroadcast {
+			inFlight = append(inFlight, wd)
+			continue
+		}
+
+		hash, err := w.broadcast(ctx, wd)
+		var refused *RPCError
+		if err != nil && !errors.As(err, &refused) {
+			return fmt.Errorf("withdrawal %d: %w", wd.ID, err)
+		}
+		if err != nil {
+			w.fail(wd, err)
+			continue
+		}
+		broadcast, err := w.exchange.UpdateWithdrawal(exchange.WithdrawalUpdate{ID: wd.ID, Status: exchange.WithdrawalBroadcast, TxHash: hash})
+		if err != nil {
+			// it has gone out, but would go out again on the next run
+			slog.Error("broadcast withdrawal not recorded", "id", wd.ID, "tx", hash, "error", err)
+			return fmt.Errorf("withdrawal %d: %w", wd.ID, err)
+		}
+		inFlight = append(inFlight, broadcast)
+	}
+	return w.confirm(ctx, inFlight)
+}
+
+// broadcast signs and sends wd from the exchange's wallet: ether directly,
+// a token by calling its contract.
+func (w *Withdrawals) broadcast(ctx context.Context, wd exchange.Withdrawal) (string, error) {
+	token := w.tokens[wd.Asset]
+	raw, _ := token.fromLedger(wd.Amount)
+	tx := token.transferTx(w.from, Address(wd.To), raw, w.chainID)
+
+	var err error
+	if tx.Nonce, err = w.client.PendingNonce(ctx, w.from); err != nil {
+		return "", err
+	}
+	if tx.GasPrice, err = w.client.GasPrice(ctx); err != nil {
+		return "", err
+	}
+	signed, err := w.signer.SignTransaction(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	hash, err := w.client.SendRawTransaction(ctx, signed)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("withdrawal broadcast", "id", wd.ID, "tx", hash, "nonce", tx.Nonce)
+	return hash, nil
+}
+
+// confirm settles the broadcast withdrawals mined at least Confirmations
+// deep: a successful one leaves the ledger, a reverted one is released.
+func (w *Withdrawals) confirm(ctx context.Context, inFlight []exchange.Withdrawal) error {
+	if len(inFlight) == 0 {
+		return nil
+	}
+
+	head, err := w.client.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	for _, wd := range inFlight {
+		receipt, mined, err := w.client.TransactionReceipt(ctx, wd.TxHash)
+		if err != nil {
+			return err
+		}
+		if !mined || head+1 < receipt.Block+w.confirmations {
+			continue
+		}
+
+		if !receipt.Success {
+			w.fail(wd, errors.New("transaction reverted"))
+			continue
+		}
+		if _, err := w.exchange.UpdateWithdrawal(exchange.WithdrawalUpdate{ID: wd.ID, Status: exchange.WithdrawalConfirmed}); err != nil {
+			return fmt.Errorf("withdrawal %d: %w", wd.ID, err)
+		}
+		slog.Info("withdrawal confirmed", "id", wd.ID, "tx", wd.TxHash, "block", receipt.Block)
+	}
+	return nil
+}
+
+// fail marks wd failed, which gives its amount back.
+func (w *Withdrawals) fail(wd exchange.Withdrawal, err error) {
+	update := exchange.WithdrawalUpdate{ID: wd.ID, Status: exchange.WithdrawalFailed, Error: err.Error()}
+	if _, updateErr := w.exchange.UpdateWithdrawal(update); updateErr != nil {
+		slog.Error("failed withdrawal not recorded", "id", wd.ID, "error", updateErr)
+		return
+	}
+	slog.Warn("withdrawal failed", "id", wd.ID, "error", err)
+}
@@ -0,0 +1,152 @@
+// Package clock puts time behind an interface so the order book and the
+// exchange can be driven by a fake clock in tests instead of sleeping.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and schedules work against it.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer that sends the time on its channel once d
+	// has passed.
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f once d has passed. The returned timer's channel is
+	// nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending event scheduled on a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It reports false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// Real returns the system clock.
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Fake is a Clock that only moves when told to. Timers fire, in deadline
+// order, from within Advance; AfterFunc callbacks run synchronously on the
+// goroutine calling Advance.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake returns a fake clock reading now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.schedule(d, nil)
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return f.schedule(d, fn)
+}
+
+func (f *Fake) schedule(d time.Duration, fn func()) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{clock: f, deadline: f.now.Add(d), fn: fn}
+	if fn == nil {
+		t.c = make(chan time.Time, 1)
+	}
+	f.timers = append(f.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that comes due on
+// the way with the clock set to its deadline.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	f.mu.Unlock()
+
+	for {
+		f.mu.Lock()
+		sort.SliceStable(f.timers, func(i, j int) bool {
+			return f.timers[i].deadline.Before(f.timers[j].deadline)
+		})
+		if len(f.timers) == 0 || f.timers[0].deadline.After(end) {
+			f.now = end
+			f.mu.Unlock()
+			return
+		}
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		f.now = t.deadline
+		f.mu.Unlock()
+
+		// fire outside the lock: callbacks may read the clock or schedule
+		// more timers
+		if t.fn != nil {
+			t.fn()
+		} else {
+			t.c <- t.deadline
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	deadline time.Time
+	fn       func()
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeFiresTimersInOrder(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := NewFake(start)
+
+	var fired []time.Duration
+	clk.AfterFunc(20*time.Millisecond, func() {
+		fired = append(fired, clk.Now().Sub(start))
+	})
+	timer := clk.NewTimer(10 * time.Millisecond)
+	stopped := clk.AfterFunc(15*time.Millisecond, func() {
+		t.Fatal("stopped timer fired")
+	})
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Stop should only succeed once")
+	}
+
+	clk.Advance(10 * time.Millisecond)
+	select {
+	case at := <-timer.C():
+		if !at.Equal(start.Add(10 * time.Millisecond)) {
+			t.Fatalf("timer fired at %v", at)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	if len(fired) != 0 {
+		t.Fatal("callback fired early")
+	}
+
+	clk.Advance(time.Second)
+	if len(fired) != 1 || fired[0] != 20*time.Millisecond {
+		t.Fatalf("expected the callback to see its deadline, got %v", fired)
+	}
+	if got := clk.Now().Sub(start); got != time.Second+10*time.Millisecond {
+		t.Fatalf("clock at %v after advancing", got)
+	}
+	if timer.Stop() {
+		t.Fatal("Stop succeeded on a fired timer")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/chain"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// withDepositWatcher serves deposit addresses and history from w. Without
+// it the deposit routes aren't registered.
+func withDepositWatcher(w *chain.Watcher) serverOption {
+	return func(s *server) {
+		s.deposits = w
+	}
+}
+
+// handleGetDepositAddress returns the caller's address for depositing
+// ether, assigning one the first time.
+func (s *server) handleGetDepositAddress(c echo.Context) error {
+	address, err := s.deposits.Address(callerID(c))
+	if errors.Is(err, chain.ErrNoAddresses) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"asset":         ledger.ETH,
+		"address":       address,
+		"confirmations": s.deposits.Confirmations(),
+	})
+}
+
+// handleGetDeposits lists the deposits credited to the caller.
+func (s *server) handleGetDeposits(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"deposits": s.deposits.Deposits(callerID(c)),
+	})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/fix"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/remote"
+	"github.com/thenaveensharma/exchange/user"
+	"google.golang.org/grpc"
+)
+
+// engine is the matching engine a server serves: the exchange itself, or a
+// remote.Client for one running in another process.
+type engine interface {
+	PlaceOrder(ctx context.Context, req exchange.PlaceOrderRequest) (exchange.ExecutionReport, error)
+	ModifyOrder(ctx context.Context, user, id uint64, req exchange.ModifyRequest) (exchange.ExecutionReport, error)
+	ReduceOrder(ctx context.Context, user, id uint64, req exchange.ReduceRequest) (exchange.OrderReduce, error)
+	Cancel(ctx context.Context, req exchange.CancelRequest) (exchange.CancelResult, error)
+	CancelOrder(ctx context.Context, user, id uint64) (exchange.OrderCancel, error)
+	CancelOrderByClientID(ctx context.Context, user uint64, clientOrderID string) (exchange.OrderCancel, error)
+	Order(user, id uint64) (exchange.OrderRecord, error)
+	OrderByClientID(user uint64, clientOrderID string) (exchange.OrderRecord, error)
+	UserOrders(user uint64) []exchange.OrderRecord
+	Fills(user uint64) []exchange.Fill
+	UserTrades(user uint64, market exchange.Market, after uint64, limit int) ([]exchange.UserTrade, error)
+	Positions(user uint64) []exchange.Position
+	Balances(user uint64) map[ledger.Asset]float64
+	Held(user uint64) map[ledger.Asset]float64
+	Statement(user uint64) []ledger.Line
+	Deposit(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error)
+	Withdraw(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error)
+	Transfer(req exchange.TransferRequest) (exchange.Transfer, error)
+	Fees() exchange.FeeReport
+	WithdrawFees(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error)
+
+	Markets() []exchange.Market
+	Sandbox() bool
+	Ready() bool
+	SetReady(ready bool)
+	Book(market exchange.Market, asks, bids []exchange.Order) (exchange.OrderbookData, error)
+	GetDepth(market exchange.Market, depth int) (exchange.MarketDepth, error)
+	RecentTrades(market exchange.Market, limit int) ([]exchange.FeedMessage, error)
+	GetDepths(markets []exchange.Market, depth int) []exchange.MarketDepth
+	LevelQueue(market exchange.Market, side orderbook.Side, price orderbook.Price) ([]exchange.QueuedOrder, error)
+	Ticker(market exchange.Market) (exchange.Ticker, error)
+	Assets(market exchange.Market) (exchange.MarketAssets, error)
+	Increments(market exchange.Market) (exchange.Increments, error)
+	Limits(market exchange.Market) (exchange.MarketConfig, error)
+	PatchLimits(market exchange.Market, patch exchange.LimitsPatch) (exchange.MarketConfig, error)
+	UserLimits(user uint64) exchange.UserLimits
+	SetUserLimits(user uint64, limits exchange.UserLimits) (exchange.UserLimits, error)
+	SuspendUser(ctx context.Context, user uint64, cancel bool) ([]exchange.OrderCancel, error)
+	ResumeUser(user uint64) error
+	FreezeOrder(ctx context.Context, id uint64) (exchange.OrderRecord, error)
+	Quality(market exchange.Market, window time.Duration) (exchange.BookQuality, error)
+	Stats(market exchange.Market) (exchange.MarketStats, error)
+	Auction(market exchange.Market) (orderbook.AuctionState, error)
+	StartAuction(market exchange.Market) (orderbook.AuctionState, error)
+	ExecuteAuction(market exchange.Market) ([]exchange.AuctionFill, error)
+	Reset(market exchange.Market, clearStats bool) (int, uint64, error)
+	Export(market exchange.Market) (exchange.MarketExport, error)
+	Import(market exchange.Market, snapshot orderbook.Snapshot, replace bool) (exchange.ImportResult, error)
+	QueryAudit(q exchange.AuditQuery) ([]exchange.AuditRecord, error)
+	RejectInvalid(action exchange.AuditAction, market exchange.Market, raw []byte, err error) *exchange.Rejection
+	RejectMalformed(action exchange.AuditAction, raw []byte, err error) *exchange.Rejection
+	SandboxSeed(market exchange.Market, seed exchange.SeedRequest) (int, error)
+	SandboxReset() error
+	SandboxFaucet(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error)
+
+	Subscribe(market exchange.Market) (updates <-chan exchange.Ticker, unsubscribe func(), err error)
+	SubscribeFeed(market exchange.Market) (updates <-chan []exchange.FeedMessage, unsubscribe func(), err error)
+	SnapshotFeed(market exchange.Market) (snapshot []exchange.FeedMessage, seq uint64, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error)
+	ResumeFeed(market exchange.Market, since uint64) (resume exchange.FeedResume, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error)
+	ResumeTrades(market exchange.Market, after uint64) (missed []exchange.FeedMessage, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error)
+	SubscribeOrderUpdates(owner uint64) (updates <-chan []exchange.OrderUpdate, unsubscribe func())
+}
+
+// userStore is the users a server authenticates: a user.Registry, or the
+// engine's in another process.
+type userStore interface {
+	Register(name, pass string) (user.User, string, error)
+	Login(name, pass string) (user.User, error)
+	Authenticate(key string) (user.User, bool)
+	Get(id uint64) (user.User, error)
+	KeySettings(key string) (user.KeySettings, error)
+	SetKeySettings(key string, settings user.KeySettings) error
+}
+
+var (
+	_ engine    = (*exchange.Exchange)(nil)
+	_ engine    = (*remote.Client)(nil)
+	_ userStore = (*user.Registry)(nil)
+	_ userStore = (*remote.Users)(nil)
+)
+
+// withUsers has the server keep its users in users instead of a registry of
+// its own.
+func withUsers(users userStore) serverOption {
+	return func(s *server) {
+		s.users = users
+	}
+}
+
+// engineOnly are the settings of the process running the engine, which a
+// gateway has no use for.
+var engineOnly = []string{
+	"EXCHANGE_SANDBOX",
+	"EXCHANGE_ORDER_TIMEOUT",
+	"EXCHANGE_MARKET_ASSETS",
+	"EXCHANGE_MARKETS",
+	"EXCHANGE_SHARD_ID",
+	"EXCHANGE_ENGINE_LISTEN_ADDR",
+	"EXCHANGE_WAL_PATH",
+	"EXCHANGE_SNAPSHOT_PATH",
+	"EXCHANGE_SNAPSHOT_RETAIN",
+	"EXCHANGE_RAFT_ID",
+	"EXCHANGE_KAFKA_BROKERS",
+	"EXCHANGE_NATS_URL",
+	"EXCHANGE_WARMUP_URL",
+	"EXCHANGE_ETH_RPC_URL",
+	"EXCHANGE_ETH_SIGNER_URL",
+	"EXCHANGE_ETH_COLD_WALLET",
+	"EXCHANGE_ETH_SETTLE_ON_CHAIN",
+	"EXCHANGE_MULTICAST_ADDR",
+}
+
+// runGateway serves the HTTP, WebSocket, gRPC and FIX APIs of the engines at
+// addrs, which serve them on EXCHANGE_ENGINE_LISTEN_ADDR, until the process
+// is signalled. A gateway keeps nothing of its own, so any number can share
+// engines, started and stopped as load requires; they must share their
+// EXCHANGE_SESSION_SECRET for sessions to carry between them. The on-chain
+// routes are only served by an engine's process.
+//
+// Given several engines, each running its own EXCHANGE_MARKETS under its
+// own EXCHANGE_SHARD_ID, the gateway routes each market's requests to its
+// engine. Users are kept by the first.
+func runGateway(addrs []string, adminKey string, opts []serverOption) {
+	for _, name := range engineOnly {
+		if os.Getenv(name) != "" {
+			slog.Error(name+" is the engine's setting, and can't be used with EXCHANGE_ENGINE_ADDR", "value", os.Getenv(name))
+			os.Exit(1)
+		}
+	}
+	clients := make([]*remote.Client, 0, len(addrs))
+	for _, addr := range addrs {
+		dialCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		client, err := remote.Dial(dialCtx, addr)
+		cancel()
+		if err != nil {
+			slog.Error("failed to reach engine", "addr", addr, "error", err)
+			os.Exit(1)
+		}
+		defer client.Close()
+		slog.Info("serving engine", "addr", addr, "markets", client.Markets())
+		clients = append(clients, client)
+	}
+	var ex engine = clients[0]
+	if len(clients) > 1 {
+		engines := make([]engine, len(clients))
+		for i, client := range clients {
+			engines[i] = client
+		}
+		r, err := newRouter(engines)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_ENGINE_ADDR", "error", err)
+			os.Exit(1)
+		}
+		ex = r
+	}
+
+	api, apiOpts := newAPIServers()
+	opts = append(opts, apiOpts...)
+	opts = append(opts, withUsers(clients[0].Users()))
+	// the engines record order history; gateways only read it
+	history := openHistory()
+	if history != nil {
+		defer history.Close()
+		opts = append(opts, withHistory(history))
+	}
+	// and the books they cache
+	if depth := openDepthCache(); depth != nil {
+		defer depth.Close()
+		opts = append(opts, withDepthCache(depth))
+	}
+	e := newServer(ex, adminKey, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveHTTP(e, stop)
+	api.serve(stop)
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down server", "error", err)
+	}
+	api.shutdown(shutdownCtx)
+}
+
+// serveHTTP starts e on :3000, calling stop if it can't.
+func serveHTTP(e *echo.Echo, stop func()) {
+	go func() {
+		if err := e.Start(":3000"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to start server", "error", err)
+			stop()
+		}
+	}()
+}
+
+// apiServers are the APIs served besides HTTP, each only if its address is
+// set: gRPC on EXCHANGE_GRPC_ADDR and FIX order entry on EXCHANGE_FIX_ADDR.
+type apiServers struct {
+	grpc     *grpc.Server
+	grpcAddr string
+	fix      *fix.Acceptor
+	fixAddr  string
+}
+
+// newAPIServers sets up the APIs configured, returning them and the
+// options to serve them with.
+func newAPIServers() (apiServers, []serverOption) {
+	var api apiServers
+	var opts []serverOption
+	if api.grpcAddr = os.Getenv("EXCHANGE_GRPC_ADDR"); api.grpcAddr != "" {
+		api.grpc = grpc.NewServer()
+		opts = append(opts, withGRPC(api.grpc))
+	}
+	if api.fixAddr = os.Getenv("EXCHANGE_FIX_ADDR"); api.fixAddr != "" {
+		api.fix = fix.NewAcceptor(fix.AcceptorConfig{CompID: os.Getenv("EXCHANGE_FIX_COMP_ID")})
+		opts = append(opts, withFIX(api.fix))
+	}
+	return api, opts
+}
+
+// serve starts the APIs, calling stop if one can't be.
+func (api apiServers) serve(stop func()) {
+	if api.grpc != nil {
+		serveGRPC(api.grpc, api.grpcAddr, "gRPC server", stop)
+	}
+	if api.fix != nil {
+		go func() {
+			lis, err := net.Listen("tcp", api.fixAddr)
+			if err == nil {
+				err = api.fix.Serve(lis)
+			}
+			if err != nil && !errors.Is(err, fix.ErrAcceptorClosed) {
+				slog.Error("failed to start FIX acceptor", "error", err)
+				stop()
+			}
+		}()
+	}
+}
+
+func (api apiServers) shutdown(ctx context.Context) {
+	if api.grpc != nil {
+		stopGRPC(ctx, api.grpc)
+	}
+	if api.fix != nil {
+		api.fix.Close()
+	}
+}
+
+// serveGRPC starts g on addr, calling stop if it can't.
+func serveGRPC(g *grpc.Server, addr, name string, stop func()) {
+	go func() {
+		lis, err := net.Listen("tcp", addr)
+		if err == nil {
+			err = g.Serve(lis)
+		}
+		if err != nil {
+			slog.Error("failed to start "+name, "error", err)
+			stop()
+		}
+	}()
+}
+
+// stopGRPC stops g once its calls finish. Streams only end when their
+// clients go, so they are cut off once ctx is done.
+func stopGRPC(ctx context.Context, g *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		g.Stop()
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "github.com/thenaveensharma/exchange/exchange"
+
+// eventTopic is where events of type t are published for downstream
+// systems: order events under prefix+".orders", fills under
+// prefix+".trades" and level changes under prefix+".book".
+func eventTopic(prefix string, t exchange.EventType) string {
+	switch t {
+	case exchange.EventFill:
+		return prefix + ".trades"
+	case exchange.EventLevelChanged:
+		return prefix + ".book"
+	default:
+		return prefix + ".orders"
+	}
+}
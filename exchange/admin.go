@@ -0,0 +1,407 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// Reset cancels every resting order in market through the normal
+// cancellation path, and its untriggered stops, releasing their holds.
+// clearStats also zeroes the book's trade-derived stats, as ResetStats does.
+// It returns how many orders were cancelled and the book's sequence number
+// afterwards.
+func (ex *Exchange) Reset(market Market, clearStats bool) (int, uint64, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ob.Lock()
+	defer ob.Unlock()
+	defer ex.begin()()
+
+	if rejection := ex.record(Command{Type: CommandReset, Market: market, ClearStats: clearStats}); rejection != nil {
+		return 0, 0, rejection
+	}
+	cancelled := ob.Reset()
+	stops := ex.stops[market].clear()
+	if clearStats {
+		ob.ResetStats()
+	}
+	sequence := ob.Sequence()
+	ex.events.Publish(ex.resetEvents(market, ob, cancelled, stops))
+	slog.Info("market reset", "market", market, "cancelled", len(cancelled), "stops", len(stops), "clearStats", clearStats)
+
+	return len(cancelled) + len(stops), sequence, nil
+}
+
+// Auction reports market's auction state and, while it is in one, the
+// indicative uncrossing price and volume.
+func (ex *Exchange) Auction(market Market) (orderbook.AuctionState, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return orderbook.AuctionState{}, err
+	}
+
+	ob.RLock()
+	defer ob.RUnlock()
+
+	return ob.IndicativeAuction(), nil
+}
+
+// StartAuction puts market into a call auction: limit orders rest without
+// matching and market orders are refused until ExecuteAuction.
+func (ex *Exchange) StartAuction(market Market) (orderbook.AuctionState, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return orderbook.AuctionState{}, err
+	}
+
+	ob.Lock()
+	defer ob.Unlock()
+	defer ex.begin()()
+
+	if rejection := ex.record(Command{Type: CommandStartAuction, Market: market}); rejection != nil {
+		return orderbook.AuctionState{}, rejection
+	}
+	ob.StartAuction()
+	slog.Info("market entered auction", "market", market)
+
+	return ob.IndicativeAuction(), nil
+}
+
+// AuctionFill is one execution of an auction uncross.
+type AuctionFill struct {
+	Price orderbook.Price `json:"price"`
+	Size  orderbook.Size  `json:"size"`
+}
+
+// ExecuteAuction uncrosses market at its indicative price and returns it to
+// continuous trading.
+func (ex *Exchange) ExecuteAuction(market Market) ([]AuctionFill, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return nil, err
+	}
+
+	ob.Lock()
+	end := ex.begin()
+	if rejection := ex.record(Command{Type: CommandExecuteAuction, Market: market}); rejection != nil {
+		end()
+		ob.Unlock()
+		return nil, rejection
+	}
+	matches, err := ob.ExecuteAuction()
+	if err == nil {
+		ex.events.Publish(ex.auctionEvents(market, ob, matches))
+		ex.fireStops(market, ob)
+		ex.trimReduceOnly(market, ob)
+	}
+	end()
+	ob.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	fills := make([]AuctionFill, len(matches))
+	var volume orderbook.Size
+	for i, match := range matches {
+		fills[i] = AuctionFill{Price: match.Price, Size: match.SizeFilled}
+		volume += match.SizeFilled
+	}
+	slog.Info("auction executed", "market", market, "fills", len(fills), "volume", volume)
+
+	return fills, nil
+}
+
+// Export serializes market's book.
+func (ex *Exchange) Export(market Market) (MarketExport, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return MarketExport{}, err
+	}
+
+	ob.RLock()
+	defer ob.RUnlock()
+
+	return MarketExport{Snapshot: ob.Export(), Checksum: ob.Checksum()}, nil
+}
+
+// MarketExport is a serialized book with the checksum of the book it was
+// taken from, taken under the same lock, so an importer can tell its copy
+// rests exactly the same orders.
+type MarketExport struct {
+	orderbook.Snapshot
+	Checksum uint32 `json:"checksum"`
+}
+
+// ImportResult identifies the book an Import left behind.
+type ImportResult struct {
+	Sequence uint64 `json:"sequence"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// Import loads a serialized book into market, its orders holding their
+// owners' funds and claiming their client order IDs as if placed. A market
+// with resting orders is refused with ErrMarketNotEmpty unless replace is
+// set, which resets it through the normal cancellation path first, as Reset
+// does. A snapshot is refused whole if any of its orders couldn't have been
+// placed for their owner: see checkImport.
+func (ex *Exchange) Import(market Market, snapshot orderbook.Snapshot, replace bool) (ImportResult, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	if err := snapshot.Validate(); err != nil {
+		return ImportResult{}, err
+	}
+
+	ob.Lock()
+	defer ob.Unlock()
+	defer ex.begin()()
+
+	resting := len(ob.Asks()) > 0 || len(ob.Bids()) > 0
+	if resting && !replace {
+		return ImportResult{}, ErrMarketNotEmpty
+	}
+	if err := ex.checkImport(market, snapshot, resting); err != nil {
+		return ImportResult{}, err
+	}
+	if rejection := ex.record(Command{Type: CommandImport, Market: market, Snapshot: &snapshot, Replace: replace}); rejection != nil {
+		return ImportResult{}, rejection
+	}
+	if resting {
+		cancelled := ob.Reset()
+		stops := ex.stops[market].clear()
+		ex.events.Publish(ex.resetEvents(market, ob, cancelled, stops))
+	}
+	if err := ob.Import(snapshot); err != nil {
+		return ImportResult{}, err
+	}
+	ex.bookReplaced(market)
+	for _, limits := range [][]*orderbook.Limit{ob.Asks(), ob.Bids()} {
+		for _, limit := range limits {
+			for _, o := range limit.Orders {
+				if o.ClientOrderID != "" {
+					ex.clientOrders.claim(o.Owner, o.ClientOrderID, o.ID)
+				}
+			}
+		}
+	}
+	slog.Info("market imported", "market", market, "sequence", ob.Sequence())
+
+	return ImportResult{Sequence: ob.Sequence(), Checksum: ob.Checksum()}, nil
+}
+
+// checkImport refuses snapshot unless market could take its orders as
+// placed: anonymous ones only if the exchange takes anonymous orders, and
+// each user's only if they have the funds free to hold for them and their
+// client order IDs aren't taken by other orders. With replacing, what
+// market's orders and stops hold now counts as free, as they are cancelled
+// first. The caller holds the book's lock.
+func (ex *Exchange) checkImport(market Market, snapshot orderbook.Snapshot, replacing bool) error {
+	type funds struct {
+		owner uint64
+		asset ledger.Asset
+	}
+	holds := ex.holds[market]
+	needed := make(map[funds]float64)
+	clientIDs := make(map[clientOrderKey]bool)
+	for _, side := range []struct {
+		bid    bool
+		levels []orderbook.SnapshotLevel
+	}{{false, snapshot.Asks}, {true, snapshot.Bids}} {
+		for _, level := range side.levels {
+			for _, o := range level.Orders {
+				if o.Owner == 0 && !ex.anonymous {
+					return &Rejection{
+						Msg:  "orders must be placed by a user with the balance to back them",
+						Code: "INSUFFICIENT_FUNDS",
+					}
+				}
+				if o.ClientOrderID != "" {
+					key := clientOrderKey{o.Owner, o.ClientOrderID}
+					holder, taken := ex.clientOrders.lookup(o.Owner, o.ClientOrderID)
+					if clientIDs[key] || taken && holder != o.ID {
+						return &Rejection{
+							Msg:  fmt.Sprintf("clientOrderId %q is already in use", o.ClientOrderID),
+							Code: "DUPLICATE_CLIENT_ORDER_ID",
+						}
+					}
+					clientIDs[key] = true
+				}
+				if o.Owner != 0 {
+					order := orderbook.Order{Bid: side.bid, Price: level.Price, Size: o.Size, Hidden: o.Hidden}
+					needed[funds{o.Owner, holds.asset(side.bid)}] += holds.restingHold(&order)
+				}
+			}
+		}
+	}
+	for f, amount := range needed {
+		free := ex.ledger.Balance(ledger.UserAccount(f.owner), f.asset)
+		if replacing {
+			for _, h := range holds.held {
+				if h.owner == f.owner && holds.asset(h.bid) == f.asset {
+					free += h.amount
+				}
+			}
+		}
+		if ledger.Round(amount) > ledger.Round(free) {
+			return &Rejection{
+				Msg:  fmt.Sprintf("insufficient %s for user %d's orders: %.8g needed, %.8g free", f.asset, f.owner, amount, free),
+				Code: "INSUFFICIENT_FUNDS",
+			}
+		}
+	}
+	return nil
+}
+
+// MarketStats is a market's book load alongside the limits it trades under,
+// the load of the exchange's shared worker pool and its feed history.
+type MarketStats struct {
+	orderbook.Stats
+	Limits MarketConfig `json:"limits"`
+	Pool   PoolStats    `json:"pool"`
+	Feed   FeedStats    `json:"feed"`
+}
+
+// Stats reports market's book load and limits.
+func (ex *Exchange) Stats(market Market) (MarketStats, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return MarketStats{}, err
+	}
+
+	ob.RLock()
+	stats := ob.Stats()
+	ob.RUnlock()
+
+	return MarketStats{Stats: stats, Limits: ex.marketConfig(market), Pool: ex.events.pool.Stats(), Feed: ex.feeds[market].Stats()}, nil
+}
+
+// SeedRequest describes a ladder of resting orders: Levels prices on each
+// side, Step apart, starting one step away from Mid, each with Size.
+type SeedRequest struct {
+	Mid    orderbook.Price `json:"mid"`
+	Step   orderbook.Price `json:"step"`
+	Levels int             `json:"levels"`
+	Size   orderbook.Size  `json:"size"`
+}
+
+// SandboxLiquidityUser owns the orders SandboxSeed places. No registered
+// user is given its ID.
+const SandboxLiquidityUser uint64 = math.MaxUint64
+
+// SandboxSeed fills market with the ladder seed describes, owned by
+// SandboxLiquidityUser, and returns the number of orders placed. The
+// faucet funds each order, which is then placed like any other, so users
+// trade against it as against each other, and one it crosses on its way in
+// is filled. It needs sandbox mode, and stops at the first order refused.
+func (ex *Exchange) SandboxSeed(market Market, seed SeedRequest) (int, error) {
+	if !ex.sandbox {
+		return 0, ErrSandboxDisabled
+	}
+	assets, err := ex.Assets(market)
+	if err != nil {
+		return 0, err
+	}
+	if seed.Mid <= 0 || seed.Step <= 0 || seed.Levels <= 0 || seed.Size <= 0 || seed.Mid-orderbook.Price(seed.Levels)*seed.Step <= 0 {
+		return 0, errors.New("mid, step, levels and size must be positive and the ladder must stay above zero")
+	}
+
+	holds := ex.holds[market]
+	placed := 0
+	for i := 1; i <= seed.Levels; i++ {
+		offset := orderbook.Price(i) * seed.Step
+		for _, rung := range []PlaceOrderRequest{
+			{Type: LimitOrder, Bid: false, Size: seed.Size, Price: seed.Mid + offset},
+			{Type: LimitOrder, Bid: true, Size: seed.Size, Price: seed.Mid - offset},
+		} {
+			rung.Market, rung.User = market, SandboxLiquidityUser
+			asset, amount := assets.Base, holds.scale.SizeValue(rung.Size)
+			if rung.Bid {
+				asset, amount = assets.Quote, holds.notionalUp(rung.Price, rung.Size)
+			}
+			if _, err := ex.SandboxFaucet(SandboxLiquidityUser, asset, amount); err != nil {
+				return placed, err
+			}
+			if _, err := ex.placeOrder(context.Background(), rung, 0); err != nil {
+				return placed, err
+			}
+			placed++
+		}
+	}
+	slog.Info("sandbox market seeded", "market", market, "levels", seed.Levels)
+
+	return placed, nil
+}
+
+// SandboxReset cancels every resting order and stop in every market, zeroes
+// the books' counters and forgets their trades, then returns every balance to
+// ledger.External, leaving nothing held. It needs sandbox mode.
+func (ex *Exchange) SandboxReset() error {
+	if !ex.sandbox {
+		return ErrSandboxDisabled
+	}
+	// every book stays locked until the balances are gone, so no order
+	// comes to hold what is about to be taken away
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.Lock()
+		defer ob.Unlock()
+	}
+	for _, market := range ex.markets {
+		end := ex.begin()
+		rejection := ex.record(Command{Type: CommandSandboxReset, Market: market})
+		if rejection == nil {
+			ex.resetSandbox(market)
+		}
+		end()
+		if rejection != nil {
+			return rejection
+		}
+	}
+	// recorded without a market, for the balances
+	end := ex.begin()
+	defer end()
+	if rejection := ex.record(Command{Type: CommandSandboxReset}); rejection != nil {
+		return rejection
+	}
+	if _, err := ex.ledger.Reset(); err != nil {
+		return err
+	}
+	slog.Info("sandbox reset")
+	return nil
+}
+
+// resetSandbox cancels every resting order and stop in market through the
+// normal cancellation path, as Reset does, releasing their holds, and
+// zeroes its book's counters and forgets its recent trades. The caller
+// holds the book's lock.
+func (ex *Exchange) resetSandbox(market Market) {
+	ob := ex.orderbooks[market]
+	cancelled := ob.Reset()
+	stops := ex.stops[market].clear()
+	ob.ResetStats()
+	ex.feeds[market].ForgetTrades()
+	ex.events.Publish(ex.resetEvents(market, ob, cancelled, stops))
+}
+
+// SandboxFaucet credits user with amount of asset from ledger.External, as
+// a deposit would, so sandbox users can trade without funding. It needs
+// sandbox mode.
+func (ex *Exchange) SandboxFaucet(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	if !ex.sandbox {
+		return ledger.Entry{}, ErrSandboxDisabled
+	}
+	if user == 0 {
+		return ledger.Entry{}, errors.New("the faucet needs a user to credit")
+	}
+	return ex.Deposit(user, asset, amount)
+}
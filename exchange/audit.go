@@ -0,0 +1,193 @@
+package exchange
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// AuditAction is the kind of order entry request an audit record is for.
+type AuditAction string
+
+const (
+	AuditPlace  AuditAction = "PLACE"
+	AuditCancel AuditAction = "CANCEL"
+	AuditModify AuditAction = "MODIFY"
+	AuditReduce AuditAction = "REDUCE"
+)
+
+// AuditResult is whether an audited request was applied.
+type AuditResult string
+
+const (
+	AuditAccepted AuditResult = "accepted"
+	AuditRejected AuditResult = "rejected"
+)
+
+// AuditRecord is one order entry attempt, kept whether or not it reached the
+// book. Request is the request as it was decoded, or as the client sent it
+// when it couldn't be; Seq is the book's sequence number after an accepted
+// request was applied. OrderID is the order the request was for, or the one
+// it placed, once known.
+type AuditRecord struct {
+	Timestamp int64           `json:"timestamp"`
+	Action    AuditAction     `json:"action"`
+	Market    Market          `json:"market"`
+	User      uint64          `json:"user,omitempty"`
+	OrderID   uint64          `json:"orderId,omitempty"`
+	Request   json.RawMessage `json:"request"`
+	Result    AuditResult     `json:"result"`
+	Code      string          `json:"code,omitempty"`
+	Msg       string          `json:"msg,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+}
+
+// AuditQuery selects records; zero fields match everything. From and To are
+// inclusive unix nanosecond bounds.
+type AuditQuery struct {
+	Market Market
+	User   uint64
+	Action AuditAction
+	Result AuditResult
+	From   int64
+	To     int64
+}
+
+func (q AuditQuery) match(r AuditRecord) bool {
+	return (q.Market == "" || r.Market == q.Market) &&
+		(q.User == 0 || r.User == q.User) &&
+		(q.Action == "" || r.Action == q.Action) &&
+		(q.Result == "" || r.Result == q.Result) &&
+		(q.From == 0 || r.Timestamp >= q.From) &&
+		(q.To == 0 || r.Timestamp <= q.To)
+}
+
+// AuditStore persists audit records. Append is only called from the audit
+// log's writer goroutine and must not keep the slice it is given; Query may be
+// called concurrently with it.
+type AuditStore interface {
+	Append(records []AuditRecord) error
+	Query(q AuditQuery) ([]AuditRecord, error)
+}
+
+// MemoryAuditStore keeps records for the life of the process.
+type MemoryAuditStore struct {
+	mu      sync.RWMutex
+	records []AuditRecord
+}
+
+// NewMemoryAuditStore returns an empty in-memory store. It is what an
+// Exchange uses unless Config.AuditStore says otherwise.
+func NewMemoryAuditStore() *MemoryAuditStore {
+	return &MemoryAuditStore{}
+}
+
+func (s *MemoryAuditStore) Append(records []AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *MemoryAuditStore) Query(q AuditQuery) ([]AuditRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := []AuditRecord{}
+	for _, r := range s.records {
+		if q.match(r) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+const auditQueueSize = 1024
+
+// auditLog writes records to its store off the request path. Writes are
+// queued and batched by a single goroutine; a full queue makes Write wait
+// rather than lose a record.
+type auditLog struct {
+	store AuditStore
+	queue chan auditOp
+	done  chan struct{}
+	// paused drops records while replayed commands, already in the trail,
+	// are applied
+	paused atomic.Bool
+}
+
+// auditOp is either a record to write or, with flushed set, a request to be
+// told once everything queued before it is stored.
+type auditOp struct {
+	record  AuditRecord
+	flushed chan struct{}
+}
+
+func newAuditLog(store AuditStore) *auditLog {
+	l := &auditLog{
+		store: store,
+		queue: make(chan auditOp, auditQueueSize),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *auditLog) run() {
+	defer close(l.done)
+
+	var batch []AuditRecord
+	store := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := l.store.Append(batch); err != nil {
+			slog.Error("failed to store audit records", "count", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for op := range l.queue {
+		if op.flushed != nil {
+			store()
+			close(op.flushed)
+			continue
+		}
+		// a burst of writes is stored as one batch once the queue drains
+		batch = append(batch, op.record)
+		if len(l.queue) == 0 {
+			store()
+		}
+	}
+	store()
+}
+
+func (l *auditLog) Write(r AuditRecord) {
+	if l.paused.Load() {
+		return
+	}
+	l.queue <- auditOp{record: r}
+}
+
+// Flush waits until every record written before it is in the store.
+func (l *auditLog) Flush() {
+	flushed := make(chan struct{})
+	l.queue <- auditOp{flushed: flushed}
+	<-flushed
+}
+
+// Close stores whatever is still queued and stops the writer. Nothing may be
+// written after it.
+func (l *auditLog) Close() {
+	close(l.queue)
+	<-l.done
+}
+
+// QueryAudit returns the audit records q matches, including every attempt
+// that has been answered so far.
+func (ex *Exchange) QueryAudit(q AuditQuery) ([]AuditRecord, error) {
+	ex.audit.Flush()
+	return ex.audit.store.Query(q)
+}
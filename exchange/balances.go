@@ -0,0 +1,92 @@
+package exchange
+
+import "github.com/thenaveensharma/exchange/ledger"
+
+// MarketAssets are the assets a market trades: Base is bought and sold for
+// Quote. BaseToken and QuoteToken register the ERC-20 token behind either,
+// for assets that are deposited and withdrawn as one.
+type MarketAssets struct {
+	Base       ledger.Asset `json:"base"`
+	Quote      ledger.Asset `json:"quote"`
+	BaseToken  *Token       `json:"baseToken,omitempty"`
+	QuoteToken *Token       `json:"quoteToken,omitempty"`
+}
+
+// Token is an ERC-20 token: the address of its contract and how many
+// decimal places it counts amounts in.
+type Token struct {
+	Contract string `json:"contract"`
+	Decimals uint8  `json:"decimals"`
+}
+
+// DefaultAssets are the assets of the built-in markets. Other markets trade
+// the asset named like them for USD unless Config.Assets says otherwise.
+var DefaultAssets = map[Market]MarketAssets{
+	MarketEth: {Base: ledger.ETH, Quote: ledger.USD},
+	MarketBtc: {Base: ledger.BTC, Quote: ledger.USD},
+}
+
+// Assets returns the assets market trades.
+func (ex *Exchange) Assets(market Market) (MarketAssets, error) {
+	holds, ok := ex.holds[market]
+	if !ok {
+		return MarketAssets{}, ErrMarketNotFound
+	}
+	return holds.assets, nil
+}
+
+// Tokens returns the ERC-20 tokens the markets register, by asset.
+func (ex *Exchange) Tokens() map[ledger.Asset]Token {
+	tokens := make(map[ledger.Asset]Token)
+	for _, market := range ex.markets {
+		assets := ex.holds[market].assets
+		if assets.BaseToken != nil {
+			tokens[assets.Base] = *assets.BaseToken
+		}
+		if assets.QuoteToken != nil {
+			tokens[assets.Quote] = *assets.QuoteToken
+		}
+	}
+	return tokens
+}
+
+// Ledger returns the ledger holding users' balances, for moving funds in
+// and out of the exchange.
+func (ex *Exchange) Ledger() *ledger.Ledger {
+	return ex.ledger
+}
+
+// Balances returns what user has free to spend in each asset.
+func (ex *Exchange) Balances(user uint64) map[ledger.Asset]float64 {
+	return ex.ledger.Balances(ledger.UserAccount(user))
+}
+
+// Held returns what user's open orders hold in each asset.
+func (ex *Exchange) Held(user uint64) map[ledger.Asset]float64 {
+	return ex.ledger.Balances(ledger.HeldAccount(user))
+}
+
+// Statement returns what each of the ledger's entries changed of user's
+// free balances, oldest first: see ledger.Ledger.Statement.
+func (ex *Exchange) Statement(user uint64) []ledger.Line {
+	return ex.ledger.Statement(ledger.UserAccount(user))
+}
+
+// Deposit credits user with amount of asset brought onto the exchange.
+func (ex *Exchange) Deposit(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandDeposit, User: user, Asset: asset, Amount: amount}); rejection != nil {
+		return ledger.Entry{}, rejection
+	}
+	return ex.ledger.Deposit(user, asset, amount)
+}
+
+// Withdraw debits user with amount of asset taken off the exchange. It
+// returns ledger.ErrInsufficientFunds if user doesn't hold that much.
+func (ex *Exchange) Withdraw(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandWithdraw, User: user, Asset: asset, Amount: amount}); rejection != nil {
+		return ledger.Entry{}, rejection
+	}
+	return ex.ledger.Withdraw(user, asset, amount)
+}
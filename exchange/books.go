@@ -0,0 +1,142 @@
+package exchange
+
+import (
+	"time"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// BooksTimeout bounds how long GetDepths waits for any one market's snapshot
+// before answering with an error entry for it.
+const BooksTimeout = 250 * time.Millisecond
+
+// Level is an aggregated price level.
+type Level struct {
+	Price orderbook.Price `json:"price"`
+	Size  orderbook.Size  `json:"size"`
+}
+
+// MarketDepth is one market's aggregated top of book, or an error when its
+// snapshot couldn't be taken.
+type MarketDepth struct {
+	Market   Market  `json:"market"`
+	Sequence uint64  `json:"sequence,omitempty"`
+	Bids     []Level `json:"bids,omitempty"`
+	Asks     []Level `json:"asks,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func depthLevels(ob *orderbook.Orderbook, side orderbook.Side, depth int) []Level {
+	levels := make([]Level, 0, depth)
+	ob.WalkLimits(side, func(l orderbook.LimitView) bool {
+		levels = append(levels, Level{Price: l.Price, Size: l.TotalVolume})
+		return len(levels) < depth
+	})
+	return levels
+}
+
+// GetDepth returns market's top depth price levels on each side.
+func (ex *Exchange) GetDepth(market Market, depth int) (MarketDepth, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return MarketDepth{}, err
+	}
+
+	ob.RLock()
+	defer ob.RUnlock()
+
+	return marketDepth(market, ob, depth), nil
+}
+
+func marketDepth(market Market, ob *orderbook.Orderbook, depth int) MarketDepth {
+	return MarketDepth{
+		Market:   market,
+		Sequence: ob.Sequence(),
+		Bids:     depthLevels(ob, orderbook.SideBid, depth),
+		Asks:     depthLevels(ob, orderbook.SideAsk, depth),
+	}
+}
+
+// GetDepths snapshots the top of several markets concurrently. A market that
+// is unknown or doesn't answer within BooksTimeout gets an entry carrying
+// an error instead of holding up the rest.
+func (ex *Exchange) GetDepths(markets []Market, depth int) []MarketDepth {
+	results := make([]chan MarketDepth, len(markets))
+	for i, market := range markets {
+		results[i] = make(chan MarketDepth, 1)
+		ob, ok := ex.orderbooks[market]
+		if !ok {
+			results[i] <- MarketDepth{Market: market, Error: ErrMarketNotFound.Error()}
+			continue
+		}
+		go func(result chan<- MarketDepth) {
+			ob.RLock()
+			defer ob.RUnlock()
+			result <- marketDepth(market, ob, depth)
+		}(results[i])
+	}
+
+	timeout := ex.clock.NewTimer(BooksTimeout)
+	defer timeout.Stop()
+
+	books := make([]MarketDepth, len(markets))
+	expired := false
+	for i, result := range results {
+		if !expired {
+			select {
+			case books[i] = <-result:
+				continue
+			case <-timeout.C():
+				expired = true
+			}
+		}
+		// the deadline is shared, so once it passes later markets only get
+		// what is already there
+		select {
+		case books[i] = <-result:
+		default:
+			books[i] = MarketDepth{Market: markets[i], Error: "snapshot timed out"}
+		}
+	}
+	return books
+}
+
+// QueuedOrder is an order resting in a level's queue. Sequence is the time
+// it took its place, in unix nanoseconds, which is what orders the queue;
+// SizeAhead is what fills before it, see orderbook.QueueView.
+type QueuedOrder struct {
+	ID        uint64         `json:"id"`
+	Owner     uint64         `json:"owner,omitempty"`
+	Size      orderbook.Size `json:"size"`
+	Sequence  int64          `json:"sequence"`
+	Position  int            `json:"position"`
+	SizeAhead orderbook.Size `json:"sizeAhead"`
+	Frozen    bool           `json:"frozen,omitempty"`
+}
+
+// LevelQueue returns the orders resting on side of market at price in time
+// priority, empty if no level is there.
+func (ex *Exchange) LevelQueue(market Market, side orderbook.Side, price orderbook.Price) ([]QueuedOrder, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return nil, err
+	}
+
+	ob.RLock()
+	defer ob.RUnlock()
+
+	queue := []QueuedOrder{}
+	ob.WalkLevel(side, price, func(o orderbook.QueueView) bool {
+		queue = append(queue, QueuedOrder{
+			ID:        o.ID,
+			Owner:     o.Owner,
+			Size:      o.Size,
+			Sequence:  o.Timestamp,
+			Position:  o.Position,
+			SizeAhead: o.SizeAhead,
+			Frozen:    o.Frozen,
+		})
+		return true
+	})
+	return queue, nil
+}
@@ -0,0 +1,298 @@
+package exchange
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// Checkpoint is the exchange's state at one point in its journal, for
+// restoring it without replaying the journal from the start. Seq is the
+// number of the last command it includes; replaying the commands after it
+// on top of it brings the exchange up to date. What it leaves out, the
+// market statistics, tickers and feed histories, starts over.
+type Checkpoint struct {
+	Seq  uint64 `json:"seq"`
+	Time int64  `json:"time"`
+	// LastOrderID is the last order ID handed out, so none is given out
+	// twice
+	LastOrderID  uint64                      `json:"lastOrderId"`
+	Markets      map[Market]MarketCheckpoint `json:"markets"`
+	Ledger       ledger.State                `json:"ledger"`
+	ClientOrders []ClientOrderClaim          `json:"clientOrders,omitempty"`
+	UserLimits   map[uint64]UserLimits       `json:"userLimits,omitempty"`
+	Suspended    []uint64                    `json:"suspended,omitempty"`
+	Transfers    []Transfer                  `json:"transfers,omitempty"`
+	Withdrawals  []Withdrawal                `json:"withdrawals,omitempty"`
+	Deposits     DepositCheckpoint           `json:"deposits"`
+	Users        user.Snapshot               `json:"users"`
+}
+
+// MarketCheckpoint is one market's part of a Checkpoint. Orders are the
+// live orders' fill totals and timestamps, resting or waiting for their
+// stop price, and Finished the finished orders, oldest first. Trades is the
+// ID of the market's latest trade and LastPrice its price.
+type MarketCheckpoint struct {
+	Book     orderbook.State   `json:"book"`
+	Limits   MarketConfig      `json:"limits"`
+	Stops    []StopCheckpoint  `json:"stops,omitempty"`
+	Holds    []HoldCheckpoint  `json:"holds,omitempty"`
+	Orders   []OrderCheckpoint `json:"orders,omitempty"`
+	Finished []OrderRecord     `json:"finished,omitempty"`
+	Fills    map[uint64][]Fill `json:"fills,omitempty"`
+	Trades   uint64            `json:"trades,omitempty"`
+	// Fees is what the market's trades have paid in fees, in each asset
+	Fees      map[ledger.Asset]float64      `json:"fees,omitempty"`
+	Positions map[uint64]PositionCheckpoint `json:"positions,omitempty"`
+	LastPrice orderbook.Price               `json:"lastPrice,omitempty"`
+}
+
+// PositionCheckpoint is a user's position in the market as its history
+// keeps it: Entry in price units, unrounded, and Realized in price units
+// times size units.
+type PositionCheckpoint struct {
+	Size     orderbook.Size `json:"size"`
+	Entry    float64        `json:"entry"`
+	Realized float64        `json:"realized"`
+}
+
+// StopCheckpoint is a stop order waiting for its stop price.
+type StopCheckpoint struct {
+	Order               orderbook.Order     `json:"order"`
+	StopPrice           orderbook.Price     `json:"stopPrice"`
+	SelfTradePrevention SelfTradePrevention `json:"selfTradePrevention,omitempty"`
+}
+
+// HoldCheckpoint is what the order with OrderID holds of its owner's
+// balance.
+type HoldCheckpoint struct {
+	OrderID uint64  `json:"orderId"`
+	Owner   uint64  `json:"owner"`
+	Bid     bool    `json:"bid"`
+	Amount  float64 `json:"amount"`
+}
+
+// OrderCheckpoint is what the exchange keeps about a live order besides the
+// order itself.
+type OrderCheckpoint struct {
+	ID        uint64         `json:"id"`
+	Owner     uint64         `json:"owner,omitempty"`
+	CreatedAt int64          `json:"createdAt"`
+	UpdatedAt int64          `json:"updatedAt"`
+	Filled    orderbook.Size `json:"filled,omitempty"`
+	Notional  float64        `json:"notional,omitempty"`
+	// SelfTradePrevention is the resting order's mode, for amendments
+	SelfTradePrevention SelfTradePrevention `json:"selfTradePrevention,omitempty"`
+	ReduceOnly          bool                `json:"reduceOnly,omitempty"`
+}
+
+// ClientOrderClaim is a client order ID User gave the order with OrderID at
+// At, in unix nanoseconds.
+type ClientOrderClaim struct {
+	User          uint64 `json:"user,omitempty"`
+	ClientOrderID string `json:"clientOrderId"`
+	OrderID       uint64 `json:"orderId"`
+	At            int64  `json:"at"`
+}
+
+// Checkpoint takes a Checkpoint of the exchange. Every book is held still
+// while it does, and so is the journal, so the checkpoint is of the state
+// after one command and before the next.
+func (ex *Exchange) Checkpoint() Checkpoint {
+	ex.applyMu.Lock()
+	defer ex.applyMu.Unlock()
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.RLock()
+		defer ob.RUnlock()
+	}
+	ex.journalMu.Lock()
+	defer ex.journalMu.Unlock()
+
+	cp := Checkpoint{
+		Seq:          ex.journaled,
+		Time:         ex.clock.Now().UnixNano(),
+		LastOrderID:  orderbook.LastOrderID(),
+		Markets:      make(map[Market]MarketCheckpoint, len(ex.markets)),
+		Ledger:       ex.ledger.State(),
+		ClientOrders: ex.clientOrders.claims(),
+		Transfers:    ex.transfers.checkpoint(),
+		Withdrawals:  ex.withdrawals.checkpoint(),
+		Deposits:     ex.deposits.checkpoint(),
+		Users:        ex.users.Snapshot(),
+	}
+	ex.configMu.RLock()
+	if len(ex.userLimits) > 0 {
+		cp.UserLimits = maps.Clone(ex.userLimits)
+	}
+	for user := range ex.suspended {
+		cp.Suspended = append(cp.Suspended, user)
+	}
+	slices.Sort(cp.Suspended)
+	ex.configMu.RUnlock()
+	for _, market := range ex.markets {
+		cp.Markets[market] = ex.checkpointMarket(market)
+	}
+	return cp
+}
+
+// checkpointMarket takes market's part of a Checkpoint. The caller holds
+// the book's lock.
+func (ex *Exchange) checkpointMarket(market Market) MarketCheckpoint {
+	history := ex.history[market]
+	cp := MarketCheckpoint{
+		Book:      ex.orderbooks[market].State(),
+		Limits:    ex.marketConfig(market),
+		Fills:     make(map[uint64][]Fill, len(history.fills)),
+		Trades:    history.trades,
+		Fees:      maps.Clone(ex.holds[market].fees),
+		Positions: make(map[uint64]PositionCheckpoint, len(history.positions)),
+		LastPrice: history.last,
+	}
+	stops := ex.stops[market]
+	for _, side := range [][]*stopOrder{stops.buys, stops.sells} {
+		for _, s := range side {
+			cp.Stops = append(cp.Stops, StopCheckpoint{Order: *s.order, StopPrice: s.stop, SelfTradePrevention: s.stp})
+		}
+	}
+	for id, held := range ex.holds[market].held {
+		cp.Holds = append(cp.Holds, HoldCheckpoint{OrderID: id, Owner: held.owner, Bid: held.bid, Amount: held.amount})
+	}
+	for id, t := range history.live {
+		cp.Orders = append(cp.Orders, OrderCheckpoint{
+			ID:                  id,
+			Owner:               t.owner,
+			CreatedAt:           t.createdAt,
+			UpdatedAt:           t.updatedAt,
+			Filled:              t.filled,
+			Notional:            t.notional,
+			SelfTradePrevention: t.stp,
+			ReduceOnly:          t.reduceOnly,
+		})
+	}
+	slices.SortFunc(cp.Holds, func(a, b HoldCheckpoint) int { return cmp.Compare(a.OrderID, b.OrderID) })
+	slices.SortFunc(cp.Orders, func(a, b OrderCheckpoint) int { return cmp.Compare(a.ID, b.ID) })
+	for _, id := range slices.Concat(history.ring[history.next:], history.ring[:history.next]) {
+		cp.Finished = append(cp.Finished, history.done[id])
+	}
+	for user, fills := range history.fills {
+		cp.Fills[user] = append([]Fill(nil), fills...)
+	}
+	for user, p := range history.positions {
+		cp.Positions[user] = PositionCheckpoint{Size: p.size, Entry: p.entry, Realized: p.realized}
+	}
+	return cp
+}
+
+// Restore loads cp into a new exchange, before it takes any request and
+// before Replay applies the journal's commands after it. Markets the
+// exchange has that cp doesn't are left empty; a market in cp the exchange
+// doesn't have is an error.
+func (ex *Exchange) Restore(cp Checkpoint) error {
+	for market := range cp.Markets {
+		if _, ok := ex.orderbooks[market]; !ok {
+			return fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+		}
+	}
+	if err := ex.ledger.Restore(cp.Ledger); err != nil {
+		return err
+	}
+	for market, mcp := range cp.Markets {
+		ob := ex.orderbooks[market]
+		ob.Lock()
+		err := ex.restoreMarket(market, mcp)
+		ob.Unlock()
+		if err != nil {
+			return fmt.Errorf("%s: %w", market, err)
+		}
+	}
+	orderbook.ReserveOrderIDs(cp.LastOrderID)
+	ex.clientOrders.restore(cp.ClientOrders)
+	ex.transfers.restore(cp.Transfers)
+	ex.withdrawals.restore(cp.Withdrawals)
+	ex.deposits.restore(cp.Deposits)
+	ex.users.Restore(cp.Users)
+	ex.configMu.Lock()
+	maps.Copy(ex.userLimits, cp.UserLimits)
+	for _, user := range cp.Suspended {
+		ex.suspended[user] = true
+	}
+	ex.configMu.Unlock()
+
+	ex.journalMu.Lock()
+	ex.journaled = cp.Seq
+	ex.journalMu.Unlock()
+	return nil
+}
+
+// restoreMarket loads market's part of a Checkpoint. The caller holds the
+// book's lock.
+func (ex *Exchange) restoreMarket(market Market, cp MarketCheckpoint) error {
+	ob := ex.orderbooks[market]
+	stops := ex.stops[market]
+	history := ex.history[market]
+	if len(stops.buys) > 0 || len(stops.sells) > 0 || len(history.live) > 0 || len(history.done) > 0 {
+		return errors.New("market has orders")
+	}
+	// the checkpoint's prices and sizes are numbers of its scale's units
+	if cp.Limits.Scale != ob.Scale() {
+		return fmt.Errorf("checkpoint has scale %+v, the market %+v", cp.Limits.Scale, ob.Scale())
+	}
+	// and its fills were allocated by its policy
+	ex.configMu.RLock()
+	policy := ex.configs[market].MatchPolicy
+	ex.configMu.RUnlock()
+	if cp.Limits.MatchPolicy != policy {
+		return fmt.Errorf("checkpoint has match policy %+v, the market %+v", cp.Limits.MatchPolicy, policy)
+	}
+	if err := ob.Restore(cp.Book); err != nil {
+		return err
+	}
+
+	limits := cp.Limits
+	ex.configMu.Lock()
+	ex.configs[market] = &limits
+	ex.configMu.Unlock()
+
+	for _, s := range cp.Stops {
+		order := s.Order
+		stops.add(&stopOrder{order: &order, stop: s.StopPrice, stp: s.SelfTradePrevention})
+	}
+	held := ex.holds[market].held
+	for _, h := range cp.Holds {
+		held[h.OrderID] = hold{owner: h.Owner, bid: h.Bid, amount: h.Amount}
+	}
+	maps.Copy(ex.holds[market].fees, cp.Fees)
+	for _, o := range cp.Orders {
+		history.start(o.ID, &orderTrack{
+			owner:      o.Owner,
+			createdAt:  o.CreatedAt,
+			updatedAt:  o.UpdatedAt,
+			filled:     o.Filled,
+			notional:   o.Notional,
+			stp:        o.SelfTradePrevention,
+			reduceOnly: o.ReduceOnly,
+		})
+	}
+	for _, record := range cp.Finished {
+		history.remember(record)
+	}
+	for user, fills := range cp.Fills {
+		history.fills[user] = append([]Fill(nil), fills...)
+	}
+	for user, p := range cp.Positions {
+		history.positions[user] = &position{size: p.Size, entry: p.Entry, realized: p.Realized}
+	}
+	history.trades, history.last = cp.Trades, cp.LastPrice
+
+	ex.feeds[market].Forget(ob.Sequence())
+	ex.scheduleExpiry(market)
+	ex.bookChanged(market)
+	return nil
+}
@@ -0,0 +1,136 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+const (
+	// DefaultClientOrderIDWindow is how long a client order ID stays taken
+	// when Config.ClientOrderIDWindow is unset.
+	DefaultClientOrderIDWindow = 24 * time.Hour
+	// MaxClientOrderIDLength is the longest client order ID accepted, in
+	// bytes.
+	MaxClientOrderIDLength = 64
+)
+
+// clientOrderKey is a client order ID as one user gave it; each user, and
+// anonymous callers as one, have IDs of their own.
+type clientOrderKey struct {
+	user     uint64
+	clientID string
+}
+
+// clientOrder is a client order ID given to the order with id at, in unix
+// nanoseconds.
+type clientOrder struct {
+	key clientOrderKey
+	id  uint64
+	at  int64
+}
+
+// clientOrderIndex maps the client order IDs given within the last window
+// to the orders they were given to. An ID in the index is refused for the
+// same user's next order, so a client retrying a request it never saw
+// answered can't place the order twice; once the window passes the ID may
+// be used again.
+type clientOrderIndex struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	window time.Duration
+	orders map[clientOrderKey]clientOrder
+	// queue holds the claims in the order they were made, for dropping them
+	// as the window passes
+	queue []clientOrder
+}
+
+func newClientOrderIndex(window time.Duration, clk clock.Clock) *clientOrderIndex {
+	return &clientOrderIndex{
+		clock:  clk,
+		window: window,
+		orders: make(map[clientOrderKey]clientOrder),
+	}
+}
+
+// expire drops the claims made more than the window ago. The caller holds
+// x.mu.
+func (x *clientOrderIndex) expire() {
+	cutoff := x.clock.Now().Add(-x.window).UnixNano()
+	n := 0
+	for n < len(x.queue) && x.queue[n].at <= cutoff {
+		// a released ID may have been claimed again since
+		if c := x.queue[n]; x.orders[c.key] == c {
+			delete(x.orders, c.key)
+		}
+		n++
+	}
+	x.queue = x.queue[n:]
+}
+
+// claim takes user's clientID for the order with id. If another order holds
+// it, it returns that order's ID and false.
+func (x *clientOrderIndex) claim(user uint64, clientID string, id uint64) (uint64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.expire()
+	key := clientOrderKey{user, clientID}
+	if c, ok := x.orders[key]; ok {
+		return c.id, false
+	}
+	c := clientOrder{key: key, id: id, at: x.clock.Now().UnixNano()}
+	x.orders[key] = c
+	x.queue = append(x.queue, c)
+	return id, true
+}
+
+// release gives back user's clientID, claimed for the order with id, when
+// the order is refused after all.
+func (x *clientOrderIndex) release(user uint64, clientID string, id uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	key := clientOrderKey{user, clientID}
+	if x.orders[key].id == id {
+		delete(x.orders, key)
+	}
+}
+
+// lookup returns the ID of the order user gave clientID to.
+func (x *clientOrderIndex) lookup(user uint64, clientID string) (uint64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.expire()
+	c, ok := x.orders[clientOrderKey{user, clientID}]
+	return c.id, ok
+}
+
+// claims returns the claims still held, oldest first.
+func (x *clientOrderIndex) claims() []ClientOrderClaim {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.expire()
+	var claims []ClientOrderClaim
+	for _, c := range x.queue {
+		if x.orders[c.key] == c {
+			claims = append(claims, ClientOrderClaim{User: c.key.user, ClientOrderID: c.key.clientID, OrderID: c.id, At: c.at})
+		}
+	}
+	return claims
+}
+
+// restore takes back claims, as returned by claims.
+func (x *clientOrderIndex) restore(claims []ClientOrderClaim) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, claim := range claims {
+		c := clientOrder{key: clientOrderKey{claim.User, claim.ClientOrderID}, id: claim.OrderID, at: claim.At}
+		x.orders[c.key] = c
+		x.queue = append(x.queue, c)
+	}
+}
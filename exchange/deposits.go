@@ -0,0 +1,204 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+var (
+	// ErrDepositCredited is returned by CreditDeposit for a transfer that
+	// has been credited already.
+	ErrDepositCredited = errors.New("deposit already credited")
+	// ErrAddressTaken is returned by AssignDepositAddress for an address
+	// given to another user, or a user given another address.
+	ErrAddressTaken = errors.New("deposit address already assigned")
+)
+
+// ChainDeposit is a transfer to a user's deposit address, credited once it
+// was confirmed. Reference tells transfers apart, so none is credited
+// twice; Block is the block it was mined in and Entry the ledger entry
+// crediting it. Timestamp is when it was credited, in unix nanoseconds.
+type ChainDeposit struct {
+	User      uint64       `json:"user"`
+	Asset     ledger.Asset `json:"asset"`
+	Amount    float64      `json:"amount"`
+	Address   string       `json:"address"`
+	TxHash    string       `json:"txHash"`
+	Reference string       `json:"reference"`
+	Block     uint64       `json:"block"`
+	Entry     uint64       `json:"entry"`
+	Timestamp int64        `json:"timestamp"`
+}
+
+// AddressAssignment is the deposit address given to User.
+type AddressAssignment struct {
+	User    uint64 `json:"user"`
+	Address string `json:"address"`
+}
+
+// DepositCheckpoint is what a Checkpoint keeps of deposits from the chain:
+// the addresses given out, in the order they were, the last block scanned
+// for deposits, and the deposits credited, oldest first.
+type DepositCheckpoint struct {
+	Addresses []AddressAssignment `json:"addresses,omitempty"`
+	Scanned   uint64              `json:"scanned,omitempty"`
+	Deposits  []ChainDeposit      `json:"deposits,omitempty"`
+}
+
+// depositBook keeps what deposits from the chain need to pick up where they
+// were after a restart.
+type depositBook struct {
+	mu        sync.Mutex
+	addresses []AddressAssignment
+	byUser    map[uint64]string
+	owners    map[string]uint64
+	scanned   uint64
+	deposits  []ChainDeposit
+	credited  map[string]bool
+}
+
+func newDepositBook() depositBook {
+	return depositBook{
+		byUser:   make(map[uint64]string),
+		owners:   make(map[string]uint64),
+		credited: make(map[string]bool),
+	}
+}
+
+// AssignDepositAddress gives user address to deposit to, for good.
+// Assigning a user the address they already have changes nothing.
+func (ex *Exchange) AssignDepositAddress(user uint64, address string) error {
+	defer ex.begin()()
+
+	d := &ex.deposits
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if owner, ok := d.owners[address]; ok && owner == user {
+		return nil
+	}
+	if _, ok := d.owners[address]; ok {
+		return fmt.Errorf("%w: %s", ErrAddressTaken, address)
+	}
+	if _, ok := d.byUser[user]; ok {
+		return fmt.Errorf("%w: user %d has one", ErrAddressTaken, user)
+	}
+	if rejection := ex.record(Command{Type: CommandAssignAddress, User: user, Address: address}); rejection != nil {
+		return rejection
+	}
+	d.addresses = append(d.addresses, AddressAssignment{User: user, Address: address})
+	d.byUser[user] = address
+	d.owners[address] = user
+	return nil
+}
+
+// DepositAddresses returns the deposit addresses given out, in the order
+// they were.
+func (ex *Exchange) DepositAddresses() []AddressAssignment {
+	d := &ex.deposits
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]AddressAssignment{}, d.addresses...)
+}
+
+// CreditDeposit credits a confirmed transfer to its user, unless one with
+// its Reference was credited before, which is ErrDepositCredited. It
+// returns the deposit as recorded.
+func (ex *Exchange) CreditDeposit(deposit ChainDeposit) (ChainDeposit, error) {
+	defer ex.begin()()
+
+	d := &ex.deposits
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.credited[deposit.Reference] {
+		return ChainDeposit{}, fmt.Errorf("%w: %s", ErrDepositCredited, deposit.Reference)
+	}
+	if rejection := ex.record(Command{Type: CommandCreditDeposit, Deposit: &deposit}); rejection != nil {
+		return ChainDeposit{}, rejection
+	}
+	entry, err := ex.ledger.Deposit(deposit.User, deposit.Asset, deposit.Amount)
+	if err != nil {
+		return ChainDeposit{}, err
+	}
+	deposit.Entry = entry.ID
+	deposit.Timestamp = ex.clock.Now().UnixNano()
+	d.deposits = append(d.deposits, deposit)
+	d.credited[deposit.Reference] = true
+	return deposit, nil
+}
+
+// ChainDeposits returns the deposits credited to user, oldest first.
+func (ex *Exchange) ChainDeposits(user uint64) []ChainDeposit {
+	d := &ex.deposits
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deposits := []ChainDeposit{}
+	for _, deposit := range d.deposits {
+		if deposit.User == user {
+			deposits = append(deposits, deposit)
+		}
+	}
+	return deposits
+}
+
+// ScannedBlock is the last block scanned for deposits, zero if none has
+// been.
+func (ex *Exchange) ScannedBlock() uint64 {
+	d := &ex.deposits
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.scanned
+}
+
+// ScanBlocks records that the blocks up to block have been scanned for
+// deposits and every one in them credited. Going back changes nothing.
+func (ex *Exchange) ScanBlocks(block uint64) error {
+	defer ex.begin()()
+
+	d := &ex.deposits
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if block <= d.scanned {
+		return nil
+	}
+	if rejection := ex.record(Command{Type: CommandScanBlocks, Block: block}); rejection != nil {
+		return rejection
+	}
+	d.scanned = block
+	return nil
+}
+
+func (d *depositBook) checkpoint() DepositCheckpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DepositCheckpoint{
+		Addresses: append([]AddressAssignment(nil), d.addresses...),
+		Scanned:   d.scanned,
+		Deposits:  append([]ChainDeposit(nil), d.deposits...),
+	}
+}
+
+func (d *depositBook) restore(cp DepositCheckpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, a := range cp.Addresses {
+		d.addresses = append(d.addresses, a)
+		d.byUser[a.User] = a.Address
+		d.owners[a.Address] = a.User
+	}
+	d.scanned = cp.Scanned
+	for _, deposit := range cp.Deposits {
+		d.deposits = append(d.deposits, deposit)
+		d.credited[deposit.Reference] = true
+	}
+}
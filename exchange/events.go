@@ -0,0 +1,421 @@
+package exchange
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// EventType names what happened to a book.
+type EventType string
+
+const (
+	// EventOrderAccepted: an order was taken by the book. Price is its limit
+	// price (zero for market orders) and Size its original size.
+	EventOrderAccepted EventType = "ORDER_ACCEPTED"
+	// EventFill: two orders traded Size at Price. Bid is the side of the
+	// incoming order; auction fills have none and report false. TradeID and
+	// Timestamp identify and date the trade.
+	EventFill EventType = "FILL"
+	// EventOrderDone: an order left the book, filled or cancelled. Size is
+	// what was left of it when it did, zero when it filled.
+	EventOrderDone EventType = "ORDER_DONE"
+	// EventLevelChanged: a price level's resting volume is now Size, zero
+	// once the level is gone.
+	EventLevelChanged EventType = "LEVEL_CHANGED"
+)
+
+// Event is one thing an operation did to a market's book. Seq is the book's
+// sequence number after the operation. OrderID is the order accepted or
+// done; a fill has the incoming order's and MakerOrderID the resting one's,
+// or in an auction the bid's and the ask's, and TakerFee and MakerFee what
+// their users paid for it: in the base asset for the bid, in the quote
+// asset for the ask.
+type Event struct {
+	Type         EventType       `json:"type"`
+	Market       Market          `json:"market"`
+	Seq          uint64          `json:"seq"`
+	OrderID      uint64          `json:"orderId,omitempty"`
+	MakerOrderID uint64          `json:"makerOrderId,omitempty"`
+	Bid          bool            `json:"bid"`
+	Price        orderbook.Price `json:"price"`
+	Size         orderbook.Size  `json:"size"`
+	TradeID      uint64          `json:"tradeId,omitempty"`
+	TakerFee     float64         `json:"takerFee,omitempty"`
+	MakerFee     float64         `json:"makerFee,omitempty"`
+	Timestamp    int64           `json:"timestamp,omitempty"`
+}
+
+// EventHandler receives the events of one operation on one market, filtered
+// to the types it registered for, in the order they happened.
+type EventHandler func(events []Event)
+
+type eventSub struct {
+	types  map[EventType]bool
+	handle EventHandler
+	queue  *handlerQueue
+}
+
+func (s *eventSub) filter(events []Event) []Event {
+	if len(s.types) == 0 {
+		return events
+	}
+	var filtered []Event
+	for _, e := range events {
+		if s.types[e.Type] {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// eventBus fans each operation's events out to registered handlers.
+// Publishers hold the market's book lock, so handlers see a market's events
+// in the order its operations were applied.
+type eventBus struct {
+	mu    sync.RWMutex
+	sync  []*eventSub
+	async []*eventSub
+	pool  *workerPool
+}
+
+func newEventBus(workers int) *eventBus {
+	return &eventBus{pool: newWorkerPool(workers)}
+}
+
+func newEventSub(fn EventHandler, types []EventType) *eventSub {
+	sub := &eventSub{handle: fn}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	return sub
+}
+
+// Handle registers fn to run inside Publish, after the handlers registered
+// before it and before the operation returns to its caller. It runs with the
+// book's lock held, so it must be quick and must not take that lock itself.
+// With no types fn gets every event.
+func (b *eventBus) Handle(fn EventHandler, types ...EventType) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sync = append(b.sync, newEventSub(fn, types))
+}
+
+// HandleAsync registers fn to run on the shared worker pool, fed from its own
+// queue as opts describe. Publish never waits for it: when the queue is full
+// the operation is dropped, coalesced or spilled as opts.Overflow says.
+func (b *eventBus) HandleAsync(fn EventHandler, opts AsyncOptions, types ...EventType) {
+	sub := newEventSub(fn, types)
+	sub.queue = b.pool.register(fn, opts)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.async = append(b.async, sub)
+}
+
+// Publish delivers one operation's events: synchronous handlers run before
+// it returns, asynchronous ones are queued.
+func (b *eventBus) Publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.sync {
+		if filtered := sub.filter(events); len(filtered) > 0 {
+			sub.handle(filtered)
+		}
+	}
+	for _, sub := range b.async {
+		if filtered := sub.filter(events); len(filtered) > 0 {
+			sub.queue.Push(filtered)
+		}
+	}
+}
+
+// Close stops the asynchronous handlers once they have drained their queues,
+// spilled operations included. Nothing may be published after it.
+func (b *eventBus) Close() {
+	b.pool.Close()
+}
+
+// HandleEvents registers fn to see the events of every operation on the
+// exchange's markets as it happens; see eventBus.Handle for what fn may do.
+// With no types fn gets every event.
+func (ex *Exchange) HandleEvents(fn EventHandler, types ...EventType) {
+	ex.events.Handle(fn, types...)
+}
+
+// HandleEventsAsync registers fn to see events on the exchange's worker pool,
+// off the matching path; see eventBus.HandleAsync. Close drains it.
+func (ex *Exchange) HandleEventsAsync(fn EventHandler, opts AsyncOptions, types ...EventType) {
+	ex.events.HandleAsync(fn, opts, types...)
+}
+
+// eventLog builds the events of one operation on a market, bringing the
+// market's order history up to date and settling trades as it goes, and
+// its holds and owners' order updates once it is done. The caller holds the
+// book's lock.
+type eventLog struct {
+	market  Market
+	ob      *orderbook.Orderbook
+	history *orderHistory
+	holds   *holdBook
+	feed    *updateFeed
+	events  []Event
+	updates []OrderUpdate
+	levels  map[orderbook.Side]map[orderbook.Price]bool
+	gone    map[*orderbook.Order]bool
+	// orders are the orders the operation placed, changed or filled, in
+	// the order it did, some more than once
+	orders []*orderbook.Order
+	// reason is given on the owners' order updates, if the operation has one
+	reason string
+	// config is the market's rules as the operation began, which set the
+	// fees its trades charge
+	config MarketConfig
+}
+
+func (ex *Exchange) newEventLog(market Market, ob *orderbook.Orderbook) *eventLog {
+	return &eventLog{market: market, ob: ob, history: ex.history[market], holds: ex.holds[market], feed: ex.updates, config: ex.marketConfig(market)}
+}
+
+// changed notes that the operation placed, changed or filled o.
+func (l *eventLog) changed(o *orderbook.Order) {
+	l.orders = append(l.orders, o)
+}
+
+func (l *eventLog) add(typ EventType, orderID uint64, bid bool, price orderbook.Price, size orderbook.Size) {
+	l.events = append(l.events, Event{
+		Type:    typ,
+		Market:  l.market,
+		OrderID: orderID,
+		Bid:     bid,
+		Price:   price,
+		Size:    size,
+	})
+}
+
+// touch notes that an order on the level at price was filled, added or
+// removed, so the level's new volume is reported once at the end.
+func (l *eventLog) touch(bid bool, price orderbook.Price) {
+	side := orderbook.SideAsk
+	if bid {
+		side = orderbook.SideBid
+	}
+	if l.levels == nil {
+		l.levels = make(map[orderbook.Side]map[orderbook.Price]bool)
+	}
+	if l.levels[side] == nil {
+		l.levels[side] = make(map[orderbook.Price]bool)
+	}
+	l.levels[side][price] = true
+}
+
+// done records an order leaving the book, once however many fills it took.
+func (l *eventLog) done(o *orderbook.Order) {
+	if l.gone[o] {
+		return
+	}
+	if l.gone == nil {
+		l.gone = make(map[*orderbook.Order]bool)
+	}
+	l.gone[o] = true
+	l.changed(o)
+	l.history.finish(l.market, o)
+	l.add(EventOrderDone, o.ID, o.Bid, o.Price, o.Size)
+	if remaining := o.Remaining(); remaining > 0 {
+		l.update(OrderUpdateCancelled, o, remaining)
+	}
+}
+
+// fills records matches and the resting orders they completed.
+func (l *eventLog) fills(taker *orderbook.Order, matches []orderbook.Match) {
+	// what each order had left before the matches, for their fills to count
+	// down from
+	remaining := make(map[*orderbook.Order]orderbook.Size)
+	for _, m := range matches {
+		for _, o := range []*orderbook.Order{m.Ask, m.Bid} {
+			if _, ok := remaining[o]; !ok {
+				remaining[o] = o.Remaining()
+			}
+			remaining[o] += m.SizeFilled
+		}
+	}
+
+	for _, m := range matches {
+		bid := taker != nil && taker.Bid
+		incoming, maker := m.Bid, m.Ask
+		if taker == m.Ask {
+			incoming, maker = m.Ask, m.Bid
+		}
+		l.add(EventFill, incoming.ID, bid, m.Price, m.SizeFilled)
+		fill := &l.events[len(l.events)-1]
+		fill.MakerOrderID = maker.ID
+		buyerFee, sellerFee := l.holds.tradeFees(m, taker, l.config)
+		fill.TakerFee, fill.MakerFee = buyerFee, sellerFee
+		if incoming == m.Ask {
+			fill.TakerFee, fill.MakerFee = sellerFee, buyerFee
+		}
+		fill.TradeID, fill.Timestamp = l.history.fill(l.market, taker, m, buyerFee, sellerFee)
+		l.holds.settle(m, buyerFee, sellerFee, tradeReference(l.market, fill.TradeID))
+		for _, o := range []*orderbook.Order{m.Ask, m.Bid} {
+			l.changed(o)
+			remaining[o] -= m.SizeFilled
+			l.fillUpdate(o, o != taker, remaining[o], fill, positionDelta(o, m))
+			if o == taker {
+				continue
+			}
+			l.touch(o.Bid, o.Price)
+			if o.IsFilled() {
+				l.done(o)
+			}
+		}
+	}
+}
+
+// finish brings the holds of the orders the operation changed in line with
+// them, appends the changed levels, best price first per side, stamps the
+// book's sequence and returns the events.
+func (l *eventLog) finish() []Event {
+	for _, o := range l.orders {
+		l.holds.sync(o, l.gone[o])
+	}
+	for _, side := range []orderbook.Side{orderbook.SideAsk, orderbook.SideBid} {
+		bid := side == orderbook.SideBid
+		index := l.ob.AskLimits
+		if bid {
+			index = l.ob.BidLimits
+		}
+		for _, price := range sortedPrices(l.levels[side], bid) {
+			var volume orderbook.Size
+			if limit, ok := index[price]; ok {
+				volume = limit.TotalVolume
+			}
+			l.add(EventLevelChanged, 0, bid, price, volume)
+		}
+	}
+
+	seq := l.ob.Sequence()
+	for i := range l.events {
+		l.events[i].Seq = seq
+	}
+	for i := range l.updates {
+		l.updates[i].Seq = seq
+	}
+	l.feed.Publish(l.updates)
+	return l.events
+}
+
+func sortedPrices(prices map[orderbook.Price]bool, bid bool) []orderbook.Price {
+	sorted := make([]orderbook.Price, 0, len(prices))
+	for price := range prices {
+		sorted = append(sorted, price)
+	}
+	slices.Sort(sorted)
+	if bid {
+		slices.Reverse(sorted)
+	}
+	return sorted
+}
+
+// place records o being placed and producing matches.
+func (l *eventLog) place(o *orderbook.Order, matches []orderbook.Match) {
+	l.add(EventOrderAccepted, o.ID, o.Bid, o.Price, o.OriginalSize)
+	// o is in every match, so they add up to what it came in with
+	size := o.Remaining()
+	for _, m := range matches {
+		size += m.SizeFilled
+	}
+	l.update(OrderUpdateAccepted, o, size)
+	l.changed(o)
+	l.history.update(o)
+	l.fills(o, matches)
+	if o.Limit == nil {
+		// filled, or an immediate-or-cancel remainder that never rested
+		l.done(o)
+	} else {
+		l.touch(o.Bid, o.Price)
+	}
+}
+
+// orderEvents describes placing o, which produced matches.
+func (ex *Exchange) orderEvents(market Market, ob *orderbook.Orderbook, o *orderbook.Order, matches []orderbook.Match) []Event {
+	l := ex.newEventLog(market, ob)
+	l.place(o, matches)
+	return l.finish()
+}
+
+// modifyEvents describes amending o, which rested showing size at price. An
+// amendment that kept its priority only changed its level; any other took
+// the old order off the book and placed o again, producing matches.
+func (ex *Exchange) modifyEvents(market Market, ob *orderbook.Orderbook, o *orderbook.Order, price orderbook.Price, size orderbook.Size, keptPriority bool, matches []orderbook.Match) []Event {
+	l := ex.newEventLog(market, ob)
+	if keptPriority {
+		l.changed(o)
+		l.update(OrderUpdateAmended, o, o.Remaining())
+		l.history.update(o)
+		l.touch(o.Bid, o.Price)
+		return l.finish()
+	}
+	l.add(EventOrderDone, o.ID, o.Bid, price, size)
+	l.touch(o.Bid, price)
+	l.place(o, matches)
+	return l.finish()
+}
+
+// cancelEvents describes cancelling orders.
+func (ex *Exchange) cancelEvents(market Market, ob *orderbook.Orderbook, orders []*orderbook.Order) []Event {
+	l := ex.newEventLog(market, ob)
+	for _, o := range orders {
+		l.done(o)
+		l.touch(o.Bid, o.Price)
+	}
+	return l.finish()
+}
+
+// resetEvents describes a reset cancelling orders off the book and stops,
+// which never rested on it, so only their owners are told.
+func (ex *Exchange) resetEvents(market Market, ob *orderbook.Orderbook, orders, stops []*orderbook.Order) []Event {
+	l := ex.newEventLog(market, ob)
+	l.reset(orders, stops)
+	return l.finish()
+}
+
+// suspendEvents is resetEvents for cancelling a suspended user's orders and
+// stops, telling them why.
+func (ex *Exchange) suspendEvents(market Market, ob *orderbook.Orderbook, orders, stops []*orderbook.Order) []Event {
+	l := ex.newEventLog(market, ob)
+	l.reason = ReasonUserSuspended
+	l.reset(orders, stops)
+	return l.finish()
+}
+
+// reset records orders cancelled off the book and stops cancelled before
+// they triggered.
+func (l *eventLog) reset(orders, stops []*orderbook.Order) {
+	for _, o := range orders {
+		l.done(o)
+		l.touch(o.Bid, o.Price)
+	}
+	for _, o := range stops {
+		l.holds.sync(o, true)
+		l.history.finish(l.market, o)
+		l.update(OrderUpdateCancelled, o, o.Remaining())
+	}
+}
+
+// auctionEvents describes an auction uncrossing through matches.
+func (ex *Exchange) auctionEvents(market Market, ob *orderbook.Orderbook, matches []orderbook.Match) []Event {
+	l := ex.newEventLog(market, ob)
+	l.fills(nil, matches)
+	return l.finish()
+}
@@ -0,0 +1,1562 @@
+// Package exchange runs a set of markets, each backed by an order book, and
+// exposes order entry, market data and administration as plain Go calls. The
+// HTTP server in the module root is one binding over it; services can embed
+// it directly.
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// Market is a market's symbol.
+type Market string
+
+const (
+	MarketEth Market = "ETH"
+	MarketBtc Market = "BTC"
+)
+
+// Increments are the smallest steps a market quotes prices and sizes in.
+type Increments struct {
+	Tick float64 `json:"tick"`
+	Lot  float64 `json:"lot"`
+}
+
+// DefaultIncrements are the tick and lot sizes of the built-in markets.
+var DefaultIncrements = map[Market]Increments{
+	MarketEth: {Tick: 0.01, Lot: 0.0001},
+	MarketBtc: {Tick: 0.01, Lot: 0.00000001},
+}
+
+var (
+	ErrMarketNotFound = errors.New("market not found")
+	// ErrMarketNotEmpty is returned by Import for a market with resting
+	// orders unless it is told to replace them.
+	ErrMarketNotEmpty = errors.New("market has resting orders")
+	// ErrSandboxDisabled is returned by the sandbox operations unless
+	// Config.Sandbox is set.
+	ErrSandboxDisabled = errors.New("sandbox mode is disabled")
+	// ErrInvalidWindow is returned by Quality for a window that isn't
+	// positive or exceeds MaxQualityWindow.
+	ErrInvalidWindow = errors.New("window must be positive and at most 24h")
+)
+
+const (
+	// DefaultOrderTimeout bounds how long order entry waits for its
+	// market's book when Config.OrderTimeout is unset.
+	DefaultOrderTimeout = 2 * time.Second
+	// DefaultTickerInterval is the most often a market's ticker feed emits
+	// when Config.TickerInterval is unset.
+	DefaultTickerInterval = 100 * time.Millisecond
+)
+
+// Config sets up an Exchange. The zero value runs the ETH and BTC markets
+// with no limits and an in-memory audit trail.
+type Config struct {
+	// Markets lists the markets to run.
+	Markets []Market
+	// Limits sets a market's initial trading rules; markets not listed
+	// start with none.
+	Limits map[Market]MarketConfig
+	// Increments sets a market's tick and lot sizes; markets not listed
+	// take theirs from DefaultIncrements.
+	Increments map[Market]Increments
+	// OrderTimeout bounds how long order entry waits for a busy book.
+	OrderTimeout time.Duration
+	// TickerInterval is the most often a market's ticker feed emits.
+	TickerInterval time.Duration
+	// Workers is the size of the pool asynchronous event handlers share. It
+	// defaults to GOMAXPROCS.
+	Workers int
+	// AuditStore keeps the order entry audit trail.
+	AuditStore AuditStore
+	// Sandbox enables the sandbox operations for development and demos.
+	Sandbox bool
+	// AnonymousOrders lets orders without a user in, for tests and demos:
+	// they hold nothing and trade against ledger.External. Otherwise every
+	// order needs a user with the balance to back it.
+	AnonymousOrders bool
+	// ClientOrderIDWindow is how long a client order ID stays taken after
+	// it is given to an order. It defaults to DefaultClientOrderIDWindow.
+	ClientOrderIDWindow time.Duration
+	// Assets sets the assets a market trades; markets not listed take
+	// theirs from DefaultAssets.
+	Assets map[Market]MarketAssets
+	// OrderHistory is how many finished orders each market keeps for Order.
+	// It defaults to DefaultOrderHistory.
+	OrderHistory int
+	// Clock is the exchange's and its books' source of time. It defaults to
+	// the system clock.
+	Clock clock.Clock
+	// Journal, if set, records every command that changes the exchange's
+	// state before it is applied, so Replay can rebuild the state from it.
+	// Commands are then applied one at a time. Ledger changes made directly
+	// through Ledger aren't commands and aren't journaled; funds move in and
+	// out through Deposit, Withdraw, CreditDeposit and RequestWithdrawal,
+	// and between users through Transfer, which are. So are users
+	// registered through Users.
+	Journal Journal
+}
+
+// Exchange runs a fixed set of markets. Its methods are safe for concurrent
+// use; each market's book is guarded by its own lock.
+type Exchange struct {
+	markets    []Market
+	orderbooks map[Market]*orderbook.Orderbook
+	configMu   sync.RWMutex
+	configs    map[Market]*MarketConfig
+	// userLimits are the users' own trading rules, guarded by configMu
+	userLimits map[uint64]UserLimits
+	tickers    map[Market]*tickerFeed
+	feeds      map[Market]*marketFeed
+	quality    map[Market]*qualityTracker
+	expiries   map[Market]*expiryScheduler
+	stops      map[Market]*stopBook
+	history    map[Market]*orderHistory
+	holds      map[Market]*holdBook
+	// suspended are the users who may not place orders, guarded by
+	// configMu
+	suspended map[uint64]bool
+	// clientOrders holds the client order IDs that are taken, across
+	// markets
+	clientOrders *clientOrderIndex
+	increments   map[Market]Increments
+	// events carries what each operation did to a book to whatever needs
+	// to react to it
+	events *eventBus
+	// updates carries what each operation did to users' orders to them
+	updates *updateFeed
+	// orderTimeout bounds how long order entry waits for a busy book
+	orderTimeout time.Duration
+	// audit keeps every order entry attempt, rejected ones included
+	audit  *auditLog
+	ledger *ledger.Ledger
+	// transfers are the transfers made between users, by sender and
+	// reference
+	transfers transferBook
+	// withdrawals are the withdrawals off the exchange requested, and where
+	// each is on its way out
+	withdrawals withdrawalBook
+	// deposits keeps deposits from the chain
+	deposits depositBook
+	// users is the user registry Users journals changes to
+	users   *user.Registry
+	sandbox bool
+	// anonymous is whether orders without a user are let in
+	anonymous bool
+	clock     *commandClock
+	// journal records commands before they are applied; journalMu applies
+	// them one at a time while there is one. journaled is the number of the
+	// last command journaled, guarded by journalMu.
+	journal   Journal
+	journalMu sync.Mutex
+	journaled uint64
+	// replaying is set while the exchange follows commands journaled
+	// elsewhere, and applyMu held while Apply applies one, so a checkpoint
+	// doesn't see part of it
+	replaying atomic.Bool
+	applyMu   sync.Mutex
+	// settlementHandlers are told of each trade as it settles
+	settlementMu       sync.RWMutex
+	settlementHandlers []SettlementHandler
+	// notReady is set while the exchange shouldn't be sent traffic, such as
+	// after a failed warm-up; the zero value is ready
+	notReady atomic.Bool
+	// config is what the exchange was configured with, less its journal
+	// and audit trail, for BookAt to build copies of it from
+	config Config
+}
+
+// New starts an exchange configured by cfg. Close it to flush the audit
+// trail and stop its background work. It panics if a market's scale is
+// invalid.
+func New(cfg Config) *Exchange {
+	if len(cfg.Markets) == 0 {
+		cfg.Markets = []Market{MarketEth, MarketBtc}
+	}
+	if cfg.OrderTimeout == 0 {
+		cfg.OrderTimeout = DefaultOrderTimeout
+	}
+	if cfg.TickerInterval == 0 {
+		cfg.TickerInterval = DefaultTickerInterval
+	}
+	if cfg.AuditStore == nil {
+		cfg.AuditStore = NewMemoryAuditStore()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	config := cfg
+	config.Journal, config.AuditStore = nil, nil
+	// everything reads the time through the exchange's clock, so a command
+	// reads the same time when it is replayed
+	commandTime := &commandClock{Clock: cfg.Clock}
+	cfg.Clock = commandTime
+	if cfg.ClientOrderIDWindow <= 0 {
+		cfg.ClientOrderIDWindow = DefaultClientOrderIDWindow
+	}
+	if cfg.OrderHistory <= 0 {
+		cfg.OrderHistory = DefaultOrderHistory
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+
+	orderbooks := make(map[Market]*orderbook.Orderbook)
+	configs := make(map[Market]*MarketConfig)
+	tickers := make(map[Market]*tickerFeed)
+	feeds := make(map[Market]*marketFeed)
+	quality := make(map[Market]*qualityTracker)
+	expiries := make(map[Market]*expiryScheduler)
+	stops := make(map[Market]*stopBook)
+	history := make(map[Market]*orderHistory)
+	holds := make(map[Market]*holdBook)
+	increments := make(map[Market]Increments)
+	balances := ledger.New(cfg.Clock)
+	for _, market := range cfg.Markets {
+		config := cfg.Limits[market]
+		if config.Scale == (orderbook.Scale{}) {
+			config.Scale = orderbook.DefaultScale
+		}
+		if err := config.Scale.Validate(); err != nil {
+			panic(fmt.Sprintf("exchange: market %s: %v", market, err))
+		}
+		if config.Scale.Price > ledger.AmountPrecision || config.Scale.Size > ledger.AmountPrecision {
+			panic(fmt.Sprintf("exchange: market %s: scale keeps more places than the ledger's %d", market, ledger.AmountPrecision))
+		}
+		if config.MatchPolicy.Type == "" {
+			config.MatchPolicy.Type = MatchFIFO
+		}
+		policy, err := config.MatchPolicy.orderbookPolicy()
+		if err != nil {
+			panic(fmt.Sprintf("exchange: market %s: %v", market, err))
+		}
+		configs[market] = &config
+		orderbooks[market] = orderbook.NewOrderbook(orderbook.WithClock(cfg.Clock), orderbook.WithScale(config.Scale), orderbook.WithMatchPolicy(policy))
+		tickers[market] = newTickerFeed(cfg.TickerInterval, cfg.Clock)
+		feeds[market] = newMarketFeed(feedHistory)
+		quality[market] = newQualityTracker(cfg.Clock)
+		expiries[market] = &expiryScheduler{}
+		stops[market] = &stopBook{}
+		history[market] = newOrderHistory(cfg.OrderHistory, cfg.Clock)
+		assets, ok := cfg.Assets[market]
+		if !ok {
+			assets, ok = DefaultAssets[market]
+		}
+		if !ok {
+			assets = MarketAssets{Base: ledger.Asset(market), Quote: ledger.USD}
+		}
+		holds[market] = newHoldBook(assets, config.Scale, balances, cfg.AnonymousOrders)
+		if inc, ok := cfg.Increments[market]; ok {
+			increments[market] = inc
+		} else {
+			increments[market] = DefaultIncrements[market]
+		}
+	}
+	ex := &Exchange{
+		markets:    cfg.Markets,
+		orderbooks: orderbooks,
+		configs:    configs,
+		userLimits: make(map[uint64]UserLimits),
+		suspended:  make(map[uint64]bool),
+		tickers:    tickers,
+		feeds:      feeds,
+		quality:    quality,
+		expiries:   expiries,
+		stops:      stops,
+		history:    history,
+		holds:      holds,
+		increments: increments,
+		events:     newEventBus(cfg.Workers),
+		updates:    newUpdateFeed(),
+
+		clientOrders: newClientOrderIndex(cfg.ClientOrderIDWindow, cfg.Clock),
+
+		orderTimeout: cfg.OrderTimeout,
+		audit:        newAuditLog(cfg.AuditStore),
+		ledger:       balances,
+		withdrawals:  withdrawalBook{byID: make(map[uint64]*Withdrawal)},
+		deposits:     newDepositBook(),
+		transfers:    newTransferBook(),
+		users:        user.NewRegistry(cfg.Clock),
+		sandbox:      cfg.Sandbox,
+		anonymous:    cfg.AnonymousOrders,
+		clock:        commandTime,
+		journal:      cfg.Journal,
+		config:       config,
+	}
+	// the ticker and quality samples read the book, so they are taken
+	// synchronously under the lock the publisher holds
+	ex.events.Handle(func(events []Event) {
+		ex.bookChanged(events[0].Market)
+	}, EventFill, EventLevelChanged)
+	// feed messages carry the operation's sequence number, so they go out
+	// under the lock too, in the order operations were applied
+	ex.events.Handle(func(events []Event) {
+		ex.feeds[events[0].Market].Publish(feedMessages(events))
+	}, EventFill, EventLevelChanged)
+	for market, holds := range holds {
+		holds.settled = func(s Settlement) { ex.settled(market, s) }
+	}
+	// stops are triggered by each trade as it is published, and sent to the
+	// book by fireStops once the operation that traded is done
+	ex.events.Handle(func(events []Event) {
+		stops := ex.stops[events[0].Market]
+		for _, e := range events {
+			stops.trigger(e.Price)
+		}
+	}, EventFill)
+	return ex
+}
+
+// bookChanged refreshes what is derived from market's book after it
+// changed. The caller holds the book's lock.
+func (ex *Exchange) bookChanged(market Market) {
+	ex.publishTicker(market)
+	ex.sampleQuality(market)
+}
+
+// bookReplaced is bookChanged for changes made to market's book without
+// publishing events, which the feed history can't replay, so it restarts
+// the history too, brings the order history and holds in line with the
+// book and schedules any expiries the new orders carry. The caller holds the
+// book's lock.
+func (ex *Exchange) bookReplaced(market Market) {
+	ex.feeds[market].Forget(ex.orderbooks[market].Sequence())
+	ex.history[market].resync(ex.orderbooks[market], ex.stops[market])
+	ex.holds[market].resync(ex.orderbooks[market], ex.stops[market])
+	ex.scheduleExpiry(market)
+	ex.bookChanged(market)
+}
+
+// Close flushes the audit trail and stops the order expiry timers and the
+// asynchronous event handlers. The exchange must not be used afterwards.
+func (ex *Exchange) Close() {
+	ex.stopExpiries()
+	ex.audit.Close()
+	ex.events.Close()
+}
+
+// Markets lists the markets the exchange runs, in configuration order.
+func (ex *Exchange) Markets() []Market {
+	return append([]Market(nil), ex.markets...)
+}
+
+// Sandbox reports whether the sandbox operations are enabled.
+func (ex *Exchange) Sandbox() bool {
+	return ex.sandbox
+}
+
+// Ready reports whether the exchange should be sent traffic. It is until
+// SetReady(false); the exchange itself never changes it.
+func (ex *Exchange) Ready() bool {
+	return !ex.notReady.Load()
+}
+
+// SetReady marks the exchange ready or not ready for traffic.
+func (ex *Exchange) SetReady(ready bool) {
+	ex.notReady.Store(!ready)
+}
+
+// Increments returns the tick and lot sizes market quotes in.
+func (ex *Exchange) Increments(market Market) (Increments, error) {
+	inc, ok := ex.increments[market]
+	if !ok {
+		return Increments{}, ErrMarketNotFound
+	}
+	return inc, nil
+}
+
+func (ex *Exchange) book(market Market) (*orderbook.Orderbook, error) {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+	return ob, nil
+}
+
+// OrderType is how an order is executed: at any price, within a limit, or
+// at any price once the market trades through a stop price.
+type OrderType string
+
+const (
+	MarketOrder     OrderType = "MARKET"
+	LimitOrder      OrderType = "LIMIT"
+	StopMarketOrder OrderType = "STOP_MARKET"
+)
+
+// PlaceOrderRequest is an order to put on a market's book. Price and
+// TimeInForce are only used for limit orders, which default to
+// GoodTillCancel; ExpiresAt, in unix nanoseconds, is required for
+// GoodTillDate and not allowed otherwise. DisplaySize makes a resting limit
+// order an iceberg that shows at most that much of itself in market data.
+// StopPrice is required for, and only allowed on, stop-market orders. A
+// market order may give Notional, an amount of quote to spend or raise,
+// instead of Size, and be protected by WorstPrice or MaxSlippageBps, a bound
+// from the best opposite price in basis points: it then fills up to the
+// tighter bound and the rest is cancelled. Metadata is kept with the order
+// but never shown in market data.
+type PlaceOrderRequest struct {
+	Type           OrderType             `json:"type"`
+	Bid            bool                  `json:"bid"`
+	Size           orderbook.Size        `json:"size"`
+	Notional       float64               `json:"notional,omitempty"`
+	WorstPrice     orderbook.Price       `json:"worstPrice,omitempty"`
+	MaxSlippageBps float64               `json:"maxSlippageBps,omitempty"`
+	Price          orderbook.Price       `json:"price"`
+	TimeInForce    orderbook.TimeInForce `json:"timeInForce,omitempty"`
+	ExpiresAt      int64                 `json:"expiresAt,omitempty"`
+	DisplaySize    orderbook.Size        `json:"displaySize,omitempty"`
+	StopPrice      orderbook.Price       `json:"stopPrice,omitempty"`
+	ClientOrderID  string                `json:"clientOrderId,omitempty"`
+	// SelfTradePrevention is what happens if the order would fill against
+	// its owner's own resting orders, STPCancelNewest if empty.
+	SelfTradePrevention SelfTradePrevention `json:"selfTradePrevention,omitempty"`
+	// ReduceOnly orders may only shrink their owner's position in the
+	// market, never grow or flip it. One larger than the position is
+	// refused, or sized down to it under ReduceOnlyResize, and one resting
+	// is trimmed as other fills shrink the position.
+	ReduceOnly       bool             `json:"reduceOnly,omitempty"`
+	ReduceOnlyPolicy ReduceOnlyPolicy `json:"reduceOnlyPolicy,omitempty"`
+	// User is the ID of the user placing the order, zero for an anonymous
+	// one. It is set by whoever authenticated the request, never taken
+	// from the client.
+	User     uint64            `json:"user,omitempty"`
+	Market   Market            `json:"market"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// rests reports whether the order can rest on the book, and so count
+// against the market's resting caps.
+func (req PlaceOrderRequest) rests() bool {
+	return req.Type == LimitOrder && req.TimeInForce.Rests()
+}
+
+// ExecutionReport is the outcome of an accepted order. OrderID is the ID
+// the book assigned, which a resting order can be cancelled by; Rested says
+// whether the remainder went on the book. The execution fields are only set
+// when the order matched; LimitPrice and PriceImprovement only for a limit
+// order that did.
+type ExecutionReport struct {
+	Order        PlaceOrderRequest `json:"order"`
+	OrderID      uint64            `json:"orderId"`
+	OriginalSize orderbook.Size    `json:"originalSize"`
+	Remaining    orderbook.Size    `json:"remaining"`
+	FilledSize   orderbook.Size    `json:"filledSize"`
+	Rested       bool              `json:"rested"`
+
+	AvgPrice      orderbook.Price       `json:"avgPrice,omitempty"`
+	WorstPrice    orderbook.Price       `json:"worstPrice,omitempty"`
+	LevelsTouched int                   `json:"levelsTouched,omitempty"`
+	Fills         []orderbook.LevelFill `json:"fills,omitempty"`
+	Trades        []Trade               `json:"trades,omitempty"`
+	LimitPrice    orderbook.Price       `json:"limitPrice,omitempty"`
+	// PriceImprovement is per unit and in the taker's favour: fills happen
+	// at the resting orders' prices, which can only be better than the
+	// limit.
+	PriceImprovement *orderbook.Price `json:"priceImprovement,omitempty"`
+}
+
+// Trade is one fill of an order against a resting one, the counterparty.
+type Trade struct {
+	Price            orderbook.Price `json:"price"`
+	Size             orderbook.Size  `json:"size"`
+	CounterpartyID   uint64          `json:"counterpartyId"`
+	CounterpartySide orderbook.Side  `json:"counterpartySide"`
+}
+
+func newTrade(order *orderbook.Order, m orderbook.Match) Trade {
+	counterparty, side := m.Ask, orderbook.SideAsk
+	if counterparty == order {
+		counterparty, side = m.Bid, orderbook.SideBid
+	}
+	return Trade{Price: m.Price, Size: m.SizeFilled, CounterpartyID: counterparty.ID, CounterpartySide: side}
+}
+
+// protection is the worst price a protected market order may fill at: the
+// tighter of WorstPrice and MaxSlippageBps from the best opposite price. ok
+// is false if the slippage has nothing to be measured from. The slippage is
+// rounded down to a whole unit, so the bound is never looser than asked.
+func (req PlaceOrderRequest) protection(ob *orderbook.Orderbook) (worst orderbook.Price, ok bool) {
+	if req.MaxSlippageBps > 0 {
+		limits := ob.Bids()
+		if req.Bid {
+			limits = ob.Asks()
+		}
+		if len(limits) == 0 {
+			return 0, false
+		}
+		slippage := orderbook.Price(math.Floor(float64(limits[0].Price) * req.MaxSlippageBps / 10_000))
+		if req.Bid {
+			worst = limits[0].Price + slippage
+		} else {
+			worst = limits[0].Price - slippage
+		}
+	}
+	if req.WorstPrice > 0 && (worst == 0 || req.Bid && req.WorstPrice < worst || !req.Bid && req.WorstPrice > worst) {
+		worst = req.WorstPrice
+	}
+	return worst, true
+}
+
+// validate checks the request is an order at all, before any market rule
+// applies.
+func (req PlaceOrderRequest) validate() *Rejection {
+	var msg string
+	switch {
+	case req.Type != LimitOrder && req.Type != MarketOrder && req.Type != StopMarketOrder:
+		msg = "type must be LIMIT, MARKET or STOP_MARKET"
+	case req.Notional < 0:
+		msg = "notional must not be negative"
+	case req.Notional > 0 && req.Type != MarketOrder:
+		msg = "notional only applies to market orders"
+	case req.Notional > 0 && req.Size != 0:
+		msg = "market orders take a size or a notional, not both"
+	case req.Size <= 0 && req.Notional == 0:
+		msg = "size must be positive"
+	case req.WorstPrice < 0 || req.MaxSlippageBps < 0:
+		msg = "worstPrice and maxSlippageBps must not be negative"
+	case (req.WorstPrice > 0 || req.MaxSlippageBps > 0) && req.Type != MarketOrder:
+		msg = "worstPrice and maxSlippageBps only apply to market orders"
+	case req.Type == LimitOrder && req.Price <= 0:
+		msg = "limit orders need a positive price"
+	case req.Type == StopMarketOrder && req.StopPrice <= 0:
+		msg = "stop orders need a positive stopPrice"
+	case req.Type != StopMarketOrder && req.StopPrice != 0:
+		msg = "stopPrice only applies to stop orders"
+	case req.TimeInForce != "" && req.Type != LimitOrder:
+		msg = "time in force only applies to limit orders"
+	case req.TimeInForce != "" && req.TimeInForce != orderbook.GoodTillCancel && req.TimeInForce != orderbook.ImmediateOrCancel && req.TimeInForce != orderbook.FillOrKill && req.TimeInForce != orderbook.GoodTillDate:
+		msg = "timeInForce must be GTC, IOC, FOK or GTD"
+	case req.TimeInForce == orderbook.GoodTillDate && req.ExpiresAt <= 0:
+		msg = "GTD orders need a positive expiresAt"
+	case req.TimeInForce != orderbook.GoodTillDate && req.ExpiresAt != 0:
+		msg = "expiresAt only applies to GTD orders"
+	case req.DisplaySize < 0:
+		msg = "displaySize must not be negative"
+	case req.DisplaySize > 0 && !req.rests():
+		msg = "displaySize only applies to limit orders that rest"
+	case len(req.ClientOrderID) > MaxClientOrderIDLength:
+		msg = fmt.Sprintf("clientOrderId must be at most %d bytes", MaxClientOrderIDLength)
+	case !req.SelfTradePrevention.Valid():
+		msg = "selfTradePrevention must be CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT"
+	case !req.ReduceOnlyPolicy.Valid():
+		msg = "reduceOnlyPolicy must be REJECT or RESIZE"
+	case req.ReduceOnlyPolicy != "" && !req.ReduceOnly:
+		msg = "reduceOnlyPolicy only applies to reduce-only orders"
+	case req.ReduceOnly && req.Type == StopMarketOrder:
+		msg = "stop orders cannot be reduce-only"
+	default:
+		return nil
+	}
+	return &Rejection{
+		Msg:  msg,
+		Code: "INVALID_REQUEST",
+	}
+}
+
+// PlaceOrder validates req against its market's rules and puts it on the
+// book. A refused order comes back as a *Rejection. Every attempt is
+// recorded in the audit trail.
+func (ex *Exchange) PlaceOrder(ctx context.Context, req PlaceOrderRequest) (ExecutionReport, error) {
+	return ex.placeOrder(ctx, req, 0)
+}
+
+// placeOrder is PlaceOrder giving the order id, or a new ID if it is zero.
+func (ex *Exchange) placeOrder(ctx context.Context, req PlaceOrderRequest, id uint64) (ExecutionReport, error) {
+	raw, _ := json.Marshal(req)
+	// journaled as it was asked for, before a notional is sized
+	journaled := req
+	audit := AuditRecord{
+		Timestamp: ex.clock.Now().UnixNano(),
+		Action:    AuditPlace,
+		Market:    req.Market,
+		User:      req.User,
+		Request:   raw,
+		// until the order is on the book, so a request that fails any other
+		// way is still recorded as not accepted
+		Result: AuditRejected,
+	}
+	defer func() { ex.audit.Write(audit) }()
+	// claimed is the order the client order ID was taken for, to be given
+	// back if the order is refused after all
+	var claimed uint64
+	// reserved is the order once it holds its owner's funds, to be released
+	// if it is refused after all
+	var reserved *orderbook.Order
+	reject := func(rejection *Rejection) (ExecutionReport, error) {
+		if claimed != 0 {
+			ex.clientOrders.release(req.User, req.ClientOrderID, claimed)
+		}
+		if reserved != nil {
+			ex.holds[req.Market].set(reserved, 0)
+		}
+		audit.Code, audit.Msg = rejection.Code, rejection.Msg
+		return ExecutionReport{}, rejection
+	}
+
+	ob, ok := ex.orderbooks[req.Market]
+	if !ok {
+		return reject(&Rejection{
+			Msg:  "market not found",
+			Code: "MARKET_NOT_FOUND",
+		})
+	}
+
+	if rejection := req.validate(); rejection != nil {
+		return reject(rejection)
+	}
+	if req.User == 0 && !ex.anonymous {
+		// nothing backs an order without a user
+		return reject(&Rejection{
+			Msg:  "orders must be placed by a user with the balance to back them",
+			Code: "INSUFFICIENT_FUNDS",
+		})
+	}
+	if err := orderbook.ValidateMetadata(req.Metadata); err != nil {
+		return reject(&Rejection{
+			Msg:  err.Error(),
+			Code: "INVALID_METADATA",
+		})
+	}
+
+	order := orderbook.NewOrder(req.Bid, req.Size)
+	order.ID = id
+	order.TimeInForce = req.TimeInForce
+	order.ExpiresAt = req.ExpiresAt
+	order.DisplaySize = req.DisplaySize
+	order.Metadata = req.Metadata
+	order.ClientOrderID = req.ClientOrderID
+	order.Owner = req.User
+
+	ctx, cancel := context.WithTimeout(ctx, ex.orderTimeout)
+	defer cancel()
+	if err := lockBook(ctx, ob); err != nil {
+		return reject(timeoutRejection(err))
+	}
+	defer ob.Unlock()
+	defer ex.begin()()
+	// read once the command has begun, so it is replayed with the same rules
+	config := ex.marketConfig(req.Market)
+
+	if req.Type == MarketOrder && ob.InAuction() {
+		return reject(&Rejection{
+			Msg:  "market orders are not accepted during an auction",
+			Code: "AUCTION_IN_PROGRESS",
+		})
+	}
+
+	if req.Notional > 0 {
+		size, ok := ob.SizeForNotional(req.Bid, req.Notional)
+		if !ok {
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("not enough resting volume to fill notional %.8g", req.Notional),
+				Code: "INSUFFICIENT_LIQUIDITY",
+			})
+		}
+		if size == 0 {
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("notional %.8g is less than the smallest size at the best price", req.Notional),
+				Code: "NOTIONAL_TOO_SMALL",
+			})
+		}
+		// from here on the order is the base size the notional fills
+		req.Size = size
+		order.Size, order.OriginalSize = size, size
+	}
+	if req.ReduceOnly {
+		if rejection := ex.capReduceOnly(&req, order, ob); rejection != nil {
+			return reject(rejection)
+		}
+	}
+	if rejection := ex.checkSuspended(req.User); rejection != nil {
+		return reject(rejection)
+	}
+	if rejection := config.check(req, ob); rejection != nil {
+		return reject(rejection)
+	}
+	if rejection := ex.checkUserOrders(req, ob, config); rejection != nil {
+		return reject(rejection)
+	}
+	if req.ExpiresAt != 0 && req.ExpiresAt <= ex.clock.Now().UnixNano() {
+		return reject(&Rejection{
+			Msg:  "expiresAt is not in the future",
+			Code: "ALREADY_EXPIRED",
+		})
+	}
+
+	// everything from here on changes state, so the order is journaled
+	// first, with the ID it is given
+	if order.ID == 0 {
+		order.ID = orderbook.NewOrderID()
+	}
+	if rejection := ex.record(Command{Type: CommandPlace, Market: req.Market, OrderID: order.ID, Place: &journaled}); rejection != nil {
+		return reject(rejection)
+	}
+	if req.ClientOrderID != "" {
+		holder, ok := ex.clientOrders.claim(req.User, req.ClientOrderID, order.ID)
+		if !ok {
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("clientOrderId %q is already in use by order %d", req.ClientOrderID, holder),
+				Code: "DUPLICATE_CLIENT_ORDER_ID",
+			})
+		}
+		claimed = order.ID
+	}
+	if order.Owner != 0 {
+		if rejection := ex.holds[req.Market].reserve(order, ex.holds[req.Market].entryHold(req, ob)); rejection != nil {
+			return reject(rejection)
+		}
+		reserved = order
+	}
+	if req.Type == StopMarketOrder {
+		if last := ob.LastPrice(); last > 0 && triggers(req.Bid, req.StopPrice, last) {
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("last trade price %s is already through the stop price", ob.Scale().PriceString(last)),
+				Code: "STOP_ALREADY_TRIGGERED",
+			})
+		}
+		ex.stops[req.Market].add(&stopOrder{order: order, stop: req.StopPrice, stp: req.SelfTradePrevention})
+		ex.history[req.Market].update(order)
+		audit.Result, audit.Seq, audit.OrderID = AuditAccepted, ob.Sequence(), order.ID
+		return ExecutionReport{
+			Order:        req,
+			OrderID:      order.ID,
+			OriginalSize: order.OriginalSize,
+			Remaining:    order.Remaining(),
+		}, nil
+	}
+	protected := req.Type == MarketOrder && (req.WorstPrice > 0 || req.MaxSlippageBps > 0)
+	var worst orderbook.Price
+	if protected {
+		if worst, ok = req.protection(ob); !ok {
+			return reject(&Rejection{
+				Msg:  "no resting orders to measure slippage from",
+				Code: "INSUFFICIENT_LIQUIDITY",
+			})
+		}
+	}
+	selfTrades := planSelfTrades(ob, order, req.SelfTradePrevention, req.reach(worst))
+	if req.TimeInForce == orderbook.FillOrKill {
+		fillable := ob.Fillable(req.Bid, req.Price, req.Size)
+		if !selfTrades.empty() {
+			// a dropped part is never filled
+			fillable = selfTrades.drop == 0 && selfTrades.covers(ob, req.Bid, req.Price, order.Size)
+		}
+		if !fillable {
+			return reject(&Rejection{
+				Msg:  "not enough resting volume within the limit price to fill the whole order",
+				Code: "FOK_NOT_FILLABLE",
+			})
+		}
+	}
+	if req.Type == MarketOrder && !protected && !selfTrades.empty() && !selfTrades.covers(ob, req.Bid, req.reach(0), order.Size) {
+		return reject(&Rejection{
+			Msg:  fmt.Sprintf("%v [size: %s]", orderbook.ErrInsufficientLiquidity, ob.Scale().SizeString(order.Size)),
+			Code: "INSUFFICIENT_LIQUIDITY",
+		})
+	}
+	if reserved != nil && req.Type == MarketOrder && req.Bid && !selfTrades.empty() {
+		// the sweep passes over the owner's own asks, so it may cost more
+		// than the book did on the way in
+		holds := ex.holds[req.Market]
+		if rejection := holds.reserve(order, holds.sweepHold(ob, order.Size-selfTrades.decrement-selfTrades.drop, selfTrades)); rejection != nil {
+			return reject(rejection)
+		}
+	}
+	ex.preventSelfTrades(req.Market, ob, order, selfTrades)
+
+	var matches []orderbook.Match
+	switch {
+	case order.Size == 0:
+		// self-trade prevention left it nothing to match
+	case req.Type == LimitOrder:
+		matches = ob.PlaceLimitOrder(req.Price, order)
+	case protected:
+		// auctions were refused above
+		matches, _ = ob.PlaceProtectedMarketOrder(order, worst)
+	default:
+		var err error
+		// auctions were refused above, so the book can only be short
+		if matches, err = ob.PlaceMarketOrder(order); err != nil {
+			return reject(&Rejection{
+				Msg:  err.Error(),
+				Code: "INSUFFICIENT_LIQUIDITY",
+			})
+		}
+	}
+	selfTrades.restoreDropped(order)
+	ex.events.Publish(ex.orderEvents(req.Market, ob, order, matches))
+	if order.Limit != nil {
+		// for amendments that cross, which match as the order would, and
+		// for trimming a reduce-only one
+		t := ex.history[req.Market].track(order)
+		t.stp, t.reduceOnly = req.SelfTradePrevention, req.ReduceOnly
+	}
+	ex.fireStops(req.Market, ob)
+	ex.trimReduceOnly(req.Market, ob)
+	if order.Limit != nil && order.ExpiresAt != 0 {
+		ex.scheduleExpiry(req.Market)
+	}
+	audit.Result, audit.Seq, audit.OrderID = AuditAccepted, ob.Sequence(), order.ID
+
+	return newExecutionReport(req, order, matches), nil
+}
+
+// newExecutionReport reports on order, placed as req and producing matches.
+func newExecutionReport(req PlaceOrderRequest, order *orderbook.Order, matches []orderbook.Match) ExecutionReport {
+	report := ExecutionReport{
+		Order:        req,
+		OrderID:      order.ID,
+		OriginalSize: order.OriginalSize,
+		Remaining:    order.Remaining(),
+		FilledSize:   order.FilledSize(),
+		Rested:       order.Limit != nil,
+	}
+	if len(matches) > 0 {
+		execution := orderbook.Summarize(matches)
+		report.AvgPrice = execution.AveragePrice
+		report.WorstPrice = execution.WorstPrice
+		report.LevelsTouched = len(execution.Levels)
+		report.Fills = execution.Levels
+		report.Trades = make([]Trade, len(matches))
+		for i, m := range matches {
+			report.Trades[i] = newTrade(order, m)
+		}
+		if req.Type == LimitOrder {
+			improvement := order.Price - execution.AveragePrice
+			if !order.Bid {
+				improvement = -improvement
+			}
+			report.LimitPrice = order.Price
+			report.PriceImprovement = &improvement
+		}
+	}
+	return report
+}
+
+// ModifyRequest amends a resting order to Size left at Price. See
+// orderbook.ModifyOrder for which amendments keep the order's place in the
+// queue.
+type ModifyRequest struct {
+	Price orderbook.Price `json:"price"`
+	Size  orderbook.Size  `json:"size"`
+}
+
+// ModifyOrder amends user's resting order with id in whichever market it
+// rests and reports on it as amended. The amendment must pass the market's
+// size, notional and price band rules; the order already counts against the
+// resting caps, and one that loses the order's place in the queue must wait
+// out the market's minimum resting time as a cancel would. Like CancelOrder
+// it refuses with a *Rejection, ORDER_NOT_FOUND for an ID with no resting
+// order of user's, and records every attempt.
+func (ex *Exchange) ModifyOrder(ctx context.Context, user, id uint64, req ModifyRequest) (ExecutionReport, error) {
+	raw, _ := json.Marshal(struct {
+		ID uint64 `json:"id"`
+		ModifyRequest
+	}{id, req})
+	audit := AuditRecord{
+		Timestamp: ex.clock.Now().UnixNano(),
+		Action:    AuditModify,
+		User:      user,
+		OrderID:   id,
+		Request:   raw,
+		Result:    AuditRejected,
+	}
+	defer func() { ex.audit.Write(audit) }()
+	reject := func(rejection *Rejection) (ExecutionReport, error) {
+		audit.Code, audit.Msg = rejection.Code, rejection.Msg
+		return ExecutionReport{}, rejection
+	}
+
+	if req.Price <= 0 || req.Size <= 0 {
+		return reject(&Rejection{
+			Msg:  "price and size must be positive",
+			Code: "INVALID_REQUEST",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ex.orderTimeout)
+	defer cancel()
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		if err := lockBook(ctx, ob); err != nil {
+			return reject(timeoutRejection(err))
+		}
+		o, ok := ob.GetOrder(id)
+		if !ok || o.Owner != user {
+			ob.Unlock()
+			continue
+		}
+		audit.Market = market
+		end := ex.begin()
+		unlock := func() {
+			end()
+			ob.Unlock()
+		}
+
+		if rejection := ex.checkSuspended(user); rejection != nil {
+			unlock()
+			return reject(rejection)
+		}
+		if o.Frozen {
+			unlock()
+			return reject(&Rejection{
+				Msg:  "order is frozen",
+				Code: "ORDER_FROZEN",
+			})
+		}
+		// checked as an order that won't rest, as it already does
+		amended := PlaceOrderRequest{Type: LimitOrder, Bid: o.Bid, Size: req.Size, Price: req.Price, TimeInForce: orderbook.ImmediateOrCancel, User: user, Market: market}
+		if rejection := ex.marketConfig(market).check(amended, ob); rejection != nil {
+			unlock()
+			return reject(rejection)
+		}
+		history := ex.history[market]
+		if history.track(o).reduceOnly && req.Size > reducible(history.positions[user], o.Bid) {
+			unlock()
+			return reject(&Rejection{
+				Msg:  "reduce-only order would grow past the position it reduces",
+				Code: "REDUCE_ONLY",
+			})
+		}
+		// an amendment that loses its place re-places the order, which is as
+		// good as cancelling it
+		if !o.KeepsPriority(req.Price, req.Size) {
+			earliest := o.Timestamp + int64(ex.marketConfig(market).MinRestingTime)
+			if ex.clock.Now().UnixNano() < earliest {
+				unlock()
+				return reject(&Rejection{
+					Msg:  fmt.Sprintf("order may not be re-placed before %s", time.Unix(0, earliest).UTC().Format(time.RFC3339Nano)),
+					Code: "MIN_RESTING_TIME",
+				})
+			}
+		}
+		if rejection := ex.record(Command{Type: CommandModify, Market: market, User: user, OrderID: id, Modify: &req}); rejection != nil {
+			unlock()
+			return reject(rejection)
+		}
+		// an amendment that needs more funds holds them first
+		holds := ex.holds[market]
+		if need := holds.restingHold(&orderbook.Order{Bid: o.Bid, Price: req.Price, Size: req.Size}); need > holds.held[id].amount {
+			if rejection := holds.reserve(o, need); rejection != nil {
+				unlock()
+				return reject(rejection)
+			}
+		}
+		price, size, kept := o.Price, o.Size, o.KeepsPriority(req.Price, req.Size)
+		var selfTrades selfTrades
+		if !kept {
+			// the replacement comes in like a new order, kept from trading
+			// with its owner's as the order was placed asking
+			replacement := &orderbook.Order{Bid: o.Bid, Size: req.Size, Owner: o.Owner}
+			selfTrades = planSelfTrades(ob, replacement, ex.history[market].track(o).stp, req.Price)
+			ex.preventSelfTrades(market, ob, replacement, selfTrades)
+		}
+		var matches []orderbook.Match
+		if left := req.Size - selfTrades.decrement - selfTrades.drop; left > 0 {
+			var err error
+			if matches, err = ob.ModifyOrder(id, req.Price, left); err != nil {
+				holds.sync(o, false)
+				unlock()
+				return reject(&Rejection{
+					Msg:  err.Error(),
+					Code: "INVALID_REQUEST",
+				})
+			}
+		} else {
+			// self-trade prevention left the replacement nothing to match
+			filled := o.FilledSize()
+			ob.CancelOrder(o)
+			o.Price, o.Size, o.Hidden, o.OriginalSize = req.Price, 0, 0, filled
+		}
+		o.OriginalSize += selfTrades.drop
+		selfTrades.restoreDropped(o)
+		ex.events.Publish(ex.modifyEvents(market, ob, o, price, size, kept, matches))
+		ex.fireStops(market, ob)
+		ex.trimReduceOnly(market, ob)
+		audit.Result, audit.Seq = AuditAccepted, ob.Sequence()
+		amended.TimeInForce = o.TimeInForce
+		report := newExecutionReport(amended, o, matches)
+		unlock()
+
+		slog.Info("order modified", "market", market, "id", id, "price", ob.Scale().PriceString(req.Price), "size", ob.Scale().SizeString(req.Size), "keptPriority", kept)
+		return report, nil
+	}
+	return reject(&Rejection{
+		Msg:  fmt.Sprintf("no resting order with id %d", id),
+		Code: "ORDER_NOT_FOUND",
+	})
+}
+
+// ReduceRequest shrinks a resting order in place, By a size or To what
+// should be left of it, whichever is set. A reduction past what is left is
+// refused unless Clamp is set, which cancels the order instead; a To above
+// it leaves the order as it is.
+type ReduceRequest struct {
+	By    orderbook.Size  `json:"by,omitempty"`
+	To    *orderbook.Size `json:"to,omitempty"`
+	Clamp bool            `json:"clamp,omitempty"`
+}
+
+// OrderReduce is the outcome of reducing an order: Reduced is the size taken
+// off it and Remaining what is left, zero if the order was cancelled.
+type OrderReduce struct {
+	ID        uint64          `json:"id"`
+	Market    Market          `json:"market"`
+	Bid       bool            `json:"bid"`
+	Price     orderbook.Price `json:"price"`
+	Reduced   orderbook.Size  `json:"reduced"`
+	Remaining orderbook.Size  `json:"remaining"`
+	Status    OrderStatus     `json:"status"`
+}
+
+// ReduceOrder shrinks user's resting order with id in place, keeping its
+// price and place in the queue, and releases what it no longer needs to
+// hold. Reducing it to nothing cancels it, subject to the market's minimum
+// resting time as CancelOrder is. Like ModifyOrder it refuses with a
+// *Rejection, ORDER_NOT_FOUND for an ID with no resting order of user's, and
+// records every attempt.
+func (ex *Exchange) ReduceOrder(ctx context.Context, user, id uint64, req ReduceRequest) (OrderReduce, error) {
+	raw, _ := json.Marshal(struct {
+		ID uint64 `json:"id"`
+		ReduceRequest
+	}{id, req})
+	audit := AuditRecord{
+		Timestamp: ex.clock.Now().UnixNano(),
+		Action:    AuditReduce,
+		User:      user,
+		OrderID:   id,
+		Request:   raw,
+		Result:    AuditRejected,
+	}
+	defer func() { ex.audit.Write(audit) }()
+	reject := func(rejection *Rejection) (OrderReduce, error) {
+		audit.Code, audit.Msg = rejection.Code, rejection.Msg
+		return OrderReduce{}, rejection
+	}
+
+	if (req.By != 0) == (req.To != nil) || req.By < 0 || (req.To != nil && *req.To < 0) {
+		return reject(&Rejection{
+			Msg:  "one of by and to must be given, and not negative",
+			Code: "INVALID_REQUEST",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ex.orderTimeout)
+	defer cancel()
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		if err := lockBook(ctx, ob); err != nil {
+			return reject(timeoutRejection(err))
+		}
+		o, ok := ob.GetOrder(id)
+		if !ok || o.Owner != user {
+			ob.Unlock()
+			continue
+		}
+		audit.Market = market
+		end := ex.begin()
+		unlock := func() {
+			end()
+			ob.Unlock()
+		}
+
+		remaining := o.Remaining()
+		size := remaining - req.By
+		if req.To != nil {
+			size = *req.To
+		}
+		switch {
+		case size > remaining && req.Clamp:
+			size = remaining
+		case size > remaining:
+			unlock()
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("order has %s left, a reduction can't grow it", ob.Scale().SizeString(remaining)),
+				Code: "INVALID_REQUEST",
+			})
+		case size < 0 && req.Clamp:
+			size = 0
+		case size < 0:
+			unlock()
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("order has only %s left to reduce", ob.Scale().SizeString(remaining)),
+				Code: "REDUCE_TOO_LARGE",
+			})
+		}
+		if size == 0 {
+			earliest := o.Timestamp + int64(ex.marketConfig(market).MinRestingTime)
+			if ex.clock.Now().UnixNano() < earliest {
+				unlock()
+				return reject(&Rejection{
+					Msg:  fmt.Sprintf("order may not be cancelled before %s", time.Unix(0, earliest).UTC().Format(time.RFC3339Nano)),
+					Code: "MIN_RESTING_TIME",
+				})
+			}
+		}
+		// a clamped reduction may leave nothing to do
+		if size < remaining {
+			if rejection := ex.record(Command{Type: CommandReduce, Market: market, User: user, OrderID: id, Reduce: &req}); rejection != nil {
+				unlock()
+				return reject(rejection)
+			}
+			if err := ob.ReduceOrder(o, size); err != nil {
+				unlock()
+				return reject(&Rejection{
+					Msg:  err.Error(),
+					Code: "INVALID_REQUEST",
+				})
+			}
+			if size == 0 {
+				ex.events.Publish(ex.cancelEvents(market, ob, []*orderbook.Order{o}))
+			} else {
+				ex.events.Publish(ex.modifyEvents(market, ob, o, o.Price, size, true, nil))
+			}
+		}
+		// the book counts what was shaved off as filled, the history doesn't
+		status := OrderCancelled
+		if size > 0 {
+			status = ex.history[market].record(market, o).Status
+		}
+		audit.Result, audit.Seq = AuditAccepted, ob.Sequence()
+		unlock()
+
+		slog.Info("order reduced", "market", market, "id", id, "from", ob.Scale().SizeString(remaining), "to", ob.Scale().SizeString(size))
+		return OrderReduce{
+			ID:        id,
+			Market:    market,
+			Bid:       o.Bid,
+			Price:     o.Price,
+			Reduced:   remaining - size,
+			Remaining: size,
+			Status:    status,
+		}, nil
+	}
+	return reject(&Rejection{
+		Msg:  fmt.Sprintf("no resting order with id %d", id),
+		Code: "ORDER_NOT_FOUND",
+	})
+}
+
+// CancelRequest selects the resting orders of a market on Side, or on both
+// sides if it is empty, priced within PriceFrom and PriceTo, both inclusive.
+// A zero PriceTo leaves the range open above, so a request without prices
+// selects every order on the side. Force cancels them whatever the market's
+// minimum resting time, for operators clearing a book. Owner, if set, limits
+// the cancel to that user's orders.
+type CancelRequest struct {
+	Market    Market          `json:"market"`
+	Owner     uint64          `json:"owner,omitempty"`
+	Side      orderbook.Side  `json:"side,omitempty"`
+	PriceFrom orderbook.Price `json:"priceFrom,omitempty"`
+	PriceTo   orderbook.Price `json:"priceTo,omitempty"`
+	Force     bool            `json:"force,omitempty"`
+}
+
+// CancelledOrder reports an order removed by a cancel with the size it had
+// left, and when it would have expired if it was GoodTillDate.
+type CancelledOrder struct {
+	ID        uint64          `json:"id"`
+	Price     orderbook.Price `json:"price"`
+	Remaining orderbook.Size  `json:"remaining"`
+	Bid       bool            `json:"bid"`
+	Timestamp int64           `json:"timestamp"`
+	ExpiresAt int64           `json:"expiresAt,omitempty"`
+}
+
+// KeptOrder reports an order a bulk cancel selected but left resting. Code
+// says why; EarliestCancel is the unix nanosecond time from which it may be
+// cancelled.
+type KeptOrder struct {
+	CancelledOrder
+	Code           string `json:"code"`
+	EarliestCancel int64  `json:"earliestCancel"`
+}
+
+// CancelResult is what a bulk cancel did. The market's rules are applied to
+// each order on its own, so some may be kept while the rest are cancelled.
+type CancelResult struct {
+	Cancelled []CancelledOrder `json:"cancelled"`
+	Kept      []KeptOrder      `json:"kept"`
+}
+
+// Cancel cancels the orders req selects, asks before bids and best price
+// first. Orders that
+// haven't rested for the market's minimum resting time are kept unless
+// req.Force is set. Like PlaceOrder it refuses with a *Rejection and records
+// every attempt.
+func (ex *Exchange) Cancel(ctx context.Context, req CancelRequest) (CancelResult, error) {
+	raw, _ := json.Marshal(req)
+	audit := AuditRecord{
+		Timestamp: ex.clock.Now().UnixNano(),
+		Action:    AuditCancel,
+		Market:    req.Market,
+		User:      req.Owner,
+		Request:   raw,
+		Result:    AuditRejected,
+	}
+	defer func() { ex.audit.Write(audit) }()
+	reject := func(rejection *Rejection) (CancelResult, error) {
+		audit.Code, audit.Msg = rejection.Code, rejection.Msg
+		return CancelResult{}, rejection
+	}
+
+	ob, ok := ex.orderbooks[req.Market]
+	if !ok {
+		return reject(&Rejection{
+			Msg:  "market not found",
+			Code: "MARKET_NOT_FOUND",
+		})
+	}
+	sides := []orderbook.Side{orderbook.SideAsk, orderbook.SideBid}
+	switch req.Side {
+	case "":
+	case orderbook.SideBid, orderbook.SideAsk:
+		sides = []orderbook.Side{req.Side}
+	default:
+		return reject(&Rejection{
+			Msg:  "side must be bid or ask",
+			Code: "INVALID_REQUEST",
+		})
+	}
+	priceTo := req.PriceTo
+	if priceTo == 0 {
+		priceTo = math.MaxInt64
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ex.orderTimeout)
+	defer cancel()
+	if err := lockBook(ctx, ob); err != nil {
+		return reject(timeoutRejection(err))
+	}
+	end := ex.begin()
+	if rejection := ex.record(Command{Type: CommandCancel, Market: req.Market, Cancel: &req}); rejection != nil {
+		end()
+		ob.Unlock()
+		return reject(rejection)
+	}
+	result := CancelResult{Cancelled: []CancelledOrder{}, Kept: []KeptOrder{}}
+	minResting := ex.marketConfig(req.Market).MinRestingTime
+	now := ex.clock.Now().UnixNano()
+	keep := func(o *orderbook.Order) bool {
+		if req.Owner != 0 && o.Owner != req.Owner {
+			return false
+		}
+		earliest := o.Timestamp + int64(minResting)
+		if req.Force || now >= earliest {
+			return true
+		}
+		result.Kept = append(result.Kept, KeptOrder{
+			CancelledOrder: cancelledOrder(o),
+			Code:           "MIN_RESTING_TIME",
+			EarliestCancel: earliest,
+		})
+		return false
+	}
+	var orders []*orderbook.Order
+	for _, side := range sides {
+		orders = append(orders, ob.CancelRange(side, req.PriceFrom, priceTo, keep)...)
+	}
+	ex.events.Publish(ex.cancelEvents(req.Market, ob, orders))
+	audit.Result, audit.Seq = AuditAccepted, ob.Sequence()
+	end()
+	ob.Unlock()
+
+	for _, o := range orders {
+		result.Cancelled = append(result.Cancelled, cancelledOrder(o))
+	}
+	slog.Info("orders cancelled", "market", req.Market, "owner", req.Owner, "side", req.Side, "from", ob.Scale().PriceString(req.PriceFrom), "to", ob.Scale().PriceString(req.PriceTo), "count", len(result.Cancelled), "kept", len(result.Kept))
+	return result, nil
+}
+
+func cancelledOrder(o *orderbook.Order) CancelledOrder {
+	return CancelledOrder{
+		ID:        o.ID,
+		Price:     o.Price,
+		Remaining: o.Remaining(),
+		Bid:       o.Bid,
+		Timestamp: o.Timestamp,
+		ExpiresAt: o.ExpiresAt,
+	}
+}
+
+// OrderStatus is where an order stands.
+type OrderStatus string
+
+const OrderCancelled OrderStatus = "CANCELLED"
+
+// OrderCancel is the outcome of cancelling one order by ID.
+type OrderCancel struct {
+	CancelledOrder
+	Market     Market         `json:"market"`
+	FilledSize orderbook.Size `json:"filledSize"`
+	Status     OrderStatus    `json:"status"`
+}
+
+// CancelOrder cancels user's resting order with id in whichever market it
+// rests, subject to the market's minimum resting time, or user's
+// untriggered stop order with id. A user of zero stands for anonymous
+// callers, who may only cancel anonymous orders. Like Cancel it refuses
+// with a *Rejection, ORDER_NOT_FOUND for an ID with neither, and records
+// every attempt.
+func (ex *Exchange) CancelOrder(ctx context.Context, user, id uint64) (OrderCancel, error) {
+	raw, _ := json.Marshal(map[string]uint64{"id": id})
+	return ex.cancelOrder(ctx, user, id, raw, fmt.Sprintf("no resting order with id %d", id))
+}
+
+// CancelOrderByClientID is CancelOrder for the order user gave
+// clientOrderID within the last Config.ClientOrderIDWindow.
+func (ex *Exchange) CancelOrderByClientID(ctx context.Context, user uint64, clientOrderID string) (OrderCancel, error) {
+	raw, _ := json.Marshal(map[string]string{"clientOrderId": clientOrderID})
+	// no order has ID 0, so an unknown client order ID finds none
+	id, _ := ex.clientOrders.lookup(user, clientOrderID)
+	return ex.cancelOrder(ctx, user, id, raw, fmt.Sprintf("no resting order with clientOrderId %q", clientOrderID))
+}
+
+// cancelOrder cancels user's order with id, recording raw as the request
+// and refusing with notFound if there is none.
+func (ex *Exchange) cancelOrder(ctx context.Context, user, id uint64, raw []byte, notFound string) (OrderCancel, error) {
+	audit := AuditRecord{
+		Timestamp: ex.clock.Now().UnixNano(),
+		Action:    AuditCancel,
+		User:      user,
+		OrderID:   id,
+		Request:   raw,
+		Result:    AuditRejected,
+	}
+	defer func() { ex.audit.Write(audit) }()
+	reject := func(rejection *Rejection) (OrderCancel, error) {
+		audit.Code, audit.Msg = rejection.Code, rejection.Msg
+		return OrderCancel{}, rejection
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ex.orderTimeout)
+	defer cancel()
+	// IDs are unique across books, so the order rests in one at most
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		if err := lockBook(ctx, ob); err != nil {
+			return reject(timeoutRejection(err))
+		}
+		o, ok := ob.GetOrder(id)
+		if !ok {
+			// an untriggered stop has never rested, so it may go at once
+			if stop, ok := ex.stops[market].get(id); ok && stop.order.Owner == user {
+				audit.Market = market
+				end := ex.begin()
+				if rejection := ex.record(Command{Type: CommandCancelOrder, Market: market, User: user, OrderID: id}); rejection != nil {
+					end()
+					ob.Unlock()
+					return reject(rejection)
+				}
+				ex.stops[market].remove(id)
+				ex.holds[market].sync(stop.order, true)
+				ex.history[market].finish(market, stop.order)
+				audit.Result, audit.Seq = AuditAccepted, ob.Sequence()
+				end()
+				ob.Unlock()
+
+				slog.Info("stop order cancelled", "market", market, "id", id)
+				return OrderCancel{
+					CancelledOrder: cancelledOrder(stop.order),
+					Market:         market,
+					Status:         OrderCancelled,
+				}, nil
+			}
+			ob.Unlock()
+			continue
+		}
+		if o.Owner != user {
+			ob.Unlock()
+			continue
+		}
+		audit.Market = market
+		end := ex.begin()
+		unlock := func() {
+			end()
+			ob.Unlock()
+		}
+
+		earliest := o.Timestamp + int64(ex.marketConfig(market).MinRestingTime)
+		if ex.clock.Now().UnixNano() < earliest {
+			unlock()
+			return reject(&Rejection{
+				Msg:  fmt.Sprintf("order may not be cancelled before %s", time.Unix(0, earliest).UTC().Format(time.RFC3339Nano)),
+				Code: "MIN_RESTING_TIME",
+			})
+		}
+		if rejection := ex.record(Command{Type: CommandCancelOrder, Market: market, User: user, OrderID: id}); rejection != nil {
+			unlock()
+			return reject(rejection)
+		}
+		ob.CancelOrder(o)
+		ex.events.Publish(ex.cancelEvents(market, ob, []*orderbook.Order{o}))
+		audit.Result, audit.Seq = AuditAccepted, ob.Sequence()
+		unlock()
+
+		slog.Info("order cancelled", "market", market, "id", id)
+		return OrderCancel{
+			CancelledOrder: cancelledOrder(o),
+			Market:         market,
+			FilledSize:     o.FilledSize(),
+			Status:         OrderCancelled,
+		}, nil
+	}
+	return reject(&Rejection{
+		Msg:  notFound,
+		Code: "ORDER_NOT_FOUND",
+	})
+}
+
+// RejectInvalid records a request that couldn't be decoded into a
+// PlaceOrderRequest or a cancel and returns the rejection to answer it
+// with. raw is kept as sent, or as a JSON string if it isn't valid JSON.
+func (ex *Exchange) RejectInvalid(action AuditAction, market Market, raw []byte, err error) *Rejection {
+	return ex.rejectUndecoded(action, market, raw, &Rejection{
+		Msg:  err.Error(),
+		Code: "INVALID_REQUEST",
+	})
+}
+
+// RejectMalformed is RejectInvalid for a request body that isn't the JSON
+// the action takes. err is what the client is told, so it must not be a
+// decoder's error.
+func (ex *Exchange) RejectMalformed(action AuditAction, raw []byte, err error) *Rejection {
+	return ex.rejectUndecoded(action, "", raw, &Rejection{
+		Msg:  err.Error(),
+		Code: "MALFORMED_BODY",
+	})
+}
+
+func (ex *Exchange) rejectUndecoded(action AuditAction, market Market, raw []byte, rejection *Rejection) *Rejection {
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(string(raw))
+	}
+	ex.audit.Write(AuditRecord{
+		Timestamp: ex.clock.Now().UnixNano(),
+		Action:    action,
+		Market:    market,
+		Request:   raw,
+		Result:    AuditRejected,
+		Code:      rejection.Code,
+		Msg:       rejection.Msg,
+	})
+	return rejection
+}
+
+// Order is a resting order in book listings. Size is the remaining size.
+type Order struct {
+	Price        orderbook.Price `json:"price"`
+	Size         orderbook.Size  `json:"size"`
+	OriginalSize orderbook.Size  `json:"originalSize"`
+	FilledSize   orderbook.Size  `json:"filledSize"`
+	Bid          bool            `json:"bid"`
+	Timestamp    int64           `json:"timestamp"`
+}
+
+// OrderbookData is a full listing of a market's book.
+type OrderbookData struct {
+	Sequence       uint64         `json:"sequence"`
+	TotalAskVolume orderbook.Size `json:"totolAskVolume"`
+	TotalBidVolume orderbook.Size `json:"totolBidVolume"`
+	Asks           []Order        `json:"asks"`
+	Bids           []Order        `json:"bids"`
+}
+
+// Book lists every resting order in market, best price first, appending them
+// to asks and bids so callers can reuse buffers across calls. The whole
+// listing is copied under one read lock, so it never mixes states.
+func (ex *Exchange) Book(market Market, asks, bids []Order) (OrderbookData, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return OrderbookData{}, err
+	}
+
+	ob.RLock()
+	defer ob.RUnlock()
+
+	return OrderbookData{
+		Sequence:       ob.Sequence(),
+		TotalAskVolume: ob.AskTotalVolume(),
+		TotalBidVolume: ob.BidTotalVolume(),
+		Asks:           appendOrders(asks, ob, orderbook.SideAsk),
+		Bids:           appendOrders(bids, ob, orderbook.SideBid),
+	}, nil
+}
+
+func appendOrders(dst []Order, ob *orderbook.Orderbook, side orderbook.Side) []Order {
+	ob.WalkOrders(side, func(o orderbook.OrderView) bool {
+		dst = append(dst, Order{
+			Price:        o.Price,
+			Size:         o.Size,
+			OriginalSize: o.OriginalSize,
+			FilledSize:   o.OriginalSize - o.Size,
+			Bid:          o.Bid,
+			Timestamp:    o.Timestamp,
+		})
+		return true
+	})
+	return dst
+}
+
+// lockBook takes ob's write lock unless ctx ends first. A request whose
+// client went away or whose deadline passed while it queued behind other
+// writers never touches the book; once the lock is held the operation runs
+// to completion regardless.
+func lockBook(ctx context.Context, ob *orderbook.Orderbook) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ob.TryLock() {
+		return nil
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		ob.Lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		if err := ctx.Err(); err != nil {
+			ob.Unlock()
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		// the waiter still gets the lock eventually; hand it straight back
+		go func() {
+			<-acquired
+			ob.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+func timeoutRejection(err error) *Rejection {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Rejection{
+			Msg:  "market is too busy to take the request in time",
+			Code: "ENGINE_TIMEOUT",
+		}
+	}
+	return &Rejection{
+		Msg:  "request was cancelled before reaching the book",
+		Code: "REQUEST_CANCELLED",
+	}
+}
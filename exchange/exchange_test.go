@@ -0,0 +1,2542 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// px and sz are the default scale's units of a decimal price and size.
+func px(v float64) orderbook.Price { return orderbook.DefaultScale.PriceOf(v) }
+func sz(v float64) orderbook.Size  { return orderbook.DefaultScale.SizeOf(v) }
+
+func TestPlaceOrder(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+
+	place := func(req PlaceOrderRequest) ExecutionReport {
+		report, err := ex.PlaceOrder(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	var resting []uint64
+	for _, price := range []float64{101, 102} {
+		resting = append(resting, place(PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(price), Market: MarketEth}).OrderID)
+	}
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(3), Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilledSize != sz(3) || report.Remaining != sz(0) || report.AvgPrice != px(304.0/3) || report.WorstPrice != px(102) || report.LevelsTouched != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report.OrderID == 0 || report.Rested || len(report.Trades) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if trade := report.Trades[1]; trade.Price != px(102) || trade.Size != sz(1) || trade.CounterpartySide != orderbook.SideAsk || trade.CounterpartyID != resting[1] {
+		t.Fatalf("unexpected trade %+v", trade)
+	}
+
+	depth, err := ex.GetDepth(MarketEth, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Level{{Price: px(102), Size: sz(1)}}; !reflect.DeepEqual(depth.Asks, want) || depth.Sequence != 3 {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+
+	result, err := ex.Cancel(ctx, CancelRequest{Market: MarketEth, Side: orderbook.SideAsk, PriceFrom: px(100), PriceTo: px(110)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled := result.Cancelled; len(cancelled) != 1 || cancelled[0].Price != px(102) || cancelled[0].Remaining != sz(1) {
+		t.Fatalf("unexpected cancels %+v", cancelled)
+	}
+
+	// a limit order that crosses rests what it doesn't fill, and can be
+	// cancelled by the ID it is given
+	ask := place(PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(101), Market: MarketEth}).OrderID
+	report = place(PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1.5), Price: px(101), Market: MarketEth})
+	if !report.Rested || report.Remaining != sz(0.5) || len(report.Trades) != 1 || report.Trades[0].CounterpartyID != ask {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if export, _ := ex.Export(MarketEth); export.Bids[0].Orders[0].ID != report.OrderID {
+		t.Fatalf("expected order %d to rest, got %+v", report.OrderID, export.Bids)
+	}
+	if _, err := ex.CancelOrder(ctx, 0, report.OrderID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlaceOrderRejections(t *testing.T) {
+	ex := New(Config{
+		AnonymousOrders: true,
+		Limits:          map[Market]MarketConfig{MarketEth: {MaxOrderSize: sz(5)}},
+	})
+	defer ex.Close()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		req  PlaceOrderRequest
+		code string
+	}{
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(9), Price: px(100), Market: MarketEth}, "MAX_ORDER_SIZE"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: "DOGE"}, "MARKET_NOT_FOUND"},
+		{PlaceOrderRequest{Type: "STOP", Size: sz(1), Price: px(100), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(0), Price: px(100), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(-1), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), Market: MarketEth}, "INSUFFICIENT_LIQUIDITY"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), TimeInForce: "DAY", Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(100), TimeInForce: orderbook.FillOrKill, Market: MarketEth}, "FOK_NOT_FILLABLE"},
+		{PlaceOrderRequest{Type: MarketOrder, Size: sz(1), TimeInForce: orderbook.ImmediateOrCancel, Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), TimeInForce: orderbook.GoodTillDate, Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), ExpiresAt: 1, Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), TimeInForce: orderbook.GoodTillDate, ExpiresAt: 1, Market: MarketEth}, "ALREADY_EXPIRED"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), DisplaySize: sz(-1), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: StopMarketOrder, Size: sz(1), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Notional: 100, Price: px(100), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: MarketOrder, Size: sz(1), Notional: 100, Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: 100, Market: MarketEth}, "INSUFFICIENT_LIQUIDITY"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), WorstPrice: px(100), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), MaxSlippageBps: 50, Market: MarketEth}, "INSUFFICIENT_LIQUIDITY"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), StopPrice: px(100), Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), DisplaySize: sz(1), TimeInForce: orderbook.ImmediateOrCancel, Market: MarketEth}, "INVALID_REQUEST"},
+		{PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), ClientOrderID: strings.Repeat("x", MaxClientOrderIDLength+1), Market: MarketEth}, "INVALID_REQUEST"},
+	} {
+		_, err := ex.PlaceOrder(ctx, tc.req)
+		var rejection *Rejection
+		if !errors.As(err, &rejection) || rejection.Code != tc.code {
+			t.Fatalf("expected a %s rejection, got %v", tc.code, err)
+		}
+	}
+
+	if _, err := ex.GetDepth("DOGE", 10); !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected ErrMarketNotFound, got %v", err)
+	}
+	if _, err := ex.SandboxSeed(MarketEth, SeedRequest{Mid: px(100), Step: px(1), Levels: 1, Size: sz(1)}); !errors.Is(err, ErrSandboxDisabled) {
+		t.Fatalf("expected ErrSandboxDisabled, got %v", err)
+	}
+	if _, err := ex.SandboxFaucet(1, ledger.USD, 100); !errors.Is(err, ErrSandboxDisabled) {
+		t.Fatalf("expected ErrSandboxDisabled, got %v", err)
+	}
+}
+
+func TestOrderTimeout(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true, OrderTimeout: 20 * time.Millisecond})
+	defer ex.Close()
+	ob := ex.orderbooks[MarketEth]
+	req := PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(100), Market: MarketEth}
+
+	// a request stuck behind a long-held lock gives up and never lands
+	ob.Lock()
+	_, err := ex.PlaceOrder(context.Background(), req)
+	ob.Unlock()
+	var rejection *Rejection
+	if !errors.As(err, &rejection) || rejection.Code != "ENGINE_TIMEOUT" {
+		t.Fatalf("expected ENGINE_TIMEOUT, got %v", err)
+	}
+
+	// a caller that went away before its order reached the book
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ex.PlaceOrder(ctx, req); !errors.As(err, &rejection) || rejection.Code != "REQUEST_CANCELLED" {
+		t.Fatalf("expected REQUEST_CANCELLED, got %v", err)
+	}
+
+	// the abandoned waiter hands the lock back without mutating
+	ob.Lock()
+	defer ob.Unlock()
+	if ob.Sequence() != 0 || ob.RestingOrders() != 0 {
+		t.Fatalf("cancelled requests mutated the book: seq %d, %d resting", ob.Sequence(), ob.RestingOrders())
+	}
+}
+
+func TestDepthsTimeout(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	if _, err := ex.PlaceOrder(context.Background(), PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(99), Market: MarketBtc}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a market whose book can't be read in time is stubbed, the rest still answer
+	ex.orderbooks[MarketEth].Lock()
+	books := ex.GetDepths([]Market{MarketEth, MarketBtc, "DOGE"}, 10)
+	ex.orderbooks[MarketEth].Unlock()
+	if books[0].Error == "" || books[1].Error != "" || len(books[1].Bids) != 1 || books[2].Error == "" {
+		t.Fatalf("expected ETH to time out, BTC to answer and DOGE to be unknown, got %+v", books)
+	}
+}
+
+func TestSubscribeTicker(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true, TickerInterval: 10 * time.Millisecond})
+	defer ex.Close()
+
+	updates, unsubscribe, err := ex.Subscribe(MarketEth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	if _, err := ex.PlaceOrder(context.Background(), PlaceOrderRequest{Type: LimitOrder, Size: sz(3), Price: px(101), Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-updates:
+		if got.Ask != px(101) || got.AskSize != sz(3) || got.Seq != 1 {
+			t.Fatalf("unexpected ticker %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ticker update")
+	}
+	if ticker, _ := ex.Ticker(MarketEth); ticker.Ask != px(101) {
+		t.Fatalf("unexpected ticker %+v", ticker)
+	}
+	if _, _, err := ex.Subscribe("DOGE"); !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected ErrMarketNotFound, got %v", err)
+	}
+}
+
+func TestTickerFeedConflates(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	feed := newTickerFeed(20*time.Millisecond, clk)
+	sub := feed.Subscribe()
+	defer feed.Unsubscribe(sub)
+
+	for i := 1; i <= 10; i++ {
+		feed.Publish(Ticker{Market: MarketEth, Bid: px(float64(100 + i)), Seq: uint64(i)})
+	}
+	// unchanged quotes don't count as updates
+	feed.Publish(Ticker{Market: MarketEth, Bid: px(110), Seq: 11})
+
+	clk.Advance(19 * time.Millisecond)
+	select {
+	case got := <-sub:
+		t.Fatalf("flushed before the interval passed: %+v", got)
+	default:
+	}
+
+	clk.Advance(time.Millisecond)
+	select {
+	case got := <-sub:
+		if got.Bid != px(110) || got.Seq != 10 {
+			t.Fatalf("expected the final state, got %+v", got)
+		}
+	default:
+		t.Fatal("no ticker update")
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case got := <-sub:
+		t.Fatalf("burst produced a second message %+v", got)
+	default:
+	}
+}
+
+func TestExchangeClock(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	store := NewMemoryAuditStore()
+	ex := New(Config{AnonymousOrders: true, Clock: clk, AuditStore: store})
+	ctx := context.Background()
+
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth})
+	clk.Advance(90 * time.Second)
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), Market: MarketEth})
+
+	ticker, _ := ex.Ticker(MarketEth)
+	ex.Close()
+	records, _ := store.Query(AuditQuery{})
+	if ticker.Last != px(100) || ticker.Ts != start.Add(90*time.Second).UnixNano() {
+		t.Fatalf("unexpected ticker %+v", ticker)
+	}
+	if len(records) != 2 || records[0].Timestamp != start.UnixNano() || records[1].Timestamp != start.Add(90*time.Second).UnixNano() {
+		t.Fatalf("unexpected audit timestamps %+v", records)
+	}
+}
+
+func TestImmediateOrCancel(t *testing.T) {
+	ex := New(Config{
+		AnonymousOrders: true,
+		Limits:          map[Market]MarketConfig{MarketEth: {MaxOpenOrders: 2}},
+	})
+	defer ex.Close()
+	ctx := context.Background()
+	var resting []uint64
+	for _, price := range []float64{101, 103} {
+		report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(price), Market: MarketEth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resting = append(resting, report.OrderID)
+	}
+	var got []Event
+	ex.HandleEvents(func(events []Event) {
+		got = append(got, events...)
+	}, EventOrderDone)
+
+	// the book is at its cap, but an IOC order never rests so it is let in
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(3), Price: px(102), TimeInForce: orderbook.ImmediateOrCancel, Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilledSize != sz(1) || report.Remaining != sz(2) || report.Rested {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	depth, _ := ex.GetDepth(MarketEth, 10)
+	if want := []Level{{Price: px(103), Size: sz(1)}}; !reflect.DeepEqual(depth.Asks, want) || len(depth.Bids) != 0 {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+	// the dropped remainder leaves like a cancelled order
+	want := []Event{
+		{Type: EventOrderDone, Market: MarketEth, Seq: 3, OrderID: resting[0], Price: px(101)},
+		{Type: EventOrderDone, Market: MarketEth, Seq: 3, OrderID: report.OrderID, Bid: true, Price: px(102), Size: sz(2)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events\n%+v\ngot\n%+v", want, got)
+	}
+}
+
+func TestGoodTillDate(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	ex := New(Config{AnonymousOrders: true, Clock: clk})
+	defer ex.Close()
+	ctx := context.Background()
+	var got []Event
+	ex.HandleEvents(func(events []Event) {
+		got = append(got, events...)
+	}, EventOrderDone)
+
+	place := func(price float64, ttl time.Duration) ExecutionReport {
+		report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(price), TimeInForce: orderbook.GoodTillDate, ExpiresAt: start.Add(ttl).UnixNano(), Market: MarketEth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	late := place(102, 2*time.Minute)
+	early := place(101, time.Minute)
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(103), Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(59 * time.Second)
+	if len(got) != 0 {
+		t.Fatalf("unexpected events %+v", got)
+	}
+	// the earlier order expires on its own, then the timer moves on to the
+	// next one
+	clk.Advance(time.Second)
+	want := []Event{{Type: EventOrderDone, Market: MarketEth, Seq: 4, OrderID: early.OrderID, Price: px(101), Size: sz(1)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events\n%+v\ngot\n%+v", want, got)
+	}
+	if _, err := ex.CancelOrder(ctx, 0, early.OrderID); err == nil {
+		t.Fatal("expected the expired order to be gone")
+	}
+
+	// a cancel reports the expiry the order had
+	cancelled, err := ex.CancelOrder(ctx, 0, late.OrderID)
+	if err != nil || cancelled.ExpiresAt != start.Add(2*time.Minute).UnixNano() {
+		t.Fatalf("unexpected cancel %+v, %v", cancelled, err)
+	}
+	clk.Advance(time.Hour)
+	depth, _ := ex.GetDepth(MarketEth, 10)
+	if want := []Level{{Price: px(103), Size: sz(1)}}; !reflect.DeepEqual(depth.Asks, want) {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected the cancel as the only other event, got %+v", got)
+	}
+}
+
+func TestIceberg(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(10), DisplaySize: sz(2), Price: px(100), Market: MarketEth})
+	if err != nil || !report.Rested || report.Remaining != sz(10) {
+		t.Fatalf("unexpected report %+v, %v", report, err)
+	}
+	// the book endpoints only ever show the displayed tranche
+	depth, _ := ex.GetDepth(MarketEth, 10)
+	if want := []Level{{Price: px(100), Size: sz(2)}}; !reflect.DeepEqual(depth.Asks, want) {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+	book, _ := ex.Book(MarketEth, nil, nil)
+	if book.TotalAskVolume != sz(2) || len(book.Asks) != 1 || book.Asks[0].Size != sz(2) || book.Asks[0].OriginalSize != sz(2) {
+		t.Fatalf("unexpected book %+v", book)
+	}
+
+	// the hidden part still fills, replenishing the display as it goes
+	report, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(5), Market: MarketEth})
+	if err != nil || report.FilledSize != sz(5) || len(report.Trades) != 3 {
+		t.Fatalf("unexpected report %+v, %v", report, err)
+	}
+	book, _ = ex.Book(MarketEth, nil, nil)
+	if book.TotalAskVolume != sz(1) || book.Asks[0].Size != sz(1) || book.Asks[0].FilledSize != sz(5) {
+		t.Fatalf("unexpected book %+v", book)
+	}
+}
+
+func TestStopMarketOrder(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	place := func(req PlaceOrderRequest) ExecutionReport {
+		req.Market = MarketEth
+		report, err := ex.PlaceOrder(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	for _, ask := range []struct {
+		price orderbook.Price
+		size  orderbook.Size
+	}{{px(101), sz(1)}, {px(102), sz(2)}, {px(105), sz(5)}} {
+		place(PlaceOrderRequest{Type: LimitOrder, Size: ask.size, Price: ask.price})
+	}
+
+	// stops wait off the book
+	buyStop := place(PlaceOrderRequest{Type: StopMarketOrder, Bid: true, Size: sz(2), StopPrice: px(102)})
+	sellStop := place(PlaceOrderRequest{Type: StopMarketOrder, Size: sz(1), StopPrice: px(90)})
+	if buyStop.OrderID == 0 || buyStop.Rested || buyStop.FilledSize != sz(0) {
+		t.Fatalf("unexpected report %+v", buyStop)
+	}
+	place(PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1)})
+	depth, _ := ex.GetDepth(MarketEth, 10)
+	if want := []Level{{Price: px(102), Size: sz(2)}, {Price: px(105), Size: sz(5)}}; !reflect.DeepEqual(depth.Asks, want) {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+
+	// a trade at the stop price sends the buy stop in as a market order
+	report := place(PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1)})
+	if report.FilledSize != sz(1) || report.AvgPrice != px(102) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	depth, _ = ex.GetDepth(MarketEth, 10)
+	if want := []Level{{Price: px(105), Size: sz(4)}}; !reflect.DeepEqual(depth.Asks, want) {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+	var rejection *Rejection
+	if _, err := ex.CancelOrder(ctx, 0, buyStop.OrderID); !errors.As(err, &rejection) || rejection.Code != "ORDER_NOT_FOUND" {
+		t.Fatalf("expected the triggered stop to be gone, got %v", err)
+	}
+
+	// a stop the last trade is already through is refused
+	_, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Bid: true, Size: sz(1), StopPrice: px(104), Market: MarketEth})
+	if !errors.As(err, &rejection) || rejection.Code != "STOP_ALREADY_TRIGGERED" {
+		t.Fatalf("expected STOP_ALREADY_TRIGGERED, got %v", err)
+	}
+
+	// untriggered stops cancel by ID
+	if cancelled, err := ex.CancelOrder(ctx, 0, sellStop.OrderID); err != nil || cancelled.Remaining != sz(1) {
+		t.Fatalf("unexpected cancel %+v, %v", cancelled, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	var updates []OrderUpdate
+	ex.HandleOrderUpdates(func(batch []OrderUpdate) { updates = append(updates, batch...) })
+	ex.Deposit(1, ledger.ETH, 2)
+	place := func(req PlaceOrderRequest) ExecutionReport {
+		req.Market = MarketEth
+		report, err := ex.PlaceOrder(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	place(PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(101), User: 1})
+	stop := place(PlaceOrderRequest{Type: StopMarketOrder, Size: sz(1), StopPrice: px(90), User: 1})
+	place(PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(0.5)})
+
+	// resting orders and stops go, their holds with them, but the stats
+	// stay unless asked
+	cancelled, _, err := ex.Reset(MarketEth, false)
+	if err != nil || cancelled != 2 {
+		t.Fatalf("expected the ask and the stop cancelled, got %d, %v", cancelled, err)
+	}
+	if held := ex.Held(1); held[ledger.ETH] != 0 {
+		t.Fatalf("expected nothing held, got %v", held)
+	}
+	if last := updates[len(updates)-1]; last.OrderID != stop.OrderID || last.Type != OrderUpdateCancelled || last.Remaining != sz(1) {
+		t.Fatalf("expected the stop's owner told it was cancelled, got %+v", last)
+	}
+	if _, err := ex.CancelOrder(ctx, 1, stop.OrderID); err == nil {
+		t.Fatal("expected the stop to be gone")
+	}
+	if stats, _ := ex.Stats(MarketEth); stats.OrdersMatched == 0 {
+		t.Fatalf("expected the stats kept, got %+v", stats.Stats)
+	}
+
+	if _, _, err := ex.Reset(MarketEth, true); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := ex.Stats(MarketEth); stats.OrdersPlaced != 0 || stats.OrdersMatched != 0 {
+		t.Fatalf("expected the stats cleared, got %+v", stats.Stats)
+	}
+}
+
+func TestNotionalMarketOrder(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	for _, ask := range []struct {
+		price orderbook.Price
+		size  orderbook.Size
+	}{{px(1000), sz(1)}, {px(1100), sz(2)}} {
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: ask.size, Price: ask.price, Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1,000 buys the first level, the other 550 half a unit of the next
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: 1550, Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilledSize != sz(1.5) || report.Order.Size != sz(1.5) || report.LevelsTouched != 2 || report.WorstPrice != px(1100) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	var rejection *Rejection
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: 0.000001, Market: MarketEth})
+	if !errors.As(err, &rejection) || rejection.Code != "NOTIONAL_TOO_SMALL" {
+		t.Fatalf("expected NOTIONAL_TOO_SMALL, got %v", err)
+	}
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: 2000, Market: MarketEth})
+	if !errors.As(err, &rejection) || rejection.Code != "INSUFFICIENT_LIQUIDITY" {
+		t.Fatalf("expected INSUFFICIENT_LIQUIDITY, got %v", err)
+	}
+}
+
+func TestMarketOrderSlippage(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	for _, ask := range []struct {
+		price orderbook.Price
+		size  orderbook.Size
+	}{{px(100), sz(1)}, {px(101), sz(1)}, {px(105), sz(5)}} {
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: ask.size, Price: ask.price, Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []Event
+	ex.HandleEvents(func(events []Event) {
+		got = append(got, events...)
+	}, EventOrderDone)
+
+	// 200bps from the best ask stops the sweep short of 105
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(4), MaxSlippageBps: 200, Market: MarketEth})
+	if err != nil || report.FilledSize != sz(2) || report.Remaining != sz(2) || report.Rested || report.WorstPrice != px(101) {
+		t.Fatalf("unexpected report %+v, %v", report, err)
+	}
+	if last := got[len(got)-1]; last.Size != sz(2) || !last.Bid {
+		t.Fatalf("expected the remainder cancelled, got %+v", got)
+	}
+
+	// the tighter of the two bounds applies
+	report, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), WorstPrice: px(104), MaxSlippageBps: 1000, Market: MarketEth})
+	if err != nil || report.FilledSize != sz(0) || report.Remaining != sz(1) {
+		t.Fatalf("unexpected report %+v, %v", report, err)
+	}
+	depth, _ := ex.GetDepth(MarketEth, 10)
+	if want := []Level{{Price: px(105), Size: sz(5)}}; !reflect.DeepEqual(depth.Asks, want) || len(depth.Bids) != 0 {
+		t.Fatalf("unexpected depth %+v", depth)
+	}
+}
+
+func TestMatchPolicy(t *testing.T) {
+	ex := New(Config{
+		AnonymousOrders: true,
+		Limits:          map[Market]MarketConfig{MarketEth: {MatchPolicy: MatchPolicy{Type: MatchProRata, LotSize: sz(0.1)}}},
+	})
+	defer ex.Close()
+	ctx := context.Background()
+	for _, market := range []Market{MarketEth, MarketBtc} {
+		for _, size := range []float64{1, 3} {
+			if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(size), Price: px(100), Market: market}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(2.2), Market: market}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ETH splits the buy by size, floored to the lot with the remainder
+	// in time priority; BTC fills the first order first
+	remaining := func(market Market) []orderbook.Size {
+		book, err := ex.Book(market, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sizes []orderbook.Size
+		for _, o := range book.Asks {
+			sizes = append(sizes, o.Size)
+		}
+		return sizes
+	}
+	if got := remaining(MarketEth); !reflect.DeepEqual(got, []orderbook.Size{sz(0.4), sz(1.4)}) {
+		t.Fatalf("expected ETH's level filled pro rata, got %v", got)
+	}
+	if got := remaining(MarketBtc); !reflect.DeepEqual(got, []orderbook.Size{sz(1.8)}) {
+		t.Fatalf("expected BTC's level filled in time priority, got %v", got)
+	}
+	if limits, _ := ex.Limits(MarketBtc); limits.MatchPolicy.Type != MatchFIFO {
+		t.Fatalf("expected FIFO by default, got %+v", limits.MatchPolicy)
+	}
+}
+
+func TestOrderStatus(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	ex := New(Config{AnonymousOrders: true, Clock: clk, OrderHistory: 3})
+	defer ex.Close()
+	ctx := context.Background()
+	place := func(req PlaceOrderRequest) uint64 {
+		req.Market = MarketEth
+		report, err := ex.PlaceOrder(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.OrderID
+	}
+	status := func(id uint64) OrderRecord {
+		record, err := ex.Order(0, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+
+	ask := place(PlaceOrderRequest{Type: LimitOrder, Size: sz(3), Price: px(101)})
+	if got := status(ask); got.Status != OrderNew || got.OriginalSize != sz(3) || got.Remaining != sz(3) || got.CreatedAt != start.UnixNano() {
+		t.Fatalf("unexpected record %+v", got)
+	}
+	place(PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(102)})
+
+	clk.Advance(time.Second)
+	buy := place(PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(2)})
+	want := OrderRecord{ID: ask, Market: MarketEth, Price: px(101), Status: OrderPartiallyFilled, OriginalSize: sz(3), FilledSize: sz(2), Remaining: sz(1), AvgPrice: px(101), CreatedAt: start.UnixNano(), UpdatedAt: clk.Now().UnixNano()}
+	if got := status(ask); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if got := status(buy); got.Status != OrderFilled || got.FilledSize != sz(2) || got.AvgPrice != px(101) {
+		t.Fatalf("unexpected record %+v", got)
+	}
+
+	// the average covers fills across levels
+	sweep := place(PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(4), Price: px(102), TimeInForce: orderbook.ImmediateOrCancel})
+	if got := status(sweep); got.Status != OrderCancelled || got.FilledSize != sz(2) || got.Remaining != sz(2) || got.AvgPrice != px(101.5) {
+		t.Fatalf("unexpected record %+v", got)
+	}
+	if got := status(ask); got.Status != OrderFilled || got.Remaining != sz(0) {
+		t.Fatalf("unexpected record %+v", got)
+	}
+
+	// only the most recent finished orders are kept
+	if _, err := ex.Order(0, buy); err == nil {
+		t.Fatal("expected the oldest finished order to be forgotten")
+	}
+	var rejection *Rejection
+	if _, err := ex.Order(0, sweep+100); !errors.As(err, &rejection) || rejection.Code != "ORDER_NOT_FOUND" {
+		t.Fatalf("expected ORDER_NOT_FOUND, got %v", err)
+	}
+
+	// a cancelled stop finishes without reaching the book
+	stop := place(PlaceOrderRequest{Type: StopMarketOrder, Bid: true, Size: sz(1), StopPrice: px(110)})
+	if got := status(stop); got.Status != OrderNew || got.StopPrice != px(110) {
+		t.Fatalf("unexpected record %+v", got)
+	}
+	if _, err := ex.CancelOrder(ctx, 0, stop); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(stop); got.Status != OrderCancelled || got.StopPrice != px(0) {
+		t.Fatalf("unexpected record %+v", got)
+	}
+}
+
+func TestReduceThenCancel(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(5), Price: px(100), Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.ReduceOrder(ctx, 0, report.OrderID, ReduceRequest{By: sz(2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size reduced away was never filled
+	book, err := ex.Book(MarketEth, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := book.Asks[0]; o.OriginalSize != sz(3) || o.FilledSize != 0 {
+		t.Fatalf("unexpected resting order %+v", o)
+	}
+	cancelled, err := ex.CancelOrder(ctx, 0, report.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.FilledSize != 0 || cancelled.Remaining != sz(3) {
+		t.Fatalf("unexpected cancel %+v", cancelled)
+	}
+}
+
+func TestClientOrderIDWindow(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := New(Config{AnonymousOrders: true, Clock: clk, ClientOrderIDWindow: time.Minute})
+	defer ex.Close()
+	ctx := context.Background()
+	place := func(market Market) error {
+		_, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), ClientOrderID: "a", Market: market})
+		return err
+	}
+
+	if err := place(MarketEth); err != nil {
+		t.Fatal(err)
+	}
+	// client order IDs are unique across markets
+	var rejection *Rejection
+	if err := place(MarketBtc); !errors.As(err, &rejection) || rejection.Code != "DUPLICATE_CLIENT_ORDER_ID" {
+		t.Fatalf("expected DUPLICATE_CLIENT_ORDER_ID, got %v", err)
+	}
+	clk.Advance(59 * time.Second)
+	if err := place(MarketEth); err == nil {
+		t.Fatal("expected the ID to be taken within the window")
+	}
+	clk.Advance(time.Second)
+	if err := place(MarketBtc); err != nil {
+		t.Fatalf("expected the ID to be free after the window, got %v", err)
+	}
+	if record, err := ex.OrderByClientID(0, "a"); err != nil || record.Market != MarketBtc {
+		t.Fatalf("expected the BTC order, got %+v, %v", record, err)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice, bob = 1, 2
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(bob, ledger.ETH, 1)
+	balances := func(user uint64, asset ledger.Asset, free, held float64) {
+		t.Helper()
+		if got := ex.Balances(user)[asset]; got != free {
+			t.Fatalf("expected user %d to have %v %s free, got %v", user, free, asset, got)
+		}
+		if got := ex.Held(user)[asset]; got != held {
+			t.Fatalf("expected user %d to hold %v %s, got %v", user, held, asset, got)
+		}
+	}
+	insufficient := func(err error) {
+		t.Helper()
+		var rejection *Rejection
+		if !errors.As(err, &rejection) || rejection.Code != "INSUFFICIENT_FUNDS" {
+			t.Fatalf("expected INSUFFICIENT_FUNDS, got %v", err)
+		}
+	}
+
+	// a bid holds its cost at its limit price, an ask its size
+	bid, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(4), Price: px(200), User: alice, Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 200, 800)
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(200), User: alice, Market: MarketEth})
+	insufficient(err)
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(300), User: bob, Market: MarketEth})
+	insufficient(err)
+	balances(bob, ledger.ETH, 1, 0)
+
+	// a trade is paid for out of what the orders hold
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Size: sz(1), User: bob, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 200, 600)
+	balances(alice, ledger.ETH, 1, 0)
+	balances(bob, ledger.ETH, 0, 0)
+	balances(bob, ledger.USD, 200, 0)
+
+	// an amendment holds what it needs first
+	if _, err := ex.ModifyOrder(ctx, alice, bid.OrderID, ModifyRequest{Price: px(300), Size: sz(3)}); err == nil {
+		t.Fatal("expected an amendment beyond alice's funds to be refused")
+	}
+	balances(alice, ledger.USD, 200, 600)
+	if _, err := ex.ModifyOrder(ctx, alice, bid.OrderID, ModifyRequest{Price: px(250), Size: sz(3)}); err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 50, 750)
+
+	// a market buy holds what sweeping the book costs while it matches
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(260), Market: MarketEth})
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), User: alice, Market: MarketEth})
+	insufficient(err)
+
+	// an anonymous seller is paid from outside the ledger
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(240), TimeInForce: orderbook.ImmediateOrCancel, Market: MarketEth})
+	balances(alice, ledger.USD, 50, 500)
+	balances(alice, ledger.ETH, 2, 0)
+
+	// cancelling releases the rest
+	if _, err := ex.CancelOrder(ctx, alice, bid.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 550, 0)
+
+	// buying below the limit price releases what the better price saved
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(300), User: alice, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 290, 0)
+	balances(alice, ledger.ETH, 3, 0)
+
+	// a stop holds until it is cancelled
+	stop, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Bid: true, Size: sz(1), StopPrice: px(290), User: alice, Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 0, 290)
+	if _, err := ex.CancelOrder(ctx, alice, stop.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	balances(alice, ledger.USD, 290, 0)
+
+	// unless anonymous orders are let in, nothing backs an order without a
+	// user
+	funded := New(Config{})
+	defer funded.Close()
+	_, err = funded.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1000), Price: px(100), Market: MarketEth})
+	insufficient(err)
+	if depth, _ := funded.GetDepth(MarketEth, 10); len(depth.Asks) != 0 {
+		t.Fatalf("expected the anonymous order kept off the book, got %+v", depth)
+	}
+}
+
+func TestFees(t *testing.T) {
+	ex := New(Config{Limits: map[Market]MarketConfig{MarketEth: {MakerFee: 0.001, TakerFee: 0.002}}})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice, bob = 1, 2
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(bob, ledger.ETH, 2)
+
+	// bob's resting ask makes, alice's bid takes; each pays out of what
+	// they receive
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(250), User: bob, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	var settled []Settlement
+	ex.HandleSettlements(func(s Settlement) { settled = append(settled, s) })
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(250), User: alice, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ex.Balances(alice); got[ledger.USD] != 500 || got[ledger.ETH] != 1.996 {
+		t.Fatalf("expected alice to have 500 USD and 1.996 ETH, got %v", got)
+	}
+	if got := ex.Balances(bob); got[ledger.USD] != 499.5 || got[ledger.ETH] != 0 {
+		t.Fatalf("expected bob to have 499.5 USD, got %v", got)
+	}
+	if got := ex.Ledger().Balances(ledger.Fees); got[ledger.USD] != 0.5 || got[ledger.ETH] != 0.004 {
+		t.Fatalf("expected 0.5 USD and 0.004 ETH in fees, got %v", got)
+	}
+	if len(settled) != 1 || settled[0].BuyerFee != 0.004 || settled[0].SellerFee != 0.5 {
+		t.Fatalf("expected the settlement to carry the fees, got %+v", settled)
+	}
+
+	// a new schedule charges the next trade
+	zero := 0.0
+	if _, err := ex.PatchLimits(MarketEth, LimitsPatch{TakerFee: &zero}); err != nil {
+		t.Fatal(err)
+	}
+	one := 1.0
+	if _, err := ex.PatchLimits(MarketEth, LimitsPatch{MakerFee: &one}); err == nil {
+		t.Fatal("expected a fee of everything to be refused")
+	}
+	ex.Deposit(bob, ledger.ETH, 1)
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(100), User: alice, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), User: bob, Market: MarketEth})
+	if got := ex.Ledger().Balances(ledger.Fees); got[ledger.ETH] != 0.005 || got[ledger.USD] != 0.5 {
+		t.Fatalf("expected only alice's maker fee charged, got %v", got)
+	}
+
+	// a fee is rounded down, the dust below the ledger's precision staying
+	// with the trader: bob's 0.3% of 33.33333333 is 0.09999999
+	three := 0.003
+	ex.PatchLimits(MarketEth, LimitsPatch{TakerFee: &three})
+	ex.Deposit(bob, ledger.ETH, 1)
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(33.33333333), User: alice, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Size: sz(1), User: bob, Market: MarketEth})
+	if fee := settled[len(settled)-1].SellerFee; fee != 0.09999999 {
+		t.Fatalf("expected a fee of 0.09999999, got %v", fee)
+	}
+	if got := ex.Balances(bob)[ledger.USD]; got != 499.5+100+33.23333334 {
+		t.Fatalf("expected bob to keep the dust, got %v USD", got)
+	}
+
+	// each market's fees are reported with what is left to withdraw
+	fees := ex.Fees()
+	if got := fees.Markets[MarketEth]; got[ledger.USD] != 0.59999999 || got[ledger.ETH] != 0.006 {
+		t.Fatalf("expected ETH-USD to have collected 0.59999999 USD and 0.006 ETH, got %v", got)
+	}
+	if len(fees.Markets[MarketBtc]) != 0 || !maps.Equal(fees.Balances, ex.Ledger().Balances(ledger.Fees)) {
+		t.Fatalf("unexpected report %+v", fees)
+	}
+	const operator = 3
+	if _, err := ex.WithdrawFees(operator, ledger.USD, 1); !errors.Is(err, ledger.ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	if _, err := ex.WithdrawFees(operator, ledger.USD, 0.59999999); err != nil {
+		t.Fatal(err)
+	}
+	fees = ex.Fees()
+	if fees.Balances[ledger.USD] != 0 || fees.Markets[MarketEth][ledger.USD] != 0.59999999 || ex.Balances(operator)[ledger.USD] != 0.59999999 {
+		t.Fatalf("expected the fees paid to the operator and still reported as collected, got %+v", fees)
+	}
+}
+
+// TestFeesConserved trades at random between a few users, at fee rates that
+// leave dust, and checks that the fee account holds exactly the fees each
+// trade recorded and that nothing was made or lost.
+func TestFeesConserved(t *testing.T) {
+	config := MarketConfig{MakerFee: 0.0013, TakerFee: 0.0027}
+	ex := New(Config{Limits: map[Market]MarketConfig{MarketEth: config, MarketBtc: config}})
+	defer ex.Close()
+	ctx := context.Background()
+	const users = 6
+	deposited := map[ledger.Asset]float64{ledger.USD: users * 100_000, ledger.ETH: users * 100, ledger.BTC: users * 100}
+	for user := uint64(1); user <= users; user++ {
+		for asset, amount := range deposited {
+			ex.Deposit(user, asset, amount/users)
+		}
+	}
+	charged := make(map[ledger.Asset]float64)
+	ex.HandleSettlements(func(s Settlement) {
+		charged[s.Base] = ledger.Round(charged[s.Base] + s.BuyerFee)
+		charged[s.Quote] = ledger.Round(charged[s.Quote] + s.SellerFee)
+	})
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 2000 {
+		req := PlaceOrderRequest{
+			Type:   LimitOrder,
+			Bid:    rng.IntN(2) == 0,
+			Size:   sz(float64(1+rng.IntN(300)) / 100),
+			Price:  px(95 + float64(rng.IntN(1000))/100),
+			User:   uint64(1 + rng.IntN(users)),
+			Market: []Market{MarketEth, MarketBtc}[rng.IntN(2)],
+		}
+		if rng.IntN(5) == 0 {
+			req.Type, req.Price = MarketOrder, 0
+		}
+		ex.PlaceOrder(ctx, req)
+	}
+
+	fees := ex.Fees()
+	for asset, want := range charged {
+		if got := fees.Balances[asset]; got != want {
+			t.Errorf("expected the fee account to hold the %v %s charged, got %v", want, asset, got)
+		}
+		if got := ledger.Round(fees.Markets[MarketEth][asset] + fees.Markets[MarketBtc][asset]); got != want {
+			t.Errorf("expected the markets to have collected %v %s, got %v", want, asset, got)
+		}
+	}
+	if charged[ledger.USD] == 0 || charged[ledger.ETH] == 0 || charged[ledger.BTC] == 0 {
+		t.Fatalf("expected fees charged in every asset, got %v", charged)
+	}
+
+	// paying the fees out to an operator moves them, and still nothing is
+	// made or lost
+	const operator = users + 1
+	for asset, amount := range charged {
+		if _, err := ex.WithdrawFees(operator, asset, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := ex.Ledger().Balances(ledger.Fees); len(got) != 0 {
+		t.Fatalf("expected the fee account emptied, got %v", got)
+	}
+	for asset, want := range deposited {
+		total := 0.0
+		for user := uint64(1); user <= operator; user++ {
+			total = ledger.Round(total + ex.Balances(user)[asset] + ex.Held(user)[asset])
+		}
+		if total != want {
+			t.Errorf("expected users to hold the %v %s deposited, got %v", want, asset, total)
+		}
+	}
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	ctx := context.Background()
+	const alice = 1
+	// alice's ask sits between two anonymous ones, and she buys through all
+	// three
+	setup := func(t *testing.T) (*Exchange, uint64) {
+		t.Helper()
+		ex := New(Config{AnonymousOrders: true})
+		t.Cleanup(ex.Close)
+		ex.Deposit(alice, ledger.USD, 1000)
+		ex.Deposit(alice, ledger.ETH, 2)
+		ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth})
+		own, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(100), User: alice, Market: MarketEth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(101), Market: MarketEth})
+		return ex, own.OrderID
+	}
+	buy := func(mode SelfTradePrevention) PlaceOrderRequest {
+		return PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(4), Price: px(101), User: alice, Market: MarketEth, SelfTradePrevention: mode}
+	}
+	asks := func(t *testing.T, ex *Exchange, want ...Level) {
+		t.Helper()
+		depth, err := ex.GetDepth(MarketEth, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(depth.Asks, want) {
+			t.Fatalf("expected asks %v, got %v", want, depth.Asks)
+		}
+	}
+
+	tests := []struct {
+		mode      SelfTradePrevention
+		original  orderbook.Size
+		filled    orderbook.Size
+		remaining orderbook.Size
+		rested    bool
+		kept      bool
+		asks      []Level
+	}{
+		// the rest of the buy is dropped on reaching alice's ask
+		{mode: "", original: sz(4), filled: sz(1), remaining: sz(3), kept: true, asks: []Level{{px(100), sz(2)}, {px(101), sz(2)}}},
+		{mode: STPCancelNewest, original: sz(4), filled: sz(1), remaining: sz(3), kept: true, asks: []Level{{px(100), sz(2)}, {px(101), sz(2)}}},
+		// alice's ask goes and the buy carries on past it
+		{mode: STPCancelOldest, original: sz(4), filled: sz(3), remaining: sz(1), rested: true, asks: nil},
+		{mode: STPCancelBoth, original: sz(4), filled: sz(1), remaining: sz(3), asks: []Level{{px(101), sz(2)}}},
+		// the 2 the two would have traded comes off both
+		{mode: STPDecrement, original: sz(2), filled: sz(2), remaining: sz(0), asks: []Level{{px(101), sz(1)}}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			ex, own := setup(t)
+			report, err := ex.PlaceOrder(ctx, buy(tt.mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.OriginalSize != tt.original || report.FilledSize != tt.filled || report.Remaining != tt.remaining || report.Rested != tt.rested {
+				t.Fatalf("expected %v placed, %v filled, %v left and rested %v, got %+v", tt.original, tt.filled, tt.remaining, tt.rested, report)
+			}
+			for _, trade := range report.Trades {
+				if trade.CounterpartyID == own {
+					t.Fatalf("expected no trade with alice's own ask, got %+v", report.Trades)
+				}
+			}
+			record, err := ex.Order(alice, own)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := record.Status == OrderNew; kept != tt.kept {
+				t.Fatalf("expected alice's ask kept %v, got %+v", tt.kept, record)
+			}
+			asks(t, ex, tt.asks...)
+			if record, _ := ex.Order(alice, report.OrderID); tt.remaining > 0 && !tt.rested && record.Status != OrderCancelled {
+				t.Fatalf("expected the dropped buy cancelled, got %+v", record)
+			}
+		})
+	}
+
+	t.Run("fill or kill", func(t *testing.T) {
+		ex, _ := setup(t)
+		req := buy(STPCancelNewest)
+		req.TimeInForce = orderbook.FillOrKill
+		var rejection *Rejection
+		if _, err := ex.PlaceOrder(ctx, req); !errors.As(err, &rejection) || rejection.Code != "FOK_NOT_FILLABLE" {
+			t.Fatalf("expected FOK_NOT_FILLABLE, got %v", err)
+		}
+		// without alice's ask there is only 3 to fill 4 from
+		req.SelfTradePrevention = STPCancelOldest
+		if _, err := ex.PlaceOrder(ctx, req); !errors.As(err, &rejection) || rejection.Code != "FOK_NOT_FILLABLE" {
+			t.Fatalf("expected FOK_NOT_FILLABLE, got %v", err)
+		}
+		asks(t, ex, Level{px(100), sz(3)}, Level{px(101), sz(2)})
+	})
+
+	t.Run("market", func(t *testing.T) {
+		ex, own := setup(t)
+		report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(4), User: alice, Market: MarketEth, SelfTradePrevention: STPCancelOldest})
+		if err == nil {
+			t.Fatalf("expected the market buy refused for want of other sellers, got %+v", report)
+		}
+		asks(t, ex, Level{px(100), sz(3)}, Level{px(101), sz(2)})
+		if report, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(3), User: alice, Market: MarketEth, SelfTradePrevention: STPCancelOldest}); err != nil {
+			t.Fatal(err)
+		}
+		if report.FilledSize != sz(3) {
+			t.Fatalf("expected 3 filled, got %+v", report)
+		}
+		if record, _ := ex.Order(alice, own); record.Status != OrderCancelled {
+			t.Fatalf("expected alice's ask cancelled, got %+v", record)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		ex, own := setup(t)
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Bid: true, Size: sz(2), StopPrice: px(100), User: alice, Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+		// bob's trade at 100 sets the stop off into alice's ask
+		ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(0.5), Price: px(100), Market: MarketEth})
+		if record, _ := ex.Order(alice, own); record.Status != OrderNew || record.Remaining != sz(2) {
+			t.Fatalf("expected alice's ask untouched, got %+v", record)
+		}
+		asks(t, ex, Level{px(100), sz(2)}, Level{px(101), sz(2)})
+	})
+
+	// bob's ask at 100 goes, leaving his market buy to sweep alice's at 200
+	// with only 150 to pay for it; ahead is anonymous size at 100 before
+	// bob's ask
+	sweep := func(t *testing.T, ahead orderbook.Size) (*Exchange, uint64) {
+		t.Helper()
+		const bob = 2
+		ex := New(Config{AnonymousOrders: true})
+		t.Cleanup(ex.Close)
+		ex.Deposit(alice, ledger.ETH, 1)
+		ex.Deposit(bob, ledger.ETH, 1)
+		ex.Deposit(bob, ledger.USD, 150)
+		if ahead > 0 {
+			ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: ahead, Price: px(100), Market: MarketEth})
+		}
+		own, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), User: bob, Market: MarketEth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(200), User: alice, Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+		return ex, own.OrderID
+	}
+	unmoved := func(t *testing.T, ex *Exchange, own uint64) {
+		t.Helper()
+		if record, _ := ex.Order(2, own); record.Status != OrderNew {
+			t.Fatalf("expected bob's ask kept, got %+v", record)
+		}
+		asks(t, ex, Level{px(100), sz(1)}, Level{px(200), sz(1)})
+		// both asks hold their ETH
+		if got := ex.Balances(2); got[ledger.USD] != 150 || got[ledger.ETH] != 0 {
+			t.Fatalf("expected bob's balances unmoved, got %v", got)
+		}
+		if got := ex.Balances(alice); got[ledger.USD] != 0 || got[ledger.ETH] != 0 {
+			t.Fatalf("expected alice's balances unmoved, got %v", got)
+		}
+	}
+
+	t.Run("market sweep past own asks", func(t *testing.T) {
+		ex, own := sweep(t, 0)
+		var rejection *Rejection
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), User: 2, Market: MarketEth, SelfTradePrevention: STPCancelOldest}); !errors.As(err, &rejection) || rejection.Code != "INSUFFICIENT_FUNDS" {
+			t.Fatalf("expected INSUFFICIENT_FUNDS, got %v", err)
+		}
+		unmoved(t, ex, own)
+
+		// with the funds for it the buy settles at 200
+		ex.Deposit(2, ledger.USD, 50)
+		report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), User: 2, Market: MarketEth, SelfTradePrevention: STPCancelOldest})
+		if err != nil || report.FilledSize != sz(1) || report.AvgPrice != px(200) {
+			t.Fatalf("expected 1 filled at 200, got %+v, %v", report, err)
+		}
+		if got := ex.Balances(2); got[ledger.USD] != 0 || got[ledger.ETH] != 2 {
+			t.Fatalf("expected bob to have paid 200 for 1 ETH, got %v", got)
+		}
+	})
+
+	t.Run("stop sweep past own asks", func(t *testing.T) {
+		// the anonymous ask ahead of bob's trades at 100, setting the stop off
+		ex, own := sweep(t, sz(0.5))
+		stop, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Bid: true, Size: sz(1), StopPrice: px(100), User: 2, Market: MarketEth, SelfTradePrevention: STPCancelOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(0.5), Market: MarketEth})
+		if record, _ := ex.Order(2, stop.OrderID); record.Status != OrderCancelled || record.FilledSize != 0 {
+			t.Fatalf("expected the stop dropped for want of funds, got %+v", record)
+		}
+		unmoved(t, ex, own)
+	})
+
+	t.Run("amend", func(t *testing.T) {
+		for _, tt := range []struct {
+			mode   SelfTradePrevention
+			filled orderbook.Size
+			kept   bool
+			asks   []Level
+		}{
+			// the amended bid reaches alice's ask first and is dropped
+			{mode: "", filled: 0, kept: true, asks: []Level{{px(100), sz(2)}}},
+			// alice's ask goes and the bid takes the anonymous one behind it
+			{mode: STPCancelOldest, filled: sz(1), kept: false, asks: nil},
+		} {
+			t.Run(string(tt.mode), func(t *testing.T) {
+				ex := New(Config{AnonymousOrders: true})
+				t.Cleanup(ex.Close)
+				ex.Deposit(alice, ledger.USD, 1000)
+				ex.Deposit(alice, ledger.ETH, 1)
+				own, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), User: alice, Market: MarketEth})
+				ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth})
+				bid, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(90), User: alice, Market: MarketEth, SelfTradePrevention: tt.mode})
+				if err != nil {
+					t.Fatal(err)
+				}
+				report, err := ex.ModifyOrder(ctx, alice, bid.OrderID, ModifyRequest{Price: px(100), Size: sz(1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.FilledSize != tt.filled || report.Rested {
+					t.Fatalf("expected %v filled and nothing rested, got %+v", tt.filled, report)
+				}
+				for _, trade := range report.Trades {
+					if trade.CounterpartyID == own.OrderID {
+						t.Fatalf("expected no trade with alice's own ask, got %+v", report.Trades)
+					}
+				}
+				if record, _ := ex.Order(alice, own.OrderID); (record.Status == OrderNew) != tt.kept {
+					t.Fatalf("expected alice's ask kept %v, got %+v", tt.kept, record)
+				}
+				if record, _ := ex.Order(alice, bid.OrderID); tt.filled == 0 && record.Status != OrderCancelled {
+					t.Fatalf("expected the dropped bid cancelled, got %+v", record)
+				}
+				asks(t, ex, tt.asks...)
+			})
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		ex, _ := setup(t)
+		var rejection *Rejection
+		if _, err := ex.PlaceOrder(ctx, buy("CANCEL_ALL")); !errors.As(err, &rejection) || rejection.Code != "INVALID_REQUEST" {
+			t.Fatalf("expected INVALID_REQUEST, got %v", err)
+		}
+	})
+}
+
+func TestSuspendUser(t *testing.T) {
+	ctx := context.Background()
+	const alice, bob = 1, 2
+	journal := &memoryJournal{}
+	ex := New(Config{Journal: journal, Limits: map[Market]MarketConfig{MarketEth: {MinRestingTime: time.Hour}}})
+	defer ex.Close()
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(alice, ledger.ETH, 5)
+	ex.Deposit(bob, ledger.ETH, 5)
+	bid, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(90), User: alice, Market: MarketEth})
+	ask, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(110), User: alice, Market: MarketEth})
+	stop, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Size: sz(1), StopPrice: px(80), User: alice, Market: MarketEth})
+	other, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(120), User: bob, Market: MarketEth})
+
+	var updates []OrderUpdate
+	ex.HandleOrderUpdates(func(batch []OrderUpdate) { updates = append(updates, batch...) })
+	// cancelled in spite of the minimum resting time
+	cancelled, err := ex.SuspendUser(ctx, alice, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint64, len(cancelled))
+	for i, o := range cancelled {
+		ids[i] = o.ID
+	}
+	if want := []uint64{bid.OrderID, ask.OrderID, stop.OrderID}; !slices.Equal(ids, want) {
+		t.Fatalf("expected %v cancelled, got %+v", want, cancelled)
+	}
+	if len(updates) != 3 {
+		t.Fatalf("expected 3 updates, got %+v", updates)
+	}
+	for _, u := range updates {
+		if u.Type != OrderUpdateCancelled || u.Reason != ReasonUserSuspended {
+			t.Fatalf("expected cancellations for the suspension, got %+v", updates)
+		}
+	}
+	if held := ex.Held(alice); held[ledger.USD] != 0 || held[ledger.ETH] != 0 {
+		t.Fatalf("expected nothing held, got %v", held)
+	}
+	if _, err := ex.Order(bob, other.OrderID); err != nil {
+		t.Fatalf("expected bob's order left alone: %v", err)
+	}
+
+	var rejection *Rejection
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(90), User: alice, Market: MarketEth})
+	if !errors.As(err, &rejection) || rejection.Code != ReasonUserSuspended {
+		t.Fatalf("expected a USER_SUSPENDED rejection, got %v", err)
+	}
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(130), User: bob, Market: MarketEth}); err != nil {
+		t.Fatalf("expected bob still trading: %v", err)
+	}
+
+	// a replayed exchange has her suspended too
+	replayed := New(Config{})
+	defer replayed.Close()
+	if _, err := replayed.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Suspended(alice) || replayed.Suspended(bob) {
+		t.Fatal("expected only alice suspended after replay")
+	}
+	if got, want := replayed.Held(alice), ex.Held(alice); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed holds are %v, want %v", got, want)
+	}
+
+	if err := ex.ResumeUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if ex.Suspended(alice) {
+		t.Fatal("expected alice resumed")
+	}
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(90), User: alice, Market: MarketEth}); err != nil {
+		t.Fatalf("expected alice trading again: %v", err)
+	}
+}
+
+func TestFreezeOrder(t *testing.T) {
+	ctx := context.Background()
+	const alice, bob = 1, 2
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ex.Deposit(alice, ledger.ETH, 5)
+	ex.Deposit(bob, ledger.USD, 1000)
+	frozen, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(100), User: alice, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(101), Market: MarketEth})
+
+	record, err := ex.FreezeOrder(ctx, frozen.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Frozen {
+		t.Fatalf("expected the order reported frozen, got %+v", record)
+	}
+	var rejection *Rejection
+	if _, err := ex.FreezeOrder(ctx, 999); !errors.As(err, &rejection) || rejection.Code != "ORDER_NOT_FOUND" {
+		t.Fatalf("expected ORDER_NOT_FOUND, got %v", err)
+	}
+
+	// only the 1 at 101 can be matched, so 2 is too much for a market buy
+	_, err = ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(2), User: bob, Market: MarketEth})
+	if !errors.As(err, &rejection) || rejection.Code != "INSUFFICIENT_LIQUIDITY" {
+		t.Fatalf("expected INSUFFICIENT_LIQUIDITY, got %v", err)
+	}
+	// the sweep passes over the frozen ask to the one behind it
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(3), Price: px(101), User: bob, Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilledSize != sz(1) || len(report.Trades) != 1 || report.Trades[0].Price != px(101) {
+		t.Fatalf("expected 1 filled at 101, got %+v", report)
+	}
+	// still resting, unfilled, under the bid it now crosses
+	if record, _ := ex.Order(alice, frozen.OrderID); record.Status != OrderNew || record.Remaining != sz(2) || !record.Frozen {
+		t.Fatalf("expected the frozen ask untouched, got %+v", record)
+	}
+	if _, err := ex.ModifyOrder(ctx, alice, frozen.OrderID, ModifyRequest{Price: px(102), Size: sz(2)}); !errors.As(err, &rejection) || rejection.Code != "ORDER_FROZEN" {
+		t.Fatalf("expected ORDER_FROZEN, got %v", err)
+	}
+	if _, err := ex.CancelOrder(ctx, alice, frozen.OrderID); err != nil {
+		t.Fatalf("expected the frozen order cancellable: %v", err)
+	}
+}
+
+func TestSettlementConservesFunds(t *testing.T) {
+	ex := New(Config{Sandbox: true})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice = 1
+	ex.Deposit(alice, ledger.USD, 1000)
+	if _, err := ex.SandboxSeed(MarketEth, SeedRequest{Mid: px(100), Step: px(1), Levels: 1, Size: sz(5)}); err != nil {
+		t.Fatal(err)
+	}
+	// the seeded seller fills alice's bid, and is paid for it
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(101), User: alice, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ex.Balances(alice); got[ledger.USD] != 798 || got[ledger.ETH] != 2 {
+		t.Fatalf("expected alice to have paid for 2 ETH, got %v", got)
+	}
+	if held := ex.Held(alice); len(held) != 0 {
+		t.Fatalf("expected nothing left held, got %v", held)
+	}
+
+	// and everyone's funds came in through ledger.External: the ladder's
+	// from the faucet
+	l := ex.Ledger()
+	for asset, want := range map[ledger.Asset]float64{ledger.USD: 1000 + 495, ledger.ETH: 5} {
+		if got := -l.Balance(ledger.External, asset); got != want {
+			t.Errorf("expected %v %s to have come in, got %v", want, asset, got)
+		}
+		total := 0.0
+		for _, user := range []uint64{alice, SandboxLiquidityUser} {
+			total += ex.Balances(user)[asset] + ex.Held(user)[asset]
+		}
+		if total != want {
+			t.Errorf("expected users to hold %v %s between them, got %v", want, asset, total)
+		}
+	}
+}
+
+func TestImportOwnedOrders(t *testing.T) {
+	ex := New(Config{})
+	var cancelled []uint64
+	ex.HandleOrderUpdates(func(updates []OrderUpdate) {
+		for _, u := range updates {
+			if u.Type == OrderUpdateCancelled {
+				cancelled = append(cancelled, u.OrderID)
+			}
+		}
+	})
+	ex.Deposit(9, ledger.ETH, 1)
+	ask := func(id uint64, size, price float64, owner uint64) orderbook.Snapshot {
+		return orderbook.Snapshot{Asks: []orderbook.SnapshotLevel{{Price: px(price), Orders: []orderbook.SnapshotOrder{
+			{ID: id, Size: sz(size), Timestamp: 1, ClientOrderID: "c1", Owner: owner},
+		}}}}
+	}
+
+	// an owner who couldn't have placed an order refuses the whole snapshot,
+	// as does an anonymous order when the exchange takes none
+	for _, snapshot := range []orderbook.Snapshot{ask(500, 2, 100, 9), ask(500, 1, 100, 0)} {
+		_, err := ex.Import(MarketEth, snapshot, false)
+		var rejection *Rejection
+		if !errors.As(err, &rejection) || rejection.Code != "INSUFFICIENT_FUNDS" {
+			t.Fatalf("expected INSUFFICIENT_FUNDS, got %v", err)
+		}
+	}
+	if depth, _ := ex.GetDepth(MarketEth, 10); len(depth.Asks) != 0 {
+		t.Fatalf("expected nothing imported, got %+v", depth)
+	}
+
+	// an imported order holds its owner's funds and claims its client ID
+	if _, err := ex.Import(MarketEth, ask(500, 1, 100, 9), false); err != nil {
+		t.Fatal(err)
+	}
+	if held := ex.Held(9); held[ledger.ETH] != 1 {
+		t.Fatalf("expected 1 ETH held, got %v", held)
+	}
+	if record, err := ex.OrderByClientID(9, "c1"); err != nil || record.ID != 500 {
+		t.Fatalf("expected order 500 by its client ID, got %+v, %v", record, err)
+	}
+	if _, err := ex.Import(MarketEth, ask(501, 1, 101, 9), true); err == nil {
+		t.Fatal("expected the client ID of another order refused")
+	}
+
+	// replacing cancels the book's orders first, freeing what they held
+	replacement := ask(500, 1, 101, 9)
+	if _, err := ex.Import(MarketEth, replacement, true); err != nil {
+		t.Fatal(err)
+	}
+	ex.Close()
+	if !reflect.DeepEqual(cancelled, []uint64{500}) {
+		t.Fatalf("expected order 500 cancelled, got %v", cancelled)
+	}
+	if held := ex.Held(9); held[ledger.ETH] != 1 {
+		t.Fatalf("expected 1 ETH held, got %v", held)
+	}
+}
+
+func TestHandleSettlements(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	var settled []Settlement
+	ex.HandleSettlements(func(s Settlement) {
+		settled = append(settled, s)
+	})
+	ex.Deposit(1, ledger.USD, 1000)
+	ex.Deposit(2, ledger.ETH, 1)
+
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(200), User: 1, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(0.5), Price: px(200), User: 2, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	if len(settled) != 1 {
+		t.Fatalf("expected 1 settlement, got %+v", settled)
+	}
+	s := settled[0]
+	if s.Market != MarketEth || s.Buyer != 1 || s.Seller != 2 || s.Base != ledger.ETH || s.Quote != ledger.USD || s.Size != 0.5 || s.Price != 200 || s.Entry == 0 {
+		t.Fatalf("unexpected settlement %+v", s)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice = 1
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(alice, ledger.ETH, 2)
+	updates, unsubscribe := ex.SubscribeOrderUpdates(alice)
+	defer unsubscribe()
+	// alice trades each time against an anonymous order resting at price
+	trade := func(bid bool, size, price float64) {
+		t.Helper()
+		ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: !bid, Size: sz(size), Price: px(price), Market: MarketEth})
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: bid, Size: sz(size), Price: px(price), User: alice, Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	position := func(want Position) {
+		t.Helper()
+		if got := ex.Positions(alice); len(got) != 1 || got[0] != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+	if got := ex.Positions(alice); len(got) != 0 {
+		t.Fatalf("expected no positions before trading, got %+v", got)
+	}
+
+	trade(true, 2, 100)
+	position(Position{Market: MarketEth, Size: sz(2), EntryPrice: px(100), LastPrice: px(100)})
+	// selling part of a long realizes it
+	trade(false, 1, 110)
+	position(Position{Market: MarketEth, Size: sz(1), EntryPrice: px(100), RealizedPnL: 10, UnrealizedPnL: 10, LastPrice: px(110)})
+	// and selling through zero closes the rest at a loss and opens a short
+	// at the fill's price
+	trade(false, 3, 90)
+	position(Position{Market: MarketEth, Size: sz(-2), EntryPrice: px(90), RealizedPnL: 0, LastPrice: px(90)})
+
+	// the short gains as the market falls without alice trading
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(80), Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(80), Market: MarketEth})
+	position(Position{Market: MarketEth, Size: sz(-2), EntryPrice: px(90), UnrealizedPnL: 20, LastPrice: px(80)})
+
+	// each fill's update carries what it changed the position by
+	var deltas []orderbook.Size
+	for range 3 {
+		for _, u := range <-updates {
+			if u.FillSize != 0 {
+				deltas = append(deltas, u.PositionDelta)
+			}
+		}
+	}
+	if want := []orderbook.Size{sz(2), sz(-1), sz(-3)}; !slices.Equal(deltas, want) {
+		t.Fatalf("expected position deltas %v, got %v", want, deltas)
+	}
+}
+
+func TestReduceOnly(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice = 1
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(alice, ledger.ETH, 5)
+	// alice goes long 3 against an anonymous ask
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(3), Price: px(100), Market: MarketEth})
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(3), Price: px(100), User: alice, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	updates, unsubscribe := ex.SubscribeOrderUpdates(alice)
+	defer unsubscribe()
+
+	// a reduce-only order can't add to the long, nor sell more than it
+	ask := PlaceOrderRequest{Type: LimitOrder, Size: sz(5), Price: px(120), User: alice, Market: MarketEth, ReduceOnly: true}
+	for _, req := range []PlaceOrderRequest{
+		{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(90), User: alice, Market: MarketEth, ReduceOnly: true},
+		ask,
+	} {
+		var rejection *Rejection
+		if _, err := ex.PlaceOrder(ctx, req); !errors.As(err, &rejection) || rejection.Code != "REDUCE_ONLY" {
+			t.Fatalf("expected REDUCE_ONLY, got %v", err)
+		}
+	}
+	// unless it asks to be capped to the position
+	ask.ReduceOnlyPolicy = ReduceOnlyResize
+	report, err := ex.PlaceOrder(ctx, ask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OriginalSize != sz(3) || report.Remaining != sz(3) {
+		t.Fatalf("expected the ask capped to 3, got %+v", report)
+	}
+	<-updates
+
+	// selling 1 by another order trims the resting one to what is left
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(110), Market: MarketEth})
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(110), User: alice, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := ex.Order(alice, report.OrderID); record.Remaining != sz(2) {
+		t.Fatalf("expected the ask trimmed to 2, got %+v", record)
+	}
+	// nor can it be amended past the position
+	var rejection *Rejection
+	if _, err := ex.ModifyOrder(ctx, alice, report.OrderID, ModifyRequest{Price: px(120), Size: sz(3)}); !errors.As(err, &rejection) || rejection.Code != "REDUCE_ONLY" {
+		t.Fatalf("expected REDUCE_ONLY, got %v", err)
+	}
+
+	// and closing the position cancels it
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(105), Market: MarketEth})
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(105), User: alice, Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := ex.Order(alice, report.OrderID); record.Status != OrderCancelled {
+		t.Fatalf("expected the ask cancelled, got %+v", record)
+	}
+	if book := ex.orderbooks[MarketEth]; book.AskTotalVolume() != 0 {
+		t.Fatalf("expected no asks left, got %v", book.AskTotalVolume())
+	}
+	var got []OrderUpdate
+	for range 4 {
+		for _, u := range <-updates {
+			if u.OrderID == report.OrderID {
+				got = append(got, u)
+			}
+		}
+	}
+	if len(got) != 2 || got[0].Type != OrderUpdateAmended || got[1].Type != OrderUpdateCancelled || got[1].Reason != ReasonReduceOnly {
+		t.Fatalf("unexpected updates %+v", got)
+	}
+}
+
+func TestSubscribeOrderUpdates(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := New(Config{AnonymousOrders: true, Clock: clk})
+	defer ex.Close()
+	ctx := context.Background()
+	ex.Deposit(1, ledger.USD, 1000)
+	ex.Deposit(2, ledger.ETH, 1)
+	buyer, unsubscribe := ex.SubscribeOrderUpdates(1)
+	defer unsubscribe()
+	seller, unsubscribeSeller := ex.SubscribeOrderUpdates(2)
+	defer unsubscribeSeller()
+	// a handler sees everyone's updates, one operation at a time
+	var sizes []int
+	ex.HandleOrderUpdates(func(updates []OrderUpdate) { sizes = append(sizes, len(updates)) })
+
+	ask, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(0.5), Price: px(200), User: 2, Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bid, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(200), User: 1, ClientOrderID: "b1", Market: MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.CancelOrder(ctx, 1, bid.OrderID); err != nil {
+		t.Fatal(err)
+	}
+
+	now := clk.Now().UnixNano()
+	want := [][]OrderUpdate{
+		{
+			{Type: OrderUpdateAccepted, Market: MarketEth, Seq: 2, OrderID: bid.OrderID, ClientOrderID: "b1", Owner: 1, Bid: true, Price: px(200), Remaining: sz(1), Timestamp: now},
+			{Type: OrderUpdatePartialFill, Market: MarketEth, Seq: 2, OrderID: bid.OrderID, ClientOrderID: "b1", Owner: 1, Bid: true, Price: px(200), Remaining: sz(0.5), TradeID: 1, FillPrice: px(200), FillSize: sz(0.5), PositionDelta: sz(0.5), Timestamp: now},
+		},
+		{
+			{Type: OrderUpdateCancelled, Market: MarketEth, Seq: 3, OrderID: bid.OrderID, ClientOrderID: "b1", Owner: 1, Bid: true, Price: px(200), Remaining: sz(0.5), Timestamp: now},
+		},
+	}
+	for i, w := range want {
+		if got := <-buyer; !reflect.DeepEqual(got, w) {
+			t.Fatalf("buyer's batch %d: expected\n%+v\ngot\n%+v", i, w, got)
+		}
+	}
+	want = [][]OrderUpdate{
+		{{Type: OrderUpdateAccepted, Market: MarketEth, Seq: 1, OrderID: ask.OrderID, Owner: 2, Price: px(200), Remaining: sz(0.5), Timestamp: now}},
+		{{Type: OrderUpdateFill, Market: MarketEth, Seq: 2, OrderID: ask.OrderID, Owner: 2, Price: px(200), TradeID: 1, FillPrice: px(200), FillSize: sz(0.5), Maker: true, PositionDelta: -sz(0.5), Timestamp: now}},
+	}
+	for i, w := range want {
+		if got := <-seller; !reflect.DeepEqual(got, w) {
+			t.Fatalf("seller's batch %d: expected\n%+v\ngot\n%+v", i, w, got)
+		}
+	}
+	select {
+	case got := <-seller:
+		t.Fatalf("unexpected updates %+v", got)
+	default:
+	}
+	if want := []int{1, 3, 1}; !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("expected the handler to see batches of %v updates, got %v", want, sizes)
+	}
+}
+
+func TestFeedCoalescesLevelChanges(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := New(Config{AnonymousOrders: true, Clock: clk})
+	defer ex.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updates, unsubscribe, err := ex.SubscribeFeed(MarketEth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(10), Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sweep is one operation: ten trades, then the level's final state once
+	msgs := <-updates
+	if len(msgs) != 11 {
+		t.Fatalf("expected 11 messages, got %d: %+v", len(msgs), msgs)
+	}
+	for i, msg := range msgs[:10] {
+		want := FeedMessage{Type: FeedTrade, Market: MarketEth, Seq: 11, Side: orderbook.SideBid, Price: px(100), Size: sz(1), TradeID: uint64(i + 1), Timestamp: clk.Now().UnixNano()}
+		if msg != want {
+			t.Fatalf("message %d: expected %+v, got %+v", i, want, msg)
+		}
+	}
+	if want := (FeedMessage{Type: FeedBook, Market: MarketEth, Seq: 11, Side: orderbook.SideAsk, Price: px(100)}); msgs[10] != want {
+		t.Fatalf("expected %+v, got %+v", want, msgs[10])
+	}
+	select {
+	case msgs := <-updates:
+		t.Fatalf("unexpected messages %+v", msgs)
+	default:
+	}
+
+	if _, _, err := ex.SubscribeFeed("DOGE"); !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected ErrMarketNotFound, got %v", err)
+	}
+}
+
+func TestFeedCutsOffSlowSubscribers(t *testing.T) {
+	feed := newMarketFeed(feedHistory)
+	sub := feed.Subscribe()
+	for i := 0; i <= feedBuffer; i++ {
+		feed.Publish([]FeedMessage{{Type: FeedBook, Seq: uint64(i + 1)}})
+	}
+
+	// what was buffered is still delivered, then the stream ends
+	for i := 0; i < feedBuffer; i++ {
+		if msgs := <-sub; msgs[0].Seq != uint64(i+1) {
+			t.Fatalf("expected seq %d, got %d", i+1, msgs[0].Seq)
+		}
+	}
+	if _, ok := <-sub; ok {
+		t.Fatal("expected the subscription to be closed")
+	}
+	// unsubscribing afterwards is harmless
+	feed.Unsubscribe(sub)
+}
+
+func TestResumeTrades(t *testing.T) {
+	feed := newMarketFeed(feedHistory)
+	for i := 1; i <= tradeHistory+5; i++ {
+		feed.Publish([]FeedMessage{{Type: FeedTrade, TradeID: uint64(i)}, {Type: FeedBook, Seq: uint64(i)}})
+	}
+
+	// only the latest trades are held
+	replay, sub := feed.ResumeTrades(0)
+	feed.Unsubscribe(sub)
+	if len(replay) != tradeHistory || replay[0].TradeID != 6 || replay[len(replay)-1].TradeID != tradeHistory+5 {
+		t.Fatalf("expected trades 6 to %d, got %d from %d", tradeHistory+5, len(replay), replay[0].TradeID)
+	}
+	replay, sub = feed.ResumeTrades(tradeHistory + 3)
+	defer feed.Unsubscribe(sub)
+	if len(replay) != 2 || replay[0].TradeID != tradeHistory+4 {
+		t.Fatalf("expected the last 2 trades, got %+v", replay)
+	}
+	if recent := feed.RecentTrades(3); len(recent) != 3 || recent[0].TradeID != tradeHistory+5 || recent[2].TradeID != tradeHistory+3 {
+		t.Fatalf("expected the last 3 trades newest first, got %+v", recent)
+	}
+	if recent := feed.RecentTrades(2 * tradeHistory); len(recent) != tradeHistory || recent[len(recent)-1].TradeID != 6 {
+		t.Fatalf("expected every trade held, got %d", len(recent))
+	}
+	feed.Publish([]FeedMessage{{Type: FeedTrade, TradeID: tradeHistory + 6}})
+	if msgs := <-sub; msgs[0].TradeID != tradeHistory+6 {
+		t.Fatalf("expected the live trade, got %+v", msgs)
+	}
+}
+
+func TestResumeFeed(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+
+	type level struct {
+		side  orderbook.Side
+		price orderbook.Price
+	}
+	liveBook := func() (map[level]orderbook.Size, uint64) {
+		export, err := ex.Export(MarketEth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		book := make(map[level]orderbook.Size)
+		for side, levels := range map[orderbook.Side][]orderbook.SnapshotLevel{orderbook.SideAsk: export.Asks, orderbook.SideBid: export.Bids} {
+			for _, l := range levels {
+				for _, o := range l.Orders {
+					book[level{side, l.Price}] += o.Size
+				}
+			}
+		}
+		return book, export.Sequence
+	}
+	apply := func(book map[level]orderbook.Size, msgs []FeedMessage) {
+		for _, msg := range msgs {
+			if msg.Type != FeedBook {
+				t.Fatalf("expected only book messages, got %+v", msg)
+			}
+			if msg.Size == sz(0) {
+				delete(book, level{msg.Side, msg.Price})
+			} else {
+				book[level{msg.Side, msg.Price}] = msg.Size
+			}
+		}
+	}
+	place := func(req PlaceOrderRequest) {
+		req.Market = MarketEth
+		if _, err := ex.PlaceOrder(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	place(PlaceOrderRequest{Type: LimitOrder, Size: sz(2), Price: px(101)})
+	place(PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(99)})
+	seen, since := liveBook()
+
+	// the client is away while the book moves on
+	place(PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(101)})
+	place(PlaceOrderRequest{Type: LimitOrder, Size: sz(4), Price: px(103)})
+	place(PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(2.5)})
+	place(PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(98)})
+	if _, err := ex.Cancel(ctx, CancelRequest{Market: MarketEth, Side: orderbook.SideBid, PriceFrom: px(99), PriceTo: px(99)}); err != nil {
+		t.Fatal(err)
+	}
+
+	resume, updates, unsubscribe, err := ex.ResumeFeed(MarketEth, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	if !resume.Resumed {
+		t.Fatal("expected the missed deltas to be replayed")
+	}
+	apply(seen, resume.Messages)
+	live, _ := liveBook()
+	if !reflect.DeepEqual(seen, live) {
+		t.Fatalf("replay gave %v, live book is %v", seen, live)
+	}
+
+	// live updates carry on from the replay
+	place(PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(102)})
+	apply(seen, bookMessages(<-updates))
+	if live, _ = liveBook(); !reflect.DeepEqual(seen, live) {
+		t.Fatalf("stream gave %v, live book is %v", seen, live)
+	}
+
+	// once the operations after since are evicted, the client gets the book
+	ex.feeds[MarketEth] = newMarketFeed(2)
+	_, since = liveBook()
+	for i := 0; i < 3; i++ {
+		place(PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(97)})
+	}
+	resume, _, unsubscribe, err = ex.ResumeFeed(MarketEth, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	if resume.Resumed {
+		t.Fatal("expected a snapshot when since is too old")
+	}
+	rebuilt := make(map[level]orderbook.Size)
+	apply(rebuilt, resume.Messages)
+	live, seq := liveBook()
+	if !reflect.DeepEqual(rebuilt, live) {
+		t.Fatalf("snapshot gave %v, live book is %v", rebuilt, live)
+	}
+	for _, msg := range resume.Messages {
+		if msg.Seq != seq {
+			t.Fatalf("expected snapshot messages at seq %d, got %+v", seq, msg)
+		}
+	}
+	// a sequence number the feed never reached can't be resumed either
+	if resume, _, unsubscribe, _ := ex.ResumeFeed(MarketEth, seq+10); resume.Resumed {
+		t.Fatal("expected a snapshot for a future sequence number")
+	} else {
+		unsubscribe()
+	}
+
+	stats, err := ex.Stats(MarketEth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FeedStats{Depth: 2, ResumeMisses: 2}); stats.Feed != want {
+		t.Fatalf("expected %+v, got %+v", want, stats.Feed)
+	}
+
+	// an import isn't in the history, so it forces resuming clients to
+	// rebuild and cuts off live ones
+	_, since = liveBook()
+	updates, unsubscribe, _ = ex.SubscribeFeed(MarketEth)
+	defer unsubscribe()
+	if _, err := ex.Import(MarketEth, orderbook.Snapshot{}, true); err != nil {
+		t.Fatal(err)
+	}
+	// once they are sent the replaced orders' cancellation
+	<-updates
+	if _, ok := <-updates; ok {
+		t.Fatal("expected live subscribers to be cut off")
+	}
+	if resume, _, unsubscribe, _ := ex.ResumeFeed(MarketEth, since); resume.Resumed {
+		t.Fatal("expected a snapshot after an import")
+	} else {
+		unsubscribe()
+	}
+}
+
+func TestSnapshotFeed(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true})
+	defer ex.Close()
+	ctx := context.Background()
+	for _, req := range []PlaceOrderRequest{
+		{Type: LimitOrder, Size: sz(1), Price: px(101), Market: MarketEth},
+		{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(99), Market: MarketEth},
+	} {
+		if _, err := ex.PlaceOrder(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, seq, updates, unsubscribe, err := ex.SnapshotFeed(MarketEth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+	want := []FeedMessage{
+		{Type: FeedBook, Market: MarketEth, Seq: 2, Side: orderbook.SideAsk, Price: px(101), Size: sz(1)},
+		{Type: FeedBook, Market: MarketEth, Seq: 2, Side: orderbook.SideBid, Price: px(99), Size: sz(2)},
+	}
+	if seq != 2 || !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("expected %+v at 2, got %+v at %d", want, snapshot, seq)
+	}
+
+	// the live stream carries on from the snapshot
+	if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(102), Market: MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := <-updates
+	if len(msgs) != 1 || msgs[0].Seq != 3 || msgs[0].Price != px(102) {
+		t.Fatalf("expected the level at 102 at seq 3, got %+v", msgs)
+	}
+
+	if _, _, _, _, err := ex.SnapshotFeed("DOGE"); !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected ErrMarketNotFound, got %v", err)
+	}
+}
+
+func TestMinRestingTime(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	ex := New(Config{
+		AnonymousOrders: true,
+		Clock:           clk,
+		Limits:          map[Market]MarketConfig{MarketEth: {MinRestingTime: 100 * time.Millisecond}},
+	})
+	defer ex.Close()
+
+	ctx := context.Background()
+	place := func(price float64) {
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(price), Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel := func(force bool) CancelResult {
+		result, err := ex.Cancel(ctx, CancelRequest{Market: MarketEth, Side: orderbook.SideAsk, PriceFrom: px(100), PriceTo: px(110), Force: force})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	place(101)
+	clk.Advance(50 * time.Millisecond)
+	result := cancel(false)
+	if len(result.Cancelled) != 0 || len(result.Kept) != 1 {
+		t.Fatalf("expected the order to be kept, got %+v", result)
+	}
+	if kept := result.Kept[0]; kept.Code != "MIN_RESTING_TIME" || kept.Price != px(101) || kept.EarliestCancel != start.Add(100*time.Millisecond).UnixNano() {
+		t.Fatalf("unexpected kept order %+v", kept)
+	}
+
+	// each order is judged on its own age
+	clk.Advance(50 * time.Millisecond)
+	place(102)
+	clk.Advance(50 * time.Millisecond)
+	result = cancel(false)
+	if len(result.Cancelled) != 1 || result.Cancelled[0].Price != px(101) ||
+		len(result.Kept) != 1 || result.Kept[0].Price != px(102) || result.Kept[0].EarliestCancel != start.Add(200*time.Millisecond).UnixNano() {
+		t.Fatalf("expected 101 cancelled and 102 kept, got %+v", result)
+	}
+
+	// forced cancels and fills don't wait
+	result = cancel(true)
+	if len(result.Cancelled) != 1 || result.Cancelled[0].Price != px(102) || len(result.Kept) != 0 {
+		t.Fatalf("expected a forced cancel of 102, got %+v", result)
+	}
+	place(103)
+	report, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), Market: MarketEth})
+	if err != nil || report.FilledSize != sz(1) {
+		t.Fatalf("expected the fresh order to fill, got %+v, %v", report, err)
+	}
+
+	// cancelling by ID waits too
+	place(104)
+	export, _ := ex.Export(MarketEth)
+	id := export.Asks[0].Orders[0].ID
+	var rejection *Rejection
+	if _, err := ex.CancelOrder(ctx, 0, id); !errors.As(err, &rejection) || rejection.Code != "MIN_RESTING_TIME" {
+		t.Fatalf("expected MIN_RESTING_TIME, got %v", err)
+	}
+	clk.Advance(100 * time.Millisecond)
+	if cancelled, err := ex.CancelOrder(ctx, 0, id); err != nil || cancelled.ID != id {
+		t.Fatalf("expected order %d cancelled, got %+v, %v", id, cancelled, err)
+	}
+
+	// so does a modify that re-places the order, but not one keeping its place
+	place(105)
+	export, _ = ex.Export(MarketEth)
+	id = export.Asks[0].Orders[0].ID
+	if _, err := ex.ModifyOrder(ctx, 0, id, ModifyRequest{Price: px(105), Size: sz(0.5)}); err != nil {
+		t.Fatalf("expected a reduction to keep its place, got %v", err)
+	}
+	if _, err := ex.ModifyOrder(ctx, 0, id, ModifyRequest{Price: px(106), Size: sz(0.5)}); !errors.As(err, &rejection) || rejection.Code != "MIN_RESTING_TIME" {
+		t.Fatalf("expected MIN_RESTING_TIME, got %v", err)
+	}
+	clk.Advance(100 * time.Millisecond)
+	if report, err := ex.ModifyOrder(ctx, 0, id, ModifyRequest{Price: px(106), Size: sz(0.5)}); err != nil || report.Remaining != sz(0.5) {
+		t.Fatalf("expected order %d moved to 106, got %+v, %v", id, report, err)
+	}
+}
+
+func TestQuality(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := New(Config{AnonymousOrders: true, Clock: clk})
+	defer ex.Close()
+
+	ctx := context.Background()
+	place := func(bid bool, price, size float64) {
+		if _, err := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: bid, Size: sz(size), Price: px(price), Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	near := func(name string, got *float64, want float64) {
+		t.Helper()
+		if got == nil || math.Abs(*got-want) > 1e-9 {
+			t.Fatalf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+
+	clk.Advance(5 * time.Minute)
+	q, _ := ex.Quality(MarketEth, time.Hour)
+	if q.Observed != 5*time.Minute || q.AvgSpread != nil || q.AvgBidSize != nil || q.Note == "" {
+		t.Fatalf("expected an empty window, got %+v", q)
+	}
+	near("twoSidedPct", q.TwoSidedPct, 0)
+
+	// empty for 10m, then mid 100 with a 0.8 spread for 20m, then a better
+	// bid narrows it to 0.6 for 30m
+	clk.Advance(5 * time.Minute)
+	place(true, 99.6, 2)
+	place(false, 100.4, 1)
+	place(false, 100.9, 4)
+	clk.Advance(20 * time.Minute)
+	place(true, 99.8, 5)
+	clk.Advance(30 * time.Minute)
+
+	q, err := ex.Quality(MarketEth, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Observed != time.Hour || q.Note != "" {
+		t.Fatalf("unexpected window %+v", q)
+	}
+	near("twoSidedPct", q.TwoSidedPct, 50.0/60*100)
+	near("avgSpread", q.AvgSpread, (20*0.8+30*0.6)/50)
+	near("avgSpreadBps", q.AvgSpreadBps, (20*0.8/100+30*0.6/100.1)/50*10_000)
+	// within 0.5% of mid: 99.6 and 100.4 at first, then 99.8 as well
+	near("avgDepth05Pct", q.AvgDepth05Pct, (20*3.0+30*8)/50)
+	// within 1% the 100.9 ask counts too
+	near("avgDepth1Pct", q.AvgDepth1Pct, (20*7.0+30*12)/50)
+	near("avgBidSize", q.AvgBidSize, (20*2.0+30*5)/50)
+	near("avgAskSize", q.AvgAskSize, 1)
+
+	// a shorter window only sees the last state; a longer one only what was
+	// observed
+	q, _ = ex.Quality(MarketEth, 30*time.Minute)
+	near("avgSpread", q.AvgSpread, 0.6)
+	near("twoSidedPct", q.TwoSidedPct, 100)
+	if q, _ := ex.Quality(MarketEth, 2*time.Hour); q.Observed != time.Hour {
+		t.Fatalf("expected an hour observed, got %v", q.Observed)
+	}
+
+	if _, err := ex.Quality(MarketEth, 25*time.Hour); !errors.Is(err, ErrInvalidWindow) {
+		t.Fatalf("expected ErrInvalidWindow, got %v", err)
+	}
+	if _, err := ex.Quality("DOGE", time.Hour); !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected ErrMarketNotFound, got %v", err)
+	}
+}
+
+// memoryJournal keeps the commands journaled to it, refusing them with err
+// once it is set.
+type memoryJournal struct {
+	cmds []Command
+	err  error
+}
+
+func (j *memoryJournal) Append(cmd Command) error {
+	if j.err != nil {
+		return j.err
+	}
+	j.cmds = append(j.cmds, cmd)
+	return nil
+}
+
+func (j *memoryJournal) commands() func(yield func(Command, error) bool) {
+	return func(yield func(Command, error) bool) {
+		for _, cmd := range j.cmds {
+			if !yield(cmd, nil) {
+				return
+			}
+		}
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	journal := &memoryJournal{}
+	ex := New(Config{AnonymousOrders: true, Clock: clk, Journal: journal, Limits: map[Market]MarketConfig{MarketEth: {MinRestingTime: time.Second}}})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice, bob = 1, 2
+
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(bob, ledger.ETH, 5)
+	bid, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(99), ClientOrderID: "bid", User: alice, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(98), TimeInForce: orderbook.GoodTillDate, ExpiresAt: start.Add(time.Minute).UnixNano(), User: alice, Market: MarketEth})
+	clk.Advance(time.Second)
+	ask, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(3), Price: px(101), User: bob, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), User: alice, Market: MarketEth})
+	stop, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Size: sz(1), StopPrice: px(95), User: bob, Market: MarketEth})
+	ex.ModifyOrder(ctx, alice, bid.OrderID, ModifyRequest{Price: px(100), Size: sz(1.5)})
+	// refused after it was journaled, and so refused again on replay
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(50), Price: px(100), TimeInForce: orderbook.FillOrKill, User: bob, Market: MarketEth})
+	clk.Advance(time.Minute)
+	ex.CancelOrder(ctx, bob, ask.OrderID)
+	maxSize := sz(10)
+	ex.PatchLimits(MarketEth, LimitsPatch{MaxOrderSize: &maxSize})
+
+	// placing the GTD order, trading, modifying and the expiry are all
+	// commands, while the refused ones before any change aren't
+	types := make([]CommandType, len(journal.cmds))
+	for i, cmd := range journal.cmds {
+		types[i] = cmd.Type
+	}
+	want := []CommandType{CommandDeposit, CommandDeposit, CommandPlace, CommandPlace, CommandPlace, CommandPlace, CommandPlace, CommandModify, CommandPlace, CommandExpire, CommandCancelOrder, CommandPatchLimits}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("journaled %v, want %v", types, want)
+	}
+
+	replayed := New(Config{AnonymousOrders: true, Clock: clock.NewFake(start.Add(time.Hour))})
+	defer replayed.Close()
+	if n, err := replayed.Replay(journal.commands()); err != nil || n != len(journal.cmds) {
+		t.Fatalf("replayed %d commands: %v", n, err)
+	}
+	for _, market := range ex.Markets() {
+		got, _ := replayed.Export(market)
+		want, _ := ex.Export(market)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("replayed %s book\n%+v\nwant\n%+v", market, got, want)
+		}
+	}
+	for _, user := range []uint64{alice, bob} {
+		if got, want := replayed.Balances(user), ex.Balances(user); !reflect.DeepEqual(got, want) {
+			t.Fatalf("replayed balances of %d are %v, want %v", user, got, want)
+		}
+		if got, want := replayed.Held(user), ex.Held(user); !reflect.DeepEqual(got, want) {
+			t.Fatalf("replayed holds of %d are %v, want %v", user, got, want)
+		}
+	}
+	if limits, _ := replayed.Limits(MarketEth); limits.MaxOrderSize != sz(10) {
+		t.Fatalf("replayed limits %+v", limits)
+	}
+	// the client order ID and the stop order came back too
+	if _, err := replayed.CancelOrderByClientID(ctx, alice, "bid"); err != nil {
+		t.Fatal(err)
+	}
+	if stops := replayed.stops[MarketEth]; len(stops.sells) != 1 || stops.sells[0].order.ID != stop.OrderID {
+		t.Fatalf("replayed stops %+v", stops)
+	}
+}
+
+func TestJournalFailure(t *testing.T) {
+	journal := &memoryJournal{err: errors.New("disk full")}
+	ex := New(Config{AnonymousOrders: true, Journal: journal})
+	defer ex.Close()
+
+	_, err := ex.PlaceOrder(context.Background(), PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth})
+	var rejection *Rejection
+	if !errors.As(err, &rejection) || rejection.Code != "JOURNAL_FAILED" {
+		t.Fatalf("expected JOURNAL_FAILED, got %v", err)
+	}
+	if depth, _ := ex.GetDepth(MarketEth, 10); len(depth.Bids)+len(depth.Asks) != 0 {
+		t.Fatalf("an order that wasn't journaled reached the book: %+v", depth)
+	}
+	if _, err := ex.Deposit(1, ledger.USD, 10); !errors.As(err, &rejection) || len(ex.Balances(1)) != 0 {
+		t.Fatalf("a deposit that wasn't journaled was credited: %v", err)
+	}
+}
+
+func TestWithdrawalJournal(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	journal := &memoryJournal{}
+	ex := New(Config{Clock: clk, Journal: journal})
+	defer ex.Close()
+	const alice = 1
+
+	ex.Deposit(alice, ledger.ETH, 2)
+	if _, err := ex.RequestWithdrawal(alice, ledger.ETH, "0xabc", 3); !errors.Is(err, ledger.ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	first, _ := ex.RequestWithdrawal(alice, ledger.ETH, "0xabc", 1)
+	second, _ := ex.RequestWithdrawal(alice, ledger.ETH, "0xabc", 0.5)
+	if _, err := ex.UpdateWithdrawal(WithdrawalUpdate{ID: first.ID, Status: WithdrawalConfirmed}); !errors.Is(err, ErrWithdrawalStatus) {
+		t.Fatalf("expected a pending withdrawal not to be confirmed, got %v", err)
+	}
+	clk.Advance(time.Second)
+	ex.UpdateWithdrawal(WithdrawalUpdate{ID: first.ID, Status: WithdrawalBroadcast, TxHash: "0x01"})
+	cp := ex.Checkpoint()
+	ex.UpdateWithdrawal(WithdrawalUpdate{ID: second.ID, Status: WithdrawalFailed, Error: "reverted"})
+	if out := ex.OutstandingWithdrawals(); len(out) != 1 || out[0].ID != first.ID || out[0].TxHash != "0x01" {
+		t.Fatalf("unexpected outstanding withdrawals %+v", out)
+	}
+	ex.UpdateWithdrawal(WithdrawalUpdate{ID: first.ID, Status: WithdrawalConfirmed})
+	if free, held := ex.Balances(alice)[ledger.ETH], ex.Held(alice)[ledger.ETH]; free != 1 || held != 0 {
+		t.Fatalf("expected 1 ETH free and none held, got %v and %v", free, held)
+	}
+	if _, err := ex.Withdrawal(2, first.ID); !errors.Is(err, ErrWithdrawalNotFound) {
+		t.Fatalf("expected another user's withdrawal not found, got %v", err)
+	}
+
+	// the refused update was never journaled, the refused request was
+	if n := len(journal.cmds); n != 7 {
+		t.Fatalf("journaled %d commands, want 7", n)
+	}
+	replayed := New(Config{})
+	defer replayed.Close()
+	if _, err := replayed.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(Config{})
+	defer restored.Close()
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*Exchange{replayed, restored} {
+		if got, want := other.UserWithdrawals(alice), ex.UserWithdrawals(alice); !reflect.DeepEqual(got, want) {
+			t.Fatalf("withdrawals came back as\n%+v\nwant\n%+v", got, want)
+		}
+		if got, want := other.Balances(alice), ex.Balances(alice); !reflect.DeepEqual(got, want) {
+			t.Fatalf("balances came back as %v, want %v", got, want)
+		}
+	}
+	if next, _ := restored.RequestWithdrawal(alice, ledger.ETH, "0xabc", 0.25); next.ID != second.ID+1 {
+		t.Fatalf("expected the next withdrawal to be %d, got %d", second.ID+1, next.ID)
+	}
+}
+
+func TestDepositJournal(t *testing.T) {
+	journal := &memoryJournal{}
+	ex := New(Config{Clock: clock.NewFake(time.Unix(1_700_000_000, 0)), Journal: journal})
+	defer ex.Close()
+	const alice, bob = 1, 2
+
+	ex.AssignDepositAddress(alice, "0xa")
+	if err := ex.AssignDepositAddress(alice, "0xa"); err != nil {
+		t.Fatalf("expected assigning the same address again to change nothing, got %v", err)
+	}
+	if err := ex.AssignDepositAddress(bob, "0xa"); !errors.Is(err, ErrAddressTaken) {
+		t.Fatalf("expected ErrAddressTaken, got %v", err)
+	}
+	deposit := ChainDeposit{User: alice, Asset: ledger.ETH, Amount: 1.5, Address: "0xa", TxHash: "0x01", Reference: "0x01", Block: 4}
+	credited, err := ex.CreditDeposit(deposit)
+	if err != nil || credited.Entry == 0 {
+		t.Fatalf("unexpected deposit %+v, err %v", credited, err)
+	}
+	if _, err := ex.CreditDeposit(deposit); !errors.Is(err, ErrDepositCredited) {
+		t.Fatalf("expected ErrDepositCredited, got %v", err)
+	}
+	ex.ScanBlocks(6)
+	ex.ScanBlocks(5)
+
+	// only what changed something was journaled
+	if n := len(journal.cmds); n != 3 {
+		t.Fatalf("journaled %d commands, want 3", n)
+	}
+	replayed := New(Config{})
+	defer replayed.Close()
+	if _, err := replayed.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(Config{})
+	defer restored.Close()
+	if err := restored.Restore(ex.Checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*Exchange{replayed, restored} {
+		if got, want := other.ChainDeposits(alice), ex.ChainDeposits(alice); !reflect.DeepEqual(got, want) {
+			t.Fatalf("deposits came back as\n%+v\nwant\n%+v", got, want)
+		}
+		if got := other.DepositAddresses(); !reflect.DeepEqual(got, []AddressAssignment{{User: alice, Address: "0xa"}}) {
+			t.Fatalf("addresses came back as %+v", got)
+		}
+		if got := other.ScannedBlock(); got != 6 {
+			t.Fatalf("expected blocks up to 6 scanned, got %d", got)
+		}
+		if got := other.Balances(alice)[ledger.ETH]; got != 1.5 {
+			t.Fatalf("expected 1.5 ETH, got %v", got)
+		}
+		if _, err := other.CreditDeposit(deposit); !errors.Is(err, ErrDepositCredited) {
+			t.Fatalf("expected ErrDepositCredited, got %v", err)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	journal := &memoryJournal{}
+	ex := New(Config{Clock: clock.NewFake(time.Unix(1_700_000_000, 0)), Journal: journal})
+	defer ex.Close()
+	const alice, bob = 1, 2
+
+	ex.Deposit(alice, ledger.USD, 100)
+	ex.Deposit(bob, ledger.USD, 100)
+	if _, err := ex.Transfer(TransferRequest{From: alice, To: bob, Asset: ledger.USD, Amount: 150, Reference: "a"}); !errors.Is(err, ledger.ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	// the refused transfer didn't use up its reference
+	first, err := ex.Transfer(TransferRequest{From: alice, To: bob, Asset: ledger.USD, Amount: 40, Reference: "a"})
+	if err != nil || first.FromBalance != 60 || first.ToBalance != 140 || first.Repeated {
+		t.Fatalf("unexpected transfer %+v, err %v", first, err)
+	}
+	entries := ex.Ledger().Entries(ledger.UserAccount(alice))
+	if last := entries[len(entries)-1]; last.ID != first.ID || last.Kind != ledger.EntryTransfer || len(last.Postings) != 2 {
+		t.Fatalf("unexpected entry %+v", last)
+	}
+	again, err := ex.Transfer(TransferRequest{From: alice, To: bob, Asset: ledger.USD, Amount: 40, Reference: "a"})
+	if err != nil || again.ID != first.ID || !again.Repeated {
+		t.Fatalf("expected the same transfer again, got %+v, err %v", again, err)
+	}
+	if _, err := ex.Transfer(TransferRequest{From: alice, To: bob, Asset: ledger.USD, Amount: 41, Reference: "a"}); !errors.Is(err, ErrTransferReference) {
+		t.Fatalf("expected ErrTransferReference, got %v", err)
+	}
+	// references are the sender's own
+	if _, err := ex.Transfer(TransferRequest{From: bob, To: alice, Asset: ledger.USD, Amount: 40, Reference: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// transfers crossing between the same pair don't deadlock, and none is
+	// lost
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ex.Transfer(TransferRequest{From: alice, To: bob, Asset: ledger.USD, Amount: 1, Reference: fmt.Sprint("ab", i)})
+		}()
+		go func() {
+			defer wg.Done()
+			ex.Transfer(TransferRequest{From: bob, To: alice, Asset: ledger.USD, Amount: 1, Reference: fmt.Sprint("ba", i)})
+		}()
+	}
+	wg.Wait()
+	if a, b := ex.Balances(alice)[ledger.USD], ex.Balances(bob)[ledger.USD]; a != 100 || b != 100 {
+		t.Fatalf("expected 100 each, got %v and %v", a, b)
+	}
+
+	replayed := New(Config{})
+	defer replayed.Close()
+	if _, err := replayed.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(Config{})
+	defer restored.Close()
+	if err := restored.Restore(ex.Checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*Exchange{replayed, restored} {
+		if got, want := other.Balances(alice), ex.Balances(alice); !reflect.DeepEqual(got, want) {
+			t.Fatalf("balances came back as %v, want %v", got, want)
+		}
+		if again, _ := other.Transfer(TransferRequest{From: alice, To: bob, Asset: ledger.USD, Amount: 40, Reference: "a"}); !again.Repeated || again.ID != first.ID {
+			t.Fatalf("expected the transfer to be remembered, got %+v", again)
+		}
+	}
+}
+
+func TestUserJournal(t *testing.T) {
+	journal := &memoryJournal{}
+	ex := New(Config{Clock: clock.NewFake(time.Unix(1_700_000_000, 0)), Journal: journal})
+	defer ex.Close()
+	users := ex.Users()
+
+	alice, aliceKey, _ := users.Register("alice", "correct horse")
+	if _, _, err := users.Register("alice", ""); !errors.Is(err, user.ErrNameTaken) {
+		t.Fatalf("expected ErrNameTaken, got %v", err)
+	}
+	cp := ex.Checkpoint()
+	bob, bobKey, _ := users.Register("bob", "")
+	users.SetKeySettings(bobKey, user.KeySettings{SelfTradePrevention: "CANCEL_BOTH"})
+	if err := users.SetKeySettings("nobody's", user.KeySettings{}); !errors.Is(err, user.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// the refused registration and settings were never journaled, and
+	// neither key was
+	if n := len(journal.cmds); n != 3 {
+		t.Fatalf("journaled %d commands, want 3", n)
+	}
+	for _, cmd := range journal.cmds {
+		if encoded, _ := json.Marshal(cmd); strings.Contains(string(encoded), aliceKey) || strings.Contains(string(encoded), bobKey) {
+			t.Fatalf("journaled an API key: %s", encoded)
+		}
+	}
+	replayed := New(Config{})
+	defer replayed.Close()
+	if _, err := replayed.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(Config{})
+	defer restored.Close()
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Replay(journal.commands()); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*Exchange{replayed, restored} {
+		if u, ok := other.Users().Authenticate(aliceKey); !ok || u != alice {
+			t.Fatalf("expected alice's key to authenticate them, got %+v, %v", u, ok)
+		}
+		if u, err := other.Users().Login("alice", "correct horse"); err != nil || u != alice {
+			t.Fatalf("expected alice to log in, got %+v, %v", u, err)
+		}
+		if u, ok := other.Users().Authenticate(bobKey); !ok || u != bob {
+			t.Fatalf("expected bob's key to authenticate them, got %+v, %v", u, ok)
+		}
+		if settings, _ := other.Users().KeySettings(bobKey); settings.SelfTradePrevention != "CANCEL_BOTH" {
+			t.Fatalf("unexpected settings %+v", settings)
+		}
+	}
+	if carol, _, _ := restored.Users().Register("carol", ""); carol.ID != 3 {
+		t.Fatalf("expected the next user to be 3, got %d", carol.ID)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	journal := &memoryJournal{}
+	ex := New(Config{AnonymousOrders: true, Clock: clk, Journal: journal, Limits: map[Market]MarketConfig{MarketEth: {MakerFee: 0.001}}})
+	defer ex.Close()
+	ctx := context.Background()
+	const alice, bob = 1, 2
+
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(bob, ledger.ETH, 5)
+	bid, _ := ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(2), Price: px(99), ClientOrderID: "bid", User: alice, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: sz(1), Price: px(98), TimeInForce: orderbook.GoodTillDate, ExpiresAt: start.Add(time.Minute).UnixNano(), User: alice, Market: MarketEth})
+	clk.Advance(time.Second)
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(3), Price: px(101), User: bob, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: sz(1), User: alice, Market: MarketEth})
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: StopMarketOrder, Size: sz(1), StopPrice: px(95), User: bob, Market: MarketEth})
+
+	// the checkpoint goes through JSON, as it does to disk
+	data, err := json.Marshal(ex.Checkpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Seq != uint64(len(journal.cmds)) {
+		t.Fatalf("checkpoint covers %d commands, want %d", cp.Seq, len(journal.cmds))
+	}
+
+	ex.ModifyOrder(ctx, alice, bid.OrderID, ModifyRequest{Price: px(100), Size: sz(1.5)})
+	clk.Advance(time.Minute)
+	ex.PlaceOrder(ctx, PlaceOrderRequest{Type: LimitOrder, Size: sz(0.5), Price: px(100), User: bob, Market: MarketEth})
+
+	// the whole journal is replayed on top, skipping what the checkpoint
+	// covers
+	restored := New(Config{AnonymousOrders: true, Clock: clock.NewFake(start.Add(time.Hour))})
+	defer restored.Close()
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := restored.Replay(journal.commands()); err != nil || n != len(journal.cmds)-int(cp.Seq) {
+		t.Fatalf("replayed %d commands: %v", n, err)
+	}
+	got, want := restored.Checkpoint(), ex.Checkpoint()
+	got.Time, want.Time = 0, 0
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored\n%+v\nwant\n%+v", got, want)
+	}
+	if _, err := restored.CancelOrderByClientID(ctx, alice, "bid"); err != nil {
+		t.Fatal(err)
+	}
+	if id := orderbook.NewOrderID(); id <= cp.LastOrderID {
+		t.Fatalf("order ID %d handed out again", id)
+	}
+
+	// a journal missing the commands after the checkpoint is refused
+	gap := New(Config{AnonymousOrders: true})
+	defer gap.Close()
+	if err := gap.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gap.Replay((&memoryJournal{cmds: journal.cmds[cp.Seq+1:]}).commands()); err == nil {
+		t.Fatal("expected a journal with a gap to be refused")
+	}
+	if err := gap.Restore(cp); err == nil {
+		t.Fatal("expected restoring into a used exchange to fail")
+	}
+}
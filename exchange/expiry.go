@@ -0,0 +1,106 @@
+package exchange
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+// expiryScheduler removes one market's GoodTillDate orders as they expire.
+// It keeps a single timer armed for the book's earliest expiry and rearms
+// it after every run.
+type expiryScheduler struct {
+	mu    sync.Mutex
+	timer clock.Timer
+	// at is when the armed timer fires, in unix nanoseconds
+	at int64
+	// gen tells a timer that was replaced while firing from the armed one
+	gen    uint64
+	closed bool
+}
+
+// scheduleExpiry arms market's expiry timer for the book's next expiry,
+// unless an earlier one is already armed. While journaled commands are
+// replayed, expiries are journaled commands too, so Replay arms the timers
+// once it is done instead. The caller holds the book's lock.
+func (ex *Exchange) scheduleExpiry(market Market) {
+	if ex.replaying.Load() {
+		return
+	}
+	next, ok := ex.orderbooks[market].NextExpiry()
+	if !ok {
+		return
+	}
+	s := ex.expiries[market]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.timer != nil && s.at <= next {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.gen++
+	gen := s.gen
+	s.at = next
+	s.timer = ex.clock.AfterFunc(time.Duration(next-ex.clock.Now().UnixNano()), func() {
+		ex.expireOrders(market, gen)
+	})
+}
+
+// expireOrders cancels market's expired orders, publishing them as
+// cancellations, and arms the timer for the next expiry.
+func (ex *Exchange) expireOrders(market Market, gen uint64) {
+	ob := ex.orderbooks[market]
+	ob.Lock()
+	defer ob.Unlock()
+
+	s := ex.expiries[market]
+	s.mu.Lock()
+	if s.closed || s.gen != gen {
+		s.mu.Unlock()
+		return
+	}
+	s.timer = nil
+	s.mu.Unlock()
+
+	end := ex.begin()
+	defer end()
+	if next, ok := ob.NextExpiry(); ok && next <= ex.clock.Now().UnixNano() {
+		if rejection := ex.record(Command{Type: CommandExpire, Market: market}); rejection != nil {
+			// left unarmed, to be tried again once an order rearms it
+			return
+		}
+		ex.expire(market)
+	}
+	ex.scheduleExpiry(market)
+}
+
+// expire cancels market's expired orders, publishing them as cancellations.
+// The caller holds the book's lock.
+func (ex *Exchange) expire(market Market) {
+	ob := ex.orderbooks[market]
+	if expired := ob.ExpireOrders(); len(expired) > 0 {
+		ex.events.Publish(ex.cancelEvents(market, ob, expired))
+		slog.Info("orders expired", "market", market, "count", len(expired))
+	}
+}
+
+// stopExpiries stops every market's expiry timer for good. Taking the book's
+// lock waits out a run already under way.
+func (ex *Exchange) stopExpiries() {
+	for market, s := range ex.expiries {
+		ob := ex.orderbooks[market]
+		ob.Lock()
+		s.mu.Lock()
+		s.closed = true
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.mu.Unlock()
+		ob.Unlock()
+	}
+}
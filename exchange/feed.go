@@ -0,0 +1,369 @@
+package exchange
+
+import (
+	"sync"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// FeedMessageType is what a market data message reports.
+type FeedMessageType string
+
+const (
+	// FeedTrade is one fill. Side is the side of the incoming order, the
+	// aggressor, and TradeID and Timestamp are the trade's.
+	FeedTrade FeedMessageType = "trade"
+	// FeedBook is a price level's resting volume after an operation, zero once
+	// the level is gone.
+	FeedBook FeedMessageType = "book"
+)
+
+// FeedMessage is one message of a market's trade and depth feed. Seq is the
+// book's sequence number after the operation that produced it.
+type FeedMessage struct {
+	Type      FeedMessageType `json:"type"`
+	Market    Market          `json:"market"`
+	Seq       uint64          `json:"seq"`
+	Side      orderbook.Side  `json:"side"`
+	Price     orderbook.Price `json:"price"`
+	Size      orderbook.Size  `json:"size"`
+	TradeID   uint64          `json:"tradeId,omitempty"`
+	Timestamp int64           `json:"timestamp,omitempty"`
+}
+
+// feedBuffer is how many operations a market data subscriber may fall behind
+// before it is cut off.
+const feedBuffer = 256
+
+// feedHistory is how many operations' book deltas a market keeps for
+// subscribers resuming after a disconnect.
+const feedHistory = 10_000
+
+// tradeHistory is how many of its latest trades a market keeps for
+// subscribers resuming after a disconnect.
+const tradeHistory = 1000
+
+// marketFeed fans one market's trades and level changes out to subscribers.
+// Each operation is delivered as one batch: a trade per fill, then a single
+// book message per level it touched carrying the level's final size.
+//
+// It also keeps the book messages of the latest operations in a ring, so a
+// subscriber that reconnects can be sent what it missed instead of the whole
+// book.
+type marketFeed struct {
+	mu   sync.Mutex
+	subs map[chan []FeedMessage]struct{}
+
+	// history holds operations' book messages oldest first from next once
+	// it is full. It has every operation after sequence number complete, up
+	// to latest.
+	history  [][]FeedMessage
+	next     int
+	complete uint64
+	latest   uint64
+	// trades holds the latest trades oldest first from tradeNext once it
+	// is full
+	trades    []FeedMessage
+	tradeNext int
+
+	resumeHits, resumeMisses uint64
+}
+
+func newMarketFeed(history int) *marketFeed {
+	return &marketFeed{
+		subs:    make(map[chan []FeedMessage]struct{}),
+		history: make([][]FeedMessage, 0, history),
+		trades:  make([]FeedMessage, 0, tradeHistory),
+	}
+}
+
+// Publish sends one operation's messages. It runs under the book's lock, so
+// it never waits: a subscriber whose buffer is full has already missed
+// deltas, so its channel is closed and it must resynchronise from a snapshot.
+func (f *marketFeed) Publish(msgs []FeedMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record(msgs)
+	for sub := range f.subs {
+		select {
+		case sub <- msgs:
+		default:
+			delete(f.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// record keeps an operation's trades and book messages in the histories,
+// evicting the oldest once they are full.
+func (f *marketFeed) record(msgs []FeedMessage) {
+	for _, msg := range msgs {
+		if msg.Type != FeedTrade {
+			continue
+		}
+		if len(f.trades) < cap(f.trades) {
+			f.trades = append(f.trades, msg)
+			continue
+		}
+		f.trades[f.tradeNext] = msg
+		f.tradeNext = (f.tradeNext + 1) % len(f.trades)
+	}
+
+	book := bookMessages(msgs)
+	if len(book) == 0 {
+		return
+	}
+	f.latest = book[0].Seq
+	if len(f.history) < cap(f.history) {
+		f.history = append(f.history, book)
+		return
+	}
+	f.complete = f.history[f.next][0].Seq
+	f.history[f.next] = book
+	f.next = (f.next + 1) % len(f.history)
+}
+
+func (f *marketFeed) Subscribe() chan []FeedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.subscribe()
+}
+
+func (f *marketFeed) subscribe() chan []FeedMessage {
+	sub := make(chan []FeedMessage, feedBuffer)
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+// Resume subscribes and, if the history still has every operation after
+// since, returns their book messages, oldest first. Nothing can be published
+// between the two, so the replay and the live stream join up exactly.
+func (f *marketFeed) Resume(since uint64) (replay []FeedMessage, ok bool, sub chan []FeedMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if since < f.complete || since > f.latest {
+		f.resumeMisses++
+		return nil, false, f.subscribe()
+	}
+	f.resumeHits++
+	replay = []FeedMessage{}
+	for i := range f.history {
+		book := f.history[(f.next+i)%len(f.history)]
+		if book[0].Seq > since {
+			replay = append(replay, book...)
+		}
+	}
+	return replay, true, f.subscribe()
+}
+
+// ResumeTrades subscribes and returns the trades held with IDs above after,
+// oldest first.
+func (f *marketFeed) ResumeTrades(after uint64) (replay []FeedMessage, sub chan []FeedMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	replay = []FeedMessage{}
+	for i := range f.trades {
+		if trade := f.trades[(f.tradeNext+i)%len(f.trades)]; trade.TradeID > after {
+			replay = append(replay, trade)
+		}
+	}
+	return replay, f.subscribe()
+}
+
+// RecentTrades returns up to limit of the trades held, newest first.
+func (f *marketFeed) RecentTrades(limit int) []FeedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recent := make([]FeedMessage, 0, min(limit, len(f.trades)))
+	for i := range cap(recent) {
+		// the newest is just before tradeNext
+		recent = append(recent, f.trades[(f.tradeNext-1-i+len(f.trades))%len(f.trades)])
+	}
+	return recent
+}
+
+func (f *marketFeed) Unsubscribe(sub chan []FeedMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subs[sub]; ok {
+		delete(f.subs, sub)
+		close(sub)
+	}
+}
+
+// Forget drops the history and cuts off every subscriber after the book
+// changed without publishing events, as when it is imported. The history
+// starts over from seq.
+func (f *marketFeed) Forget(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.history = f.history[:0]
+	f.next = 0
+	f.complete, f.latest = seq, seq
+	for sub := range f.subs {
+		delete(f.subs, sub)
+		close(sub)
+	}
+}
+
+// ForgetTrades drops the latest trades, for a market starting over.
+func (f *marketFeed) ForgetTrades() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.trades = f.trades[:0]
+	f.tradeNext = 0
+}
+
+// FeedStats describes a market's feed history: how many operations it holds
+// and how many resuming subscribers it could and couldn't serve from them.
+type FeedStats struct {
+	Depth        int    `json:"depth"`
+	ResumeHits   uint64 `json:"resumeHits"`
+	ResumeMisses uint64 `json:"resumeMisses"`
+}
+
+func (f *marketFeed) Stats() FeedStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return FeedStats{Depth: len(f.history), ResumeHits: f.resumeHits, ResumeMisses: f.resumeMisses}
+}
+
+// feedMessages turns one operation's events into feed messages. The event log
+// already reports each touched level once, after the fills, so a sweep of
+// many orders at one price gives many trades but only one book message.
+func feedMessages(events []Event) []FeedMessage {
+	msgs := make([]FeedMessage, 0, len(events))
+	for _, e := range events {
+		msg := FeedMessage{Market: e.Market, Seq: e.Seq, Side: orderbook.SideAsk, Price: e.Price, Size: e.Size, TradeID: e.TradeID, Timestamp: e.Timestamp}
+		if e.Bid {
+			msg.Side = orderbook.SideBid
+		}
+		switch e.Type {
+		case EventFill:
+			msg.Type = FeedTrade
+		case EventLevelChanged:
+			msg.Type = FeedBook
+		default:
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// bookMessages keeps the book deltas of an operation's messages.
+func bookMessages(msgs []FeedMessage) []FeedMessage {
+	var book []FeedMessage
+	for _, msg := range msgs {
+		if msg.Type == FeedBook {
+			book = append(book, msg)
+		}
+	}
+	return book
+}
+
+// SubscribeFeed streams market's trades and book deltas, one batch per
+// operation in sequence order. A subscriber that falls more than a few
+// hundred operations behind has its channel closed; unsubscribe stops the
+// stream.
+func (ex *Exchange) SubscribeFeed(market Market) (updates <-chan []FeedMessage, unsubscribe func(), err error) {
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return nil, nil, ErrMarketNotFound
+	}
+	sub := feed.Subscribe()
+	return sub, func() { feed.Unsubscribe(sub) }, nil
+}
+
+// FeedResume is where a resumed feed subscription picks up. When Resumed,
+// Messages are the book deltas published after the subscriber's sequence
+// number, oldest first. Otherwise they were no longer held, and Messages are
+// the whole book instead, one book message per level at its current
+// sequence number, for the subscriber to rebuild from.
+type FeedResume struct {
+	Resumed  bool          `json:"resumed"`
+	Messages []FeedMessage `json:"messages"`
+}
+
+// ResumeFeed is SubscribeFeed for a subscriber that has seen market's book up
+// to sequence number since. Live updates pick up where the resume leaves
+// off.
+func (ex *Exchange) ResumeFeed(market Market, since uint64) (resume FeedResume, updates <-chan []FeedMessage, unsubscribe func(), err error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return FeedResume{}, nil, nil, err
+	}
+	feed := ex.feeds[market]
+
+	// publishers hold the write lock, so the book can't move on between the
+	// snapshot and the subscription
+	ob.RLock()
+	defer ob.RUnlock()
+
+	replay, ok, sub := feed.Resume(since)
+	if ok {
+		return FeedResume{Resumed: true, Messages: replay}, sub, func() { feed.Unsubscribe(sub) }, nil
+	}
+	return FeedResume{Messages: feedSnapshot(market, ob)}, sub, func() { feed.Unsubscribe(sub) }, nil
+}
+
+// ResumeTrades is SubscribeFeed for a subscriber that has seen market's
+// trades up to ID after. It is first handed the trades it missed, as far as
+// the last thousand or so go back; live updates pick up after them.
+func (ex *Exchange) ResumeTrades(market Market, after uint64) (missed []FeedMessage, updates <-chan []FeedMessage, unsubscribe func(), err error) {
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return nil, nil, nil, ErrMarketNotFound
+	}
+	missed, sub := feed.ResumeTrades(after)
+	return missed, sub, func() { feed.Unsubscribe(sub) }, nil
+}
+
+// RecentTrades returns up to limit of market's latest trades, newest first,
+// as far as the last thousand or so go back.
+func (ex *Exchange) RecentTrades(market Market, limit int) ([]FeedMessage, error) {
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+	return feed.RecentTrades(limit), nil
+}
+
+// SnapshotFeed is SubscribeFeed starting from the whole of market's book: one
+// book message per level, asks then bids, as of sequence number seq. Live
+// updates pick up after seq.
+func (ex *Exchange) SnapshotFeed(market Market) (snapshot []FeedMessage, seq uint64, updates <-chan []FeedMessage, unsubscribe func(), err error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	feed := ex.feeds[market]
+
+	// as in ResumeFeed, nothing is published between the two
+	ob.RLock()
+	defer ob.RUnlock()
+
+	sub := feed.Subscribe()
+	return feedSnapshot(market, ob), ob.Sequence(), sub, func() { feed.Unsubscribe(sub) }, nil
+}
+
+// feedSnapshot renders ob as book messages. The caller holds its lock.
+func feedSnapshot(market Market, ob *orderbook.Orderbook) []FeedMessage {
+	snapshot := []FeedMessage{}
+	for _, side := range []orderbook.Side{orderbook.SideAsk, orderbook.SideBid} {
+		ob.WalkLimits(side, func(l orderbook.LimitView) bool {
+			snapshot = append(snapshot, FeedMessage{Type: FeedBook, Market: market, Seq: ob.Sequence(), Side: side, Price: l.Price, Size: l.TotalVolume})
+			return true
+		})
+	}
+	return snapshot
+}
@@ -0,0 +1,42 @@
+package exchange
+
+import (
+	"maps"
+
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// FeeReport is what the exchange has charged in fees. Balances is what
+// ledger.Fees holds in each asset, what is left to withdraw, and Markets
+// what each market's trades have paid into it in each asset, withdrawn or
+// not.
+type FeeReport struct {
+	Balances map[ledger.Asset]float64            `json:"balances"`
+	Markets  map[Market]map[ledger.Asset]float64 `json:"markets"`
+}
+
+// Fees returns the fees charged so far.
+func (ex *Exchange) Fees() FeeReport {
+	report := FeeReport{
+		Balances: ex.ledger.Balances(ledger.Fees),
+		Markets:  make(map[Market]map[ledger.Asset]float64, len(ex.markets)),
+	}
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.RLock()
+		report.Markets[market] = maps.Clone(ex.holds[market].fees)
+		ob.RUnlock()
+	}
+	return report
+}
+
+// WithdrawFees pays amount of asset out of the fees collected to user's
+// free balance, in one ledger entry. It returns ledger.ErrInsufficientFunds
+// if that much hasn't been collected.
+func (ex *Exchange) WithdrawFees(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandWithdrawFees, User: user, Asset: asset, Amount: amount}); rejection != nil {
+		return ledger.Entry{}, rejection
+	}
+	return ex.ledger.WithdrawFees(user, asset, amount)
+}
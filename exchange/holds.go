@@ -0,0 +1,185 @@
+package exchange
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// hold is what one order has set aside of its owner's balance, in the base
+// asset for an ask and the quote asset for a bid.
+type hold struct {
+	owner  uint64
+	bid    bool
+	amount float64
+}
+
+// holdBook keeps what one market's user orders hold of their owners'
+// balances, so the same funds can't back two orders: an ask holds its
+// remaining size, a bid the quote its remaining size costs at its limit
+// price, and a market order what sweeping the book would cost while it
+// matches. Anonymous orders aren't funded from the ledger and hold nothing.
+// It is guarded by the market's book lock.
+type holdBook struct {
+	assets MarketAssets
+	// scale is the market's, to value its prices and sizes in the ledger
+	scale  orderbook.Scale
+	ledger *ledger.Ledger
+	held   map[uint64]hold
+	// anonymous is whether anonymous orders may trade against users'
+	anonymous bool
+	// settled is told of each trade settled
+	settled func(Settlement)
+	// fees is what the market's trades have paid into ledger.Fees, in each
+	// asset
+	fees map[ledger.Asset]float64
+}
+
+func newHoldBook(assets MarketAssets, scale orderbook.Scale, l *ledger.Ledger, anonymous bool) *holdBook {
+	return &holdBook{assets: assets, scale: scale, ledger: l, held: make(map[uint64]hold), anonymous: anonymous, fees: make(map[ledger.Asset]float64)}
+}
+
+// asset is the asset an order on the given side holds.
+func (h *holdBook) asset(bid bool) ledger.Asset {
+	if bid {
+		return h.assets.Quote
+	}
+	return h.assets.Base
+}
+
+// set makes o hold amount, holding more of its owner's balance or releasing
+// the difference. Holding more fails with ledger.ErrInsufficientFunds if
+// the owner doesn't have it free.
+func (h *holdBook) set(o *orderbook.Order, amount float64) error {
+	if o.Owner == 0 {
+		return nil
+	}
+	amount = ledger.Round(amount)
+	held := h.held[o.ID].amount
+	asset := h.asset(o.Bid)
+	switch change := ledger.Round(amount - held); {
+	case change > 0:
+		if _, err := h.ledger.Hold(o.Owner, asset, change); err != nil {
+			return err
+		}
+	case change < 0:
+		if _, err := h.ledger.Release(o.Owner, asset, -change); err != nil {
+			return err
+		}
+	}
+	if amount == 0 {
+		delete(h.held, o.ID)
+	} else {
+		h.held[o.ID] = hold{owner: o.Owner, bid: o.Bid, amount: amount}
+	}
+	return nil
+}
+
+// reserve is set for an order coming in, answering a shortfall with a
+// *Rejection.
+func (h *holdBook) reserve(o *orderbook.Order, amount float64) *Rejection {
+	if err := h.set(o, amount); err != nil {
+		asset := h.asset(o.Bid)
+		return &Rejection{
+			Msg:  fmt.Sprintf("insufficient %s: %.8g needed, %.8g free", asset, amount, h.ledger.Balance(ledger.UserAccount(o.Owner), asset)),
+			Code: "INSUFFICIENT_FUNDS",
+		}
+	}
+	return nil
+}
+
+// sync brings o's hold in line with o after an operation on the book: what
+// it needs while it rests, nothing once it is gone.
+func (h *holdBook) sync(o *orderbook.Order, gone bool) {
+	amount := 0.0
+	if !gone && o.Limit != nil {
+		amount = h.restingHold(o)
+	}
+	if err := h.set(o, amount); err != nil {
+		slog.Error("order hold out of line with the book", "id", o.ID, "owner", o.Owner, "amount", amount, "error", err)
+	}
+}
+
+// resync brings the holds in line with ob after it was changed without
+// events: orders that are gone, and aren't held elsewhere as stops are,
+// release theirs, and orders new to the book hold what they need if their
+// owners have it.
+func (h *holdBook) resync(ob *orderbook.Orderbook, stops *stopBook) {
+	for id, held := range h.held {
+		if _, ok := ob.GetOrder(id); ok {
+			continue
+		}
+		if _, ok := stops.get(id); ok {
+			continue
+		}
+		h.sync(&orderbook.Order{ID: id, Owner: held.owner, Bid: held.bid}, true)
+	}
+	for _, limits := range [][]*orderbook.Limit{ob.Asks(), ob.Bids()} {
+		for _, limit := range limits {
+			for _, o := range limit.Orders {
+				h.sync(o, false)
+			}
+		}
+	}
+}
+
+// restingHold is what o needs to hold while it rests.
+func (h *holdBook) restingHold(o *orderbook.Order) float64 {
+	if o.Bid {
+		return h.notionalUp(o.Price, o.Remaining())
+	}
+	return h.scale.SizeValue(o.Remaining())
+}
+
+// entryHold is what an order placed as req needs to hold on the way in. A
+// market buy may cost up to sweeping size off the book; a stop buy is held
+// at its stop price until it triggers and the book says what it costs.
+func (h *holdBook) entryHold(req PlaceOrderRequest, ob *orderbook.Orderbook) float64 {
+	switch {
+	case !req.Bid:
+		return h.scale.SizeValue(req.Size)
+	case req.Type == LimitOrder:
+		return h.notionalUp(req.Price, req.Size)
+	case req.Type == StopMarketOrder:
+		return h.notionalUp(req.StopPrice, req.Size)
+	default:
+		notional, _ := ob.NotionalForSize(true, req.Size)
+		return ledger.Round(notional)
+	}
+}
+
+// sweepHold is what a market buy of size holds once plan has taken its
+// owner's own asks out of its way: what sweeping size off what is left of the
+// book costs, which may go deeper than entryHold's sweep of the whole book.
+func (h *holdBook) sweepHold(ob *orderbook.Orderbook, size orderbook.Size, plan selfTrades) float64 {
+	removed := plan.removedFrom()
+	notional := 0.0
+	for _, limit := range ob.Asks() {
+		if size == 0 {
+			break
+		}
+		volume := orderbook.Size(0)
+		for _, o := range limit.Orders {
+			if !o.Frozen {
+				volume += o.Remaining() - removed[o]
+			}
+		}
+		take := min(size, volume)
+		notional += h.scale.Notional(limit.Price, take)
+		size -= take
+	}
+	return ledger.Round(notional)
+}
+
+// notional is size at price in the quote asset, as the ledger settles a
+// trade of it.
+func (h *holdBook) notional(price orderbook.Price, size orderbook.Size) float64 {
+	return ledger.Notional(h.scale.PriceValue(price), h.scale.SizeValue(size))
+}
+
+// notionalUp is notional rounded up, as ledger.NotionalUp is.
+func (h *holdBook) notionalUp(price orderbook.Price, size orderbook.Size) float64 {
+	return ledger.NotionalUp(h.scale.PriceValue(price), h.scale.SizeValue(size))
+}
@@ -0,0 +1,427 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// CommandType names an operation that changes the exchange's state.
+type CommandType string
+
+const (
+	CommandPlace          CommandType = "PLACE"
+	CommandModify         CommandType = "MODIFY"
+	CommandReduce         CommandType = "REDUCE"
+	CommandCancel         CommandType = "CANCEL"
+	CommandCancelOrder    CommandType = "CANCEL_ORDER"
+	CommandExpire         CommandType = "EXPIRE"
+	CommandReset          CommandType = "RESET"
+	CommandStartAuction   CommandType = "START_AUCTION"
+	CommandExecuteAuction CommandType = "EXECUTE_AUCTION"
+	CommandImport         CommandType = "IMPORT"
+	CommandPatchLimits    CommandType = "PATCH_LIMITS"
+	CommandUserLimits     CommandType = "USER_LIMITS"
+	CommandSuspendUser    CommandType = "SUSPEND_USER"
+	CommandResumeUser     CommandType = "RESUME_USER"
+	CommandFreezeOrder    CommandType = "FREEZE_ORDER"
+	CommandSandboxReset   CommandType = "SANDBOX_RESET"
+	CommandDeposit        CommandType = "DEPOSIT"
+	CommandWithdraw       CommandType = "WITHDRAW"
+	CommandTransfer       CommandType = "TRANSFER"
+	CommandWithdrawFees   CommandType = "WITHDRAW_FEES"
+	// CommandRequestWithdrawal and CommandUpdateWithdrawal queue a
+	// withdrawal off the exchange and move it on as it goes out
+	CommandRequestWithdrawal CommandType = "REQUEST_WITHDRAWAL"
+	CommandUpdateWithdrawal  CommandType = "UPDATE_WITHDRAWAL"
+	// CommandAssignAddress, CommandCreditDeposit and CommandScanBlocks
+	// keep deposits from the chain: the addresses given out, the transfers
+	// credited and how far the chain has been scanned
+	CommandAssignAddress CommandType = "ASSIGN_ADDRESS"
+	CommandCreditDeposit CommandType = "CREDIT_DEPOSIT"
+	CommandScanBlocks    CommandType = "SCAN_BLOCKS"
+	// CommandRegisterUser and CommandKeySettings keep the user registry
+	CommandRegisterUser CommandType = "REGISTER_USER"
+	CommandKeySettings  CommandType = "KEY_SETTINGS"
+)
+
+// Command is an operation as the journal records it: what Replay needs to
+// apply it again with the same outcome. Seq numbers the commands journaled,
+// from one. Time is when it was applied, in unix nanoseconds, and the time
+// it reads throughout. OrderID is the order placed, modified or cancelled; a
+// placed order keeps its ID when replayed. Only the fields of the command's
+// type are set.
+type Command struct {
+	Seq     uint64      `json:"seq,omitempty"`
+	Type    CommandType `json:"type"`
+	Time    int64       `json:"time"`
+	Market  Market      `json:"market,omitempty"`
+	User    uint64      `json:"user,omitempty"`
+	OrderID uint64      `json:"orderId,omitempty"`
+
+	Place      *PlaceOrderRequest  `json:"place,omitempty"`
+	Modify     *ModifyRequest      `json:"modify,omitempty"`
+	Reduce     *ReduceRequest      `json:"reduce,omitempty"`
+	Cancel     *CancelRequest      `json:"cancel,omitempty"`
+	Snapshot   *orderbook.Snapshot `json:"snapshot,omitempty"`
+	Replace    bool                `json:"replace,omitempty"`
+	ClearStats bool                `json:"clearStats,omitempty"`
+	Limits     *LimitsPatch        `json:"limits,omitempty"`
+	UserLimits *UserLimits         `json:"userLimits,omitempty"`
+	Asset      ledger.Asset        `json:"asset,omitempty"`
+	Amount     float64             `json:"amount,omitempty"`
+	Transfer   *TransferRequest    `json:"transfer,omitempty"`
+	// Destination is where a withdrawal is sent
+	Destination string            `json:"destination,omitempty"`
+	Withdrawal  *WithdrawalUpdate `json:"withdrawal,omitempty"`
+	// Address is a deposit address assigned, and Block the last block
+	// scanned for deposits
+	Address string        `json:"address,omitempty"`
+	Deposit *ChainDeposit `json:"deposit,omitempty"`
+	Block   uint64        `json:"block,omitempty"`
+	// Registration is a user registered, and KeyHash the hash of the API
+	// key whose KeySettings were set; the key itself is never journaled
+	Registration *user.Registration `json:"registration,omitempty"`
+	KeyHash      string             `json:"keyHash,omitempty"`
+	KeySettings  *user.KeySettings  `json:"keySettings,omitempty"`
+}
+
+// Journal persists commands before they are applied. Append must not return
+// until cmd is durable: the exchange applies it as soon as it does, and
+// refuses it with JOURNAL_FAILED if it returns an error.
+type Journal interface {
+	Append(cmd Command) error
+}
+
+// commandClock is the exchange's clock. While a command is applied it stands
+// still at the command's time, so applying it again from the journal reads
+// the same time; otherwise it reads the clock it wraps.
+type commandClock struct {
+	clock.Clock
+	// pinned is the time it stands still at, in unix nanoseconds, or zero
+	pinned atomic.Int64
+}
+
+func (c *commandClock) Now() time.Time {
+	if t := c.pinned.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return c.Clock.Now()
+}
+
+// begin starts applying a command, and returns the function that ends it.
+// With a journal, commands are applied one at a time, so they are journaled
+// in the order they were applied, and each reads the time it began. The
+// caller holds the lock of the book the command is for, if there is one.
+func (ex *Exchange) begin() (end func()) {
+	if ex.journal == nil || ex.replaying.Load() {
+		return func() {}
+	}
+	ex.journalMu.Lock()
+	ex.clock.pinned.Store(ex.clock.Clock.Now().UnixNano())
+	return func() {
+		ex.clock.pinned.Store(0)
+		ex.journalMu.Unlock()
+	}
+}
+
+// record journals cmd, applied from now until the end of the command begin
+// started, before it changes anything.
+func (ex *Exchange) record(cmd Command) *Rejection {
+	if ex.journal == nil || ex.replaying.Load() {
+		return nil
+	}
+	cmd.Seq = ex.journaled + 1
+	cmd.Time = ex.clock.pinned.Load()
+	if err := ex.journal.Append(cmd); err != nil {
+		slog.Error("failed to journal command", "type", cmd.Type, "market", cmd.Market, "error", err)
+		return journalRejection()
+	}
+	ex.journaled = cmd.Seq
+	return nil
+}
+
+func journalRejection() *Rejection {
+	return &Rejection{
+		Msg:  "the exchange could not record the request",
+		Code: "JOURNAL_FAILED",
+	}
+}
+
+// Replay applies commands read back from a journal, in order, each at its
+// recorded time, and returns how many it applied. It must be called before
+// the exchange takes any other request, and before any handler that
+// shouldn't see the commands' events again is registered. Replayed commands
+// are neither journaled again nor audited; one the exchange refused when it
+// was first applied is refused again. Commands a checkpoint restored by
+// Restore already includes are skipped. Replay stops at the first command
+// that can't be read or applied, or that doesn't follow the one before.
+func (ex *Exchange) Replay(commands iter.Seq2[Command, error]) (int, error) {
+	ex.Follow()
+	defer ex.Lead()
+
+	n := 0
+	for cmd, err := range commands {
+		if err != nil {
+			return n, err
+		}
+		applied, err := ex.Apply(cmd)
+		if err != nil {
+			return n, fmt.Errorf("command %d: %w", n+1, err)
+		}
+		if applied {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PastBook is a market's book as it was after the journaled command Seq,
+// applied at Time, in unix nanoseconds.
+type PastBook struct {
+	Market Market `json:"market"`
+	Seq    uint64 `json:"seq"`
+	Time   int64  `json:"time"`
+	OrderbookData
+}
+
+// BookAt rebuilds market's book as it was after commands, journaled after
+// cp, were applied on top of it: cp is restored into a new exchange
+// configured like this one, commands are applied to it as Replay would and
+// its book is taken. Without a checkpoint the commands are applied from
+// the start. The exchange itself is left alone.
+func (ex *Exchange) BookAt(market Market, cp *Checkpoint, commands iter.Seq2[Command, error]) (PastBook, error) {
+	if _, err := ex.book(market); err != nil {
+		return PastBook{}, err
+	}
+	past := New(ex.config)
+	defer past.Close()
+
+	var at int64
+	if cp != nil {
+		if err := past.Restore(*cp); err != nil {
+			return PastBook{}, err
+		}
+		at = cp.Time
+	}
+	// it follows the commands and never leads, so none of its orders
+	// expires of its own accord
+	past.Follow()
+	for cmd, err := range commands {
+		if err != nil {
+			return PastBook{}, err
+		}
+		applied, err := past.Apply(cmd)
+		if err != nil {
+			return PastBook{}, fmt.Errorf("command %d: %w", cmd.Seq, err)
+		}
+		if applied {
+			at = cmd.Time
+		}
+	}
+	book, err := past.Book(market, nil, nil)
+	if err != nil {
+		return PastBook{}, err
+	}
+	return PastBook{Market: market, Seq: past.journaled, Time: at, OrderbookData: book}, nil
+}
+
+// Follow makes the exchange a follower of commands journaled elsewhere,
+// such as by another exchange it stands by for, which it applies one at a
+// time through Apply until Lead. A follower takes no requests of its own,
+// journals and audits nothing and leaves expiring orders to the commands
+// it is sent.
+func (ex *Exchange) Follow() {
+	ex.replaying.Store(true)
+	ex.audit.paused.Store(true)
+}
+
+// Lead ends Follow: the exchange takes requests again, and its own clock
+// expires orders from now on.
+func (ex *Exchange) Lead() {
+	ex.replaying.Store(false)
+	ex.audit.paused.Store(false)
+	// expiries were left unarmed while it followed
+	for market, ob := range ex.orderbooks {
+		ob.Lock()
+		ex.scheduleExpiry(market)
+		ob.Unlock()
+	}
+}
+
+// Apply applies cmd, journaled elsewhere, at its recorded time, as Replay
+// does, while the exchange follows. It reports whether cmd was applied; one
+// a restored checkpoint already includes is skipped. A command that doesn't
+// follow the last one applied is an error.
+func (ex *Exchange) Apply(cmd Command) (bool, error) {
+	if !ex.replaying.Load() {
+		return false, errors.New("exchange isn't following")
+	}
+	ex.applyMu.Lock()
+	defer ex.applyMu.Unlock()
+
+	// commands journaled before they were numbered are applied as they
+	// come
+	if cmd.Seq != 0 {
+		if cmd.Seq <= ex.journaled {
+			return false, nil
+		}
+		if cmd.Seq != ex.journaled+1 {
+			return false, fmt.Errorf("command %d follows command %d: the journal is missing commands", cmd.Seq, ex.journaled)
+		}
+	}
+	ex.clock.pinned.Store(cmd.Time)
+	err := ex.apply(cmd)
+	ex.clock.pinned.Store(0)
+	if err != nil {
+		return false, err
+	}
+	if cmd.Seq != 0 {
+		ex.journaled = cmd.Seq
+	}
+	return true, nil
+}
+
+// apply applies cmd through the operation it was journaled by. The
+// operation refusing it is no error: it was refused the same way then.
+func (ex *Exchange) apply(cmd Command) error {
+	ctx := context.Background()
+	incomplete := fmt.Errorf("%s command without its request", cmd.Type)
+	var err error
+	switch cmd.Type {
+	case CommandPlace:
+		if cmd.Place == nil {
+			return incomplete
+		}
+		orderbook.ReserveOrderIDs(cmd.OrderID)
+		_, err = ex.placeOrder(ctx, *cmd.Place, cmd.OrderID)
+	case CommandModify:
+		if cmd.Modify == nil {
+			return incomplete
+		}
+		_, err = ex.ModifyOrder(ctx, cmd.User, cmd.OrderID, *cmd.Modify)
+	case CommandReduce:
+		if cmd.Reduce == nil {
+			return incomplete
+		}
+		_, err = ex.ReduceOrder(ctx, cmd.User, cmd.OrderID, *cmd.Reduce)
+	case CommandCancel:
+		if cmd.Cancel == nil {
+			return incomplete
+		}
+		_, err = ex.Cancel(ctx, *cmd.Cancel)
+	case CommandCancelOrder:
+		_, err = ex.CancelOrder(ctx, cmd.User, cmd.OrderID)
+	case CommandExpire:
+		var ob *orderbook.Orderbook
+		if ob, err = ex.book(cmd.Market); err == nil {
+			ob.Lock()
+			ex.expire(cmd.Market)
+			ob.Unlock()
+		}
+	case CommandReset:
+		_, _, err = ex.Reset(cmd.Market, cmd.ClearStats)
+	case CommandStartAuction:
+		_, err = ex.StartAuction(cmd.Market)
+	case CommandExecuteAuction:
+		_, err = ex.ExecuteAuction(cmd.Market)
+	case CommandImport:
+		if cmd.Snapshot == nil {
+			return incomplete
+		}
+		_, err = ex.Import(cmd.Market, *cmd.Snapshot, cmd.Replace)
+	case CommandPatchLimits:
+		if cmd.Limits == nil {
+			return incomplete
+		}
+		_, err = ex.PatchLimits(cmd.Market, *cmd.Limits)
+	case CommandUserLimits:
+		if cmd.UserLimits == nil {
+			return incomplete
+		}
+		_, err = ex.SetUserLimits(cmd.User, *cmd.UserLimits)
+	case CommandSuspendUser:
+		// journaled once for the suspension, then once for each market
+		// its orders were cancelled in
+		var ob *orderbook.Orderbook
+		if cmd.Market == "" {
+			ex.suspend(cmd.User, true)
+		} else if ob, err = ex.book(cmd.Market); err == nil {
+			ob.Lock()
+			ex.cancelSuspended(cmd.Market, cmd.User)
+			ob.Unlock()
+		}
+	case CommandResumeUser:
+		err = ex.ResumeUser(cmd.User)
+	case CommandFreezeOrder:
+		var ob *orderbook.Orderbook
+		if ob, err = ex.book(cmd.Market); err == nil {
+			ob.Lock()
+			_, err = ex.freezeOrder(cmd.Market, cmd.OrderID)
+			ob.Unlock()
+		}
+	case CommandSandboxReset:
+		var ob *orderbook.Orderbook
+		if !ex.sandbox {
+			err = ErrSandboxDisabled
+		} else if cmd.Market == "" {
+			_, err = ex.ledger.Reset()
+		} else if ob, err = ex.book(cmd.Market); err == nil {
+			ob.Lock()
+			ex.resetSandbox(cmd.Market)
+			ob.Unlock()
+		}
+	case CommandDeposit:
+		_, err = ex.Deposit(cmd.User, cmd.Asset, cmd.Amount)
+	case CommandWithdraw:
+		_, err = ex.Withdraw(cmd.User, cmd.Asset, cmd.Amount)
+	case CommandTransfer:
+		if cmd.Transfer == nil {
+			return incomplete
+		}
+		_, err = ex.Transfer(*cmd.Transfer)
+	case CommandWithdrawFees:
+		_, err = ex.WithdrawFees(cmd.User, cmd.Asset, cmd.Amount)
+	case CommandRequestWithdrawal:
+		_, err = ex.RequestWithdrawal(cmd.User, cmd.Asset, cmd.Destination, cmd.Amount)
+	case CommandUpdateWithdrawal:
+		if cmd.Withdrawal == nil {
+			return incomplete
+		}
+		_, err = ex.UpdateWithdrawal(*cmd.Withdrawal)
+	case CommandAssignAddress:
+		err = ex.AssignDepositAddress(cmd.User, cmd.Address)
+	case CommandCreditDeposit:
+		if cmd.Deposit == nil {
+			return incomplete
+		}
+		_, err = ex.CreditDeposit(*cmd.Deposit)
+	case CommandScanBlocks:
+		err = ex.ScanBlocks(cmd.Block)
+	case CommandRegisterUser:
+		if cmd.Registration == nil {
+			return incomplete
+		}
+		_, err = ex.register(*cmd.Registration)
+	case CommandKeySettings:
+		if cmd.KeySettings == nil {
+			return incomplete
+		}
+		err = ex.setKeySettings(cmd.KeyHash, *cmd.KeySettings)
+	default:
+		return fmt.Errorf("unknown command type %q", cmd.Type)
+	}
+	if err != nil {
+		slog.Debug("replayed command refused", "type", cmd.Type, "market", cmd.Market, "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// MarketConfig holds the per-market trading rules enforced at order entry.
+// A zero value leaves the corresponding rule disabled.
+type MarketConfig struct {
+	// Scale is the precision the market's prices and sizes are kept to,
+	// orderbook.DefaultScale if zero. It is set when the exchange starts
+	// and never patched: every price and size the market has taken, in its
+	// book, its journal and its checkpoints, is a number of its units.
+	Scale orderbook.Scale `json:"scale"`
+	// MaxOpenOrders caps the resting orders in the market.
+	MaxOpenOrders int `json:"maxOpenOrders"`
+	// MaxUserOpenOrders caps each user's open orders in the market, resting
+	// or waiting for their stop price. A user's own UserLimits replace it.
+	MaxUserOpenOrders int `json:"maxUserOpenOrders"`
+	// MaxOrderSize caps the size of a single order.
+	MaxOrderSize orderbook.Size `json:"maxOrderSize"`
+	// MaxNotional caps size times price of a single order; market orders
+	// are valued at the reference price.
+	MaxNotional float64 `json:"maxNotional"`
+	// MaxPriceDeviation caps how far a limit price may sit from the
+	// reference price, as a fraction of it (0.1 is 10%).
+	MaxPriceDeviation float64 `json:"maxPriceDeviation"`
+	// MaxPriceLevels caps the price levels on each side of the book.
+	MaxPriceLevels int `json:"maxPriceLevels"`
+	// MaxSideOrders caps the resting orders on each side of the book.
+	MaxSideOrders int `json:"maxSideOrders"`
+	// MinRestingTime is how long a resting order must have rested before it
+	// may be cancelled, in nanoseconds over JSON like every other duration
+	// the exchange reports. Fills and forced cancels ignore it.
+	MinRestingTime time.Duration `json:"minRestingTime"`
+	// MakerFee and TakerFee are what the resting and the incoming side of
+	// a trade pay, as a fraction of what they receive (0.001 is 0.1%): the
+	// buyer in the base asset, the seller in the quote. Both sides of an
+	// auction trade are makers.
+	MakerFee float64 `json:"makerFee"`
+	TakerFee float64 `json:"takerFee"`
+	// MatchPolicy is how the market's book allocates an incoming order
+	// across a price level, price-time priority if zero. Like Scale it is set
+	// when the exchange starts and never patched, so that replaying the
+	// journal fills orders as they were filled.
+	MatchPolicy MatchPolicy `json:"matchPolicy"`
+}
+
+// MatchPolicyType names a way of allocating an incoming order across the
+// resting orders of a price level.
+type MatchPolicyType string
+
+const (
+	// MatchFIFO fills resting orders in time priority. It is the default.
+	MatchFIFO MatchPolicyType = "FIFO"
+	// MatchProRata fills resting orders in proportion to their size.
+	MatchProRata MatchPolicyType = "PRO_RATA"
+)
+
+// MatchPolicy is a market's MatchPolicyType and its parameters.
+type MatchPolicy struct {
+	Type MatchPolicyType `json:"type"`
+	// LotSize and MinFill are a pro-rata policy's: each share is floored
+	// to a multiple of LotSize and dropped if below MinFill, the remainder
+	// going in time priority. Both are ignored for FIFO.
+	LotSize orderbook.Size `json:"lotSize,omitempty"`
+	MinFill orderbook.Size `json:"minFill,omitempty"`
+}
+
+// orderbookPolicy is p as the book applies it, FIFO if p.Type is empty.
+func (p MatchPolicy) orderbookPolicy() (orderbook.MatchPolicy, error) {
+	switch p.Type {
+	case "", MatchFIFO:
+		return orderbook.FIFOPolicy{}, nil
+	case MatchProRata:
+		if p.LotSize < 0 || p.MinFill < 0 {
+			return nil, errors.New("pro-rata lot size and minimum fill must not be negative")
+		}
+		return orderbook.ProRataPolicy{LotSize: p.LotSize, MinFill: p.MinFill}, nil
+	}
+	return nil, fmt.Errorf("unknown match policy %q", p.Type)
+}
+
+// Rejection is an order entry request refused before or at the book. Code
+// identifies the reason; Limit carries the value of the market rule that was
+// broken, if one was, a size in the base asset rather than in the market's
+// units.
+type Rejection struct {
+	Msg   string  `json:"msg"`
+	Code  string  `json:"code"`
+	Limit float64 `json:"limit"`
+}
+
+func (r *Rejection) Error() string {
+	return r.Msg
+}
+
+// check validates an order against the market's rules before it reaches the
+// book. The price band is measured from the mid price, or the last trade
+// price on a one-sided book; with neither there is no reference and the band
+// and market order notional checks are skipped. Stop orders are valued at
+// their stop price.
+func (cfg MarketConfig) check(req PlaceOrderRequest, ob *orderbook.Orderbook) *Rejection {
+	if cfg.MaxOpenOrders > 0 || cfg.MaxPriceLevels > 0 || cfg.MaxSideOrders > 0 {
+		if rejection := cfg.checkDepth(req, ob); rejection != nil {
+			return rejection
+		}
+	}
+
+	if cfg.MaxOrderSize > 0 && req.Size > cfg.MaxOrderSize {
+		return &Rejection{
+			Msg:   fmt.Sprintf("order size %s exceeds the market maximum", cfg.Scale.SizeString(req.Size)),
+			Code:  "MAX_ORDER_SIZE",
+			Limit: cfg.Scale.SizeValue(cfg.MaxOrderSize),
+		}
+	}
+
+	ref, hasRef := ob.ReferencePrice()
+
+	price := req.Price
+	switch req.Type {
+	case MarketOrder:
+		price = ref
+	case StopMarketOrder:
+		price = req.StopPrice
+	}
+	if notional := cfg.Scale.Notional(price, req.Size); cfg.MaxNotional > 0 && price > 0 && notional > cfg.MaxNotional {
+		return &Rejection{
+			Msg:   fmt.Sprintf("order notional %.8g exceeds the market maximum", notional),
+			Code:  "MAX_NOTIONAL",
+			Limit: cfg.MaxNotional,
+		}
+	}
+
+	if req.Type == LimitOrder && cfg.MaxPriceDeviation > 0 && hasRef {
+		if deviation := math.Abs(float64(req.Price-ref)) / float64(ref); deviation > cfg.MaxPriceDeviation {
+			return &Rejection{
+				Msg:   fmt.Sprintf("price %s is too far from the reference price %s", cfg.Scale.PriceString(req.Price), cfg.Scale.PriceString(ref)),
+				Code:  "PRICE_OUT_OF_BAND",
+				Limit: cfg.MaxPriceDeviation,
+			}
+		}
+	}
+
+	return nil
+}
+
+// restsRemainder reports whether some of req would rest on entry. Orders
+// that fill completely against the book never rest, except in an auction
+// where nothing matches on entry.
+func restsRemainder(req PlaceOrderRequest, ob *orderbook.Orderbook) bool {
+	return req.rests() && (ob.InAuction() || req.Size > ob.MatchableVolume(req.Bid, req.Price))
+}
+
+// checkDepth rejects a limit order whose unmatched remainder would rest
+// beyond the market's order cap or the side's level or order cap.
+func (cfg MarketConfig) checkDepth(req PlaceOrderRequest, ob *orderbook.Orderbook) *Rejection {
+	if !restsRemainder(req, ob) {
+		return nil
+	}
+
+	if cfg.MaxOpenOrders > 0 && ob.RestingOrders() >= cfg.MaxOpenOrders {
+		return &Rejection{
+			Msg:   "market has reached its maximum open orders",
+			Code:  "MAX_OPEN_ORDERS",
+			Limit: float64(cfg.MaxOpenOrders),
+		}
+	}
+
+	side, levels := orderbook.SideAsk, ob.AskLimits
+	if req.Bid {
+		side, levels = orderbook.SideBid, ob.BidLimits
+	}
+
+	if cfg.MaxSideOrders > 0 && ob.SideOrders(side) >= cfg.MaxSideOrders {
+		return &Rejection{
+			Msg:   fmt.Sprintf("%s side has reached its maximum resting orders", side),
+			Code:  "MAX_SIDE_ORDERS",
+			Limit: float64(cfg.MaxSideOrders),
+		}
+	}
+	if _, exists := levels[req.Price]; !exists && cfg.MaxPriceLevels > 0 && len(levels) >= cfg.MaxPriceLevels {
+		return &Rejection{
+			Msg:   fmt.Sprintf("%s side has reached its maximum price levels", side),
+			Code:  "MAX_PRICE_LEVELS",
+			Limit: float64(cfg.MaxPriceLevels),
+		}
+	}
+	return nil
+}
+
+// checkUserOrders rejects an order whose unmatched remainder would rest
+// while its owner already has as many open orders in the market as they
+// may: as many as their own UserLimits allow, or else the market's
+// MaxUserOpenOrders. The caller holds the book's lock.
+func (ex *Exchange) checkUserOrders(req PlaceOrderRequest, ob *orderbook.Orderbook, cfg MarketConfig) *Rejection {
+	if req.User == 0 || !restsRemainder(req, ob) {
+		return nil
+	}
+	limit := cfg.MaxUserOpenOrders
+	if limits := ex.UserLimits(req.User); limits.MaxOpenOrders > 0 {
+		limit = limits.MaxOpenOrders
+	}
+	if limit > 0 && ex.history[req.Market].openOrders(req.User) >= limit {
+		return &Rejection{
+			Msg:   "user has reached their maximum open orders in the market",
+			Code:  "MAX_OPEN_ORDERS",
+			Limit: float64(limit),
+		}
+	}
+	return nil
+}
+
+func (ex *Exchange) marketConfig(market Market) MarketConfig {
+	ex.configMu.RLock()
+	defer ex.configMu.RUnlock()
+
+	return *ex.configs[market]
+}
+
+// LimitsPatch updates the listed market limits and leaves the rest as they
+// are.
+type LimitsPatch struct {
+	MaxOpenOrders     *int            `json:"maxOpenOrders"`
+	MaxUserOpenOrders *int            `json:"maxUserOpenOrders"`
+	MaxOrderSize      *orderbook.Size `json:"maxOrderSize"`
+	MaxNotional       *float64        `json:"maxNotional"`
+	MaxPriceDeviation *float64        `json:"maxPriceDeviation"`
+	MaxPriceLevels    *int            `json:"maxPriceLevels"`
+	MaxSideOrders     *int            `json:"maxSideOrders"`
+	MinRestingTime    *time.Duration  `json:"minRestingTime"`
+	MakerFee          *float64        `json:"makerFee"`
+	TakerFee          *float64        `json:"takerFee"`
+}
+
+// Limits returns market's current trading rules.
+func (ex *Exchange) Limits(market Market) (MarketConfig, error) {
+	if _, err := ex.book(market); err != nil {
+		return MarketConfig{}, err
+	}
+	return ex.marketConfig(market), nil
+}
+
+// PatchLimits applies patch to market's rules, taking effect for the next
+// order, and returns the rules now in force.
+func (ex *Exchange) PatchLimits(market Market, patch LimitsPatch) (MarketConfig, error) {
+	if _, err := ex.book(market); err != nil {
+		return MarketConfig{}, err
+	}
+	if patch.MaxOrderSize != nil && *patch.MaxOrderSize < 0 {
+		return MarketConfig{}, errors.New("limits must not be negative")
+	}
+	for _, v := range []*float64{patch.MaxNotional, patch.MaxPriceDeviation} {
+		if v != nil && *v < 0 {
+			return MarketConfig{}, errors.New("limits must not be negative")
+		}
+	}
+	for _, v := range []*int{patch.MaxOpenOrders, patch.MaxUserOpenOrders, patch.MaxPriceLevels, patch.MaxSideOrders} {
+		if v != nil && *v < 0 {
+			return MarketConfig{}, errors.New("limits must not be negative")
+		}
+	}
+	if patch.MinRestingTime != nil && *patch.MinRestingTime < 0 {
+		return MarketConfig{}, errors.New("limits must not be negative")
+	}
+	for _, v := range []*float64{patch.MakerFee, patch.TakerFee} {
+		if v != nil && (*v < 0 || *v >= 1) {
+			return MarketConfig{}, errors.New("fees must be at least 0 and less than 1")
+		}
+	}
+
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandPatchLimits, Market: market, Limits: &patch}); rejection != nil {
+		return MarketConfig{}, rejection
+	}
+
+	ex.configMu.Lock()
+	config := *ex.configs[market]
+	if patch.MaxOpenOrders != nil {
+		config.MaxOpenOrders = *patch.MaxOpenOrders
+	}
+	if patch.MaxUserOpenOrders != nil {
+		config.MaxUserOpenOrders = *patch.MaxUserOpenOrders
+	}
+	if patch.MaxOrderSize != nil {
+		config.MaxOrderSize = *patch.MaxOrderSize
+	}
+	if patch.MaxNotional != nil {
+		config.MaxNotional = *patch.MaxNotional
+	}
+	if patch.MaxPriceDeviation != nil {
+		config.MaxPriceDeviation = *patch.MaxPriceDeviation
+	}
+	if patch.MaxPriceLevels != nil {
+		config.MaxPriceLevels = *patch.MaxPriceLevels
+	}
+	if patch.MaxSideOrders != nil {
+		config.MaxSideOrders = *patch.MaxSideOrders
+	}
+	if patch.MinRestingTime != nil {
+		config.MinRestingTime = *patch.MinRestingTime
+	}
+	if patch.MakerFee != nil {
+		config.MakerFee = *patch.MakerFee
+	}
+	if patch.TakerFee != nil {
+		config.TakerFee = *patch.TakerFee
+	}
+	ex.configs[market] = &config
+	ex.configMu.Unlock()
+
+	slog.Info("market limits updated", "market", market, "config", config)
+	return config, nil
+}
+
+// UserLimits are a user's own trading rules, in place of the markets' for
+// them, such as for VIP accounts. A zero value leaves the market's rule in
+// force.
+type UserLimits struct {
+	// MaxOpenOrders caps the user's open orders in each market in place of
+	// MarketConfig.MaxUserOpenOrders.
+	MaxOpenOrders int `json:"maxOpenOrders"`
+}
+
+// UserLimits returns user's own trading rules.
+func (ex *Exchange) UserLimits(user uint64) UserLimits {
+	ex.configMu.RLock()
+	defer ex.configMu.RUnlock()
+
+	return ex.userLimits[user]
+}
+
+// SetUserLimits replaces user's own trading rules, taking effect for their
+// next order, and returns them. Orders already resting are left alone.
+func (ex *Exchange) SetUserLimits(user uint64, limits UserLimits) (UserLimits, error) {
+	if user == 0 {
+		return UserLimits{}, errors.New("limits are for a user")
+	}
+	if limits.MaxOpenOrders < 0 {
+		return UserLimits{}, errors.New("limits must not be negative")
+	}
+
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandUserLimits, User: user, UserLimits: &limits}); rejection != nil {
+		return UserLimits{}, rejection
+	}
+
+	ex.configMu.Lock()
+	if limits == (UserLimits{}) {
+		delete(ex.userLimits, user)
+	} else {
+		ex.userLimits[user] = limits
+	}
+	ex.configMu.Unlock()
+
+	slog.Info("user limits updated", "user", user, "limits", limits)
+	return limits, nil
+}
@@ -0,0 +1,518 @@
+package exchange
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// DefaultOrderHistory is how many finished orders each market keeps for
+// Order when Config.OrderHistory is unset.
+const DefaultOrderHistory = 10_000
+
+// userFillHistory is how many of a user's most recent fills each market
+// keeps for Fills.
+const userFillHistory = 1000
+
+const (
+	OrderNew             OrderStatus = "NEW"
+	OrderPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	OrderFilled          OrderStatus = "FILLED"
+)
+
+// OrderRecord is the state of an order, live or finished. Price is the limit
+// price, zero for market orders, and StopPrice is set while a stop order
+// waits for its trigger. AvgPrice is the size-weighted price of the fills so
+// far. CreatedAt is when the order reached the exchange and UpdatedAt when
+// it last filled, changed or left the book, both in unix nanoseconds.
+type OrderRecord struct {
+	ID            uint64                `json:"id"`
+	ClientOrderID string                `json:"clientOrderId,omitempty"`
+	User          uint64                `json:"user,omitempty"`
+	Market        Market                `json:"market"`
+	Bid           bool                  `json:"bid"`
+	Price         orderbook.Price       `json:"price"`
+	StopPrice     orderbook.Price       `json:"stopPrice,omitempty"`
+	TimeInForce   orderbook.TimeInForce `json:"timeInForce,omitempty"`
+	ExpiresAt     int64                 `json:"expiresAt,omitempty"`
+	Status        OrderStatus           `json:"status"`
+	OriginalSize  orderbook.Size        `json:"originalSize"`
+	FilledSize    orderbook.Size        `json:"filledSize"`
+	Remaining     orderbook.Size        `json:"remaining"`
+	AvgPrice      orderbook.Price       `json:"avgPrice,omitempty"`
+	// Frozen is set while the order rests out of matching; see
+	// Exchange.FreezeOrder.
+	Frozen    bool  `json:"frozen,omitempty"`
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+// Fill is one of a user's orders trading Size at Price. Maker is set when
+// the order was resting rather than the one coming in; in an auction both
+// sides are makers. TradeID numbers the market's trades, so both sides'
+// fills of a trade share it. Fee is what the order's user paid for it: in
+// the base asset they got for a bid, in the quote asset for an ask.
+type Fill struct {
+	TradeID       uint64          `json:"tradeId"`
+	OrderID       uint64          `json:"orderId"`
+	ClientOrderID string          `json:"clientOrderId,omitempty"`
+	Market        Market          `json:"market"`
+	Bid           bool            `json:"bid"`
+	Price         orderbook.Price `json:"price"`
+	Size          orderbook.Size  `json:"size"`
+	Maker         bool            `json:"maker"`
+	Fee           float64         `json:"fee"`
+	Timestamp     int64           `json:"timestamp"`
+}
+
+// orderTrack is what the book doesn't keep about a live order.
+type orderTrack struct {
+	owner     uint64
+	createdAt int64
+	updatedAt int64
+	// filled and notional sum the size and the price times size of the
+	// order's fills, in the book's units
+	filled   orderbook.Size
+	notional float64
+	// stp is how a resting order was placed to prevent self-trades, which
+	// an amendment that crosses does again
+	stp SelfTradePrevention
+	// reduceOnly orders are trimmed as their owner's position shrinks
+	reduceOnly bool
+}
+
+// orderHistory keeps one market's order records: timestamps and fill totals
+// for the orders it has seen placed, and the final record of orders that
+// left the book, the most recent limit of them. For users it also indexes
+// which of those orders are theirs and keeps their latest fills. It is kept
+// up to date by the market's eventLogs and guarded by the market's book
+// lock.
+type orderHistory struct {
+	clock clock.Clock
+	live  map[uint64]*orderTrack
+	done  map[uint64]OrderRecord
+	// ring holds the IDs in done oldest first, from next on
+	ring []uint64
+	next int
+	// owned holds each user's order IDs in live and done
+	owned map[uint64]map[uint64]bool
+	// open counts each user's orders in live
+	open  map[uint64]int
+	fills map[uint64][]Fill
+	// positions holds each user's position, built up from their fills
+	positions map[uint64]*position
+	// moved holds the users whose positions changed since their
+	// reduce-only orders were last trimmed to them
+	moved map[uint64]bool
+	// trades is the ID of the market's latest trade, and last its price
+	trades uint64
+	last   orderbook.Price
+}
+
+func newOrderHistory(limit int, clk clock.Clock) *orderHistory {
+	return &orderHistory{
+		clock:     clk,
+		live:      make(map[uint64]*orderTrack),
+		done:      make(map[uint64]OrderRecord),
+		ring:      make([]uint64, 0, limit),
+		owned:     make(map[uint64]map[uint64]bool),
+		open:      make(map[uint64]int),
+		fills:     make(map[uint64][]Fill),
+		positions: make(map[uint64]*position),
+		moved:     make(map[uint64]bool),
+	}
+}
+
+// track returns o's track, starting one for an order not seen yet, dated by
+// its book timestamp if it has one.
+func (h *orderHistory) track(o *orderbook.Order) *orderTrack {
+	t, ok := h.live[o.ID]
+	if !ok {
+		created := o.Timestamp
+		if created == 0 {
+			created = h.clock.Now().UnixNano()
+		}
+		t = &orderTrack{owner: o.Owner, createdAt: created, updatedAt: created}
+		h.start(o.ID, t)
+	}
+	return t
+}
+
+// start adds t, the track of the live order with id, indexing it under its
+// owner.
+func (h *orderHistory) start(id uint64, t *orderTrack) {
+	h.live[id] = t
+	if t.owner != 0 {
+		if h.owned[t.owner] == nil {
+			h.owned[t.owner] = make(map[uint64]bool)
+		}
+		h.owned[t.owner][id] = true
+		h.open[t.owner]++
+	}
+}
+
+// stop drops the track of the live order with id, which its owner no longer
+// has open.
+func (h *orderHistory) stop(id uint64) {
+	t, ok := h.live[id]
+	if !ok {
+		return
+	}
+	delete(h.live, id)
+	if t.owner != 0 {
+		if h.open[t.owner]--; h.open[t.owner] == 0 {
+			delete(h.open, t.owner)
+		}
+	}
+}
+
+// openOrders returns how many of user's orders are live: resting, or
+// waiting for their stop price.
+func (h *orderHistory) openOrders(user uint64) int {
+	return h.open[user]
+}
+
+// update notes that o was placed or changed.
+func (h *orderHistory) update(o *orderbook.Order) {
+	h.track(o).updatedAt = h.clock.Now().UnixNano()
+}
+
+// fill adds m, which taker came in for, to the fill totals of both its
+// orders and to their owners' fills and positions, with the fees they paid,
+// and returns the ID and time of the trade.
+func (h *orderHistory) fill(market Market, taker *orderbook.Order, m orderbook.Match, buyerFee, sellerFee float64) (tradeID uint64, timestamp int64) {
+	h.trades++
+	h.last = m.Price
+	now := h.clock.Now().UnixNano()
+	for _, o := range []*orderbook.Order{m.Ask, m.Bid} {
+		t := h.track(o)
+		t.filled += m.SizeFilled
+		t.notional += float64(m.Price) * float64(m.SizeFilled)
+		t.updatedAt = now
+
+		if o.Owner == 0 {
+			continue
+		}
+		fee := sellerFee
+		if o.Bid {
+			fee = buyerFee
+		}
+		fills := append(h.fills[o.Owner], Fill{
+			TradeID:       h.trades,
+			OrderID:       o.ID,
+			ClientOrderID: o.ClientOrderID,
+			Market:        market,
+			Bid:           o.Bid,
+			Price:         m.Price,
+			Size:          m.SizeFilled,
+			Maker:         o != taker,
+			Fee:           fee,
+			Timestamp:     now,
+		})
+		if len(fills) > userFillHistory {
+			fills = slices.Delete(fills, 0, len(fills)-userFillHistory)
+		}
+		h.fills[o.Owner] = fills
+		if delta := positionDelta(o, m); delta != 0 {
+			h.position(o.Owner).trade(m.Price, delta)
+			h.moved[o.Owner] = true
+		}
+	}
+	return h.trades, now
+}
+
+// position returns user's position, starting a flat one for a user who
+// hasn't traded yet.
+func (h *orderHistory) position(user uint64) *position {
+	p, ok := h.positions[user]
+	if !ok {
+		p = &position{}
+		h.positions[user] = p
+	}
+	return p
+}
+
+// finish moves o, which has left the book filled or cancelled, to the
+// finished records, dropping the oldest once they are full.
+func (h *orderHistory) finish(market Market, o *orderbook.Order) {
+	h.update(o)
+	record := h.record(market, o)
+	h.stop(o.ID)
+	if record.Remaining == 0 {
+		record.Status = OrderFilled
+	} else {
+		record.Status = OrderCancelled
+	}
+
+	h.remember(record)
+}
+
+// remember adds record to the finished records, dropping the oldest once
+// they are full.
+func (h *orderHistory) remember(record OrderRecord) {
+	if _, ok := h.done[record.ID]; !ok {
+		if len(h.ring) < cap(h.ring) {
+			h.ring = append(h.ring, record.ID)
+		} else {
+			h.forget(h.ring[h.next])
+			h.ring[h.next] = record.ID
+			h.next = (h.next + 1) % len(h.ring)
+		}
+	}
+	h.done[record.ID] = record
+	if record.User != 0 {
+		if h.owned[record.User] == nil {
+			h.owned[record.User] = make(map[uint64]bool)
+		}
+		h.owned[record.User][record.ID] = true
+	}
+}
+
+// forget drops the finished record of the order with id.
+func (h *orderHistory) forget(id uint64) {
+	h.disown(h.done[id].User, id)
+	delete(h.done, id)
+}
+
+// disown takes the order with id out of owner's orders.
+func (h *orderHistory) disown(owner, id uint64) {
+	if owner == 0 {
+		return
+	}
+	delete(h.owned[owner], id)
+	if len(h.owned[owner]) == 0 {
+		delete(h.owned, owner)
+	}
+}
+
+// record describes o, which is live unless finish says otherwise. An order
+// the history hasn't seen placed, like an imported one, is dated by its
+// book timestamp.
+func (h *orderHistory) record(market Market, o *orderbook.Order) OrderRecord {
+	record := OrderRecord{
+		ID:            o.ID,
+		ClientOrderID: o.ClientOrderID,
+		User:          o.Owner,
+		Market:        market,
+		Bid:           o.Bid,
+		Price:         o.Price,
+		TimeInForce:   o.TimeInForce,
+		ExpiresAt:     o.ExpiresAt,
+		Frozen:        o.Frozen,
+		Status:        OrderNew,
+		OriginalSize:  o.OriginalSize,
+		FilledSize:    o.FilledSize(),
+		Remaining:     o.Remaining(),
+		CreatedAt:     o.Timestamp,
+		UpdatedAt:     o.Timestamp,
+	}
+	if t, ok := h.live[o.ID]; ok {
+		record.CreatedAt, record.UpdatedAt = t.createdAt, t.updatedAt
+		record.FilledSize = t.filled
+		if t.filled > 0 {
+			record.AvgPrice = orderbook.Price(math.Round(t.notional / float64(t.filled)))
+		}
+	}
+	if record.FilledSize > 0 {
+		record.Status = OrderPartiallyFilled
+	}
+	return record
+}
+
+// resync brings the tracks in line with ob after it was changed without
+// events: orders that are gone, and aren't held elsewhere as stops are,
+// lose theirs, and orders new to the history start one.
+func (h *orderHistory) resync(ob *orderbook.Orderbook, stops *stopBook) {
+	for id, t := range h.live {
+		if _, ok := ob.GetOrder(id); ok {
+			continue
+		}
+		if _, ok := stops.get(id); ok {
+			continue
+		}
+		h.stop(id)
+		h.disown(t.owner, id)
+	}
+	for _, limits := range [][]*orderbook.Limit{ob.Asks(), ob.Bids()} {
+		for _, limit := range limits {
+			for _, o := range limit.Orders {
+				h.track(o)
+			}
+		}
+	}
+}
+
+// OrderByClientID is Order for the order user gave clientOrderID within the
+// last Config.ClientOrderIDWindow.
+func (ex *Exchange) OrderByClientID(user uint64, clientOrderID string) (OrderRecord, error) {
+	if id, ok := ex.clientOrders.lookup(user, clientOrderID); ok {
+		if record, err := ex.Order(user, id); err == nil {
+			return record, nil
+		}
+	}
+	return OrderRecord{}, &Rejection{
+		Msg:  fmt.Sprintf("no order with clientOrderId %q", clientOrderID),
+		Code: "ORDER_NOT_FOUND",
+	}
+}
+
+// Order returns the state of user's order with id: resting, waiting for its
+// stop price, or one of the most recent Config.OrderHistory orders each
+// market saw finish. A user of zero stands for anonymous callers, who only
+// see anonymous orders. It returns a *Rejection, ORDER_NOT_FOUND, for any
+// other ID.
+func (ex *Exchange) Order(user, id uint64) (OrderRecord, error) {
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.RLock()
+		record, ok := ex.findOrder(market, id)
+		ob.RUnlock()
+		if ok && record.User == user {
+			return record, nil
+		}
+	}
+	return OrderRecord{}, &Rejection{
+		Msg:  fmt.Sprintf("no order with id %d", id),
+		Code: "ORDER_NOT_FOUND",
+	}
+}
+
+// findOrder returns the record of the order with id in market. The caller
+// holds the book's lock.
+func (ex *Exchange) findOrder(market Market, id uint64) (OrderRecord, bool) {
+	history := ex.history[market]
+	if o, ok := ex.orderbooks[market].GetOrder(id); ok {
+		return history.record(market, o), true
+	}
+	if s, ok := ex.stops[market].get(id); ok {
+		record := history.record(market, s.order)
+		record.StopPrice = s.stop
+		return record, true
+	}
+	record, ok := history.done[id]
+	return record, ok
+}
+
+// UserOrders returns user's orders across markets, live and recently
+// finished, by ID.
+func (ex *Exchange) UserOrders(user uint64) []OrderRecord {
+	records := []OrderRecord{}
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.RLock()
+		for id := range ex.history[market].owned[user] {
+			if record, ok := ex.findOrder(market, id); ok {
+				records = append(records, record)
+			}
+		}
+		ob.RUnlock()
+	}
+	slices.SortFunc(records, func(a, b OrderRecord) int { return cmp.Compare(a.ID, b.ID) })
+	return records
+}
+
+// Fills returns user's most recent fills across markets, oldest first.
+func (ex *Exchange) Fills(user uint64) []Fill {
+	fills := []Fill{}
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.RLock()
+		fills = append(fills, ex.history[market].fills[user]...)
+		ob.RUnlock()
+	}
+	slices.SortStableFunc(fills, func(a, b Fill) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+	return fills
+}
+
+// TradeRole is whether a user's order was resting or coming in when it
+// traded.
+type TradeRole string
+
+const (
+	RoleMaker TradeRole = "MAKER"
+	RoleTaker TradeRole = "TAKER"
+)
+
+// TradeSide is which way a user traded: buying the base asset or selling
+// it.
+type TradeSide string
+
+const (
+	SideBuy  TradeSide = "BUY"
+	SideSell TradeSide = "SELL"
+)
+
+// UserTrade is one of a user's fills as their trade history shows it.
+// FeeAsset is the asset Fee was paid in. NetBase and NetQuote run the
+// totals of what the user's fills in the market, up to and including this
+// one, added to their balances of its assets, after fees: negative for
+// what they paid out.
+type UserTrade struct {
+	Fill
+	Role     TradeRole    `json:"role"`
+	Side     TradeSide    `json:"side"`
+	FeeAsset ledger.Asset `json:"feeAsset"`
+	NetBase  float64      `json:"netBase"`
+	NetQuote float64      `json:"netQuote"`
+}
+
+// UserTrades returns user's most recent trades in market numbered after
+// after, oldest first, at most limit of them. The running totals count
+// every fill the market keeps for the user, so they don't change from one
+// page to the next.
+func (ex *Exchange) UserTrades(user uint64, market Market, after uint64, limit int) ([]UserTrade, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return nil, err
+	}
+	holds := ex.holds[market]
+	assets := holds.assets
+
+	ob.RLock()
+	fills := slices.Clone(ex.history[market].fills[user])
+	ob.RUnlock()
+
+	trades := []UserTrade{}
+	var netBase, netQuote float64
+	for _, fill := range fills {
+		trade := UserTrade{Fill: fill, Role: RoleTaker, Side: SideSell, FeeAsset: assets.Quote}
+		if fill.Maker {
+			trade.Role = RoleMaker
+		}
+		size, notional := holds.scale.SizeValue(fill.Size), holds.notional(fill.Price, fill.Size)
+		if fill.Bid {
+			trade.Side, trade.FeeAsset = SideBuy, assets.Base
+			netBase += size - fill.Fee
+			netQuote -= notional
+		} else {
+			netBase -= size
+			netQuote += notional - fill.Fee
+		}
+		trade.NetBase, trade.NetQuote = ledger.Round(netBase), netQuote
+		if fill.TradeID > after && len(trades) < limit {
+			trades = append(trades, trade)
+		}
+	}
+	return trades, nil
+}
+
+// ReserveTradeIDs makes sure market's trades are numbered after id from now
+// on, for a market whose earlier trades are kept elsewhere, like a
+// database of its history, by a process that didn't restore them.
+func (ex *Exchange) ReserveTradeIDs(market Market, id uint64) error {
+	ob, err := ex.book(market)
+	if err != nil {
+		return err
+	}
+
+	ob.Lock()
+	defer ob.Unlock()
+
+	ex.history[market].trades = max(ex.history[market].trades, id)
+	return nil
+}
@@ -0,0 +1,407 @@
+package exchange
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// OverflowPolicy is what an asynchronous handler does with an operation's
+// events when its queue is full. Publishing never waits for room.
+type OverflowPolicy string
+
+const (
+	// OverflowDrop discards the operation.
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowCoalesce merges the operation into the newest queued one,
+	// keeping only the latest event for each type, side and price. It suits
+	// handlers that only care about the current state, like a depth feed.
+	OverflowCoalesce OverflowPolicy = "coalesce"
+	// OverflowSpill writes the operation to a file and reads it back, in
+	// order, as the queue drains. Nothing is lost or reordered.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// AsyncOptions configure a handler run on the exchange's worker pool.
+type AsyncOptions struct {
+	// Name identifies the handler in pool stats.
+	Name string
+	// Concurrency is the most of the handler's jobs the pool runs at once.
+	// The default, 1, also hands it operations in publish order.
+	Concurrency int
+	// QueueSize is how many operations may wait for a worker before
+	// Overflow applies. It defaults to DefaultQueueSize.
+	QueueSize int
+	// Overflow defaults to OverflowDrop.
+	Overflow OverflowPolicy
+	// SpillDir is where OverflowSpill writes; it defaults to the system's
+	// temporary directory.
+	SpillDir string
+}
+
+// DefaultQueueSize is the queue an asynchronous handler gets when
+// AsyncOptions.QueueSize is unset.
+const DefaultQueueSize = 1024
+
+// PoolStats reports the worker pool's load.
+type PoolStats struct {
+	Workers  int            `json:"workers"`
+	Busy     int            `json:"busy"`
+	Handlers []HandlerStats `json:"handlers"`
+}
+
+// HandlerStats reports one asynchronous handler. Queued and Spilled are the
+// operations waiting for it; the counters are totals since it registered.
+type HandlerStats struct {
+	Name      string         `json:"name"`
+	Overflow  OverflowPolicy `json:"overflow"`
+	Running   int            `json:"running"`
+	Queued    int            `json:"queued"`
+	Spilled   int            `json:"spilled"`
+	Processed uint64         `json:"processed"`
+	Dropped   uint64         `json:"dropped"`
+	Coalesced uint64         `json:"coalesced"`
+}
+
+// workerPool runs asynchronous handlers' jobs on a fixed set of goroutines
+// shared by every handler. Each handler has its own bounded queue, so a slow
+// one only ever backs up itself.
+type workerPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   []*handlerQueue
+	busy    int
+	closed  bool
+	workers int
+	queues  []*handlerQueue
+
+	// pending counts operations accepted but not yet handled, so Close can
+	// wait for them
+	pending sync.WaitGroup
+	stopped sync.WaitGroup
+}
+
+func newWorkerPool(workers int) *workerPool {
+	p := &workerPool{workers: workers}
+	p.cond = sync.NewCond(&p.mu)
+	p.stopped.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.stopped.Done()
+	for {
+		p.mu.Lock()
+		for len(p.ready) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.ready) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		q := p.ready[0]
+		p.ready = p.ready[1:]
+		p.busy++
+		p.mu.Unlock()
+
+		q.runOne()
+
+		p.mu.Lock()
+		p.busy--
+		p.mu.Unlock()
+	}
+}
+
+// schedule hands q a worker for one job. Each call matches a slot q counted
+// in running, so the ready list never outgrows the handlers' concurrency.
+func (p *workerPool) schedule(q *handlerQueue) {
+	p.mu.Lock()
+	p.ready = append(p.ready, q)
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+func (p *workerPool) register(fn EventHandler, opts AsyncOptions) *handlerQueue {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = OverflowDrop
+	}
+	q := &handlerQueue{pool: p, fn: fn, opts: opts}
+
+	p.mu.Lock()
+	p.queues = append(p.queues, q)
+	p.mu.Unlock()
+	return q
+}
+
+// Close waits for every accepted operation to be handled, then stops the
+// workers.
+func (p *workerPool) Close() {
+	p.pending.Wait()
+
+	p.mu.Lock()
+	p.closed = true
+	queues := p.queues
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.stopped.Wait()
+
+	for _, q := range queues {
+		q.closeSpill()
+	}
+}
+
+func (p *workerPool) Stats() PoolStats {
+	p.mu.Lock()
+	stats := PoolStats{Workers: p.workers, Busy: p.busy}
+	queues := p.queues
+	p.mu.Unlock()
+
+	stats.Handlers = make([]HandlerStats, len(queues))
+	for i, q := range queues {
+		stats.Handlers[i] = q.Stats()
+	}
+	return stats
+}
+
+// handlerQueue is one asynchronous handler's backlog.
+type handlerQueue struct {
+	pool *workerPool
+	fn   EventHandler
+	opts AsyncOptions
+
+	mu    sync.Mutex
+	queue [][]Event
+	// running counts the handler's jobs on or waiting for a worker;
+	// scheduled those of them that haven't taken their operation yet
+	running   int
+	scheduled int
+	processed uint64
+	dropped   uint64
+	coalesced uint64
+	spill     *spillFile
+}
+
+// Push queues one operation's events without ever blocking, applying the
+// overflow policy when the queue is full.
+func (q *handlerQueue) Push(events []Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch {
+	case q.spill != nil && q.spill.count > 0:
+		// older operations are on disk; queueing past them would reorder
+		q.spillLocked(events)
+	case len(q.queue) < q.opts.QueueSize:
+		q.pool.pending.Add(1)
+		q.queue = append(q.queue, events)
+	case q.opts.Overflow == OverflowCoalesce:
+		last := len(q.queue) - 1
+		q.queue[last] = coalesce(q.queue[last], events)
+		q.coalesced++
+	case q.opts.Overflow == OverflowSpill:
+		q.spillLocked(events)
+	default:
+		q.dropped++
+	}
+	q.dispatchLocked()
+}
+
+func (q *handlerQueue) spillLocked(events []Event) {
+	if q.spill == nil {
+		spill, err := newSpillFile(q.opts.SpillDir)
+		if err != nil {
+			slog.Error("failed to open event spill file, dropping", "handler", q.opts.Name, "error", err)
+			q.dropped++
+			return
+		}
+		q.spill = spill
+	}
+	if err := q.spill.Write(events); err != nil {
+		slog.Error("failed to spill events, dropping", "handler", q.opts.Name, "error", err)
+		q.dropped++
+		return
+	}
+	q.pool.pending.Add(1)
+}
+
+// dispatchLocked starts jobs for queued work up to the handler's
+// concurrency.
+func (q *handlerQueue) dispatchLocked() {
+	for q.running < q.opts.Concurrency && q.scheduled < len(q.queue) {
+		q.running++
+		q.scheduled++
+		q.pool.schedule(q)
+	}
+}
+
+// runOne handles the oldest queued operation.
+func (q *handlerQueue) runOne() {
+	q.mu.Lock()
+	events := q.queue[0]
+	q.queue = q.queue[1:]
+	q.scheduled--
+	q.refillLocked()
+	q.mu.Unlock()
+
+	q.fn(events)
+
+	q.mu.Lock()
+	q.processed++
+	q.running--
+	q.dispatchLocked()
+	q.mu.Unlock()
+	q.pool.pending.Done()
+}
+
+// refillLocked moves spilled operations back into the queue as it drains.
+func (q *handlerQueue) refillLocked() {
+	for q.spill != nil && q.spill.count > 0 && len(q.queue) < q.opts.QueueSize {
+		events, err := q.spill.Read()
+		if err != nil {
+			slog.Error("failed to read spilled events, dropping them", "handler", q.opts.Name, "count", q.spill.count, "error", err)
+			for ; q.spill.count > 0; q.spill.count-- {
+				q.dropped++
+				q.pool.pending.Done()
+			}
+			break
+		}
+		q.queue = append(q.queue, events)
+	}
+	if q.spill != nil && q.spill.count == 0 {
+		if err := q.spill.Reset(); err != nil {
+			slog.Error("failed to reset event spill file", "handler", q.opts.Name, "error", err)
+		}
+	}
+}
+
+func (q *handlerQueue) closeSpill() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.spill != nil {
+		q.spill.Close()
+		q.spill = nil
+	}
+}
+
+func (q *handlerQueue) Stats() HandlerStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := HandlerStats{
+		Name:      q.opts.Name,
+		Overflow:  q.opts.Overflow,
+		Running:   q.running,
+		Queued:    len(q.queue),
+		Processed: q.processed,
+		Dropped:   q.dropped,
+		Coalesced: q.coalesced,
+	}
+	if q.spill != nil {
+		stats.Spilled = q.spill.count
+	}
+	return stats
+}
+
+// coalesce merges next into queued, replacing events of the same type, side
+// and price with their newer version. queued may share its array with the
+// publisher's, so the result is always a fresh slice.
+func coalesce(queued, next []Event) []Event {
+	type key struct {
+		typ    EventType
+		market Market
+		bid    bool
+		price  orderbook.Price
+	}
+	merged := make([]Event, 0, len(queued)+len(next))
+	index := make(map[key]int, len(queued)+len(next))
+	for _, events := range [][]Event{queued, next} {
+		for _, e := range events {
+			k := key{e.Type, e.Market, e.Bid, e.Price}
+			if i, ok := index[k]; ok {
+				merged[i] = e
+				continue
+			}
+			index[k] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// spillFile is an append-only file of JSON-encoded operations, read back in
+// the order they were written.
+type spillFile struct {
+	f *os.File
+	// off is where the next unread operation starts
+	off   int64
+	count int
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, "exchange-events-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	// the file only lives as long as the open handle
+	os.Remove(f.Name())
+	return &spillFile{f: f}, nil
+}
+
+func (s *spillFile) Write(events []Event) error {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+func (s *spillFile) Read() ([]Event, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(s.f, s.off, math.MaxInt64-s.off)).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading spilled events: %w", err)
+	}
+	var events []Event
+	if err := json.Unmarshal(line, &events); err != nil {
+		return nil, fmt.Errorf("decoding spilled events: %w", err)
+	}
+	s.off += int64(len(line))
+	s.count--
+	return events, nil
+}
+
+// Reset empties the file once everything in it has been read.
+func (s *spillFile) Reset() error {
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.off = 0
+	return nil
+}
+
+func (s *spillFile) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,160 @@
+package exchange
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingHandler records what it is given and holds its worker until
+// release is closed. started is signalled on its first call.
+type blockingHandler struct {
+	release <-chan struct{}
+	started chan struct{}
+
+	mu      sync.Mutex
+	batches [][]Event
+}
+
+func newBlockingHandler(release <-chan struct{}) *blockingHandler {
+	return &blockingHandler{release: release, started: make(chan struct{}, 1)}
+}
+
+func (h *blockingHandler) handle(events []Event) {
+	select {
+	case h.started <- struct{}{}:
+	default:
+	}
+	<-h.release
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batches = append(h.batches, events)
+}
+
+func TestPoolOverflowPolicies(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true, Workers: 3})
+	release := make(chan struct{})
+	handlers := map[OverflowPolicy]*blockingHandler{}
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowCoalesce, OverflowSpill} {
+		h := newBlockingHandler(release)
+		handlers[policy] = h
+		ex.HandleEventsAsync(h.handle, AsyncOptions{
+			Name:      string(policy),
+			QueueSize: 2,
+			Overflow:  policy,
+			SpillDir:  t.TempDir(),
+		})
+	}
+
+	place := func() {
+		if _, err := ex.PlaceOrder(context.Background(), PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place()
+	for _, h := range handlers {
+		<-h.started
+	}
+
+	// every worker is stuck, yet matching carries on without waiting
+	const orders = 20
+	begin := time.Now()
+	for i := 1; i < orders; i++ {
+		place()
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("placing orders against a saturated pool took %v", elapsed)
+	}
+
+	stats, _ := ex.Stats(MarketEth)
+	if stats.Pool.Workers != 3 || stats.Pool.Busy != 3 || len(stats.Pool.Handlers) != 3 {
+		t.Fatalf("unexpected pool stats %+v", stats.Pool)
+	}
+	for _, hs := range stats.Pool.Handlers {
+		want := HandlerStats{Name: hs.Name, Overflow: hs.Overflow, Running: 1, Queued: 2}
+		switch hs.Overflow {
+		case OverflowDrop:
+			want.Dropped = orders - 3
+		case OverflowCoalesce:
+			want.Coalesced = orders - 3
+		case OverflowSpill:
+			want.Spilled = orders - 3
+		}
+		if hs != want {
+			t.Fatalf("expected %+v, got %+v", want, hs)
+		}
+	}
+
+	close(release)
+	ex.Close()
+
+	if got := len(handlers[OverflowDrop].batches); got != 3 {
+		t.Fatalf("drop: expected 3 operations handled, got %d", got)
+	}
+
+	// the newest queued operation absorbed the rest, keeping the latest
+	// level size
+	coalesced := handlers[OverflowCoalesce].batches
+	if len(coalesced) != 3 {
+		t.Fatalf("coalesce: expected 3 batches, got %d", len(coalesced))
+	}
+	last := coalesced[2]
+	if len(last) != 2 || last[0].Type != EventOrderAccepted || last[1].Type != EventLevelChanged || last[1].Size != sz(orders) || last[1].Seq != orders {
+		t.Fatalf("coalesce: unexpected merged batch %+v", last)
+	}
+
+	spilled := handlers[OverflowSpill].batches
+	if len(spilled) != orders {
+		t.Fatalf("spill: expected %d operations handled, got %d", orders, len(spilled))
+	}
+	for i, events := range spilled {
+		if events[0].Seq != uint64(i+1) {
+			t.Fatalf("spill: operation %d delivered with seq %d", i+1, events[0].Seq)
+		}
+	}
+}
+
+func TestPoolConcurrencyLimit(t *testing.T) {
+	ex := New(Config{AnonymousOrders: true, Workers: 4})
+	release := make(chan struct{})
+	var (
+		mu             sync.Mutex
+		active, peak   int
+		startedTwo     = make(chan struct{})
+		startedTwoOnce sync.Once
+	)
+	ex.HandleEventsAsync(func([]Event) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		if active == 2 {
+			startedTwoOnce.Do(func() { close(startedTwo) })
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}, AsyncOptions{Name: "limited", Concurrency: 2}, EventOrderAccepted)
+
+	for i := 0; i < 5; i++ {
+		ex.PlaceOrder(context.Background(), PlaceOrderRequest{Type: LimitOrder, Size: sz(1), Price: px(100), Market: MarketEth})
+	}
+	<-startedTwo
+
+	stats, _ := ex.Stats(MarketEth)
+	if hs := stats.Pool.Handlers[0]; hs.Running != 2 || hs.Queued != 3 {
+		t.Fatalf("expected 2 running and 3 queued, got %+v", hs)
+	}
+
+	close(release)
+	ex.Close()
+	stats, _ = ex.Stats(MarketEth)
+	if hs := stats.Pool.Handlers[0]; peak != 2 || hs.Processed != 5 || hs.Running != 0 || hs.Queued != 0 {
+		t.Fatalf("expected 5 processed at most 2 at a time, got peak %d and %+v", peak, hs)
+	}
+}
@@ -0,0 +1,107 @@
+package exchange
+
+import (
+	"math"
+
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// Position is a user's running position in a market, built up from their
+// fills. Size is signed: positive is long, negative short. EntryPrice is
+// the weighted average price the open size was entered at. RealizedPnL is
+// what closing has made, in the quote asset, and UnrealizedPnL what closing
+// the rest at LastPrice, the market's last trade price, would. Fees are left
+// out of both, and so are trades of a user with themselves.
+type Position struct {
+	Market        Market          `json:"market"`
+	Size          orderbook.Size  `json:"size"`
+	EntryPrice    orderbook.Price `json:"entryPrice"`
+	RealizedPnL   float64         `json:"realizedPnl"`
+	UnrealizedPnL float64         `json:"unrealizedPnl"`
+	LastPrice     orderbook.Price `json:"lastPrice"`
+}
+
+// position is a Position as a market's history keeps it: entry in the
+// book's price units, unrounded, and realized as price times size in its
+// units, like orderTrack.notional.
+type position struct {
+	size     orderbook.Size
+	entry    float64
+	realized float64
+}
+
+// trade applies a fill at price changing the position by delta. A fill
+// against the position closes it first, realizing the difference from the
+// entry price, and whatever is left over opens it the other way at price.
+func (p *position) trade(price orderbook.Price, delta orderbook.Size) {
+	if p.size != 0 && (p.size > 0) != (delta > 0) {
+		closed := delta
+		if absSize(delta) > absSize(p.size) {
+			closed = -p.size
+		}
+		p.realized += (float64(price) - p.entry) * float64(-closed)
+		p.size += closed
+		delta -= closed
+		if p.size == 0 {
+			p.entry = 0
+		}
+	}
+	if delta != 0 {
+		open := float64(absSize(p.size))
+		p.entry = (p.entry*open + float64(price)*float64(absSize(delta))) / (open + float64(absSize(delta)))
+		p.size += delta
+	}
+}
+
+func absSize(z orderbook.Size) orderbook.Size {
+	if z < 0 {
+		return -z
+	}
+	return z
+}
+
+// positionDelta is what m changes the position of o's owner by: the size
+// o bought, or minus what it sold, or nothing if the owner was on both
+// sides.
+func positionDelta(o *orderbook.Order, m orderbook.Match) orderbook.Size {
+	switch {
+	case m.Bid.Owner == m.Ask.Owner:
+		return 0
+	case o.Bid:
+		return m.SizeFilled
+	}
+	return -m.SizeFilled
+}
+
+// Positions returns user's positions in each market they have traded in,
+// in the order the markets were configured.
+func (ex *Exchange) Positions(user uint64) []Position {
+	positions := []Position{}
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		ob.RLock()
+		history := ex.history[market]
+		p, ok := history.positions[user]
+		last := history.last
+		ob.RUnlock()
+		if !ok {
+			continue
+		}
+
+		// realized and unrealized are in price units times size units
+		units := math.Pow10(ob.Scale().Price + ob.Scale().Size)
+		position := Position{
+			Market:      market,
+			Size:        p.size,
+			EntryPrice:  orderbook.Price(math.Round(p.entry)),
+			RealizedPnL: ledger.Round(p.realized / units),
+			LastPrice:   last,
+		}
+		if p.size != 0 {
+			position.UnrealizedPnL = ledger.Round((float64(last) - p.entry) * float64(p.size) / units)
+		}
+		positions = append(positions, position)
+	}
+	return positions
+}
@@ -0,0 +1,225 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// MaxQualityWindow is the longest window BookQuality reports on; book states
+// older than that are forgotten.
+const MaxQualityWindow = 24 * time.Hour
+
+// qualityBands are the distances from mid, as fractions of it, that depth is
+// measured within.
+var qualityBands = [2]float64{0.005, 0.01}
+
+// bookState is what the quality tracker keeps of a book after each change,
+// in the quote and base assets. Bid and Ask are zero when their side is
+// empty.
+type bookState struct {
+	Bid, BidSize float64
+	Ask, AskSize float64
+	// Depth is the resting volume, both sides together, within each of
+	// qualityBands of mid; zero on a one-sided book
+	Depth [2]float64
+}
+
+func newBookState(ob *orderbook.Orderbook) bookState {
+	var s bookState
+	scale := ob.Scale()
+	ob.WalkLimits(orderbook.SideBid, func(l orderbook.LimitView) bool {
+		s.Bid, s.BidSize = scale.PriceValue(l.Price), scale.SizeValue(l.TotalVolume)
+		return false
+	})
+	ob.WalkLimits(orderbook.SideAsk, func(l orderbook.LimitView) bool {
+		s.Ask, s.AskSize = scale.PriceValue(l.Price), scale.SizeValue(l.TotalVolume)
+		return false
+	})
+	if !s.twoSided() {
+		return s
+	}
+
+	mid := (s.Bid + s.Ask) / 2
+	for i, band := range qualityBands {
+		ob.WalkLimits(orderbook.SideBid, func(l orderbook.LimitView) bool {
+			if scale.PriceValue(l.Price) < mid*(1-band) {
+				return false
+			}
+			s.Depth[i] += scale.SizeValue(l.TotalVolume)
+			return true
+		})
+		ob.WalkLimits(orderbook.SideAsk, func(l orderbook.LimitView) bool {
+			if scale.PriceValue(l.Price) > mid*(1+band) {
+				return false
+			}
+			s.Depth[i] += scale.SizeValue(l.TotalVolume)
+			return true
+		})
+	}
+	return s
+}
+
+func (s bookState) twoSided() bool {
+	return s.Bid > 0 && s.Ask > 0
+}
+
+type qualitySample struct {
+	at    time.Time
+	state bookState
+}
+
+// qualityTracker records how a market's book looked over time. Each sample
+// holds until the next one, so averages weigh every state by how long it
+// lasted rather than by how often the book changed.
+type qualityTracker struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	samples []qualitySample
+}
+
+// newQualityTracker starts tracking an empty book from now.
+func newQualityTracker(c clock.Clock) *qualityTracker {
+	return &qualityTracker{
+		clock:   c,
+		samples: []qualitySample{{at: c.Now()}},
+	}
+}
+
+// Observe records the book's state after a change. States equal to the
+// current one are skipped, and samples that ended before MaxQualityWindow
+// are dropped.
+func (q *qualityTracker) Observe(state bookState) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.samples[len(q.samples)-1].state == state {
+		return
+	}
+	now := q.clock.Now()
+	q.samples = append(q.samples, qualitySample{at: now, state: state})
+
+	cutoff := now.Add(-MaxQualityWindow)
+	drop := 0
+	for drop+1 < len(q.samples) && !q.samples[drop+1].at.After(cutoff) {
+		drop++
+	}
+	q.samples = q.samples[drop:]
+}
+
+// BookQuality describes a market's resting liquidity over a window, each
+// figure weighted by how long the book held it. Observed is how much of the
+// window the exchange was tracking the book, and TwoSidedPct the share of
+// it, in percent, with both sides quoted. Spread and depth only exist while
+// the book is two-sided, and top-of-book sizes while their side is quoted;
+// figures with no such time are null and Note says why.
+type BookQuality struct {
+	Market        Market        `json:"market"`
+	Window        time.Duration `json:"window"`
+	Observed      time.Duration `json:"observed"`
+	TwoSidedPct   *float64      `json:"twoSidedPct"`
+	AvgSpread     *float64      `json:"avgSpread"`
+	AvgSpreadBps  *float64      `json:"avgSpreadBps"`
+	AvgDepth05Pct *float64      `json:"avgDepth05Pct"`
+	AvgDepth1Pct  *float64      `json:"avgDepth1Pct"`
+	AvgBidSize    *float64      `json:"avgBidSize"`
+	AvgAskSize    *float64      `json:"avgAskSize"`
+	Note          string        `json:"note,omitempty"`
+}
+
+// Quality computes the book's quality over the window ending now.
+func (q *qualityTracker) Quality(market Market, window time.Duration) BookQuality {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now()
+	from := now.Add(-window)
+
+	var observed, twoSided, bidTime, askTime time.Duration
+	var spread, spreadBps, bidSize, askSize float64
+	var depth [2]float64
+	for i, sample := range q.samples {
+		start, end := sample.at, now
+		if i+1 < len(q.samples) {
+			end = q.samples[i+1].at
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if !end.After(start) {
+			continue
+		}
+		d := end.Sub(start)
+		weight := d.Seconds()
+		s := sample.state
+
+		observed += d
+		if s.Bid > 0 {
+			bidTime += d
+			bidSize += s.BidSize * weight
+		}
+		if s.Ask > 0 {
+			askTime += d
+			askSize += s.AskSize * weight
+		}
+		if s.twoSided() {
+			twoSided += d
+			mid := (s.Bid + s.Ask) / 2
+			spread += (s.Ask - s.Bid) * weight
+			spreadBps += (s.Ask - s.Bid) / mid * 10_000 * weight
+			for j := range depth {
+				depth[j] += s.Depth[j] * weight
+			}
+		}
+	}
+
+	quality := BookQuality{Market: market, Window: window, Observed: observed}
+	if observed == 0 {
+		quality.Note = "no book data in the window"
+		return quality
+	}
+	avg := func(sum float64, over time.Duration) *float64 {
+		if over == 0 {
+			return nil
+		}
+		v := sum / over.Seconds()
+		return &v
+	}
+	pct := float64(twoSided) / float64(observed) * 100
+	quality.TwoSidedPct = &pct
+	quality.AvgSpread = avg(spread, twoSided)
+	quality.AvgSpreadBps = avg(spreadBps, twoSided)
+	quality.AvgDepth05Pct = avg(depth[0], twoSided)
+	quality.AvgDepth1Pct = avg(depth[1], twoSided)
+	quality.AvgBidSize = avg(bidSize, bidTime)
+	quality.AvgAskSize = avg(askSize, askTime)
+	switch {
+	case bidTime == 0 && askTime == 0:
+		quality.Note = "the book was empty for the whole window"
+	case twoSided == 0:
+		quality.Note = "the book was never two-sided in the window, so there is no spread or depth"
+	}
+	return quality
+}
+
+// sampleQuality records market's book state for quality metrics. The caller
+// holds the book's lock.
+func (ex *Exchange) sampleQuality(market Market) {
+	ex.quality[market].Observe(newBookState(ex.orderbooks[market]))
+}
+
+// Quality reports market's book quality over the window ending now, which
+// must be positive and at most MaxQualityWindow.
+func (ex *Exchange) Quality(market Market, window time.Duration) (BookQuality, error) {
+	tracker, ok := ex.quality[market]
+	if !ok {
+		return BookQuality{}, ErrMarketNotFound
+	}
+	if window <= 0 || window > MaxQualityWindow {
+		return BookQuality{}, ErrInvalidWindow
+	}
+	return tracker.Quality(market, window), nil
+}
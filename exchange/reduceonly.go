@@ -0,0 +1,115 @@
+package exchange
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// ReduceOnlyPolicy is what happens to a reduce-only order larger than the
+// position it reduces.
+type ReduceOnlyPolicy string
+
+const (
+	// ReduceOnlyReject refuses the order. It is the default.
+	ReduceOnlyReject ReduceOnlyPolicy = "REJECT"
+	// ReduceOnlyResize places it sized down to the position.
+	ReduceOnlyResize ReduceOnlyPolicy = "RESIZE"
+)
+
+// Valid reports whether p is a known policy, or empty for the default.
+func (p ReduceOnlyPolicy) Valid() bool {
+	switch p {
+	case "", ReduceOnlyReject, ReduceOnlyResize:
+		return true
+	}
+	return false
+}
+
+// ReasonReduceOnly is the Reason of the updates of a resting reduce-only
+// order trimmed or cancelled because its owner's position shrank.
+const ReasonReduceOnly = "REDUCE_ONLY"
+
+// reducible is how much an order on the given side can take off p without
+// growing it or flipping it: nothing unless it trades against it.
+func reducible(p *position, bid bool) orderbook.Size {
+	if p == nil || p.size == 0 || (p.size > 0) == bid {
+		return 0
+	}
+	return absSize(p.size)
+}
+
+// capReduceOnly holds req, a reduce-only order, to its owner's position in
+// its market, sizing it and order down to the position under
+// ReduceOnlyResize. The caller holds the book's lock.
+func (ex *Exchange) capReduceOnly(req *PlaceOrderRequest, order *orderbook.Order, ob *orderbook.Orderbook) *Rejection {
+	allowed := reducible(ex.history[req.Market].positions[req.User], req.Bid)
+	switch {
+	case allowed == 0:
+		return &Rejection{
+			Msg:  "reduce-only order would open or grow a position",
+			Code: "REDUCE_ONLY",
+		}
+	case req.Size <= allowed:
+		return nil
+	case req.ReduceOnlyPolicy != ReduceOnlyResize:
+		return &Rejection{
+			Msg:  fmt.Sprintf("reduce-only order is larger than the %s position it reduces", ob.Scale().SizeString(allowed)),
+			Code: "REDUCE_ONLY",
+		}
+	}
+	req.Size = allowed
+	order.Size, order.OriginalSize = allowed, allowed
+	order.DisplaySize = min(order.DisplaySize, allowed)
+	return nil
+}
+
+// trimReduceOnly brings the resting reduce-only orders of the users whose
+// positions in market moved since it was last called in line with them:
+// one that could now grow or flip its owner's position is cancelled, and
+// one larger than it is reduced to it, as ReduceOrder would. The caller
+// holds the book's lock.
+func (ex *Exchange) trimReduceOnly(market Market, ob *orderbook.Orderbook) {
+	history := ex.history[market]
+	if len(history.moved) == 0 {
+		return
+	}
+	var orders []*orderbook.Order
+	for user := range history.moved {
+		for id := range history.owned[user] {
+			if t, ok := history.live[id]; !ok || !t.reduceOnly {
+				continue
+			}
+			if o, ok := ob.GetOrder(id); ok && o.Remaining() > reducible(history.positions[user], o.Bid) {
+				orders = append(orders, o)
+			}
+		}
+	}
+	clear(history.moved)
+	if len(orders) == 0 {
+		return
+	}
+	// by ID rather than map order, so a replay trims them alike
+	slices.SortFunc(orders, func(a, b *orderbook.Order) int { return cmp.Compare(a.ID, b.ID) })
+
+	l := ex.newEventLog(market, ob)
+	l.reason = ReasonReduceOnly
+	for _, o := range orders {
+		remaining, size := o.Remaining(), reducible(history.positions[o.Owner], o.Bid)
+		// size is below what o has left, so the book takes it
+		ob.ReduceOrder(o, size)
+		if size == 0 {
+			l.done(o)
+		} else {
+			l.changed(o)
+			l.update(OrderUpdateAmended, o, size)
+			l.history.update(o)
+		}
+		l.touch(o.Bid, o.Price)
+		slog.Info("reduce-only order trimmed", "market", market, "id", o.ID, "from", ob.Scale().SizeString(remaining), "to", ob.Scale().SizeString(size))
+	}
+	ex.events.Publish(l.finish())
+}
@@ -0,0 +1,133 @@
+package exchange
+
+import (
+	"log/slog"
+	"strconv"
+
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// Settlement is a trade as it was settled: the ledger entry recording it,
+// and the market it was made in.
+type Settlement struct {
+	ledger.Trade
+	Market Market
+	Entry  uint64
+}
+
+// SettlementHandler receives trades as they settle.
+type SettlementHandler func(Settlement)
+
+// HandleSettlements registers fn to see every trade with a user on either
+// side as it settles. Like a handler registered by HandleEvents, it runs with
+// the book's lock held, so it must be quick and must not take that lock
+// itself.
+func (ex *Exchange) HandleSettlements(fn SettlementHandler) {
+	ex.settlementMu.Lock()
+	defer ex.settlementMu.Unlock()
+
+	ex.settlementHandlers = append(ex.settlementHandlers, fn)
+}
+
+// settled hands s, settled in market, to the settlement handlers.
+func (ex *Exchange) settled(market Market, s Settlement) {
+	ex.settlementMu.RLock()
+	defer ex.settlementMu.RUnlock()
+
+	s.Market = market
+	for _, fn := range ex.settlementHandlers {
+		fn(s)
+	}
+}
+
+// tradeFees returns the fees the buyer and the seller of m pay under cfg,
+// taker being the order that came in: the buyer's in the base asset it
+// gets and the seller's in the quote asset. An anonymous side pays none.
+// Each is rounded down to the ledger's precision, by ledger.Fee, so the
+// dust below it stays with the trader and a fee never exceeds its rate.
+func (h *holdBook) tradeFees(m orderbook.Match, taker *orderbook.Order, cfg MarketConfig) (buyerFee, sellerFee float64) {
+	feeRate := func(o *orderbook.Order) float64 {
+		switch {
+		case o.Owner == 0:
+			return 0
+		case o == taker:
+			return cfg.TakerFee
+		}
+		return cfg.MakerFee
+	}
+	return ledger.Fee(h.scale.SizeValue(m.SizeFilled), feeRate(m.Bid)), ledger.Fee(h.notional(m.Price, m.SizeFilled), feeRate(m.Ask))
+}
+
+// settle moves the balances m trades: the seller's base to the buyer and
+// the buyer's quote to the seller, less buyerFee and sellerFee, as one
+// ledger entry paid out of what each order holds. An anonymous side is
+// settled against ledger.External, but only where anonymous orders are let
+// in: elsewhere one that got on the book some other way, like a warm-up,
+// would credit its user funds nobody paid. What each order paid comes off
+// its hold, so the hold only covers what it has left to trade. The entry's
+// reference is reference, naming the trade.
+func (h *holdBook) settle(m orderbook.Match, buyerFee, sellerFee float64, reference string) {
+	buyer, seller := m.Bid.Owner, m.Ask.Owner
+	if buyer == 0 && seller == 0 {
+		return
+	}
+	if (buyer == 0 || seller == 0) && !h.anonymous {
+		slog.Error("trade with an anonymous order not settled", "bid", m.Bid.ID, "ask", m.Ask.ID, "price", h.scale.PriceString(m.Price), "size", h.scale.SizeString(m.SizeFilled))
+		return
+	}
+	trade := ledger.Trade{
+		Buyer:     buyer,
+		Seller:    seller,
+		Base:      h.assets.Base,
+		Quote:     h.assets.Quote,
+		Price:     h.scale.PriceValue(m.Price),
+		Size:      h.scale.SizeValue(m.SizeFilled),
+		BuyerFee:  buyerFee,
+		SellerFee: sellerFee,
+		FromHeld:  true,
+		Reference: reference,
+	}
+	entry, err := h.ledger.Trade(trade)
+	if err != nil {
+		// the holds are taken to cover every fill before the book matches,
+		// so this is a bug, and the trade stands all the same
+		slog.Error("trade not settled", "bid", m.Bid.ID, "ask", m.Ask.ID, "price", trade.Price, "size", trade.Size, "error", err)
+		return
+	}
+	h.spend(m.Bid, h.notional(m.Price, m.SizeFilled))
+	h.spend(m.Ask, h.scale.SizeValue(m.SizeFilled))
+	h.collect(trade.Base, buyerFee)
+	h.collect(trade.Quote, sellerFee)
+	if h.settled != nil {
+		h.settled(Settlement{Trade: trade, Entry: entry.ID})
+	}
+}
+
+// collect adds fee, paid into ledger.Fees by one of the market's trades, to
+// what the market has collected in asset.
+func (h *holdBook) collect(asset ledger.Asset, fee float64) {
+	if fee > 0 {
+		h.fees[asset] = ledger.Round(h.fees[asset] + fee)
+	}
+}
+
+// tradeReference is the reference of the ledger entry settling market's
+// trade with id.
+func tradeReference(market Market, id uint64) string {
+	return string(market) + ":" + strconv.FormatUint(id, 10)
+}
+
+// spend takes amount, paid out by a trade, off what o holds.
+func (h *holdBook) spend(o *orderbook.Order, amount float64) {
+	held, ok := h.held[o.ID]
+	if !ok {
+		return
+	}
+	held.amount = ledger.Round(held.amount - amount)
+	if held.amount <= 0 {
+		delete(h.held, o.ID)
+		return
+	}
+	h.held[o.ID] = held
+}
@@ -0,0 +1,164 @@
+package exchange
+
+import (
+	"log/slog"
+	"slices"
+	"sort"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// stopOrder is a stop-market order held off the book until the last trade
+// price reaches its stop price.
+type stopOrder struct {
+	order *orderbook.Order
+	stop  orderbook.Price
+	// stp is what happens if it triggers into its owner's resting orders
+	stp SelfTradePrevention
+}
+
+// triggers reports whether a trade at price sets off a stop on the given
+// side: buy stops at or above their stop price, sell stops at or below it.
+func triggers(bid bool, stop, price orderbook.Price) bool {
+	if bid {
+		return price >= stop
+	}
+	return price <= stop
+}
+
+// stopBook holds one market's untriggered stop orders, each side sorted by
+// how soon it triggers and then by time. It is guarded by the market's book
+// lock.
+type stopBook struct {
+	buys  []*stopOrder
+	sells []*stopOrder
+	// fired are the stops triggered by the operation being applied, waiting
+	// for fireStops
+	fired []*stopOrder
+}
+
+func (b *stopBook) add(s *stopOrder) {
+	if s.order.Bid {
+		at := sort.Search(len(b.buys), func(i int) bool { return b.buys[i].stop > s.stop })
+		b.buys = slices.Insert(b.buys, at, s)
+	} else {
+		at := sort.Search(len(b.sells), func(i int) bool { return b.sells[i].stop < s.stop })
+		b.sells = slices.Insert(b.sells, at, s)
+	}
+}
+
+// get returns the untriggered stop with id.
+func (b *stopBook) get(id uint64) (*stopOrder, bool) {
+	for _, side := range [][]*stopOrder{b.buys, b.sells} {
+		if i := slices.IndexFunc(side, func(s *stopOrder) bool { return s.order.ID == id }); i >= 0 {
+			return side[i], true
+		}
+	}
+	return nil, false
+}
+
+// remove takes the untriggered stop with id off the book.
+func (b *stopBook) remove(id uint64) (*stopOrder, bool) {
+	for _, side := range []*[]*stopOrder{&b.buys, &b.sells} {
+		if i := slices.IndexFunc(*side, func(s *stopOrder) bool { return s.order.ID == id }); i >= 0 {
+			s := (*side)[i]
+			*side = slices.Delete(*side, i, i+1)
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// clear takes every untriggered stop off the book and returns their orders.
+func (b *stopBook) clear() []*orderbook.Order {
+	var orders []*orderbook.Order
+	for _, side := range []*[]*stopOrder{&b.buys, &b.sells} {
+		for _, s := range *side {
+			orders = append(orders, s.order)
+		}
+		*side = nil
+	}
+	return orders
+}
+
+// removeOwned takes owner's untriggered stops off the book and returns their
+// orders.
+func (b *stopBook) removeOwned(owner uint64) []*orderbook.Order {
+	var orders []*orderbook.Order
+	for _, side := range []*[]*stopOrder{&b.buys, &b.sells} {
+		*side = slices.DeleteFunc(*side, func(s *stopOrder) bool {
+			if s.order.Owner != owner {
+				return false
+			}
+			orders = append(orders, s.order)
+			return true
+		})
+	}
+	return orders
+}
+
+// trigger moves the stops a trade at price sets off to fired.
+func (b *stopBook) trigger(price orderbook.Price) {
+	for _, side := range []*[]*stopOrder{&b.buys, &b.sells} {
+		n := 0
+		for n < len(*side) && triggers((*side)[n].order.Bid, (*side)[n].stop, price) {
+			n++
+		}
+		b.fired = append(b.fired, (*side)[:n]...)
+		*side = slices.Delete(*side, 0, n)
+	}
+}
+
+// fireStops sends market's triggered stops to the book as market orders, in
+// the order they triggered, along with any stops their own fills trigger.
+// A stop the book refuses, or whose owner can no longer fund it now the book
+// says what it costs, is dropped, finishing as cancelled. The caller holds
+// the book's lock.
+func (ex *Exchange) fireStops(market Market, ob *orderbook.Orderbook) {
+	stops := ex.stops[market]
+	holds := ex.holds[market]
+	for len(stops.fired) > 0 {
+		s := stops.fired[0]
+		stops.fired = slices.Delete(stops.fired, 0, 1)
+
+		matches, err := ex.fireStop(market, ob, s)
+		if err != nil {
+			slog.Warn("triggered stop order dropped", "market", market, "id", s.order.ID, "stop", holds.scale.PriceString(s.stop), "error", err)
+			holds.sync(s.order, true)
+			ex.history[market].finish(market, s.order)
+			continue
+		}
+		ex.events.Publish(ex.orderEvents(market, ob, s.order, matches))
+		slog.Info("stop order triggered", "market", market, "id", s.order.ID, "stop", holds.scale.PriceString(s.stop), "filled", holds.scale.SizeString(s.order.FilledSize()))
+	}
+}
+
+// fireStop places the triggered stop s on the book as a market order,
+// preventing its self-trades as it asked, once it holds what the sweep past
+// them costs.
+func (ex *Exchange) fireStop(market Market, ob *orderbook.Orderbook, s *stopOrder) ([]orderbook.Match, error) {
+	bid := s.order.Bid
+	reach := PlaceOrderRequest{Type: MarketOrder, Bid: bid}.reach(0)
+	selfTrades := planSelfTrades(ob, s.order, s.stp, reach)
+	if !selfTrades.empty() && !selfTrades.covers(ob, bid, reach, s.order.Size) {
+		return nil, orderbook.ErrInsufficientLiquidity
+	}
+	holds := ex.holds[market]
+	need := holds.scale.SizeValue(s.order.Remaining())
+	if bid {
+		need = holds.sweepHold(ob, s.order.Size-selfTrades.decrement-selfTrades.drop, selfTrades)
+	}
+	if err := holds.set(s.order, need); err != nil {
+		return nil, err
+	}
+	ex.preventSelfTrades(market, ob, s.order, selfTrades)
+	var matches []orderbook.Match
+	if s.order.Size > 0 {
+		var err error
+		if matches, err = ob.PlaceMarketOrder(s.order); err != nil {
+			return nil, err
+		}
+	}
+	selfTrades.restoreDropped(s.order)
+	return matches, nil
+}
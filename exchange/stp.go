@@ -0,0 +1,199 @@
+package exchange
+
+import (
+	"math"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// SelfTradePrevention is what happens when an order would fill against a
+// resting order with the same owner. Anonymous orders have no owner, so
+// they are never stopped from trading with each other.
+type SelfTradePrevention string
+
+const (
+	// STPCancelNewest drops the rest of the incoming order on reaching its
+	// owner's resting order. It is the default.
+	STPCancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+	// STPCancelOldest cancels the owner's resting orders in the way and
+	// lets the incoming order carry on past them.
+	STPCancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+	// STPCancelBoth drops the rest of the incoming order and cancels the
+	// resting order it reached.
+	STPCancelBoth SelfTradePrevention = "CANCEL_BOTH"
+	// STPDecrement takes the size the two would have traded off both of
+	// them, cancelling whichever is left with nothing.
+	STPDecrement SelfTradePrevention = "DECREMENT"
+)
+
+// Valid reports whether p is a known mode, or empty for the default.
+func (p SelfTradePrevention) Valid() bool {
+	switch p {
+	case "", STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrement:
+		return true
+	}
+	return false
+}
+
+// reduction is a resting order an incoming one is decremented against, and
+// by how much.
+type reduction struct {
+	order *orderbook.Order
+	size  orderbook.Size
+}
+
+// selfTrades is what preventing an incoming order's self-trades does to the
+// book and to the order, worked out before either changes.
+type selfTrades struct {
+	cancel []*orderbook.Order
+	reduce []reduction
+	// decrement is taken off the incoming order along with reduce, as if it
+	// had been placed that much smaller
+	decrement orderbook.Size
+	// drop is taken off the incoming order unmatched, to finish as cancelled
+	drop orderbook.Size
+	// removed is the resting volume cancel and reduce take off the book
+	removed orderbook.Size
+}
+
+// reach is the worst price req can match at: its limit price, the worst
+// price a protected market order allows, or no limit at all.
+func (req PlaceOrderRequest) reach(worst orderbook.Price) orderbook.Price {
+	switch {
+	case req.Type == LimitOrder:
+		return req.Price
+	case worst > 0:
+		return worst
+	case req.Bid:
+		return math.MaxInt64
+	}
+	return 0
+}
+
+// planSelfTrades walks the resting orders o would match at price or better,
+// in the order it would match them, and works out what mode does about the
+// ones o's owner placed. The walk counts only what the others show: an
+// iceberg's hidden size goes to the back of its level once the shown part
+// fills, so it can't come between o and an order behind it. Nothing is
+// planned for an anonymous order, or during an auction, when nothing
+// matches on entry.
+func planSelfTrades(ob *orderbook.Orderbook, o *orderbook.Order, mode SelfTradePrevention, price orderbook.Price) selfTrades {
+	var plan selfTrades
+	if o.Owner == 0 || ob.InAuction() {
+		return plan
+	}
+	limits := ob.Bids()
+	if o.Bid {
+		limits = ob.Asks()
+	}
+	remaining := o.Size
+	for _, limit := range limits {
+		if o.Bid && limit.Price > price || !o.Bid && limit.Price < price {
+			return plan
+		}
+		if !plan.walk(limit, o.Owner, mode, &remaining) {
+			return plan
+		}
+	}
+	return plan
+}
+
+// walk plans one level for an incoming order of owner's with remaining
+// still to match. It reports whether the walk goes on to the next level.
+func (plan *selfTrades) walk(limit *orderbook.Limit, owner uint64, mode SelfTradePrevention, remaining *orderbook.Size) bool {
+	for _, r := range limit.Orders {
+		if *remaining == 0 {
+			return false
+		}
+		if r.Frozen {
+			continue
+		}
+		if r.Owner != owner {
+			*remaining = max(*remaining-r.Size, 0)
+			continue
+		}
+		switch mode {
+		case STPCancelOldest:
+			plan.cancel = append(plan.cancel, r)
+			plan.removed += r.Remaining()
+		case STPDecrement:
+			size := min(*remaining, r.Remaining())
+			plan.reduce = append(plan.reduce, reduction{order: r, size: size})
+			plan.decrement += size
+			plan.removed += size
+			*remaining -= size
+		case STPCancelBoth:
+			plan.cancel = append(plan.cancel, r)
+			plan.removed += r.Remaining()
+			plan.drop = *remaining
+			return false
+		default:
+			plan.drop = *remaining
+			return false
+		}
+	}
+	return *remaining > 0
+}
+
+// removedFrom is how much the plan takes off each resting order it cancels
+// or reduces.
+func (plan selfTrades) removedFrom() map[*orderbook.Order]orderbook.Size {
+	removed := make(map[*orderbook.Order]orderbook.Size, len(plan.cancel)+len(plan.reduce))
+	for _, r := range plan.cancel {
+		removed[r] = r.Remaining()
+	}
+	for _, red := range plan.reduce {
+		removed[red.order] = red.size
+	}
+	return removed
+}
+
+// empty reports whether the plan changes nothing.
+func (plan selfTrades) empty() bool {
+	return len(plan.cancel) == 0 && len(plan.reduce) == 0 && plan.drop == 0
+}
+
+// covers reports whether, once the plan is applied, what rests at price or
+// better for an incoming order on the given side still fills what is left
+// of size.
+func (plan selfTrades) covers(ob *orderbook.Orderbook, bid bool, price orderbook.Price, size orderbook.Size) bool {
+	return ob.MatchableVolume(bid, price)-plan.removed >= size-plan.decrement-plan.drop
+}
+
+// preventSelfTrades applies plan to the book and to o, which is about to
+// match, publishing what happened to the resting orders. o is left with
+// the size it matches; the dropped part is given back by restoreDropped.
+// The caller holds the book's lock.
+func (ex *Exchange) preventSelfTrades(market Market, ob *orderbook.Orderbook, o *orderbook.Order, plan selfTrades) {
+	if plan.empty() {
+		return
+	}
+	cancelled := plan.cancel
+	for _, r := range plan.cancel {
+		ob.CancelOrder(r)
+	}
+	for _, red := range plan.reduce {
+		left := red.order.Remaining() - red.size
+		if left == 0 {
+			ob.CancelOrder(red.order)
+			cancelled = append(cancelled, red.order)
+			continue
+		}
+		// within what remains, so it can't fail
+		_ = ob.ReduceOrder(red.order, left)
+		ex.events.Publish(ex.modifyEvents(market, ob, red.order, red.order.Price, red.order.Size, true, nil))
+	}
+	if len(cancelled) > 0 {
+		ex.events.Publish(ex.cancelEvents(market, ob, cancelled))
+	}
+	o.Size -= plan.decrement + plan.drop
+	o.OriginalSize -= plan.decrement
+}
+
+// restoreDropped gives o back the size plan dropped once it has matched,
+// so it finishes with that much cancelled rather than resting it.
+func (plan selfTrades) restoreDropped(o *orderbook.Order) {
+	if plan.drop > 0 {
+		o.Size += plan.drop
+	}
+}
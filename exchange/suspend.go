@@ -0,0 +1,172 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// ReasonUserSuspended is the reason given on the order updates of orders
+// cancelled because their owner was suspended.
+const ReasonUserSuspended = "USER_SUSPENDED"
+
+// SuspendUser stops user from placing or amending orders in any market
+// until ResumeUser, and with cancel also cancels their resting orders and
+// untriggered stops everywhere, regardless of the minimum resting time. It
+// returns the orders it cancelled. Suspending a suspended user only cancels.
+func (ex *Exchange) SuspendUser(ctx context.Context, user uint64, cancel bool) ([]OrderCancel, error) {
+	if user == 0 {
+		return nil, errors.New("only a user can be suspended")
+	}
+	end := ex.begin()
+	if rejection := ex.record(Command{Type: CommandSuspendUser, User: user}); rejection != nil {
+		end()
+		return nil, rejection
+	}
+	ex.suspend(user, true)
+	end()
+	slog.Info("user suspended", "user", user, "cancel", cancel)
+
+	cancelled := []OrderCancel{}
+	if !cancel {
+		return cancelled, nil
+	}
+	ctx, stop := context.WithTimeout(ctx, ex.orderTimeout)
+	defer stop()
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		if err := lockBook(ctx, ob); err != nil {
+			return cancelled, timeoutRejection(err)
+		}
+		end := ex.begin()
+		if rejection := ex.record(Command{Type: CommandSuspendUser, Market: market, User: user}); rejection != nil {
+			end()
+			ob.Unlock()
+			return cancelled, rejection
+		}
+		for _, o := range ex.cancelSuspended(market, user) {
+			cancelled = append(cancelled, OrderCancel{
+				CancelledOrder: cancelledOrder(o),
+				Market:         market,
+				FilledSize:     o.FilledSize(),
+				Status:         OrderCancelled,
+			})
+		}
+		end()
+		ob.Unlock()
+	}
+	slog.Info("suspended user's orders cancelled", "user", user, "count", len(cancelled))
+	return cancelled, nil
+}
+
+// ResumeUser lets a suspended user place orders again. Resuming a user who
+// isn't suspended changes nothing.
+func (ex *Exchange) ResumeUser(user uint64) error {
+	if user == 0 {
+		return errors.New("only a user can be resumed")
+	}
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandResumeUser, User: user}); rejection != nil {
+		return rejection
+	}
+	ex.suspend(user, false)
+	slog.Info("user resumed", "user", user)
+	return nil
+}
+
+// Suspended reports whether user is suspended.
+func (ex *Exchange) Suspended(user uint64) bool {
+	ex.configMu.RLock()
+	defer ex.configMu.RUnlock()
+
+	return ex.suspended[user]
+}
+
+func (ex *Exchange) suspend(user uint64, suspended bool) {
+	ex.configMu.Lock()
+	defer ex.configMu.Unlock()
+
+	if suspended {
+		ex.suspended[user] = true
+	} else {
+		delete(ex.suspended, user)
+	}
+}
+
+// checkSuspended refuses a suspended user's order.
+func (ex *Exchange) checkSuspended(user uint64) *Rejection {
+	if user == 0 || !ex.Suspended(user) {
+		return nil
+	}
+	return &Rejection{
+		Msg:  "the user is suspended",
+		Code: ReasonUserSuspended,
+	}
+}
+
+// cancelSuspended cancels user's resting orders and untriggered stops in
+// market, publishing them with the suspension as the reason, and returns
+// them. The caller holds the book's lock.
+func (ex *Exchange) cancelSuspended(market Market, user uint64) []*orderbook.Order {
+	ob := ex.orderbooks[market]
+	owned := func(o *orderbook.Order) bool { return o.Owner == user }
+	orders := ob.CancelRange(orderbook.SideBid, 0, math.MaxInt64, owned)
+	orders = append(orders, ob.CancelRange(orderbook.SideAsk, 0, math.MaxInt64, owned)...)
+	stops := ex.stops[market].removeOwned(user)
+	if len(orders) > 0 || len(stops) > 0 {
+		ex.events.Publish(ex.suspendEvents(market, ob, orders, stops))
+	}
+	return slices.Concat(orders, stops)
+}
+
+// FreezeOrder leaves the resting order with id where it is but stops
+// anything matching against it, until it is cancelled; its owner can't
+// amend it meanwhile. It refuses with ORDER_NOT_FOUND if no book has the
+// order.
+func (ex *Exchange) FreezeOrder(ctx context.Context, id uint64) (OrderRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, ex.orderTimeout)
+	defer cancel()
+	for _, market := range ex.markets {
+		ob := ex.orderbooks[market]
+		if err := lockBook(ctx, ob); err != nil {
+			return OrderRecord{}, timeoutRejection(err)
+		}
+		if _, ok := ob.GetOrder(id); !ok {
+			ob.Unlock()
+			continue
+		}
+		end := ex.begin()
+		if rejection := ex.record(Command{Type: CommandFreezeOrder, Market: market, OrderID: id}); rejection != nil {
+			end()
+			ob.Unlock()
+			return OrderRecord{}, rejection
+		}
+		record, err := ex.freezeOrder(market, id)
+		end()
+		ob.Unlock()
+		if err != nil {
+			return OrderRecord{}, err
+		}
+		slog.Info("order frozen", "market", market, "id", id)
+		return record, nil
+	}
+	return OrderRecord{}, &Rejection{
+		Msg:  fmt.Sprintf("no resting order with id %d", id),
+		Code: "ORDER_NOT_FOUND",
+	}
+}
+
+// freezeOrder freezes the order with id in market's book. The caller holds
+// the book's lock.
+func (ex *Exchange) freezeOrder(market Market, id uint64) (OrderRecord, error) {
+	o, err := ex.orderbooks[market].FreezeOrder(id)
+	if err != nil {
+		return OrderRecord{}, err
+	}
+	return ex.history[market].record(market, o), nil
+}
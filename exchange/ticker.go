@@ -0,0 +1,147 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// Ticker is the top of book and last trade price of a market.
+type Ticker struct {
+	Market  Market          `json:"market"`
+	Bid     orderbook.Price `json:"bid"`
+	BidSize orderbook.Size  `json:"bidSize"`
+	Ask     orderbook.Price `json:"ask"`
+	AskSize orderbook.Size  `json:"askSize"`
+	Last    orderbook.Price `json:"last"`
+	Seq     uint64          `json:"seq"`
+	Ts      int64           `json:"ts"`
+}
+
+// sameQuote reports whether two tickers carry the same prices and sizes,
+// ignoring sequence and time.
+func (t Ticker) sameQuote(o Ticker) bool {
+	return t.Bid == o.Bid && t.BidSize == o.BidSize &&
+		t.Ask == o.Ask && t.AskSize == o.AskSize && t.Last == o.Last
+}
+
+func newTicker(market Market, ob *orderbook.Orderbook, now time.Time) Ticker {
+	t := Ticker{
+		Market: market,
+		Last:   ob.LastPrice(),
+		Seq:    ob.Sequence(),
+		Ts:     now.UnixNano(),
+	}
+	ob.WalkLimits(orderbook.SideBid, func(l orderbook.LimitView) bool {
+		t.Bid, t.BidSize = l.Price, l.TotalVolume
+		return false
+	})
+	ob.WalkLimits(orderbook.SideAsk, func(l orderbook.LimitView) bool {
+		t.Ask, t.AskSize = l.Price, l.TotalVolume
+		return false
+	})
+	return t
+}
+
+// tickerFeed conflates ticker updates for one market: changes arriving within
+// interval of each other are collapsed and subscribers get only the latest.
+type tickerFeed struct {
+	interval time.Duration
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	current Ticker
+	pending bool
+	subs    map[chan Ticker]struct{}
+}
+
+func newTickerFeed(interval time.Duration, c clock.Clock) *tickerFeed {
+	return &tickerFeed{
+		interval: interval,
+		clock:    c,
+		subs:     make(map[chan Ticker]struct{}),
+	}
+}
+
+// Publish records the market's latest ticker. Updates that don't change the
+// quote are dropped; the first change in a quiet period schedules a flush one
+// interval later, and anything published before it fires replaces what it
+// will send.
+func (f *tickerFeed) Publish(t Ticker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if t.sameQuote(f.current) {
+		return
+	}
+	f.current = t
+	if !f.pending {
+		f.pending = true
+		f.clock.AfterFunc(f.interval, f.flush)
+	}
+}
+
+func (f *tickerFeed) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pending = false
+	for sub := range f.subs {
+		// subscribers hold at most one message; a slow reader gets the
+		// newest state rather than a backlog of stale ones
+		select {
+		case <-sub:
+		default:
+		}
+		sub <- f.current
+	}
+}
+
+func (f *tickerFeed) Subscribe() chan Ticker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub := make(chan Ticker, 1)
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+func (f *tickerFeed) Unsubscribe(sub chan Ticker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.subs, sub)
+}
+
+// publishTicker pushes the market's current ticker to its feed after the
+// book has changed. The caller holds the book's lock.
+func (ex *Exchange) publishTicker(market Market) {
+	ex.tickers[market].Publish(newTicker(market, ex.orderbooks[market], ex.clock.Now()))
+}
+
+// Ticker returns market's current top of book and last trade price.
+func (ex *Exchange) Ticker(market Market) (Ticker, error) {
+	ob, err := ex.book(market)
+	if err != nil {
+		return Ticker{}, err
+	}
+
+	ob.RLock()
+	defer ob.RUnlock()
+
+	return newTicker(market, ob, ex.clock.Now()), nil
+}
+
+// Subscribe streams market's conflated ticker updates. The channel
+// holds at most one update, so a slow reader gets the newest state rather
+// than a backlog; unsubscribe stops the stream.
+func (ex *Exchange) Subscribe(market Market) (updates <-chan Ticker, unsubscribe func(), err error) {
+	feed, ok := ex.tickers[market]
+	if !ok {
+		return nil, nil, ErrMarketNotFound
+	}
+	sub := feed.Subscribe()
+	return sub, func() { feed.Unsubscribe(sub) }, nil
+}
@@ -0,0 +1,136 @@
+package exchange
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+var (
+	// ErrInvalidTransfer is returned by Transfer for a request missing its
+	// reference or moving funds from a user to themselves.
+	ErrInvalidTransfer = errors.New("invalid transfer")
+	// ErrTransferReference is returned by Transfer for a reference the
+	// sender has used for a different transfer.
+	ErrTransferReference = errors.New("reference already used for another transfer")
+)
+
+// TransferRequest asks to move Amount of Asset from From's free balance to
+// To's. Reference is the sender's name for the transfer: a request
+// repeating one From has used is the same transfer, made only once.
+type TransferRequest struct {
+	From      uint64       `json:"from"`
+	To        uint64       `json:"to"`
+	Asset     ledger.Asset `json:"asset"`
+	Amount    float64      `json:"amount"`
+	Reference string       `json:"reference"`
+}
+
+// Transfer is a transfer made. ID is that of the ledger entry debiting From
+// and crediting To, and FromBalance and ToBalance what each had free in
+// Asset right after it. Timestamp is in unix nanoseconds. Repeated is set
+// when it is returned again for a request repeating its reference.
+type Transfer struct {
+	ID          uint64       `json:"id"`
+	From        uint64       `json:"from"`
+	To          uint64       `json:"to"`
+	Asset       ledger.Asset `json:"asset"`
+	Amount      float64      `json:"amount"`
+	Reference   string       `json:"reference"`
+	FromBalance float64      `json:"fromBalance"`
+	ToBalance   float64      `json:"toBalance"`
+	Timestamp   int64        `json:"timestamp"`
+	Repeated    bool         `json:"repeated,omitempty"`
+}
+
+// transferKey is a transfer's sender and reference, which name it.
+type transferKey struct {
+	from      uint64
+	reference string
+}
+
+// transferBook keeps every transfer made, by sender and reference.
+type transferBook struct {
+	mu    sync.Mutex
+	byKey map[transferKey]Transfer
+}
+
+func newTransferBook() transferBook {
+	return transferBook{byKey: make(map[transferKey]Transfer)}
+}
+
+// Transfer moves funds between two users, as req asks, in one ledger
+// entry. It returns ledger.ErrInsufficientFunds if the sender doesn't have
+// the amount free: what their orders and withdrawals hold is never touched.
+// A request repeating a reference its sender has used returns the transfer
+// made for it, without moving anything again, or ErrTransferReference if it
+// asks for a different one.
+func (ex *Exchange) Transfer(req TransferRequest) (Transfer, error) {
+	if req.Reference == "" {
+		return Transfer{}, fmt.Errorf("%w: reference is required", ErrInvalidTransfer)
+	}
+	if req.From == req.To {
+		return Transfer{}, fmt.Errorf("%w: sender and receiver are the same user", ErrInvalidTransfer)
+	}
+	defer ex.begin()()
+
+	t := &ex.transfers
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := transferKey{from: req.From, reference: req.Reference}
+	if made, ok := t.byKey[key]; ok {
+		if made.To != req.To || made.Asset != req.Asset || made.Amount != req.Amount {
+			return Transfer{}, fmt.Errorf("%w: %s", ErrTransferReference, req.Reference)
+		}
+		made.Repeated = true
+		return made, nil
+	}
+	if rejection := ex.record(Command{Type: CommandTransfer, Transfer: &req}); rejection != nil {
+		return Transfer{}, rejection
+	}
+	entry, err := ex.ledger.Transfer(req.From, req.To, req.Asset, req.Amount, req.Reference)
+	if err != nil {
+		return Transfer{}, err
+	}
+	made := Transfer{
+		ID:          entry.ID,
+		From:        req.From,
+		To:          req.To,
+		Asset:       req.Asset,
+		Amount:      req.Amount,
+		Reference:   req.Reference,
+		FromBalance: ex.ledger.Balance(ledger.UserAccount(req.From), req.Asset),
+		ToBalance:   ex.ledger.Balance(ledger.UserAccount(req.To), req.Asset),
+		Timestamp:   entry.Timestamp,
+	}
+	t.byKey[key] = made
+	return made, nil
+}
+
+// checkpoint returns every transfer, oldest first.
+func (t *transferBook) checkpoint() []Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]Transfer, 0, len(t.byKey))
+	for _, made := range t.byKey {
+		list = append(list, made)
+	}
+	slices.SortFunc(list, func(a, b Transfer) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// restore loads the transfers a checkpoint kept.
+func (t *transferBook) restore(list []Transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, made := range list {
+		t.byKey[transferKey{from: made.From, reference: made.Reference}] = made
+	}
+}
@@ -0,0 +1,189 @@
+package exchange
+
+import (
+	"sync"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// OrderUpdateType is what an operation did to a user's order.
+type OrderUpdateType string
+
+const (
+	// OrderUpdateAccepted: the order was placed, or amended in a way that
+	// placed it again, with Remaining of it to fill before any of it traded.
+	OrderUpdateAccepted OrderUpdateType = "ACCEPTED"
+	// OrderUpdateAmended: a resting order now rests at Price with Remaining
+	// left, keeping its priority.
+	OrderUpdateAmended OrderUpdateType = "AMENDED"
+	// OrderUpdatePartialFill: the order traded FillSize at FillPrice and has
+	// Remaining left.
+	OrderUpdatePartialFill OrderUpdateType = "PARTIAL_FILL"
+	// OrderUpdateFill: the order traded FillSize at FillPrice, the last of
+	// it.
+	OrderUpdateFill OrderUpdateType = "FILL"
+	// OrderUpdateCancelled: the order left the book with Remaining unfilled,
+	// cancelled, expired or, for one that couldn't rest, what the book
+	// couldn't match.
+	OrderUpdateCancelled OrderUpdateType = "CANCELLED"
+)
+
+// OrderUpdate is an operation's news of one of a user's orders. Seq is the
+// book's sequence number after the operation and Timestamp, in unix
+// nanoseconds, when it happened; fills carry the trade's ID and time.
+type OrderUpdate struct {
+	Type          OrderUpdateType `json:"type"`
+	Market        Market          `json:"market"`
+	Seq           uint64          `json:"seq"`
+	OrderID       uint64          `json:"orderId"`
+	ClientOrderID string          `json:"clientOrderId,omitempty"`
+	Owner         uint64          `json:"owner"`
+	Bid           bool            `json:"bid"`
+	Price         orderbook.Price `json:"price"`
+	Remaining     orderbook.Size  `json:"remaining"`
+	TradeID       uint64          `json:"tradeId,omitempty"`
+	FillPrice     orderbook.Price `json:"fillPrice,omitempty"`
+	FillSize      orderbook.Size  `json:"fillSize,omitempty"`
+	Maker         bool            `json:"maker,omitempty"`
+	// PositionDelta is what a fill changed the owner's position in the
+	// market by: see Position.
+	PositionDelta orderbook.Size `json:"positionDelta,omitempty"`
+	// Reason says why the exchange cancelled the order, when it wasn't the
+	// owner's doing or the order's own terms.
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// updateBuffer is how many operations a user's order update subscriber may
+// fall behind before it is cut off.
+const updateBuffer = 256
+
+// updateFeed fans order updates out to their owners' subscribers. Like
+// marketFeed it never waits: a subscriber that has fallen behind has its
+// channel closed.
+type updateFeed struct {
+	mu   sync.Mutex
+	subs map[uint64]map[chan []OrderUpdate]struct{}
+	// handlers see every operation's updates, whoever they are for
+	handlers []func([]OrderUpdate)
+}
+
+func newUpdateFeed() *updateFeed {
+	return &updateFeed{subs: make(map[uint64]map[chan []OrderUpdate]struct{})}
+}
+
+// Publish sends one operation's updates, each subscriber getting its user's
+// in one batch.
+func (f *updateFeed) Publish(updates []OrderUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, handle := range f.handlers {
+		handle(updates)
+	}
+	byOwner := make(map[uint64][]OrderUpdate)
+	for _, u := range updates {
+		if len(f.subs[u.Owner]) > 0 {
+			byOwner[u.Owner] = append(byOwner[u.Owner], u)
+		}
+	}
+	for owner, batch := range byOwner {
+		for sub := range f.subs[owner] {
+			select {
+			case sub <- batch:
+			default:
+				f.unsubscribe(owner, sub)
+			}
+		}
+	}
+}
+
+func (f *updateFeed) Subscribe(owner uint64) chan []OrderUpdate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub := make(chan []OrderUpdate, updateBuffer)
+	if f.subs[owner] == nil {
+		f.subs[owner] = make(map[chan []OrderUpdate]struct{})
+	}
+	f.subs[owner][sub] = struct{}{}
+	return sub
+}
+
+func (f *updateFeed) Unsubscribe(owner uint64, sub chan []OrderUpdate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unsubscribe(owner, sub)
+}
+
+// unsubscribe closes sub if it is still open. The caller holds f.mu.
+func (f *updateFeed) unsubscribe(owner uint64, sub chan []OrderUpdate) {
+	if _, ok := f.subs[owner][sub]; !ok {
+		return
+	}
+	delete(f.subs[owner], sub)
+	if len(f.subs[owner]) == 0 {
+		delete(f.subs, owner)
+	}
+	close(sub)
+}
+
+// SubscribeOrderUpdates streams what happens to owner's orders on every
+// market, one batch per operation. A subscriber that falls more than a few
+// hundred operations behind has its channel closed; unsubscribe stops the
+// stream.
+func (ex *Exchange) SubscribeOrderUpdates(owner uint64) (updates <-chan []OrderUpdate, unsubscribe func()) {
+	sub := ex.updates.Subscribe(owner)
+	return sub, func() { ex.updates.Unsubscribe(owner, sub) }
+}
+
+// HandleOrderUpdates registers fn to see the updates of every user's orders,
+// one call per operation, as SubscribeOrderUpdates would hand them to their
+// owners. Like a handler registered by HandleEvents, it runs with the book's
+// lock held, so it must be quick and must not keep the slice.
+func (ex *Exchange) HandleOrderUpdates(fn func(updates []OrderUpdate)) {
+	ex.updates.mu.Lock()
+	defer ex.updates.mu.Unlock()
+
+	ex.updates.handlers = append(ex.updates.handlers, fn)
+}
+
+// fillUpdate records o, the maker if so, trading in fill, which changed its
+// owner's position by delta, and having remaining left.
+func (l *eventLog) fillUpdate(o *orderbook.Order, maker bool, remaining orderbook.Size, fill *Event, delta orderbook.Size) {
+	typ := OrderUpdatePartialFill
+	if remaining == 0 {
+		typ = OrderUpdateFill
+	}
+	l.update(typ, o, remaining)
+	if o.Owner == 0 {
+		return
+	}
+	u := &l.updates[len(l.updates)-1]
+	u.TradeID, u.FillPrice, u.FillSize, u.Maker, u.Timestamp = fill.TradeID, fill.Price, fill.Size, maker, fill.Timestamp
+	u.PositionDelta = delta
+}
+
+// update records an update of o for its owner, if it has one.
+func (l *eventLog) update(typ OrderUpdateType, o *orderbook.Order, remaining orderbook.Size) {
+	if o.Owner == 0 {
+		return
+	}
+	l.updates = append(l.updates, OrderUpdate{
+		Type:          typ,
+		Market:        l.market,
+		OrderID:       o.ID,
+		ClientOrderID: o.ClientOrderID,
+		Owner:         o.Owner,
+		Bid:           o.Bid,
+		Price:         o.Price,
+		Remaining:     remaining,
+		Reason:        l.reason,
+		Timestamp:     l.history.clock.Now().UnixNano(),
+	})
+}
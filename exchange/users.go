@@ -0,0 +1,62 @@
+package exchange
+
+import (
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// Users is the exchange's user registry: a user.Registry whose changes are
+// journaled, checkpointed and followed with the rest of the exchange's
+// state, so users and their IDs outlive a restart.
+type Users struct {
+	*user.Registry
+	ex *Exchange
+}
+
+// Users returns the exchange's user registry.
+func (ex *Exchange) Users() *Users {
+	return &Users{Registry: ex.users, ex: ex}
+}
+
+// Register adds a user called name, as user.Registry's Register does.
+func (u *Users) Register(name, pass string) (user.User, string, error) {
+	// the password is stretched before the command begins, so the
+	// commands after it don't wait on it
+	reg, key, err := user.NewRegistration(name, pass)
+	if err != nil {
+		return user.User{}, "", err
+	}
+	usr, err := u.ex.register(reg)
+	if err != nil {
+		return user.User{}, "", err
+	}
+	return usr, key, nil
+}
+
+// SetKeySettings replaces the settings of key.
+func (u *Users) SetKeySettings(key string, settings user.KeySettings) error {
+	return u.ex.setKeySettings(user.HashKey(key), settings)
+}
+
+func (ex *Exchange) register(reg user.Registration) (user.User, error) {
+	defer ex.begin()()
+
+	if ex.users.Registered(reg.User.Name) {
+		return user.User{}, user.ErrNameTaken
+	}
+	if rejection := ex.record(Command{Type: CommandRegisterUser, Registration: &reg}); rejection != nil {
+		return user.User{}, rejection
+	}
+	return ex.users.Add(reg)
+}
+
+func (ex *Exchange) setKeySettings(hash string, settings user.KeySettings) error {
+	defer ex.begin()()
+
+	if _, err := ex.users.HashedKeySettings(hash); err != nil {
+		return err
+	}
+	if rejection := ex.record(Command{Type: CommandKeySettings, KeyHash: hash, KeySettings: &settings}); rejection != nil {
+		return rejection
+	}
+	return ex.users.SetHashedKeySettings(hash, settings)
+}
@@ -0,0 +1,218 @@
+package exchange
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// WithdrawalStatus is where a withdrawal is on its way out.
+type WithdrawalStatus string
+
+const (
+	// WithdrawalPending: queued, its amount held, waiting to be signed and
+	// broadcast.
+	WithdrawalPending WithdrawalStatus = "PENDING"
+	// WithdrawalBroadcast: sent to the network, waiting to be mined and
+	// confirmed.
+	WithdrawalBroadcast WithdrawalStatus = "BROADCAST"
+	// WithdrawalConfirmed: mined with enough confirmations; the amount has
+	// left the user's balance.
+	WithdrawalConfirmed WithdrawalStatus = "CONFIRMED"
+	// WithdrawalFailed: refused or reverted; the amount was released back
+	// to the user.
+	WithdrawalFailed WithdrawalStatus = "FAILED"
+)
+
+var (
+	// ErrWithdrawalNotFound is returned for an ID with no withdrawal of the
+	// user's.
+	ErrWithdrawalNotFound = errors.New("withdrawal not found")
+	// ErrWithdrawalStatus is returned by UpdateWithdrawal for a move the
+	// withdrawal can't make from where it is.
+	ErrWithdrawalStatus = errors.New("withdrawal can't move to that status")
+)
+
+// Withdrawal is a user's request to send Amount of Asset to To, off the
+// exchange. TxHash is set once it is broadcast and Error once it failed.
+// CreatedAt and UpdatedAt are in unix nanoseconds.
+type Withdrawal struct {
+	ID        uint64           `json:"id"`
+	User      uint64           `json:"user"`
+	Asset     ledger.Asset     `json:"asset"`
+	Amount    float64          `json:"amount"`
+	To        string           `json:"to"`
+	Status    WithdrawalStatus `json:"status"`
+	TxHash    string           `json:"txHash,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	CreatedAt int64            `json:"createdAt"`
+	UpdatedAt int64            `json:"updatedAt"`
+}
+
+// WithdrawalUpdate moves the withdrawal with ID to Status: BROADCAST with
+// the TxHash it went out as, CONFIRMED, or FAILED with the Error it failed
+// with.
+type WithdrawalUpdate struct {
+	ID     uint64           `json:"id"`
+	Status WithdrawalStatus `json:"status"`
+	TxHash string           `json:"txHash,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// withdrawalBook keeps every withdrawal requested, by ID. The pending ones
+// are the queue waiting to go out, in ID order, and the broadcast ones those
+// in flight.
+type withdrawalBook struct {
+	mu   sync.Mutex
+	last uint64
+	byID map[uint64]*Withdrawal
+}
+
+// RequestWithdrawal queues a withdrawal of amount of user's asset to to,
+// holding the amount until it goes out or fails. It returns
+// ledger.ErrInsufficientFunds if user doesn't have that much free. Checking
+// that the asset can be sent to to is left to the caller.
+func (ex *Exchange) RequestWithdrawal(user uint64, asset ledger.Asset, to string, amount float64) (Withdrawal, error) {
+	defer ex.begin()()
+	if rejection := ex.record(Command{Type: CommandRequestWithdrawal, User: user, Asset: asset, Amount: amount, Destination: to}); rejection != nil {
+		return Withdrawal{}, rejection
+	}
+
+	w := &ex.withdrawals
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := ex.ledger.Hold(user, asset, amount); err != nil {
+		return Withdrawal{}, err
+	}
+	w.last++
+	now := ex.clock.Now().UnixNano()
+	wd := &Withdrawal{
+		ID:        w.last,
+		User:      user,
+		Asset:     asset,
+		Amount:    amount,
+		To:        to,
+		Status:    WithdrawalPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	w.byID[wd.ID] = wd
+	return *wd, nil
+}
+
+// UpdateWithdrawal moves a withdrawal on: a pending one may be broadcast or
+// fail, and a broadcast one be confirmed, when its amount leaves the ledger,
+// or fail, when it is released back to its user. Any other move is
+// ErrWithdrawalStatus.
+func (ex *Exchange) UpdateWithdrawal(update WithdrawalUpdate) (Withdrawal, error) {
+	defer ex.begin()()
+
+	w := &ex.withdrawals
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, ok := w.byID[update.ID]
+	if !ok {
+		return Withdrawal{}, ErrWithdrawalNotFound
+	}
+	switch {
+	case update.Status == WithdrawalBroadcast && wd.Status == WithdrawalPending && update.TxHash != "":
+	case update.Status == WithdrawalConfirmed && wd.Status == WithdrawalBroadcast:
+	case update.Status == WithdrawalFailed && (wd.Status == WithdrawalPending || wd.Status == WithdrawalBroadcast):
+	default:
+		return Withdrawal{}, fmt.Errorf("%w: %s to %s", ErrWithdrawalStatus, wd.Status, update.Status)
+	}
+	if rejection := ex.record(Command{Type: CommandUpdateWithdrawal, Withdrawal: &update}); rejection != nil {
+		return Withdrawal{}, rejection
+	}
+
+	switch update.Status {
+	case WithdrawalBroadcast:
+		wd.TxHash = update.TxHash
+	case WithdrawalConfirmed:
+		if _, err := ex.ledger.WithdrawHeld(wd.User, wd.Asset, wd.Amount); err != nil {
+			// the funds have gone, so this is a bug; the withdrawal still
+			// stands
+			slog.Error("confirmed withdrawal not taken from the ledger", "id", wd.ID, "error", err)
+		}
+	case WithdrawalFailed:
+		if _, err := ex.ledger.Release(wd.User, wd.Asset, wd.Amount); err != nil {
+			slog.Error("failed withdrawal not released", "id", wd.ID, "error", err)
+		}
+		wd.Error = update.Error
+	}
+	wd.Status = update.Status
+	wd.UpdatedAt = ex.clock.Now().UnixNano()
+	return *wd, nil
+}
+
+// Withdrawal returns user's withdrawal with id.
+func (ex *Exchange) Withdrawal(user, id uint64) (Withdrawal, error) {
+	w := &ex.withdrawals
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, ok := w.byID[id]
+	if !ok || wd.User != user {
+		return Withdrawal{}, ErrWithdrawalNotFound
+	}
+	return *wd, nil
+}
+
+// UserWithdrawals returns user's withdrawals, oldest first.
+func (ex *Exchange) UserWithdrawals(user uint64) []Withdrawal {
+	return ex.listWithdrawals(func(wd *Withdrawal) bool { return wd.User == user })
+}
+
+// OutstandingWithdrawals returns the withdrawals still on their way out,
+// pending or broadcast, oldest first.
+func (ex *Exchange) OutstandingWithdrawals() []Withdrawal {
+	return ex.listWithdrawals(func(wd *Withdrawal) bool {
+		return wd.Status == WithdrawalPending || wd.Status == WithdrawalBroadcast
+	})
+}
+
+func (ex *Exchange) listWithdrawals(keep func(*Withdrawal) bool) []Withdrawal {
+	w := &ex.withdrawals
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	list := []Withdrawal{}
+	for _, wd := range w.byID {
+		if keep(wd) {
+			list = append(list, *wd)
+		}
+	}
+	slices.SortFunc(list, func(a, b Withdrawal) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// checkpoint returns every withdrawal, oldest first.
+func (w *withdrawalBook) checkpoint() []Withdrawal {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	list := make([]Withdrawal, 0, len(w.byID))
+	for _, id := range slices.Sorted(maps.Keys(w.byID)) {
+		list = append(list, *w.byID[id])
+	}
+	return list
+}
+
+// restore loads the withdrawals a checkpoint kept.
+func (w *withdrawalBook) restore(list []Withdrawal) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, wd := range list {
+		w.byID[wd.ID] = &wd
+		w.last = max(w.last, wd.ID)
+	}
+}
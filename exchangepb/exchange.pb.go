@@ -0,0 +1,1600 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v31.1.0
+// source: exchange.proto
+
+package exchangepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type OrderType int32
+
+const (
+	OrderType_ORDER_TYPE_UNSPECIFIED OrderType = 0
+	OrderType_ORDER_TYPE_LIMIT       OrderType = 1
+	OrderType_ORDER_TYPE_MARKET      OrderType = 2
+	OrderType_ORDER_TYPE_STOP_MARKET OrderType = 3
+)
+
+// Enum value maps for OrderType.
+var (
+	OrderType_name = map[int32]string{
+		0: "ORDER_TYPE_UNSPECIFIED",
+		1: "ORDER_TYPE_LIMIT",
+		2: "ORDER_TYPE_MARKET",
+		3: "ORDER_TYPE_STOP_MARKET",
+	}
+	OrderType_value = map[string]int32{
+		"ORDER_TYPE_UNSPECIFIED": 0,
+		"ORDER_TYPE_LIMIT":       1,
+		"ORDER_TYPE_MARKET":      2,
+		"ORDER_TYPE_STOP_MARKET": 3,
+	}
+)
+
+func (x OrderType) Enum() *OrderType {
+	p := new(OrderType)
+	*p = x
+	return p
+}
+
+func (x OrderType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (OrderType) Descriptor() protoreflect.EnumDescriptor {
+	return file_exchange_proto_enumTypes[0].Descriptor()
+}
+
+func (OrderType) Type() protoreflect.EnumType {
+	return &file_exchange_proto_enumTypes[0]
+}
+
+func (x OrderType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use OrderType.Descriptor instead.
+func (OrderType) EnumDescriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{0}
+}
+
+// TimeInForce only applies to limit orders; unspecified is good till
+// cancelled.
+type TimeInForce int32
+
+const (
+	TimeInForce_TIME_IN_FORCE_UNSPECIFIED TimeInForce = 0
+	TimeInForce_TIME_IN_FORCE_GTC         TimeInForce = 1
+	TimeInForce_TIME_IN_FORCE_IOC         TimeInForce = 2
+	TimeInForce_TIME_IN_FORCE_FOK         TimeInForce = 3
+	TimeInForce_TIME_IN_FORCE_GTD         TimeInForce = 4
+)
+
+// Enum value maps for TimeInForce.
+var (
+	TimeInForce_name = map[int32]string{
+		0: "TIME_IN_FORCE_UNSPECIFIED",
+		1: "TIME_IN_FORCE_GTC",
+		2: "TIME_IN_FORCE_IOC",
+		3: "TIME_IN_FORCE_FOK",
+		4: "TIME_IN_FORCE_GTD",
+	}
+	TimeInForce_value = map[string]int32{
+		"TIME_IN_FORCE_UNSPECIFIED": 0,
+		"TIME_IN_FORCE_GTC":         1,
+		"TIME_IN_FORCE_IOC":         2,
+		"TIME_IN_FORCE_FOK":         3,
+		"TIME_IN_FORCE_GTD":         4,
+	}
+)
+
+func (x TimeInForce) Enum() *TimeInForce {
+	p := new(TimeInForce)
+	*p = x
+	return p
+}
+
+func (x TimeInForce) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TimeInForce) Descriptor() protoreflect.EnumDescriptor {
+	return file_exchange_proto_enumTypes[1].Descriptor()
+}
+
+func (TimeInForce) Type() protoreflect.EnumType {
+	return &file_exchange_proto_enumTypes[1]
+}
+
+func (x TimeInForce) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TimeInForce.Descriptor instead.
+func (TimeInForce) EnumDescriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{1}
+}
+
+// PlaceOrderRequest is POST /order's body; see there for which fields
+// apply to which orders.
+type PlaceOrderRequest struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Market      string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	Type        OrderType              `protobuf:"varint,2,opt,name=type,proto3,enum=exchange.v1.OrderType" json:"type,omitempty"`
+	Bid         bool                   `protobuf:"varint,3,opt,name=bid,proto3" json:"bid,omitempty"`
+	Size        float64                `protobuf:"fixed64,4,opt,name=size,proto3" json:"size,omitempty"`
+	Price       float64                `protobuf:"fixed64,5,opt,name=price,proto3" json:"price,omitempty"`
+	TimeInForce TimeInForce            `protobuf:"varint,6,opt,name=time_in_force,json=timeInForce,proto3,enum=exchange.v1.TimeInForce" json:"time_in_force,omitempty"`
+	// expires_at is when a GTD order expires, in unix nanoseconds.
+	ExpiresAt      int64             `protobuf:"varint,7,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	DisplaySize    float64           `protobuf:"fixed64,8,opt,name=display_size,json=displaySize,proto3" json:"display_size,omitempty"`
+	StopPrice      float64           `protobuf:"fixed64,9,opt,name=stop_price,json=stopPrice,proto3" json:"stop_price,omitempty"`
+	ClientOrderId  string            `protobuf:"bytes,10,opt,name=client_order_id,json=clientOrderId,proto3" json:"client_order_id,omitempty"`
+	Notional       float64           `protobuf:"fixed64,11,opt,name=notional,proto3" json:"notional,omitempty"`
+	WorstPrice     float64           `protobuf:"fixed64,12,opt,name=worst_price,json=worstPrice,proto3" json:"worst_price,omitempty"`
+	MaxSlippageBps float64           `protobuf:"fixed64,13,opt,name=max_slippage_bps,json=maxSlippageBps,proto3" json:"max_slippage_bps,omitempty"`
+	Metadata       map[string]string `protobuf:"bytes,14,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *PlaceOrderRequest) Reset() {
+	*x = PlaceOrderRequest{}
+	mi := &file_exchange_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PlaceOrderRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PlaceOrderRequest) ProtoMessage() {}
+
+func (x *PlaceOrderRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PlaceOrderRequest.ProtoReflect.Descriptor instead.
+func (*PlaceOrderRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PlaceOrderRequest) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *PlaceOrderRequest) GetType() OrderType {
+	if x != nil {
+		return x.Type
+	}
+	return OrderType_ORDER_TYPE_UNSPECIFIED
+}
+
+func (x *PlaceOrderRequest) GetBid() bool {
+	if x != nil {
+		return x.Bid
+	}
+	return false
+}
+
+func (x *PlaceOrderRequest) GetSize() float64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetTimeInForce() TimeInForce {
+	if x != nil {
+		return x.TimeInForce
+	}
+	return TimeInForce_TIME_IN_FORCE_UNSPECIFIED
+}
+
+func (x *PlaceOrderRequest) GetExpiresAt() int64 {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetDisplaySize() float64 {
+	if x != nil {
+		return x.DisplaySize
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetStopPrice() float64 {
+	if x != nil {
+		return x.StopPrice
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetClientOrderId() string {
+	if x != nil {
+		return x.ClientOrderId
+	}
+	return ""
+}
+
+func (x *PlaceOrderRequest) GetNotional() float64 {
+	if x != nil {
+		return x.Notional
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetWorstPrice() float64 {
+	if x != nil {
+		return x.WorstPrice
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetMaxSlippageBps() float64 {
+	if x != nil {
+		return x.MaxSlippageBps
+	}
+	return 0
+}
+
+func (x *PlaceOrderRequest) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+// Trade is one fill of the order against a resting one.
+type Trade struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Price           float64                `protobuf:"fixed64,1,opt,name=price,proto3" json:"price,omitempty"`
+	Size            float64                `protobuf:"fixed64,2,opt,name=size,proto3" json:"size,omitempty"`
+	CounterpartyId  uint64                 `protobuf:"varint,3,opt,name=counterparty_id,json=counterpartyId,proto3" json:"counterparty_id,omitempty"`
+	CounterpartyBid bool                   `protobuf:"varint,4,opt,name=counterparty_bid,json=counterpartyBid,proto3" json:"counterparty_bid,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Trade) Reset() {
+	*x = Trade{}
+	mi := &file_exchange_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Trade) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Trade) ProtoMessage() {}
+
+func (x *Trade) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Trade.ProtoReflect.Descriptor instead.
+func (*Trade) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Trade) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *Trade) GetSize() float64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Trade) GetCounterpartyId() uint64 {
+	if x != nil {
+		return x.CounterpartyId
+	}
+	return 0
+}
+
+func (x *Trade) GetCounterpartyBid() bool {
+	if x != nil {
+		return x.CounterpartyBid
+	}
+	return false
+}
+
+// ExecutionReport is the outcome of an accepted order. The execution fields
+// are only set when it matched.
+type ExecutionReport struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	OrderId          uint64                 `protobuf:"varint,1,opt,name=order_id,json=orderId,proto3" json:"order_id,omitempty"`
+	Market           string                 `protobuf:"bytes,2,opt,name=market,proto3" json:"market,omitempty"`
+	OriginalSize     float64                `protobuf:"fixed64,3,opt,name=original_size,json=originalSize,proto3" json:"original_size,omitempty"`
+	Remaining        float64                `protobuf:"fixed64,4,opt,name=remaining,proto3" json:"remaining,omitempty"`
+	FilledSize       float64                `protobuf:"fixed64,5,opt,name=filled_size,json=filledSize,proto3" json:"filled_size,omitempty"`
+	Rested           bool                   `protobuf:"varint,6,opt,name=rested,proto3" json:"rested,omitempty"`
+	AvgPrice         float64                `protobuf:"fixed64,7,opt,name=avg_price,json=avgPrice,proto3" json:"avg_price,omitempty"`
+	WorstPrice       float64                `protobuf:"fixed64,8,opt,name=worst_price,json=worstPrice,proto3" json:"worst_price,omitempty"`
+	LevelsTouched    int32                  `protobuf:"varint,9,opt,name=levels_touched,json=levelsTouched,proto3" json:"levels_touched,omitempty"`
+	Trades           []*Trade               `protobuf:"bytes,10,rep,name=trades,proto3" json:"trades,omitempty"`
+	LimitPrice       float64                `protobuf:"fixed64,11,opt,name=limit_price,json=limitPrice,proto3" json:"limit_price,omitempty"`
+	PriceImprovement *float64               `protobuf:"fixed64,12,opt,name=price_improvement,json=priceImprovement,proto3,oneof" json:"price_improvement,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *ExecutionReport) Reset() {
+	*x = ExecutionReport{}
+	mi := &file_exchange_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExecutionReport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExecutionReport) ProtoMessage() {}
+
+func (x *ExecutionReport) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExecutionReport.ProtoReflect.Descriptor instead.
+func (*ExecutionReport) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ExecutionReport) GetOrderId() uint64 {
+	if x != nil {
+		return x.OrderId
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *ExecutionReport) GetOriginalSize() float64 {
+	if x != nil {
+		return x.OriginalSize
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetRemaining() float64 {
+	if x != nil {
+		return x.Remaining
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetFilledSize() float64 {
+	if x != nil {
+		return x.FilledSize
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetRested() bool {
+	if x != nil {
+		return x.Rested
+	}
+	return false
+}
+
+func (x *ExecutionReport) GetAvgPrice() float64 {
+	if x != nil {
+		return x.AvgPrice
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetWorstPrice() float64 {
+	if x != nil {
+		return x.WorstPrice
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetLevelsTouched() int32 {
+	if x != nil {
+		return x.LevelsTouched
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetTrades() []*Trade {
+	if x != nil {
+		return x.Trades
+	}
+	return nil
+}
+
+func (x *ExecutionReport) GetLimitPrice() float64 {
+	if x != nil {
+		return x.LimitPrice
+	}
+	return 0
+}
+
+func (x *ExecutionReport) GetPriceImprovement() float64 {
+	if x != nil && x.PriceImprovement != nil {
+		return *x.PriceImprovement
+	}
+	return 0
+}
+
+type CancelOrderRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Order:
+	//
+	//	*CancelOrderRequest_OrderId
+	//	*CancelOrderRequest_ClientOrderId
+	Order         isCancelOrderRequest_Order `protobuf_oneof:"order"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CancelOrderRequest) Reset() {
+	*x = CancelOrderRequest{}
+	mi := &file_exchange_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CancelOrderRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelOrderRequest) ProtoMessage() {}
+
+func (x *CancelOrderRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelOrderRequest.ProtoReflect.Descriptor instead.
+func (*CancelOrderRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CancelOrderRequest) GetOrder() isCancelOrderRequest_Order {
+	if x != nil {
+		return x.Order
+	}
+	return nil
+}
+
+func (x *CancelOrderRequest) GetOrderId() uint64 {
+	if x != nil {
+		if x, ok := x.Order.(*CancelOrderRequest_OrderId); ok {
+			return x.OrderId
+		}
+	}
+	return 0
+}
+
+func (x *CancelOrderRequest) GetClientOrderId() string {
+	if x != nil {
+		if x, ok := x.Order.(*CancelOrderRequest_ClientOrderId); ok {
+			return x.ClientOrderId
+		}
+	}
+	return ""
+}
+
+type isCancelOrderRequest_Order interface {
+	isCancelOrderRequest_Order()
+}
+
+type CancelOrderRequest_OrderId struct {
+	OrderId uint64 `protobuf:"varint,1,opt,name=order_id,json=orderId,proto3,oneof"`
+}
+
+type CancelOrderRequest_ClientOrderId struct {
+	ClientOrderId string `protobuf:"bytes,2,opt,name=client_order_id,json=clientOrderId,proto3,oneof"`
+}
+
+func (*CancelOrderRequest_OrderId) isCancelOrderRequest_Order() {}
+
+func (*CancelOrderRequest_ClientOrderId) isCancelOrderRequest_Order() {}
+
+type CancelledOrder struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	OrderId       uint64                 `protobuf:"varint,1,opt,name=order_id,json=orderId,proto3" json:"order_id,omitempty"`
+	Market        string                 `protobuf:"bytes,2,opt,name=market,proto3" json:"market,omitempty"`
+	Bid           bool                   `protobuf:"varint,3,opt,name=bid,proto3" json:"bid,omitempty"`
+	Price         float64                `protobuf:"fixed64,4,opt,name=price,proto3" json:"price,omitempty"`
+	Remaining     float64                `protobuf:"fixed64,5,opt,name=remaining,proto3" json:"remaining,omitempty"`
+	FilledSize    float64                `protobuf:"fixed64,6,opt,name=filled_size,json=filledSize,proto3" json:"filled_size,omitempty"`
+	Status        string                 `protobuf:"bytes,7,opt,name=status,proto3" json:"status,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,8,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CancelledOrder) Reset() {
+	*x = CancelledOrder{}
+	mi := &file_exchange_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CancelledOrder) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelledOrder) ProtoMessage() {}
+
+func (x *CancelledOrder) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelledOrder.ProtoReflect.Descriptor instead.
+func (*CancelledOrder) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *CancelledOrder) GetOrderId() uint64 {
+	if x != nil {
+		return x.OrderId
+	}
+	return 0
+}
+
+func (x *CancelledOrder) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *CancelledOrder) GetBid() bool {
+	if x != nil {
+		return x.Bid
+	}
+	return false
+}
+
+func (x *CancelledOrder) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *CancelledOrder) GetRemaining() float64 {
+	if x != nil {
+		return x.Remaining
+	}
+	return 0
+}
+
+func (x *CancelledOrder) GetFilledSize() float64 {
+	if x != nil {
+		return x.FilledSize
+	}
+	return 0
+}
+
+func (x *CancelledOrder) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *CancelledOrder) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+type GetOrderRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Order:
+	//
+	//	*GetOrderRequest_OrderId
+	//	*GetOrderRequest_ClientOrderId
+	Order         isGetOrderRequest_Order `protobuf_oneof:"order"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetOrderRequest) Reset() {
+	*x = GetOrderRequest{}
+	mi := &file_exchange_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetOrderRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetOrderRequest) ProtoMessage() {}
+
+func (x *GetOrderRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetOrderRequest.ProtoReflect.Descriptor instead.
+func (*GetOrderRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GetOrderRequest) GetOrder() isGetOrderRequest_Order {
+	if x != nil {
+		return x.Order
+	}
+	return nil
+}
+
+func (x *GetOrderRequest) GetOrderId() uint64 {
+	if x != nil {
+		if x, ok := x.Order.(*GetOrderRequest_OrderId); ok {
+			return x.OrderId
+		}
+	}
+	return 0
+}
+
+func (x *GetOrderRequest) GetClientOrderId() string {
+	if x != nil {
+		if x, ok := x.Order.(*GetOrderRequest_ClientOrderId); ok {
+			return x.ClientOrderId
+		}
+	}
+	return ""
+}
+
+type isGetOrderRequest_Order interface {
+	isGetOrderRequest_Order()
+}
+
+type GetOrderRequest_OrderId struct {
+	OrderId uint64 `protobuf:"varint,1,opt,name=order_id,json=orderId,proto3,oneof"`
+}
+
+type GetOrderRequest_ClientOrderId struct {
+	ClientOrderId string `protobuf:"bytes,2,opt,name=client_order_id,json=clientOrderId,proto3,oneof"`
+}
+
+func (*GetOrderRequest_OrderId) isGetOrderRequest_Order() {}
+
+func (*GetOrderRequest_ClientOrderId) isGetOrderRequest_Order() {}
+
+// Order is an order's state; times are in unix nanoseconds.
+type Order struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	OrderId       uint64                 `protobuf:"varint,1,opt,name=order_id,json=orderId,proto3" json:"order_id,omitempty"`
+	ClientOrderId string                 `protobuf:"bytes,2,opt,name=client_order_id,json=clientOrderId,proto3" json:"client_order_id,omitempty"`
+	Market        string                 `protobuf:"bytes,3,opt,name=market,proto3" json:"market,omitempty"`
+	Bid           bool                   `protobuf:"varint,4,opt,name=bid,proto3" json:"bid,omitempty"`
+	Price         float64                `protobuf:"fixed64,5,opt,name=price,proto3" json:"price,omitempty"`
+	StopPrice     float64                `protobuf:"fixed64,6,opt,name=stop_price,json=stopPrice,proto3" json:"stop_price,omitempty"`
+	TimeInForce   TimeInForce            `protobuf:"varint,7,opt,name=time_in_force,json=timeInForce,proto3,enum=exchange.v1.TimeInForce" json:"time_in_force,omitempty"`
+	ExpiresAt     int64                  `protobuf:"varint,8,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	Status        string                 `protobuf:"bytes,9,opt,name=status,proto3" json:"status,omitempty"`
+	OriginalSize  float64                `protobuf:"fixed64,10,opt,name=original_size,json=originalSize,proto3" json:"original_size,omitempty"`
+	FilledSize    float64                `protobuf:"fixed64,11,opt,name=filled_size,json=filledSize,proto3" json:"filled_size,omitempty"`
+	Remaining     float64                `protobuf:"fixed64,12,opt,name=remaining,proto3" json:"remaining,omitempty"`
+	AvgPrice      float64                `protobuf:"fixed64,13,opt,name=avg_price,json=avgPrice,proto3" json:"avg_price,omitempty"`
+	CreatedAt     int64                  `protobuf:"varint,14,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	UpdatedAt     int64                  `protobuf:"varint,15,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Order) Reset() {
+	*x = Order{}
+	mi := &file_exchange_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Order) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Order) ProtoMessage() {}
+
+func (x *Order) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Order.ProtoReflect.Descriptor instead.
+func (*Order) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Order) GetOrderId() uint64 {
+	if x != nil {
+		return x.OrderId
+	}
+	return 0
+}
+
+func (x *Order) GetClientOrderId() string {
+	if x != nil {
+		return x.ClientOrderId
+	}
+	return ""
+}
+
+func (x *Order) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *Order) GetBid() bool {
+	if x != nil {
+		return x.Bid
+	}
+	return false
+}
+
+func (x *Order) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *Order) GetStopPrice() float64 {
+	if x != nil {
+		return x.StopPrice
+	}
+	return 0
+}
+
+func (x *Order) GetTimeInForce() TimeInForce {
+	if x != nil {
+		return x.TimeInForce
+	}
+	return TimeInForce_TIME_IN_FORCE_UNSPECIFIED
+}
+
+func (x *Order) GetExpiresAt() int64 {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return 0
+}
+
+func (x *Order) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Order) GetOriginalSize() float64 {
+	if x != nil {
+		return x.OriginalSize
+	}
+	return 0
+}
+
+func (x *Order) GetFilledSize() float64 {
+	if x != nil {
+		return x.FilledSize
+	}
+	return 0
+}
+
+func (x *Order) GetRemaining() float64 {
+	if x != nil {
+		return x.Remaining
+	}
+	return 0
+}
+
+func (x *Order) GetAvgPrice() float64 {
+	if x != nil {
+		return x.AvgPrice
+	}
+	return 0
+}
+
+func (x *Order) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+func (x *Order) GetUpdatedAt() int64 {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return 0
+}
+
+type GetBookRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Market string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	// depth is how many levels a side to return, 10 if unset.
+	Depth         int32 `protobuf:"varint,2,opt,name=depth,proto3" json:"depth,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetBookRequest) Reset() {
+	*x = GetBookRequest{}
+	mi := &file_exchange_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetBookRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetBookRequest) ProtoMessage() {}
+
+func (x *GetBookRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetBookRequest.ProtoReflect.Descriptor instead.
+func (*GetBookRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *GetBookRequest) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *GetBookRequest) GetDepth() int32 {
+	if x != nil {
+		return x.Depth
+	}
+	return 0
+}
+
+type Level struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Price         float64                `protobuf:"fixed64,1,opt,name=price,proto3" json:"price,omitempty"`
+	Size          float64                `protobuf:"fixed64,2,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Level) Reset() {
+	*x = Level{}
+	mi := &file_exchange_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Level) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Level) ProtoMessage() {}
+
+func (x *Level) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Level.ProtoReflect.Descriptor instead.
+func (*Level) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Level) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *Level) GetSize() float64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type Book struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Market        string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	Sequence      uint64                 `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	Bids          []*Level               `protobuf:"bytes,3,rep,name=bids,proto3" json:"bids,omitempty"`
+	Asks          []*Level               `protobuf:"bytes,4,rep,name=asks,proto3" json:"asks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Book) Reset() {
+	*x = Book{}
+	mi := &file_exchange_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Book) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Book) ProtoMessage() {}
+
+func (x *Book) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Book.ProtoReflect.Descriptor instead.
+func (*Book) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Book) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *Book) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *Book) GetBids() []*Level {
+	if x != nil {
+		return x.Bids
+	}
+	return nil
+}
+
+func (x *Book) GetAsks() []*Level {
+	if x != nil {
+		return x.Asks
+	}
+	return nil
+}
+
+type StreamBookRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Market        string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamBookRequest) Reset() {
+	*x = StreamBookRequest{}
+	mi := &file_exchange_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamBookRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamBookRequest) ProtoMessage() {}
+
+func (x *StreamBookRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamBookRequest.ProtoReflect.Descriptor instead.
+func (*StreamBookRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *StreamBookRequest) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+// BookUpdate is the first snapshot of a book, or the levels one operation
+// changed, best price first; a level with no size is gone. An update
+// follows on from the message whose seq is its prev_seq, so a client that
+// sees a gap knows it missed one.
+type BookUpdate struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Market        string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	Seq           uint64                 `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	PrevSeq       uint64                 `protobuf:"varint,3,opt,name=prev_seq,json=prevSeq,proto3" json:"prev_seq,omitempty"`
+	Snapshot      bool                   `protobuf:"varint,4,opt,name=snapshot,proto3" json:"snapshot,omitempty"`
+	Bids          []*Level               `protobuf:"bytes,5,rep,name=bids,proto3" json:"bids,omitempty"`
+	Asks          []*Level               `protobuf:"bytes,6,rep,name=asks,proto3" json:"asks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BookUpdate) Reset() {
+	*x = BookUpdate{}
+	mi := &file_exchange_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BookUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BookUpdate) ProtoMessage() {}
+
+func (x *BookUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BookUpdate.ProtoReflect.Descriptor instead.
+func (*BookUpdate) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *BookUpdate) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *BookUpdate) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *BookUpdate) GetPrevSeq() uint64 {
+	if x != nil {
+		return x.PrevSeq
+	}
+	return 0
+}
+
+func (x *BookUpdate) GetSnapshot() bool {
+	if x != nil {
+		return x.Snapshot
+	}
+	return false
+}
+
+func (x *BookUpdate) GetBids() []*Level {
+	if x != nil {
+		return x.Bids
+	}
+	return nil
+}
+
+func (x *BookUpdate) GetAsks() []*Level {
+	if x != nil {
+		return x.Asks
+	}
+	return nil
+}
+
+type StreamTradesRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Market string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	// after_trade_id is the last trade the client has seen, if any.
+	AfterTradeId  *uint64 `protobuf:"varint,2,opt,name=after_trade_id,json=afterTradeId,proto3,oneof" json:"after_trade_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamTradesRequest) Reset() {
+	*x = StreamTradesRequest{}
+	mi := &file_exchange_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamTradesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamTradesRequest) ProtoMessage() {}
+
+func (x *StreamTradesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamTradesRequest.ProtoReflect.Descriptor instead.
+func (*StreamTradesRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *StreamTradesRequest) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *StreamTradesRequest) GetAfterTradeId() uint64 {
+	if x != nil && x.AfterTradeId != nil {
+		return *x.AfterTradeId
+	}
+	return 0
+}
+
+// MarketTrade is one trade on a market. bid is the side of the order that
+// came in; auction trades have none and report false. The timestamp is in
+// unix nanoseconds.
+type MarketTrade struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Market        string                 `protobuf:"bytes,1,opt,name=market,proto3" json:"market,omitempty"`
+	TradeId       uint64                 `protobuf:"varint,2,opt,name=trade_id,json=tradeId,proto3" json:"trade_id,omitempty"`
+	Seq           uint64                 `protobuf:"varint,3,opt,name=seq,proto3" json:"seq,omitempty"`
+	Bid           bool                   `protobuf:"varint,4,opt,name=bid,proto3" json:"bid,omitempty"`
+	Price         float64                `protobuf:"fixed64,5,opt,name=price,proto3" json:"price,omitempty"`
+	Size          float64                `protobuf:"fixed64,6,opt,name=size,proto3" json:"size,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MarketTrade) Reset() {
+	*x = MarketTrade{}
+	mi := &file_exchange_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MarketTrade) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MarketTrade) ProtoMessage() {}
+
+func (x *MarketTrade) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MarketTrade.ProtoReflect.Descriptor instead.
+func (*MarketTrade) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *MarketTrade) GetMarket() string {
+	if x != nil {
+		return x.Market
+	}
+	return ""
+}
+
+func (x *MarketTrade) GetTradeId() uint64 {
+	if x != nil {
+		return x.TradeId
+	}
+	return 0
+}
+
+func (x *MarketTrade) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *MarketTrade) GetBid() bool {
+	if x != nil {
+		return x.Bid
+	}
+	return false
+}
+
+func (x *MarketTrade) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *MarketTrade) GetSize() float64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *MarketTrade) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+var File_exchange_proto protoreflect.FileDescriptor
+
+const file_exchange_proto_rawDesc = "" +
+	"\n" +
+	"\x0eexchange.proto\x12\vexchange.v1\"\xc8\x04\n" +
+	"\x11PlaceOrderRequest\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\x12*\n" +
+	"\x04type\x18\x02 \x01(\x0e2\x16.exchange.v1.OrderTypeR\x04type\x12\x10\n" +
+	"\x03bid\x18\x03 \x01(\bR\x03bid\x12\x12\n" +
+	"\x04size\x18\x04 \x01(\x01R\x04size\x12\x14\n" +
+	"\x05price\x18\x05 \x01(\x01R\x05price\x12<\n" +
+	"\rtime_in_force\x18\x06 \x01(\x0e2\x18.exchange.v1.TimeInForceR\vtimeInForce\x12\x1d\n" +
+	"\n" +
+	"expires_at\x18\a \x01(\x03R\texpiresAt\x12!\n" +
+	"\fdisplay_size\x18\b \x01(\x01R\vdisplaySize\x12\x1d\n" +
+	"\n" +
+	"stop_price\x18\t \x01(\x01R\tstopPrice\x12&\n" +
+	"\x0fclient_order_id\x18\n" +
+	" \x01(\tR\rclientOrderId\x12\x1a\n" +
+	"\bnotional\x18\v \x01(\x01R\bnotional\x12\x1f\n" +
+	"\vworst_price\x18\f \x01(\x01R\n" +
+	"worstPrice\x12(\n" +
+	"\x10max_slippage_bps\x18\r \x01(\x01R\x0emaxSlippageBps\x12H\n" +
+	"\bmetadata\x18\x0e \x03(\v2,.exchange.v1.PlaceOrderRequest.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x85\x01\n" +
+	"\x05Trade\x12\x14\n" +
+	"\x05price\x18\x01 \x01(\x01R\x05price\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x01R\x04size\x12'\n" +
+	"\x0fcounterparty_id\x18\x03 \x01(\x04R\x0ecounterpartyId\x12)\n" +
+	"\x10counterparty_bid\x18\x04 \x01(\bR\x0fcounterpartyBid\"\xba\x03\n" +
+	"\x0fExecutionReport\x12\x19\n" +
+	"\border_id\x18\x01 \x01(\x04R\aorderId\x12\x16\n" +
+	"\x06market\x18\x02 \x01(\tR\x06market\x12#\n" +
+	"\roriginal_size\x18\x03 \x01(\x01R\foriginalSize\x12\x1c\n" +
+	"\tremaining\x18\x04 \x01(\x01R\tremaining\x12\x1f\n" +
+	"\vfilled_size\x18\x05 \x01(\x01R\n" +
+	"filledSize\x12\x16\n" +
+	"\x06rested\x18\x06 \x01(\bR\x06rested\x12\x1b\n" +
+	"\tavg_price\x18\a \x01(\x01R\bavgPrice\x12\x1f\n" +
+	"\vworst_price\x18\b \x01(\x01R\n" +
+	"worstPrice\x12%\n" +
+	"\x0elevels_touched\x18\t \x01(\x05R\rlevelsTouched\x12*\n" +
+	"\x06trades\x18\n" +
+	" \x03(\v2\x12.exchange.v1.TradeR\x06trades\x12\x1f\n" +
+	"\vlimit_price\x18\v \x01(\x01R\n" +
+	"limitPrice\x120\n" +
+	"\x11price_improvement\x18\f \x01(\x01H\x00R\x10priceImprovement\x88\x01\x01B\x14\n" +
+	"\x12_price_improvement\"d\n" +
+	"\x12CancelOrderRequest\x12\x1b\n" +
+	"\border_id\x18\x01 \x01(\x04H\x00R\aorderId\x12(\n" +
+	"\x0fclient_order_id\x18\x02 \x01(\tH\x00R\rclientOrderIdB\a\n" +
+	"\x05order\"\xe0\x01\n" +
+	"\x0eCancelledOrder\x12\x19\n" +
+	"\border_id\x18\x01 \x01(\x04R\aorderId\x12\x16\n" +
+	"\x06market\x18\x02 \x01(\tR\x06market\x12\x10\n" +
+	"\x03bid\x18\x03 \x01(\bR\x03bid\x12\x14\n" +
+	"\x05price\x18\x04 \x01(\x01R\x05price\x12\x1c\n" +
+	"\tremaining\x18\x05 \x01(\x01R\tremaining\x12\x1f\n" +
+	"\vfilled_size\x18\x06 \x01(\x01R\n" +
+	"filledSize\x12\x16\n" +
+	"\x06status\x18\a \x01(\tR\x06status\x12\x1c\n" +
+	"\ttimestamp\x18\b \x01(\x03R\ttimestamp\"a\n" +
+	"\x0fGetOrderRequest\x12\x1b\n" +
+	"\border_id\x18\x01 \x01(\x04H\x00R\aorderId\x12(\n" +
+	"\x0fclient_order_id\x18\x02 \x01(\tH\x00R\rclientOrderIdB\a\n" +
+	"\x05order\"\xdd\x03\n" +
+	"\x05Order\x12\x19\n" +
+	"\border_id\x18\x01 \x01(\x04R\aorderId\x12&\n" +
+	"\x0fclient_order_id\x18\x02 \x01(\tR\rclientOrderId\x12\x16\n" +
+	"\x06market\x18\x03 \x01(\tR\x06market\x12\x10\n" +
+	"\x03bid\x18\x04 \x01(\bR\x03bid\x12\x14\n" +
+	"\x05price\x18\x05 \x01(\x01R\x05price\x12\x1d\n" +
+	"\n" +
+	"stop_price\x18\x06 \x01(\x01R\tstopPrice\x12<\n" +
+	"\rtime_in_force\x18\a \x01(\x0e2\x18.exchange.v1.TimeInForceR\vtimeInForce\x12\x1d\n" +
+	"\n" +
+	"expires_at\x18\b \x01(\x03R\texpiresAt\x12\x16\n" +
+	"\x06status\x18\t \x01(\tR\x06status\x12#\n" +
+	"\roriginal_size\x18\n" +
+	" \x01(\x01R\foriginalSize\x12\x1f\n" +
+	"\vfilled_size\x18\v \x01(\x01R\n" +
+	"filledSize\x12\x1c\n" +
+	"\tremaining\x18\f \x01(\x01R\tremaining\x12\x1b\n" +
+	"\tavg_price\x18\r \x01(\x01R\bavgPrice\x12\x1d\n" +
+	"\n" +
+	"created_at\x18\x0e \x01(\x03R\tcreatedAt\x12\x1d\n" +
+	"\n" +
+	"updated_at\x18\x0f \x01(\x03R\tupdatedAt\">\n" +
+	"\x0eGetBookRequest\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\x12\x14\n" +
+	"\x05depth\x18\x02 \x01(\x05R\x05depth\"1\n" +
+	"\x05Level\x12\x14\n" +
+	"\x05price\x18\x01 \x01(\x01R\x05price\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x01R\x04size\"\x8a\x01\n" +
+	"\x04Book\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x04R\bsequence\x12&\n" +
+	"\x04bids\x18\x03 \x03(\v2\x12.exchange.v1.LevelR\x04bids\x12&\n" +
+	"\x04asks\x18\x04 \x03(\v2\x12.exchange.v1.LevelR\x04asks\"+\n" +
+	"\x11StreamBookRequest\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\"\xbd\x01\n" +
+	"\n" +
+	"BookUpdate\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\x12\x10\n" +
+	"\x03seq\x18\x02 \x01(\x04R\x03seq\x12\x19\n" +
+	"\bprev_seq\x18\x03 \x01(\x04R\aprevSeq\x12\x1a\n" +
+	"\bsnapshot\x18\x04 \x01(\bR\bsnapshot\x12&\n" +
+	"\x04bids\x18\x05 \x03(\v2\x12.exchange.v1.LevelR\x04bids\x12&\n" +
+	"\x04asks\x18\x06 \x03(\v2\x12.exchange.v1.LevelR\x04asks\"k\n" +
+	"\x13StreamTradesRequest\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\x12)\n" +
+	"\x0eafter_trade_id\x18\x02 \x01(\x04H\x00R\fafterTradeId\x88\x01\x01B\x11\n" +
+	"\x0f_after_trade_id\"\xac\x01\n" +
+	"\vMarketTrade\x12\x16\n" +
+	"\x06market\x18\x01 \x01(\tR\x06market\x12\x19\n" +
+	"\btrade_id\x18\x02 \x01(\x04R\atradeId\x12\x10\n" +
+	"\x03seq\x18\x03 \x01(\x04R\x03seq\x12\x10\n" +
+	"\x03bid\x18\x04 \x01(\bR\x03bid\x12\x14\n" +
+	"\x05price\x18\x05 \x01(\x01R\x05price\x12\x12\n" +
+	"\x04size\x18\x06 \x01(\x01R\x04size\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp*p\n" +
+	"\tOrderType\x12\x1a\n" +
+	"\x16ORDER_TYPE_UNSPECIFIED\x10\x00\x12\x14\n" +
+	"\x10ORDER_TYPE_LIMIT\x10\x01\x12\x15\n" +
+	"\x11ORDER_TYPE_MARKET\x10\x02\x12\x1a\n" +
+	"\x16ORDER_TYPE_STOP_MARKET\x10\x03*\x88\x01\n" +
+	"\vTimeInForce\x12\x1d\n" +
+	"\x19TIME_IN_FORCE_UNSPECIFIED\x10\x00\x12\x15\n" +
+	"\x11TIME_IN_FORCE_GTC\x10\x01\x12\x15\n" +
+	"\x11TIME_IN_FORCE_IOC\x10\x02\x12\x15\n" +
+	"\x11TIME_IN_FORCE_FOK\x10\x03\x12\x15\n" +
+	"\x11TIME_IN_FORCE_GTD\x10\x042\xb3\x03\n" +
+	"\bExchange\x12J\n" +
+	"\n" +
+	"PlaceOrder\x12\x1e.exchange.v1.PlaceOrderRequest\x1a\x1c.exchange.v1.ExecutionReport\x12K\n" +
+	"\vCancelOrder\x12\x1f.exchange.v1.CancelOrderRequest\x1a\x1b.exchange.v1.CancelledOrder\x12<\n" +
+	"\bGetOrder\x12\x1c.exchange.v1.GetOrderRequest\x1a\x12.exchange.v1.Order\x129\n" +
+	"\aGetBook\x12\x1b.exchange.v1.GetBookRequest\x1a\x11.exchange.v1.Book\x12G\n" +
+	"\n" +
+	"StreamBook\x12\x1e.exchange.v1.StreamBookRequest\x1a\x17.exchange.v1.BookUpdate0\x01\x12L\n" +
+	"\fStreamTrades\x12 .exchange.v1.StreamTradesRequest\x1a\x18.exchange.v1.MarketTrade0\x01B0Z.github.com/thenaveensharma/exchange/exchangepbb\x06proto3"
+
+var (
+	file_exchange_proto_rawDescOnce sync.Once
+	file_exchange_proto_rawDescData []byte
+)
+
+func file_exchange_proto_rawDescGZIP() []byte {
+	file_exchange_proto_rawDescOnce.Do(func() {
+		file_exchange_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_exchange_proto_rawDesc), len(file_exchange_proto_rawDesc)))
+	})
+	return file_exchange_proto_rawDescData
+}
+
+var file_exchange_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_exchange_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
+var file_exchange_proto_goTypes = []any{
+	(OrderType)(0),              // 0: exchange.v1.OrderType
+	(TimeInForce)(0),            // 1: exchange.v1.TimeInForce
+	(*PlaceOrderRequest)(nil),   // 2: exchange.v1.PlaceOrderRequest
+	(*Trade)(nil),               // 3: exchange.v1.Trade
+	(*ExecutionReport)(nil),     // 4: exchange.v1.ExecutionReport
+	(*CancelOrderRequest)(nil),  // 5: exchange.v1.CancelOrderRequest
+	(*CancelledOrder)(nil),      // 6: exchange.v1.CancelledOrder
+	(*GetOrderRequest)(nil),     // 7: exchange.v1.GetOrderRequest
+	(*Order)(nil),               // 8: exchange.v1.Order
+	(*GetBookRequest)(nil),      // 9: exchange.v1.GetBookRequest
+	(*Level)(nil),               // 10: exchange.v1.Level
+	(*Book)(nil),                // 11: exchange.v1.Book
+	(*StreamBookRequest)(nil),   // 12: exchange.v1.StreamBookRequest
+	(*BookUpdate)(nil),          // 13: exchange.v1.BookUpdate
+	(*StreamTradesRequest)(nil), // 14: exchange.v1.StreamTradesRequest
+	(*MarketTrade)(nil),         // 15: exchange.v1.MarketTrade
+	nil,                         // 16: exchange.v1.PlaceOrderRequest.MetadataEntry
+}
+var file_exchange_proto_depIdxs = []int32{
+	0,  // 0: exchange.v1.PlaceOrderRequest.type:type_name -> exchange.v1.OrderType
+	1,  // 1: exchange.v1.PlaceOrderRequest.time_in_force:type_name -> exchange.v1.TimeInForce
+	16, // 2: exchange.v1.PlaceOrderRequest.metadata:type_name -> exchange.v1.PlaceOrderRequest.MetadataEntry
+	3,  // 3: exchange.v1.ExecutionReport.trades:type_name -> exchange.v1.Trade
+	1,  // 4: exchange.v1.Order.time_in_force:type_name -> exchange.v1.TimeInForce
+	10, // 5: exchange.v1.Book.bids:type_name -> exchange.v1.Level
+	10, // 6: exchange.v1.Book.asks:type_name -> exchange.v1.Level
+	10, // 7: exchange.v1.BookUpdate.bids:type_name -> exchange.v1.Level
+	10, // 8: exchange.v1.BookUpdate.asks:type_name -> exchange.v1.Level
+	2,  // 9: exchange.v1.Exchange.PlaceOrder:input_type -> exchange.v1.PlaceOrderRequest
+	5,  // 10: exchange.v1.Exchange.CancelOrder:input_type -> exchange.v1.CancelOrderRequest
+	7,  // 11: exchange.v1.Exchange.GetOrder:input_type -> exchange.v1.GetOrderRequest
+	9,  // 12: exchange.v1.Exchange.GetBook:input_type -> exchange.v1.GetBookRequest
+	12, // 13: exchange.v1.Exchange.StreamBook:input_type -> exchange.v1.StreamBookRequest
+	14, // 14: exchange.v1.Exchange.StreamTrades:input_type -> exchange.v1.StreamTradesRequest
+	4,  // 15: exchange.v1.Exchange.PlaceOrder:output_type -> exchange.v1.ExecutionReport
+	6,  // 16: exchange.v1.Exchange.CancelOrder:output_type -> exchange.v1.CancelledOrder
+	8,  // 17: exchange.v1.Exchange.GetOrder:output_type -> exchange.v1.Order
+	11, // 18: exchange.v1.Exchange.GetBook:output_type -> exchange.v1.Book
+	13, // 19: exchange.v1.Exchange.StreamBook:output_type -> exchange.v1.BookUpdate
+	15, // 20: exchange.v1.Exchange.StreamTrades:output_type -> exchange.v1.MarketTrade
+	15, // [15:21] is the sub-list for method output_type
+	9,  // [9:15] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_exchange_proto_init() }
+func file_exchange_proto_init() {
+	if File_exchange_proto != nil {
+		return
+	}
+	file_exchange_proto_msgTypes[2].OneofWrappers = []any{}
+	file_exchange_proto_msgTypes[3].OneofWrappers = []any{
+		(*CancelOrderRequest_OrderId)(nil),
+		(*CancelOrderRequest_ClientOrderId)(nil),
+	}
+	file_exchange_proto_msgTypes[5].OneofWrappers = []any{
+		(*GetOrderRequest_OrderId)(nil),
+		(*GetOrderRequest_ClientOrderId)(nil),
+	}
+	file_exchange_proto_msgTypes[12].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_exchange_proto_rawDesc), len(file_exchange_proto_rawDesc)),
+			NumEnums:      2,
+			NumMessages:   15,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_exchange_proto_goTypes,
+		DependencyIndexes: file_exchange_proto_depIdxs,
+		EnumInfos:         file_exchange_proto_enumTypes,
+		MessageInfos:      file_exchange_proto_msgTypes,
+	}.Build()
+	File_exchange_proto = out.File
+	file_exchange_proto_goTypes = nil
+	file_exchange_proto_depIdxs = nil
+}
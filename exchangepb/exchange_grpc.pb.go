@@ -0,0 +1,358 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v31.1.0
+// source: exchange.proto
+
+package exchangepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Exchange_PlaceOrder_FullMethodName   = "/exchange.v1.Exchange/PlaceOrder"
+	Exchange_CancelOrder_FullMethodName  = "/exchange.v1.Exchange/CancelOrder"
+	Exchange_GetOrder_FullMethodName     = "/exchange.v1.Exchange/GetOrder"
+	Exchange_GetBook_FullMethodName      = "/exchange.v1.Exchange/GetBook"
+	Exchange_StreamBook_FullMethodName   = "/exchange.v1.Exchange/StreamBook"
+	Exchange_StreamTrades_FullMethodName = "/exchange.v1.Exchange/StreamTrades"
+)
+
+// ExchangeClient is the client API for Exchange service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Exchange is order entry and queries for programs. Calls act for the user
+// whose API key is in the x-api-key metadata, or whose session token is a
+// bearer authorization; with neither they act anonymously, as over HTTP.
+// A refused request fails with a status carrying an ErrorInfo whose reason
+// is the rejection code.
+type ExchangeClient interface {
+	// PlaceOrder validates an order against its market's rules and puts it
+	// on the book.
+	PlaceOrder(ctx context.Context, in *PlaceOrderRequest, opts ...grpc.CallOption) (*ExecutionReport, error)
+	// CancelOrder cancels a resting or untriggered stop order, by ID or by
+	// client order ID.
+	CancelOrder(ctx context.Context, in *CancelOrderRequest, opts ...grpc.CallOption) (*CancelledOrder, error)
+	// GetOrder reports an order, live or recently finished, by ID or by
+	// client order ID.
+	GetOrder(ctx context.Context, in *GetOrderRequest, opts ...grpc.CallOption) (*Order, error)
+	// GetBook returns the top of a market's book, aggregated by price.
+	GetBook(ctx context.Context, in *GetBookRequest, opts ...grpc.CallOption) (*Book, error)
+	// StreamBook streams a market's book by price level: a snapshot of every
+	// level, then the levels each operation changed. A stream that falls too
+	// far behind the market ends with RESOURCE_EXHAUSTED, and the client
+	// starts again from a new snapshot.
+	StreamBook(ctx context.Context, in *StreamBookRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BookUpdate], error)
+	// StreamTrades streams a market's trades as they happen, after the ones
+	// since after_trade_id as far back as the exchange keeps them. A stream
+	// that falls too far behind ends with RESOURCE_EXHAUSTED.
+	StreamTrades(ctx context.Context, in *StreamTradesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[MarketTrade], error)
+}
+
+type exchangeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewExchangeClient(cc grpc.ClientConnInterface) ExchangeClient {
+	return &exchangeClient{cc}
+}
+
+func (c *exchangeClient) PlaceOrder(ctx context.Context, in *PlaceOrderRequest, opts ...grpc.CallOption) (*ExecutionReport, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ExecutionReport)
+	err := c.cc.Invoke(ctx, Exchange_PlaceOrder_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exchangeClient) CancelOrder(ctx context.Context, in *CancelOrderRequest, opts ...grpc.CallOption) (*CancelledOrder, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CancelledOrder)
+	err := c.cc.Invoke(ctx, Exchange_CancelOrder_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exchangeClient) GetOrder(ctx context.Context, in *GetOrderRequest, opts ...grpc.CallOption) (*Order, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Order)
+	err := c.cc.Invoke(ctx, Exchange_GetOrder_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exchangeClient) GetBook(ctx context.Context, in *GetBookRequest, opts ...grpc.CallOption) (*Book, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Book)
+	err := c.cc.Invoke(ctx, Exchange_GetBook_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exchangeClient) StreamBook(ctx context.Context, in *StreamBookRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BookUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Exchange_ServiceDesc.Streams[0], Exchange_StreamBook_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamBookRequest, BookUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Exchange_StreamBookClient = grpc.ServerStreamingClient[BookUpdate]
+
+func (c *exchangeClient) StreamTrades(ctx context.Context, in *StreamTradesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[MarketTrade], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Exchange_ServiceDesc.Streams[1], Exchange_StreamTrades_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamTradesRequest, MarketTrade]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Exchange_StreamTradesClient = grpc.ServerStreamingClient[MarketTrade]
+
+// ExchangeServer is the server API for Exchange service.
+// All implementations must embed UnimplementedExchangeServer
+// for forward compatibility.
+//
+// Exchange is order entry and queries for programs. Calls act for the user
+// whose API key is in the x-api-key metadata, or whose session token is a
+// bearer authorization; with neither they act anonymously, as over HTTP.
+// A refused request fails with a status carrying an ErrorInfo whose reason
+// is the rejection code.
+type ExchangeServer interface {
+	// PlaceOrder validates an order against its market's rules and puts it
+	// on the book.
+	PlaceOrder(context.Context, *PlaceOrderRequest) (*ExecutionReport, error)
+	// CancelOrder cancels a resting or untriggered stop order, by ID or by
+	// client order ID.
+	CancelOrder(context.Context, *CancelOrderRequest) (*CancelledOrder, error)
+	// GetOrder reports an order, live or recently finished, by ID or by
+	// client order ID.
+	GetOrder(context.Context, *GetOrderRequest) (*Order, error)
+	// GetBook returns the top of a market's book, aggregated by price.
+	GetBook(context.Context, *GetBookRequest) (*Book, error)
+	// StreamBook streams a market's book by price level: a snapshot of every
+	// level, then the levels each operation changed. A stream that falls too
+	// far behind the market ends with RESOURCE_EXHAUSTED, and the client
+	// starts again from a new snapshot.
+	StreamBook(*StreamBookRequest, grpc.ServerStreamingServer[BookUpdate]) error
+	// StreamTrades streams a market's trades as they happen, after the ones
+	// since after_trade_id as far back as the exchange keeps them. A stream
+	// that falls too far behind ends with RESOURCE_EXHAUSTED.
+	StreamTrades(*StreamTradesRequest, grpc.ServerStreamingServer[MarketTrade]) error
+	mustEmbedUnimplementedExchangeServer()
+}
+
+// UnimplementedExchangeServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedExchangeServer struct{}
+
+func (UnimplementedExchangeServer) PlaceOrder(context.Context, *PlaceOrderRequest) (*ExecutionReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PlaceOrder not implemented")
+}
+func (UnimplementedExchangeServer) CancelOrder(context.Context, *CancelOrderRequest) (*CancelledOrder, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelOrder not implemented")
+}
+func (UnimplementedExchangeServer) GetOrder(context.Context, *GetOrderRequest) (*Order, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOrder not implemented")
+}
+func (UnimplementedExchangeServer) GetBook(context.Context, *GetBookRequest) (*Book, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBook not implemented")
+}
+func (UnimplementedExchangeServer) StreamBook(*StreamBookRequest, grpc.ServerStreamingServer[BookUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamBook not implemented")
+}
+func (UnimplementedExchangeServer) StreamTrades(*StreamTradesRequest, grpc.ServerStreamingServer[MarketTrade]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTrades not implemented")
+}
+func (UnimplementedExchangeServer) mustEmbedUnimplementedExchangeServer() {}
+func (UnimplementedExchangeServer) testEmbeddedByValue()                  {}
+
+// UnsafeExchangeServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ExchangeServer will
+// result in compilation errors.
+type UnsafeExchangeServer interface {
+	mustEmbedUnimplementedExchangeServer()
+}
+
+func RegisterExchangeServer(s grpc.ServiceRegistrar, srv ExchangeServer) {
+	// If the following call pancis, it indicates UnimplementedExchangeServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Exchange_ServiceDesc, srv)
+}
+
+func _Exchange_PlaceOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlaceOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).PlaceOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_PlaceOrder_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).PlaceOrder(ctx, req.(*PlaceOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exchange_CancelOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).CancelOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_CancelOrder_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).CancelOrder(ctx, req.(*CancelOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exchange_GetOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).GetOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_GetOrder_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).GetOrder(ctx, req.(*GetOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exchange_GetBook_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).GetBook(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_GetBook_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).GetBook(ctx, req.(*GetBookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exchange_StreamBook_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamBookRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ExchangeServer).StreamBook(m, &grpc.GenericServerStream[StreamBookRequest, BookUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Exchange_StreamBookServer = grpc.ServerStreamingServer[BookUpdate]
+
+func _Exchange_StreamTrades_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamTradesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ExchangeServer).StreamTrades(m, &grpc.GenericServerStream[StreamTradesRequest, MarketTrade]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Exchange_StreamTradesServer = grpc.ServerStreamingServer[MarketTrade]
+
+// Exchange_ServiceDesc is the grpc.ServiceDesc for Exchange service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Exchange_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "exchange.v1.Exchange",
+	HandlerType: (*ExchangeServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PlaceOrder",
+			Handler:    _Exchange_PlaceOrder_Handler,
+		},
+		{
+			MethodName: "CancelOrder",
+			Handler:    _Exchange_CancelOrder_Handler,
+		},
+		{
+			MethodName: "GetOrder",
+			Handler:    _Exchange_GetOrder_Handler,
+		},
+		{
+			MethodName: "GetBook",
+			Handler:    _Exchange_GetBook_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamBook",
+			Handler:       _Exchange_StreamBook_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamTrades",
+			Handler:       _Exchange_StreamTrades_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "exchange.proto",
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/fix"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// withFIX serves FIX order entry on a too, for the same users as the HTTP
+// routes: they log on with their API key as the Password.
+func withFIX(a *fix.Acceptor) serverOption {
+	return func(s *server) {
+		s.fix = a
+	}
+}
+
+// fixApp logs users on to FIX sessions.
+type fixApp struct {
+	s *server
+}
+
+func (a *fixApp) Logon(sess *fix.Session, logon *fix.Message) (fix.Handler, error) {
+	key, _ := logon.Get(fix.TagPassword)
+	u, ok := a.s.users.Authenticate(key)
+	if !ok {
+		return nil, errors.New("unauthorized")
+	}
+	updates, unsubscribe := a.s.ex.SubscribeOrderUpdates(u.ID)
+	h := &fixSession{
+		s:           a.s,
+		sess:        sess,
+		user:        u.ID,
+		unsubscribe: unsubscribe,
+		orders:      make(map[uint64]*fixOrder),
+		cancels:     make(map[uint64]string),
+	}
+	go h.report(updates)
+	return h, nil
+}
+
+// fixSession is one user's FIX session: it places and cancels their orders
+// and reports on every one of them, however it was placed, as its updates
+// come in.
+type fixSession struct {
+	s           *server
+	sess        *fix.Session
+	user        uint64
+	unsubscribe func()
+
+	mu sync.Mutex
+	// orders are the user's live orders as their updates have told
+	orders map[uint64]*fixOrder
+	// cancels are the ClOrdIDs of cancel requests waiting on their orders'
+	// cancellation, by order ID
+	cancels map[uint64]string
+}
+
+// fixOrder is what an order's execution reports need that its updates
+// don't each carry.
+type fixOrder struct {
+	size   orderbook.Size
+	filled orderbook.Size
+	// notional is the sum of the fills' prices times their sizes, in units
+	// of both
+	notional float64
+}
+
+// fixRejects numbers execution reports that reject orders, which have no
+// order or operation to number them by.
+var fixRejects struct {
+	sync.Mutex
+	n uint64
+}
+
+func (h *fixSession) Logout() {
+	h.unsubscribe()
+}
+
+func (h *fixSession) FromApp(msg *fix.Message) {
+	switch msg.Type() {
+	case fix.MsgNewOrderSingle:
+		h.newOrder(msg)
+	case fix.MsgOrderCancelRequest:
+		h.cancel(msg)
+	default:
+		reject := fix.NewMessage(fix.MsgBusinessMessageReject).
+			Set(fix.TagRefMsgType, msg.Type()).
+			Set(fix.TagBusinessRejectReason, "3").
+			Set(fix.TagText, "unsupported message type")
+		if seq, ok := msg.Get(fix.TagMsgSeqNum); ok {
+			reject.Set(fix.TagRefSeqNum, seq)
+		}
+		h.sess.Send(reject)
+	}
+}
+
+// newOrder places a NewOrderSingle. Only a refusal is answered here: the
+// order's own reports follow from its updates.
+func (h *fixSession) newOrder(msg *fix.Message) {
+	symbol, _ := msg.Get(fix.TagSymbol)
+	scale, err := h.s.requestScale(exchange.Market(symbol))
+	if err != nil {
+		h.reject(msg, exchange.PlaceOrderRequest{Market: exchange.Market(symbol)}, err)
+		return
+	}
+	req, fieldErr := fixOrderRequest(msg, scale)
+	if fieldErr != nil {
+		h.sess.RejectField(msg, fieldErr)
+		return
+	}
+	req.User = h.user
+	ctx, cancel := context.WithTimeout(context.Background(), fixRequestTimeout)
+	defer cancel()
+	if _, err := h.s.ex.PlaceOrder(ctx, req); err != nil {
+		h.reject(msg, req, err)
+	}
+}
+
+// fixRequestTimeout bounds how long a FIX request waits on the engine.
+const fixRequestTimeout = 10 * time.Second
+
+// fixOrderRequest reads a NewOrderSingle, its prices and quantities exactly
+// with scale. Fields the exchange has no use for, TransactTime among them,
+// are ignored; ones it does are checked by PlaceOrder as any order is.
+func fixOrderRequest(msg *fix.Message, scale orderbook.Scale) (exchange.PlaceOrderRequest, *fix.FieldError) {
+	var req exchange.PlaceOrderRequest
+
+	clOrdID, ok := msg.Get(fix.TagClOrdID)
+	if !ok {
+		return req, &fix.FieldError{Tag: fix.TagClOrdID, Missing: true}
+	}
+	req.ClientOrderID = clOrdID
+	symbol, ok := msg.Get(fix.TagSymbol)
+	if !ok {
+		return req, &fix.FieldError{Tag: fix.TagSymbol, Missing: true}
+	}
+	req.Market = exchange.Market(symbol)
+	switch side, _ := msg.Get(fix.TagSide); side {
+	case "1":
+		req.Bid = true
+	case "2":
+	default:
+		return req, &fix.FieldError{Tag: fix.TagSide, Missing: side == ""}
+	}
+	qty, ok := msg.Get(fix.TagOrderQty)
+	if !ok {
+		return req, &fix.FieldError{Tag: fix.TagOrderQty, Missing: true}
+	}
+	size, err := scale.ParseSize(qty)
+	if err != nil {
+		return req, &fix.FieldError{Tag: fix.TagOrderQty}
+	}
+	req.Size = size
+	switch ordType, _ := msg.Get(fix.TagOrdType); ordType {
+	case "1":
+		req.Type = exchange.MarketOrder
+	case "2":
+		req.Type = exchange.LimitOrder
+	case "3":
+		req.Type = exchange.StopMarketOrder
+	default:
+		return req, &fix.FieldError{Tag: fix.TagOrdType, Missing: ordType == ""}
+	}
+
+	prices := []struct {
+		tag fix.Tag
+		v   *orderbook.Price
+	}{
+		{fix.TagPrice, &req.Price},
+		{fix.TagStopPx, &req.StopPrice},
+	}
+	for _, f := range prices {
+		v, ok := msg.Get(f.tag)
+		if !ok {
+			continue
+		}
+		price, err := scale.ParsePrice(v)
+		if err != nil {
+			return req, &fix.FieldError{Tag: f.tag}
+		}
+		*f.v = price
+	}
+	if v, ok := msg.Get(fix.TagMaxFloor); ok {
+		if req.DisplaySize, err = scale.ParseSize(v); err != nil {
+			return req, &fix.FieldError{Tag: fix.TagMaxFloor}
+		}
+	}
+
+	switch tif, _ := msg.Get(fix.TagTimeInForce); tif {
+	case "":
+	case "1":
+		req.TimeInForce = orderbook.GoodTillCancel
+	case "3":
+		req.TimeInForce = orderbook.ImmediateOrCancel
+	case "4":
+		req.TimeInForce = orderbook.FillOrKill
+	case "6":
+		req.TimeInForce = orderbook.GoodTillDate
+		v, ok := msg.Get(fix.TagExpireTime)
+		if !ok {
+			return req, &fix.FieldError{Tag: fix.TagExpireTime, Missing: true}
+		}
+		expires, err := time.Parse(fix.TimestampFormat, v)
+		if err != nil {
+			// seconds are allowed to leave off the milliseconds
+			if expires, err = time.Parse("20060102-15:04:05", v); err != nil {
+				return req, &fix.FieldError{Tag: fix.TagExpireTime}
+			}
+		}
+		req.ExpiresAt = expires.UnixNano()
+	default:
+		// Day and the other FIX times in force aren't offered
+		return req, &fix.FieldError{Tag: fix.TagTimeInForce}
+	}
+	return req, nil
+}
+
+// fixOrdRejReasons are the OrdRejReasons of the rejection codes FIX has one
+// for; the rest are Other.
+var fixOrdRejReasons = map[string]string{
+	"MARKET_NOT_FOUND":          "1",
+	"MAX_ORDER_SIZE":            "3",
+	"MAX_NOTIONAL":              "3",
+	"MAX_OPEN_ORDERS":           "3",
+	"MAX_SIDE_ORDERS":           "3",
+	"MAX_PRICE_LEVELS":          "3",
+	"DUPLICATE_CLIENT_ORDER_ID": "6",
+	"PRICE_OUT_OF_BAND":         "8",
+}
+
+// reject reports msg's order refused with err.
+func (h *fixSession) reject(msg *fix.Message, req exchange.PlaceOrderRequest, err error) {
+	code := "OTHER"
+	var rejection *exchange.Rejection
+	if errors.As(err, &rejection) {
+		code = rejection.Code
+	} else if errors.Is(err, exchange.ErrMarketNotFound) {
+		code = "MARKET_NOT_FOUND"
+	}
+	reason, ok := fixOrdRejReasons[code]
+	if !ok {
+		reason = "99"
+	}
+
+	fixRejects.Lock()
+	fixRejects.n++
+	execID := fmt.Sprintf("REJ-%d", fixRejects.n)
+	fixRejects.Unlock()
+
+	side, _ := msg.Get(fix.TagSide)
+	qty, _ := msg.Get(fix.TagOrderQty)
+	report := fix.NewMessage(fix.MsgExecutionReport).
+		Set(fix.TagOrderID, "NONE").
+		Set(fix.TagClOrdID, req.ClientOrderID).
+		Set(fix.TagExecID, execID).
+		Set(fix.TagExecType, "8").
+		Set(fix.TagOrdStatus, "8").
+		Set(fix.TagSymbol, string(req.Market)).
+		Set(fix.TagSide, side).
+		Set(fix.TagOrderQty, qty).
+		Set(fix.TagLeavesQty, "0").
+		Set(fix.TagCumQty, "0").
+		Set(fix.TagAvgPx, "0").
+		Set(fix.TagOrdRejReason, reason).
+		Set(fix.TagText, fmt.Sprintf("%s: %s", code, err)).
+		SetTime(fix.TagTransactTime, time.Now())
+	h.sess.Send(report)
+}
+
+// cancel cancels the order an OrderCancelRequest names, by OrderID if it
+// gives one and OrigClOrdID otherwise. The cancellation is reported from
+// the order's update, a refusal with an OrderCancelReject.
+func (h *fixSession) cancel(msg *fix.Message) {
+	clOrdID, ok := msg.Get(fix.TagClOrdID)
+	if !ok {
+		h.sess.RejectField(msg, &fix.FieldError{Tag: fix.TagClOrdID, Missing: true})
+		return
+	}
+	origClOrdID, _ := msg.Get(fix.TagOrigClOrdID)
+	var id uint64
+	if v, ok := msg.Get(fix.TagOrderID); ok {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			h.cancelReject(msg, "", "1", "unknown order")
+			return
+		}
+		id = parsed
+	} else if origClOrdID != "" {
+		order, err := h.s.ex.OrderByClientID(h.user, origClOrdID)
+		if err != nil {
+			h.cancelReject(msg, "", "1", err.Error())
+			return
+		}
+		id = order.ID
+	} else {
+		h.sess.RejectField(msg, &fix.FieldError{Tag: fix.TagOrigClOrdID, Missing: true})
+		return
+	}
+
+	h.mu.Lock()
+	h.cancels[id] = clOrdID
+	h.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), fixRequestTimeout)
+	defer cancel()
+	if _, err := h.s.ex.CancelOrder(ctx, h.user, id); err != nil {
+		h.mu.Lock()
+		delete(h.cancels, id)
+		h.mu.Unlock()
+		reason := "99"
+		var rejection *exchange.Rejection
+		if errors.As(err, &rejection) && rejection.Code == "ORDER_NOT_FOUND" {
+			reason = "1"
+		}
+		h.cancelReject(msg, strconv.FormatUint(id, 10), reason, err.Error())
+	}
+}
+
+// cancelReject refuses an OrderCancelRequest for the order with orderID.
+func (h *fixSession) cancelReject(msg *fix.Message, orderID, reason, text string) {
+	if orderID == "" {
+		orderID = "NONE"
+	}
+	// the order's status as this session knows it, rejected if it doesn't
+	status := "8"
+	if id, err := strconv.ParseUint(orderID, 10, 64); err == nil {
+		h.mu.Lock()
+		if o, ok := h.orders[id]; ok {
+			status = "0"
+			if o.filled > 0 {
+				status = "1"
+			}
+		}
+		h.mu.Unlock()
+	}
+	clOrdID, _ := msg.Get(fix.TagClOrdID)
+	origClOrdID, _ := msg.Get(fix.TagOrigClOrdID)
+	h.sess.Send(fix.NewMessage(fix.MsgOrderCancelReject).
+		Set(fix.TagOrderID, orderID).
+		Set(fix.TagClOrdID, clOrdID).
+		Set(fix.TagOrigClOrdID, origClOrdID).
+		Set(fix.TagOrdStatus, status).
+		Set(fix.TagCxlRejResponseTo, "1").
+		Set(fix.TagCxlRejReason, reason).
+		Set(fix.TagText, text))
+}
+
+// report sends an execution report for each of the user's order updates
+// until the session ends, or logs it out once it falls behind them.
+func (h *fixSession) report(updates <-chan []exchange.OrderUpdate) {
+	for batch := range updates {
+		for _, u := range batch {
+			h.sess.Send(h.executionReport(u))
+		}
+	}
+	h.sess.Logout("fell behind the order updates")
+}
+
+// executionReport is the ExecutionReport for u, keeping the order's
+// running totals.
+func (h *fixSession) executionReport(u exchange.OrderUpdate) *fix.Message {
+	h.mu.Lock()
+	o, ok := h.orders[u.OrderID]
+	if !ok {
+		// accepted, or placed before the session and only known from here
+		// on
+		o = &fixOrder{size: u.Remaining}
+		h.orders[u.OrderID] = o
+	}
+	clOrdID := u.ClientOrderID
+	var origClOrdID string
+	var execType, status string
+	switch u.Type {
+	case exchange.OrderUpdateAccepted:
+		execType, status = "0", "0"
+	case exchange.OrderUpdateAmended:
+		execType, status = "5", "0"
+		o.size = o.filled + u.Remaining
+	case exchange.OrderUpdatePartialFill, exchange.OrderUpdateFill:
+		execType, status = "F", "1"
+		o.filled += u.FillSize
+		o.notional += float64(u.FillPrice) * float64(u.FillSize)
+		if u.Type == exchange.OrderUpdateFill {
+			status = "2"
+		}
+	case exchange.OrderUpdateCancelled:
+		execType, status = "4", "4"
+		if cancelClOrdID, ok := h.cancels[u.OrderID]; ok {
+			clOrdID, origClOrdID = cancelClOrdID, u.ClientOrderID
+			delete(h.cancels, u.OrderID)
+		}
+	}
+	if execType == "5" && o.filled > 0 {
+		status = "1"
+	}
+	size, filled, notional := o.size, o.filled, o.notional
+	if status == "2" || status == "4" {
+		delete(h.orders, u.OrderID)
+	}
+	h.mu.Unlock()
+
+	if clOrdID == "" {
+		clOrdID = "NONE"
+	}
+	side := "2"
+	if u.Bid {
+		side = "1"
+	}
+	// a market's scale is already known once it has an order
+	scale, _ := h.s.scale(u.Market)
+	var avgPx orderbook.Price
+	if filled > 0 {
+		avgPx = orderbook.Price(math.Round(notional / float64(filled)))
+	}
+	report := fix.NewMessage(fix.MsgExecutionReport).
+		Set(fix.TagOrderID, strconv.FormatUint(u.OrderID, 10)).
+		Set(fix.TagClOrdID, clOrdID)
+	if origClOrdID != "" {
+		report.Set(fix.TagOrigClOrdID, origClOrdID)
+	}
+	// an order has one update of each type per operation, bar fills, each
+	// of which is its own trade
+	report.Set(fix.TagExecID, fmt.Sprintf("%s-%d-%d-%s%d", u.Market, u.Seq, u.OrderID, execType, u.TradeID)).
+		Set(fix.TagExecType, execType).
+		Set(fix.TagOrdStatus, status).
+		Set(fix.TagSymbol, string(u.Market)).
+		Set(fix.TagSide, side).
+		Set(fix.TagOrderQty, scale.SizeString(size))
+	if u.Price > 0 {
+		report.Set(fix.TagPrice, scale.PriceString(u.Price))
+	}
+	if execType == "F" {
+		report.Set(fix.TagLastQty, scale.SizeString(u.FillSize)).Set(fix.TagLastPx, scale.PriceString(u.FillPrice))
+	}
+	leaves := u.Remaining
+	if status == "4" {
+		leaves = 0
+	}
+	return report.Set(fix.TagLeavesQty, scale.SizeString(leaves)).
+		Set(fix.TagCumQty, scale.SizeString(filled)).
+		Set(fix.TagAvgPx, scale.PriceString(avgPx)).
+		SetTime(fix.TagTransactTime, time.Unix(0, u.Timestamp))
+}
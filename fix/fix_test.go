@@ -0,0 +1,192 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := NewMessage(MsgNewOrderSingle).Set(TagClOrdID, "a-1").SetFloat(TagOrderQty, 0.25).Set(TagSymbol, "ETH")
+	wire := msg.Bytes()
+	if want := "8=FIX.4.4\x019=27\x0135=D\x0111=a-1\x0138=0.25\x0155=ETH\x0110=065\x01"; string(wire) != want {
+		t.Fatalf("expected %q, got %q", want, wire)
+	}
+
+	got, err := ReadMessage(bufio.NewReader(bytes.NewReader(wire)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != msg.String() {
+		t.Fatalf("expected %s, got %s", msg, got)
+	}
+	if qty, err := got.Float(TagOrderQty); err != nil || qty != 0.25 {
+		t.Fatalf("expected OrderQty 0.25, got %v %v", qty, err)
+	}
+	if _, err := got.Int(TagPrice); err == nil || !err.(*FieldError).Missing {
+		t.Fatalf("expected Price to be missing, got %v", err)
+	}
+
+	// a bad checksum skips the message, which still has to be framed
+	bad := bytes.Replace(wire, []byte("10=065"), []byte("10=066"), 1)
+	r := bufio.NewReader(bytes.NewReader(append(bad, wire...)))
+	if _, err := ReadMessage(r); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("expected a bad checksum, got %v", err)
+	}
+	if _, err := ReadMessage(r); err != nil {
+		t.Fatalf("expected the next message to read, got %v", err)
+	}
+
+	for _, garbled := range []string{
+		"8=FIX.4.2\x019=5\x0135=0\x0110=000\x01",
+		"9=5\x0135=0\x01",
+		"8=FIX.4.4\x019=x\x01",
+		"8=FIX.4.4\x019=999999999\x01",
+	} {
+		if _, err := ReadMessage(bufio.NewReader(bytes.NewReader([]byte(garbled)))); !errors.Is(err, ErrGarbled) {
+			t.Fatalf("expected %q to be garbled, got %v", garbled, err)
+		}
+	}
+}
+
+// testApp takes logons with the password "secret" and hands on what its
+// sessions get.
+type testApp struct {
+	msgs    chan *Message
+	logouts chan struct{}
+}
+
+func (a *testApp) Logon(s *Session, logon *Message) (Handler, error) {
+	if password, _ := logon.Get(TagPassword); password != "secret" {
+		return nil, errors.New("unauthorized")
+	}
+	return testHandler{a}, nil
+}
+
+type testHandler struct{ a *testApp }
+
+func (h testHandler) FromApp(msg *Message) { h.a.msgs <- msg }
+func (h testHandler) Logout()              { h.a.logouts <- struct{}{} }
+
+// testClient is the counterparty's end of a session.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn), seq: 1}
+}
+
+func (c *testClient) send(msg *Message) {
+	c.t.Helper()
+	fields := []Field{
+		{TagMsgType, msg.Type()},
+		{TagSenderCompID, "CLIENT"},
+		{TagTargetCompID, DefaultCompID},
+		{TagMsgSeqNum, strconv.Itoa(c.seq)},
+		{TagSendingTime, "20231114-22:13:20.000"},
+	}
+	out := &Message{Fields: append(fields, msg.Fields[1:]...)}
+	if _, err := c.conn.Write(out.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	c.seq++
+}
+
+func (c *testClient) expect(msgType string, fields ...Field) *Message {
+	c.t.Helper()
+	msg, err := ReadMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if msg.Type() != msgType {
+		c.t.Fatalf("expected message type %s, got %s", msgType, msg)
+	}
+	for _, f := range fields {
+		if v, _ := msg.Get(f.Tag); v != f.Value {
+			c.t.Fatalf("expected %d=%s, got %s", f.Tag, f.Value, msg)
+		}
+	}
+	return msg
+}
+
+func (c *testClient) logon(password string) {
+	c.t.Helper()
+	c.send(NewMessage(MsgLogon).Set(TagEncryptMethod, "0").Set(TagHeartBtInt, "30").Set(TagPassword, password))
+}
+
+func TestSession(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	a := NewAcceptor(AcceptorConfig{Clock: clk})
+	app := &testApp{msgs: make(chan *Message, 1), logouts: make(chan struct{}, 1)}
+	a.Register(app)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Serve(lis)
+	defer a.Close()
+
+	refused := dial(t, lis.Addr().String())
+	refused.logon("wrong")
+	refused.expect(MsgLogout, Field{TagText, "unauthorized"}, Field{TagTargetCompID, "CLIENT"})
+
+	c := dial(t, lis.Addr().String())
+	c.logon("secret")
+	c.expect(MsgLogon, Field{TagMsgSeqNum, "1"}, Field{TagHeartBtInt, "30"}, Field{TagResetSeqNumFlag, "Y"}, Field{TagSendingTime, "20231114-22:13:20.000"})
+
+	c.send(NewMessage(MsgTestRequest).Set(TagTestReqID, "ping"))
+	c.expect(MsgHeartbeat, Field{TagMsgSeqNum, "2"}, Field{TagTestReqID, "ping"})
+
+	order := NewMessage(MsgNewOrderSingle).Set(TagClOrdID, "a-1")
+	c.send(order)
+	if got := <-app.msgs; got.Type() != MsgNewOrderSingle {
+		t.Fatalf("expected the order to reach the application, got %s", got)
+	}
+
+	// nothing sent is kept, so a resend request is gapped over
+	c.send(NewMessage(MsgResendRequest).Set(TagBeginSeqNo, "1").Set(TagEndSeqNo, "0"))
+	c.expect(MsgSequenceReset, Field{TagMsgSeqNum, "1"}, Field{TagPossDupFlag, "Y"}, Field{TagGapFillFlag, "Y"}, Field{TagNewSeqNo, "3"})
+
+	// a quiet counterparty is tested, then logged out; until then the
+	// session's traffic has kept it alive
+	clk.Advance(30 * time.Second)
+	clk.Advance(30 * time.Second)
+	c.expect(MsgTestRequest, Field{TagMsgSeqNum, "3"})
+	clk.Advance(30 * time.Second)
+	c.expect(MsgLogout, Field{TagText, "test request not answered"})
+	<-app.logouts
+
+	// a gap in the counterparty's numbers ends the session
+	gap := dial(t, lis.Addr().String())
+	gap.logon("secret")
+	gap.expect(MsgLogon)
+	gap.seq++
+	gap.send(NewMessage(MsgHeartbeat))
+	gap.expect(MsgLogout, Field{TagText, "MsgSeqNum too high, expecting 2 but received 3"})
+	<-app.logouts
+
+	// closing the acceptor logs sessions out
+	last := dial(t, lis.Addr().String())
+	last.logon("secret")
+	last.expect(MsgLogon)
+	a.Close()
+	last.expect(MsgLogout, Field{TagText, "exchange shutting down"})
+	<-app.logouts
+}
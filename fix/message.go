@@ -0,0 +1,323 @@
+// Package fix accepts FIX 4.4 sessions: it frames and checks tag=value
+// messages, logs counterparties on and off, keeps sequence numbers and
+// heartbeats, and hands application messages to an Application.
+//
+// Sessions aren't persisted. Every logon starts both sides' sequence
+// numbers afresh, and the acceptor answers a resend request by gapping over
+// what it sent: orders are reported again from the exchange's state, not
+// replayed from the session.
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// BeginString is the only protocol version spoken.
+const BeginString = "FIX.4.4"
+
+// Tag is a field's tag number.
+type Tag int
+
+// The tags the session layer and order entry use.
+const (
+	TagAvgPx                Tag = 6
+	TagBeginSeqNo           Tag = 7
+	TagBeginString          Tag = 8
+	TagBodyLength           Tag = 9
+	TagCheckSum             Tag = 10
+	TagClOrdID              Tag = 11
+	TagCumQty               Tag = 14
+	TagEndSeqNo             Tag = 16
+	TagExecID               Tag = 17
+	TagLastPx               Tag = 31
+	TagLastQty              Tag = 32
+	TagMsgSeqNum            Tag = 34
+	TagMsgType              Tag = 35
+	TagNewSeqNo             Tag = 36
+	TagOrderID              Tag = 37
+	TagOrderQty             Tag = 38
+	TagOrdStatus            Tag = 39
+	TagOrdType              Tag = 40
+	TagOrigClOrdID          Tag = 41
+	TagPossDupFlag          Tag = 43
+	TagPrice                Tag = 44
+	TagRefSeqNum            Tag = 45
+	TagSenderCompID         Tag = 49
+	TagSendingTime          Tag = 52
+	TagSide                 Tag = 54
+	TagSymbol               Tag = 55
+	TagTargetCompID         Tag = 56
+	TagText                 Tag = 58
+	TagTimeInForce          Tag = 59
+	TagTransactTime         Tag = 60
+	TagEncryptMethod        Tag = 98
+	TagStopPx               Tag = 99
+	TagCxlRejReason         Tag = 102
+	TagOrdRejReason         Tag = 103
+	TagHeartBtInt           Tag = 108
+	TagMaxFloor             Tag = 111
+	TagTestReqID            Tag = 112
+	TagGapFillFlag          Tag = 123
+	TagExpireTime           Tag = 126
+	TagResetSeqNumFlag      Tag = 141
+	TagExecType             Tag = 150
+	TagLeavesQty            Tag = 151
+	TagRefTagID             Tag = 371
+	TagRefMsgType           Tag = 372
+	TagSessionRejectReason  Tag = 373
+	TagBusinessRejectReason Tag = 380
+	TagCxlRejResponseTo     Tag = 434
+	TagUsername             Tag = 553
+	TagPassword             Tag = 554
+)
+
+// The message types the session layer and order entry use.
+const (
+	MsgHeartbeat             = "0"
+	MsgTestRequest           = "1"
+	MsgResendRequest         = "2"
+	MsgReject                = "3"
+	MsgSequenceReset         = "4"
+	MsgLogout                = "5"
+	MsgExecutionReport       = "8"
+	MsgOrderCancelReject     = "9"
+	MsgLogon                 = "A"
+	MsgNewOrderSingle        = "D"
+	MsgOrderCancelRequest    = "F"
+	MsgBusinessMessageReject = "j"
+)
+
+// TimestampFormat is FIX's UTCTimestamp, to the millisecond.
+const TimestampFormat = "20060102-15:04:05.000"
+
+// maxBodyLength bounds a message's body, so a bad length can't make the
+// reader allocate without limit.
+const maxBodyLength = 64 << 10
+
+// Field is one tag=value pair.
+type Field struct {
+	Tag   Tag
+	Value string
+}
+
+// Message is a FIX message's fields in order, from MsgType on: the
+// BeginString, BodyLength and CheckSum framing it are added and checked by
+// the session.
+type Message struct {
+	Fields []Field
+}
+
+// NewMessage starts a message of type msgType. The session fills in the
+// rest of the header when it is sent.
+func NewMessage(msgType string) *Message {
+	return &Message{Fields: []Field{{TagMsgType, msgType}}}
+}
+
+// Type is the message's MsgType.
+func (m *Message) Type() string {
+	v, _ := m.Get(TagMsgType)
+	return v
+}
+
+// Get returns the value of the first field with tag.
+func (m *Message) Get(tag Tag) (string, bool) {
+	for _, f := range m.Fields {
+		if f.Tag == tag {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Int returns the value of the field with tag as an integer.
+func (m *Message) Int(tag Tag) (int, error) {
+	v, ok := m.Get(tag)
+	if !ok {
+		return 0, &FieldError{Tag: tag, Missing: true}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, &FieldError{Tag: tag}
+	}
+	return n, nil
+}
+
+// Float returns the value of the field with tag as a number.
+func (m *Message) Float(tag Tag) (float64, error) {
+	v, ok := m.Get(tag)
+	if !ok {
+		return 0, &FieldError{Tag: tag, Missing: true}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, &FieldError{Tag: tag}
+	}
+	return f, nil
+}
+
+// Set sets the field with tag to value, adding it at the end if the message
+// hasn't one.
+func (m *Message) Set(tag Tag, value string) *Message {
+	for i, f := range m.Fields {
+		if f.Tag == tag {
+			m.Fields[i].Value = value
+			return m
+		}
+	}
+	m.Fields = append(m.Fields, Field{tag, value})
+	return m
+}
+
+// SetFloat sets the field with tag to v, in as few digits as it takes.
+func (m *Message) SetFloat(tag Tag, v float64) *Message {
+	return m.Set(tag, strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// SetTime sets the field with tag to t as a UTCTimestamp.
+func (m *Message) SetTime(tag Tag, t time.Time) *Message {
+	return m.Set(tag, t.UTC().Format(TimestampFormat))
+}
+
+func (m *Message) String() string {
+	var b bytes.Buffer
+	for _, f := range m.Fields {
+		fmt.Fprintf(&b, "%d=%s|", f.Tag, f.Value)
+	}
+	return b.String()
+}
+
+// FieldError is a field a message lacks, or has with a value that doesn't
+// parse.
+type FieldError struct {
+	Tag     Tag
+	Missing bool
+}
+
+func (e *FieldError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("required tag %d missing", e.Tag)
+	}
+	return fmt.Sprintf("incorrect value for tag %d", e.Tag)
+}
+
+// Reasons for rejecting a message outright, in SessionRejectReason.
+const (
+	RejectRequiredTagMissing = 1
+	RejectIncorrectValue     = 5
+	RejectCompIDProblem      = 9
+)
+
+// rejectReason is the SessionRejectReason for err.
+func rejectReason(err *FieldError) int {
+	if err.Missing {
+		return RejectRequiredTagMissing
+	}
+	return RejectIncorrectValue
+}
+
+// Bytes frames m for the wire.
+func (m *Message) Bytes() []byte {
+	var body bytes.Buffer
+	for _, f := range m.Fields {
+		body.WriteString(strconv.Itoa(int(f.Tag)))
+		body.WriteByte('=')
+		body.WriteString(f.Value)
+		body.WriteByte(soh)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "8=%s\x019=%d\x01", BeginString, body.Len())
+	b.Write(body.Bytes())
+	fmt.Fprintf(&b, "10=%03d\x01", checksum(b.Bytes()))
+	return b.Bytes()
+}
+
+const soh = '\x01'
+
+func checksum(b []byte) int {
+	var sum int
+	for _, c := range b {
+		sum += int(c)
+	}
+	return sum % 256
+}
+
+var (
+	// ErrGarbled is a message that can't be framed, after which the stream
+	// can't be trusted.
+	ErrGarbled = errors.New("fix: garbled message")
+	// ErrBadChecksum is a framed message whose checksum doesn't match. It
+	// is ignored, as the spec says, and reading goes on after it.
+	ErrBadChecksum = errors.New("fix: bad checksum")
+)
+
+// ReadMessage reads the next message from r: its fields after the framing,
+// which it checks.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	begin, err := readField(r, TagBeginString)
+	if err != nil {
+		return nil, err
+	}
+	if begin != BeginString {
+		return nil, fmt.Errorf("%w: BeginString %q", ErrGarbled, begin)
+	}
+	length, err := readField(r, TagBodyLength)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n <= 0 || n > maxBodyLength {
+		return nil, fmt.Errorf("%w: BodyLength %q", ErrGarbled, length)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	sum, err := readField(r, TagCheckSum)
+	if err != nil {
+		return nil, err
+	}
+
+	head := fmt.Sprintf("8=%s\x019=%s\x01", begin, length)
+	want := (checksum([]byte(head)) + checksum(body)) % 256
+	if got, err := strconv.Atoi(sum); err != nil || got != want {
+		return nil, ErrBadChecksum
+	}
+	if body[len(body)-1] != soh {
+		return nil, fmt.Errorf("%w: body not delimited", ErrGarbled)
+	}
+
+	m := &Message{}
+	for _, field := range bytes.Split(body[:len(body)-1], []byte{soh}) {
+		tag, value, ok := bytes.Cut(field, []byte{'='})
+		t, err := strconv.Atoi(string(tag))
+		if !ok || err != nil || t <= 0 {
+			return nil, fmt.Errorf("%w: field %q", ErrGarbled, field)
+		}
+		m.Fields = append(m.Fields, Field{Tag(t), string(value)})
+	}
+	return m, nil
+}
+
+// readField reads one framing field, which must have tag.
+func readField(r *bufio.Reader, tag Tag) (string, error) {
+	// framing fields are short: anything that fills the buffer is garbage
+	line, err := r.ReadSlice(soh)
+	field := string(line)
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return "", ErrGarbled
+		}
+		return "", err
+	}
+	prefix := strconv.Itoa(int(tag)) + "="
+	if len(field) < len(prefix)+1 || field[:len(prefix)] != prefix {
+		return "", fmt.Errorf("%w: expected tag %d, got %q", ErrGarbled, tag, field)
+	}
+	return field[len(prefix) : len(field)-1], nil
+}
@@ -0,0 +1,499 @@
+package fix
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+const (
+	// DefaultCompID is the acceptor's CompID when AcceptorConfig.CompID is
+	// unset.
+	DefaultCompID = "EXCHANGE"
+	// logonTimeout is how long a connection has to log on.
+	logonTimeout = 10 * time.Second
+	// writeTimeout is how long a write may block before the counterparty is
+	// given up on.
+	writeTimeout = 10 * time.Second
+)
+
+// Application is what the sessions are for: it decides who may log on and
+// handles their application messages.
+type Application interface {
+	// Logon authenticates the Logon opening s and returns the Handler for
+	// the rest of the session. An error refuses the logon, its text going
+	// back in the Logout.
+	Logon(s *Session, logon *Message) (Handler, error)
+}
+
+// Handler handles one logged on session's application messages.
+type Handler interface {
+	// FromApp handles an application message. Messages are handled one at
+	// a time, in sequence.
+	FromApp(msg *Message)
+	// Logout is called once the session has ended, however it did.
+	Logout()
+}
+
+// AcceptorConfig sets up an Acceptor.
+type AcceptorConfig struct {
+	// CompID is the acceptor's SenderCompID, which counterparties must
+	// target. It defaults to DefaultCompID.
+	CompID string
+	// Clock stamps messages and paces heartbeats. It defaults to the
+	// system clock.
+	Clock clock.Clock
+}
+
+// Acceptor accepts FIX sessions on the listeners it serves.
+type Acceptor struct {
+	compID string
+	clock  clock.Clock
+
+	mu        sync.Mutex
+	app       Application
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewAcceptor returns an acceptor set up by cfg. Register an Application
+// before serving.
+func NewAcceptor(cfg AcceptorConfig) *Acceptor {
+	if cfg.CompID == "" {
+		cfg.CompID = DefaultCompID
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	return &Acceptor{
+		compID:    cfg.CompID,
+		clock:     cfg.Clock,
+		listeners: make(map[net.Listener]struct{}),
+		sessions:  make(map[*Session]struct{}),
+	}
+}
+
+// Register sets the Application sessions log on to. It must be called
+// before Serve.
+func (a *Acceptor) Register(app Application) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.app = app
+}
+
+// ErrAcceptorClosed is returned by Serve once the acceptor is closed.
+var ErrAcceptorClosed = errors.New("fix: acceptor closed")
+
+// Serve accepts sessions on lis until the acceptor is closed.
+func (a *Acceptor) Serve(lis net.Listener) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		lis.Close()
+		return ErrAcceptorClosed
+	}
+	a.listeners[lis] = struct{}{}
+	a.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			a.mu.Lock()
+			closed := a.closed
+			delete(a.listeners, lis)
+			a.mu.Unlock()
+			if closed {
+				return ErrAcceptorClosed
+			}
+			return err
+		}
+		s := &Session{a: a, conn: conn, r: bufio.NewReader(conn), outSeq: 1, loggedOn: make(chan struct{}), done: make(chan struct{})}
+		a.mu.Lock()
+		if a.closed {
+			a.mu.Unlock()
+			conn.Close()
+			return ErrAcceptorClosed
+		}
+		a.sessions[s] = struct{}{}
+		a.wg.Add(1)
+		a.mu.Unlock()
+		go s.run()
+	}
+}
+
+// Close stops accepting sessions, logs out the ones open and waits for them
+// to end.
+func (a *Acceptor) Close() error {
+	a.mu.Lock()
+	a.closed = true
+	for lis := range a.listeners {
+		lis.Close()
+	}
+	sessions := make([]*Session, 0, len(a.sessions))
+	for s := range a.sessions {
+		sessions = append(sessions, s)
+	}
+	a.mu.Unlock()
+
+	for _, s := range sessions {
+		s.Logout("exchange shutting down")
+	}
+	a.wg.Wait()
+	return nil
+}
+
+// Session is one counterparty's connection.
+type Session struct {
+	a    *Acceptor
+	conn net.Conn
+	r    *bufio.Reader
+	// counterparty is the SenderCompID the counterparty logged on with
+	counterparty string
+	heartbeat    time.Duration
+	// inSeq is the MsgSeqNum expected next; only the reader touches it
+	inSeq int
+
+	// mu guards writes, so messages go out whole and in sequence
+	mu     sync.Mutex
+	outSeq int
+	// sent and received note traffic since the last heartbeat check, and
+	// testReq the TestRequest it is waiting on an answer to
+	sent, received bool
+	testReq        string
+
+	// loggedOn is closed once the Logon is answered, before which nothing
+	// else goes out
+	loggedOn  chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// CompID is the SenderCompID the counterparty logged on with.
+func (s *Session) CompID() string {
+	return s.counterparty
+}
+
+// Send sends msg, filling in its header, once the session has logged on.
+// It fails once the session has ended.
+func (s *Session) Send(msg *Message) error {
+	select {
+	case <-s.loggedOn:
+	case <-s.done:
+		return net.ErrClosed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.send(msg)
+}
+
+// send is Send with s.mu held.
+func (s *Session) send(msg *Message) error {
+	select {
+	case <-s.done:
+		return net.ErrClosed
+	default:
+	}
+	out := &Message{Fields: make([]Field, 0, len(msg.Fields)+4)}
+	out.Fields = append(out.Fields,
+		Field{TagMsgType, msg.Type()},
+		Field{TagSenderCompID, s.a.compID},
+		Field{TagTargetCompID, s.counterparty},
+		Field{TagMsgSeqNum, strconv.Itoa(s.outSeq)},
+		Field{TagSendingTime, s.a.clock.Now().UTC().Format(TimestampFormat)},
+	)
+	for _, f := range msg.Fields {
+		switch f.Tag {
+		case TagMsgType, TagSenderCompID, TagTargetCompID, TagMsgSeqNum, TagSendingTime:
+		default:
+			out.Fields = append(out.Fields, f)
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := s.conn.Write(out.Bytes()); err != nil {
+		s.close()
+		return err
+	}
+	s.outSeq++
+	s.sent = true
+	return nil
+}
+
+// Reject refuses msg at the session level, for a problem with tag.
+func (s *Session) Reject(msg *Message, tag Tag, reason int, text string) error {
+	reject := NewMessage(MsgReject)
+	if seq, ok := msg.Get(TagMsgSeqNum); ok {
+		reject.Set(TagRefSeqNum, seq)
+	}
+	if tag != 0 {
+		reject.Set(TagRefTagID, strconv.Itoa(int(tag)))
+	}
+	reject.Set(TagRefMsgType, msg.Type())
+	reject.Set(TagSessionRejectReason, strconv.Itoa(reason))
+	if text != "" {
+		reject.Set(TagText, text)
+	}
+	return s.Send(reject)
+}
+
+// RejectField is Reject for a field msg lacks or can't parse.
+func (s *Session) RejectField(msg *Message, err *FieldError) error {
+	return s.Reject(msg, err.Tag, rejectReason(err), err.Error())
+}
+
+// Logout ends the session, telling the counterparty why.
+func (s *Session) Logout(text string) {
+	logout := NewMessage(MsgLogout)
+	if text != "" {
+		logout.Set(TagText, text)
+	}
+	s.mu.Lock()
+	// a session refused or cut off before it logged on is told too, if it
+	// said who it is
+	if s.counterparty != "" {
+		s.send(logout)
+	}
+	s.mu.Unlock()
+	s.close()
+}
+
+func (s *Session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// run logs the counterparty on and serves the session until it ends.
+func (s *Session) run() {
+	defer s.a.wg.Done()
+	defer func() {
+		s.close()
+		s.a.mu.Lock()
+		delete(s.a.sessions, s)
+		s.a.mu.Unlock()
+	}()
+
+	handler, ok := s.logon()
+	if !ok {
+		return
+	}
+	slog.Info("fix session logged on", "compId", s.counterparty)
+	defer func() {
+		handler.Logout()
+		slog.Info("fix session logged out", "compId", s.counterparty)
+	}()
+
+	for {
+		msg, err := ReadMessage(s.r)
+		if errors.Is(err, ErrBadChecksum) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, ErrGarbled) {
+				s.Logout(err.Error())
+			}
+			return
+		}
+		s.mu.Lock()
+		s.received = true
+		s.mu.Unlock()
+		if !s.sequence(msg) {
+			return
+		}
+		switch msg.Type() {
+		case MsgHeartbeat:
+			s.mu.Lock()
+			if id, _ := msg.Get(TagTestReqID); id == s.testReq {
+				s.testReq = ""
+			}
+			s.mu.Unlock()
+		case MsgTestRequest:
+			heartbeat := NewMessage(MsgHeartbeat)
+			if id, ok := msg.Get(TagTestReqID); ok {
+				heartbeat.Set(TagTestReqID, id)
+			}
+			s.Send(heartbeat)
+		case MsgResendRequest:
+			s.gapFill(msg)
+		case MsgReject, MsgSequenceReset:
+		case MsgLogout:
+			s.Logout("")
+			return
+		case MsgLogon:
+			s.Reject(msg, TagMsgType, RejectIncorrectValue, "already logged on")
+		default:
+			handler.FromApp(msg)
+		}
+	}
+}
+
+// logon reads the Logon opening the session and asks the application to
+// accept it.
+func (s *Session) logon() (Handler, bool) {
+	s.conn.SetReadDeadline(time.Now().Add(logonTimeout))
+	msg, err := ReadMessage(s.r)
+	if err != nil || msg.Type() != MsgLogon {
+		return nil, false
+	}
+	s.conn.SetReadDeadline(time.Time{})
+
+	// answers, refusals included, go to whoever sent the logon
+	s.mu.Lock()
+	s.counterparty, _ = msg.Get(TagSenderCompID)
+	s.mu.Unlock()
+	if s.counterparty == "" {
+		s.close()
+		return nil, false
+	}
+	if target, _ := msg.Get(TagTargetCompID); target != s.a.compID {
+		s.Logout(fmt.Sprintf("TargetCompID must be %s", s.a.compID))
+		return nil, false
+	}
+	seq, err := msg.Int(TagMsgSeqNum)
+	if err != nil {
+		s.Logout(err.Error())
+		return nil, false
+	}
+	heartbeat, err := msg.Int(TagHeartBtInt)
+	if err != nil || heartbeat < 0 {
+		s.Logout(fmt.Sprintf("incorrect value for tag %d", TagHeartBtInt))
+		return nil, false
+	}
+	s.inSeq = seq + 1
+	s.heartbeat = time.Duration(heartbeat) * time.Second
+
+	s.a.mu.Lock()
+	app := s.a.app
+	s.a.mu.Unlock()
+	if app == nil {
+		s.Logout("not accepting logons")
+		return nil, false
+	}
+	handler, err := app.Logon(s, msg)
+	if err != nil {
+		s.Logout(err.Error())
+		return nil, false
+	}
+
+	reply := NewMessage(MsgLogon).
+		Set(TagEncryptMethod, "0").
+		Set(TagHeartBtInt, strconv.Itoa(heartbeat)).
+		Set(TagResetSeqNumFlag, "Y")
+	s.mu.Lock()
+	err = s.send(reply)
+	s.mu.Unlock()
+	if err != nil {
+		handler.Logout()
+		return nil, false
+	}
+	close(s.loggedOn)
+	if s.heartbeat > 0 {
+		s.monitor()
+	}
+	return handler, true
+}
+
+// sequence checks msg's MsgSeqNum is the next one, reporting whether the
+// session can go on. Nothing is kept to recover from a gap with, so one
+// ends the session, as does a number already seen unless the message is a
+// possible duplicate, which is dropped. A sequence reset moves the expected
+// number on.
+func (s *Session) sequence(msg *Message) bool {
+	seq, err := msg.Int(TagMsgSeqNum)
+	if err != nil {
+		s.Logout(err.Error())
+		return false
+	}
+	if msg.Type() == MsgSequenceReset {
+		next, err := msg.Int(TagNewSeqNo)
+		if err != nil || next < s.inSeq {
+			s.Reject(msg, TagNewSeqNo, RejectIncorrectValue, "NewSeqNo must not go back")
+			s.inSeq++
+			return true
+		}
+		s.inSeq = next
+		return true
+	}
+	switch {
+	case seq > s.inSeq:
+		s.Logout(fmt.Sprintf("MsgSeqNum too high, expecting %d but received %d", s.inSeq, seq))
+		return false
+	case seq < s.inSeq:
+		if dup, _ := msg.Get(TagPossDupFlag); dup == "Y" {
+			// handled already
+			return true
+		}
+		s.Logout(fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", s.inSeq, seq))
+		return false
+	}
+	s.inSeq++
+	return true
+}
+
+// gapFill answers a resend request. Sent messages aren't kept, so it gaps
+// over all of them: the gap fill goes out under the first number asked for
+// and says where numbers pick up again.
+func (s *Session) gapFill(msg *Message) {
+	begin, err := msg.Int(TagBeginSeqNo)
+	if err != nil {
+		s.RejectField(msg, err.(*FieldError))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.outSeq
+	if begin <= 0 || begin >= next {
+		// nothing sent from there yet
+		return
+	}
+	s.outSeq = begin
+	s.send(NewMessage(MsgSequenceReset).
+		Set(TagPossDupFlag, "Y").
+		Set(TagGapFillFlag, "Y").
+		Set(TagNewSeqNo, strconv.Itoa(next)))
+	s.outSeq = next
+}
+
+// monitor keeps the session alive. Every heartbeat interval it sends a
+// Heartbeat if nothing else went out, and a TestRequest if nothing came in;
+// a TestRequest still unanswered an interval later ends the session.
+func (s *Session) monitor() {
+	s.a.clock.AfterFunc(s.heartbeat, func() {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		s.mu.Lock()
+		sent, received, pending := s.sent, s.received, s.testReq != ""
+		s.sent, s.received = false, false
+		switch {
+		case !received && pending:
+			s.mu.Unlock()
+			s.Logout("test request not answered")
+			return
+		case !received:
+			s.testReq = strconv.FormatInt(s.a.clock.Now().UnixNano(), 10)
+			s.send(NewMessage(MsgTestRequest).Set(TagTestReqID, s.testReq))
+		case !sent:
+			s.send(NewMessage(MsgHeartbeat))
+		}
+		s.mu.Unlock()
+		s.monitor()
+	})
+}
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// decimals returns the number of decimal places in step, up to
+// maxDecimals.
+func decimals(step float64) int {
+	const maxDecimals = 8
+	for places := 0; places < maxDecimals; places++ {
+		scaled := step * math.Pow10(places)
+		if math.Abs(scaled-math.Round(scaled)) < 1e-9 {
+			return places
+		}
+	}
+	return maxDecimals
+}
+
+// numberFormat renders a market's prices and sizes, which the exchange keeps
+// in its scale's units, for clients. In market data responses they are by
+// default decimal strings with exactly the market's precision; clients that
+// ask for format=number get JSON numbers with that precision instead.
+// Order entry and account responses are exact: JSON numbers with the places
+// each value needs.
+type numberFormat struct {
+	scale         orderbook.Scale
+	priceDecimals int
+	sizeDecimals  int
+	numbers       bool
+	exact         bool
+}
+
+// exactFormat is how order entry and account responses render the numbers
+// of a market with scale.
+func exactFormat(scale orderbook.Scale) numberFormat {
+	return numberFormat{scale: scale, numbers: true, exact: true}
+}
+
+func (f numberFormat) price(p orderbook.Price) decimal {
+	if f.exact {
+		return decimal{value: f.scale.PriceString(p), number: f.numbers}
+	}
+	return decimal{value: f.scale.FormatPrice(p, f.priceDecimals), number: f.numbers}
+}
+
+func (f numberFormat) size(z orderbook.Size) decimal {
+	if f.exact {
+		return decimal{value: f.scale.SizeString(z), number: f.numbers}
+	}
+	return decimal{value: f.scale.FormatSize(z, f.sizeDecimals), number: f.numbers}
+}
+
+// optPrice and optSize are price and size for fields left out when zero.
+func (f numberFormat) optPrice(p orderbook.Price) *decimal {
+	if p == 0 {
+		return nil
+	}
+	d := f.price(p)
+	return &d
+}
+
+func (f numberFormat) optSize(z orderbook.Size) *decimal {
+	if z == 0 {
+		return nil
+	}
+	d := f.size(z)
+	return &d
+}
+
+// decimal is a price or size written out in fixed-point notation, never in
+// exponent form and never with more places than its market quotes.
+type decimal struct {
+	value  string
+	number bool
+}
+
+func (d decimal) MarshalJSON() ([]byte, error) {
+	if d.number {
+		return []byte(d.value), nil
+	}
+	return strconv.AppendQuote(nil, d.value), nil
+}
+
+var errInvalidFormat = errors.New("format must be string or number")
+
+// numberFormat returns how market's numbers are rendered for the request in
+// c, which picks strings or numbers with its format query parameter.
+func (s *server) numberFormat(c echo.Context, market exchange.Market) (numberFormat, error) {
+	var numbers bool
+	switch c.QueryParam("format") {
+	case "", "string":
+	case "number":
+		numbers = true
+	default:
+		return numberFormat{}, errInvalidFormat
+	}
+	increments, err := s.ex.Increments(market)
+	if err != nil {
+		return numberFormat{}, err
+	}
+	scale, err := s.scale(market)
+	if err != nil {
+		return numberFormat{}, err
+	}
+	return numberFormat{
+		scale:         scale,
+		priceDecimals: min(decimals(increments.Tick), scale.Price),
+		sizeDecimals:  min(decimals(increments.Lot), scale.Size),
+		numbers:       numbers,
+	}, nil
+}
+
+// exactFormat is exactFormat for market.
+func (s *server) exactFormat(market exchange.Market) (numberFormat, error) {
+	scale, err := s.scale(market)
+	return exactFormat(scale), err
+}
+
+// scale returns market's scale. It never changes, so each market's is only
+// asked of the engine once.
+func (s *server) scale(market exchange.Market) (orderbook.Scale, error) {
+	if scale, ok := s.scales.Load(market); ok {
+		return scale.(orderbook.Scale), nil
+	}
+	cfg, err := s.ex.Limits(market)
+	if err != nil {
+		return orderbook.Scale{}, err
+	}
+	s.scales.Store(market, cfg.Scale)
+	return cfg.Scale, nil
+}
+
+// requestScale is the scale a request in market is read with. For a market
+// the engine doesn't have it is the default scale, leaving the engine to
+// refuse, and audit, the request.
+func (s *server) requestScale(market exchange.Market) (orderbook.Scale, error) {
+	scale, err := s.scale(market)
+	if errors.Is(err, exchange.ErrMarketNotFound) {
+		return orderbook.DefaultScale, nil
+	}
+	return scale, err
+}
+
+// orderResponse is a resting order as the book endpoint renders it.
+type orderResponse struct {
+	exchange.Order
+	format numberFormat
+}
+
+func (r orderResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Price        decimal `json:"price"`
+		Size         decimal `json:"size"`
+		OriginalSize decimal `json:"originalSize"`
+		FilledSize   decimal `json:"filledSize"`
+		Bid          bool    `json:"bid"`
+		Timestamp    int64   `json:"timestamp"`
+	}{
+		Price:        r.format.price(r.Price),
+		Size:         r.format.size(r.Size),
+		OriginalSize: r.format.size(r.OriginalSize),
+		FilledSize:   r.format.size(r.FilledSize),
+		Bid:          r.Bid,
+		Timestamp:    r.Timestamp,
+	})
+}
+
+// bookResponse is the body of GET /book/:market.
+type bookResponse struct {
+	exchange.OrderbookData
+	format numberFormat
+}
+
+func (r bookResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Sequence       uint64          `json:"sequence"`
+		TotalAskVolume decimal         `json:"totolAskVolume"`
+		TotalBidVolume decimal         `json:"totolBidVolume"`
+		Asks           []orderResponse `json:"asks"`
+		Bids           []orderResponse `json:"bids"`
+	}{
+		Sequence:       r.Sequence,
+		TotalAskVolume: r.format.size(r.TotalAskVolume),
+		TotalBidVolume: r.format.size(r.TotalBidVolume),
+		Asks:           orderResponses(r.Asks, r.format),
+		Bids:           orderResponses(r.Bids, r.format),
+	})
+}
+
+func orderResponses(src []exchange.Order, format numberFormat) []orderResponse {
+	dst := make([]orderResponse, len(src))
+	for i, o := range src {
+		dst[i] = orderResponse{Order: o, format: format}
+	}
+	return dst
+}
+
+// levelResponse is an aggregated price level as depth responses render it.
+type levelResponse struct {
+	exchange.Level
+	format numberFormat
+}
+
+func (r levelResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Price decimal `json:"price"`
+		Size  decimal `json:"size"`
+	}{r.format.price(r.Price), r.format.size(r.Size)})
+}
+
+// depthResponse is one market's entry in GET /books.
+type depthResponse struct {
+	exchange.MarketDepth
+	format numberFormat
+}
+
+func (r depthResponse) MarshalJSON() ([]byte, error) {
+	levels := func(src []exchange.Level) []levelResponse {
+		if len(src) == 0 {
+			return nil
+		}
+		dst := make([]levelResponse, len(src))
+		for i, l := range src {
+			dst[i] = levelResponse{Level: l, format: r.format}
+		}
+		return dst
+	}
+	return json.Marshal(struct {
+		Market   exchange.Market `json:"market"`
+		Sequence uint64          `json:"sequence,omitempty"`
+		Bids     []levelResponse `json:"bids,omitempty"`
+		Asks     []levelResponse `json:"asks,omitempty"`
+		Error    string          `json:"error,omitempty"`
+	}{
+		Market:   r.Market,
+		Sequence: r.Sequence,
+		Bids:     levels(r.Bids),
+		Asks:     levels(r.Asks),
+		Error:    r.Error,
+	})
+}
+
+// tickerResponse is a ticker as the BBO and stream endpoints render it.
+type tickerResponse struct {
+	exchange.Ticker
+	format numberFormat
+}
+
+func (r tickerResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Market  exchange.Market `json:"market"`
+		Bid     decimal         `json:"bid"`
+		BidSize decimal         `json:"bidSize"`
+		Ask     decimal         `json:"ask"`
+		AskSize decimal         `json:"askSize"`
+		Last    decimal         `json:"last"`
+		Seq     uint64          `json:"seq"`
+		Ts      int64           `json:"ts"`
+	}{
+		Market:  r.Market,
+		Bid:     r.format.price(r.Bid),
+		BidSize: r.format.size(r.BidSize),
+		Ask:     r.format.price(r.Ask),
+		AskSize: r.format.size(r.AskSize),
+		Last:    r.format.price(r.Last),
+		Seq:     r.Seq,
+		Ts:      r.Ts,
+	})
+}
+
+// feedMessageResponse is a trade or book delta as the feed stream renders it.
+type feedMessageResponse struct {
+	exchange.FeedMessage
+	format numberFormat
+}
+
+func (r feedMessageResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type      exchange.FeedMessageType `json:"type"`
+		Market    exchange.Market          `json:"market"`
+		Seq       uint64                   `json:"seq"`
+		Side      orderbook.Side           `json:"side"`
+		Price     decimal                  `json:"price"`
+		Size      decimal                  `json:"size"`
+		TradeID   uint64                   `json:"tradeId,omitempty"`
+		Timestamp int64                    `json:"timestamp,omitempty"`
+	}{
+		Type:      r.Type,
+		Market:    r.Market,
+		Seq:       r.Seq,
+		Side:      r.Side,
+		Price:     r.format.price(r.Price),
+		Size:      r.format.size(r.Size),
+		TradeID:   r.TradeID,
+		Timestamp: r.Timestamp,
+	})
+}
+
+// tradeResponse is a trade as GET /trades/:market renders it. Side is the
+// side of the incoming order.
+type tradeResponse struct {
+	exchange.FeedMessage
+	format numberFormat
+}
+
+func (r tradeResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID        uint64         `json:"id"`
+		Price     decimal        `json:"price"`
+		Size      decimal        `json:"size"`
+		Side      orderbook.Side `json:"side"`
+		Timestamp int64          `json:"timestamp"`
+	}{
+		ID:        r.TradeID,
+		Price:     r.format.price(r.Price),
+		Size:      r.format.size(r.Size),
+		Side:      r.Side,
+		Timestamp: r.Timestamp,
+	})
+}
+
+// candleResponse is a candle as GET /candles/:market renders it.
+type candleResponse struct {
+	candle.Candle
+	format numberFormat
+}
+
+func (r candleResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start  int64   `json:"start"`
+		Open   decimal `json:"open"`
+		High   decimal `json:"high"`
+		Low    decimal `json:"low"`
+		Close  decimal `json:"close"`
+		Volume decimal `json:"volume"`
+		Trades int     `json:"trades"`
+	}{
+		Start:  r.Start,
+		Open:   r.format.price(r.format.scale.PriceOf(r.Open)),
+		High:   r.format.price(r.format.scale.PriceOf(r.High)),
+		Low:    r.format.price(r.format.scale.PriceOf(r.Low)),
+		Close:  r.format.price(r.format.scale.PriceOf(r.Close)),
+		Volume: r.format.size(r.format.scale.SizeOf(r.Volume)),
+		Trades: r.Trades,
+	})
+}
+
+// The responses below render the exchange's order entry and account types,
+// and its events, with their prices and sizes as decimals. Each shadows the
+// type's price and size fields with decimal ones of the same name.
+
+// orderRequestResponse is an order request as an execution report echoes
+// it.
+type orderRequestResponse struct {
+	exchange.PlaceOrderRequest
+	format numberFormat
+}
+
+func (r orderRequestResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.PlaceOrderRequest
+		Size        decimal  `json:"size"`
+		WorstPrice  *decimal `json:"worstPrice,omitempty"`
+		Price       decimal  `json:"price"`
+		DisplaySize *decimal `json:"displaySize,omitempty"`
+		StopPrice   *decimal `json:"stopPrice,omitempty"`
+	}{
+		PlaceOrderRequest: r.PlaceOrderRequest,
+		Size:              r.format.size(r.Size),
+		WorstPrice:        r.format.optPrice(r.WorstPrice),
+		Price:             r.format.price(r.Price),
+		DisplaySize:       r.format.optSize(r.DisplaySize),
+		StopPrice:         r.format.optPrice(r.StopPrice),
+	})
+}
+
+// executionReportResponse is the outcome of placing or modifying an order.
+type executionReportResponse struct {
+	exchange.ExecutionReport
+	format numberFormat
+}
+
+func (r executionReportResponse) MarshalJSON() ([]byte, error) {
+	type levelFill struct {
+		Price          decimal `json:"price"`
+		Size           decimal `json:"size"`
+		CumulativeSize decimal `json:"cumulativeSize"`
+		AveragePrice   decimal `json:"averagePrice"`
+	}
+	type trade struct {
+		exchange.Trade
+		Price decimal `json:"price"`
+		Size  decimal `json:"size"`
+	}
+	var fills []levelFill
+	for _, f := range r.Fills {
+		fills = append(fills, levelFill{
+			Price:          r.format.price(f.Price),
+			Size:           r.format.size(f.Size),
+			CumulativeSize: r.format.size(f.CumulativeSize),
+			AveragePrice:   r.format.price(f.AveragePrice),
+		})
+	}
+	var trades []trade
+	for _, t := range r.Trades {
+		trades = append(trades, trade{Trade: t, Price: r.format.price(t.Price), Size: r.format.size(t.Size)})
+	}
+	var improvement *decimal
+	if r.PriceImprovement != nil {
+		d := r.format.price(*r.PriceImprovement)
+		improvement = &d
+	}
+	return json.Marshal(struct {
+		exchange.ExecutionReport
+		Order            orderRequestResponse `json:"order"`
+		OriginalSize     decimal              `json:"originalSize"`
+		Remaining        decimal              `json:"remaining"`
+		FilledSize       decimal              `json:"filledSize"`
+		AvgPrice         *decimal             `json:"avgPrice,omitempty"`
+		WorstPrice       *decimal             `json:"worstPrice,omitempty"`
+		Fills            []levelFill          `json:"fills,omitempty"`
+		Trades           []trade              `json:"trades,omitempty"`
+		LimitPrice       *decimal             `json:"limitPrice,omitempty"`
+		PriceImprovement *decimal             `json:"priceImprovement,omitempty"`
+	}{
+		ExecutionReport:  r.ExecutionReport,
+		Order:            orderRequestResponse{PlaceOrderRequest: r.Order, format: r.format},
+		OriginalSize:     r.format.size(r.OriginalSize),
+		Remaining:        r.format.size(r.Remaining),
+		FilledSize:       r.format.size(r.FilledSize),
+		AvgPrice:         r.format.optPrice(r.AvgPrice),
+		WorstPrice:       r.format.optPrice(r.WorstPrice),
+		Fills:            fills,
+		Trades:           trades,
+		LimitPrice:       r.format.optPrice(r.LimitPrice),
+		PriceImprovement: improvement,
+	})
+}
+
+// orderRecordResponse is the state of an order.
+type orderRecordResponse struct {
+	exchange.OrderRecord
+	format numberFormat
+}
+
+func (r orderRecordResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.OrderRecord
+		Price        decimal  `json:"price"`
+		StopPrice    *decimal `json:"stopPrice,omitempty"`
+		OriginalSize decimal  `json:"originalSize"`
+		FilledSize   decimal  `json:"filledSize"`
+		Remaining    decimal  `json:"remaining"`
+		AvgPrice     *decimal `json:"avgPrice,omitempty"`
+	}{
+		OrderRecord:  r.OrderRecord,
+		Price:        r.format.price(r.Price),
+		StopPrice:    r.format.optPrice(r.StopPrice),
+		OriginalSize: r.format.size(r.OriginalSize),
+		FilledSize:   r.format.size(r.FilledSize),
+		Remaining:    r.format.size(r.Remaining),
+		AvgPrice:     r.format.optPrice(r.AvgPrice),
+	})
+}
+
+// cancelledOrderResponse is an order a cancel removed.
+type cancelledOrderResponse struct {
+	exchange.CancelledOrder
+	format numberFormat
+}
+
+func (r cancelledOrderResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.CancelledOrder
+		Price     decimal `json:"price"`
+		Remaining decimal `json:"remaining"`
+	}{r.CancelledOrder, r.format.price(r.Price), r.format.size(r.Remaining)})
+}
+
+// orderCancelResponse is the outcome of cancelling one order.
+type orderCancelResponse struct {
+	exchange.OrderCancel
+	format numberFormat
+}
+
+func (r orderCancelResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.OrderCancel
+		Price      decimal `json:"price"`
+		Remaining  decimal `json:"remaining"`
+		FilledSize decimal `json:"filledSize"`
+	}{r.OrderCancel, r.format.price(r.Price), r.format.size(r.Remaining), r.format.size(r.FilledSize)})
+}
+
+// keptOrderResponse is an order a bulk cancel left resting.
+type keptOrderResponse struct {
+	exchange.KeptOrder
+	format numberFormat
+}
+
+func (r keptOrderResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.KeptOrder
+		Price     decimal `json:"price"`
+		Remaining decimal `json:"remaining"`
+	}{r.KeptOrder, r.format.price(r.Price), r.format.size(r.Remaining)})
+}
+
+// orderReduceResponse is the outcome of reducing an order.
+type orderReduceResponse struct {
+	exchange.OrderReduce
+	format numberFormat
+}
+
+func (r orderReduceResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.OrderReduce
+		Price     decimal `json:"price"`
+		Reduced   decimal `json:"reduced"`
+		Remaining decimal `json:"remaining"`
+	}{r.OrderReduce, r.format.price(r.Price), r.format.size(r.Reduced), r.format.size(r.Remaining)})
+}
+
+// fillResponse is one of a user's fills.
+type fillResponse struct {
+	exchange.Fill
+	format numberFormat
+}
+
+func (r fillResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.Fill
+		Price decimal `json:"price"`
+		Size  decimal `json:"size"`
+	}{r.Fill, r.format.price(r.Price), r.format.size(r.Size)})
+}
+
+// userTradeResponse is one of a user's trades with its running totals.
+type userTradeResponse struct {
+	exchange.UserTrade
+	format numberFormat
+}
+
+func (r userTradeResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.UserTrade
+		Price decimal `json:"price"`
+		Size  decimal `json:"size"`
+	}{r.UserTrade, r.format.price(r.Price), r.format.size(r.Size)})
+}
+
+// positionResponse is a user's position in a market.
+type positionResponse struct {
+	exchange.Position
+	format numberFormat
+}
+
+func (r positionResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.Position
+		Size       decimal  `json:"size"`
+		EntryPrice *decimal `json:"entryPrice,omitempty"`
+		LastPrice  decimal  `json:"lastPrice"`
+	}{r.Position, r.format.size(r.Size), r.format.optPrice(r.EntryPrice), r.format.price(r.LastPrice)})
+}
+
+// orderUpdateResponse is news of one of a user's orders.
+type orderUpdateResponse struct {
+	exchange.OrderUpdate
+	format numberFormat
+}
+
+func (r orderUpdateResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.OrderUpdate
+		Price         decimal  `json:"price"`
+		Remaining     decimal  `json:"remaining"`
+		FillPrice     *decimal `json:"fillPrice,omitempty"`
+		FillSize      *decimal `json:"fillSize,omitempty"`
+		PositionDelta *decimal `json:"positionDelta,omitempty"`
+	}{
+		OrderUpdate:   r.OrderUpdate,
+		Price:         r.format.price(r.Price),
+		Remaining:     r.format.size(r.Remaining),
+		FillPrice:     r.format.optPrice(r.FillPrice),
+		FillSize:      r.format.optSize(r.FillSize),
+		PositionDelta: r.format.optSize(r.PositionDelta),
+	})
+}
+
+// eventResponse is an event as the Kafka and JetStream publishers write it.
+type eventResponse struct {
+	exchange.Event
+	format numberFormat
+}
+
+func (r eventResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.Event
+		Price decimal `json:"price"`
+		Size  decimal `json:"size"`
+	}{r.Event, r.format.price(r.Price), r.format.size(r.Size)})
+}
+
+// eventFormat is how the publishers write the events of ex's market.
+func eventFormat(ex *exchange.Exchange, market exchange.Market) numberFormat {
+	// events only ever come from markets the exchange has
+	cfg, _ := ex.Limits(market)
+	return exactFormat(cfg.Scale)
+}
+
+// auctionStateResponse is a market's auction and its indicative uncrossing.
+type auctionStateResponse struct {
+	orderbook.AuctionState
+	format numberFormat
+}
+
+func (r auctionStateResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		orderbook.AuctionState
+		Price     decimal `json:"price"`
+		Volume    decimal `json:"volume"`
+		Imbalance decimal `json:"imbalance"`
+	}{r.AuctionState, r.format.price(r.Price), r.format.size(r.Volume), r.format.size(r.Imbalance)})
+}
+
+// auctionFillResponse is one trade of an auction's uncrossing.
+type auctionFillResponse struct {
+	exchange.AuctionFill
+	format numberFormat
+}
+
+func (r auctionFillResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Price decimal `json:"price"`
+		Size  decimal `json:"size"`
+	}{r.format.price(r.Price), r.format.size(r.Size)})
+}
+
+// marketConfigResponse is a market's rules.
+type marketConfigResponse struct {
+	exchange.MarketConfig
+	format numberFormat
+}
+
+func (r marketConfigResponse) MarshalJSON() ([]byte, error) {
+	type matchPolicy struct {
+		exchange.MatchPolicy
+		LotSize *decimal `json:"lotSize,omitempty"`
+		MinFill *decimal `json:"minFill,omitempty"`
+	}
+	return json.Marshal(struct {
+		exchange.MarketConfig
+		MaxOrderSize decimal     `json:"maxOrderSize"`
+		MatchPolicy  matchPolicy `json:"matchPolicy"`
+	}{
+		MarketConfig: r.MarketConfig,
+		MaxOrderSize: r.format.size(r.MaxOrderSize),
+		MatchPolicy: matchPolicy{
+			MatchPolicy: r.MatchPolicy,
+			LotSize:     r.format.optSize(r.MatchPolicy.LotSize),
+			MinFill:     r.format.optSize(r.MatchPolicy.MinFill),
+		},
+	})
+}
+
+// marketStatsResponse is a market's book load and rules.
+type marketStatsResponse struct {
+	exchange.MarketStats
+	format numberFormat
+}
+
+func (r marketStatsResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.MarketStats
+		AskVolume decimal              `json:"askVolume"`
+		BidVolume decimal              `json:"bidVolume"`
+		Limits    marketConfigResponse `json:"limits"`
+	}{
+		MarketStats: r.MarketStats,
+		AskVolume:   r.format.size(r.AskVolume),
+		BidVolume:   r.format.size(r.BidVolume),
+		Limits:      marketConfigResponse{MarketConfig: r.Limits, format: r.format},
+	})
+}
+
+// snapshotLevelResponse is a level of a serialized book, as exportResponse
+// writes it and exportBody reads it back.
+type snapshotLevelResponse struct {
+	orderbook.SnapshotLevel
+	format numberFormat
+}
+
+func (r snapshotLevelResponse) MarshalJSON() ([]byte, error) {
+	type order struct {
+		orderbook.SnapshotOrder
+		Size         decimal  `json:"size"`
+		OriginalSize *decimal `json:"originalSize,omitempty"`
+		DisplaySize  *decimal `json:"displaySize,omitempty"`
+		Hidden       *decimal `json:"hidden,omitempty"`
+	}
+	orders := make([]order, len(r.Orders))
+	for i, o := range r.Orders {
+		orders[i] = order{
+			SnapshotOrder: o,
+			Size:          r.format.size(o.Size),
+			OriginalSize:  r.format.optSize(o.OriginalSize),
+			DisplaySize:   r.format.optSize(o.DisplaySize),
+			Hidden:        r.format.optSize(o.Hidden),
+		}
+	}
+	return json.Marshal(struct {
+		Price  decimal `json:"price"`
+		Orders []order `json:"orders"`
+	}{r.format.price(r.Price), orders})
+}
+
+func snapshotLevelResponses(src []orderbook.SnapshotLevel, format numberFormat) []snapshotLevelResponse {
+	if src == nil {
+		return nil
+	}
+	dst := make([]snapshotLevelResponse, len(src))
+	for i, l := range src {
+		dst[i] = snapshotLevelResponse{SnapshotLevel: l, format: format}
+	}
+	return dst
+}
+
+// exportResponse is the body of GET /admin/markets/:symbol/export.
+type exportResponse struct {
+	exchange.MarketExport
+	format numberFormat
+}
+
+func (r exportResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		exchange.MarketExport
+		Asks []snapshotLevelResponse `json:"asks"`
+		Bids []snapshotLevelResponse `json:"bids"`
+	}{r.MarketExport, snapshotLevelResponses(r.Asks, r.format), snapshotLevelResponses(r.Bids, r.format)})
+}
+
+// pastBookResponse is the body of GET /admin/markets/:symbol/book-at.
+type pastBookResponse struct {
+	exchange.PastBook
+	format numberFormat
+}
+
+func (r pastBookResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Market         exchange.Market `json:"market"`
+		Seq            uint64          `json:"seq"`
+		Time           int64           `json:"time"`
+		Sequence       uint64          `json:"sequence"`
+		TotalAskVolume decimal         `json:"totolAskVolume"`
+		TotalBidVolume decimal         `json:"totolBidVolume"`
+		Asks           []orderResponse `json:"asks"`
+		Bids           []orderResponse `json:"bids"`
+	}{
+		Market:         r.Market,
+		Seq:            r.Seq,
+		Time:           r.Time,
+		Sequence:       r.Sequence,
+		TotalAskVolume: r.format.size(r.TotalAskVolume),
+		TotalBidVolume: r.format.size(r.TotalBidVolume),
+		Asks:           orderResponses(r.Asks, r.format),
+		Bids:           orderResponses(r.Bids, r.format),
+	})
+}
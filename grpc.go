@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/exchangepb"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/remote"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// withGRPC registers the exchange's gRPC API on g too, with the same users
+// and sessions as the HTTP routes.
+func withGRPC(g *grpc.Server) serverOption {
+	return func(s *server) {
+		s.grpc = g
+	}
+}
+
+// grpcServer implements exchangepb.ExchangeServer on a server's exchange.
+type grpcServer struct {
+	exchangepb.UnimplementedExchangeServer
+	s *server
+}
+
+// caller is authenticate for gRPC calls, which carry their credentials in
+// the x-api-key and authorization metadata: it returns the calling user's
+// ID, zero for an anonymous call.
+func (g *grpcServer) caller(ctx context.Context) (uint64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	u, _, err := g.s.credentials(first("x-api-key"), first("authorization"))
+	if err != nil {
+		return 0, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return u.ID, nil
+}
+
+// grpcError is errorResponse for gRPC: a refusal becomes a status whose
+// ErrorInfo reason is the rejection code.
+func grpcError(err error) error {
+	var rejection *exchange.Rejection
+	switch {
+	case errors.As(err, &rejection):
+		code := codes.InvalidArgument
+		switch rejection.Code {
+		case "ENGINE_TIMEOUT":
+			code = codes.DeadlineExceeded
+		case "REQUEST_CANCELLED":
+			code = codes.Canceled
+		case "JOURNAL_FAILED":
+			code = codes.Unavailable
+		case "ORDER_NOT_FOUND":
+			code = codes.NotFound
+		}
+		st, err := status.New(code, rejection.Msg).WithDetails(&errdetails.ErrorInfo{
+			Reason: rejection.Code,
+			Domain: "exchange",
+		})
+		if err != nil {
+			return status.Error(code, rejection.Msg)
+		}
+		return st.Err()
+	case errors.Is(err, exchange.ErrMarketNotEmpty):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, remote.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
+
+var grpcOrderTypes = map[exchangepb.OrderType]exchange.OrderType{
+	exchangepb.OrderType_ORDER_TYPE_LIMIT:       exchange.LimitOrder,
+	exchangepb.OrderType_ORDER_TYPE_MARKET:      exchange.MarketOrder,
+	exchangepb.OrderType_ORDER_TYPE_STOP_MARKET: exchange.StopMarketOrder,
+}
+
+var grpcTimesInForce = map[exchangepb.TimeInForce]orderbook.TimeInForce{
+	exchangepb.TimeInForce_TIME_IN_FORCE_GTC: orderbook.GoodTillCancel,
+	exchangepb.TimeInForce_TIME_IN_FORCE_IOC: orderbook.ImmediateOrCancel,
+	exchangepb.TimeInForce_TIME_IN_FORCE_FOK: orderbook.FillOrKill,
+	exchangepb.TimeInForce_TIME_IN_FORCE_GTD: orderbook.GoodTillDate,
+}
+
+func grpcTimeInForce(tif orderbook.TimeInForce) exchangepb.TimeInForce {
+	for pb, t := range grpcTimesInForce {
+		if t == tif {
+			return pb
+		}
+	}
+	return exchangepb.TimeInForce_TIME_IN_FORCE_UNSPECIFIED
+}
+
+// grpcNumber is a gRPC double as the decimal it prints as, the shortest
+// that reads back as it, which is what the client wrote: the messages carry
+// prices and sizes as doubles, read exactly with the market's scale like
+// the HTTP API's decimals.
+func grpcNumber(v float64) number {
+	return number(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func (g *grpcServer) PlaceOrder(ctx context.Context, req *exchangepb.PlaceOrderRequest) (*exchangepb.ExecutionReport, error) {
+	caller, err := g.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	market := exchange.Market(req.GetMarket())
+	scale, err := g.s.requestScale(market)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	p := unitParser{scale: scale}
+	order := exchange.PlaceOrderRequest{
+		// an unknown type is left empty for validation to refuse
+		Type:           grpcOrderTypes[req.GetType()],
+		Bid:            req.GetBid(),
+		Size:           p.size("size", grpcNumber(req.GetSize())),
+		Notional:       req.GetNotional(),
+		WorstPrice:     p.price("worst_price", grpcNumber(req.GetWorstPrice())),
+		MaxSlippageBps: req.GetMaxSlippageBps(),
+		Price:          p.price("price", grpcNumber(req.GetPrice())),
+		TimeInForce:    grpcTimesInForce[req.GetTimeInForce()],
+		ExpiresAt:      req.GetExpiresAt(),
+		DisplaySize:    p.size("display_size", grpcNumber(req.GetDisplaySize())),
+		StopPrice:      p.price("stop_price", grpcNumber(req.GetStopPrice())),
+		ClientOrderID:  req.GetClientOrderId(),
+		User:           caller,
+		Market:         market,
+		Metadata:       req.GetMetadata(),
+	}
+	if p.err != nil {
+		raw, _ := protojson.Marshal(req)
+		return nil, grpcError(g.s.ex.RejectInvalid(exchange.AuditPlace, market, raw, p.err))
+	}
+	report, err := g.s.ex.PlaceOrder(ctx, order)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	trades := make([]*exchangepb.Trade, len(report.Trades))
+	for i, t := range report.Trades {
+		trades[i] = &exchangepb.Trade{
+			Price:           scale.PriceValue(t.Price),
+			Size:            scale.SizeValue(t.Size),
+			CounterpartyId:  t.CounterpartyID,
+			CounterpartyBid: t.CounterpartySide == orderbook.SideBid,
+		}
+	}
+	var improvement *float64
+	if report.PriceImprovement != nil {
+		v := scale.PriceValue(*report.PriceImprovement)
+		improvement = &v
+	}
+	return &exchangepb.ExecutionReport{
+		OrderId:          report.OrderID,
+		Market:           string(report.Order.Market),
+		OriginalSize:     scale.SizeValue(report.OriginalSize),
+		Remaining:        scale.SizeValue(report.Remaining),
+		FilledSize:       scale.SizeValue(report.FilledSize),
+		Rested:           report.Rested,
+		AvgPrice:         scale.PriceValue(report.AvgPrice),
+		WorstPrice:       scale.PriceValue(report.WorstPrice),
+		LevelsTouched:    int32(report.LevelsTouched),
+		Trades:           trades,
+		LimitPrice:       scale.PriceValue(report.LimitPrice),
+		PriceImprovement: improvement,
+	}, nil
+}
+
+func (g *grpcServer) CancelOrder(ctx context.Context, req *exchangepb.CancelOrderRequest) (*exchangepb.CancelledOrder, error) {
+	caller, err := g.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var cancelled exchange.OrderCancel
+	switch order := req.GetOrder().(type) {
+	case *exchangepb.CancelOrderRequest_OrderId:
+		cancelled, err = g.s.ex.CancelOrder(ctx, caller, order.OrderId)
+	case *exchangepb.CancelOrderRequest_ClientOrderId:
+		cancelled, err = g.s.ex.CancelOrderByClientID(ctx, caller, order.ClientOrderId)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "order_id or client_order_id is required")
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	scale, err := g.s.scale(cancelled.Market)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &exchangepb.CancelledOrder{
+		OrderId:    cancelled.ID,
+		Market:     string(cancelled.Market),
+		Bid:        cancelled.Bid,
+		Price:      scale.PriceValue(cancelled.Price),
+		Remaining:  scale.SizeValue(cancelled.Remaining),
+		FilledSize: scale.SizeValue(cancelled.FilledSize),
+		Status:     string(cancelled.Status),
+		Timestamp:  cancelled.Timestamp,
+	}, nil
+}
+
+func (g *grpcServer) GetOrder(ctx context.Context, req *exchangepb.GetOrderRequest) (*exchangepb.Order, error) {
+	caller, err := g.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var order exchange.OrderRecord
+	switch o := req.GetOrder().(type) {
+	case *exchangepb.GetOrderRequest_OrderId:
+		order, err = g.s.ex.Order(caller, o.OrderId)
+	case *exchangepb.GetOrderRequest_ClientOrderId:
+		order, err = g.s.ex.OrderByClientID(caller, o.ClientOrderId)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "order_id or client_order_id is required")
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	scale, err := g.s.scale(order.Market)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &exchangepb.Order{
+		OrderId:       order.ID,
+		ClientOrderId: order.ClientOrderID,
+		Market:        string(order.Market),
+		Bid:           order.Bid,
+		Price:         scale.PriceValue(order.Price),
+		StopPrice:     scale.PriceValue(order.StopPrice),
+		TimeInForce:   grpcTimeInForce(order.TimeInForce),
+		ExpiresAt:     order.ExpiresAt,
+		Status:        string(order.Status),
+		OriginalSize:  scale.SizeValue(order.OriginalSize),
+		FilledSize:    scale.SizeValue(order.FilledSize),
+		Remaining:     scale.SizeValue(order.Remaining),
+		AvgPrice:      scale.PriceValue(order.AvgPrice),
+		CreatedAt:     order.CreatedAt,
+		UpdatedAt:     order.UpdatedAt,
+	}, nil
+}
+
+func (g *grpcServer) GetBook(ctx context.Context, req *exchangepb.GetBookRequest) (*exchangepb.Book, error) {
+	depth := defaultBooksDepth
+	if req.GetDepth() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "depth must not be negative")
+	}
+	if req.GetDepth() > 0 {
+		depth = int(req.GetDepth())
+	}
+	book, err := g.s.ex.GetDepth(exchange.Market(req.GetMarket()), depth)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	scale, err := g.s.scale(book.Market)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	levels := func(src []exchange.Level) []*exchangepb.Level {
+		dst := make([]*exchangepb.Level, len(src))
+		for i, l := range src {
+			dst[i] = &exchangepb.Level{Price: scale.PriceValue(l.Price), Size: scale.SizeValue(l.Size)}
+		}
+		return dst
+	}
+	return &exchangepb.Book{
+		Market:   string(book.Market),
+		Sequence: book.Sequence,
+		Bids:     levels(book.Bids),
+		Asks:     levels(book.Asks),
+	}, nil
+}
+
+// errFellBehind ends a stream the feed cut off for falling behind.
+var errFellBehind = status.Error(codes.ResourceExhausted, "fell behind the feed")
+
+// bookUpdate collects the book messages among msgs into an update.
+func bookUpdate(market exchange.Market, scale orderbook.Scale, msgs []exchange.FeedMessage) *exchangepb.BookUpdate {
+	update := &exchangepb.BookUpdate{Market: string(market)}
+	for _, msg := range msgs {
+		if msg.Type != exchange.FeedBook {
+			continue
+		}
+		level := &exchangepb.Level{Price: scale.PriceValue(msg.Price), Size: scale.SizeValue(msg.Size)}
+		if msg.Side == orderbook.SideBid {
+			update.Bids = append(update.Bids, level)
+		} else {
+			update.Asks = append(update.Asks, level)
+		}
+	}
+	return update
+}
+
+func (g *grpcServer) StreamBook(req *exchangepb.StreamBookRequest, stream exchangepb.Exchange_StreamBookServer) error {
+	if _, err := g.caller(stream.Context()); err != nil {
+		return err
+	}
+	market := exchange.Market(req.GetMarket())
+	snapshot, seq, updates, unsubscribe, err := g.s.ex.SnapshotFeed(market)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer unsubscribe()
+	scale, err := g.s.scale(market)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	first := bookUpdate(market, scale, snapshot)
+	first.Seq, first.Snapshot = seq, true
+	if err := stream.Send(first); err != nil {
+		return err
+	}
+	for {
+		select {
+		case msgs, ok := <-updates:
+			if !ok {
+				return errFellBehind
+			}
+			update := bookUpdate(market, scale, msgs)
+			if len(update.Bids) == 0 && len(update.Asks) == 0 {
+				continue
+			}
+			update.PrevSeq, update.Seq = seq, msgs[0].Seq
+			seq = update.Seq
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (g *grpcServer) StreamTrades(req *exchangepb.StreamTradesRequest, stream exchangepb.Exchange_StreamTradesServer) error {
+	if _, err := g.caller(stream.Context()); err != nil {
+		return err
+	}
+	market := exchange.Market(req.GetMarket())
+	var (
+		missed      []exchange.FeedMessage
+		updates     <-chan []exchange.FeedMessage
+		unsubscribe func()
+		err         error
+	)
+	if req.AfterTradeId != nil {
+		missed, updates, unsubscribe, err = g.s.ex.ResumeTrades(market, req.GetAfterTradeId())
+	} else {
+		updates, unsubscribe, err = g.s.ex.SubscribeFeed(market)
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	defer unsubscribe()
+	scale, err := g.s.scale(market)
+	if err != nil {
+		return grpcError(err)
+	}
+	// the headers tell the client it is subscribed, which may be well before
+	// the first trade
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	send := func(msgs []exchange.FeedMessage) error {
+		for _, msg := range msgs {
+			if msg.Type != exchange.FeedTrade {
+				continue
+			}
+			err := stream.Send(&exchangepb.MarketTrade{
+				Market:    string(msg.Market),
+				TradeId:   msg.TradeID,
+				Seq:       msg.Seq,
+				Bid:       msg.Side == orderbook.SideBid,
+				Price:     scale.PriceValue(msg.Price),
+				Size:      scale.SizeValue(msg.Size),
+				Timestamp: msg.Timestamp,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := send(missed); err != nil {
+		return err
+	}
+	for {
+		select {
+		case msgs, ok := <-updates:
+			if !ok {
+				return errFellBehind
+			}
+			if err := send(msgs); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/store"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// openHistory opens the database order history is kept in, migrating its
+// schema: the PostgreSQL one at EXCHANGE_POSTGRES_URL or, for a single node
+// or development, the SQLite file at EXCHANGE_SQLITE_PATH. Without either
+// it returns nil.
+func openHistory() store.Repository {
+	pgURL, sqlitePath := os.Getenv("EXCHANGE_POSTGRES_URL"), os.Getenv("EXCHANGE_SQLITE_PATH")
+	if pgURL != "" && sqlitePath != "" {
+		slog.Error("EXCHANGE_POSTGRES_URL can't be used with EXCHANGE_SQLITE_PATH")
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	switch {
+	case pgURL != "":
+		repo, err := store.OpenPostgres(ctx, pgURL)
+		if err != nil {
+			slog.Error("failed to open EXCHANGE_POSTGRES_URL", "error", err)
+			os.Exit(1)
+		}
+		return repo
+	case sqlitePath != "":
+		repo, err := store.OpenSQLite(ctx, sqlitePath)
+		if err != nil {
+			slog.Error("failed to open EXCHANGE_SQLITE_PATH", "path", sqlitePath, "error", err)
+			os.Exit(1)
+		}
+		return repo
+	default:
+		return nil
+	}
+}
+
+// resumeIDs has ex number orders and trades after those repo keeps, which
+// a process starting without a journal, or with a newer history than its
+// journal's, would otherwise number again.
+func resumeIDs(ex *exchange.Exchange, repo store.Repository) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	orderID, tradeIDs, err := repo.LastIDs(ctx, ex.Markets())
+	if err != nil {
+		slog.Error("failed to read order history", "error", err)
+		os.Exit(1)
+	}
+	orderbook.ReserveOrderIDs(orderID)
+	for market, id := range tradeIDs {
+		ex.ReserveTradeIDs(market, id)
+	}
+}
+
+// withHistory serves users their order history from repo, which keeps it
+// for longer than the exchange does and across restarts. Without it the
+// history routes aren't registered.
+func withHistory(repo store.Repository) serverOption {
+	return func(s *server) {
+		s.history = repo
+	}
+}
+
+// handleGetOrderHistory lists the caller's orders, newest first, narrowed
+// by the market, from and to (RFC 3339, bounding when they were placed)
+// query parameters and at most limit of them.
+func (s *server) handleGetOrderHistory(c echo.Context) error {
+	limit, ok := queryLimit(c)
+	if !ok {
+		return badLimit(c)
+	}
+	q := store.OrderQuery{
+		Owner:  callerID(c),
+		Market: exchange.Market(c.QueryParam("market")),
+		Limit:  limit,
+	}
+	if err := queryBounds(c, &q.From, &q.To); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+
+	orders, err := s.history.Orders(c.Request().Context(), q)
+	if err != nil {
+		return historyError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"orders": orders,
+	})
+}
+
+// handleGetOrderUpdates returns one of the caller's orders with every update
+// it had, oldest first.
+func (s *server) handleGetOrderUpdates(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be an order ID",
+		})
+	}
+
+	order, updates, err := s.history.Order(c.Request().Context(), callerID(c), id)
+	if err != nil {
+		return historyError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"order":   order,
+		"updates": updates,
+	})
+}
+
+// queryBounds reads the from and to query parameters, RFC 3339 times, into
+// from and to as unix nanoseconds, leaving those unset as they are.
+func queryBounds(c echo.Context, from, to *int64) error {
+	for _, bound := range []struct {
+		param string
+		dst   *int64
+	}{{"from", from}, {"to", to}} {
+		v := c.QueryParam(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return errors.New(bound.param + " must be an RFC 3339 time")
+		}
+		*bound.dst = t.UnixNano()
+	}
+	return nil
+}
+
+// queryLimit reads the limit query parameter, defaultHistoryLimit if it is
+// unset. It reports whether it is within bounds.
+func queryLimit(c echo.Context) (int, bool) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return defaultHistoryLimit, true
+	}
+	limit, err := strconv.Atoi(v)
+	return limit, err == nil && limit > 0 && limit <= maxHistoryLimit
+}
+
+func badLimit(c echo.Context) error {
+	return c.JSON(http.StatusBadRequest, map[string]any{
+		"msg": "limit must be an integer from 1 to " + strconv.Itoa(maxHistoryLimit),
+	})
+}
+
+// historyError answers a failed history query: 404 for an order it has no
+// record of, and 503 when the database can't be read.
+func historyError(c echo.Context, err error) error {
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, store.ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	return c.JSON(status, map[string]any{
+		"msg": err.Error(),
+	})
+}
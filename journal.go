@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iter"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/internal/atomicfile"
+	"github.com/thenaveensharma/exchange/wal"
+)
+
+// walJournal journals the exchange's commands to a write-ahead log, one JSON
+// record each.
+type walJournal struct {
+	log *wal.Log
+}
+
+func (j walJournal) Append(cmd exchange.Command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return j.log.Append(data)
+}
+
+// journaledCommands reads back the commands walJournal appended to log.
+func journaledCommands(log *wal.Log) iter.Seq2[exchange.Command, error] {
+	return func(yield func(exchange.Command, error) bool) {
+		for data, err := range log.Records() {
+			var cmd exchange.Command
+			if err == nil {
+				err = json.Unmarshal(data, &cmd)
+			}
+			if !yield(cmd, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkpointer writes the exchange's checkpoints to a file and drops the
+// commands they cover from its journal, so a restart restores the latest
+// checkpoint and replays only the commands after it.
+//
+// It keeps the retain latest checkpoints, the one before the latest beside
+// it named for the last command it covers, and the journal's commands from
+// the oldest on, so books can be rebuilt as they were back to it. Without
+// a path it takes no checkpoints, and the journal keeps every command.
+type checkpointer struct {
+	mu     sync.Mutex
+	ex     *exchange.Exchange
+	log    *wal.Log
+	path   string
+	retain int
+	// seq is the last command the checkpoint at path covers, zero until
+	// there is one
+	seq uint64
+}
+
+// run writes a checkpoint every interval until ctx ends.
+func (c *checkpointer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.write(); err != nil {
+			slog.Error("failed to write checkpoint", "path", c.path, "error", err)
+		}
+	}
+}
+
+// write takes a checkpoint and replaces the file with it, then trims the
+// commands it covers off the journal. A crash in between leaves them to be
+// skipped when the journal is replayed on top of the checkpoint.
+func (c *checkpointer) write() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp := c.ex.Checkpoint()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// the checkpoint being replaced is kept by another name, linked rather
+	// than copied so a crash leaves it whole under one name or the other
+	if c.retain > 1 && c.seq != 0 && c.seq != cp.Seq {
+		if err := os.Link(c.path, c.archivePath(c.seq)); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	if err := atomicfile.WriteFile(c.path, data); err != nil {
+		return err
+	}
+	c.seq = cp.Seq
+
+	oldest := cp.Seq
+	archived, err := c.archived()
+	if err != nil {
+		return err
+	}
+	for i, seq := range archived {
+		if i < len(archived)-(c.retain-1) {
+			if err := os.Remove(c.archivePath(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		oldest = min(oldest, seq)
+	}
+	covered := 0
+	for cmd, err := range journaledCommands(c.log) {
+		if err != nil {
+			return err
+		}
+		if cmd.Seq > oldest {
+			break
+		}
+		covered++
+	}
+	return c.log.TrimFront(covered)
+}
+
+// archivePath is where the checkpoint covering the commands up to seq is
+// kept once a later one replaces it.
+func (c *checkpointer) archivePath(seq uint64) string {
+	return c.path + "." + strconv.FormatUint(seq, 10)
+}
+
+// archived returns the last commands the checkpoints kept beside the
+// latest cover, oldest first.
+func (c *checkpointer) archived() ([]uint64, error) {
+	paths, err := filepath.Glob(c.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, path := range paths {
+		// others, like a checkpoint's temporary file, aren't numbered
+		if seq, err := strconv.ParseUint(strings.TrimPrefix(path, c.path+"."), 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	slices.Sort(seqs)
+	return seqs, nil
+}
+
+// restore loads the checkpoint at the checkpointer's path into the
+// exchange, if one has been written, and returns the number of the last
+// command it covers.
+func (c *checkpointer) restore() (uint64, error) {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var cp exchange.Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return 0, err
+	}
+	c.seq = cp.Seq
+	return cp.Seq, c.ex.Restore(cp)
+}
+
+// withCheckpoints has the server rebuild past books from c's checkpoints
+// and journal.
+func withCheckpoints(c *checkpointer) serverOption {
+	return func(s *server) {
+		s.checkpoints = c
+	}
+}
+
+// handleBookAt rebuilds a market's book as it was at the time query
+// parameter (RFC 3339), or after the journaled command numbered seq, from
+// the checkpoints and journal kept, leaving the live book alone.
+func (s *server) handleBookAt(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	var seq uint64
+	var at int64
+	switch v, t := c.QueryParam("seq"), c.QueryParam("time"); {
+	case (v == "") == (t == ""):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "one of time and seq is required",
+		})
+	case v != "":
+		var err error
+		if seq, err = strconv.ParseUint(v, 10, 64); err != nil || seq == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "seq must be a command number",
+			})
+		}
+	default:
+		parsed, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "time must be an RFC 3339 time",
+			})
+		}
+		at = parsed.UnixNano()
+	}
+
+	book, err := s.checkpoints.bookAt(market, seq, at)
+	switch {
+	case errors.Is(err, errNoCheckpoint):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"msg": err.Error(),
+		})
+	case err != nil:
+		return errorResponse(c, err)
+	}
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, pastBookResponse{PastBook: book, format: format})
+}
+
+// errNoCheckpoint is returned by bookAt for a point before the oldest
+// checkpoint kept.
+var errNoCheckpoint = errors.New("no checkpoint that old is kept")
+
+// bookAt rebuilds market's book as it was after the last command journaled
+// up to seq or, with seq zero, at or before at, in unix nanoseconds: the
+// latest checkpoint from before then is restored apart from the exchange,
+// and the commands after it are applied up to there. Checkpoints wait for
+// it, so the files and the journal it reads stay as they are.
+func (c *checkpointer) bookAt(market exchange.Market, seq uint64, at int64) (exchange.PastBook, error) {
+	if _, err := c.ex.Assets(market); err != nil {
+		return exchange.PastBook{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	before := func(cmdSeq uint64, cmdTime int64) bool {
+		if seq != 0 {
+			return cmdSeq <= seq
+		}
+		return cmdTime <= at
+	}
+	var cp *exchange.Checkpoint
+	if c.seq != 0 {
+		archived, err := c.archived()
+		if err != nil {
+			return exchange.PastBook{}, err
+		}
+		paths := []string{c.path}
+		for _, kept := range slices.Backward(archived) {
+			paths = append(paths, c.archivePath(kept))
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return exchange.PastBook{}, err
+			}
+			var kept exchange.Checkpoint
+			if err := json.Unmarshal(data, &kept); err != nil {
+				return exchange.PastBook{}, err
+			}
+			if before(kept.Seq, kept.Time) {
+				cp = &kept
+				break
+			}
+		}
+		if cp == nil {
+			return exchange.PastBook{}, errNoCheckpoint
+		}
+	}
+	commands := func(yield func(exchange.Command, error) bool) {
+		for cmd, err := range journaledCommands(c.log) {
+			if err == nil && !before(cmd.Seq, cmd.Time) {
+				return
+			}
+			if !yield(cmd, err) {
+				return
+			}
+		}
+	}
+	return c.ex.BookAt(market, cp, commands)
+}
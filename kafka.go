@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// kafkaWriteTimeout is how long one operation's events may take to be
+// acknowledged before they are given up on.
+const kafkaWriteTimeout = 30 * time.Second
+
+// kafkaWriter is what events are published through; *kafka.Writer is one.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// publishToKafka publishes every operation's events through w as JSON, with
+// their prices and sizes as decimals as the API gives them, to the topics
+// eventTopic names. Each carries its market in a "market" header, which
+// marketBalancer partitions on, and is keyed by its order ID, a fill by the
+// incoming order's; level changes have no key. It runs off the matching
+// path, spilling operations to disk while Kafka can't keep up, and logs any
+// it fails to write.
+func publishToKafka(ex *exchange.Exchange, w kafkaWriter, prefix string) {
+	ex.HandleEventsAsync(func(events []exchange.Event) {
+		format := eventFormat(ex, events[0].Market)
+		msgs := make([]kafka.Message, 0, len(events))
+		for _, event := range events {
+			value, _ := json.Marshal(eventResponse{Event: event, format: format})
+			msg := kafka.Message{
+				Topic:   eventTopic(prefix, event.Type),
+				Value:   value,
+				Headers: []kafka.Header{{Key: "market", Value: []byte(event.Market)}},
+			}
+			if event.OrderID != 0 {
+				msg.Key = strconv.AppendUint(nil, event.OrderID, 10)
+			}
+			msgs = append(msgs, msg)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaWriteTimeout)
+		defer cancel()
+		if err := w.WriteMessages(ctx, msgs...); err != nil {
+			slog.Error("failed to publish events to Kafka", "market", events[0].Market, "seq", events[0].Seq, "error", err)
+		}
+	}, exchange.AsyncOptions{Name: "kafka", Overflow: exchange.OverflowSpill})
+}
+
+// marketBalancer sends every message of a market to the same partition, so
+// consumers see a market's events in order.
+type marketBalancer struct{}
+
+func (marketBalancer) Balance(msg kafka.Message, partitions ...int) int {
+	h := fnv.New32a()
+	for _, header := range msg.Headers {
+		if header.Key == "market" {
+			h.Write(header.Value)
+		}
+	}
+	return partitions[h.Sum32()%uint32(len(partitions))]
+}
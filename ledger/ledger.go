@@ -0,0 +1,631 @@
+// Package ledger keeps users' balances in each asset as a double-entry
+// journal: every change is an entry whose postings move amounts between
+// accounts and sum to zero in each asset, so value is never created or lost
+// inside the exchange.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/bits"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+// AmountPrecision is the number of decimal places an amount keeps once it
+// reaches the ledger.
+const AmountPrecision = 8
+
+var amountScale = math.Pow10(AmountPrecision)
+
+// units converts amount to a whole number of 10^-AmountPrecision units.
+// Balances are kept in units, so postings sum to exactly zero and a balance
+// spent down is left with exactly nothing.
+func units(amount float64) int64 {
+	return int64(math.Round(amount * amountScale))
+}
+
+func fromUnits(u int64) float64 {
+	return float64(u) / amountScale
+}
+
+// Asset is a currency or token balances are held in.
+type Asset string
+
+const (
+	USD Asset = "USD"
+	ETH Asset = "ETH"
+	BTC Asset = "BTC"
+)
+
+// AssetPattern is what an asset's symbol may look like.
+var AssetPattern = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// Account is a ledger account: a user's, or one of the exchange's own.
+type Account string
+
+const (
+	// External stands for everything outside the exchange. Deposits move
+	// value from it and withdrawals back to it, so it is the only account
+	// that goes negative: its balance is minus what users hold.
+	External Account = "external"
+	// Fees collects the fees charged on trades, in the asset each side
+	// receives.
+	Fees Account = "fees"
+)
+
+// UserAccount is the account holding user's balances.
+func UserAccount(user uint64) Account {
+	return Account("user:" + strconv.FormatUint(user, 10))
+}
+
+// HeldAccount is the account holding what user has set aside, such as for
+// open orders. It is user's but can't be spent until it is released back to
+// UserAccount.
+func HeldAccount(user uint64) Account {
+	return Account("user:" + strconv.FormatUint(user, 10) + ":held")
+}
+
+// EntryKind is what an entry records.
+type EntryKind string
+
+const (
+	EntryDeposit    EntryKind = "DEPOSIT"
+	EntryWithdrawal EntryKind = "WITHDRAWAL"
+	// EntryTrade is a trade settling, with the fees charged on it.
+	EntryTrade EntryKind = "TRADE"
+	// EntryHold and EntryRelease move a user's funds to and from their
+	// held account.
+	EntryHold    EntryKind = "HOLD"
+	EntryRelease EntryKind = "RELEASE"
+	// EntryReset returns every balance to External, as Reset does.
+	EntryReset EntryKind = "RESET"
+	// EntryTransfer moves funds from one user to another.
+	EntryTransfer EntryKind = "TRANSFER"
+	// EntryFeeWithdrawal pays fees collected out of Fees to a user.
+	EntryFeeWithdrawal EntryKind = "FEE_WITHDRAWAL"
+	// EntryFee is no entry's kind, but that of the lines of a Statement
+	// paying a trade's fees.
+	EntryFee EntryKind = "FEE"
+)
+
+// Posting moves Amount of Asset into Account, or out of it if Amount is
+// negative.
+type Posting struct {
+	Account Account `json:"account"`
+	Asset   Asset   `json:"asset"`
+	Amount  float64 `json:"amount"`
+}
+
+// Entry is one change to the ledger. Its postings sum to zero in each asset
+// and are applied together or not at all. Reference names what it records
+// elsewhere, such as the trade it settles, if anything does. Timestamp is in
+// unix nanoseconds.
+type Entry struct {
+	ID        uint64    `json:"id"`
+	Kind      EntryKind `json:"kind"`
+	Postings  []Posting `json:"postings"`
+	Reference string    `json:"reference,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+var (
+	// ErrUnbalanced is returned by Post for postings that don't sum to zero
+	// in every asset.
+	ErrUnbalanced = errors.New("postings don't balance")
+	// ErrInsufficientFunds is returned by Post for postings that would take
+	// an account other than External below zero.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInvalidAsset      = errors.New("invalid asset")
+	ErrInvalidAmount     = errors.New("amount must be positive")
+)
+
+// RecentEntries is how many of its latest entries a ledger keeps at least.
+// Older ones are dropped: the balances are what the ledger keeps for good.
+const RecentEntries = 10_000
+
+// Ledger holds the balances and the latest entries that changed them. Its
+// methods are safe for concurrent use.
+type Ledger struct {
+	mu       sync.RWMutex
+	clock    clock.Clock
+	balances map[Account]map[Asset]int64
+	// journal holds the latest entries, oldest first, and last is the ID
+	// of the last entry posted
+	journal []Entry
+	last    uint64
+}
+
+// New returns an empty ledger dating entries by clk.
+func New(clk clock.Clock) *Ledger {
+	return &Ledger{
+		clock:    clk,
+		balances: make(map[Account]map[Asset]int64),
+	}
+}
+
+// Post records an entry of kind made of postings, after checking that they
+// balance and leave no account but External overdrawn.
+func (l *Ledger) Post(kind EntryKind, postings ...Posting) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.post(kind, "", postings)
+}
+
+// post is Post, of an entry with reference, with l.mu held.
+func (l *Ledger) post(kind EntryKind, reference string, postings []Posting) (Entry, error) {
+	postings = slices.Clone(postings)
+	sums := make(map[Asset]int64)
+	for i, p := range postings {
+		if !AssetPattern.MatchString(string(p.Asset)) {
+			return Entry{}, fmt.Errorf("%w %q", ErrInvalidAsset, p.Asset)
+		}
+		postings[i].Amount = fromUnits(units(p.Amount))
+		sums[p.Asset] += units(p.Amount)
+	}
+	for asset, sum := range sums {
+		if sum != 0 {
+			return Entry{}, fmt.Errorf("%w: %s is off by %v", ErrUnbalanced, asset, fromUnits(sum))
+		}
+	}
+
+	// net the postings per account first, so an entry may pass through an
+	// account without it having the funds in between
+	net := make(map[Account]map[Asset]int64)
+	for _, p := range postings {
+		if net[p.Account] == nil {
+			net[p.Account] = make(map[Asset]int64)
+		}
+		net[p.Account][p.Asset] += units(p.Amount)
+	}
+	for account, assets := range net {
+		if account == External {
+			continue
+		}
+		for asset, change := range assets {
+			if l.balances[account][asset]+change < 0 {
+				return Entry{}, fmt.Errorf("%w: %s has %v %s", ErrInsufficientFunds, account, fromUnits(l.balances[account][asset]), asset)
+			}
+		}
+	}
+
+	for account, assets := range net {
+		if l.balances[account] == nil {
+			l.balances[account] = make(map[Asset]int64)
+		}
+		for asset, change := range assets {
+			l.balances[account][asset] += change
+			if l.balances[account][asset] == 0 {
+				delete(l.balances[account], asset)
+			}
+		}
+	}
+	l.last++
+	entry := Entry{
+		ID:        l.last,
+		Kind:      kind,
+		Postings:  postings,
+		Reference: reference,
+		Timestamp: l.clock.Now().UnixNano(),
+	}
+	l.keep(entry)
+	return entry, nil
+}
+
+// keep adds entry to the journal, dropping the oldest once it holds twice
+// RecentEntries, so it is only trimmed now and then. The caller holds l.mu.
+func (l *Ledger) keep(entry Entry) {
+	l.journal = append(l.journal, entry)
+	if len(l.journal) >= 2*RecentEntries {
+		l.journal = slices.Delete(l.journal, 0, len(l.journal)-RecentEntries)
+	}
+}
+
+// Deposit credits user with amount of asset brought onto the exchange.
+func (l *Ledger) Deposit(user uint64, asset Asset, amount float64) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	return l.Post(EntryDeposit,
+		Posting{Account: External, Asset: asset, Amount: -amount},
+		Posting{Account: UserAccount(user), Asset: asset, Amount: amount},
+	)
+}
+
+// Withdraw debits user with amount of asset taken off the exchange.
+func (l *Ledger) Withdraw(user uint64, asset Asset, amount float64) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	return l.Post(EntryWithdrawal,
+		Posting{Account: UserAccount(user), Asset: asset, Amount: -amount},
+		Posting{Account: External, Asset: asset, Amount: amount},
+	)
+}
+
+// WithdrawHeld is Withdraw for funds already set aside by Hold, such as a
+// withdrawal waiting to go out.
+func (l *Ledger) WithdrawHeld(user uint64, asset Asset, amount float64) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	return l.Post(EntryWithdrawal,
+		Posting{Account: HeldAccount(user), Asset: asset, Amount: -amount},
+		Posting{Account: External, Asset: asset, Amount: amount},
+	)
+}
+
+// Hold sets amount of user's asset aside. It returns ErrInsufficientFunds if
+// user doesn't have that much free.
+func (l *Ledger) Hold(user uint64, asset Asset, amount float64) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	return l.Post(EntryHold,
+		Posting{Account: UserAccount(user), Asset: asset, Amount: -amount},
+		Posting{Account: HeldAccount(user), Asset: asset, Amount: amount},
+	)
+}
+
+// Release frees amount of user's asset set aside by Hold.
+func (l *Ledger) Release(user uint64, asset Asset, amount float64) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	return l.Post(EntryRelease,
+		Posting{Account: HeldAccount(user), Asset: asset, Amount: -amount},
+		Posting{Account: UserAccount(user), Asset: asset, Amount: amount},
+	)
+}
+
+// Transfer moves amount of asset from one user's free balance to another's,
+// debiting and crediting them in one entry with reference. It never touches
+// what from holds, and returns ErrInsufficientFunds if from doesn't have
+// that much free.
+func (l *Ledger) Transfer(from, to uint64, asset Asset, amount float64, reference string) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.post(EntryTransfer, reference, []Posting{
+		{Account: UserAccount(from), Asset: asset, Amount: -amount},
+		{Account: UserAccount(to), Asset: asset, Amount: amount},
+	})
+}
+
+// WithdrawFees moves amount of asset collected in Fees to user's free
+// balance. It returns ErrInsufficientFunds if Fees doesn't hold that much.
+func (l *Ledger) WithdrawFees(user uint64, asset Asset, amount float64) (Entry, error) {
+	if units(amount) <= 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	return l.Post(EntryFeeWithdrawal,
+		Posting{Account: Fees, Asset: asset, Amount: -amount},
+		Posting{Account: UserAccount(user), Asset: asset, Amount: amount},
+	)
+}
+
+// Trade is a trade to settle: Buyer pays Seller Price for each of Size of
+// Base, in Quote. BuyerFee and SellerFee are what each side pays to Fees out
+// of what it receives: the buyer in Base and the seller in Quote. A zero
+// Buyer or Seller is a party outside the exchange, settled against External.
+// FromHeld pays both sides from what they hold rather than from their free
+// balances, as trades of orders holding funds are. Reference is the entry's.
+type Trade struct {
+	Buyer     uint64
+	Seller    uint64
+	Base      Asset
+	Quote     Asset
+	Price     float64
+	Size      float64
+	BuyerFee  float64
+	SellerFee float64
+	FromHeld  bool
+	Reference string
+}
+
+// Trade records t as one entry: the base moving from seller to buyer, the
+// quote, Notional(Price, Size), from buyer to seller, and both fees to Fees.
+// A fee can't be more than what its side receives.
+func (l *Ledger) Trade(t Trade) (Entry, error) {
+	if units(t.Size) <= 0 || units(t.Price) <= 0 || units(t.BuyerFee) < 0 || units(t.SellerFee) < 0 {
+		return Entry{}, ErrInvalidAmount
+	}
+	notional := Notional(t.Price, t.Size)
+	if units(t.BuyerFee) > units(t.Size) || units(t.SellerFee) > units(notional) {
+		return Entry{}, ErrInvalidAmount
+	}
+	from := func(user uint64) Account {
+		switch {
+		case user == 0:
+			return External
+		case t.FromHeld:
+			return HeldAccount(user)
+		}
+		return UserAccount(user)
+	}
+	to := func(user uint64) Account {
+		if user == 0 {
+			return External
+		}
+		return UserAccount(user)
+	}
+	postings := []Posting{
+		{Account: from(t.Seller), Asset: t.Base, Amount: -t.Size},
+		{Account: to(t.Buyer), Asset: t.Base, Amount: t.Size},
+		{Account: from(t.Buyer), Asset: t.Quote, Amount: -notional},
+		{Account: to(t.Seller), Asset: t.Quote, Amount: notional},
+	}
+	if units(t.BuyerFee) > 0 {
+		postings = append(postings,
+			Posting{Account: to(t.Buyer), Asset: t.Base, Amount: -t.BuyerFee},
+			Posting{Account: Fees, Asset: t.Base, Amount: t.BuyerFee},
+		)
+	}
+	if units(t.SellerFee) > 0 {
+		postings = append(postings,
+			Posting{Account: to(t.Seller), Asset: t.Quote, Amount: -t.SellerFee},
+			Posting{Account: Fees, Asset: t.Quote, Amount: t.SellerFee},
+		)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.post(EntryTrade, t.Reference, postings)
+}
+
+// Round rounds amount to AmountPrecision, as the ledger keeps it, so
+// amounts worked out in floating point compare as the ledger would.
+func Round(amount float64) float64 {
+	return fromUnits(units(amount))
+}
+
+// Fee is rate of amount, rounded down to AmountPrecision, so a fee never
+// comes to more than the rate.
+func Fee(amount, rate float64) float64 {
+	if rate <= 0 {
+		return 0
+	}
+	return fromUnits(int64(math.Floor(float64(units(amount)) * rate)))
+}
+
+// Notional is size at price, rounded down to AmountPrecision: what a trade
+// of size at price settles for.
+func Notional(price, size float64) float64 {
+	return fromUnits(notionalUnits(price, size, false))
+}
+
+// NotionalUp is Notional rounded up instead, so holding it covers trades
+// of size at price or better however they are split.
+func NotionalUp(price, size float64) float64 {
+	return fromUnits(notionalUnits(price, size, true))
+}
+
+// notionalUnits multiplies in units, exactly, so rounding is only ever
+// done once.
+func notionalUnits(price, size float64, up bool) int64 {
+	hi, lo := bits.Mul64(uint64(units(price)), uint64(units(size)))
+	q, r := bits.Div64(hi, lo, uint64(amountScale))
+	if up && r > 0 {
+		q++
+	}
+	return int64(q)
+}
+
+// Reset returns every account's balances to External, as if everything on
+// the exchange had been withdrawn, in one entry. It returns an empty entry,
+// recording nothing, if there is nothing to return.
+func (l *Ledger) Reset() (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var postings []Posting
+	returned := make(map[Asset]int64)
+	for account, assets := range l.balances {
+		if account == External {
+			continue
+		}
+		for asset, u := range assets {
+			postings = append(postings, Posting{Account: account, Asset: asset, Amount: -fromUnits(u)})
+			returned[asset] += u
+		}
+	}
+	if len(postings) == 0 {
+		return Entry{}, nil
+	}
+	for asset, u := range returned {
+		postings = append(postings, Posting{Account: External, Asset: asset, Amount: fromUnits(u)})
+	}
+	// in the same order however the balances were kept
+	slices.SortFunc(postings, func(a, b Posting) int {
+		if a.Account != b.Account {
+			return strings.Compare(string(a.Account), string(b.Account))
+		}
+		return strings.Compare(string(a.Asset), string(b.Asset))
+	})
+	return l.post(EntryReset, "", postings)
+}
+
+// Balance returns account's balance in asset.
+func (l *Ledger) Balance(account Account, asset Asset) float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return fromUnits(l.balances[account][asset])
+}
+
+// Balances returns account's balance in each asset it holds.
+func (l *Ledger) Balances(account Account) map[Asset]float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[Asset]float64, len(l.balances[account]))
+	for asset, u := range l.balances[account] {
+		balances[asset] = fromUnits(u)
+	}
+	return balances
+}
+
+// Entries returns the entries with a posting to account, oldest first.
+func (l *Ledger) Entries(account Account) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entries := []Entry{}
+	for _, entry := range l.journal {
+		for _, p := range entry.Postings {
+			if p.Account == account {
+				entries = append(entries, entry)
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// Line is what one entry changed of an account's balance in one asset:
+// Amount moved in, or out if negative, and the Balance it left. Kind is the
+// entry's, but EntryFee for the fees a trade charged. Entry, Reference and
+// Timestamp are the entry's.
+type Line struct {
+	Entry     uint64    `json:"entry"`
+	Kind      EntryKind `json:"kind"`
+	Asset     Asset     `json:"asset"`
+	Amount    float64   `json:"amount"`
+	Balance   float64   `json:"balance"`
+	Reference string    `json:"reference,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+// Statement returns account's lines in the entries the ledger keeps,
+// oldest first. As long as it keeps all of account's entries, the lines in
+// each asset sum to the balance.
+func (l *Ledger) Statement(account Account) []Line {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	// the balance each line left is worked out back from the balance now
+	balances := make(map[Asset]int64)
+	maps.Copy(balances, l.balances[account])
+	var lines []Line
+	for _, entry := range slices.Backward(l.journal) {
+		var changes []Line
+		for i, p := range entry.Postings {
+			if p.Account != account {
+				continue
+			}
+			kind := entry.Kind
+			// Trade pays each fee into Fees right after taking it
+			if next := i + 1; kind == EntryTrade && next < len(entry.Postings) && entry.Postings[next].Account == Fees && entry.Postings[next].Asset == p.Asset {
+				kind = EntryFee
+			}
+			j := slices.IndexFunc(changes, func(c Line) bool { return c.Kind == kind && c.Asset == p.Asset })
+			if j < 0 {
+				changes = append(changes, Line{Entry: entry.ID, Kind: kind, Asset: p.Asset, Reference: entry.Reference, Timestamp: entry.Timestamp})
+				j = len(changes) - 1
+			}
+			changes[j].Amount += p.Amount
+		}
+		for _, c := range slices.Backward(changes) {
+			c.Amount = fromUnits(units(c.Amount))
+			c.Balance = fromUnits(balances[c.Asset])
+			balances[c.Asset] -= units(c.Amount)
+			lines = append(lines, c)
+		}
+	}
+	slices.Reverse(lines)
+	return lines
+}
+
+// Journal returns the entries the ledger keeps, at least the latest
+// RecentEntries, oldest first.
+func (l *Ledger) Journal() []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return slices.Clone(l.journal)
+}
+
+// State is a ledger's balances, by account and asset, with the entries it
+// keeps and the ID of the last one posted: what restoring it needs, however
+// long its history.
+type State struct {
+	LastID   uint64                        `json:"lastId"`
+	Balances map[Account]map[Asset]float64 `json:"balances,omitempty"`
+	Entries  []Entry                       `json:"entries,omitempty"`
+}
+
+// State returns the ledger's State.
+func (l *Ledger) State() State {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s := State{
+		LastID:   l.last,
+		Balances: make(map[Account]map[Asset]float64, len(l.balances)),
+		Entries:  slices.Clone(l.journal),
+	}
+	for account, assets := range l.balances {
+		if len(assets) == 0 {
+			continue
+		}
+		s.Balances[account] = make(map[Asset]float64, len(assets))
+		for asset, u := range assets {
+			s.Balances[account][asset] = fromUnits(u)
+		}
+	}
+	return s
+}
+
+// Restore loads s, as returned by State, into an empty ledger, after
+// checking that its balances sum to zero in each asset and its entries are
+// in order.
+func (l *Ledger) Restore(s State) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last > 0 {
+		return errors.New("ledger has entries")
+	}
+	sums := make(map[Asset]int64)
+	balances := make(map[Account]map[Asset]int64, len(s.Balances))
+	for account, assets := range s.Balances {
+		for asset, amount := range assets {
+			if units(amount) == 0 {
+				continue
+			}
+			if balances[account] == nil {
+				balances[account] = make(map[Asset]int64)
+			}
+			balances[account][asset] = units(amount)
+			sums[asset] += units(amount)
+		}
+	}
+	for asset, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%w: %s is off by %v", ErrUnbalanced, asset, fromUnits(sum))
+		}
+	}
+	prev := uint64(0)
+	for _, entry := range s.Entries {
+		if entry.ID <= prev || entry.ID > s.LastID {
+			return fmt.Errorf("entry %d is out of order", entry.ID)
+		}
+		prev = entry.ID
+	}
+
+	l.balances = balances
+	l.journal = slices.Clone(s.Entries)
+	l.last = s.LastID
+	return nil
+}
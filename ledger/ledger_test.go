@@ -0,0 +1,218 @@
+package ledger
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+func TestLedger(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	alice, bob := UserAccount(1), UserAccount(2)
+
+	if _, err := l.Deposit(1, USD, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Deposit(2, ETH, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []float64{0, -1, 0.000000001} {
+		if _, err := l.Deposit(1, USD, amount); !errors.Is(err, ErrInvalidAmount) {
+			t.Fatalf("expected ErrInvalidAmount for %v, got %v", amount, err)
+		}
+	}
+	if _, err := l.Deposit(1, "usd", 1); !errors.Is(err, ErrInvalidAsset) {
+		t.Fatalf("expected ErrInvalidAsset, got %v", err)
+	}
+
+	// alice buys 1.5 ETH from bob at 2000.10, each paying a fee out of
+	// what they receive
+	entry, err := l.Trade(Trade{Buyer: 1, Seller: 2, Base: ETH, Quote: USD, Price: 2000.1, Size: 1.5, BuyerFee: 0.003, SellerFee: 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != 3 || entry.Kind != EntryTrade || len(entry.Postings) != 8 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	for _, c := range []struct {
+		account Account
+		asset   Asset
+		want    float64
+	}{
+		{alice, USD, 10_000 - 3000.15},
+		{alice, ETH, 1.497},
+		{bob, USD, 3000.15 - 1.5},
+		{bob, ETH, 1.5},
+		{Fees, USD, 1.5},
+		{Fees, ETH, 0.003},
+		{External, USD, -10_000},
+		{External, ETH, -3},
+	} {
+		if got := l.Balance(c.account, c.asset); got != c.want {
+			t.Fatalf("expected %s to hold %v %s, got %v", c.account, c.want, c.asset, got)
+		}
+	}
+
+	// a failed entry changes nothing
+	if _, err := l.Trade(Trade{Buyer: 1, Seller: 2, Base: ETH, Quote: USD, Price: 2000, Size: 2}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	if _, err := l.Post(EntryDeposit, Posting{Account: alice, Asset: USD, Amount: 1}); !errors.Is(err, ErrUnbalanced) {
+		t.Fatalf("expected ErrUnbalanced, got %v", err)
+	}
+	if got := l.Balance(alice, ETH); got != 1.497 {
+		t.Fatalf("expected alice to still hold 1.497 ETH, got %v", got)
+	}
+	// nor can a fee come to more than its side receives
+	if _, err := l.Trade(Trade{Buyer: 1, Seller: 2, Base: ETH, Quote: USD, Price: 1, Size: 0.1, BuyerFee: 0.2}); !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("expected ErrInvalidAmount, got %v", err)
+	}
+	if got := Fee(3000.15, 0.00033333); got != 1.00003999 {
+		t.Fatalf("expected a fee of 1.00003999, got %v", got)
+	}
+
+	// withdrawing everything leaves no balance behind
+	if _, err := l.Withdraw(2, ETH, 1.5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Withdraw(2, ETH, 0.1); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	balances := l.Balances(bob)
+	if len(balances) != 1 || balances[USD] != 2998.65 {
+		t.Fatalf("unexpected balances %v", balances)
+	}
+	if entries := l.Entries(bob); len(entries) != 3 || entries[2].Kind != EntryWithdrawal {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	// the fees collected can be paid out, but no more than them
+	if _, err := l.WithdrawFees(3, USD, 1.6); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	entry, err = l.WithdrawFees(3, USD, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Kind != EntryFeeWithdrawal || l.Balance(UserAccount(3), USD) != 1.5 || l.Balance(Fees, USD) != 0 {
+		t.Fatalf("expected the fees paid to user 3, got %+v", entry)
+	}
+}
+
+func TestTradeFromHeld(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	l.Deposit(1, USD, 100)
+	if _, err := l.Hold(1, USD, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	// user 1 buys from outside the exchange, paying out of what they hold
+	if _, err := l.Trade(Trade{Buyer: 1, Base: ETH, Quote: USD, Price: 33.33333333, Size: 1.5, FromHeld: true}); err != nil {
+		t.Fatal(err)
+	}
+	if free, held := l.Balance(UserAccount(1), USD), l.Balance(HeldAccount(1), USD); free != 40 || held != 10.00000001 {
+		t.Fatalf("expected 40 free and 10.00000001 held, got %v and %v", free, held)
+	}
+	if got := l.Balance(External, ETH); got != -1.5 {
+		t.Fatalf("expected External to have paid 1.5 ETH, got %v", got)
+	}
+	if _, err := l.Trade(Trade{Buyer: 1, Base: ETH, Quote: USD, Price: 100, Size: 1, FromHeld: true}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+
+	// notionals round down as trades settle and up as they are held
+	if got := Notional(33.33333333, 1.5); got != 49.99999999 {
+		t.Fatalf("expected 49.99999999, got %v", got)
+	}
+	if got := NotionalUp(33.33333333, 1.5); got != 50 {
+		t.Fatalf("expected 50, got %v", got)
+	}
+}
+
+func TestStatement(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	l.Deposit(1, USD, 1000)
+	l.Deposit(2, ETH, 2)
+	l.Hold(1, USD, 500)
+	l.Hold(2, ETH, 1)
+	l.Trade(Trade{Buyer: 1, Seller: 2, Base: ETH, Quote: USD, Price: 400, Size: 1, BuyerFee: 0.01, SellerFee: 2, FromHeld: true, Reference: "ETH:1"})
+	l.Transfer(2, 1, ETH, 0.5, "gift")
+
+	want := []Line{
+		{Entry: 1, Kind: EntryDeposit, Asset: USD, Amount: 1000, Balance: 1000},
+		{Entry: 3, Kind: EntryHold, Asset: USD, Amount: -500, Balance: 500},
+		{Entry: 5, Kind: EntryTrade, Asset: ETH, Amount: 1, Balance: 1, Reference: "ETH:1"},
+		{Entry: 5, Kind: EntryFee, Asset: ETH, Amount: -0.01, Balance: 0.99, Reference: "ETH:1"},
+		{Entry: 6, Kind: EntryTransfer, Asset: ETH, Amount: 0.5, Balance: 1.49, Reference: "gift"},
+	}
+	got := l.Statement(UserAccount(1))
+	for i := range got {
+		got[i].Timestamp = 0
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got statement\n%+v\nwant\n%+v", got, want)
+	}
+	// the seller's fee comes out of the quote they received
+	seller := l.Statement(UserAccount(2))
+	if fee := seller[3]; fee.Kind != EntryFee || fee.Asset != USD || fee.Amount != -2 || fee.Balance != 398 {
+		t.Fatalf("unexpected fee line %+v", fee)
+	}
+}
+
+func TestReset(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	if entry, err := l.Reset(); err != nil || entry.ID != 0 {
+		t.Fatalf("expected nothing to reset, got %+v, %v", entry, err)
+	}
+	l.Deposit(1, USD, 1000)
+	l.Deposit(2, ETH, 2)
+	l.Hold(1, USD, 400)
+
+	entry, err := l.Reset()
+	if err != nil || entry.Kind != EntryReset || len(entry.Postings) != 5 {
+		t.Fatalf("unexpected entry %+v, %v", entry, err)
+	}
+	for _, account := range []Account{UserAccount(1), HeldAccount(1), UserAccount(2), External} {
+		if balances := l.Balances(account); len(balances) != 0 {
+			t.Fatalf("expected %s emptied, got %v", account, balances)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	for range RecentEntries + 5 {
+		if _, err := l.Deposit(1, USD, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Hold(1, USD, 5)
+
+	// the journal is trimmed, but the balances add up to every entry
+	s := l.State()
+	if s.LastID != RecentEntries+6 || len(s.Entries) > 2*RecentEntries || s.Entries[len(s.Entries)-1].ID != s.LastID {
+		t.Fatalf("unexpected state: last %d with %d entries", s.LastID, len(s.Entries))
+	}
+	restored := New(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	if err := restored.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if free, held := restored.Balance(UserAccount(1), USD), restored.Balance(HeldAccount(1), USD); free != RecentEntries || held != 5 {
+		t.Fatalf("expected %d free and 5 held, got %v and %v", RecentEntries, free, held)
+	}
+	if entry, _ := restored.Deposit(2, ETH, 1); entry.ID != s.LastID+1 {
+		t.Fatalf("expected entry %d, got %d", s.LastID+1, entry.ID)
+	}
+	if err := restored.Restore(s); err == nil {
+		t.Fatal("expected a ledger with entries to refuse a restore")
+	}
+
+	// balances that don't sum to zero aren't a ledger
+	s.Balances[External][USD]++
+	if err := New(clock.Real()).Restore(s); !errors.Is(err, ErrUnbalanced) {
+		t.Fatalf("expected ErrUnbalanced, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+func (s *server) handlePatchLimits(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	var body limitsPatchBody
+	if _, err := decodeBody(c, &body); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	patch, err := body.units(format.scale)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	config, err := s.ex.PatchLimits(market, patch)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, marketConfigResponse{MarketConfig: config, format: format})
+}
+
+// handleGetUserLimits reports a user's own limits, which replace the
+// markets' for them.
+func (s *server) handleGetUserLimits(c echo.Context) error {
+	user, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || user == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be a user ID",
+		})
+	}
+
+	return c.JSON(http.StatusOK, s.ex.UserLimits(user))
+}
+
+// handlePutUserLimits replaces a user's own limits, such as to let a VIP
+// account keep more orders open; zero limits return them to the markets'.
+func (s *server) handlePutUserLimits(c echo.Context) error {
+	user, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || user == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be a user ID",
+		})
+	}
+
+	var limits exchange.UserLimits
+	if _, err := decodeBody(c, &limits); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	limits, err = s.ex.SetUserLimits(user, limits)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, limits)
+}
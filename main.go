@@ -1,30 +1,863 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/segmentio/kafka-go"
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/chain"
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/exchangepb"
+	"github.com/thenaveensharma/exchange/fix"
+	"github.com/thenaveensharma/exchange/marketdata"
+	"github.com/thenaveensharma/exchange/multicast"
 	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/remote"
+	"github.com/thenaveensharma/exchange/replica"
+	"github.com/thenaveensharma/exchange/store"
+	"github.com/thenaveensharma/exchange/user"
+	"github.com/thenaveensharma/exchange/wal"
+	"google.golang.org/grpc"
 )
 
 func main() {
+	sandbox := os.Getenv("EXCHANGE_SANDBOX") == "true"
+	cfg := exchange.Config{
+		Sandbox: sandbox,
+		// only demos trade without funds
+		AnonymousOrders: sandbox,
+	}
+	if v := os.Getenv("EXCHANGE_ORDER_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_ORDER_TIMEOUT", "value", v, "error", err)
+			os.Exit(1)
+		}
+		cfg.OrderTimeout = timeout
+	}
+	// markets to run besides the built-in ones, and the tokens behind their
+	// assets
+	if path := os.Getenv("EXCHANGE_MARKET_ASSETS"); path != "" {
+		assets, err := loadMarketAssets(path)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_MARKET_ASSETS", "path", path, "error", err)
+			os.Exit(1)
+		}
+		cfg.Markets = []exchange.Market{exchange.MarketEth, exchange.MarketBtc}
+		for market := range assets {
+			if !slices.Contains(cfg.Markets, market) {
+				cfg.Markets = append(cfg.Markets, market)
+			}
+		}
+		cfg.Assets = assets
+	}
+	// an engine may run only some markets, leaving the others to engines
+	// of their own behind the same gateways
+	if v := os.Getenv("EXCHANGE_MARKETS"); v != "" {
+		markets, err := parseMarkets(v, cfg.Markets)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_MARKETS", "value", v, "error", err)
+			os.Exit(1)
+		}
+		cfg.Markets = markets
+	}
+	// which then hands out order IDs from a range of its own, so they don't
+	// repeat between engines; there are 2^15 of them, keeping IDs within
+	// the signed 64-bit integers databases store them as
+	if v := os.Getenv("EXCHANGE_SHARD_ID"); v != "" {
+		shard, err := strconv.ParseUint(v, 10, 15)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_SHARD_ID", "value", v, "error", err)
+			os.Exit(1)
+		}
+		orderbook.ReserveOrderIDs(shard << 48)
+	}
+	var opts []serverOption
+	if v := os.Getenv("EXCHANGE_BODY_LIMIT"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			slog.Error("invalid EXCHANGE_BODY_LIMIT", "value", v, "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, withBodyLimit(limit))
+	}
+	if v := os.Getenv("EXCHANGE_SESSION_SECRET"); v != "" {
+		opts = append(opts, withSessionSecret([]byte(v)))
+	}
+	adminKey := os.Getenv("EXCHANGE_ADMIN_KEY")
+	// a gateway serves the APIs of engines running in other processes
+	if v := os.Getenv("EXCHANGE_ENGINE_ADDR"); v != "" {
+		addrs, err := parseEngineAddrs(v)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_ENGINE_ADDR", "value", v, "error", err)
+			os.Exit(1)
+		}
+		runGateway(addrs, adminKey, opts)
+		return
+	}
+
+	// every command is journaled before it is applied, so a restart picks up
+	// where the last process left off
+	walPath := os.Getenv("EXCHANGE_WAL_PATH")
+	var journal *wal.Log
+	if walPath != "" {
+		var err error
+		if journal, err = wal.Open(walPath); err != nil {
+			slog.Error("invalid EXCHANGE_WAL_PATH", "path", walPath, "error", err)
+			os.Exit(1)
+		}
+		cfg.Journal = walJournal{journal}
+	}
+	// or, for a standby to take over from, to a log replicated across a
+	// Raft cluster
+	raftID := os.Getenv("EXCHANGE_RAFT_ID")
+	var node *replica.Node
+	if raftID != "" {
+		if walPath != "" {
+			slog.Error("EXCHANGE_RAFT_ID can't be used with EXCHANGE_WAL_PATH")
+			os.Exit(1)
+		}
+		node = newReplica(raftID)
+		cfg.Journal = node
+	}
+	// the database keeping history keeps the audit trail too, so it
+	// outlives the process
+	history := openHistory()
+	if history != nil {
+		cfg.AuditStore = history.(exchange.AuditStore)
+	}
+	ex := exchange.New(cfg)
+	// checkpoints are taken periodically, so a restart only replays the
+	// commands journaled since the last one
+	var checkpoints *checkpointer
+	if path := os.Getenv("EXCHANGE_SNAPSHOT_PATH"); path != "" {
+		if journal == nil {
+			slog.Error("EXCHANGE_SNAPSHOT_PATH requires EXCHANGE_WAL_PATH")
+			os.Exit(1)
+		}
+		checkpoints = &checkpointer{ex: ex, log: journal, path: path}
+		seq, err := checkpoints.restore()
+		if err != nil {
+			slog.Error("invalid EXCHANGE_SNAPSHOT_PATH", "path", path, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("checkpoint restored", "path", path, "seq", seq)
+	}
+	snapshotInterval := time.Minute
+	if v := os.Getenv("EXCHANGE_SNAPSHOT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			slog.Error("invalid EXCHANGE_SNAPSHOT_INTERVAL", "value", v, "error", err)
+			os.Exit(1)
+		}
+		snapshotInterval = interval
+	}
+	// and the latest few kept, with the commands since the oldest, for
+	// operators to look at books as they were
+	if v := os.Getenv("EXCHANGE_SNAPSHOT_RETAIN"); v != "" {
+		retain, err := strconv.Atoi(v)
+		if err != nil || retain <= 0 || checkpoints == nil {
+			slog.Error("invalid EXCHANGE_SNAPSHOT_RETAIN: a positive count with EXCHANGE_SNAPSHOT_PATH", "value", v, "error", err)
+			os.Exit(1)
+		}
+		checkpoints.retain = retain
+	}
+	// orders, trades and candles are kept in a database for users to look
+	// back on. Saving them again is harmless, so unlike what follows they
+	// are recorded from the replay on, which saves those the last process
+	// didn't get to
+	var recorder *store.Recorder
+	if history != nil {
+		recorder = store.NewRecorder(history)
+		candles := resumeCandles(ex, history)
+		recorder.Candles(candles)
+		recorder.Record(ex)
+		opts = append(opts, withHistory(history), withCandles(candles))
+	} else {
+		// the live candles are kept in memory all the same
+		candles := candle.NewAggregator()
+		aggregateCandles(ex, candles)
+		opts = append(opts, withCandles(candles))
+	}
+	if journal != nil {
+		// before anything downstream is told of events, so replayed
+		// commands don't publish them again
+		replayed, err := ex.Replay(journaledCommands(journal))
+		if err != nil {
+			slog.Error("failed to replay EXCHANGE_WAL_PATH", "path", walPath, "replayed", replayed, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("write-ahead log replayed", "path", walPath, "commands", replayed)
+	}
+	if node != nil {
+		// the exchange applies the cluster's commands until this node is
+		// elected, and only then takes requests
+		if err := node.Start(ex); err != nil {
+			slog.Error("failed to start raft node", "id", raftID, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("standing by for raft leadership", "id", raftID)
+		if err := node.Lead(context.Background()); err != nil {
+			slog.Error("raft node failed", "id", raftID, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("leading raft cluster", "id", raftID)
+	}
+	if history != nil {
+		// once the journal's commands are applied, numbering their orders
+		// and trades as they were
+		resumeIDs(ex, history)
+	}
+	// users are kept by the exchange, so they are journaled with it
+	opts = append(opts, withUsers(ex.Users()))
+	switch {
+	case checkpoints != nil:
+		opts = append(opts, withCheckpoints(checkpoints))
+	case journal != nil:
+		// without checkpoints the journal keeps every command
+		opts = append(opts, withCheckpoints(&checkpointer{ex: ex, log: journal}))
+	}
+
+	// downstream systems can follow the exchange's activity on Kafka or NATS
+	// JetStream
+	var kafkaEvents *kafka.Writer
+	if brokers := os.Getenv("EXCHANGE_KAFKA_BROKERS"); brokers != "" {
+		kafkaEvents = &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Balancer:     marketBalancer{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		}
+		prefix := os.Getenv("EXCHANGE_KAFKA_TOPIC_PREFIX")
+		if prefix == "" {
+			prefix = "exchange"
+		}
+		publishToKafka(ex, kafkaEvents, prefix)
+	}
+	var natsConn *nats.Conn
+	if url := os.Getenv("EXCHANGE_NATS_URL"); url != "" {
+		natsConn = newJetStreamPublisher(ex, url)
+	}
+	// and recorded to files, to research and replay
+	var marketData *marketdata.Recorder
+	if dir := os.Getenv("EXCHANGE_MARKETDATA_DIR"); dir != "" {
+		marketData = recordMarketData(ex, dir)
+		opts = append(opts, withMarketData(marketData))
+	}
+	// books are cached in Redis for this process and gateways to serve
+	depth := openDepthCache()
+	if depth != nil {
+		cacheBooks(ex, depth)
+		opts = append(opts, withDepthCache(depth))
+	}
+
+	// a new instance can start from a live one's books instead of empty ones
+	if peer := os.Getenv("EXCHANGE_WARMUP_URL"); peer != "" {
+		peerKey := os.Getenv("EXCHANGE_WARMUP_KEY")
+		if peerKey == "" {
+			peerKey = adminKey
+		}
+		warmUpCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := warmUp(warmUpCtx, ex, http.DefaultClient, peer, peerKey); err != nil {
+			slog.Error("WARM-UP FAILED: starting with empty books and not ready until POST /admin/ready", "peer", peer, "error", err)
+		}
+		cancel()
+	}
+	var watcher *chain.Watcher
+	var addresses *chain.AddressPool
+	if node := os.Getenv("EXCHANGE_ETH_RPC_URL"); node != "" {
+		addresses = loadDepositAddresses(ex)
+		watcher = newDepositWatcher(ex, node, addresses)
+		opts = append(opts, withDepositWatcher(watcher))
+	}
+	var withdrawals *chain.Withdrawals
+	if signer := os.Getenv("EXCHANGE_ETH_SIGNER_URL"); signer != "" {
+		withdrawals = newWithdrawals(ex, signer)
+		opts = append(opts, withWithdrawals(withdrawals))
+	}
+	var sweeper *chain.Sweeper
+	if os.Getenv("EXCHANGE_ETH_COLD_WALLET") != "" {
+		sweeper = newSweeper(ex, addresses)
+		opts = append(opts, withSweeper(sweeper))
+	}
+	var settler *chain.Settler
+	if os.Getenv("EXCHANGE_ETH_SETTLE_ON_CHAIN") == "true" {
+		if sweeper != nil {
+			slog.Error("EXCHANGE_ETH_SETTLE_ON_CHAIN keeps users' funds in their deposit addresses, so it can't be used with EXCHANGE_ETH_COLD_WALLET")
+			os.Exit(1)
+		}
+		settler = newSettler(ex, addresses)
+		opts = append(opts, withSettler(settler))
+	}
+	api, apiOpts := newAPIServers()
+	opts = append(opts, apiOpts...)
+	// gateways in other processes serve the engine's APIs through this one
+	var engineServer *grpc.Server
+	engineAddr := os.Getenv("EXCHANGE_ENGINE_LISTEN_ADDR")
+	if engineAddr != "" {
+		engineServer = grpc.NewServer()
+		remote.Register(engineServer, ex)
+	}
+	// colocated consumers can take market data by multicast, asking the
+	// retransmission address for packets they lost
+	var publisher *multicast.Publisher
+	if group := os.Getenv("EXCHANGE_MULTICAST_ADDR"); group != "" {
+		conn, err := net.Dial("udp", group)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_MULTICAST_ADDR", "value", group, "error", err)
+			os.Exit(1)
+		}
+		defer conn.Close()
+		publisher = multicast.NewPublisher(multicast.PublisherConfig{Conn: conn})
+	}
+	e := newServer(ex, adminKey, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if watcher != nil {
+		go watcher.Run(ctx)
+	}
+	if withdrawals != nil {
+		go withdrawals.Run(ctx)
+	}
+	if sweeper != nil {
+		go sweeper.Run(ctx)
+	}
+	if settler != nil {
+		go settler.Run(ctx)
+	}
+	if checkpoints != nil {
+		go checkpoints.run(ctx, snapshotInterval)
+	}
+	if node != nil {
+		// a leader that stops leading can't tell whether its last commands
+		// were committed, so it shuts down, to stand by again once started
+		go func() {
+			select {
+			case err := <-node.Failed():
+				slog.Error("raft node failed", "id", raftID, "error", err)
+				stop()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	if publisher != nil {
+		go publishMarketData(ctx, ex, publisher)
+	}
+
+	// Start server
+	serveHTTP(e, stop)
+	api.serve(stop)
+	if engineServer != nil {
+		serveGRPC(engineServer, engineAddr, "engine server", stop)
+	}
+	if addr := os.Getenv("EXCHANGE_MULTICAST_RETRANSMIT_ADDR"); publisher != nil && addr != "" {
+		go func() {
+			lis, err := net.Listen("tcp", addr)
+			if err == nil {
+				err = publisher.Serve(lis)
+			}
+			if err != nil && !errors.Is(err, multicast.ErrPublisherClosed) {
+				slog.Error("failed to start multicast retransmission", "error", err)
+				stop()
+			}
+		}()
+	}
+	<-ctx.Done()
+
+	// stop taking requests before the audit trail is flushed, so every
+	// answered request is in it
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down server", "error", err)
+	}
+	api.shutdown(shutdownCtx)
+	if engineServer != nil {
+		// after the local APIs, so gateways' requests are answered as long
+		// as these are
+		stopGRPC(shutdownCtx, engineServer)
+	}
+	if publisher != nil {
+		publisher.Close()
+	}
+	ex.Close()
+	if marketData != nil {
+		marketData.Close()
+	}
+	if checkpoints != nil {
+		// the last one covers every command, so the next start replays none
+		if err := checkpoints.write(); err != nil {
+			slog.Error("failed to write checkpoint", "path", checkpoints.path, "error", err)
+		}
+	}
+	if journal != nil {
+		journal.Close()
+	}
+	if node != nil {
+		node.Shutdown()
+	}
+	if recorder != nil {
+		recorder.Close()
+		history.Close()
+	}
+	if kafkaEvents != nil {
+		kafkaEvents.Close()
+	}
+	if natsConn != nil {
+		natsConn.Close()
+	}
+	if depth != nil {
+		depth.Close()
+	}
+}
+
+// loadDepositAddresses loads the deposit addresses listed in
+// EXCHANGE_ETH_DEPOSIT_ADDRESSES, those ex has given out already staying
+// with their users.
+func loadDepositAddresses(ex *exchange.Exchange) *chain.AddressPool {
+	path := os.Getenv("EXCHANGE_ETH_DEPOSIT_ADDRESSES")
+	if path == "" {
+		slog.Error("EXCHANGE_ETH_DEPOSIT_ADDRESSES is required with EXCHANGE_ETH_RPC_URL")
+		os.Exit(1)
+	}
+	addresses, err := chain.LoadAddressPool(path, ex)
+	if err != nil {
+		slog.Error("invalid EXCHANGE_ETH_DEPOSIT_ADDRESSES", "path", path, "error", err)
+		os.Exit(1)
+	}
+	return addresses
+}
+
+// newDepositWatcher watches the Ethereum node at url for deposits to
+// addresses, crediting them to ex after EXCHANGE_ETH_CONFIRMATIONS blocks.
+// The first time it runs it starts from EXCHANGE_ETH_START_BLOCK, or the
+// chain's head without it; after that from where it left off.
+func newDepositWatcher(ex *exchange.Exchange, url string, addresses *chain.AddressPool) *chain.Watcher {
+	cfg := chain.WatcherConfig{
+		Client:    newNodeClient(url),
+		Addresses: addresses,
+		Exchange:  ex,
+		Tokens:    mustChainTokens(ex),
+	}
+	if v := os.Getenv("EXCHANGE_ETH_START_BLOCK"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			slog.Error("invalid EXCHANGE_ETH_START_BLOCK", "value", v, "error", err)
+			os.Exit(1)
+		}
+		cfg.StartBlock = n
+	}
+	if v := os.Getenv("EXCHANGE_ETH_CONFIRMATIONS"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			slog.Error("invalid EXCHANGE_ETH_CONFIRMATIONS", "value", v, "error", err)
+			os.Exit(1)
+		}
+		cfg.Confirmations = n
+	}
+	return chain.NewWatcher(cfg)
+}
+
+// mustChainTokens is chainTokens, exiting on a token that can't be used.
+func mustChainTokens(ex *exchange.Exchange) []chain.Token {
+	tokens, err := chainTokens(ex)
+	if err != nil {
+		slog.Error("invalid EXCHANGE_MARKET_ASSETS", "error", err)
+		os.Exit(1)
+	}
+	return tokens
+}
+
+// newWithdrawals pays withdrawals from ex out of the hot wallet at
+// EXCHANGE_ETH_HOT_WALLET, signing them through the signer at signerURL and
+// broadcasting them through the node at EXCHANGE_ETH_RPC_URL.
+func newWithdrawals(ex *exchange.Exchange, signerURL string) *chain.Withdrawals {
+	node := os.Getenv("EXCHANGE_ETH_RPC_URL")
+	if node == "" {
+		slog.Error("EXCHANGE_ETH_RPC_URL is required with EXCHANGE_ETH_SIGNER_URL")
+		os.Exit(1)
+	}
+	cfg := chain.WithdrawalConfig{
+		Client:   newNodeClient(node),
+		Signer:   newSigner(signerURL),
+		Exchange: ex,
+		From:     envAddress("EXCHANGE_ETH_HOT_WALLET"),
+		ChainID:  envChainID(),
+		Tokens:   mustChainTokens(ex),
+	}
+	if v := os.Getenv("EXCHANGE_ETH_CONFIRMATIONS"); v != "" {
+		// already checked by newDepositWatcher
+		cfg.Confirmations, _ = strconv.ParseUint(v, 10, 64)
+	}
+	return chain.NewWithdrawals(cfg)
+}
+
+// newSweeper sweeps addresses through the signer at EXCHANGE_ETH_SIGNER_URL
+// to the hot wallet at EXCHANGE_ETH_HOT_WALLET, up to the ceilings in
+// EXCHANGE_ETH_HOT_CEILING, such as "ETH=10,USDC=50000", and the rest to
+// cold storage at EXCHANGE_ETH_COLD_WALLET, every
+// EXCHANGE_ETH_SWEEP_INTERVAL.
+func newSweeper(ex *exchange.Exchange, addresses *chain.AddressPool) *chain.Sweeper {
+	signerURL := os.Getenv("EXCHANGE_ETH_SIGNER_URL")
+	if addresses == nil || signerURL == "" {
+		slog.Error("EXCHANGE_ETH_RPC_URL and EXCHANGE_ETH_SIGNER_URL are required with EXCHANGE_ETH_COLD_WALLET")
+		os.Exit(1)
+	}
+	ceilings, err := parseHotCeilings(os.Getenv("EXCHANGE_ETH_HOT_CEILING"))
+	if err != nil {
+		slog.Error("invalid EXCHANGE_ETH_HOT_CEILING", "error", err)
+		os.Exit(1)
+	}
+	cfg := chain.SweeperConfig{
+		Client:     newNodeClient(os.Getenv("EXCHANGE_ETH_RPC_URL")),
+		Signer:     newSigner(signerURL),
+		Addresses:  addresses,
+		Hot:        envAddress("EXCHANGE_ETH_HOT_WALLET"),
+		Cold:       envAddress("EXCHANGE_ETH_COLD_WALLET"),
+		ChainID:    envChainID(),
+		Tokens:     mustChainTokens(ex),
+		HotCeiling: ceilings,
+	}
+	if v := os.Getenv("EXCHANGE_ETH_SWEEP_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			slog.Error("invalid EXCHANGE_ETH_SWEEP_INTERVAL", "value", v, "error", err)
+			os.Exit(1)
+		}
+		cfg.Interval = interval
+	}
+	return chain.NewSweeper(cfg)
+}
+
+// newSettler mirrors the trades ex settles between users on chain, moving
+// funds between their deposit addresses through the signer at
+// EXCHANGE_ETH_SIGNER_URL.
+func newSettler(ex *exchange.Exchange, addresses *chain.AddressPool) *chain.Settler {
+	signerURL := os.Getenv("EXCHANGE_ETH_SIGNER_URL")
+	if addresses == nil || signerURL == "" {
+		slog.Error("EXCHANGE_ETH_RPC_URL and EXCHANGE_ETH_SIGNER_URL are required with EXCHANGE_ETH_SETTLE_ON_CHAIN")
+		os.Exit(1)
+	}
+	cfg := chain.SettlerConfig{
+		Client:    newNodeClient(os.Getenv("EXCHANGE_ETH_RPC_URL")),
+		Signer:    newSigner(signerURL),
+		Addresses: addresses,
+		ChainID:   envChainID(),
+		Tokens:    mustChainTokens(ex),
+	}
+	if v := os.Getenv("EXCHANGE_ETH_CONFIRMATIONS"); v != "" {
+		// already checked by newDepositWatcher
+		cfg.Confirmations, _ = strconv.ParseUint(v, 10, 64)
+	}
+	settler := chain.NewSettler(cfg)
+	ex.HandleSettlements(func(s exchange.Settlement) {
+		settler.Settle(s.Trade, s.Entry)
+	})
+	return settler
+}
+
+// newJetStreamPublisher publishes ex's events to the NATS server at url,
+// under the subject prefix EXCHANGE_NATS_SUBJECT_PREFIX, "exchange" by
+// default. They are kept in the stream EXCHANGE_NATS_STREAM, "EXCHANGE" by
+// default, for the durable consumers listed in EXCHANGE_NATS_CONSUMERS,
+// such as "archive,risk=exchange.trades.>".
+func newJetStreamPublisher(ex *exchange.Exchange, url string) *nats.Conn {
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		slog.Error("failed to connect to NATS", "url", url, "error", err)
+		os.Exit(1)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		slog.Error("failed to connect to NATS", "url", url, "error", err)
+		os.Exit(1)
+	}
+	prefix := os.Getenv("EXCHANGE_NATS_SUBJECT_PREFIX")
+	if prefix == "" {
+		prefix = "exchange"
+	}
+	stream := os.Getenv("EXCHANGE_NATS_STREAM")
+	if stream == "" {
+		stream = "EXCHANGE"
+	}
+	var consumers []string
+	if v := os.Getenv("EXCHANGE_NATS_CONSUMERS"); v != "" {
+		consumers = strings.Split(v, ",")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := setUpJetStream(ctx, js, stream, prefix, consumers); err != nil {
+		slog.Error("failed to set up JetStream", "error", err)
+		os.Exit(1)
+	}
+	publishToJetStream(ex, js, prefix)
+	return conn
+}
+
+func newNodeClient(url string) *chain.Client {
+	return chain.NewClient(url, &http.Client{Timeout: 10 * time.Second})
+}
+
+// newSigner signs through Clef at url. Clef waits on its operator to
+// approve, so it is given longer than the node.
+func newSigner(url string) chain.Signer {
+	return chain.NewClefSigner(chain.NewClient(url, &http.Client{Timeout: 2 * time.Minute}))
+}
+
+// envAddress is the address in the environment variable name, exiting if
+// it isn't one.
+func envAddress(name string) chain.Address {
+	address, err := chain.ParseAddress(os.Getenv(name))
+	if err != nil {
+		slog.Error("invalid "+name, "error", err)
+		os.Exit(1)
+	}
+	return address
+}
+
+// envChainID is the chain ID in EXCHANGE_ETH_CHAIN_ID, exiting if it isn't
+// one.
+func envChainID() uint64 {
+	chainID, err := strconv.ParseUint(os.Getenv("EXCHANGE_ETH_CHAIN_ID"), 10, 64)
+	if err != nil || chainID == 0 {
+		slog.Error("invalid EXCHANGE_ETH_CHAIN_ID", "value", os.Getenv("EXCHANGE_ETH_CHAIN_ID"), "error", err)
+		os.Exit(1)
+	}
+	return chainID
+}
+
+// server binds an exchange to HTTP.
+type server struct {
+	ex       engine
+	adminKey string
+	users    userStore
+	sessions *user.Sessions
+	// loginNames and loginAddresses throttle logins by name and by client
+	// address
+	loginNames     *user.Throttle
+	loginAddresses *user.Throttle
+	deposits       *chain.Watcher
+	// withdrawals is nil without a signer, and the withdrawal routes aren't
+	// registered
+	withdrawals *chain.Withdrawals
+	// sweeper is nil without cold storage, and the wallet routes aren't
+	// registered
+	sweeper *chain.Sweeper
+	// settler is nil unless trades are settled on chain too
+	settler *chain.Settler
+	// sessionSecret signs session tokens; without one a random secret is
+	// used, and sessions don't outlive the process
+	sessionSecret []byte
+	// bodyLimit bounds request bodies, in bytes; routes taking a whole book
+	// allow batchBodyFactor times as much
+	bodyLimit int64
+	// heartbeat is how often WebSocket clients are pinged
+	heartbeat time.Duration
+	// clock times sessions, login throttles and candles' rollovers
+	clock clock.Clock
+	// grpc is nil unless the gRPC API is served too
+	grpc *grpc.Server
+	// fix is nil unless FIX order entry is served too
+	fix *fix.Acceptor
+	// history is nil unless order history is kept in a database, and the
+	// history routes aren't registered
+	history store.Repository
+	// summaries caches the daily summaries of days over
+	summaries summaryCache
+	// candles is nil unless this process aggregates them, and they are
+	// served as last saved
+	candles *candle.Aggregator
+	// depth is nil unless books are cached in Redis, and they are read from
+	// the engine
+	depth *depthCache
+	// checkpoints is nil unless this process journals the exchange, and
+	// past books can't be rebuilt
+	checkpoints *checkpointer
+	// marketData is nil unless market data is recorded to files, and the
+	// recorder route isn't registered
+	marketData *marketdata.Recorder
+	// scales caches each market's scale, by market
+	scales sync.Map
+}
+
+// serverOption configures a server built by newServer.
+type serverOption func(*server)
+
+// withBodyLimit sets the request body limit; the default is
+// defaultBodyLimit.
+func withBodyLimit(limit int64) serverOption {
+	return func(s *server) {
+		s.bodyLimit = limit
+	}
+}
+
+// withSessionSecret sets the secret session tokens are signed with, so
+// they stay good across restarts and between instances sharing it.
+func withSessionSecret(secret []byte) serverOption {
+	return func(s *server) {
+		s.sessionSecret = secret
+	}
+}
+
+// withClock sets the clock the server goes by; the default is the system
+// clock.
+func withClock(clk clock.Clock) serverOption {
+	return func(s *server) {
+		s.clock = clk
+	}
+}
+
+// newServer builds the Echo instance serving ex. Admin routes require
+// adminKey in the X-Admin-Key header; users authenticate with their API key
+// in X-API-Key or a session token from POST /login as a bearer token. With
+// withGRPC the same users can call the gRPC API.
+func newServer(ex engine, adminKey string, opts ...serverOption) *echo.Echo {
+	s := &server{ex: ex, adminKey: adminKey, users: user.NewRegistry(clock.Real()), bodyLimit: defaultBodyLimit, heartbeat: defaultHeartbeat, clock: clock.Real()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.sessionSecret == nil {
+		s.sessionSecret = make([]byte, 32)
+		rand.Read(s.sessionSecret)
+	}
+	s.sessions = user.NewSessions(s.sessionSecret, user.DefaultSessionTTL, s.clock)
+	s.loginNames = user.NewThrottle(loginNameBurst, loginInterval, s.clock)
+	s.loginAddresses = user.NewThrottle(loginAddressBurst, loginInterval, s.clock)
+	if s.grpc != nil {
+		exchangepb.RegisterExchangeServer(s.grpc, &grpcServer{s: s})
+	}
+	if s.fix != nil {
+		s.fix.Register(&fixApp{s: s})
+	}
+	limitBody := bodyLimit(s.bodyLimit)
+	limitBatchBody := bodyLimit(s.bodyLimit * batchBodyFactor)
+
 	// Echo instance
 	e := echo.New()
-	ex := NewExchange()
+	e.Use(s.authenticate)
 
 	// Routes
 	e.GET("/", handleHealthCheck)
-	e.POST("/order", ex.handlePlaceOrder)
-	e.GET("/book/:market", ex.handleGetBook)
+	e.GET("/ready", s.handleReady)
+	e.POST("/order", s.handlePlaceOrder, limitBody)
+	e.GET("/order/:id", s.handleGetOrder)
+	e.DELETE("/order/:id", s.handleCancelOrder)
+	e.GET("/order/client/:clientOrderId", s.handleGetOrderByClientID)
+	e.DELETE("/order/client/:clientOrderId", s.handleCancelOrderByClientID)
+	e.PUT("/order/:id", s.handleModifyOrder, limitBody)
+	e.POST("/order/:id/reduce", s.handleReduceOrder, limitBody)
+	e.GET("/book/:market", s.handleGetBook)
+	e.GET("/book/:market/stream", s.handleStreamFeed)
+	e.GET("/book/:market/level", s.handleGetLevel)
+	e.GET("/books", s.handleGetBooks)
+	e.GET("/trades/:market", s.handleGetTrades)
+	e.GET("/candles/:market", s.handleGetCandles)
+	e.GET("/ticker/:market/bbo", s.handleGetBBO)
+	e.GET("/ticker/:market/stream", s.handleStreamTicker)
+	e.GET("/ws", s.handleWebSocket)
 
-	// Start server
-	if err := e.Start(":3000"); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("failed to start server", "error", err)
+	e.POST("/users", s.handleRegister, limitBody)
+	e.POST("/login", s.handleLogin, limitBody)
+	me := e.Group("/me", requireUser)
+	me.GET("", s.handleGetMe)
+	me.GET("/orders", s.handleGetMyOrders)
+	me.GET("/trades", s.handleGetMyTrades)
+	me.GET("/key", s.handleGetKeySettings)
+	me.PUT("/key", s.handlePutKeySettings)
+	if s.settler != nil {
+		me.GET("/settlements", s.handleGetMySettlements)
+	}
+	if s.history != nil {
+		me.GET("/history/orders", s.handleGetOrderHistory)
+		me.GET("/history/orders/:id", s.handleGetOrderUpdates)
+		e.GET("/trades/:market/export", s.handleExportTrades, adminOrUser(adminKey))
+	}
+	e.GET("/balances", s.handleGetBalances, requireUser)
+	e.POST("/transfers", s.handleTransfer, adminOrUser(adminKey), limitBody)
+	e.POST("/users/:id/deposits", s.handleUserDeposit, adminOrSelf(adminKey), limitBody)
+	e.POST("/users/:id/withdrawals", s.handleUserWithdrawal, adminOrSelf(adminKey), limitBody)
+	e.GET("/users/:id/ledger", s.handleGetUserLedger, adminOrSelf(adminKey))
+	e.GET("/users/:id/trades", s.handleGetUserTrades, adminOrSelf(adminKey))
+	e.GET("/users/:id/positions", s.handleGetUserPositions, adminOrSelf(adminKey))
+
+	e.GET("/markets/:symbol/auction", s.handleGetAuction)
+	e.GET("/markets/:symbol/quality", s.handleGetQuality)
+	e.GET("/markets/:symbol/stream", s.handleStreamMarket)
+
+	requireAdmin := adminAuth(adminKey)
+	e.POST("/markets/:symbol/auction/execute", s.handleExecuteAuction, requireAdmin)
+	e.PATCH("/markets/:symbol/limits", s.handlePatchLimits, requireAdmin, limitBody)
+	// users may bulk cancel their own orders, operators anyone's
+	e.DELETE("/orders", s.handleCancelOrders, adminOrUser(adminKey))
+
+	admin := e.Group("/admin", requireAdmin)
+	admin.POST("/markets/:symbol/reset", s.handleResetMarket)
+	admin.POST("/markets/:symbol/auction", s.handleStartAuction)
+	admin.GET("/markets/:symbol/export", s.handleExportMarket)
+	if s.checkpoints != nil {
+		admin.GET("/markets/:symbol/book-at", s.handleBookAt)
+	}
+	admin.POST("/markets/:symbol/import", s.handleImportMarket, limitBatchBody)
+	admin.GET("/markets/:symbol/stats", s.handleGetMarketStats)
+	admin.GET("/audit", s.handleQueryAudit)
+	if s.history != nil {
+		admin.GET("/summary", s.handleGetSummary)
 	}
+	admin.GET("/users/:id/limits", s.handleGetUserLimits)
+	admin.PUT("/users/:id/limits", s.handlePutUserLimits, limitBody)
+	admin.POST("/users/:id/suspend", s.handleSuspendUser)
+	admin.POST("/users/:id/resume", s.handleResumeUser)
+	admin.POST("/orders/:id/freeze", s.handleFreezeOrder)
+	admin.POST("/deposits", s.handleDeposit, limitBody)
+	admin.GET("/fees", s.handleGetFees)
+	admin.POST("/fees/withdraw", s.handleWithdrawFees, limitBody)
+	admin.POST("/ready", s.handleSetReady)
 
+	if s.deposits != nil {
+		e.GET("/deposits", s.handleGetDeposits, requireUser)
+		e.GET("/deposits/address", s.handleGetDepositAddress, requireUser)
+	}
+	if s.withdrawals != nil {
+		e.POST("/withdrawals", s.handleRequestWithdrawal, requireUser, limitBody)
+		e.GET("/withdrawals", s.handleGetWithdrawals, requireUser)
+		e.GET("/withdrawals/:id", s.handleGetWithdrawal, requireUser)
+	}
+	if s.marketData != nil {
+		admin.GET("/marketdata", s.handleGetMarketDataStats)
+	}
+	if s.sweeper != nil {
+		admin.GET("/wallets", s.handleGetWallets)
+		admin.GET("/wallets/sweeps", s.handleGetSweeps)
+	}
+
+	// sandbox routes are only registered, and so only reachable, in sandbox mode
+	if ex.Sandbox() {
+		sandbox := e.Group("/sandbox")
+		sandbox.POST("/seed/:market", s.handleSandboxSeed, requireAdmin, limitBody)
+		sandbox.POST("/reset", s.handleSandboxReset, requireAdmin)
+		sandbox.POST("/faucet", s.handleSandboxFaucet, requireUser, limitBody)
+	}
+
+	return e
 }
 
 func handleHealthCheck(c echo.Context) error {
@@ -32,125 +865,554 @@ func handleHealthCheck(c echo.Context) error {
 	return c.JSON(200, "server is alive")
 }
 
-type Market string
+// handleReady answers 503 while the exchange is not ready for traffic, so
+// load balancers keep it out of rotation.
+func (s *server) handleReady(c echo.Context) error {
+	if !s.ex.Ready() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]any{
+			"ready": false,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ready": true,
+	})
+}
 
-const (
-	MarketEth Market = "ETH"
-	MarketBtc Market = "BTC"
-)
+// handleSetReady lets an operator put the exchange into rotation after
+// checking it over, for instance once a failed warm-up has been dealt with.
+func (s *server) handleSetReady(c echo.Context) error {
+	s.ex.SetReady(true)
+	slog.Info("exchange marked ready")
 
-type Exchange struct {
-	orderbooks map[Market]*orderbook.Orderbook
+	return c.JSON(http.StatusOK, map[string]any{
+		"ready": true,
+	})
 }
 
-func NewExchange() *Exchange {
-	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketEth] = orderbook.NewOrderbook()
-	orderbooks[MarketBtc] = orderbook.NewOrderbook()
-	return &Exchange{
-		orderbooks,
+// errorResponse answers a failed exchange call. Rejections are sent whole,
+// with a 504 for those that timed out waiting for the book and a 503 for
+// those that couldn't be journaled; a gateway that can't reach its engine
+// answers 503 too, and anything else is a 400 carrying the error's message.
+func errorResponse(c echo.Context, err error) error {
+	var rejection *exchange.Rejection
+	switch {
+	case errors.As(err, &rejection):
+		status := http.StatusBadRequest
+		switch rejection.Code {
+		case "ENGINE_TIMEOUT", "REQUEST_CANCELLED":
+			status = http.StatusGatewayTimeout
+		case "JOURNAL_FAILED":
+			status = http.StatusServiceUnavailable
+		case "ORDER_NOT_FOUND":
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, rejection)
+	case errors.Is(err, exchange.ErrMarketNotEmpty):
+		return c.JSON(http.StatusConflict, map[string]any{
+			"msg": err.Error(),
+		})
+	case errors.Is(err, remote.ErrUnavailable):
+		return c.JSON(http.StatusServiceUnavailable, map[string]any{
+			"msg": err.Error(),
+		})
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
 	}
 }
 
-type OrderType string
+func (s *server) handlePlaceOrder(c echo.Context) error {
+	var body placeOrderBody
+	raw, err := decodeBody(c, &body)
+	if errors.Is(err, errMalformedBody) {
+		return c.JSON(http.StatusBadRequest, s.ex.RejectMalformed(exchange.AuditPlace, raw, err))
+	}
+	if err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	scale, err := s.requestScale(body.Market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	placeOrderRequest, err := body.units(scale)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditPlace, body.Market, raw, err))
+	}
 
-const (
-	MarketOrder OrderType = "MARKET"
-	LimitOrder  OrderType = "LIMIT"
-)
+	placeOrderRequest.User = callerID(c)
+	if key, ok := callerKey(c); ok && placeOrderRequest.SelfTradePrevention == "" {
+		// authenticate has already refused a key that isn't known
+		settings, _ := s.users.KeySettings(key)
+		placeOrderRequest.SelfTradePrevention = exchange.SelfTradePrevention(settings.SelfTradePrevention)
+	}
+	report, err := s.ex.PlaceOrder(c.Request().Context(), placeOrderRequest)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, struct {
+		Msg string `json:"msg"`
+		executionReportResponse
+	}{"order placed", executionReportResponse{ExecutionReport: report, format: exactFormat(scale)}})
+}
 
-type PlaceOrderRequest struct {
-	Type   OrderType `json:"type"`
-	Bid    bool      `json:"bid"`
-	Size   float64   `json:"size"`
-	Price  float64   `json:"price"`
-	Market Market    `json:"market"`
+// handleGetOrder reports the state of one order by ID, live or recently
+// finished.
+func (s *server) handleGetOrder(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be an order ID",
+		})
+	}
+
+	order, err := s.ex.Order(callerID(c), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return s.orderRecord(c, order)
 }
 
-func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
-	var placeOrderRequest PlaceOrderRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderRequest); err != nil {
-		return err
+// handleGetOrderByClientID is handleGetOrder by the order's client order ID.
+func (s *server) handleGetOrderByClientID(c echo.Context) error {
+	order, err := s.ex.OrderByClientID(callerID(c), c.Param("clientOrderId"))
+	if err != nil {
+		return errorResponse(c, err)
 	}
+	return s.orderRecord(c, order)
+}
 
-	market := Market(placeOrderRequest.Market)
+// orderRecord answers with order's state.
+func (s *server) orderRecord(c echo.Context, order exchange.OrderRecord) error {
+	format, err := s.exactFormat(order.Market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, orderRecordResponse{OrderRecord: order, format: format})
+}
+
+// handleCancelOrder cancels one resting order by ID, in whichever market it
+// rests.
+func (s *server) handleCancelOrder(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		raw, _ := json.Marshal(map[string]string{"id": c.Param("id")})
+		err := errors.New("id must be an order ID")
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditCancel, "", raw, err))
+	}
 
-	ob := ex.orderbooks[market]
+	cancelled, err := s.ex.CancelOrder(c.Request().Context(), callerID(c), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
 
-	order := orderbook.NewOrder(placeOrderRequest.Bid, placeOrderRequest.Size)
+	return s.orderCancelled(c, cancelled)
+}
 
-	if placeOrderRequest.Type == LimitOrder {
-		ob.PlaceLimitOrder(placeOrderRequest.Price, order)
-	} else {
-		ob.PlaceMarketOrder(order)
+// handleCancelOrderByClientID is handleCancelOrder by the order's client
+// order ID.
+func (s *server) handleCancelOrderByClientID(c echo.Context) error {
+	cancelled, err := s.ex.CancelOrderByClientID(c.Request().Context(), callerID(c), c.Param("clientOrderId"))
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
-	return c.JSON(200, map[string]any{
-		"msg":   "order placed",
-		"order": placeOrderRequest,
-	})
+	return s.orderCancelled(c, cancelled)
 }
 
-type Order struct {
-	Price     float64 `json:"price"`
-	Size      float64 `json:"size"`
-	Bid       bool    `json:"bid"`
-	Timestamp int64   `json:"timestamp"`
+// orderCancelled answers with the outcome of cancelling one order.
+func (s *server) orderCancelled(c echo.Context, cancelled exchange.OrderCancel) error {
+	format, err := s.exactFormat(cancelled.Market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":   "order cancelled",
+		"order": orderCancelResponse{OrderCancel: cancelled, format: format},
+	})
 }
-type OrderbookData struct {
-	TotalAskVolume float64  `json:"totolAskVolume"`
-	TotalBidVolume float64  `json:"totolBidVolume"`
-	Asks           []*Order `json:"asks"`
-	Bids           []*Order `json:"bids"`
+
+// handleModifyOrder amends one resting order by ID to the price and size in
+// the body, in whichever market it rests.
+func (s *server) handleModifyOrder(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		raw, _ := json.Marshal(map[string]string{"id": c.Param("id")})
+		err := errors.New("id must be an order ID")
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditModify, "", raw, err))
+	}
+	var body modifyBody
+	raw, err := decodeBody(c, &body)
+	if errors.Is(err, errMalformedBody) {
+		return c.JSON(http.StatusBadRequest, s.ex.RejectMalformed(exchange.AuditModify, raw, err))
+	}
+	if err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	market, format, err := s.orderFormat(c, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	modifyRequest, err := body.units(format.scale)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditModify, market, raw, err))
+	}
+
+	report, err := s.ex.ModifyOrder(c.Request().Context(), callerID(c), id, modifyRequest)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, struct {
+		Msg string `json:"msg"`
+		executionReportResponse
+	}{"order modified", executionReportResponse{ExecutionReport: report, format: format}})
 }
 
-func (ex *Exchange) handleGetBook(c echo.Context) error {
-	market := Market(c.Param("market"))
+// handleReduceOrder shrinks one of the caller's resting orders in place, by
+// or to a size, without losing its place in the queue.
+func (s *server) handleReduceOrder(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		raw, _ := json.Marshal(map[string]string{"id": c.Param("id")})
+		err := errors.New("id must be an order ID")
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditReduce, "", raw, err))
+	}
+	var body reduceBody
+	raw, err := decodeBody(c, &body)
+	if errors.Is(err, errMalformedBody) {
+		return c.JSON(http.StatusBadRequest, s.ex.RejectMalformed(exchange.AuditReduce, raw, err))
+	}
+	if err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	market, format, err := s.orderFormat(c, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	reduceRequest, err := body.units(format.scale)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditReduce, market, raw, err))
+	}
 
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{
-			"msg": "market not found",
-		})
+	reduce, err := s.ex.ReduceOrder(c.Request().Context(), callerID(c), id, reduceRequest)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, struct {
+		Msg string `json:"msg"`
+		orderReduceResponse
+	}{"order reduced", orderReduceResponse{OrderReduce: reduce, format: format}})
+}
+
+// orderFormat returns the market of the caller's order with id, which a
+// request amending it is read in, and how its numbers are rendered. For an
+// ID with no order of the caller's it returns the default scale's, leaving
+// the engine to refuse, and audit, the request.
+func (s *server) orderFormat(c echo.Context, id uint64) (exchange.Market, numberFormat, error) {
+	order, err := s.ex.Order(callerID(c), id)
+	var rejection *exchange.Rejection
+	if errors.As(err, &rejection) {
+		return "", exactFormat(orderbook.DefaultScale), nil
+	}
+	if err != nil {
+		return "", numberFormat{}, err
 	}
+	format, err := s.exactFormat(order.Market)
+	return order.Market, format, err
+}
+
+// snapshotPool recycles the order buffers handleGetBook copies levels into;
+// they are returned once the response has been written.
+var snapshotPool = sync.Pool{
+	New: func() any {
+		s := make([]exchange.Order, 0, 64)
+		return &s
+	},
+}
 
-	orderbookData := OrderbookData{
-		TotalAskVolume: ob.AskTotalVolume(),
-		TotalBidVolume: ob.BidTotalVolume(),
-		Asks:           []*Order{},
-		Bids:           []*Order{},
+func (s *server) handleGetBook(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
 	}
-	for _, limit := range ob.Asks() {
 
-		for _, order := range limit.Orders {
-			o :=
-				Order{
-					Price:     limit.Price,
-					Size:      order.Size,
-					Bid:       order.Bid,
-					Timestamp: order.Timestamp,
-				}
+	asks := snapshotPool.Get().(*[]exchange.Order)
+	bids := snapshotPool.Get().(*[]exchange.Order)
+	defer func() {
+		*asks, *bids = (*asks)[:0], (*bids)[:0]
+		snapshotPool.Put(asks)
+		snapshotPool.Put(bids)
+	}()
+
+	book, err := s.getBook(c.Request().Context(), market, (*asks)[:0], (*bids)[:0])
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	// keep the grown buffers for the next request
+	*asks, *bids = book.Asks, book.Bids
 
-			orderbookData.Asks = append(orderbookData.Asks, &o)
+	return c.JSON(http.StatusOK, bookResponse{OrderbookData: book, format: format})
+}
 
+// adminAuth guards admin routes with a shared key sent in the X-Admin-Key
+// header. With no key configured every admin request is rejected.
+func adminAuth(key string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !isAdmin(c, key) {
+				return unauthorized(c)
+			}
+			return next(c)
 		}
+	}
+}
+
+func (s *server) handleResetMarket(c echo.Context) error {
+	// stats=true also clears the stats trades left, for a market starting
+	// over
+	clearStats := c.QueryParam("stats") == "true"
+	cancelled, sequence, err := s.ex.Reset(exchange.Market(c.Param("symbol")), clearStats)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":       "market reset",
+		"cancelled": cancelled,
+		"sequence":  sequence,
+	})
+}
 
+func (s *server) handleGetAuction(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	state, err := s.ex.Auction(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return s.auctionState(c, market, state)
+}
+
+func (s *server) handleStartAuction(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	state, err := s.ex.StartAuction(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return s.auctionState(c, market, state)
+}
+
+func (s *server) auctionState(c echo.Context, market exchange.Market, state orderbook.AuctionState) error {
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, auctionStateResponse{AuctionState: state, format: format})
+}
+
+func (s *server) handleExecuteAuction(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	fills, err := s.ex.ExecuteAuction(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
 	}
-	for _, limit := range ob.Bids() {
 
-		for _, order := range limit.Orders {
-			o :=
-				Order{
-					Price:     limit.Price,
-					Size:      order.Size,
-					Bid:       order.Bid,
-					Timestamp: order.Timestamp,
-				}
+	var volume orderbook.Size
+	responses := make([]auctionFillResponse, len(fills))
+	for i, fill := range fills {
+		volume += fill.Size
+		responses[i] = auctionFillResponse{AuctionFill: fill, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":    "auction executed",
+		"volume": format.size(volume),
+		"fills":  responses,
+	})
+}
+
+func (s *server) handleExportMarket(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	snapshot, err := s.ex.Export(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, exportResponse{MarketExport: snapshot, format: format})
+}
+
+// handleImportMarket loads a serialized book into a market, as exported with
+// or without its checksum. A market with resting orders is only overwritten
+// with replace=true.
+func (s *server) handleImportMarket(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	var body exportBody
+	if _, err := decodeBody(c, &body); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	scale, err := s.scale(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	snapshot, err := body.units(scale)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	result, err := s.ex.Import(market, snapshot, c.QueryParam("replace") == "true")
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":      "market imported",
+		"sequence": result.Sequence,
+		"checksum": result.Checksum,
+	})
+}
+
+func (s *server) handleGetMarketStats(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+	stats, err := s.ex.Stats(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
 
-			orderbookData.Bids = append(orderbookData.Bids, &o)
+	return c.JSON(http.StatusOK, marketStatsResponse{MarketStats: stats, format: format})
+}
 
+// handleGetQuality reports time-weighted liquidity metrics for a market over
+// the window query parameter, a Go duration defaulting to an hour.
+func (s *server) handleGetQuality(c echo.Context) error {
+	window := time.Hour
+	if v := c.QueryParam("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return errorResponse(c, exchange.ErrInvalidWindow)
 		}
+		window = d
+	}
+
+	quality, err := s.ex.Quality(exchange.Market(c.Param("symbol")), window)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, quality)
+}
 
+func (s *server) handleSandboxSeed(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+	var body seedBody
+	if _, err := decodeBody(c, &body); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	scale, err := s.scale(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	seed, err := body.units(scale)
+	if err != nil {
+		return errorResponse(c, err)
 	}
-	return c.JSON(http.StatusOK, orderbookData)
+
+	orders, err := s.ex.SandboxSeed(market, seed)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":    "market seeded",
+		"orders": orders,
+	})
+}
+
+func (s *server) handleSandboxReset(c echo.Context) error {
+	if err := s.ex.SandboxReset(); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg": "sandbox reset",
+	})
+}
+
+// handleCancelOrders mass-cancels a market's resting orders, on one side if
+// side is given and priced within priceFrom and priceTo, both inclusive, if
+// those are. Orders younger than the market's minimum resting time are kept
+// and listed unless force=true.
+func (s *server) handleCancelOrders(c echo.Context) error {
+	market := exchange.Market(c.QueryParam("market"))
+
+	scale, err := s.requestScale(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	var from, to orderbook.Price
+	var errFrom, errTo error
+	if p := c.QueryParam("priceFrom"); p != "" {
+		from, errFrom = scale.ParsePrice(p)
+	}
+	if p := c.QueryParam("priceTo"); p != "" {
+		to, errTo = scale.ParsePrice(p)
+	}
+	if errFrom != nil || errTo != nil {
+		raw, _ := json.Marshal(map[string]string{
+			"market":    c.QueryParam("market"),
+			"side":      c.QueryParam("side"),
+			"priceFrom": c.QueryParam("priceFrom"),
+			"priceTo":   c.QueryParam("priceTo"),
+		})
+		err := errors.New("priceFrom and priceTo must be numbers within the market's precision")
+		return c.JSON(http.StatusBadRequest, s.ex.RejectInvalid(exchange.AuditCancel, market, raw, err))
+	}
+
+	// only operators may cancel orders younger than the minimum resting time
+	force := c.QueryParam("force") == "true"
+	if force && !isAdmin(c, s.adminKey) {
+		return c.JSON(http.StatusForbidden, map[string]any{
+			"msg": "only operators may force a cancel",
+		})
+	}
+
+	result, err := s.ex.Cancel(c.Request().Context(), exchange.CancelRequest{
+		Market:    market,
+		Owner:     callerID(c),
+		Side:      orderbook.Side(c.QueryParam("side")),
+		PriceFrom: from,
+		PriceTo:   to,
+		Force:     force,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	format := exactFormat(scale)
+	cancelled := make([]cancelledOrderResponse, len(result.Cancelled))
+	for i, o := range result.Cancelled {
+		cancelled[i] = cancelledOrderResponse{CancelledOrder: o, format: format}
+	}
+	kept := make([]keptOrderResponse, len(result.Kept))
+	for i, o := range result.Kept {
+		kept[i] = keptOrderResponse{KeptOrder: o, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":       "orders cancelled",
+		"cancelled": cancelled,
+		"kept":      kept,
+	})
 }
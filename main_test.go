@@ -0,0 +1,4052 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/chain"
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/exchangepb"
+	"github.com/thenaveensharma/exchange/fix"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/multicast"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/remote"
+	"github.com/thenaveensharma/exchange/sbe"
+	"github.com/thenaveensharma/exchange/store"
+	"github.com/thenaveensharma/exchange/wal"
+	"golang.org/x/net/websocket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+const testAdminKey = "test-admin-key"
+
+func doRequest(t *testing.T, e *echo.Echo, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Admin-Key", testAdminKey)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// doUserRequest is doRequest as the user with key, without the admin key.
+func doUserRequest(t *testing.T, e *echo.Echo, key, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// register signs up name and returns its API key.
+func register(t *testing.T, e *echo.Echo, name string) string {
+	t.Helper()
+	rec := doRequest(t, e, http.MethodPost, "/users", `{"name":"`+name+`"}`)
+	var resp struct {
+		APIKey string `json:"apiKey"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusCreated || resp.APIKey == "" {
+		t.Fatalf("failed to register %s: %d %s", name, rec.Code, rec.Body)
+	}
+	return resp.APIKey
+}
+
+// deposit credits user with amount of asset.
+func deposit(t *testing.T, e *echo.Echo, user uint64, asset string, amount float64) {
+	t.Helper()
+	body := fmt.Sprintf(`{"user":%d,"asset":%q,"amount":%v}`, user, asset, amount)
+	if rec := doRequest(t, e, http.MethodPost, "/admin/deposits", body); rec.Code != http.StatusCreated {
+		t.Fatalf("failed to deposit %v %s for user %d: %d %s", amount, asset, user, rec.Code, rec.Body)
+	}
+}
+
+// exportBook returns market's book as the admin export sees it.
+func exportBook(t *testing.T, ex *exchange.Exchange, market exchange.Market) orderbook.Snapshot {
+	t.Helper()
+	export, err := ex.Export(market)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return export.Snapshot
+}
+
+// px and sz are the default scale's units of a decimal price and size.
+func px(v float64) orderbook.Price { return orderbook.DefaultScale.PriceOf(v) }
+func sz(v float64) orderbook.Size  { return orderbook.DefaultScale.SizeOf(v) }
+
+// unitFields are the JSON fields responses write prices and sizes in.
+var unitFields = map[string]bool{
+	"price": true, "size": true, "remaining": true, "filledSize": true,
+	"originalSize": true, "avgPrice": true, "worstPrice": true,
+	"limitPrice": true, "priceImprovement": true, "stopPrice": true,
+	"displaySize": true, "reduced": true, "fillPrice": true, "fillSize": true,
+	"cumulativeSize": true, "averagePrice": true, "totolAskVolume": true,
+	"totolBidVolume": true, "bid": true, "ask": true, "bidSize": true,
+	"askSize": true, "last": true, "volume": true, "imbalance": true,
+	"maxOrderSize": true, "askVolume": true, "bidVolume": true, "hidden": true,
+}
+
+// decodeUnits decodes a response into v, an exchange type, reading the
+// decimals of its price and size fields back into the default scale's
+// units, which keeps as many places for both.
+func decodeUnits(t *testing.T, data []byte, v any) {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	var units func(v any, unit bool) any
+	units = func(v any, unit bool) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				v[k] = units(e, unitFields[k])
+			}
+		case []any:
+			for i, e := range v {
+				v[i] = units(e, unit)
+			}
+		case json.Number:
+			if unit {
+				if p, err := orderbook.DefaultScale.ParsePrice(v.String()); err == nil {
+					return p
+				}
+			}
+		case string:
+			if unit {
+				if p, err := orderbook.DefaultScale.ParsePrice(v); err == nil {
+					return p
+				}
+			}
+		}
+		return v
+	}
+	raw, _ := json.Marshal(units(doc, false))
+	if err := json.Unmarshal(raw, v); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+}
+
+func TestPlaceOrderMetadata(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+
+	rec := doRequest(t, e, http.MethodPost, "/order",
+		`{"type":"LIMIT","bid":false,"size":5,"price":100,"market":"ETH","metadata":{"strategy":"mm-1"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	order := exportBook(t, ex, exchange.MarketEth).Asks[0].Orders[0]
+	if order.Metadata["strategy"] != "mm-1" {
+		t.Fatalf("metadata not stored on the order: %+v", order.Metadata)
+	}
+
+	// public market data never carries metadata
+	rec = doRequest(t, e, http.MethodGet, "/book/ETH", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "mm-1") || strings.Contains(rec.Body.String(), "metadata") {
+		t.Fatalf("book leaks metadata: %s", rec.Body)
+	}
+
+	big := strings.Repeat("x", 300)
+	rec = doRequest(t, e, http.MethodPost, "/order",
+		`{"type":"LIMIT","bid":false,"size":5,"price":101,"market":"ETH","metadata":{"note":"`+big+`"}}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if len(exportBook(t, ex, exchange.MarketEth).Asks) != 1 {
+		t.Fatal("rejected order reached the book")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	e := newServer(exchange.New(exchange.Config{AnonymousOrders: true}), testAdminKey)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/markets/ETH/reset", nil)
+	req.Header.Set("X-Admin-Key", "wrong")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+
+	// no key configured locks the admin routes
+	e = newServer(exchange.New(exchange.Config{AnonymousOrders: true}), "")
+	rec = doRequest(t, e, http.MethodPost, "/admin/markets/ETH/reset", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestResetMarket(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+
+	var resp struct{ Cancelled int }
+	rec := doRequest(t, e, http.MethodPost, "/admin/markets/ETH/reset", "")
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Cancelled != 1 {
+		t.Fatalf("expected the ask cancelled, got %d: %s", rec.Code, rec.Body)
+	}
+	if stats, _ := ex.Stats(exchange.MarketEth); stats.OrdersMatched == 0 {
+		t.Fatalf("expected the stats kept, got %+v", stats.Stats)
+	}
+	doRequest(t, e, http.MethodPost, "/admin/markets/ETH/reset?stats=true", "")
+	if stats, _ := ex.Stats(exchange.MarketEth); stats.OrdersMatched != 0 || stats.OrdersPlaced != 0 {
+		t.Fatalf("expected the stats cleared, got %+v", stats.Stats)
+	}
+}
+
+func TestExportImportMarket(t *testing.T) {
+	source := exchange.New(exchange.Config{AnonymousOrders: true})
+	sourceServer := newServer(source, testAdminKey)
+	for _, body := range []string{
+		`{"type":"LIMIT","bid":false,"size":5,"price":101,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":false,"size":3,"price":101,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":2,"price":99,"market":"ETH"}`,
+	} {
+		doRequest(t, sourceServer, http.MethodPost, "/order", body)
+	}
+
+	export := doRequest(t, sourceServer, http.MethodGet, "/admin/markets/ETH/export", "")
+	if export.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", export.Code, export.Body)
+	}
+
+	target := exchange.New(exchange.Config{AnonymousOrders: true})
+	targetServer := newServer(target, testAdminKey)
+	rec := doRequest(t, targetServer, http.MethodPost, "/admin/markets/ETH/import", export.Body.String())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	sameOrders := func() bool {
+		src, dst := exportBook(t, source, exchange.MarketEth), exportBook(t, target, exchange.MarketEth)
+		return reflect.DeepEqual(src.Asks, dst.Asks) && reflect.DeepEqual(src.Bids, dst.Bids)
+	}
+	if !sameOrders() {
+		t.Fatal("imported book differs from the source")
+	}
+	// listings match; the sequence number moves on with the import
+	var srcBook, dstBook exchange.OrderbookData
+	decodeUnits(t, doRequest(t, sourceServer, http.MethodGet, "/book/ETH?format=number", "").Body.Bytes(), &srcBook)
+	decodeUnits(t, doRequest(t, targetServer, http.MethodGet, "/book/ETH?format=number", "").Body.Bytes(), &dstBook)
+	if !reflect.DeepEqual(srcBook.Asks, dstBook.Asks) || !reflect.DeepEqual(srcBook.Bids, dstBook.Bids) {
+		t.Fatalf("book listings differ:\n%+v\n%+v", srcBook, dstBook)
+	}
+	if dstBook.Sequence <= srcBook.Sequence {
+		t.Fatalf("import did not bump the sequence: %d <= %d", dstBook.Sequence, srcBook.Sequence)
+	}
+
+	// a second import needs replace=true
+	rec = doRequest(t, targetServer, http.MethodPost, "/admin/markets/ETH/import", export.Body.String())
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rec.Code)
+	}
+	rec = doRequest(t, targetServer, http.MethodPost, "/admin/markets/ETH/import?replace=true", export.Body.String())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if !sameOrders() {
+		t.Fatal("replaced book differs from the source")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	// disabled: the routes don't exist
+	e := newServer(exchange.New(exchange.Config{AnonymousOrders: true}), testAdminKey)
+	for _, path := range []string{"/sandbox/seed/ETH", "/sandbox/reset", "/sandbox/faucet"} {
+		rec := doRequest(t, e, http.MethodPost, path, `{}`)
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", path, rec.Code)
+		}
+	}
+
+	ex := exchange.New(exchange.Config{Sandbox: true})
+	e = newServer(ex, testAdminKey)
+	var cancelled int
+	ex.HandleOrderUpdates(func(batch []exchange.OrderUpdate) {
+		for _, u := range batch {
+			if u.Owner == 1 && u.Type == exchange.OrderUpdateCancelled {
+				cancelled++
+			}
+		}
+	})
+
+	// the faucet funds a user to trade with
+	alice := register(t, e, "alice")
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/sandbox/faucet", `{"asset":"USD","amount":5000}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/sandbox/faucet", `{"asset":"USD","amount":5000}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the faucet to need a user, got %d", rec.Code)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":2010,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// seeding is for operators, and crosses alice's bid like any order
+	seed := `{"mid":2000,"step":5,"levels":3,"size":2}`
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/sandbox/seed/ETH", seed); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a user, got %d", rec.Code)
+	}
+	rec := doRequest(t, e, http.MethodPost, "/sandbox/seed/ETH", seed)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	book := exportBook(t, ex, exchange.MarketEth)
+	if len(book.Asks) != 3 || len(book.Bids) != 3 || book.Asks[0].Price != px(2005) || book.Bids[0].Price != px(1995) {
+		t.Fatalf("unexpected seeded book: asks %v bids %v", book.Asks, book.Bids)
+	}
+	if balances := ex.Balances(1); balances[ledger.ETH] != 1 || balances[ledger.USD] != 2990 {
+		t.Fatalf("expected alice's bid settled against the ladder, got %v", balances)
+	}
+
+	// the seeded book is immediately tradeable, and trades settle
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":2005,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if balances := ex.Balances(1); balances[ledger.ETH] != 2 || balances[ledger.USD] != 985 {
+		t.Fatalf("expected alice's buy settled, got %v", balances)
+	}
+	if balances := ex.Balances(exchange.SandboxLiquidityUser); balances[ledger.USD] != 4015 {
+		t.Fatalf("expected the ladder's owner paid, got %v", balances)
+	}
+	if stats, _ := ex.Stats(exchange.MarketEth); stats.AskVolume != sz(4) {
+		t.Fatalf("expected 4 ask volume left, got %v", stats.AskVolume)
+	}
+	if trades, _ := ex.RecentTrades(exchange.MarketEth, 10); len(trades) != 2 {
+		t.Fatalf("expected 2 trades, got %v", trades)
+	}
+
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":0.2,"price":1900,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"STOP_MARKET","bid":true,"size":0.2,"stopPrice":2100,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if held := ex.Held(1); held[ledger.USD] == 0 {
+		t.Fatalf("expected alice's orders to hold USD, got %v", held)
+	}
+
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/sandbox/reset", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a user, got %d", rec.Code)
+	}
+	rec = doRequest(t, e, http.MethodPost, "/sandbox/reset", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	stats, _ := ex.Stats(exchange.MarketEth)
+	if stats.AskOrders != 0 || stats.BidOrders != 0 || stats.OrdersPlaced != 0 {
+		t.Fatalf("sandbox reset left state behind: %+v", stats)
+	}
+	if trades, _ := ex.RecentTrades(exchange.MarketEth, 10); len(trades) != 0 {
+		t.Fatalf("expected the trades forgotten, got %v", trades)
+	}
+	ex.Close()
+	if cancelled != 2 {
+		t.Fatalf("expected alice told of 2 cancelled orders, got %d", cancelled)
+	}
+	if balances, held := ex.Balances(1), ex.Held(1); len(balances) != 0 || len(held) != 0 {
+		t.Fatalf("expected alice's balances wiped, got %v free and %v held", balances, held)
+	}
+	if external := ex.Ledger().Balances(ledger.External); len(external) != 0 {
+		t.Fatalf("expected every balance back with External, got %v", external)
+	}
+}
+
+func TestMaxOpenOrders(t *testing.T) {
+	ex := exchange.New(exchange.Config{
+		AnonymousOrders: true,
+		Limits:          map[exchange.Market]exchange.MarketConfig{exchange.MarketEth: {MaxOpenOrders: 2}},
+	})
+	e := newServer(ex, testAdminKey)
+
+	limitOrder := `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`
+	for i := 0; i < 2; i++ {
+		if rec := doRequest(t, e, http.MethodPost, "/order", limitOrder); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	rec := doRequest(t, e, http.MethodPost, "/order", limitOrder)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"MAX_OPEN_ORDERS"`) {
+		t.Fatalf("expected MAX_OPEN_ORDERS rejection, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// filling a resting order frees a slot
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+	if rec := doRequest(t, e, http.MethodPost, "/order", limitOrder); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// other markets are unaffected
+	if rec := doRequest(t, e, http.MethodPost, "/order", strings.Replace(limitOrder, "ETH", "BTC", 1)); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMaxUserOpenOrders(t *testing.T) {
+	ex := exchange.New(exchange.Config{
+		AnonymousOrders: true,
+		Limits:          map[exchange.Market]exchange.MarketConfig{exchange.MarketEth: {MaxUserOpenOrders: 2}},
+	})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "ETH", 10)
+	deposit(t, e, 2, "ETH", 10)
+
+	ask := `{"type":"LIMIT","bid":false,"size":1,"price":2100,"market":"ETH"}`
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		rec := doUserRequest(t, e, alice, http.MethodPost, "/order", ask)
+		var report exchange.ExecutionReport
+		decodeUnits(t, rec.Body.Bytes(), &report)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		ids = append(ids, report.OrderID)
+	}
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/order", ask)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"MAX_OPEN_ORDERS"`) {
+		t.Fatalf("expected MAX_OPEN_ORDERS rejection, got %d: %s", rec.Code, rec.Body)
+	}
+	// the cap is each user's own
+	if rec := doUserRequest(t, e, bob, http.MethodPost, "/order", ask); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for bob, got %d: %s", rec.Code, rec.Body)
+	}
+	// an order that fills completely never rests, so the cap lets it in
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":2000,"market":"ETH"}`)
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a matching order, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// cancelling one frees a slot
+	if rec := doUserRequest(t, e, alice, http.MethodDelete, fmt.Sprintf("/order/%d", ids[0]), ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", ask); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// a VIP override replaces the market's cap for that user
+	rec = doRequest(t, e, http.MethodPut, "/admin/users/1/limits", `{"maxOpenOrders":3}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", ask); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 under the override, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = doUserRequest(t, e, alice, http.MethodPost, "/order", ask)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"limit":3`) {
+		t.Fatalf("expected the override's cap, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = doRequest(t, e, http.MethodGet, "/admin/users/1/limits", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"maxOpenOrders":3`) {
+		t.Fatalf("unexpected limits %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPut, "/admin/users/1/limits", `{"maxOpenOrders":100}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a user, got %d", rec.Code)
+	}
+}
+
+func TestKeySelfTradePrevention(t *testing.T) {
+	ex := exchange.New(exchange.Config{})
+	e := newServer(ex, testAdminKey)
+	alice := register(t, e, "alice")
+	deposit(t, e, 1, "ETH", 10)
+	deposit(t, e, 1, "USD", 10000)
+
+	rec := doUserRequest(t, e, alice, http.MethodPut, "/me/key", `{"selfTradePrevention":"CANCEL_ALL"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown mode, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = doUserRequest(t, e, alice, http.MethodPut, "/me/key", `{"selfTradePrevention":"CANCEL_OLDEST"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = doUserRequest(t, e, alice, http.MethodGet, "/me/key", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"selfTradePrevention":"CANCEL_OLDEST"`) {
+		t.Fatalf("unexpected key settings %d: %s", rec.Code, rec.Body)
+	}
+
+	ask := `{"type":"LIMIT","bid":false,"size":1,"price":2000,"market":"ETH"}`
+	bid := `{"type":"LIMIT","bid":true,"size":1,"price":2000,"market":"ETH"%s}`
+	doUserRequest(t, e, alice, http.MethodPost, "/order", ask)
+	// an order that names a mode keeps it over the key's
+	rec = doUserRequest(t, e, alice, http.MethodPost, "/order", fmt.Sprintf(bid, `,"selfTradePrevention":"CANCEL_NEWEST"`))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"rested":false`) {
+		t.Fatalf("expected the buy dropped, got %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); len(book.Asks) != 1 {
+		t.Fatalf("expected alice's ask kept, got %+v", book)
+	}
+	// one that doesn't takes the key's, cancelling the ask and resting
+	rec = doUserRequest(t, e, alice, http.MethodPost, "/order", fmt.Sprintf(bid, ""))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"rested":true`) {
+		t.Fatalf("expected the buy rested, got %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); len(book.Asks) != 0 || len(book.Bids) != 1 {
+		t.Fatalf("expected only alice's bid, got %+v", book)
+	}
+}
+
+func TestSuspendAndFreezeRoutes(t *testing.T) {
+	ex := exchange.New(exchange.Config{})
+	e := newServer(ex, testAdminKey)
+	alice := register(t, e, "alice")
+	deposit(t, e, 1, "ETH", 10)
+
+	ask := `{"type":"LIMIT","bid":false,"size":1,"price":2000,"market":"ETH"}`
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/order", ask)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var placed struct {
+		OrderID uint64 `json:"orderId"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &placed)
+	rec = doRequest(t, e, http.MethodPost, fmt.Sprintf("/admin/orders/%d/freeze", placed.OrderID), "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"frozen":true`) {
+		t.Fatalf("unexpected freeze %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/admin/orders/999/freeze", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown order, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, e, http.MethodPost, "/admin/users/1/suspend?cancel=true", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), fmt.Sprintf(`"id":%d`, placed.OrderID)) {
+		t.Fatalf("unexpected suspension %d: %s", rec.Code, rec.Body)
+	}
+	rec = doUserRequest(t, e, alice, http.MethodPost, "/order", ask)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "USER_SUSPENDED") {
+		t.Fatalf("expected USER_SUSPENDED, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/admin/users/1/resume", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a user, got %d", rec.Code)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/admin/users/1/resume", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", ask); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 once resumed, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGetLevel(t *testing.T) {
+	ex := exchange.New(exchange.Config{})
+	e := newServer(ex, testAdminKey)
+	alice := register(t, e, "alice")
+	bob := register(t, e, "bob")
+	deposit(t, e, 1, "ETH", 10)
+	deposit(t, e, 2, "ETH", 10)
+
+	var ids []uint64
+	for i, key := range []string{alice, bob, alice} {
+		ask := fmt.Sprintf(`{"type":"LIMIT","bid":false,"size":%d,"price":2000,"market":"ETH"}`, i+1)
+		rec := doUserRequest(t, e, key, http.MethodPost, "/order", ask)
+		var placed struct {
+			OrderID uint64 `json:"orderId"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &placed)
+		ids = append(ids, placed.OrderID)
+	}
+
+	type level struct {
+		Orders []struct {
+			ID        uint64   `json:"id"`
+			Hash      string   `json:"hash"`
+			Owner     uint64   `json:"owner"`
+			Size      float64  `json:"size"`
+			Own       bool     `json:"own"`
+			Position  *int     `json:"position"`
+			SizeAhead *float64 `json:"sizeAhead"`
+		} `json:"orders"`
+	}
+	get := func(rec *httptest.ResponseRecorder) level {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var l level
+		json.Unmarshal(rec.Body.Bytes(), &l)
+		return l
+	}
+	path := "/book/ETH/level?side=ask&price=2000&format=number"
+
+	l := get(doUserRequest(t, e, bob, http.MethodGet, path, ""))
+	if len(l.Orders) != 3 {
+		t.Fatalf("expected 3 orders, got %+v", l)
+	}
+	for _, i := range []int{0, 2} {
+		if o := l.Orders[i]; o.ID != 0 || o.Hash == "" || o.Position != nil || o.Own {
+			t.Fatalf("expected alice's order %d redacted, got %+v", i, o)
+		}
+	}
+	if o := l.Orders[1]; o.ID != ids[1] || !o.Own || *o.Position != 1 || *o.SizeAhead != 1 {
+		t.Fatalf("unexpected own order %+v", o)
+	}
+
+	doUserRequest(t, e, alice, http.MethodDelete, fmt.Sprintf("/order/%d", ids[0]), "")
+	l = get(doUserRequest(t, e, bob, http.MethodGet, path, ""))
+	if len(l.Orders) != 2 || *l.Orders[0].Position != 0 || *l.Orders[0].SizeAhead != 0 {
+		t.Fatalf("expected bob's order first once alice's is cancelled, got %+v", l)
+	}
+	l = get(doRequest(t, e, http.MethodGet, path, ""))
+	if o := l.Orders[1]; o.ID != ids[2] || o.Owner != 1 || *o.Position != 1 || *o.SizeAhead != 2 {
+		t.Fatalf("expected an operator to see alice's order, got %+v", o)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/book/ETH/level?side=both&price=2000", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown side, got %d", rec.Code)
+	}
+}
+
+func TestTickerBBO(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":101,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":3,"price":101,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":4,"price":99,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+
+	rec := doRequest(t, e, http.MethodGet, "/ticker/ETH/bbo?format=number", "")
+	var ticker exchange.Ticker
+	decodeUnits(t, rec.Body.Bytes(), &ticker)
+	if ticker.Bid != px(99) || ticker.BidSize != sz(4) || ticker.Ask != px(101) || ticker.AskSize != sz(4) || ticker.Last != px(101) {
+		t.Fatalf("unexpected ticker %+v", ticker)
+	}
+	if seq := exportBook(t, ex, exchange.MarketEth).Sequence; ticker.Seq != seq {
+		t.Fatalf("expected seq %d, got %d", seq, ticker.Seq)
+	}
+}
+
+func TestMarketLimits(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+
+	rec := doRequest(t, e, http.MethodPatch, "/markets/ETH/limits", `{"maxOrderSize":10,"maxNotional":5000,"maxPriceDeviation":0.1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// with an empty book there is no reference price, so any price passes
+	// the band check
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":1000,"market":"ETH"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 without a reference price, got %d: %s", rec.Code, rec.Body)
+	}
+	// a one-sided book has no mid and no trades yet either
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 without a reference price, got %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name  string
+		body  string
+		code  string
+		limit float64
+	}{
+		{"size", `{"type":"LIMIT","bid":false,"size":11,"price":600,"market":"ETH"}`, "MAX_ORDER_SIZE", 10},
+		{"notional", `{"type":"LIMIT","bid":false,"size":9,"price":600,"market":"ETH"}`, "MAX_NOTIONAL", 5000},
+		// mid is 550, so 10% allows 495 to 605
+		{"band above", `{"type":"LIMIT","bid":false,"size":1,"price":606,"market":"ETH"}`, "PRICE_OUT_OF_BAND", 0.1},
+		{"band below", `{"type":"LIMIT","bid":true,"size":1,"price":494,"market":"ETH"}`, "PRICE_OUT_OF_BAND", 0.1},
+		{"market notional", `{"type":"MARKET","bid":true,"size":10,"market":"ETH"}`, "MAX_NOTIONAL", 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, e, http.MethodPost, "/order", tt.body)
+			var rejection exchange.Rejection
+			if err := json.Unmarshal(rec.Body.Bytes(), &rejection); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusBadRequest || rejection.Code != tt.code || rejection.Limit != tt.limit {
+				t.Fatalf("expected %s rejection with limit %v, got %d: %s", tt.code, tt.limit, rec.Code, rec.Body)
+			}
+		})
+	}
+
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":600,"market":"ETH"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 within limits, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// loosening a cap at runtime takes effect immediately
+	doRequest(t, e, http.MethodPatch, "/markets/ETH/limits", `{"maxOrderSize":0}`)
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":11,"price":600,"market":"ETH"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "MAX_NOTIONAL") {
+		t.Fatalf("expected only the notional cap to apply, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGetBookConsistentUnderFills(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":3,"price":101,"market":"ETH"}`)
+			doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":99,"market":"ETH"}`)
+			doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1.5,"market":"ETH"}`)
+			doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":1,"market":"ETH"}`)
+		}
+	}()
+
+	sum := func(orders []exchange.Order) orderbook.Size {
+		var total orderbook.Size
+		for _, o := range orders {
+			total += o.Size
+		}
+		return total
+	}
+
+	var last uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		var book exchange.OrderbookData
+		decodeUnits(t, doRequest(t, e, http.MethodGet, "/book/ETH", "").Body.Bytes(), &book)
+		if book.Sequence < last {
+			t.Fatalf("sequence went backwards: %d after %d", book.Sequence, last)
+		}
+		last = book.Sequence
+		if sum(book.Asks) != book.TotalAskVolume || sum(book.Bids) != book.TotalBidVolume {
+			t.Fatalf("torn book response: %+v", book)
+		}
+	}
+}
+
+func TestOrderSizesInResponses(t *testing.T) {
+	e := newServer(exchange.New(exchange.Config{AnonymousOrders: true}), testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":10,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":4,"market":"ETH"}`)
+
+	var book exchange.OrderbookData
+	decodeUnits(t, doRequest(t, e, http.MethodGet, "/book/ETH?format=number", "").Body.Bytes(), &book)
+	if len(book.Asks) != 1 || book.Asks[0].Size != sz(6) || book.Asks[0].OriginalSize != sz(10) || book.Asks[0].FilledSize != sz(4) {
+		t.Fatalf("unexpected resting order %+v", book.Asks)
+	}
+
+	rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":8,"price":100,"market":"ETH"}`)
+	var placed struct {
+		OriginalSize float64 `json:"originalSize"`
+		Remaining    float64 `json:"remaining"`
+		FilledSize   float64 `json:"filledSize"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &placed)
+	if placed.OriginalSize != 8 || placed.Remaining != 2 || placed.FilledSize != 6 {
+		t.Fatalf("unexpected placement result %+v", placed)
+	}
+}
+
+func TestMarketScale(t *testing.T) {
+	ex := exchange.New(exchange.Config{
+		AnonymousOrders: true,
+		Limits:          map[exchange.Market]exchange.MarketConfig{exchange.MarketEth: {Scale: orderbook.Scale{Price: 2, Size: 3}}},
+	})
+	e := newServer(ex, testAdminKey)
+
+	// decimals are read exactly in the market's units
+	rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1.5,"price":2000.25,"market":"ETH"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); book.Asks[0].Price != 200025 || book.Asks[0].Orders[0].Size != 1500 {
+		t.Fatalf("unexpected book %+v", book.Asks)
+	}
+	if !strings.Contains(rec.Body.String(), `"price":2000.25`) || !strings.Contains(rec.Body.String(), `"remaining":1.5`) {
+		t.Fatalf("expected the order written back as decimals, got %s", rec.Body)
+	}
+
+	// more places than the market keeps are refused rather than rounded
+	for _, body := range []string{
+		`{"type":"LIMIT","bid":false,"size":1,"price":2000.255,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":false,"size":0.0005,"price":2000,"market":"ETH"}`,
+	} {
+		rec := doRequest(t, e, http.MethodPost, "/order", body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INVALID_REQUEST") || !strings.Contains(rec.Body.String(), "too many decimal places") {
+			t.Fatalf("expected %s refused, got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestCancelOrdersByPriceRange(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	for _, price := range []string{"2050", "2100", "2150", "2200", "2250"} {
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":`+price+`,"market":"ETH"}`)
+	}
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2100,"market":"BTC"}`)
+
+	rec := doRequest(t, e, http.MethodDelete, "/orders?market=ETH&side=ask&priceFrom=2100&priceTo=2200", "")
+	var resp struct {
+		Cancelled []exchange.CancelledOrder `json:"cancelled"`
+	}
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || len(resp.Cancelled) != 3 || resp.Cancelled[0].Price != px(2100) || resp.Cancelled[2].Price != px(2200) || resp.Cancelled[0].Remaining != sz(1) {
+		t.Fatalf("unexpected cancel result %d: %s", rec.Code, rec.Body)
+	}
+	if len(exportBook(t, ex, exchange.MarketEth).Asks) != 2 || len(exportBook(t, ex, exchange.MarketBtc).Asks) != 1 {
+		t.Fatal("cancelled orders outside the range or market")
+	}
+
+	rec = doRequest(t, e, http.MethodDelete, "/orders?market=ETH&side=ask&priceFrom=3000&priceTo=3100", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"cancelled":[]`) {
+		t.Fatalf("expected an empty list, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCancelAllOrders(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	for _, price := range []string{"2050", "2100", "2150"} {
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":`+price+`,"market":"ETH"}`)
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":`+price+`,"market":"ETH"}`)
+	}
+	for _, price := range []string{"1900", "1950"} {
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":`+price+`,"market":"ETH"}`)
+	}
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":30000,"market":"BTC"}`)
+
+	var resp struct {
+		Cancelled []exchange.CancelledOrder `json:"cancelled"`
+	}
+	rec := doRequest(t, e, http.MethodDelete, "/orders?market=ETH&side=bid", "")
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || len(resp.Cancelled) != 2 || resp.Cancelled[0].Price != px(1950) {
+		t.Fatalf("unexpected cancel result %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); len(book.Bids) != 0 || len(book.Asks) != 3 {
+		t.Fatalf("expected only the bids cancelled, got %+v", book)
+	}
+
+	// without a side both are cleared
+	rec = doRequest(t, e, http.MethodDelete, "/orders?market=ETH", "")
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || len(resp.Cancelled) != 6 {
+		t.Fatalf("unexpected cancel result %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); len(book.Asks) != 0 {
+		t.Fatalf("expected an empty book, got %+v", book)
+	}
+	if len(exportBook(t, ex, exchange.MarketBtc).Bids) != 1 {
+		t.Fatal("cancelled orders in another market")
+	}
+}
+
+func TestCancelOrderByID(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":30000,"market":"BTC"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":0.5,"market":"BTC"}`)
+	id := exportBook(t, ex, exchange.MarketBtc).Bids[0].Orders[0].ID
+
+	// the order is found in whichever market it rests
+	rec := doRequest(t, e, http.MethodDelete, fmt.Sprintf("/order/%d", id), "")
+	var resp struct {
+		Order exchange.OrderCancel `json:"order"`
+	}
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	want := exchange.OrderCancel{
+		CancelledOrder: exchange.CancelledOrder{ID: id, Price: px(30000), Remaining: sz(1.5), Bid: true, Timestamp: resp.Order.Timestamp},
+		Market:         exchange.MarketBtc,
+		FilledSize:     sz(0.5),
+		Status:         exchange.OrderCancelled,
+	}
+	if rec.Code != http.StatusOK || resp.Order != want {
+		t.Fatalf("expected %+v, got %d: %s", want, rec.Code, rec.Body)
+	}
+	if len(exportBook(t, ex, exchange.MarketBtc).Bids) != 0 || len(exportBook(t, ex, exchange.MarketEth).Asks) != 1 {
+		t.Fatal("expected only the BTC bid to be cancelled")
+	}
+
+	rec = doRequest(t, e, http.MethodDelete, fmt.Sprintf("/order/%d", id), "")
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "ORDER_NOT_FOUND") {
+		t.Fatalf("expected 404 for a cancelled order, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodDelete, "/order/abc", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad id, got %d", rec.Code)
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	var placed exchange.ExecutionReport
+	rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":2100,"market":"ETH"}`)
+	decodeUnits(t, rec.Body.Bytes(), &placed)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":0.5,"market":"ETH"}`)
+
+	var order exchange.OrderRecord
+	rec = doRequest(t, e, http.MethodGet, fmt.Sprintf("/order/%d", placed.OrderID), "")
+	decodeUnits(t, rec.Body.Bytes(), &order)
+	if rec.Code != http.StatusOK || order.Status != exchange.OrderPartiallyFilled || order.FilledSize != sz(0.5) || order.AvgPrice != px(2100) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+
+	doRequest(t, e, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), "")
+	rec = doRequest(t, e, http.MethodGet, fmt.Sprintf("/order/%d", placed.OrderID), "")
+	decodeUnits(t, rec.Body.Bytes(), &order)
+	if rec.Code != http.StatusOK || order.Status != exchange.OrderCancelled || order.Remaining != sz(1.5) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, fmt.Sprintf("/order/%d", placed.OrderID+100), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown order, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/order/abc", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad id, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestClientOrderID(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	body := `{"type":"LIMIT","bid":false,"size":2,"price":2100,"market":"ETH","clientOrderId":"mm-1"}`
+	var placed exchange.ExecutionReport
+	rec := doRequest(t, e, http.MethodPost, "/order", body)
+	decodeUnits(t, rec.Body.Bytes(), &placed)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// a retry of the same request is refused rather than placed twice
+	rec = doRequest(t, e, http.MethodPost, "/order", body)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "DUPLICATE_CLIENT_ORDER_ID") {
+		t.Fatalf("expected DUPLICATE_CLIENT_ORDER_ID, got %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); len(book.Asks[0].Orders) != 1 {
+		t.Fatalf("expected one order, got %+v", book.Asks)
+	}
+
+	var order exchange.OrderRecord
+	rec = doRequest(t, e, http.MethodGet, "/order/client/mm-1", "")
+	decodeUnits(t, rec.Body.Bytes(), &order)
+	if rec.Code != http.StatusOK || order.ID != placed.OrderID || order.ClientOrderID != "mm-1" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodDelete, "/order/client/mm-1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodDelete, "/order/client/mm-1", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 once cancelled, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/order/client/mm-2", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown client order ID, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// an order that is refused leaves its client order ID free
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":5,"market":"ETH","clientOrderId":"mm-2"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":2000,"market":"ETH","clientOrderId":"mm-2"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "ETH", 2)
+	deposit(t, e, 2, "ETH", 1)
+	deposit(t, e, 2, "USD", 5000)
+	if rec := doRequest(t, e, http.MethodPost, "/users", `{"name":"alice"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a taken name, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/users", `{"name":"a b"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad name, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, "nope", http.MethodGet, "/book/ETH", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown key, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/me/orders", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a key, got %d: %s", rec.Code, rec.Body)
+	}
+	var me struct {
+		ID   uint64 `json:"id"`
+		Name string `json:"name"`
+	}
+	rec := doUserRequest(t, e, alice, http.MethodGet, "/me", "")
+	decodeUnits(t, rec.Body.Bytes(), &me)
+	if rec.Code != http.StatusOK || me.Name != "alice" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+
+	// both may use the same client order ID, and the user in the body is
+	// ignored
+	var placed exchange.ExecutionReport
+	rec = doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":2100,"market":"ETH","clientOrderId":"x","user":99}`)
+	decodeUnits(t, rec.Body.Bytes(), &placed)
+	if rec.Code != http.StatusOK || placed.Order.User != me.ID {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2200,"market":"ETH","clientOrderId":"x"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// nobody else can see, amend or cancel alice's order
+	path := fmt.Sprintf("/order/%d", placed.OrderID)
+	for _, rec := range []*httptest.ResponseRecorder{
+		doUserRequest(t, e, bob, http.MethodGet, path, ""),
+		doUserRequest(t, e, bob, http.MethodPut, path, `{"price":2100,"size":1}`),
+		doUserRequest(t, e, bob, http.MethodDelete, path, ""),
+		doRequest(t, e, http.MethodDelete, path, ""),
+	} {
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	// bob takes part of alice's order
+	doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":0.5,"market":"ETH"}`)
+	var trades struct {
+		Trades []exchange.Fill `json:"trades"`
+	}
+	rec = doUserRequest(t, e, alice, http.MethodGet, "/me/trades", "")
+	decodeUnits(t, rec.Body.Bytes(), &trades)
+	if len(trades.Trades) != 1 || trades.Trades[0].OrderID != placed.OrderID || !trades.Trades[0].Maker || trades.Trades[0].Size != sz(0.5) {
+		t.Fatalf("unexpected trades %s", rec.Body)
+	}
+	rec = doUserRequest(t, e, bob, http.MethodGet, "/me/trades", "")
+	decodeUnits(t, rec.Body.Bytes(), &trades)
+	if len(trades.Trades) != 1 || trades.Trades[0].Maker || !trades.Trades[0].Bid {
+		t.Fatalf("unexpected trades %s", rec.Body)
+	}
+
+	// a user can't force a cancel past the minimum resting time
+	if rec := doUserRequest(t, e, bob, http.MethodDelete, "/orders?market=ETH&force=true", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a forced cancel by a user refused, got %d: %s", rec.Code, rec.Body)
+	}
+	// a bulk cancel by a user only takes their own orders
+	rec = doUserRequest(t, e, bob, http.MethodDelete, "/orders?market=ETH", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"price":2200`) || strings.Contains(rec.Body.String(), `"price":2100`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	var orders struct {
+		Orders []exchange.OrderRecord `json:"orders"`
+	}
+	rec = doUserRequest(t, e, bob, http.MethodGet, "/me/orders", "")
+	decodeUnits(t, rec.Body.Bytes(), &orders)
+	if len(orders.Orders) != 2 || orders.Orders[0].Status != exchange.OrderCancelled || orders.Orders[1].Status != exchange.OrderFilled {
+		t.Fatalf("unexpected orders %s", rec.Body)
+	}
+	rec = doUserRequest(t, e, alice, http.MethodGet, "/me/orders", "")
+	decodeUnits(t, rec.Body.Bytes(), &orders)
+	if len(orders.Orders) != 1 || orders.Orders[0].Status != exchange.OrderPartiallyFilled || orders.Orders[0].AvgPrice != px(2100) {
+		t.Fatalf("unexpected orders %s", rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodDelete, "/order/client/x", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestModifyOrder(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":2100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2100,"market":"ETH"}`)
+	orders := exportBook(t, ex, exchange.MarketEth).Asks[0].Orders
+	first, second := orders[0].ID, orders[1].ID
+
+	modify := func(id uint64, body string) *httptest.ResponseRecorder {
+		return doRequest(t, e, http.MethodPut, fmt.Sprintf("/order/%d", id), body)
+	}
+	// a reduction keeps the order at the head of the queue
+	if rec := modify(first, `{"price":2100,"size":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	orders = exportBook(t, ex, exchange.MarketEth).Asks[0].Orders
+	if orders[0].ID != first || orders[0].Size != sz(1) {
+		t.Fatalf("expected %d first with size 1, got %+v", first, orders)
+	}
+
+	// an increase sends it behind the other order
+	rec := modify(first, `{"price":2100,"size":3}`)
+	var resp exchange.ExecutionReport
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.OrderID != first || resp.Remaining != sz(3) || !resp.Rested {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	orders = exportBook(t, ex, exchange.MarketEth).Asks[0].Orders
+	if orders[0].ID != second || orders[1].ID != first {
+		t.Fatalf("expected %d behind %d, got %+v", first, second, orders)
+	}
+
+	if rec := modify(first+second, `{"price":2100,"size":1}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown order, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := modify(first, `{"price":2100,"size":0}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INVALID_REQUEST") {
+		t.Fatalf("expected INVALID_REQUEST, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReduceOrder(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	var updates []exchange.OrderUpdate
+	ex.HandleOrderUpdates(func(batch []exchange.OrderUpdate) { updates = append(updates, batch...) })
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "ETH", 5)
+	doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":2100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2100,"market":"ETH"}`)
+	orders := exportBook(t, ex, exchange.MarketEth).Asks[0].Orders
+	first, second := orders[0].ID, orders[1].ID
+
+	reduce := func(key string, id uint64, body string) *httptest.ResponseRecorder {
+		return doUserRequest(t, e, key, http.MethodPost, fmt.Sprintf("/order/%d/reduce", id), body)
+	}
+	// shaved below the order behind it, it keeps its place and holds less
+	rec := reduce(alice, first, `{"by":1.5}`)
+	var resp exchange.OrderReduce
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Reduced != sz(1.5) || resp.Remaining != sz(0.5) || resp.Status != exchange.OrderNew {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if held := ex.Held(1); held["ETH"] != 0.5 {
+		t.Fatalf("expected 0.5 ETH held, got %v", held)
+	}
+	if last := updates[len(updates)-1]; last.OrderID != first || last.Type != exchange.OrderUpdateAmended || last.Remaining != sz(0.5) {
+		t.Fatalf("expected an amended update, got %+v", last)
+	}
+	if stats, _ := ex.Stats(exchange.MarketEth); stats.AskVolume != sz(1.5) {
+		t.Fatalf("expected 1.5 ask volume, got %v", stats.AskVolume)
+	}
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+	var report exchange.ExecutionReport
+	decodeUnits(t, rec.Body.Bytes(), &report)
+	if len(report.Trades) != 2 || report.Trades[0].CounterpartyID != first || report.Trades[0].Size != sz(0.5) || report.Trades[1].CounterpartyID != second {
+		t.Fatalf("expected the reduced order filled first, got %+v", report.Trades)
+	}
+
+	// too much is refused, unless clamped, which cancels it like a cancel
+	doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2200,"market":"ETH"}`)
+	third := exportBook(t, ex, exchange.MarketEth).Asks[1].Orders[0].ID
+	if rec := reduce(alice, third, `{"by":2}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "REDUCE_TOO_LARGE") {
+		t.Fatalf("expected REDUCE_TOO_LARGE, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := reduce(alice, third, `{"to":2}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a reduction growing the order refused, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := reduce(alice, third, `{"by":1,"to":0}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INVALID_REQUEST") {
+		t.Fatalf("expected INVALID_REQUEST, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := reduce(bob, third, `{"by":0.5}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's order, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = reduce(alice, third, `{"by":2,"clamp":true}`)
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Remaining != sz(0) || resp.Status != exchange.OrderCancelled {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if book := exportBook(t, ex, exchange.MarketEth); len(book.Asks) != 1 {
+		t.Fatalf("expected the emptied level cleared, got %+v", book.Asks)
+	}
+	if held := ex.Held(1); len(held) != 0 {
+		t.Fatalf("expected nothing held, got %v", held)
+	}
+	if last := updates[len(updates)-1]; last.OrderID != third || last.Type != exchange.OrderUpdateCancelled {
+		t.Fatalf("expected a cancelled update, got %+v", last)
+	}
+}
+
+func TestDepthLimits(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	doRequest(t, e, http.MethodPatch, "/markets/ETH/limits", `{"maxPriceLevels":3,"maxSideOrders":4}`)
+
+	for _, price := range []string{"101", "102", "103"} {
+		if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":`+price+`,"market":"ETH"}`); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	// a fourth level is refused, joining an existing one is not
+	rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":104,"market":"ETH"}`)
+	if !strings.Contains(rec.Body.String(), "MAX_PRICE_LEVELS") {
+		t.Fatalf("expected MAX_PRICE_LEVELS, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":103,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// the side now holds 4 orders
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":101,"market":"ETH"}`)
+	if !strings.Contains(rec.Body.String(), "MAX_SIDE_ORDERS") {
+		t.Fatalf("expected MAX_SIDE_ORDERS, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// the bid side has its own caps, and an order that fully matches
+	// never rests so it is accepted
+	if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":101,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// the fill cleared the 101 level, so a new level fits again
+	if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":104,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	doRequest(t, e, http.MethodDelete, "/orders?market=ETH&side=ask&priceFrom=104&priceTo=104", "")
+	if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":105,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after a cancel, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, e, http.MethodGet, "/admin/markets/ETH/stats", "")
+	if !strings.Contains(rec.Body.String(), `"askLevels":3`) || !strings.Contains(rec.Body.String(), `"maxPriceLevels":3`) {
+		t.Fatalf("stats missing usage or limits: %s", rec.Body)
+	}
+}
+
+func TestGetBooks(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	for _, price := range []string{"101", "102", "103"} {
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":`+price+`,"market":"ETH"}`)
+	}
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":99,"market":"BTC"}`)
+
+	var resp struct {
+		Timestamp int64
+		Books     []exchange.MarketDepth
+	}
+	rec := doRequest(t, e, http.MethodGet, "/books?markets=ETH,BTC,DOGE&depth=2&format=number", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	decodeUnits(t, rec.Body.Bytes(), &resp)
+	if resp.Timestamp == 0 || len(resp.Books) != 3 {
+		t.Fatalf("unexpected response %s", rec.Body)
+	}
+
+	eth, btc, doge := resp.Books[0], resp.Books[1], resp.Books[2]
+	if eth.Market != exchange.MarketEth || eth.Sequence != exportBook(t, ex, exchange.MarketEth).Sequence ||
+		!reflect.DeepEqual(eth.Asks, []exchange.Level{{Price: px(101), Size: sz(1)}, {Price: px(102), Size: sz(1)}}) || len(eth.Bids) != 0 {
+		t.Fatalf("unexpected ETH depth %+v", eth)
+	}
+	if btc.Market != exchange.MarketBtc || btc.Sequence != exportBook(t, ex, exchange.MarketBtc).Sequence ||
+		!reflect.DeepEqual(btc.Bids, []exchange.Level{{Price: px(99), Size: sz(2)}}) || btc.Error != "" {
+		t.Fatalf("unexpected BTC depth %+v", btc)
+	}
+	if doge.Market != "DOGE" || doge.Error == "" {
+		t.Fatalf("expected an error stub for DOGE, got %+v", doge)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/books", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without markets, got %d", rec.Code)
+	}
+}
+
+func TestOrderEvents(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clk})
+	e := newServer(ex, testAdminKey)
+	var got []exchange.Event
+	ex.HandleEvents(func(events []exchange.Event) {
+		got = append(got, events...)
+	})
+
+	place := func(body string) uint64 {
+		var report struct {
+			OrderID uint64 `json:"orderId"`
+		}
+		json.Unmarshal(doRequest(t, e, http.MethodPost, "/order", body).Body.Bytes(), &report)
+		return report.OrderID
+	}
+	ask1 := place(`{"type":"LIMIT","bid":false,"size":2,"price":101,"market":"ETH"}`)
+	ask2 := place(`{"type":"LIMIT","bid":false,"size":3,"price":102,"market":"ETH"}`)
+	got = nil
+	bid := place(`{"type":"LIMIT","bid":true,"size":4,"price":102,"market":"ETH"}`)
+
+	want := []exchange.Event{
+		{Type: exchange.EventOrderAccepted, Market: exchange.MarketEth, Seq: 3, OrderID: bid, Bid: true, Price: px(102), Size: sz(4)},
+		{Type: exchange.EventFill, Market: exchange.MarketEth, Seq: 3, OrderID: bid, MakerOrderID: ask1, Bid: true, Price: px(101), Size: sz(2), TradeID: 1, Timestamp: clk.Now().UnixNano()},
+		{Type: exchange.EventOrderDone, Market: exchange.MarketEth, Seq: 3, OrderID: ask1, Price: px(101)},
+		{Type: exchange.EventFill, Market: exchange.MarketEth, Seq: 3, OrderID: bid, MakerOrderID: ask2, Bid: true, Price: px(102), Size: sz(2), TradeID: 2, Timestamp: clk.Now().UnixNano()},
+		{Type: exchange.EventOrderDone, Market: exchange.MarketEth, Seq: 3, OrderID: bid, Bid: true, Price: px(102)},
+		{Type: exchange.EventLevelChanged, Market: exchange.MarketEth, Seq: 3, Price: px(101), Size: sz(0)},
+		{Type: exchange.EventLevelChanged, Market: exchange.MarketEth, Seq: 3, Price: px(102), Size: sz(1)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events\n%+v\ngot\n%+v", want, got)
+	}
+
+	got = nil
+	doRequest(t, e, http.MethodDelete, "/orders?market=ETH&side=ask&priceFrom=100&priceTo=110", "")
+	want = []exchange.Event{
+		{Type: exchange.EventOrderDone, Market: exchange.MarketEth, Seq: 4, OrderID: ask2, Price: px(102), Size: sz(1)},
+		{Type: exchange.EventLevelChanged, Market: exchange.MarketEth, Seq: 4, Price: px(102), Size: sz(0)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events\n%+v\ngot\n%+v", want, got)
+	}
+}
+
+func TestEventOrderingUnderConcurrency(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+
+	var mu sync.Mutex
+	seqs := make(map[exchange.Market][]uint64)
+	// a short queue that spills keeps every operation, in order
+	ex.HandleEventsAsync(func(events []exchange.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		seqs[events[0].Market] = append(seqs[events[0].Market], events[0].Seq)
+	}, exchange.AsyncOptions{QueueSize: 4, Overflow: exchange.OverflowSpill, SpillDir: t.TempDir()}, exchange.EventOrderAccepted)
+
+	const perMarket = 200
+	var wg sync.WaitGroup
+	for _, market := range []exchange.Market{exchange.MarketEth, exchange.MarketBtc} {
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(bid bool) {
+				defer wg.Done()
+				for i := 0; i < perMarket/4; i++ {
+					body := fmt.Sprintf(`{"type":"LIMIT","bid":%t,"size":1,"price":%d,"market":"%s"}`, bid, 100+i%5, market)
+					doRequest(t, e, http.MethodPost, "/order", body)
+				}
+			}(w%2 == 0)
+		}
+	}
+	wg.Wait()
+	ex.Close()
+
+	// every placement bumps the sequence once, so a market's operations must
+	// arrive as exactly 1..perMarket
+	for _, market := range []exchange.Market{exchange.MarketEth, exchange.MarketBtc} {
+		got := seqs[market]
+		if len(got) != perMarket {
+			t.Fatalf("%s: expected %d operations, got %d", market, perMarket, len(got))
+		}
+		for i, seq := range got {
+			if seq != uint64(i+1) {
+				t.Fatalf("%s: operation %d delivered with seq %d", market, i+1, seq)
+			}
+		}
+	}
+}
+
+func TestPriceImprovement(t *testing.T) {
+	e := newServer(exchange.New(exchange.Config{AnonymousOrders: true}), testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2000,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2050,"market":"ETH"}`)
+
+	var placed struct {
+		LimitPrice       float64 `json:"limitPrice"`
+		AvgPrice         float64 `json:"avgPrice"`
+		PriceImprovement float64 `json:"priceImprovement"`
+	}
+	rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":2100,"market":"ETH"}`)
+	json.Unmarshal(rec.Body.Bytes(), &placed)
+	if placed.LimitPrice != 2100 || placed.AvgPrice != 2025 || placed.PriceImprovement != 75 {
+		t.Fatalf("unexpected execution report %s", rec.Body)
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":1990,"market":"ETH"}`)
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":1900,"market":"ETH"}`)
+	json.Unmarshal(rec.Body.Bytes(), &placed)
+	if placed.LimitPrice != 1900 || placed.AvgPrice != 1990 || placed.PriceImprovement != 90 {
+		t.Fatalf("unexpected execution report %s", rec.Body)
+	}
+
+	rec = doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":1000,"market":"ETH"}`)
+	if strings.Contains(rec.Body.String(), "priceImprovement") {
+		t.Fatalf("resting order reported an execution %s", rec.Body)
+	}
+}
+
+func TestCancelledRequest(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+
+	// a client that went away before its order reached the book
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH"}`)).WithContext(ctx)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "REQUEST_CANCELLED") {
+		t.Fatalf("expected 504 REQUEST_CANCELLED, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(exportBook(t, ex, exchange.MarketEth).Bids) != 0 {
+		t.Fatal("cancelled request reached the book")
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	store := exchange.NewMemoryAuditStore()
+	ex := exchange.New(exchange.Config{
+		AnonymousOrders: true,
+		Limits:          map[exchange.Market]exchange.MarketConfig{exchange.MarketEth: {MaxOrderSize: sz(5)}},
+		AuditStore:      store,
+	})
+	e := newServer(ex, testAdminKey)
+
+	start := time.Now().UTC().Format(time.RFC3339)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":9,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"DOGE"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":`)
+	doRequest(t, e, http.MethodDelete, "/orders?market=ETH&side=ask&priceFrom=100&priceTo=100", "")
+
+	var resp struct{ Records []exchange.AuditRecord }
+	rec := doRequest(t, e, http.MethodGet, "/admin/audit?from="+start, "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		Action exchange.AuditAction
+		Market exchange.Market
+		Result exchange.AuditResult
+		Code   string
+		Seq    uint64
+	}
+	var got []summary
+	for _, r := range resp.Records {
+		got = append(got, summary{r.Action, r.Market, r.Result, r.Code, r.Seq})
+	}
+	want := []summary{
+		{exchange.AuditPlace, exchange.MarketEth, exchange.AuditAccepted, "", 1},
+		{exchange.AuditPlace, exchange.MarketEth, exchange.AuditRejected, "MAX_ORDER_SIZE", 0},
+		{exchange.AuditPlace, "DOGE", exchange.AuditRejected, "MARKET_NOT_FOUND", 0},
+		{exchange.AuditPlace, "", exchange.AuditRejected, "MALFORMED_BODY", 0},
+		{exchange.AuditCancel, exchange.MarketEth, exchange.AuditAccepted, "", 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected trail\n%+v\ngot\n%+v", want, got)
+	}
+	// the engine keeps the request as it read it, in the market's units
+	if string(resp.Records[1].Request) != `{"type":"LIMIT","bid":false,"size":900000000,"price":10000000000,"market":"ETH"}` {
+		t.Fatalf("expected the request to be kept, got %s", resp.Records[1].Request)
+	}
+	if string(resp.Records[3].Request) != `"{\"type\":"` {
+		t.Fatalf("expected an undecodable request kept as a string, got %s", resp.Records[3].Request)
+	}
+	if resp.Records[0].OrderID == 0 || resp.Records[1].OrderID != 0 {
+		t.Fatalf("expected only the accepted order's ID kept, got %+v", resp.Records[:2])
+	}
+
+	rec = doRequest(t, e, http.MethodGet, "/admin/audit?result=rejected&market=ETH", "")
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Records) != 1 || resp.Records[0].Code != "MAX_ORDER_SIZE" || resp.Records[0].Msg == "" {
+		t.Fatalf("unexpected rejected ETH records %+v", resp.Records)
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rec = doRequest(t, e, http.MethodGet, "/admin/audit?from="+future, "")
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Records) != 0 {
+		t.Fatalf("expected no records after %s, got %+v", future, resp.Records)
+	}
+
+	// an admin can follow one user's attempts
+	alice := register(t, e, "alice")
+	deposit(t, e, 1, "ETH", 1)
+	doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":110,"market":"ETH"}`)
+	doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":120,"market":"ETH"}`)
+	var byUser struct{ Records []exchange.AuditRecord }
+	rec = doRequest(t, e, http.MethodGet, "/admin/audit?user=1", "")
+	json.Unmarshal(rec.Body.Bytes(), &byUser)
+	if len(byUser.Records) != 2 || byUser.Records[0].Result != exchange.AuditAccepted || byUser.Records[1].Code != "INSUFFICIENT_FUNDS" {
+		t.Fatalf("unexpected records of user 1 %+v", byUser.Records)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/admin/audit?user=alice", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a user that isn't an ID, got %d", rec.Code)
+	}
+
+	// records still queued at shutdown are stored
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":90,"market":"ETH"}`)
+	ex.Close()
+	records, _ := store.Query(exchange.AuditQuery{})
+	if len(records) != 8 {
+		t.Fatalf("expected 8 records after close, got %d", len(records))
+	}
+}
+
+func TestFillBreakdown(t *testing.T) {
+	e := newServer(exchange.New(exchange.Config{AnonymousOrders: true}), testAdminKey)
+	for _, order := range []string{
+		`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":2,"price":99,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":2,"price":98,"market":"ETH"}`,
+	} {
+		doRequest(t, e, http.MethodPost, "/order", order)
+	}
+
+	var placed struct {
+		Fills         []orderbook.LevelFill `json:"fills"`
+		WorstPrice    orderbook.Price       `json:"worstPrice"`
+		LevelsTouched int                   `json:"levelsTouched"`
+	}
+	rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":5,"market":"ETH"}`)
+	decodeUnits(t, rec.Body.Bytes(), &placed)
+	want := []orderbook.LevelFill{
+		{Price: px(100), Size: sz(2), CumulativeSize: sz(2), AveragePrice: px(100)},
+		{Price: px(99), Size: sz(2), CumulativeSize: sz(4), AveragePrice: px(99.5)},
+		{Price: px(98), Size: sz(1), CumulativeSize: sz(5), AveragePrice: px(99.2)},
+	}
+	if !reflect.DeepEqual(placed.Fills, want) || placed.WorstPrice != px(98) || placed.LevelsTouched != 3 {
+		t.Fatalf("unexpected breakdown %s", rec.Body)
+	}
+}
+
+func TestMarketDataPrecision(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	// 0.1+0.2 and 1e6 are the values float formatting gets wrong
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":0.1,"price":1000000,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":0.2,"price":1000000,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":0.3,"price":0.3,"market":"BTC"}`)
+
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/book/ETH", []string{`"totolAskVolume":"0.3000"`, `"price":"1000000.00","size":"0.1000"`, `"filledSize":"0.0000"`}},
+		{"/book/ETH?format=number", []string{`"totolAskVolume":0.3000`, `"price":1000000.00,"size":0.1000`}},
+		{"/books?markets=ETH,BTC", []string{
+			`"asks":[{"price":"1000000.00","size":"0.3000"}]`,
+			`"bids":[{"price":"0.30","size":"0.30000000"}]`,
+		}},
+		{"/books?markets=ETH&format=number", []string{`"asks":[{"price":1000000.00,"size":0.3000}]`}},
+		{"/ticker/ETH/bbo", []string{`"bid":"0.00","bidSize":"0.0000","ask":"1000000.00","askSize":"0.3000"`}},
+		{"/ticker/ETH/bbo?format=number", []string{`"ask":1000000.00,"askSize":0.3000`}},
+	} {
+		rec := doRequest(t, e, http.MethodGet, tc.path, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tc.path, rec.Code, rec.Body)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Fatalf("%s: expected %s in %s", tc.path, want, rec.Body)
+			}
+		}
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/book/ETH?format=float", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+
+	// the stream renders the same way
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/ticker/ETH/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1e6,"price":0.1,"market":"ETH"}`)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"bid":"0.10","bidSize":"1000000.0000"`; !strings.Contains(line, want) {
+		t.Fatalf("expected %s in %s", want, line)
+	}
+}
+
+func TestStreamFeed(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	e := newServer(ex, testAdminKey)
+	for i := 0; i < 3; i++ {
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	}
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/book/ETH/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":3,"market":"ETH"}`)
+
+	var got []string
+	r := bufio.NewReader(resp.Body)
+	for len(got) < 4 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+			got = append(got, data)
+		}
+	}
+	trade := `{"type":"trade","market":"ETH","seq":4,"side":"bid","price":"100.00","size":"1.0000","tradeId":%d,"timestamp":1700000000000000000}`
+	want := []string{fmt.Sprintf(trade, 1), fmt.Sprintf(trade, 2), fmt.Sprintf(trade, 3), `{"type":"book","market":"ETH","seq":4,"side":"ask","price":"100.00","size":"0.0000"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected\n%v\ngot\n%v", want, got)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/book/DOGE/stream", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown market, got %d", rec.Code)
+	}
+}
+
+func TestStreamFeedResume(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	since := exportBook(t, ex, exchange.MarketEth).Sequence
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":99,"market":"ETH"}`)
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	stream := func(query string, lines int) []string {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/book/ETH/stream"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var got []string
+		r := bufio.NewReader(resp.Body)
+		for len(got) < lines {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				got = append(got, line)
+			}
+		}
+		return got
+	}
+
+	// the missed deltas are replayed
+	got := stream(fmt.Sprintf("?since=%d", since), 2)
+	want := []string{
+		`data: {"type":"book","market":"ETH","seq":2,"side":"ask","price":"100.00","size":"3.0000"}`,
+		`data: {"type":"book","market":"ETH","seq":3,"side":"bid","price":"99.00","size":"1.0000"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected\n%v\ngot\n%v", want, got)
+	}
+
+	// after an import the history starts over, so the client gets the book
+	book := exportBook(t, ex, exchange.MarketEth)
+	if _, err := ex.Import(exchange.MarketEth, book, true); err != nil {
+		t.Fatal(err)
+	}
+	seq := exportBook(t, ex, exchange.MarketEth).Sequence
+	got = stream(fmt.Sprintf("?since=%d", since), 2)
+	want = []string{
+		"event: snapshot",
+		fmt.Sprintf(`data: [{"type":"book","market":"ETH","seq":%[1]d,"side":"ask","price":"100.00","size":"3.0000"},{"type":"book","market":"ETH","seq":%[1]d,"side":"bid","price":"99.00","size":"1.0000"}]`, seq),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected\n%v\ngot\n%v", want, got)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/book/ETH/stream?since=-1", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad since, got %d", rec.Code)
+	}
+}
+
+func TestStreamMarket(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	e := newServer(ex, testAdminKey)
+	for i := 0; i < 3; i++ {
+		doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	}
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":3,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":101,"market":"ETH"}`)
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	stream := func(lastEventID string) (*bufio.Reader, func()) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/markets/ETH/stream", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bufio.NewReader(resp.Body), func() {
+			cancel()
+			resp.Body.Close()
+		}
+	}
+	read := func(r *bufio.Reader, lines int) []string {
+		t.Helper()
+		var got []string
+		for len(got) < lines {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				got = append(got, line)
+			}
+		}
+		return got
+	}
+	trade := func(id int) []string {
+		return []string{
+			"event: trade",
+			fmt.Sprintf("id: %d", id),
+			fmt.Sprintf(`data: {"type":"trade","market":"ETH","seq":%d,"side":"bid","price":"%d.00","size":"1.0000","tradeId":%d,"timestamp":1700000000000000000}`, 4+(id-1)/3*2, 100+(id-1)/3, id),
+		}
+	}
+	ticker := []string{"event: ticker", `data: {"market":"ETH","bid":"0.00","bidSize":"0.0000","ask":"101.00","askSize":"1.0000","last":"100.00","seq":5,"ts":1700000000000000000}`}
+
+	// a reconnecting client gets the trades it missed, then the ticker
+	r, stop := stream("1")
+	got := read(r, 8)
+	want := append(append(trade(2), trade(3)...), ticker...)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected\n%v\ngot\n%v", want, got)
+	}
+	// and the trades as they happen
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+	if got := read(r, 3); !reflect.DeepEqual(got, trade(4)) {
+		t.Fatalf("expected\n%v\ngot\n%v", trade(4), got)
+	}
+	stop()
+
+	// a new client starts from the ticker
+	r, stop = stream("")
+	ticker[1] = strings.Replace(strings.Replace(ticker[1], `"ask":"101.00","askSize":"1.0000"`, `"ask":"0.00","askSize":"0.0000"`, 1), `"last":"100.00","seq":5`, `"last":"101.00","seq":6`, 1)
+	if got := read(r, 2); !reflect.DeepEqual(got, ticker) {
+		t.Fatalf("expected\n%v\ngot\n%v", ticker, got)
+	}
+	stop()
+
+	req := httptest.NewRequest(http.MethodGet, "/markets/ETH/stream", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad Last-Event-ID, got %d", rec.Code)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/markets/DOGE/stream", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown market, got %d", rec.Code)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	e := newServer(ex, testAdminKey)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip := func(req string, want ...string) {
+		t.Helper()
+		if req != "" {
+			if err := websocket.Message.Send(conn, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, w := range want {
+			var got string
+			if err := websocket.Message.Receive(conn, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != w {
+				t.Fatalf("expected\n%s\ngot\n%s", w, got)
+			}
+		}
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	roundTrip(`{"op":"subscribe","channel":"trades","market":"ETH"}`, `{"type":"subscribed","channel":"trades","market":"ETH"}`)
+	// the book starts from a snapshot, and each update links to the last
+	roundTrip(`{"op":"subscribe","channel":"book","market":"ETH"}`,
+		`{"type":"subscribed","channel":"book","market":"ETH"}`,
+		`{"type":"snapshot","channel":"book","market":"ETH","seq":1,"data":[{"type":"book","market":"ETH","seq":1,"side":"ask","price":"100.00","size":"1.0000"}]}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":101,"market":"ETH"}`)
+	roundTrip("", `{"type":"update","channel":"book","market":"ETH","seq":2,"prevSeq":1,"data":[{"type":"book","market":"ETH","seq":2,"side":"ask","price":"101.00","size":"2.0000"}]}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+
+	// the two channels' updates of one operation may arrive either way round
+	want := map[string]bool{
+		`{"type":"update","channel":"trades","market":"ETH","data":[{"type":"trade","market":"ETH","seq":3,"side":"bid","price":"100.00","size":"1.0000","tradeId":1,"timestamp":1700000000000000000}]}`: true,
+		`{"type":"update","channel":"book","market":"ETH","seq":3,"prevSeq":2,"data":[{"type":"book","market":"ETH","seq":3,"side":"ask","price":"100.00","size":"0.0000"}]}`:                            true,
+	}
+	for range 2 {
+		var got string
+		if err := websocket.Message.Receive(conn, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !want[got] {
+			t.Fatalf("unexpected message %s", got)
+		}
+		delete(want, got)
+	}
+
+	// nothing follows the acknowledgement of an unsubscribe
+	roundTrip(`{"op":"unsubscribe","channel":"book","market":"ETH"}`, `{"type":"unsubscribed","channel":"book","market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":99,"market":"ETH"}`)
+
+	roundTrip(`{"op":"unsubscribe","channel":"book","market":"ETH"}`, `{"type":"error","channel":"book","market":"ETH","msg":"not subscribed"}`)
+	roundTrip(`{"op":"subscribe","channel":"trades","market":"ETH"}`, `{"type":"error","channel":"trades","market":"ETH","msg":"already subscribed"}`)
+	roundTrip(`{"op":"subscribe","channel":"quotes","market":"ETH"}`, `{"type":"error","channel":"quotes","market":"ETH","msg":"channel must be book, trades, candles or orders"}`)
+	roundTrip(`{"op":"subscribe","channel":"book","market":"DOGE"}`, `{"type":"error","channel":"book","market":"DOGE","msg":"market not found"}`)
+	roundTrip(`{"op":"list"}`, `{"type":"error","msg":"op must be subscribe, unsubscribe, auth, cancelOnDisconnect, ping or pong"}`)
+	roundTrip(`not json`, `{"type":"error","msg":"requests must be JSON objects"}`)
+
+	if rec := doRequest(t, e, http.MethodGet, "/ws?format=hex", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad format, got %d", rec.Code)
+	}
+}
+
+func TestWebSocketCandles(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clk})
+	e := newServer(ex, testAdminKey, withClock(clk))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip := func(req string, want ...string) {
+		t.Helper()
+		if req != "" {
+			if err := websocket.Message.Send(conn, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, w := range want {
+			var got string
+			if err := websocket.Message.Receive(conn, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != w {
+				t.Fatalf("expected\n%s\ngot\n%s", w, got)
+			}
+		}
+	}
+
+	roundTrip(`{"op":"subscribe","channel":"candles","market":"ETH","interval":"2m"}`, `{"type":"error","channel":"candles","market":"ETH","interval":"2m","msg":"interval must be 1m, 5m, 1h or 1d"}`)
+	roundTrip(`{"op":"subscribe","channel":"candles","market":"ETH"}`, `{"type":"subscribed","channel":"candles","market":"ETH","interval":"1m"}`)
+
+	// both trades of one order go into one update of the minute's candle
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":102,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":2,"market":"ETH"}`)
+	first := `{"start":1699999980000000000,"open":"100.00","high":"102.00","low":"100.00","close":"102.00","volume":"2.0000","trades":2}`
+	roundTrip("", `{"type":"update","channel":"candles","market":"ETH","interval":"1m","data":`+first+`}`)
+
+	// the minute ends without a trade to start the next, and its candle is
+	// closed all the same, once
+	clk.Advance(40 * time.Second)
+	roundTrip("", `{"type":"closed","channel":"candles","market":"ETH","interval":"1m","data":`+first+`}`)
+	clk.Advance(2 * time.Minute)
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":99,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":0.5,"market":"ETH"}`)
+	roundTrip("", `{"type":"update","channel":"candles","market":"ETH","interval":"1m","data":{"start":1700000160000000000,"open":"99.00","high":"99.00","low":"99.00","close":"99.00","volume":"0.5000","trades":1}}`)
+
+	roundTrip(`{"op":"unsubscribe","channel":"candles","market":"ETH"}`, `{"type":"unsubscribed","channel":"candles","market":"ETH","interval":"1m"}`)
+	roundTrip(`{"op":"unsubscribe","channel":"candles","market":"ETH","interval":"5m"}`, `{"type":"error","channel":"candles","market":"ETH","interval":"5m","msg":"not subscribed"}`)
+}
+
+func TestWebSocketBinary(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	e := newServer(ex, testAdminKey)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?encoding=binary", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	receive := func() []sbe.Message {
+		t.Helper()
+		var frame []byte
+		if err := websocket.Message.Receive(conn, &frame); err != nil {
+			t.Fatal(err)
+		}
+		var msgs []sbe.Message
+		for len(frame) > 0 {
+			msg, n, err := sbe.Decode(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+			frame = frame[n:]
+		}
+		return msgs
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	// control messages stay JSON
+	if err := websocket.Message.Send(conn, `{"op":"subscribe","channel":"book","market":"ETH"}`); err != nil {
+		t.Fatal(err)
+	}
+	var ack string
+	if err := websocket.Message.Receive(conn, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"subscribed","channel":"book","market":"ETH"}`; ack != want {
+		t.Fatalf("expected %s, got %s", want, ack)
+	}
+	snapshot := receive()
+	if len(snapshot) != 2 || snapshot[0].Template != sbe.TemplateSnapshot || snapshot[0].Seq != 1 || snapshot[0].Levels != 1 {
+		t.Fatalf("expected a snapshot of one level, got %+v", snapshot)
+	}
+	if level := snapshot[1]; level.Market != "ETH" || level.Side != orderbook.SideAsk || level.Price != px(100) || level.Size != sz(1) {
+		t.Fatalf("unexpected level %+v", level)
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":101,"market":"ETH"}`)
+	update := receive()
+	if len(update) != 1 || update[0].Template != sbe.TemplateBookDelta || update[0].Seq != 2 || update[0].PrevSeq != 1 || update[0].Price != px(101) || update[0].Size != sz(2) {
+		t.Fatalf("unexpected update %+v", update)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/ws?encoding=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad encoding, got %d", rec.Code)
+	}
+}
+
+func TestWebSocketOrders(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "USD", 1000)
+	deposit(t, e, 2, "ETH", 1)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	dial := func(apiKey string) *websocket.Conn {
+		t.Helper()
+		cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apiKey != "" {
+			cfg.Header.Set("X-API-Key", apiKey)
+		}
+		conn, err := websocket.DialConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	type message struct {
+		Type string `json:"type"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			Type      exchange.OrderUpdateType `json:"type"`
+			Owner     uint64                   `json:"owner"`
+			Remaining float64                  `json:"remaining"`
+		} `json:"data"`
+	}
+	roundTrip := func(conn *websocket.Conn, req string) message {
+		t.Helper()
+		if req != "" {
+			if err := websocket.Message.Send(conn, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var msg message
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	updates := func(msg message) string {
+		t.Helper()
+		if msg.Type != "update" {
+			t.Fatalf("expected an update, got %+v", msg)
+		}
+		var got []string
+		for _, u := range msg.Data {
+			got = append(got, fmt.Sprintf("%s %d %v", u.Type, u.Owner, u.Remaining))
+		}
+		return strings.Join(got, ", ")
+	}
+
+	// alice authenticates the upgrade, bob once connected
+	aliceConn := dial(alice)
+	defer aliceConn.Close()
+	if msg := roundTrip(aliceConn, `{"op":"subscribe","channel":"orders"}`); msg.Type != "subscribed" {
+		t.Fatalf("expected alice to subscribe, got %+v", msg)
+	}
+	bobConn := dial("")
+	defer bobConn.Close()
+	if msg := roundTrip(bobConn, `{"op":"subscribe","channel":"orders"}`); msg.Type != "error" || msg.Msg != "unauthorized" {
+		t.Fatalf("expected an anonymous subscription to be refused, got %+v", msg)
+	}
+	if msg := roundTrip(bobConn, `{"op":"auth","apiKey":"nope"}`); msg.Type != "error" || msg.Msg != "unauthorized" {
+		t.Fatalf("expected a bad key to be refused, got %+v", msg)
+	}
+	if msg := roundTrip(bobConn, fmt.Sprintf(`{"op":"auth","apiKey":%q}`, bob)); msg.Type != "authenticated" {
+		t.Fatalf("expected bob to authenticate, got %+v", msg)
+	}
+	if msg := roundTrip(bobConn, fmt.Sprintf(`{"op":"auth","apiKey":%q}`, alice)); msg.Type != "error" {
+		t.Fatalf("expected switching users to be refused, got %+v", msg)
+	}
+	if msg := roundTrip(bobConn, `{"op":"subscribe","channel":"orders"}`); msg.Type != "subscribed" {
+		t.Fatalf("expected bob to subscribe, got %+v", msg)
+	}
+
+	doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":0.5,"price":200,"market":"ETH"}`)
+	if got := updates(roundTrip(bobConn, "")); got != "ACCEPTED 2 0.5" {
+		t.Fatalf("bob: got %s", got)
+	}
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":200,"market":"ETH"}`)
+	if got := updates(roundTrip(aliceConn, "")); got != "ACCEPTED 1 1, PARTIAL_FILL 1 0.5" {
+		t.Fatalf("alice: got %s", got)
+	}
+	if got := updates(roundTrip(bobConn, "")); got != "FILL 2 0" {
+		t.Fatalf("bob: got %s", got)
+	}
+	var report struct {
+		OrderID uint64 `json:"orderId"`
+	}
+	decodeUnits(t, rec.Body.Bytes(), &report)
+	doUserRequest(t, e, alice, http.MethodDelete, fmt.Sprintf("/order/%d", report.OrderID), "")
+	if got := updates(roundTrip(aliceConn, "")); got != "CANCELLED 1 0.5" {
+		t.Fatalf("alice: got %s", got)
+	}
+}
+
+func TestWebSocketHeartbeat(t *testing.T) {
+	ex := exchange.New(exchange.Config{
+		AnonymousOrders: true,
+		Limits:          map[exchange.Market]exchange.MarketConfig{exchange.MarketEth: {MinRestingTime: time.Second}},
+	})
+	e := newServer(ex, testAdminKey, withHeartbeat(50*time.Millisecond))
+	alice := register(t, e, "alice")
+	deposit(t, e, 1, "USD", 1000)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	// next returns the next message that isn't a ping, answering those
+	next := func(conn *websocket.Conn) (string, error) {
+		for {
+			var msg string
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				return "", err
+			}
+			if msg != `{"type":"ping"}` {
+				return msg, nil
+			}
+			websocket.Message.Send(conn, `{"op":"pong"}`)
+		}
+	}
+	roundTrip := func(conn *websocket.Conn, req, want string) {
+		t.Helper()
+		websocket.Message.Send(conn, req)
+		if got, err := next(conn); err != nil || got != want {
+			t.Fatalf("expected %s, got %s (%v)", want, got, err)
+		}
+	}
+
+	// a client that answers the pings stays connected past a few of them
+	live := dial()
+	defer live.Close()
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		roundTrip(live, `{"op":"ping"}`, `{"type":"pong"}`)
+		time.Sleep(20 * time.Millisecond)
+	}
+	roundTrip(live, `{"op":"cancelOnDisconnect","enabled":true}`, `{"type":"error","msg":"unauthorized"}`)
+
+	// one that stops answering is dropped, taking its user's orders with it
+	for _, market := range []string{"ETH", "BTC"} {
+		body := fmt.Sprintf(`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":%q}`, market)
+		if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", body); rec.Code != http.StatusOK {
+			t.Fatalf("failed to place an order on %s: %d %s", market, rec.Code, rec.Body)
+		}
+	}
+	quiet := dial()
+	defer quiet.Close()
+	roundTrip(quiet, fmt.Sprintf(`{"op":"auth","apiKey":%q}`, alice), `{"type":"authenticated"}`)
+	roundTrip(quiet, `{"op":"cancelOnDisconnect","enabled":true}`, `{"type":"cancelOnDisconnect","enabled":true}`)
+	for {
+		var msg string
+		if err := websocket.Message.Receive(quiet, &msg); err != nil {
+			break
+		}
+		if msg != `{"type":"ping"}` {
+			t.Fatalf("unexpected message %s", msg)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(exportBook(t, ex, exchange.MarketBtc).Bids) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the orders to be cancelled on disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the ETH order hasn't rested long enough to cancel, so it is cancelled
+	// once it has
+	if len(exportBook(t, ex, exchange.MarketEth).Bids) != 1 {
+		t.Fatal("expected the ETH order left resting for its minimum resting time")
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for len(exportBook(t, ex, exchange.MarketEth).Bids) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the ETH order cancelled once its minimum resting time was up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	live := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(live, testAdminKey)
+	for _, body := range []string{
+		`{"type":"LIMIT","bid":false,"size":2,"price":101,"market":"ETH","metadata":{"ref":"a"}}`,
+		`{"type":"LIMIT","bid":false,"size":1,"price":101,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":3,"price":99,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":0.5,"price":30000,"market":"BTC"}`,
+	} {
+		doRequest(t, e, http.MethodPost, "/order", body)
+	}
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	fresh := exchange.New(exchange.Config{AnonymousOrders: true})
+	if err := warmUp(context.Background(), fresh, srv.Client(), srv.URL, testAdminKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, market := range []exchange.Market{exchange.MarketEth, exchange.MarketBtc} {
+		want, _ := live.Export(market)
+		got, _ := fresh.Export(market)
+		if got.Checksum != want.Checksum || !reflect.DeepEqual(got.Asks, want.Asks) || !reflect.DeepEqual(got.Bids, want.Bids) {
+			t.Fatalf("%s: expected %+v, got %+v", market, want, got)
+		}
+	}
+	if !fresh.Ready() {
+		t.Fatal("expected a warmed up exchange to be ready")
+	}
+
+	// a peer that refuses leaves empty books and an exchange out of rotation
+	// until an operator says otherwise
+	failed := exchange.New(exchange.Config{AnonymousOrders: true})
+	if err := warmUp(context.Background(), failed, srv.Client(), srv.URL, "wrong-key"); err == nil {
+		t.Fatal("expected warm-up to fail")
+	}
+	if book := exportBook(t, failed, exchange.MarketEth); len(book.Asks) != 0 || len(book.Bids) != 0 {
+		t.Fatalf("expected an empty book, got %+v", book)
+	}
+	fe := newServer(failed, testAdminKey)
+	if rec := doRequest(t, fe, http.MethodGet, "/ready", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec := doRequest(t, fe, http.MethodPost, "/admin/ready", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec := doRequest(t, fe, http.MethodGet, "/ready", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestRequestBodies(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey, withBodyLimit(1024))
+
+	padded := fmt.Sprintf(`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH","metadata":{"pad":"%s"}}`, strings.Repeat("x", 2048))
+	if rec := doRequest(t, e, http.MethodPost, "/order", padded); rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), `"code":"BODY_TOO_LARGE"`) {
+		t.Fatalf("expected 413, got %d: %s", rec.Code, rec.Body)
+	}
+	// a body of unknown length is cut off as it is read
+	req := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(padded))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a streamed body, got %d: %s", rec.Code, rec.Body)
+	}
+	// routes taking a whole book allow more
+	if rec := doRequest(t, e, http.MethodPost, "/admin/markets/ETH/import", `{"asks":[],"bids":[],"pad":"`+strings.Repeat("x", 2048)+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the import to be decoded and refused, got %d", rec.Code)
+	}
+
+	for _, body := range []string{
+		`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH","leverage":10}`,
+		`{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH"}{"type":"LIMIT"}`,
+		`{"type":"LIMIT","bid":true,"size":"1","price":100,"market":"ETH"}`,
+		`[]`,
+	} {
+		rec := doRequest(t, e, http.MethodPost, "/order", body)
+		var rejection exchange.Rejection
+		json.Unmarshal(rec.Body.Bytes(), &rejection)
+		if rec.Code != http.StatusBadRequest || rejection.Code != "MALFORMED_BODY" || strings.Contains(rejection.Msg, "exchange.") {
+			t.Fatalf("%s: expected a MALFORMED_BODY rejection, got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+	if rec := doRequest(t, e, http.MethodPatch, "/markets/ETH/limits", `{"maxOrderSize":5,"maxOrdreSize":6}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown limit to be refused, got %d", rec.Code)
+	}
+
+	// no mangling of a valid order ever fails the server or, unless the
+	// order went through, touches the book
+	valid := `{"type":"LIMIT","bid":true,"size":1,"price":100,"market":"ETH","metadata":{"ref":"a"}}`
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		body := []byte(valid)
+		switch i % 3 {
+		case 0:
+			body = body[:r.Intn(len(body))]
+		case 1:
+			for n := 1 + r.Intn(3); n > 0; n-- {
+				body[r.Intn(len(body))] = byte(r.Intn(256))
+			}
+		case 2:
+			at := r.Intn(len(body))
+			junk := make([]byte, 1+r.Intn(8))
+			r.Read(junk)
+			body = append(body[:at:at], append(junk, body[at:]...)...)
+		}
+
+		before := exportBook(t, ex, exchange.MarketEth).Sequence
+		rec := doRequest(t, e, http.MethodPost, "/order", string(body))
+		if rec.Code >= 500 {
+			t.Fatalf("%q: got %d", body, rec.Code)
+		}
+		if rec.Code != http.StatusOK && exportBook(t, ex, exchange.MarketEth).Sequence != before {
+			t.Fatalf("%q: refused with %d but changed the book", body, rec.Code)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey, withSessionSecret([]byte("secret")))
+	if rec := doRequest(t, e, http.MethodPost, "/users", `{"name":"alice","password":"correct horse"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/users", `{"name":"bob","password":"short"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a short password, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/login", `{"name":"alice","password":"wrong horse"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong password, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var session struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+	rec := doRequest(t, e, http.MethodPost, "/login", `{"name":"alice","password":"correct horse"}`)
+	json.Unmarshal(rec.Body.Bytes(), &session)
+	if rec.Code != http.StatusOK || session.Token == "" || session.ExpiresAt <= time.Now().UnixNano() {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+
+	withToken := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = withToken(session.Token)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name":"alice"`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := withToken(session.Token + "x"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad token, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// another instance with the same secret takes the token, but doesn't
+	// know the user
+	other := newServer(exchange.New(exchange.Config{AnonymousOrders: true}), testAdminKey, withSessionSecret([]byte("secret")))
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+session.Token)
+	rec = httptest.NewRecorder()
+	other.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown user, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// a name tried too often is throttled, before its password is checked,
+	// while other names from the same address still log in
+	for range loginNameBurst {
+		if rec := doRequest(t, e, http.MethodPost, "/login", `{"name":"mallory","password":"guess"}`); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	rec = doRequest(t, e, http.MethodPost, "/login", `{"name":"mallory","password":"guess"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("expected 429 to retry after 10s, got %d after %q: %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/login", `{"name":"alice","password":"correct horse"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUserLedger(t *testing.T) {
+	ex := exchange.New(exchange.Config{Limits: map[exchange.Market]exchange.MarketConfig{
+		exchange.MarketEth: {MakerFee: 0.001, TakerFee: 0.002},
+	}})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/users/1/deposits", `{"asset":"USD","amount":10000}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected users not to credit themselves, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/users/1/deposits", `{"asset":"USD","amount":10000}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/users/2/deposits", `{"asset":"ETH","amount":5}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/users/3/deposits", `{"asset":"ETH","amount":5}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/users/1/ledger", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected bob refused alice's ledger, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// a bid holds 4000 of alice's 10000, which can't be withdrawn until it
+	// is cancelled
+	var report exchange.ExecutionReport
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":2000,"market":"ETH"}`)
+	decodeUnits(t, rec.Body.Bytes(), &report)
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/users/1/withdrawals", `{"asset":"USD","amount":7000}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a withdrawal of held funds refused, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodDelete, fmt.Sprintf("/order/%d", report.OrderID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/users/1/withdrawals", `{"asset":"USD","amount":7000}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected the withdrawal once the order is cancelled, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// alice makes and bob takes, each paying a fee
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1.5,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, u := range []struct {
+		id  uint64
+		key string
+	}{{1, alice}, {2, bob}} {
+		var resp struct {
+			Entries []ledger.Line `json:"entries"`
+		}
+		rec := doUserRequest(t, e, u.key, http.MethodGet, fmt.Sprintf("/users/%d/ledger", u.id), "")
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		sums := make(map[ledger.Asset]float64)
+		fees := 0
+		for _, line := range resp.Entries {
+			sums[line.Asset] = math.Round((sums[line.Asset]+line.Amount)*1e8) / 1e8
+			if line.Balance != sums[line.Asset] {
+				t.Fatalf("user %d: line %+v left %v, want %v", u.id, line, line.Balance, sums[line.Asset])
+			}
+			if line.Kind == ledger.EntryFee {
+				fees++
+				if line.Reference != "ETH:1" || line.Amount >= 0 {
+					t.Fatalf("user %d: unexpected fee %+v", u.id, line)
+				}
+			}
+		}
+		if fees != 1 {
+			t.Fatalf("user %d: expected 1 fee, got %d in %+v", u.id, fees, resp.Entries)
+		}
+		for asset, balance := range ex.Balances(u.id) {
+			if sums[asset] != balance {
+				t.Fatalf("user %d: ledger sums to %v %s, balance is %v", u.id, sums[asset], asset, balance)
+			}
+		}
+	}
+	// alice paid the maker fee in ETH, bob the taker fee in USD
+	if got := ex.Balances(1)[ledger.ETH]; got != 0.999 {
+		t.Fatalf("expected alice to have 0.999 ETH, got %v", got)
+	}
+	if got := ex.Balances(2)[ledger.USD]; got != 1996 {
+		t.Fatalf("expected bob to have 1996 USD, got %v", got)
+	}
+}
+
+func TestUserTrades(t *testing.T) {
+	ex := exchange.New(exchange.Config{Limits: map[exchange.Market]exchange.MarketConfig{
+		exchange.MarketEth: {MakerFee: 0.001, TakerFee: 0.002},
+	}})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	ex.Deposit(1, ledger.USD, 10000)
+	ex.Deposit(2, ledger.ETH, 5)
+
+	// alice makes a bid bob takes in two trades
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	for range 2 {
+		if rec := doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/users/1/trades?market=ETH", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected bob refused alice's trades, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodGet, "/users/1/trades", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a market, got %d: %s", rec.Code, rec.Body)
+	}
+
+	type page struct {
+		Trades []exchange.UserTrade `json:"trades"`
+		Next   uint64               `json:"next"`
+	}
+	get := func(key, target string) page {
+		t.Helper()
+		var p page
+		rec := doUserRequest(t, e, key, http.MethodGet, target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", target, rec.Code, rec.Body)
+		}
+		json.Unmarshal(rec.Body.Bytes(), &p)
+		return p
+	}
+
+	first := get(alice, "/users/1/trades?market=ETH&limit=1")
+	if len(first.Trades) != 1 || first.Next != 1 {
+		t.Fatalf("expected the first trade and a cursor, got %+v", first)
+	}
+	second := get(alice, fmt.Sprintf("/users/1/trades?market=ETH&limit=1&from=%d", first.Next))
+	if len(second.Trades) != 1 || second.Trades[0].TradeID != 2 {
+		t.Fatalf("expected the second trade, got %+v", second)
+	}
+	if got := get(alice, "/users/1/trades?market=ETH&from=2"); len(got.Trades) != 0 || got.Next != 0 {
+		t.Fatalf("expected no trades after the last, got %+v", got)
+	}
+
+	made, taken := first.Trades[0], get(bob, "/users/2/trades?market=ETH").Trades[0]
+	if made.TradeID != taken.TradeID || made.OrderID == taken.OrderID {
+		t.Fatalf("expected both sides of one trade, got %+v and %+v", made, taken)
+	}
+	if made.Role != exchange.RoleMaker || made.Side != exchange.SideBuy || made.Fee != 0.001 || made.FeeAsset != ledger.ETH {
+		t.Fatalf("unexpected maker side %+v", made)
+	}
+	if taken.Role != exchange.RoleTaker || taken.Side != exchange.SideSell || taken.Fee != 4 || taken.FeeAsset != ledger.USD {
+		t.Fatalf("unexpected taker side %+v", taken)
+	}
+	if last := second.Trades[0]; last.NetBase != 1.998 || last.NetQuote != -4000 {
+		t.Fatalf("expected alice's totals to come to 1.998 ETH for 4000 USD, got %+v", last)
+	}
+
+	// an operator sees them too
+	rec := doRequest(t, e, http.MethodGet, "/users/2/trades?market=ETH", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUserPositions(t *testing.T) {
+	ex := exchange.New(exchange.Config{})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	ex.Deposit(1, ledger.USD, 10000)
+	ex.Deposit(2, ledger.ETH, 5)
+	doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":2000,"market":"ETH"}`)
+	doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1.5,"price":2000,"market":"ETH"}`)
+
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/users/1/positions", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected bob refused alice's positions, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, c := range []struct{ key, path, want string }{
+		{alice, "/users/1/positions", `{"positions":[{"market":"ETH","realizedPnl":0,"unrealizedPnl":0,"size":1.5,"entryPrice":2000,"lastPrice":2000}]}`},
+		{bob, "/users/2/positions", `{"positions":[{"market":"ETH","realizedPnl":0,"unrealizedPnl":0,"size":-1.5,"entryPrice":2000,"lastPrice":2000}]}`},
+	} {
+		rec := doUserRequest(t, e, c.key, http.MethodGet, c.path, "")
+		if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != c.want {
+			t.Fatalf("%s: expected %s, got %d: %s", c.path, c.want, rec.Code, rec.Body)
+		}
+	}
+	// a user who hasn't traded has none
+	if rec := doRequest(t, e, http.MethodGet, "/users/3/positions", ""); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"positions":[]}` {
+		t.Fatalf("expected no positions, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ex := exchange.New(exchange.Config{})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "USD", 1000)
+
+	// an open order holds 600 of alice's 1000
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":0.3,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/transfers", `{"to":2,"asset":"USD","amount":500,"reference":"rent"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a transfer touching held funds, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodPost, "/transfers", `{"from":1,"to":2,"asset":"USD","amount":100,"reference":"rent"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user's funds, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/transfers", `{"to":3,"asset":"USD","amount":100,"reference":"rent"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/transfers", `{"to":2,"asset":"USD","amount":100}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a reference, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var transfer exchange.Transfer
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/transfers", `{"to":2,"asset":"USD","amount":400,"reference":"rent"}`)
+	json.Unmarshal(rec.Body.Bytes(), &transfer)
+	if rec.Code != http.StatusCreated || transfer.ID == 0 || transfer.FromBalance != 0 || transfer.ToBalance != 400 {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	// the retry is answered with the same transfer, and moves nothing
+	var retried exchange.Transfer
+	rec = doUserRequest(t, e, alice, http.MethodPost, "/transfers", `{"to":2,"asset":"USD","amount":400,"reference":"rent"}`)
+	json.Unmarshal(rec.Body.Bytes(), &retried)
+	if rec.Code != http.StatusOK || retried.ID != transfer.ID || !retried.Repeated {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/transfers", `{"to":2,"asset":"USD","amount":1,"reference":"rent"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a reused reference, got %d: %s", rec.Code, rec.Body)
+	}
+	// operators move anyone's funds
+	if rec := doRequest(t, e, http.MethodPost, "/transfers", `{"from":2,"to":1,"asset":"USD","amount":50,"reference":"refund"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if free, held := ex.Balances(1)[ledger.USD], ex.Held(1)[ledger.USD]; free != 50 || held != 600 {
+		t.Fatalf("expected alice to have 50 free and 600 held, got %v and %v", free, held)
+	}
+	if free := ex.Balances(2)[ledger.USD]; free != 350 {
+		t.Fatalf("expected bob to have 350, got %v", free)
+	}
+}
+
+func TestBalances(t *testing.T) {
+	ex := exchange.New(exchange.Config{})
+	e := newServer(ex, testAdminKey)
+	alice := register(t, e, "alice")
+	if rec := doRequest(t, e, http.MethodGet, "/balances", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a key, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/admin/deposits", `{"user":1,"asset":"USD","amount":500}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected users to be refused deposits, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/admin/deposits", `{"user":2,"asset":"USD","amount":500}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/admin/deposits", `{"user":1,"asset":"USD","amount":-5}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative amount, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, body := range []string{
+		`{"user":1,"asset":"USD","amount":500}`,
+		`{"user":1,"asset":"USD","amount":250.5}`,
+		`{"user":1,"asset":"ETH","amount":2}`,
+	} {
+		if rec := doRequest(t, e, http.MethodPost, "/admin/deposits", body); rec.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	// an open order holds part of them, and an order beyond the rest is
+	// refused
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":0.25,"price":2000,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":3,"price":2100,"market":"ETH"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INSUFFICIENT_FUNDS") {
+		t.Fatalf("expected INSUFFICIENT_FUNDS, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1000,"price":2100,"market":"ETH"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INSUFFICIENT_FUNDS") {
+		t.Fatalf("expected an anonymous order refused, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp struct {
+		Balances map[string]float64 `json:"balances"`
+		Held     map[string]float64 `json:"held"`
+	}
+	rec := doUserRequest(t, e, alice, http.MethodGet, "/balances", "")
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || len(resp.Balances) != 2 || resp.Balances["USD"] != 250.5 || resp.Balances["ETH"] != 2 || len(resp.Held) != 1 || resp.Held["USD"] != 500 {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestFees(t *testing.T) {
+	ex := exchange.New(exchange.Config{Limits: map[exchange.Market]exchange.MarketConfig{exchange.MarketEth: {MakerFee: 0.001, TakerFee: 0.002}}})
+	e := newServer(ex, testAdminKey)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	register(t, e, "operator")
+	deposit(t, e, 1, "USD", 1000)
+	deposit(t, e, 2, "ETH", 2)
+	doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":250,"market":"ETH"}`)
+	doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":2,"price":250,"market":"ETH"}`)
+
+	if rec := doUserRequest(t, e, alice, http.MethodGet, "/admin/fees", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected users to be refused the fees, got %d: %s", rec.Code, rec.Body)
+	}
+	var report exchange.FeeReport
+	rec := doRequest(t, e, http.MethodGet, "/admin/fees", "")
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if rec.Code != http.StatusOK || report.Balances[ledger.USD] != 0.5 || report.Balances[ledger.ETH] != 0.004 || report.Markets[exchange.MarketEth][ledger.USD] != 0.5 {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := doRequest(t, e, http.MethodPost, "/admin/fees/withdraw", `{"user":4,"asset":"USD","amount":0.5}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/admin/fees/withdraw", `{"user":3,"asset":"USD","amount":1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for more than was collected, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, e, http.MethodPost, "/admin/fees/withdraw", `{"user":3,"asset":"USD","amount":0.5}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := ex.Balances(3)[ledger.USD]; got != 0.5 {
+		t.Fatalf("expected the operator to have been paid 0.5 USD, got %v", got)
+	}
+	rec = doRequest(t, e, http.MethodGet, "/admin/fees", "")
+	report = exchange.FeeReport{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if _, ok := report.Balances[ledger.USD]; ok || report.Markets[exchange.MarketEth][ledger.USD] != 0.5 {
+		t.Fatalf("expected the fees withdrawn still reported as collected, got %s", rec.Body)
+	}
+}
+
+func TestDepositAddress(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	alice := register(t, e, "alice")
+	if rec := doUserRequest(t, e, alice, http.MethodGet, "/deposits/address", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a deposit watcher, got %d: %s", rec.Code, rec.Body)
+	}
+
+	address := chain.Address("0x" + strings.Repeat("a", 40))
+	watcher := chain.NewWatcher(chain.WatcherConfig{Addresses: chain.NewAddressPool([]chain.Address{address}, ex), Exchange: ex})
+	e = newServer(ex, testAdminKey, withDepositWatcher(watcher))
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	for range 2 {
+		rec := doUserRequest(t, e, alice, http.MethodGet, "/deposits/address", "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), string(address)) {
+			t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/deposits/address", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the pool is used up, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodGet, "/deposits", ""); rec.Code != http.StatusOK || rec.Body.String() != "{\"deposits\":[]}\n" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWithdrawalRequests(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey, withWithdrawals(chain.NewWithdrawals(chain.WithdrawalConfig{Exchange: ex})))
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "ETH", 1)
+	to := "0x" + strings.Repeat("b", 40)
+
+	for _, body := range []string{
+		`{"asset":"USD","amount":0.5,"address":"` + to + `"}`,
+		`{"asset":"ETH","amount":0.5,"address":"0x1234"}`,
+		`{"asset":"ETH","amount":2,"address":"` + to + `"}`,
+	} {
+		if rec := doUserRequest(t, e, alice, http.MethodPost, "/withdrawals", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/withdrawals", `{"asset":"ETH","amount":0.5,"address":"`+to+`"}`)
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"status":"PENDING"`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if held := ex.Held(1)["ETH"]; held != 0.5 {
+		t.Fatalf("expected 0.5 ETH held, got %v", held)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodGet, "/withdrawals/1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/withdrawals/1", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's withdrawal, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/withdrawals", ""); rec.Body.String() != "{\"withdrawals\":[]}\n" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMarketTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "assets.json")
+	contract := "0x" + strings.Repeat("C", 40)
+	os.WriteFile(path, []byte(`{"LINK":{"base":"LINK","quote":"USDC","baseToken":{"contract":"`+contract+`","decimals":18},"quoteToken":{"contract":"0x`+strings.Repeat("d", 40)+`","decimals":6}}}`), 0o600)
+	assets, err := loadMarketAssets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Markets: []exchange.Market{exchange.MarketEth, "LINK"}, Assets: assets})
+	tokens, err := chainTokens(ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Asset != "LINK" || tokens[0].Contract != chain.Address(strings.ToLower(contract)) || tokens[1].Asset != "USDC" || tokens[1].Decimals != 6 {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+
+	assets["LINK"] = exchange.MarketAssets{Base: "LINK", Quote: "USD", BaseToken: &exchange.Token{Contract: "0x1234"}}
+	if _, err := chainTokens(exchange.New(exchange.Config{AnonymousOrders: true, Markets: []exchange.Market{"LINK"}, Assets: assets})); !errors.Is(err, chain.ErrInvalidAddress) {
+		t.Fatalf("expected ErrInvalidAddress, got %v", err)
+	}
+}
+
+func TestWallets(t *testing.T) {
+	ceilings, err := parseHotCeilings("ETH=10, USDC=50000")
+	if err != nil || !reflect.DeepEqual(ceilings, map[ledger.Asset]float64{"ETH": 10, "USDC": 50000}) {
+		t.Fatalf("unexpected ceilings %v, %v", ceilings, err)
+	}
+	for _, s := range []string{"ETH", "ETH=-1", "eth=1", "ETH=ten"} {
+		if _, err := parseHotCeilings(s); err == nil {
+			t.Fatalf("expected %q rejected", s)
+		}
+	}
+
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	if rec := doRequest(t, newServer(ex, testAdminKey), http.MethodGet, "/admin/wallets/sweeps", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without cold storage, got %d: %s", rec.Code, rec.Body)
+	}
+	sweeper := chain.NewSweeper(chain.SweeperConfig{Addresses: chain.NewAddressPool(nil, nil)})
+	e := newServer(ex, testAdminKey, withSweeper(sweeper))
+	if rec := doRequest(t, e, http.MethodGet, "/admin/wallets/sweeps", ""); rec.Code != http.StatusOK || rec.Body.String() != "{\"sweeps\":[]}\n" {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// dialGRPC serves e's gRPC API in memory and returns a client for it.
+func dialGRPC(t *testing.T, ex *exchange.Exchange) (*echo.Echo, exchangepb.ExchangeClient) {
+	t.Helper()
+	rpc := grpc.NewServer()
+	e := newServer(ex, testAdminKey, withGRPC(rpc))
+	lis := bufconn.Listen(1 << 20)
+	go rpc.Serve(lis)
+	t.Cleanup(rpc.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return e, exchangepb.NewExchangeClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e, client := dialGRPC(t, ex)
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "USD", 1000)
+	deposit(t, e, 2, "ETH", 1)
+	as := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+	}
+
+	resting, err := client.PlaceOrder(as(bob), &exchangepb.PlaceOrderRequest{
+		Market:        "ETH",
+		Type:          exchangepb.OrderType_ORDER_TYPE_LIMIT,
+		Size:          1,
+		Price:         100,
+		ClientOrderId: "ask-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resting.Rested || resting.Remaining != 1 {
+		t.Fatalf("expected the ask to rest, got %v", resting)
+	}
+
+	report, err := client.PlaceOrder(as(alice), &exchangepb.PlaceOrderRequest{
+		Market: "ETH",
+		Type:   exchangepb.OrderType_ORDER_TYPE_LIMIT,
+		Bid:    true,
+		Size:   0.4,
+		Price:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilledSize != 0.4 || report.AvgPrice != 100 || len(report.Trades) != 1 || report.Trades[0].CounterpartyId != resting.OrderId {
+		t.Fatalf("expected the bid to fill against the ask, got %v", report)
+	}
+
+	book, err := client.GetBook(context.Background(), &exchangepb.GetBookRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Asks) != 1 || book.Asks[0].Price != 100 || book.Asks[0].Size != 0.6 || len(book.Bids) != 0 {
+		t.Fatalf("unexpected book %v", book)
+	}
+
+	order, err := client.GetOrder(as(bob), &exchangepb.GetOrderRequest{Order: &exchangepb.GetOrderRequest_ClientOrderId{ClientOrderId: "ask-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderId != resting.OrderId || order.FilledSize != 0.4 || order.Remaining != 0.6 || order.Status != "PARTIALLY_FILLED" {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	// orders are only found, and cancelled, by their owner
+	_, err = client.CancelOrder(as(alice), &exchangepb.CancelOrderRequest{Order: &exchangepb.CancelOrderRequest_OrderId{OrderId: resting.OrderId}})
+	if st := status.Convert(err); st.Code() != codes.NotFound {
+		t.Fatalf("expected alice's cancel to find nothing, got %v", err)
+	} else if info, ok := st.Details()[0].(*errdetails.ErrorInfo); !ok || info.Reason != "ORDER_NOT_FOUND" {
+		t.Fatalf("expected ORDER_NOT_FOUND, got %v", st.Details())
+	}
+	cancelled, err := client.CancelOrder(as(bob), &exchangepb.CancelOrderRequest{Order: &exchangepb.CancelOrderRequest_OrderId{OrderId: resting.OrderId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Remaining != 0.6 || cancelled.FilledSize != 0.4 {
+		t.Fatalf("unexpected cancel %v", cancelled)
+	}
+
+	if _, err := client.PlaceOrder(as("no-such-key"), &exchangepb.PlaceOrderRequest{Market: "ETH"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected a bad key to be refused, got %v", err)
+	}
+	if _, err := client.PlaceOrder(context.Background(), &exchangepb.PlaceOrderRequest{Market: "ETH", Size: 1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an order without a type to be refused, got %v", err)
+	}
+}
+
+func TestGRPCStreams(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	e, client := dialGRPC(t, ex)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	book, err := client.StreamBook(ctx, &exchangepb.StreamBookRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trades, err := client.StreamTrades(ctx, &exchangepb.StreamTradesRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the book starts from a snapshot, and each update links to the last
+	snapshot, err := book.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.Snapshot || snapshot.Seq != 1 || len(snapshot.Asks) != 1 || snapshot.Asks[0].Size != 1 || len(snapshot.Bids) != 0 {
+		t.Fatalf("unexpected snapshot %v", snapshot)
+	}
+	// the trade stream is subscribed once its headers arrive
+	if _, err := trades.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":0.25,"market":"ETH"}`)
+	update, err := book.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Snapshot || update.PrevSeq != 1 || update.Seq != 2 || len(update.Asks) != 1 || update.Asks[0].Size != 0.75 {
+		t.Fatalf("unexpected update %v", update)
+	}
+	trade, err := trades.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeId != 1 || trade.Seq != 2 || !trade.Bid || trade.Price != 100 || trade.Size != 0.25 || trade.Timestamp != time.Unix(1_700_000_000, 0).UnixNano() {
+		t.Fatalf("unexpected trade %v", trade)
+	}
+
+	// a client that saw the first trade resumes after it
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":0.5,"market":"ETH"}`)
+	resumed, err := client.StreamTrades(ctx, &exchangepb.StreamTradesRequest{Market: "ETH", AfterTradeId: proto.Uint64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade, err := resumed.Recv(); err != nil || trade.TradeId != 2 || trade.Size != 0.5 {
+		t.Fatalf("expected the missed trade, got %v %v", trade, err)
+	}
+
+	stream, err := client.StreamBook(ctx, &exchangepb.StreamBookRequest{Market: "NOPE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an unknown market to be refused, got %v", err)
+	}
+}
+
+func TestFIX(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	acceptor := fix.NewAcceptor(fix.AcceptorConfig{})
+	e := newServer(ex, testAdminKey, withFIX(acceptor))
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "USD", 1000)
+	deposit(t, e, 2, "ETH", 1)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptor.Serve(lis)
+	defer acceptor.Close()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	seq := 1
+	send := func(msg *fix.Message) {
+		t.Helper()
+		header := []fix.Field{
+			{Tag: fix.TagMsgType, Value: msg.Type()},
+			{Tag: fix.TagSenderCompID, Value: "ALICE"},
+			{Tag: fix.TagTargetCompID, Value: fix.DefaultCompID},
+			{Tag: fix.TagMsgSeqNum, Value: strconv.Itoa(seq)},
+			{Tag: fix.TagSendingTime, Value: "20231114-22:13:20.000"},
+		}
+		seq++
+		out := &fix.Message{Fields: append(header, msg.Fields[1:]...)}
+		if _, err := conn.Write(out.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(msgType string, fields map[fix.Tag]string) *fix.Message {
+		t.Helper()
+		msg, err := fix.ReadMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type() != msgType {
+			t.Fatalf("expected message type %s, got %s", msgType, msg)
+		}
+		for tag, want := range fields {
+			if got, _ := msg.Get(tag); got != want {
+				t.Fatalf("expected %d=%s, got %s", tag, want, msg)
+			}
+		}
+		return msg
+	}
+
+	send(fix.NewMessage(fix.MsgLogon).Set(fix.TagEncryptMethod, "0").Set(fix.TagHeartBtInt, "30").Set(fix.TagPassword, alice))
+	expect(fix.MsgLogon, nil)
+
+	send(fix.NewMessage(fix.MsgNewOrderSingle).
+		Set(fix.TagClOrdID, "bid-1").
+		Set(fix.TagSymbol, "ETH").
+		Set(fix.TagSide, "1").
+		Set(fix.TagOrderQty, "1").
+		Set(fix.TagOrdType, "2").
+		Set(fix.TagPrice, "100").
+		Set(fix.TagTransactTime, "20231114-22:13:20.000"))
+	accepted := expect(fix.MsgExecutionReport, map[fix.Tag]string{
+		fix.TagClOrdID: "bid-1", fix.TagExecType: "0", fix.TagOrdStatus: "0",
+		fix.TagSymbol: "ETH", fix.TagSide: "1", fix.TagOrderQty: "1", fix.TagPrice: "100",
+		fix.TagLeavesQty: "1", fix.TagCumQty: "0", fix.TagAvgPx: "0",
+		fix.TagTransactTime: "20231114-22:13:20.000",
+	})
+	id, _ := accepted.Get(fix.TagOrderID)
+
+	// orders placed anywhere are reported, here bob's filling part of alice's
+	if rec := doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":0.25,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+	expect(fix.MsgExecutionReport, map[fix.Tag]string{
+		fix.TagOrderID: id, fix.TagClOrdID: "bid-1", fix.TagExecType: "F", fix.TagOrdStatus: "1",
+		fix.TagExecID: "ETH-2-" + id + "-F1", fix.TagLastQty: "0.25", fix.TagLastPx: "100",
+		fix.TagLeavesQty: "0.75", fix.TagCumQty: "0.25", fix.TagAvgPx: "100",
+	})
+
+	send(fix.NewMessage(fix.MsgOrderCancelRequest).
+		Set(fix.TagClOrdID, "cancel-1").
+		Set(fix.TagOrigClOrdID, "bid-1").
+		Set(fix.TagSymbol, "ETH").
+		Set(fix.TagSide, "1"))
+	expect(fix.MsgExecutionReport, map[fix.Tag]string{
+		fix.TagOrderID: id, fix.TagClOrdID: "cancel-1", fix.TagOrigClOrdID: "bid-1", fix.TagExecType: "4", fix.TagOrdStatus: "4",
+		fix.TagLeavesQty: "0", fix.TagCumQty: "0.25",
+	})
+	send(fix.NewMessage(fix.MsgOrderCancelRequest).
+		Set(fix.TagClOrdID, "cancel-2").
+		Set(fix.TagOrigClOrdID, "bid-1").
+		Set(fix.TagSymbol, "ETH").
+		Set(fix.TagSide, "1"))
+	expect(fix.MsgOrderCancelReject, map[fix.Tag]string{
+		fix.TagOrderID: id, fix.TagClOrdID: "cancel-2", fix.TagOrigClOrdID: "bid-1", fix.TagOrdStatus: "8",
+		fix.TagCxlRejResponseTo: "1", fix.TagCxlRejReason: "1",
+	})
+
+	send(fix.NewMessage(fix.MsgNewOrderSingle).
+		Set(fix.TagClOrdID, "bid-2").
+		Set(fix.TagSymbol, "NOPE").
+		Set(fix.TagSide, "1").
+		Set(fix.TagOrderQty, "1").
+		Set(fix.TagOrdType, "2").
+		Set(fix.TagPrice, "100"))
+	expect(fix.MsgExecutionReport, map[fix.Tag]string{
+		fix.TagOrderID: "NONE", fix.TagClOrdID: "bid-2", fix.TagExecType: "8", fix.TagOrdStatus: "8",
+		fix.TagOrdRejReason: "1",
+	})
+	send(fix.NewMessage(fix.MsgNewOrderSingle).Set(fix.TagClOrdID, "bid-3").Set(fix.TagSymbol, "ETH").Set(fix.TagSide, "1"))
+	expect(fix.MsgReject, map[fix.Tag]string{fix.TagRefSeqNum: "6", fix.TagRefTagID: "38", fix.TagSessionRejectReason: "1"})
+	send(fix.NewMessage("AE"))
+	expect(fix.MsgBusinessMessageReject, map[fix.Tag]string{fix.TagRefSeqNum: "7", fix.TagRefMsgType: "AE", fix.TagBusinessRejectReason: "3"})
+}
+
+// packetChan hands on the packets written to it.
+type packetChan chan []byte
+
+func (c packetChan) Write(b []byte) (int, error) {
+	c <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestMulticast(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	defer ex.Close()
+	e := newServer(ex, testAdminKey)
+	packets := make(packetChan, 16)
+	p := multicast.NewPublisher(multicast.PublisherConfig{Conn: packets, Heartbeat: time.Hour})
+	defer p.Close()
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go publishMarketData(ctx, ex, p)
+
+	// each market starts from a snapshot, in whichever order
+	ethSeq := uint64(0)
+	for range ex.Markets() {
+		_, msgs, err := multicast.ParsePacket(<-packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgs[0].Template != sbe.TemplateSnapshot {
+			t.Fatalf("expected a snapshot, got %+v", msgs)
+		}
+		if msgs[0].Market == exchange.MarketEth {
+			if msgs[0].Levels != 1 || len(msgs) != 2 || msgs[1].Price != px(100) {
+				t.Fatalf("unexpected snapshot %+v", msgs)
+			}
+			ethSeq = msgs[0].Seq
+		}
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+	seq, msgs, err := multicast.ParsePacket(<-packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != uint64(len(ex.Markets())+1) {
+		t.Fatalf("expected packet %d, got %d", len(ex.Markets())+1, seq)
+	}
+	if len(msgs) != 2 || msgs[0].Type != exchange.FeedTrade || msgs[0].Side != orderbook.SideBid ||
+		msgs[1].Type != exchange.FeedBook || msgs[1].Size != sz(0) || msgs[1].PrevSeq != ethSeq {
+		t.Fatalf("unexpected update %+v", msgs)
+	}
+}
+
+// kafkaLog records the messages written to it.
+type kafkaLog struct {
+	mu   sync.Mutex
+	msgs []kafka.Message
+}
+
+func (l *kafkaLog) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.msgs = append(l.msgs, msgs...)
+	return nil
+}
+
+func TestKafkaEvents(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	w := &kafkaLog{}
+	publishToKafka(ex, w, "test")
+
+	var report struct {
+		OrderID uint64 `json:"orderId"`
+	}
+	json.Unmarshal(doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`).Body.Bytes(), &report)
+	ask := report.OrderID
+	json.Unmarshal(doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`).Body.Bytes(), &report)
+	bid := report.OrderID
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":50,"market":"BTC"}`)
+	// closing drains the handler
+	ex.Close()
+
+	var got []string
+	for _, msg := range w.msgs {
+		var event exchange.Event
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			t.Fatal(err)
+		}
+		if market := string(msg.Headers[0].Value); market != string(event.Market) {
+			t.Fatalf("expected a %s header, got %s", event.Market, market)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s %s", msg.Topic, msg.Key, event.Type, event.Market))
+	}
+	want := []string{
+		fmt.Sprintf("test.orders %d ORDER_ACCEPTED ETH", ask),
+		"test.book  LEVEL_CHANGED ETH",
+		fmt.Sprintf("test.orders %d ORDER_ACCEPTED ETH", bid),
+		fmt.Sprintf("test.trades %d FILL ETH", bid),
+		fmt.Sprintf("test.orders %d ORDER_DONE ETH", ask),
+		fmt.Sprintf("test.orders %d ORDER_DONE ETH", bid),
+		"test.book  LEVEL_CHANGED ETH",
+	}
+	// the BTC order may have been handled before or after
+	var eth []string
+	for _, g := range got {
+		if !strings.HasSuffix(g, "BTC") {
+			eth = append(eth, g)
+		}
+	}
+	if !slices.Equal(eth, want) || len(got) != len(want)+2 {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	// a market's messages all go to one partition
+	partitions := []int{0, 1, 2, 3}
+	for _, market := range ex.Markets() {
+		msg := kafka.Message{Headers: []kafka.Header{{Key: "market", Value: []byte(market)}}}
+		p := marketBalancer{}.Balance(msg, partitions...)
+		for i := range 10 {
+			msg.Key = strconv.AppendInt(nil, int64(i), 10)
+			if got := (marketBalancer{}).Balance(msg, partitions...); got != p {
+				t.Fatalf("%s: expected partition %d, got %d", market, p, got)
+			}
+		}
+	}
+}
+
+// jetStreamLog records the messages published to it, acknowledging each.
+type jetStreamLog struct {
+	mu   sync.Mutex
+	msgs []*nats.Msg
+}
+
+type pubAck struct {
+	msg *nats.Msg
+	ok  chan *jetstream.PubAck
+}
+
+func (a pubAck) Ok() <-chan *jetstream.PubAck { return a.ok }
+func (a pubAck) Err() <-chan error            { return nil }
+func (a pubAck) Msg() *nats.Msg               { return a.msg }
+
+func (l *jetStreamLog) PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.msgs = append(l.msgs, msg)
+	ack := pubAck{msg: msg, ok: make(chan *jetstream.PubAck, 1)}
+	ack.ok <- &jetstream.PubAck{Sequence: uint64(len(l.msgs))}
+	return ack, nil
+}
+
+func TestJetStreamEvents(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	e := newServer(ex, testAdminKey)
+	js := &jetStreamLog{}
+	publishToJetStream(ex, js, "test")
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+	// closing drains the handler
+	ex.Close()
+
+	var got []string
+	for _, msg := range js.msgs {
+		var event exchange.Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s", msg.Subject, msg.Header.Get(jetstream.MsgIDHeader), event.Type))
+	}
+	want := []string{
+		"test.orders.ETH ETH-1-0 ORDER_ACCEPTED",
+		"test.book.ETH ETH-1-1 LEVEL_CHANGED",
+		"test.orders.ETH ETH-2-0 ORDER_ACCEPTED",
+		"test.trades.ETH ETH-2-1 FILL",
+		"test.orders.ETH ETH-2-2 ORDER_DONE",
+		"test.orders.ETH ETH-2-3 ORDER_DONE",
+		"test.book.ETH ETH-2-4 LEVEL_CHANGED",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Journal: walJournal{log}})
+	ctx := context.Background()
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(101), Market: exchange.MarketEth})
+	report, _ := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(99), Market: exchange.MarketEth})
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(0.5), Market: exchange.MarketEth})
+	ex.CancelOrder(ctx, 0, report.OrderID)
+	want, _ := ex.Export(exchange.MarketEth)
+	ex.Close()
+	log.Close()
+
+	// a restart replays the log into empty books
+	if log, err = wal.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	restarted := exchange.New(exchange.Config{AnonymousOrders: true, Journal: walJournal{log}})
+	defer restarted.Close()
+	if n, err := restarted.Replay(journaledCommands(log)); err != nil || n != 4 {
+		t.Fatalf("replayed %d commands: %v", n, err)
+	}
+	if got, _ := restarted.Export(exchange.MarketEth); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed book\n%+v\nwant\n%+v", got, want)
+	}
+	// and carries on journaling to it
+	restarted.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(102), Market: exchange.MarketEth})
+	if log.Len() != 5 {
+		t.Fatalf("log holds %d commands, want 5", log.Len())
+	}
+}
+
+func TestCheckpointer(t *testing.T) {
+	dir := t.TempDir()
+	log, err := wal.Open(filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Journal: walJournal{log}})
+	checkpoints := &checkpointer{ex: ex, log: log, path: filepath.Join(dir, "checkpoint")}
+	ctx := context.Background()
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(101), Market: exchange.MarketEth})
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(0.5), Market: exchange.MarketEth})
+	if err := checkpoints.write(); err != nil {
+		t.Fatal(err)
+	}
+	// the checkpoint covers everything journaled so far
+	if log.Len() != 0 {
+		t.Fatalf("log holds %d commands after the checkpoint, want 0", log.Len())
+	}
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(99), Market: exchange.MarketEth})
+	want, _ := ex.Export(exchange.MarketEth)
+	ex.Close()
+	log.Close()
+
+	// a restart restores the checkpoint and replays what came after it
+	if log, err = wal.Open(filepath.Join(dir, "wal")); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	restarted := exchange.New(exchange.Config{AnonymousOrders: true, Journal: walJournal{log}})
+	defer restarted.Close()
+	checkpoints = &checkpointer{ex: restarted, log: log, path: checkpoints.path}
+	if seq, err := checkpoints.restore(); err != nil || seq != 2 {
+		t.Fatalf("restored checkpoint %d: %v", seq, err)
+	}
+	if n, err := restarted.Replay(journaledCommands(log)); err != nil || n != 1 {
+		t.Fatalf("replayed %d commands: %v", n, err)
+	}
+	if got, _ := restarted.Export(exchange.MarketEth); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored book\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestBookAt(t *testing.T) {
+	dir := t.TempDir()
+	log, err := wal.Open(filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Journal: walJournal{log}, Clock: clk})
+	defer ex.Close()
+	checkpoints := &checkpointer{ex: ex, log: log, path: filepath.Join(dir, "checkpoint"), retain: 3}
+	e := newServer(ex, testAdminKey, withCheckpoints(checkpoints))
+	ctx := context.Background()
+	write := func() {
+		t.Helper()
+		if err := checkpoints.write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// commands 1 and 2 before the first checkpoint, 3 and 4 before the
+	// second, a minute apart, and 5 before the third
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(101), Market: exchange.MarketEth})
+	bid, _ := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(99), Market: exchange.MarketEth})
+	write()
+	clk.Advance(time.Minute)
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(103), Market: exchange.MarketEth})
+	clk.Advance(time.Minute)
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(0.5), Market: exchange.MarketEth})
+	write()
+	clk.Advance(time.Minute)
+	ex.CancelOrder(ctx, 0, bid.OrderID)
+	write()
+	// the journal keeps the commands after the oldest checkpoint kept
+	if log.Len() != 3 {
+		t.Fatalf("log holds %d commands, want 3", log.Len())
+	}
+	live, _ := ex.Export(exchange.MarketEth)
+
+	bookAt := func(query string) exchange.PastBook {
+		t.Helper()
+		rec := doRequest(t, e, http.MethodGet, "/admin/markets/ETH/book-at?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", query, rec.Code, rec.Body)
+		}
+		var book exchange.PastBook
+		decodeUnits(t, rec.Body.Bytes(), &book)
+		return book
+	}
+	sizes := func(orders []exchange.Order) []orderbook.Size {
+		var sizes []orderbook.Size
+		for _, o := range orders {
+			sizes = append(sizes, o.Size)
+		}
+		return sizes
+	}
+
+	// between the first two checkpoints, from the first and the journal
+	book := bookAt("time=" + start.Add(90*time.Second).UTC().Format(time.RFC3339))
+	if book.Seq != 3 || !slices.Equal(sizes(book.Asks), []orderbook.Size{sz(2), sz(1)}) || !slices.Equal(sizes(book.Bids), []orderbook.Size{sz(1)}) {
+		t.Fatalf("unexpected book after command 3: %+v", book)
+	}
+	book = bookAt("seq=4")
+	if book.Seq != 4 || !slices.Equal(sizes(book.Asks), []orderbook.Size{sz(1.5), sz(1)}) || len(book.Bids) != 1 {
+		t.Fatalf("unexpected book after command 4: %+v", book)
+	}
+	book = bookAt("time=" + start.Add(time.Hour).UTC().Format(time.RFC3339))
+	if book.Seq != 5 || book.Time != start.Add(3*time.Minute).UnixNano() || len(book.Bids) != 0 {
+		t.Fatalf("unexpected latest book: %+v", book)
+	}
+
+	if rec := doRequest(t, e, http.MethodGet, "/admin/markets/ETH/book-at?time="+start.Add(-time.Hour).UTC().Format(time.RFC3339), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the oldest checkpoint, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, query := range []string{"", "seq=1&time=2024-01-01T00:00:00Z", "seq=first", "time=yesterday"} {
+		if rec := doRequest(t, e, http.MethodGet, "/admin/markets/ETH/book-at?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %q refused, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/admin/markets/DOGE/book-at?seq=1", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown market, got %d: %s", rec.Code, rec.Body)
+	}
+	if got, _ := ex.Export(exchange.MarketEth); !reflect.DeepEqual(got, live) {
+		t.Fatalf("live book changed\n%+v\nwant\n%+v", got, live)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("a=10.0.0.1:7000, b=10.0.0.2:7000")
+	if err != nil || !reflect.DeepEqual(peers, map[string]string{"a": "10.0.0.1:7000", "b": "10.0.0.2:7000"}) {
+		t.Fatalf("unexpected peers %v, %v", peers, err)
+	}
+	for _, s := range []string{"a", "=10.0.0.1:7000", "a=", "a=x:1,a=y:1"} {
+		if _, err := parsePeers(s); err == nil {
+			t.Fatalf("expected %q rejected", s)
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	defer ex.Close()
+	engineServer := grpc.NewServer()
+	remote.Register(engineServer, ex)
+	lis := bufconn.Listen(1 << 20)
+	go engineServer.Serve(lis)
+	defer engineServer.Stop()
+
+	// gateways share the engine's users and books
+	gateway := func() *echo.Echo {
+		client, err := remote.Dial(context.Background(), "passthrough:///engine", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return newServer(client, testAdminKey, withUsers(client.Users()))
+	}
+	a, b := gateway(), gateway()
+	key := register(t, a, "alice")
+	if rec := doUserRequest(t, b, key, http.MethodGet, "/me", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected alice's key to work on another gateway, got %d: %s", rec.Code, rec.Body)
+	}
+	deposit(t, a, 1, "USD", 1000)
+	rec := doUserRequest(t, b, key, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":99,"market":"ETH"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the order placed, got %d: %s", rec.Code, rec.Body)
+	}
+	if orders := ex.UserOrders(1); len(orders) != 1 || orders[0].Price != px(99) {
+		t.Fatalf("expected the order on the engine, got %+v", orders)
+	}
+	rec = doRequest(t, a, http.MethodGet, "/book/ETH", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"price":"99.00"`) {
+		t.Fatalf("expected the order in the book, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// without its engine a gateway is out of rotation, and refuses orders
+	engineServer.Stop()
+	if rec := doRequest(t, a, http.MethodGet, "/ready", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = doRequest(t, b, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":98,"market":"ETH"}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	eth := exchange.New(exchange.Config{AnonymousOrders: true, Markets: []exchange.Market{exchange.MarketEth}})
+	defer eth.Close()
+	btc := exchange.New(exchange.Config{AnonymousOrders: true, Markets: []exchange.Market{exchange.MarketBtc}})
+	defer btc.Close()
+	if _, err := newRouter([]engine{eth, eth}); err == nil {
+		t.Fatal("expected a market on two engines to be refused")
+	}
+	r, err := newRouter([]engine{eth, btc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, unsubscribe := r.SubscribeOrderUpdates(1)
+	defer unsubscribe()
+	e := newServer(r, testAdminKey)
+	key := register(t, e, "alice")
+
+	// USD backs orders on both engines, so it must be deposited for one
+	rec := doRequest(t, e, http.MethodPost, "/admin/deposits", `{"user":1,"asset":"USD","amount":1000}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an ambiguous deposit to be refused, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, body := range []string{
+		`{"user":1,"asset":"USD","amount":1000,"market":"ETH"}`,
+		`{"user":1,"asset":"USD","amount":500,"market":"BTC"}`,
+	} {
+		if rec := doRequest(t, e, http.MethodPost, "/admin/deposits", body); rec.Code != http.StatusCreated {
+			t.Fatalf("expected the deposit, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	deposit(t, e, 1, "ETH", 2)
+	if got := eth.Balances(1)[ledger.ETH]; got != 2 {
+		t.Fatalf("expected ETH deposited on the engine trading it, got %v", got)
+	}
+	if got := r.Balances(1)[ledger.USD]; got != 1500 {
+		t.Fatalf("expected USD balances summed across engines, got %v", got)
+	}
+
+	// each market's orders go to its engine
+	for _, body := range []string{
+		`{"type":"LIMIT","bid":true,"size":1,"price":99,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":1,"price":98,"market":"BTC"}`,
+	} {
+		if rec := doUserRequest(t, e, key, http.MethodPost, "/order", body); rec.Code != http.StatusOK {
+			t.Fatalf("expected the order placed, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if len(eth.UserOrders(1)) != 1 || len(btc.UserOrders(1)) != 1 {
+		t.Fatalf("expected an order on each engine, got %+v and %+v", eth.UserOrders(1), btc.UserOrders(1))
+	}
+	orders := r.UserOrders(1)
+	if len(orders) != 2 || orders[0].ID >= orders[1].ID {
+		t.Fatalf("expected both orders by ID, got %+v", orders)
+	}
+	for range 2 {
+		select {
+		case batch := <-updates:
+			if len(batch) == 0 || batch[0].Owner != 1 {
+				t.Fatalf("expected alice's update, got %+v", batch)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no order update")
+		}
+	}
+
+	// and orders are found on whichever engine has them
+	id := btc.UserOrders(1)[0].ID
+	path := fmt.Sprintf("/order/%d", id)
+	if rec := doUserRequest(t, e, key, http.MethodGet, path, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected the BTC order, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, key, http.MethodDelete, path, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected the BTC order cancelled, got %d: %s", rec.Code, rec.Body)
+	}
+	if status := btc.UserOrders(1)[0].Status; status != exchange.OrderCancelled {
+		t.Fatalf("expected the order cancelled on its engine, got %s", status)
+	}
+	audit, _ := eth.QueryAudit(exchange.AuditQuery{Action: exchange.AuditCancel})
+	if len(audit) != 0 {
+		t.Fatalf("expected the other engine not to hear of the cancel, got %+v", audit)
+	}
+	if rec := doUserRequest(t, e, key, http.MethodDelete, "/order/12345", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOrderHistory(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	history, err := store.OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	recorder := store.NewRecorder(history)
+	recorder.Record(ex)
+	plain := newServer(ex, testAdminKey)
+	if rec := doUserRequest(t, plain, register(t, plain, "carol"), http.MethodGet, "/me/history/orders", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no history routes without a database, got %d", rec.Code)
+	}
+	e := newServer(ex, testAdminKey, withHistory(history))
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "USD", 1000)
+	rec := doUserRequest(t, e, alice, http.MethodPost, "/order", `{"type":"LIMIT","bid":true,"size":1,"price":99,"market":"ETH"}`)
+	var placed struct {
+		OrderID uint64 `json:"orderId"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &placed)
+	if rec := doUserRequest(t, e, alice, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected the order cancelled, got %d: %s", rec.Code, rec.Body)
+	}
+	ex.Close()
+	recorder.Close()
+
+	rec = doUserRequest(t, e, alice, http.MethodGet, "/me/history/orders?limit=10&from=2024-01-01T00:00:00Z", "")
+	var orders struct {
+		Orders []store.Order `json:"orders"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &orders)
+	if rec.Code != http.StatusOK || len(orders.Orders) != 1 || orders.Orders[0].ID != placed.OrderID {
+		t.Fatalf("expected alice's order, got %d: %s", rec.Code, rec.Body)
+	}
+	path := fmt.Sprintf("/me/history/orders/%d", placed.OrderID)
+	rec = doUserRequest(t, e, alice, http.MethodGet, path, "")
+	var order struct {
+		Updates []exchange.OrderUpdate `json:"updates"`
+	}
+	decodeUnits(t, rec.Body.Bytes(), &order)
+	if rec.Code != http.StatusOK || len(order.Updates) != 2 || order.Updates[1].Type != exchange.OrderUpdateCancelled {
+		t.Fatalf("expected the order accepted and cancelled, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected alice's order hidden from bob, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, query := range []string{"limit=0", "limit=1001", "from=yesterday"} {
+		if rec := doUserRequest(t, e, alice, http.MethodGet, "/me/history/orders?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s refused, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestExportTrades(t *testing.T) {
+	ex := exchange.New(exchange.Config{Limits: map[exchange.Market]exchange.MarketConfig{
+		exchange.MarketEth: {MakerFee: 0.001, TakerFee: 0.002},
+	}})
+	history, err := store.OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	recorder := store.NewRecorder(history)
+	recorder.Record(ex)
+	e := newServer(ex, testAdminKey, withHistory(history))
+	alice, bob, carol := register(t, e, "alice"), register(t, e, "bob"), register(t, e, "carol")
+	deposit(t, e, 1, "USD", 10000)
+	deposit(t, e, 2, "ETH", 1)
+	deposit(t, e, 3, "ETH", 1)
+
+	// alice's bid is taken by bob, then carol
+	var ids []string
+	for _, key := range []string{alice, bob, carol} {
+		bid := key == alice
+		body := fmt.Sprintf(`{"type":"LIMIT","bid":%t,"size":%d,"price":2000,"market":"ETH"}`, bid, map[bool]int{true: 2, false: 1}[bid])
+		rec := doUserRequest(t, e, key, http.MethodPost, "/order", body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var report exchange.ExecutionReport
+		decodeUnits(t, rec.Body.Bytes(), &report)
+		ids = append(ids, strconv.FormatUint(report.OrderID, 10))
+	}
+	ex.Close()
+	recorder.Close()
+
+	export := func(rec *httptest.ResponseRecorder) [][]string {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get(echo.HeaderContentDisposition); !strings.HasPrefix(got, `attachment; filename="trades-ETH-`) || !strings.HasSuffix(got, `.csv"`) {
+			t.Fatalf("unexpected Content-Disposition %q", got)
+		}
+		rows, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(rows[0], exportColumns) {
+			t.Fatalf("unexpected header %v", rows[0])
+		}
+		return rows[1:]
+	}
+
+	rows := export(doRequest(t, e, http.MethodGet, "/trades/ETH/export?format=csv&from=2024-01-01T00:00:00Z", ""))
+	if len(rows) != 2 {
+		t.Fatalf("expected both trades, got %v", rows)
+	}
+	first := rows[0]
+	if first[0] != "1" || first[2] != "ETH" || first[3] != "2000" || first[4] != "1" || first[5] != "2000" || first[6] != "SELL" {
+		t.Fatalf("unexpected row %v", first)
+	}
+	if _, err := time.Parse(time.RFC3339, first[1]); err != nil {
+		t.Fatalf("expected an RFC 3339 time, got %q", first[1])
+	}
+	// alice made with the bid, paying the maker fee in ETH, and bob took,
+	// paying the taker fee in USD
+	if first[7] != ids[0] || first[8] != ids[1] || first[9] != "0.001" || first[10] != "4" {
+		t.Fatalf("unexpected orders or fees in %v", first)
+	}
+
+	rows = export(doUserRequest(t, e, bob, http.MethodGet, "/trades/ETH/export", ""))
+	if len(rows) != 1 || rows[0][0] != "1" {
+		t.Fatalf("expected only bob's trade, got %v", rows)
+	}
+	rows = export(doRequest(t, e, http.MethodGet, "/trades/ETH/export?user=3", ""))
+	if len(rows) != 1 || rows[0][0] != "2" {
+		t.Fatalf("expected only carol's trade, got %v", rows)
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodGet, "/trades/ETH/export?user=1", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected bob refused alice's trades, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, query := range []string{"format=json", "from=yesterday", "user=bob"} {
+		if rec := doRequest(t, e, http.MethodGet, "/trades/ETH/export?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s refused, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/trades/DOGE/export", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown market, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDepthCache(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	mr := miniredis.RunT(t)
+	cache := &depthCache{rdb: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	defer cache.Close()
+	cacheBooks(ex, cache)
+	e := newServer(ex, testAdminKey, withDepthCache(cache))
+	plain := newServer(ex, testAdminKey)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	// cached waits for the book as of seq to be cached
+	cached := func(seq uint64) string {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			data, _ := mr.Get(bookKey(exchange.MarketEth))
+			var book exchange.OrderbookData
+			if json.Unmarshal([]byte(data), &book) == nil && book.Sequence == seq {
+				return data
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("book as of %d not cached, got %s", seq, data)
+			}
+		}
+	}
+
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":1,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":101,"market":"ETH"}`)
+	stale := cached(2)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":3,"price":101,"market":"ETH"}`)
+	cached(3)
+	want := doRequest(t, plain, http.MethodGet, "/book/ETH", "").Body.String()
+	if rec := doRequest(t, e, http.MethodGet, "/book/ETH", ""); rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Fatalf("expected the cached book\n%s\ngot %d\n%s", want, rec.Code, rec.Body)
+	}
+
+	// a book cached before the last operation is served as it is, and new
+	// subscribers have the operation's deltas applied to it
+	mr.Set(bookKey(exchange.MarketEth), stale)
+	if rec := doRequest(t, e, http.MethodGet, "/book/ETH", ""); !strings.Contains(rec.Body.String(), `"sequence":2`) {
+		t.Fatalf("expected the book read from the cache, got %s", rec.Body)
+	}
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Send(conn, `{"op":"subscribe","channel":"book","market":"ETH"}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{
+		`{"type":"subscribed","channel":"book","market":"ETH"}`,
+		`{"type":"snapshot","channel":"book","market":"ETH","seq":3,"data":[{"type":"book","market":"ETH","seq":3,"side":"ask","price":"100.00","size":"1.0000"},{"type":"book","market":"ETH","seq":3,"side":"ask","price":"101.00","size":"5.0000"}]}`,
+	} {
+		var got string
+		if err := websocket.Message.Receive(conn, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Fatalf("expected\n%s\ngot\n%s", w, got)
+		}
+	}
+
+	// without it the engine's book is served
+	mr.FlushAll()
+	if rec := doRequest(t, e, http.MethodGet, "/book/ETH", ""); rec.Body.String() != want {
+		t.Fatalf("expected the engine's book\n%s\ngot\n%s", want, rec.Body)
+	}
+}
+
+func TestRecentTrades(t *testing.T) {
+	ctx := context.Background()
+	history, err := store.OpenSQLite(ctx, filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	trade := func(ex *exchange.Exchange, n int) {
+		t.Helper()
+		ex.Deposit(1, ledger.ETH, float64(n))
+		if _, err := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(float64(n)), Price: px(100), User: 1, Market: exchange.MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+		for range n {
+			ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(1), Market: exchange.MarketEth})
+		}
+	}
+	// trades of a process since gone are only in the database
+	before := exchange.New(exchange.Config{AnonymousOrders: true})
+	recorder := store.NewRecorder(history)
+	recorder.Record(before)
+	trade(before, 3)
+	before.Close()
+	recorder.Close()
+
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clock.NewFake(time.Unix(1_700_000_000, 0))})
+	resumeIDs(ex, history)
+	trade(ex, 1)
+	ids := func(e *echo.Echo, query string) []uint64 {
+		t.Helper()
+		rec := doRequest(t, e, http.MethodGet, "/trades/ETH"+query, "")
+		var body struct {
+			Trades []struct {
+				ID uint64 `json:"id"`
+			} `json:"trades"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("expected trades, got %d: %s", rec.Code, rec.Body)
+		}
+		var ids []uint64
+		for _, t := range body.Trades {
+			ids = append(ids, t.ID)
+		}
+		return ids
+	}
+
+	e := newServer(ex, testAdminKey, withHistory(history))
+	want := `{"trades":[{"id":4,"price":"100.00","size":"1.0000","side":"bid","timestamp":1700000000000000000}]}`
+	if rec := doRequest(t, e, http.MethodGet, "/trades/ETH?limit=1", ""); strings.TrimSpace(rec.Body.String()) != want {
+		t.Fatalf("expected\n%s\ngot %d\n%s", want, rec.Code, rec.Body)
+	}
+	if got := ids(e, "?limit=3"); !reflect.DeepEqual(got, []uint64{4, 3, 2}) {
+		t.Fatalf("expected trades 4 to 2, got %v", got)
+	}
+	if got := ids(e, ""); !reflect.DeepEqual(got, []uint64{4, 3, 2, 1}) {
+		t.Fatalf("expected every trade, got %v", got)
+	}
+	if got := ids(newServer(ex, testAdminKey), ""); !reflect.DeepEqual(got, []uint64{4}) {
+		t.Fatalf("expected only the engine's trades without a database, got %v", got)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/trades/ETH?limit=1001", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a limit over 1000, got %d", rec.Code)
+	}
+	if rec := doRequest(t, e, http.MethodGet, "/trades/DOGE", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown market, got %d", rec.Code)
+	}
+}
+
+func TestCandles(t *testing.T) {
+	ctx := context.Background()
+	history, err := store.OpenSQLite(ctx, filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clk})
+	defer ex.Close()
+	recorder := store.NewRecorder(history)
+	candles := resumeCandles(ex, history)
+	recorder.Candles(candles)
+	recorder.Record(ex)
+	trade := func(price float64) {
+		t.Helper()
+		ex.Deposit(1, ledger.ETH, 1)
+		if _, err := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(price), User: 1, Market: exchange.MarketEth}); err != nil {
+			t.Fatal(err)
+		}
+		ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(1), Market: exchange.MarketEth})
+	}
+	trade(100)
+	clk.Advance(time.Minute)
+	trade(101)
+	recorder.Close()
+	// the live candle moves on before it is saved again
+	trade(99)
+
+	e := newServer(ex, testAdminKey, withHistory(history), withCandles(candles))
+	minute := time.Unix(1_700_000_040, 0)
+	want := fmt.Sprintf(`{"candles":[{"start":%d,"open":"101.00","high":"101.00","low":"99.00","close":"99.00","volume":"2.0000","trades":2},`+
+		`{"start":%d,"open":"100.00","high":"100.00","low":"100.00","close":"100.00","volume":"1.0000","trades":1}]}`, minute.UnixNano(), minute.Add(-time.Minute).UnixNano())
+	if rec := doRequest(t, e, http.MethodGet, "/candles/ETH", ""); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != want {
+		t.Fatalf("expected\n%s\ngot %d\n%s", want, rec.Code, rec.Body)
+	}
+	var body struct {
+		Candles []struct {
+			Start  int64 `json:"start"`
+			Trades int   `json:"trades"`
+		} `json:"candles"`
+	}
+	get := func(e *echo.Echo, query string) {
+		t.Helper()
+		body.Candles = nil
+		rec := doRequest(t, e, http.MethodGet, "/candles/ETH?"+query, "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("expected candles for %s, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+	if get(e, "interval=1h"); len(body.Candles) != 1 || body.Candles[0].Trades != 3 {
+		t.Fatalf("expected one hour's candle of every trade, got %+v", body.Candles)
+	}
+	if get(e, "from="+minute.UTC().Format(time.RFC3339)); len(body.Candles) != 1 || body.Candles[0].Start != minute.UnixNano() {
+		t.Fatalf("expected only the candle from the second minute, got %+v", body.Candles)
+	}
+	if get(e, "to="+minute.Add(-time.Second).UTC().Format(time.RFC3339)); len(body.Candles) != 1 || body.Candles[0].Start == minute.UnixNano() {
+		t.Fatalf("expected only the first minute's candle, got %+v", body.Candles)
+	}
+	if get(e, "limit=1"); len(body.Candles) != 1 || body.Candles[0].Trades != 2 {
+		t.Fatalf("expected only the live candle, got %+v", body.Candles)
+	}
+	// a gateway serves the candles as last saved
+	if get(newServer(ex, testAdminKey, withHistory(history)), ""); len(body.Candles) != 2 || body.Candles[0].Trades != 1 {
+		t.Fatalf("expected the saved candles, got %+v", body.Candles)
+	}
+
+	for _, query := range []string{"interval=1w", "limit=0", "from=yesterday"} {
+		if rec := doRequest(t, e, http.MethodGet, "/candles/ETH?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %s refused, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+	// without a database only the live candle is kept
+	if get(newServer(ex, testAdminKey, withCandles(candles)), ""); len(body.Candles) != 1 || body.Candles[0].Trades != 2 {
+		t.Fatalf("expected only the live candle, got %+v", body.Candles)
+	}
+	if rec := doRequest(t, newServer(ex, testAdminKey), http.MethodGet, "/candles/ETH", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no candles without a database or live ones, got %d", rec.Code)
+	}
+}
+
+func TestLiveCandles(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clk})
+	defer ex.Close()
+	candles := candle.NewAggregator()
+	aggregateCandles(ex, candles)
+	e := newServer(ex, testAdminKey, withCandles(candles))
+
+	if rec := doRequest(t, e, http.MethodGet, "/candles/ETH", ""); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"candles":[]}` {
+		t.Fatalf("expected no candles before a trade, got %d: %s", rec.Code, rec.Body)
+	}
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"LIMIT","bid":false,"size":2,"price":100,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":1,"market":"ETH"}`)
+	doRequest(t, e, http.MethodPost, "/order", `{"type":"MARKET","bid":true,"size":0.5,"market":"ETH"}`)
+
+	start := time.Unix(1_700_000_000-1_700_000_000%60, 0)
+	want := fmt.Sprintf(`{"candles":[{"start":%d,"open":"100.00","high":"100.00","low":"100.00","close":"100.00","volume":"1.5000","trades":2}]}`, start.UnixNano())
+	if rec := doRequest(t, e, http.MethodGet, "/candles/ETH", ""); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != want {
+		t.Fatalf("expected\n%s\ngot %d\n%s", want, rec.Code, rec.Body)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	ex := exchange.New(exchange.Config{Clock: clk, Limits: map[exchange.Market]exchange.MarketConfig{
+		exchange.MarketEth: {MakerFee: 0.001, TakerFee: 0.002},
+	}})
+	history, err := store.OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	recorder := store.NewRecorder(history)
+	recorder.Record(ex)
+	e := newServer(ex, testAdminKey, withHistory(history), withClock(clk))
+	alice, bob := register(t, e, "alice"), register(t, e, "bob")
+	deposit(t, e, 1, "USD", 10000)
+	deposit(t, e, 2, "ETH", 2)
+	for _, body := range []string{
+		`{"type":"LIMIT","bid":true,"size":2,"price":2000,"market":"ETH"}`,
+		`{"type":"LIMIT","bid":true,"size":1,"price":1000,"market":"ETH"}`,
+	} {
+		if rec := doUserRequest(t, e, alice, http.MethodPost, "/order", body); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if rec := doUserRequest(t, e, bob, http.MethodPost, "/order", `{"type":"MARKET","bid":false,"size":2,"market":"ETH"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doUserRequest(t, e, alice, http.MethodDelete, "/orders?market=ETH&side=bid", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	ex.Close()
+	recorder.Close()
+
+	summary := func(query string) daySummary {
+		t.Helper()
+		rec := doRequest(t, e, http.MethodGet, "/admin/summary"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var summary daySummary
+		json.Unmarshal(rec.Body.Bytes(), &summary)
+		return summary
+	}
+
+	today := summary("")
+	if today.Date != "2024-03-01" || !today.Partial || len(today.Markets) != len(ex.Markets()) {
+		t.Fatalf("expected today's partial summary of every market, got %+v", today)
+	}
+	eth := today.Markets[slices.IndexFunc(today.Markets, func(ms store.MarketSummary) bool { return ms.Market == exchange.MarketEth })]
+	// bob's market sell is the taker, paying its fee in USD
+	if eth.Trades != 1 || eth.BaseVolume != 2 || eth.QuoteVolume != 4000 || eth.Open != 2000 || eth.Close != 2000 || eth.BaseFees != 0.002 || eth.QuoteFees != 8 {
+		t.Fatalf("unexpected ETH summary %+v", eth)
+	}
+	if eth.Traders != 2 || eth.Orders != 3 || eth.Cancels != 1 {
+		t.Fatalf("expected two traders, three orders and alice's resting bid cancelled, got %+v", eth)
+	}
+	if tot := today.Total; tot.Trades != 1 || tot.Traders != 2 || tot.QuoteVolume["USD"] != 4000 || tot.Fees["USD"] != 8 || tot.Fees["ETH"] != 0.002 {
+		t.Fatalf("unexpected totals %+v", tot)
+	}
+
+	// a day with no trading has every market zeroed
+	empty := summary("?date=2024-02-01")
+	if empty.Partial || len(empty.Markets) != len(ex.Markets()) || empty.Total.Trades != 0 {
+		t.Fatalf("expected an empty day, got %+v", empty)
+	}
+	for _, ms := range empty.Markets {
+		if ms != (store.MarketSummary{Market: ms.Market}) {
+			t.Fatalf("expected a zeroed row, got %+v", ms)
+		}
+	}
+
+	// once the day is over it is complete, and cached
+	clk.Advance(13 * time.Hour)
+	done := summary("?date=2024-03-01")
+	if done.Partial || done.Total.Trades != 1 {
+		t.Fatalf("expected the day complete, got %+v", done)
+	}
+	history.Save(context.Background(), store.Batch{Trades: []store.Trade{
+		{ID: 99, Market: exchange.MarketEth, Price: 1, Size: 1, Timestamp: time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC).UnixNano()},
+	}})
+	if cached := summary("?date=2024-03-01"); cached.Total.Trades != 1 {
+		t.Fatalf("expected the cached summary, got %+v", cached)
+	}
+
+	for _, query := range []string{"?date=2024-03-05", "?date=March"} {
+		if rec := doRequest(t, e, http.MethodGet, "/admin/summary"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/marketdata"
+)
+
+// withMarketData reports on the market data rec records. Without it the
+// recorder route isn't registered.
+func withMarketData(rec *marketdata.Recorder) serverOption {
+	return func(s *server) {
+		s.marketData = rec
+	}
+}
+
+// recordMarketData records ex's market data to files under dir, snapshotting
+// each market's depth every EXCHANGE_MARKETDATA_SNAPSHOT_INTERVAL.
+func recordMarketData(ex *exchange.Exchange, dir string) *marketdata.Recorder {
+	opts := marketdata.Options{Dir: dir}
+	if v := os.Getenv("EXCHANGE_MARKETDATA_SNAPSHOT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			slog.Error("invalid EXCHANGE_MARKETDATA_SNAPSHOT_INTERVAL", "value", v, "error", err)
+			os.Exit(1)
+		}
+		opts.SnapshotInterval = interval
+	}
+	rec := marketdata.NewRecorder(opts)
+	rec.Record(ex)
+	return rec
+}
+
+// handleGetMarketDataStats reports what the market data recorder has
+// written and dropped.
+func (s *server) handleGetMarketDataStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.marketData.Stats())
+}
@@ -0,0 +1,83 @@
+package marketdata
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+const (
+	// fileLayout names a file for the hour it covers, so names sort in time
+	// order
+	fileLayout = "2006-01-02T15"
+	fileExt    = ".jsonl"
+	gzipExt    = ".gz"
+)
+
+// Files lists market's recorded files under dir, oldest first, compressed
+// or not.
+func Files(dir string, market exchange.Market) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, string(market)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, fileExt) || strings.HasSuffix(name, fileExt+gzipExt) {
+			files = append(files, filepath.Join(dir, string(market), name))
+		}
+	}
+	// a reopened hour's file follows what was compressed of it before
+	slices.SortFunc(files, func(a, b string) int {
+		if c := strings.Compare(strings.TrimSuffix(a, gzipExt), strings.TrimSuffix(b, gzipExt)); c != 0 {
+			return c
+		}
+		return -strings.Compare(a, b)
+	})
+	return files, nil
+}
+
+// Read reads the records of the file at path back in the order they were
+// written, decompressing it if its name ends in ".gz". It stops at the
+// first error. Rebuilding a book from a file takes its first snapshot and
+// the level changes after it; see Record.
+func Read(path string) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		f, err := os.Open(path)
+		if err != nil {
+			yield(Record{}, err)
+			return
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if strings.HasSuffix(path, gzipExt) {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				yield(Record{}, err)
+				return
+			}
+			defer zr.Close()
+			r = zr
+		}
+
+		dec := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var rec Record
+			err := dec.Decode(&rec)
+			if err == io.EOF {
+				return
+			}
+			if !yield(rec, err) || err != nil {
+				return
+			}
+		}
+	}
+}
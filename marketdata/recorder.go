@@ -0,0 +1,312 @@
+// Package marketdata records the exchange's market data to disk for research
+// and replay: each market's trades and price level changes as they happen,
+// and snapshots of its depth to start from, as JSON lines in hourly files.
+package marketdata
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+const (
+	// DefaultSnapshotInterval is how often a Recorder snapshots each market's
+	// depth when Options.SnapshotInterval is unset.
+	DefaultSnapshotInterval = 10 * time.Second
+	// DefaultDepth is how many levels a side of a snapshot holds when
+	// Options.Depth is unset.
+	DefaultDepth = 1000
+)
+
+// Kind is what a record holds.
+type Kind string
+
+const (
+	// KindSnapshot: the market's depth, as of the snapshot's sequence
+	// number.
+	KindSnapshot Kind = "SNAPSHOT"
+	// KindTrade: an exchange.EventFill.
+	KindTrade Kind = "TRADE"
+	// KindLevel: an exchange.EventLevelChanged.
+	KindLevel Kind = "LEVEL"
+)
+
+// Record is one line of a recorded file. Timestamp is when it was recorded,
+// in unix nanoseconds, and Snapshot or Event is what it holds, with prices
+// and sizes in the market's units. A book is rebuilt from a snapshot by the
+// level changes with a greater Seq than its Sequence: those recorded around
+// it may be either side of it.
+type Record struct {
+	Kind      Kind                  `json:"kind"`
+	Timestamp int64                 `json:"timestamp"`
+	Snapshot  *exchange.MarketDepth `json:"snapshot,omitempty"`
+	Event     *exchange.Event       `json:"event,omitempty"`
+}
+
+// Options configure a Recorder.
+type Options struct {
+	// Dir is where each market's files are written, in a directory named
+	// for the market.
+	Dir string
+	// SnapshotInterval defaults to DefaultSnapshotInterval.
+	SnapshotInterval time.Duration
+	// Depth defaults to DefaultDepth.
+	Depth int
+	// Clock dates records and times snapshots and rotations. It defaults to
+	// the system clock.
+	Clock clock.Clock
+}
+
+// Stats reports what a Recorder has written since it started. Records and
+// Bytes count the lines written, and Dropped those that couldn't be, such
+// as while the disk is full. Files counts the files opened and Compressed
+// those closed and compressed.
+type Stats struct {
+	Records    uint64 `json:"records"`
+	Bytes      uint64 `json:"bytes"`
+	Dropped    uint64 `json:"dropped"`
+	Files      uint64 `json:"files"`
+	Compressed uint64 `json:"compressed"`
+}
+
+// Recorder writes each market's trades and level changes, and a snapshot of
+// its depth every SnapshotInterval, to a file per market and hour. Each
+// file starts with a snapshot, so it can be replayed alone, and is
+// compressed with gzip once the next hour's is opened. It takes events from
+// the exchange's worker pool, so it adds nothing to matching, and a record
+// it fails to write is dropped and counted rather than retried.
+type Recorder struct {
+	opts Options
+	ex   *exchange.Exchange
+
+	mu     sync.Mutex
+	files  map[exchange.Market]*hourFile
+	timer  clock.Timer
+	closed bool
+	// failing is set while writes fail, so only the first is logged
+	failing bool
+	stats   Stats
+	// compressing waits for the closed files being compressed
+	compressing sync.WaitGroup
+}
+
+// hourFile is the file a market's records of an hour are written to. size
+// is how much of it is whole lines.
+type hourFile struct {
+	f    *os.File
+	hour time.Time
+	size int64
+}
+
+// NewRecorder returns a Recorder writing as opts say. Record starts it.
+func NewRecorder(opts Options) *Recorder {
+	if opts.SnapshotInterval <= 0 {
+		opts.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = DefaultDepth
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real()
+	}
+	return &Recorder{opts: opts, files: make(map[exchange.Market]*hourFile)}
+}
+
+// Record registers r to record ex's market data and takes the first
+// snapshots. Close stops it.
+func (r *Recorder) Record(ex *exchange.Exchange) {
+	r.ex = ex
+	ex.HandleEventsAsync(r.events, exchange.AsyncOptions{Name: "marketdata", Overflow: exchange.OverflowSpill}, exchange.EventFill, exchange.EventLevelChanged)
+	r.snapshot()
+}
+
+// Stats returns what r has written so far.
+func (r *Recorder) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+func (r *Recorder) events(events []exchange.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.opts.Clock.Now().UnixNano()
+	for _, e := range events {
+		kind := KindLevel
+		if e.Type == exchange.EventFill {
+			kind = KindTrade
+		}
+		r.write(e.Market, Record{Kind: kind, Timestamp: now, Event: &e})
+	}
+}
+
+// snapshot records every market's depth and schedules the next snapshot.
+func (r *Recorder) snapshot() {
+	depths := r.ex.GetDepths(r.ex.Markets(), r.opts.Depth)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	now := r.opts.Clock.Now().UnixNano()
+	for _, depth := range depths {
+		if depth.Error == "" {
+			r.write(depth.Market, Record{Kind: KindSnapshot, Timestamp: now, Snapshot: &depth})
+		}
+	}
+	r.timer = r.opts.Clock.AfterFunc(r.opts.SnapshotInterval, r.snapshot)
+}
+
+// write appends rec to its market's file for the hour, rotating to it if
+// need be, or drops it if it can't. The caller holds r.mu.
+func (r *Recorder) write(market exchange.Market, rec Record) {
+	hour := time.Unix(0, rec.Timestamp).UTC().Truncate(time.Hour)
+	file := r.files[market]
+	if file == nil || !file.hour.Equal(hour) {
+		if file != nil {
+			r.rotate(file)
+			delete(r.files, market)
+		}
+		var err error
+		if file, err = r.open(market, hour); err != nil {
+			r.drop(market, err)
+			return
+		}
+		r.files[market] = file
+		if rec.Kind != KindSnapshot {
+			// so the file can be replayed without the one before it
+			if depth, err := r.ex.GetDepth(market, r.opts.Depth); err == nil {
+				r.append(file, market, Record{Kind: KindSnapshot, Timestamp: rec.Timestamp, Snapshot: &depth})
+			}
+		}
+	}
+	r.append(file, market, rec)
+}
+
+func (r *Recorder) append(file *hourFile, market exchange.Market, rec Record) {
+	line, _ := json.Marshal(rec)
+	line = append(line, '\n')
+	if _, err := file.f.Write(line); err != nil {
+		// whatever part of the line reached the file is cut off, so the
+		// next follows the last whole one
+		file.f.Truncate(file.size)
+		r.drop(market, err)
+		return
+	}
+	file.size += int64(len(line))
+	r.stats.Records++
+	r.stats.Bytes += uint64(len(line))
+	r.failing = false
+}
+
+func (r *Recorder) drop(market exchange.Market, err error) {
+	r.stats.Dropped++
+	if !r.failing {
+		slog.Error("failed to record market data, dropping it until it can be", "market", market, "error", err)
+		r.failing = true
+	}
+}
+
+// open opens market's file for hour, appending to it if it was opened
+// before.
+func (r *Recorder) open(market exchange.Market, hour time.Time) (*hourFile, error) {
+	dir := filepath.Join(r.opts.Dir, string(market))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, hour.Format(fileLayout)+fileExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.stats.Files++
+	return &hourFile{f: f, hour: hour, size: info.Size()}, nil
+}
+
+// rotate closes file and compresses it in the background. The caller holds
+// r.mu.
+func (r *Recorder) rotate(file *hourFile) {
+	path := file.f.Name()
+	if err := file.f.Close(); err != nil {
+		slog.Error("failed to close market data file", "path", path, "error", err)
+		return
+	}
+	r.compressing.Add(1)
+	go func() {
+		defer r.compressing.Done()
+		if err := compress(path); err != nil {
+			slog.Error("failed to compress market data file", "path", path, "error", err)
+			return
+		}
+		r.mu.Lock()
+		r.stats.Compressed++
+		r.mu.Unlock()
+	}()
+}
+
+// compress moves the file at path into a gzipped one named path plus
+// ".gz", as a stream of its own after any already there, such as from a
+// process recording the same hour before. A failure leaves both as they
+// were.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+gzipExt, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	size, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Truncate(size)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close stops the snapshots and closes and compresses every file. The
+// exchange must not be handing r events by then: close it first.
+func (r *Recorder) Close() {
+	r.mu.Lock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	for market, file := range r.files {
+		r.rotate(file)
+		delete(r.files, market)
+	}
+	r.mu.Unlock()
+	r.compressing.Wait()
+}
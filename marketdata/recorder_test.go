@@ -0,0 +1,136 @@
+package marketdata
+
+import (
+	"cmp"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// px and sz are the default scale's units of a decimal price and size.
+func px(v float64) orderbook.Price { return orderbook.DefaultScale.PriceOf(v) }
+func sz(v float64) orderbook.Size  { return orderbook.DefaultScale.SizeOf(v) }
+
+func TestRecorder(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 2, 10, 59, 0, 0, time.UTC))
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clk})
+	dir := t.TempDir()
+	r := NewRecorder(Options{Dir: dir, SnapshotInterval: 10 * time.Second, Clock: clk})
+	r.Record(ex)
+	ctx := context.Background()
+	place := func(bid bool, size, price float64) uint64 {
+		t.Helper()
+		report, err := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: bid, Size: sz(size), Price: px(price), Market: exchange.MarketEth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.OrderID
+	}
+
+	// a session running over the hour, snapshotted along the way
+	place(false, 2, 101)
+	place(false, 1, 102)
+	bid := place(true, 3, 99)
+	clk.Advance(10 * time.Second)
+	place(true, 1.5, 101)
+	place(false, 1, 98)
+	clk.Advance(time.Minute)
+	ex.CancelOrder(ctx, 0, bid)
+	place(true, 1, 100)
+	place(true, 2, 102.5)
+	clk.Advance(5 * time.Second)
+	place(false, 0.5, 100)
+	place(false, 1, 105)
+	ex.Close()
+	r.Close()
+
+	files, err := Files(dir, exchange.MarketEth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || !strings.HasSuffix(files[0], "2024-01-02T10.jsonl.gz") || !strings.HasSuffix(files[1], "2024-01-02T11.jsonl.gz") {
+		t.Fatalf("expected a compressed file for each hour, got %v", files)
+	}
+
+	// the book is rebuilt from the latest snapshot and the level changes
+	// after it, and every trade is there
+	var book exchange.MarketDepth
+	var trades int
+	for _, file := range files {
+		first := true
+		for rec, err := range Read(file) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first && rec.Kind != KindSnapshot {
+				t.Fatalf("expected %s to start with a snapshot, got %+v", file, rec)
+			}
+			first = false
+			switch rec.Kind {
+			case KindSnapshot:
+				book = *rec.Snapshot
+			case KindTrade:
+				trades++
+			case KindLevel:
+				if e := rec.Event; e.Seq > book.Sequence {
+					if e.Bid {
+						book.Bids = applyLevel(book.Bids, e.Price, e.Size, true)
+					} else {
+						book.Asks = applyLevel(book.Asks, e.Price, e.Size, false)
+					}
+				}
+			}
+		}
+	}
+	want, _ := ex.GetDepth(exchange.MarketEth, DefaultDepth)
+	if !slices.Equal(book.Bids, want.Bids) || !slices.Equal(book.Asks, want.Asks) {
+		t.Fatalf("expected the book rebuilt as\n%+v\ngot\n%+v", want, book)
+	}
+	if trades != 5 {
+		t.Fatalf("expected 5 trades recorded, got %d", trades)
+	}
+	if stats := r.Stats(); stats.Dropped != 0 || stats.Files != 4 || stats.Compressed != 4 || stats.Records == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// applyLevel sets the level at price to size in levels, best price first,
+// dropping it at zero.
+func applyLevel(levels []exchange.Level, price orderbook.Price, size orderbook.Size, bid bool) []exchange.Level {
+	levels = slices.DeleteFunc(levels, func(l exchange.Level) bool { return l.Price == price })
+	if size == 0 {
+		return levels
+	}
+	i, _ := slices.BinarySearchFunc(levels, price, func(l exchange.Level, p orderbook.Price) int {
+		if bid {
+			return cmp.Compare(p, l.Price)
+		}
+		return cmp.Compare(l.Price, p)
+	})
+	return slices.Insert(levels, i, exchange.Level{Price: price, Size: size})
+}
+
+func TestRecorderDrops(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	// nothing can be written under a file
+	path := filepath.Join(t.TempDir(), "full")
+	os.WriteFile(path, nil, 0o644)
+	r := NewRecorder(Options{Dir: path})
+	r.Record(ex)
+	ex.PlaceOrder(context.Background(), exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(100), Market: exchange.MarketEth})
+	ex.Close()
+	r.Close()
+
+	// a snapshot of each market, and the order's level
+	if stats := r.Stats(); stats.Dropped != 3 || stats.Records != 0 || stats.Files != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/multicast"
+)
+
+// publishMarketData publishes every market's book and trades through p
+// until ctx is done.
+func publishMarketData(ctx context.Context, ex *exchange.Exchange, p *multicast.Publisher) {
+	var wg sync.WaitGroup
+	for _, market := range ex.Markets() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publishMarket(ctx, ex, p, market)
+		}()
+	}
+	wg.Wait()
+}
+
+// publishMarket publishes a snapshot of market's book, then its updates.
+// Falling behind the feed cuts the updates off, so it starts over with a
+// new snapshot.
+func publishMarket(ctx context.Context, ex *exchange.Exchange, p *multicast.Publisher, market exchange.Market) {
+	for {
+		snapshot, seq, updates, unsubscribe, err := ex.SnapshotFeed(market)
+		if err != nil {
+			slog.Error("failed to publish market data", "market", market, "error", err)
+			return
+		}
+		p.PublishSnapshot(market, seq, snapshot)
+		cutOff := publishUpdates(ctx, p, seq, updates)
+		unsubscribe()
+		if !cutOff {
+			return
+		}
+		slog.Warn("multicast fell behind the feed, resending the book", "market", market)
+	}
+}
+
+// publishUpdates publishes updates following seq until ctx is done, or
+// until they are cut off, when it reports true.
+func publishUpdates(ctx context.Context, p *multicast.Publisher, seq uint64, updates <-chan []exchange.FeedMessage) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case data, ok := <-updates:
+			if !ok {
+				return true
+			}
+			if len(data) == 0 {
+				continue
+			}
+			p.Publish(data, seq)
+			seq = data[0].Seq
+		}
+	}
+}
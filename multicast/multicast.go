@@ -0,0 +1,370 @@
+// Package multicast publishes market data to colocated consumers as UDP
+// multicast packets of sbe messages, with a TCP side channel for asking for
+// lost packets again.
+//
+// A packet is its sequence number and message count, both little-endian,
+// then that many sbe messages. Packets are numbered from one and never
+// split a message, though a book snapshot may span several. When nothing
+// has been sent for a heartbeat interval a heartbeat goes out: a packet of
+// no messages carrying the number the next packet will have, so a receiver
+// notices losing the last packets before a lull. Heartbeats aren't kept.
+//
+// A retransmission request is the first packet number wanted and how many,
+// a u64 and a u32. The answer is each of those packets the publisher still
+// holds, prefixed with its length as a u16, then a zero length. Packets too
+// old to be held are left out, so a receiver that asked for them must
+// resynchronise from a snapshot instead.
+package multicast
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/sbe"
+)
+
+const (
+	// DefaultMaxPacket bounds packets when PublisherConfig.MaxPacket is
+	// unset. It leaves a 1500 byte Ethernet frame room for the IP and UDP
+	// headers.
+	DefaultMaxPacket = 1400
+	// DefaultHistory is how many packets are kept for retransmission when
+	// PublisherConfig.History is unset.
+	DefaultHistory = 100_000
+	// DefaultHeartbeat is the heartbeat interval when
+	// PublisherConfig.Heartbeat is unset.
+	DefaultHeartbeat = time.Second
+	// MaxRetransmit is the most packets one request is answered with.
+	MaxRetransmit = 1000
+
+	headerLength  = 10
+	requestLength = 12
+	// requestTimeout is how long a retransmission connection may go
+	// without a request before it is closed.
+	requestTimeout = time.Minute
+)
+
+// PublisherConfig sets up a Publisher.
+type PublisherConfig struct {
+	// Conn is where packets are written, usually a UDP socket connected to
+	// the multicast group.
+	Conn io.Writer
+	// MaxPacket bounds a packet's size in bytes. It defaults to
+	// DefaultMaxPacket.
+	MaxPacket int
+	// History is how many of the latest packets are kept for
+	// retransmission. It defaults to DefaultHistory.
+	History int
+	// Heartbeat is how long the publisher may be quiet before it sends a
+	// heartbeat. It defaults to DefaultHeartbeat.
+	Heartbeat time.Duration
+	// Clock paces heartbeats. It defaults to the system clock.
+	Clock clock.Clock
+}
+
+// Publisher numbers and sends packets, keeps the latest for retransmission
+// and answers retransmission requests on the listeners it serves. Its
+// methods are safe for concurrent use.
+type Publisher struct {
+	conn      io.Writer
+	maxPacket int
+	heartbeat time.Duration
+	clock     clock.Clock
+
+	mu sync.Mutex
+	// packet is the packet being filled, next its number
+	packet  []byte
+	count   int
+	next    uint64
+	history [][]byte
+	oldest  int
+	sent    bool
+	timer   clock.Timer
+
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewPublisher returns a publisher set up by cfg, sending heartbeats until
+// it is closed.
+func NewPublisher(cfg PublisherConfig) *Publisher {
+	if cfg.MaxPacket == 0 {
+		cfg.MaxPacket = DefaultMaxPacket
+	}
+	if cfg.History == 0 {
+		cfg.History = DefaultHistory
+	}
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = DefaultHeartbeat
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+	p := &Publisher{
+		conn:      cfg.Conn,
+		maxPacket: cfg.MaxPacket,
+		heartbeat: cfg.Heartbeat,
+		clock:     cfg.Clock,
+		next:      1,
+		history:   make([][]byte, 0, cfg.History),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	p.mu.Lock()
+	p.timer = p.clock.AfterFunc(p.heartbeat, p.beat)
+	p.mu.Unlock()
+	return p
+}
+
+// PublishSnapshot sends a snapshot of market's book as of seq, levels being
+// every level as book messages.
+func (p *Publisher) PublishSnapshot(market exchange.Market, seq uint64, levels []exchange.FeedMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.add(sbe.AppendSnapshot(nil, market, seq, len(levels)))
+	for _, level := range levels {
+		p.add(sbe.AppendFeedMessage(nil, level, 0))
+	}
+	p.flush()
+}
+
+// Publish sends one operation's messages, its book messages following the
+// update with sequence number prevSeq.
+func (p *Publisher) Publish(msgs []exchange.FeedMessage, prevSeq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, msg := range msgs {
+		p.add(sbe.AppendFeedMessage(nil, msg, prevSeq))
+	}
+	p.flush()
+}
+
+// add adds an encoded message to the packet being filled, sending the
+// packet first if it has no room.
+func (p *Publisher) add(msg []byte) {
+	if p.count > 0 && len(p.packet)+len(msg) > p.maxPacket {
+		p.flush()
+	}
+	if p.count == 0 {
+		p.packet = binary.LittleEndian.AppendUint64(p.packet[:0], p.next)
+		p.packet = binary.LittleEndian.AppendUint16(p.packet, 0)
+	}
+	p.packet = append(p.packet, msg...)
+	p.count++
+}
+
+// flush sends the packet being filled, if it has anything, and keeps it.
+func (p *Publisher) flush() {
+	if p.count == 0 {
+		return
+	}
+	binary.LittleEndian.PutUint16(p.packet[8:], uint16(p.count))
+	packet := append([]byte(nil), p.packet...)
+	p.write(packet)
+	if len(p.history) < cap(p.history) {
+		p.history = append(p.history, packet)
+	} else {
+		p.history[p.oldest] = packet
+		p.oldest = (p.oldest + 1) % len(p.history)
+	}
+	p.next++
+	p.count = 0
+	p.sent = true
+}
+
+// write sends a packet. A lost packet is what retransmission is for, so a
+// failed send is only logged.
+func (p *Publisher) write(packet []byte) {
+	if _, err := p.conn.Write(packet); err != nil {
+		slog.Warn("failed to send market data packet", "error", err)
+	}
+}
+
+// beat sends a heartbeat unless something was sent since the last, and
+// schedules the next.
+func (p *Publisher) beat() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	if !p.sent {
+		heartbeat := binary.LittleEndian.AppendUint64(nil, p.next)
+		p.write(binary.LittleEndian.AppendUint16(heartbeat, 0))
+	}
+	p.sent = false
+	p.timer = p.clock.AfterFunc(p.heartbeat, p.beat)
+}
+
+// packets returns the held packets numbered from from, at most count.
+func (p *Publisher) packets(from uint64, count int) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	first := p.next - uint64(len(p.history))
+	if from < first {
+		count -= int(min(first-from, uint64(count)))
+		from = first
+	}
+	var packets [][]byte
+	for seq := from; seq < p.next && len(packets) < count; seq++ {
+		packets = append(packets, p.history[(p.oldest+int(seq-first))%len(p.history)])
+	}
+	return packets
+}
+
+// ErrPublisherClosed is returned by Serve once the publisher is closed.
+var ErrPublisherClosed = errors.New("multicast: publisher closed")
+
+// Serve answers retransmission requests on lis until the publisher is
+// closed.
+func (p *Publisher) Serve(lis net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		lis.Close()
+		return ErrPublisherClosed
+	}
+	p.listeners[lis] = struct{}{}
+	p.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			delete(p.listeners, lis)
+			p.mu.Unlock()
+			if closed {
+				return ErrPublisherClosed
+			}
+			return err
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return ErrPublisherClosed
+		}
+		p.conns[conn] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+		go p.serveConn(conn)
+	}
+}
+
+// serveConn answers one connection's requests until it closes or goes
+// quiet.
+func (p *Publisher) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		p.wg.Done()
+	}()
+
+	w := bufio.NewWriter(conn)
+	req := make([]byte, requestLength)
+	for {
+		conn.SetDeadline(time.Now().Add(requestTimeout))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		from := binary.LittleEndian.Uint64(req)
+		count := min(int(binary.LittleEndian.Uint32(req[8:])), MaxRetransmit)
+		for _, packet := range p.packets(from, count) {
+			w.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(packet))))
+			w.Write(packet)
+		}
+		w.Write([]byte{0, 0})
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops heartbeats and retransmissions, closing the connections
+// open, and waits for them to end.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.timer.Stop()
+	for lis := range p.listeners {
+		lis.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// ErrGarbled is a packet or retransmission that can't be read.
+var ErrGarbled = errors.New("multicast: garbled packet")
+
+// ParsePacket returns a packet's number and messages. A heartbeat has none.
+func ParsePacket(packet []byte) (seq uint64, msgs []sbe.Message, err error) {
+	if len(packet) < headerLength {
+		return 0, nil, ErrGarbled
+	}
+	seq = binary.LittleEndian.Uint64(packet)
+	count := int(binary.LittleEndian.Uint16(packet[8:]))
+	b := packet[headerLength:]
+	for range count {
+		msg, n, err := sbe.Decode(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		msgs = append(msgs, msg)
+		b = b[n:]
+	}
+	if len(b) > 0 {
+		return 0, nil, ErrGarbled
+	}
+	return seq, msgs, nil
+}
+
+// Retransmit asks the publisher at the other end of conn for count packets
+// numbered from from, returning those it still holds.
+func Retransmit(conn io.ReadWriter, from uint64, count int) ([][]byte, error) {
+	req := binary.LittleEndian.AppendUint64(nil, from)
+	req = binary.LittleEndian.AppendUint32(req, uint32(count))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var packets [][]byte
+	length := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint16(length)
+		if n == 0 {
+			return packets, nil
+		}
+		if n < headerLength {
+			return nil, ErrGarbled
+		}
+		packet := make([]byte, n)
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return nil, err
+		}
+		packets = append(packets, packet)
+	}
+}
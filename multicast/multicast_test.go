@@ -0,0 +1,123 @@
+package multicast
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/sbe"
+)
+
+// packetLog records the packets written to it.
+type packetLog struct {
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (l *packetLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.packets = append(l.packets, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (l *packetLog) take(t *testing.T) (seqs []uint64, msgs [][]sbe.Message) {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, packet := range l.packets {
+		seq, m, err := ParsePacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+		msgs = append(msgs, m)
+	}
+	l.packets = nil
+	return seqs, msgs
+}
+
+func TestPublisher(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	out := &packetLog{}
+	// room for the header and two book deltas or a trade and a delta, and a
+	// history of two
+	p := NewPublisher(PublisherConfig{Conn: out, MaxPacket: 110, History: 2, Heartbeat: time.Second, Clock: clk})
+	defer p.Close()
+
+	level := func(seq uint64, price orderbook.Price) exchange.FeedMessage {
+		return exchange.FeedMessage{Type: exchange.FeedBook, Market: "ETH", Seq: seq, Side: orderbook.SideAsk, Price: price, Size: 1}
+	}
+	p.PublishSnapshot("ETH", 3, []exchange.FeedMessage{level(3, 100), level(3, 101), level(3, 102)})
+	seqs, msgs := out.take(t)
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Fatalf("expected the snapshot in packets 1 and 2, got %v", seqs)
+	}
+	if len(msgs[0]) != 2 || msgs[0][0].Template != sbe.TemplateSnapshot || msgs[0][0].Levels != 3 || len(msgs[1]) != 2 || msgs[1][1].Price != 102 {
+		t.Fatalf("unexpected snapshot %+v", msgs)
+	}
+
+	trade := exchange.FeedMessage{Type: exchange.FeedTrade, Market: "ETH", Seq: 4, Side: orderbook.SideBid, Price: 100, Size: 1, TradeID: 7}
+	p.Publish([]exchange.FeedMessage{trade, {Type: exchange.FeedBook, Market: "ETH", Seq: 4, Side: orderbook.SideAsk, Price: 100}}, 3)
+	seqs, msgs = out.take(t)
+	if len(seqs) != 1 || seqs[0] != 3 || msgs[0][0].TradeID != 7 || msgs[0][1].PrevSeq != 3 {
+		t.Fatalf("expected packet 3 with the trade and delta, got %v %+v", seqs, msgs)
+	}
+
+	// a quiet publisher sends the next packet's number
+	clk.Advance(time.Second)
+	if seqs, msgs = out.take(t); len(seqs) != 0 {
+		t.Fatalf("expected no heartbeat after traffic, got %v", seqs)
+	}
+	clk.Advance(time.Second)
+	if seqs, msgs = out.take(t); len(seqs) != 1 || seqs[0] != 4 || len(msgs[0]) != 0 {
+		t.Fatalf("expected a heartbeat for packet 4, got %v %+v", seqs, msgs)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(lis)
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// packet 1 has aged out, and nothing has been sent after 3
+	packets, err := Retransmit(conn, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("expected packets 2 and 3, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		if seq, _, err := ParsePacket(packet); err != nil || seq != uint64(i+2) {
+			t.Fatalf("expected packet %d, got %d %v", i+2, seq, err)
+		}
+	}
+	if packets, err = Retransmit(conn, 2, 1); err != nil || len(packets) != 1 {
+		t.Fatalf("expected one packet, got %d %v", len(packets), err)
+	}
+	if packets, err = Retransmit(conn, 4, 1); err != nil || len(packets) != 0 {
+		t.Fatalf("expected no packets, got %d %v", len(packets), err)
+	}
+
+	p.Close()
+	if _, err := Retransmit(conn, 2, 1); err == nil {
+		t.Fatal("expected closing to end the connection")
+	}
+	clk.Advance(2 * time.Second)
+	if seqs, _ = out.take(t); len(seqs) != 0 {
+		t.Fatalf("expected no heartbeats once closed, got %v", seqs)
+	}
+}
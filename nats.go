@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// jetStreamPublisher is what events are published through; a
+// jetstream.JetStream is one.
+type jetStreamPublisher interface {
+	PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error)
+}
+
+// publishToJetStream is publishToKafka for NATS JetStream: events go to the
+// subjects eventTopic names followed by their market, such as
+// "exchange.trades.ETH", so a consumer filters to a market by subject. Each
+// message's ID is its market, sequence number and place in the operation,
+// so the stream drops a retried operation's duplicates.
+func publishToJetStream(ex *exchange.Exchange, js jetStreamPublisher, prefix string) {
+	ex.HandleEventsAsync(func(events []exchange.Event) {
+		format := eventFormat(ex, events[0].Market)
+		acks := make([]jetstream.PubAckFuture, 0, len(events))
+		for i, event := range events {
+			msg := nats.NewMsg(eventTopic(prefix, event.Type) + "." + string(event.Market))
+			msg.Data, _ = json.Marshal(eventResponse{Event: event, format: format})
+			msg.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s-%d-%d", event.Market, event.Seq, i))
+			ack, err := js.PublishMsgAsync(msg)
+			if err != nil {
+				slog.Error("failed to publish events to JetStream", "market", event.Market, "seq", event.Seq, "error", err)
+				return
+			}
+			acks = append(acks, ack)
+		}
+		for _, ack := range acks {
+			select {
+			case <-ack.Ok():
+			case err := <-ack.Err():
+				slog.Error("failed to publish events to JetStream", "market", events[0].Market, "seq", events[0].Seq, "error", err)
+				return
+			}
+		}
+	}, exchange.AsyncOptions{Name: "jetstream", Overflow: exchange.OverflowSpill})
+}
+
+// setUpJetStream creates or updates the stream keeping the events published
+// under prefix and its durable consumers, so downstream systems don't miss
+// events published before they first connect. Each consumer is a name,
+// optionally followed by "=" and the subject it is filtered to, such as
+// "risk=exchange.trades.>".
+func setUpJetStream(ctx context.Context, js jetstream.JetStream, stream, prefix string, consumers []string) error {
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     stream,
+		Subjects: []string{prefix + ".>"},
+	}); err != nil {
+		return fmt.Errorf("stream %s: %w", stream, err)
+	}
+	for _, consumer := range consumers {
+		name, filter, _ := strings.Cut(consumer, "=")
+		if _, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+			Durable:       name,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			FilterSubject: filter,
+		}); err != nil {
+			return fmt.Errorf("consumer %s: %w", name, err)
+		}
+	}
+	return nil
+}
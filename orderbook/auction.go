@@ -0,0 +1,145 @@
+package orderbook
+
+import "fmt"
+
+// AuctionState is the indicative outcome of uncrossing the book at its
+// current state.
+type AuctionState struct {
+	InAuction bool  `json:"inAuction"`
+	Price     Price `json:"price"`
+	Volume    Size  `json:"volume"`
+	Imbalance Size  `json:"imbalance"`
+}
+
+// StartAuction switches the book into call auction mode: limit orders rest
+// without matching and the book may cross until ExecuteAuction is called.
+func (ob *Orderbook) StartAuction() {
+	ob.seq++
+	ob.auction = true
+}
+
+func (ob *Orderbook) InAuction() bool {
+	return ob.auction
+}
+
+// IndicativeAuction computes the clearing price: the resting price that
+// maximizes executable volume, ties broken by the smallest imbalance between
+// the two sides and then by the lowest price. Volume is zero if the book
+// does not cross.
+func (ob *Orderbook) IndicativeAuction() AuctionState {
+	state := AuctionState{InAuction: ob.auction}
+
+	asks, bids := ob.Asks(), ob.Bids()
+	if len(asks) == 0 || len(bids) == 0 || bids[0].Price < asks[0].Price {
+		return state
+	}
+
+	for _, candidates := range [][]*Limit{asks, bids} {
+		for _, candidate := range candidates {
+			price := candidate.Price
+
+			buy := Size(0)
+			for _, limit := range bids {
+				if limit.Price < price {
+					break
+				}
+				buy += limit.shown()
+			}
+			sell := Size(0)
+			for _, limit := range asks {
+				if limit.Price > price {
+					break
+				}
+				sell += limit.shown()
+			}
+
+			volume, imbalance := min(buy, sell), max(buy-sell, sell-buy)
+			switch {
+			case volume > state.Volume,
+				volume == state.Volume && imbalance < state.Imbalance,
+				volume == state.Volume && imbalance == state.Imbalance && price < state.Price:
+				state.Price, state.Volume, state.Imbalance = price, volume, imbalance
+			}
+		}
+	}
+	return state
+}
+
+// ExecuteAuction uncrosses the book at the clearing price, allocating in
+// price-time priority on both sides, and returns the book to continuous
+// trading. Every match executes at the clearing price.
+func (ob *Orderbook) ExecuteAuction() ([]Match, error) {
+	if !ob.auction {
+		return nil, fmt.Errorf("book is not in auction")
+	}
+	ob.seq++
+
+	state := ob.IndicativeAuction()
+	ob.auction = false
+	if state.Volume == 0 {
+		return []Match{}, nil
+	}
+
+	// filling through a level at the clearing price stamps every match
+	// with it, whatever the resting prices
+	clearing := NewLimit(state.Price)
+
+	var (
+		matches     []Match
+		asks, bids  = ob.Asks(), ob.Bids()
+		clearedAsks int
+		clearedBids int
+		remaining   = state.Volume
+	)
+	for remaining > 0 && clearedAsks < len(asks) && clearedBids < len(bids) {
+		askLimit, bidLimit := asks[clearedAsks], bids[clearedBids]
+		if askLimit.Price > state.Price || bidLimit.Price < state.Price {
+			break
+		}
+
+		ask, bid := askLimit.first(), bidLimit.first()
+		// a level holding only frozen orders is passed over
+		if ask == nil {
+			clearedAsks++
+			continue
+		}
+		if bid == nil {
+			clearedBids++
+			continue
+		}
+		match := clearing.FillOrder(ask, bid)
+		askLimit.TotalVolume -= match.SizeFilled
+		bidLimit.TotalVolume -= match.SizeFilled
+		remaining -= match.SizeFilled
+		matches = append(matches, match)
+		ob.counters.trade(ob.clock.Now(), 1)
+
+		if ask.IsFilled() {
+			askLimit.take(ask)
+			if !ob.replenish(askLimit, ask) {
+				delete(ob.orders, ask.ID)
+				ob.counters.rest(false, -1)
+				if len(askLimit.Orders) == 0 {
+					clearedAsks++
+				}
+			}
+		}
+		if bid.IsFilled() {
+			bidLimit.take(bid)
+			if !ob.replenish(bidLimit, bid) {
+				delete(ob.orders, bid.ID)
+				ob.counters.rest(true, -1)
+				if len(bidLimit.Orders) == 0 {
+					clearedBids++
+				}
+			}
+		}
+	}
+	ob.clearBest(false, clearedAsks)
+	ob.clearBest(true, clearedBids)
+	if len(matches) > 0 {
+		ob.lastPrice = state.Price
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,56 @@
+package orderbook
+
+import "math"
+
+// LevelFill is what an order executed at one price. CumulativeSize and
+// AveragePrice cover this level and every one before it; averages are
+// rounded to the nearest Price.
+type LevelFill struct {
+	Price          Price `json:"price"`
+	Size           Size  `json:"size"`
+	CumulativeSize Size  `json:"cumulativeSize"`
+	AveragePrice   Price `json:"averagePrice"`
+}
+
+// Execution summarizes an order's matches by price level, in the order the
+// levels were reached.
+type Execution struct {
+	Levels       []LevelFill `json:"levels"`
+	Size         Size        `json:"size"`
+	AveragePrice Price       `json:"averagePrice"`
+	// WorstPrice is the last level reached, the furthest from the top of
+	// book the order had to go.
+	WorstPrice Price `json:"worstPrice"`
+}
+
+// Summarize groups matches by price. Consecutive matches against several
+// resting orders at one price collapse into a single level.
+func Summarize(matches []Match) Execution {
+	var (
+		ex       Execution
+		notional float64
+	)
+	for _, m := range matches {
+		ex.Size += m.SizeFilled
+		notional += float64(m.Price) * float64(m.SizeFilled)
+		if n := len(ex.Levels); n == 0 || ex.Levels[n-1].Price != m.Price {
+			ex.Levels = append(ex.Levels, LevelFill{Price: m.Price})
+		}
+		level := &ex.Levels[len(ex.Levels)-1]
+		level.Size += m.SizeFilled
+		level.CumulativeSize = ex.Size
+		level.AveragePrice = Price(math.Round(notional / float64(ex.Size)))
+	}
+	if n := len(ex.Levels); n > 0 {
+		ex.AveragePrice = ex.Levels[n-1].AveragePrice
+		ex.WorstPrice = ex.Levels[n-1].Price
+	}
+	return ex
+}
+
+// AveragePrice is the volume-weighted price of matches, or 0 if there are
+// none. Matches execute at the resting order's price, so for a crossing limit
+// order this is never worse than its limit.
+func AveragePrice(matches []Match) Price {
+	return Summarize(matches).AveragePrice
+}
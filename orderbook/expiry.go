@@ -0,0 +1,66 @@
+package orderbook
+
+import "container/heap"
+
+// expiryQueue is a min-heap of GoodTillDate orders by ExpiresAt, ties in ID
+// order. Orders that fill or are cancelled first are not removed; they are
+// skipped when they reach the top.
+type expiryQueue []*Order
+
+func (q expiryQueue) Len() int { return len(q) }
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].ExpiresAt != q[j].ExpiresAt {
+		return q[i].ExpiresAt < q[j].ExpiresAt
+	}
+	return q[i].ID < q[j].ID
+}
+func (q expiryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)   { *q = append(*q, x.(*Order)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	o := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return o
+}
+
+// queueExpiry schedules o, which has just come to rest, for ExpireOrders.
+func (ob *Orderbook) queueExpiry(o *Order) {
+	if o.TimeInForce == GoodTillDate && o.ExpiresAt > 0 {
+		heap.Push(&ob.expiries, o)
+	}
+}
+
+// dropStaleExpiries pops queued orders that are no longer resting.
+func (ob *Orderbook) dropStaleExpiries() {
+	for len(ob.expiries) > 0 && ob.orders[ob.expiries[0].ID] != ob.expiries[0] {
+		heap.Pop(&ob.expiries)
+	}
+}
+
+// NextExpiry returns when the next resting GoodTillDate order expires, in
+// unix nanoseconds, and false if none rests.
+func (ob *Orderbook) NextExpiry() (int64, bool) {
+	ob.dropStaleExpiries()
+	if len(ob.expiries) == 0 {
+		return 0, false
+	}
+	return ob.expiries[0].ExpiresAt, true
+}
+
+// ExpireOrders cancels, through CancelOrder, every resting GoodTillDate
+// order whose ExpiresAt is at or before the book clock's current time, and
+// returns them in expiry order.
+func (ob *Orderbook) ExpireOrders() []*Order {
+	now := ob.clock.Now().UnixNano()
+	var expired []*Order
+	for {
+		ob.dropStaleExpiries()
+		if len(ob.expiries) == 0 || ob.expiries[0].ExpiresAt > now {
+			return expired
+		}
+		o := heap.Pop(&ob.expiries).(*Order)
+		ob.CancelOrder(o)
+		expired = append(expired, o)
+	}
+}
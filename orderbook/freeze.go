@@ -0,0 +1,36 @@
+package orderbook
+
+// A frozen order stays where it rests, in its place in its level's queue,
+// but nothing matches against it: fills pass over it, and it counts towards
+// none of what an incoming order can fill. TotalVolume, the walks and
+// Checksum still see it, as they see any displayed size. It stays frozen
+// until it is cancelled.
+
+// FreezeOrder makes the resting order with id unmatchable. Freezing a frozen
+// order changes nothing.
+func (ob *Orderbook) FreezeOrder(id uint64) (*Order, error) {
+	o, ok := ob.orders[id]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	if !o.Frozen {
+		ob.seq++
+		o.Frozen = true
+		o.Limit.countFrozen(o, 1)
+	}
+	return o, nil
+}
+
+// countFrozen adds o's displayed and hidden size to the level's frozen
+// volume, or takes them off for a sign of -1, if o is frozen.
+func (l *Limit) countFrozen(o *Order, sign Size) {
+	if o.Frozen {
+		l.frozen += sign * o.Size
+		l.frozenHidden += sign * o.Hidden
+	}
+}
+
+// shown is the displayed size at the level that can be matched.
+func (l *Limit) shown() Size {
+	return l.TotalVolume - l.frozen
+}
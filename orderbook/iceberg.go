@@ -0,0 +1,45 @@
+package orderbook
+
+// An iceberg is a limit order with a DisplaySize smaller than its size. It
+// takes liquidity with its full size, but rests showing only a tranche of
+// DisplaySize and holds the rest back in Hidden. Each time the displayed
+// tranche fills, the next one goes on display at the back of the level's
+// queue, losing time priority, until the hidden part runs out.
+//
+// Hidden size is matchable, so it counts towards what an incoming order can
+// fill, but TotalVolume, the walks and Checksum only ever see the displayed
+// tranches.
+
+// hide moves what o has left beyond its display size into Hidden as it
+// comes to rest.
+func (o *Order) hide() {
+	if o.DisplaySize > 0 && o.Size > o.DisplaySize {
+		o.Hidden += o.Size - o.DisplaySize
+		o.Size = o.DisplaySize
+	}
+}
+
+// volume is everything at the level an incoming order can fill against,
+// hidden size included and frozen orders left out.
+func (l *Limit) volume() Size {
+	return l.shown() + l.hidden - l.frozenHidden
+}
+
+// replenish puts the next tranche of o, whose displayed size has just filled
+// and which has been taken out of l.Orders, at the back of l's queue. It
+// reports false, leaving o out, if o has no hidden size left.
+func (ob *Orderbook) replenish(l *Limit, o *Order) bool {
+	if o.Hidden <= 0 {
+		return false
+	}
+	l.hidden -= o.Hidden
+	o.Size = o.Hidden
+	o.Hidden = 0
+	o.hide()
+	o.Timestamp = max(ob.clock.Now().UnixNano(), o.Timestamp)
+	if n := len(l.Orders); n > 0 {
+		o.Timestamp = max(o.Timestamp, l.Orders[n-1].Timestamp)
+	}
+	l.AddOrder(o)
+	return true
+}
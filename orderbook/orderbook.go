@@ -1,39 +1,211 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"sort"
-	"time"
+	"sync"
+	"sync/atomic"
+
+	"github.com/thenaveensharma/exchange/clock"
 )
 
+// matchPool recycles the scratch match slices PlaceLimitOrder gathers fills
+// in; they are copied out only when the order crossed, so an order that just
+// rests doesn't allocate for them.
+var matchPool = sync.Pool{
+	New: func() any {
+		s := make([]Match, 0, 16)
+		return &s
+	},
+}
+
 type Match struct {
 	Ask        *Order
 	Bid        *Order
-	SizeFilled float64
-	Price      float64
+	SizeFilled Size
+	Price      Price
 }
 
 type Order struct {
-	Size      float64 `json:"size"`
-	Bid       bool    `json:"bid"`
-	Limit     *Limit  `json:"limit"`
-	Timestamp int64   `json:"timestamp"`
+	// ID identifies the order from the moment it reaches a book. IDs are
+	// unique across every book in the process.
+	ID uint64 `json:"id"`
+	// Size is the remaining size, reduced in place as the order fills.
+	Size Size `json:"size"`
+	// OriginalSize is the size the order was placed with.
+	OriginalSize Size `json:"originalSize"`
+	// Price is the limit price, set when placed as a limit order.
+	Price     Price  `json:"price"`
+	Bid       bool   `json:"bid"`
+	Limit     *Limit `json:"limit"`
+	Timestamp int64  `json:"timestamp"`
+	// TimeInForce is how long a limit order's unfilled remainder rests; the
+	// zero value is GoodTillCancel.
+	TimeInForce TimeInForce `json:"timeInForce,omitempty"`
+	// ExpiresAt is when a GoodTillDate order leaves the book, in unix
+	// nanoseconds. See ExpireOrders.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// DisplaySize makes a limit order an iceberg: it rests showing at most
+	// DisplaySize, with the rest held back in Hidden. See iceberg.go.
+	DisplaySize Size `json:"displaySize,omitempty"`
+	// Hidden is the part of a resting iceberg's remaining size that is not
+	// on display.
+	Hidden Size `json:"hidden,omitempty"`
+	// Metadata is opaque client data carried with the order. It is private to
+	// the order's owner and never part of public market data.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ClientOrderID is the client's own name for the order, as private as
+	// Metadata.
+	ClientOrderID string `json:"clientOrderId,omitempty"`
+	// Owner is the ID of the user who placed the order, zero if it is
+	// anonymous. The book doesn't look at it.
+	Owner uint64 `json:"owner,omitempty"`
+	// Frozen keeps a resting order on the book but out of matching. See
+	// freeze.go.
+	Frozen bool `json:"frozen,omitempty"`
+}
+
+const (
+	MaxMetadataKeys  = 8
+	MaxMetadataBytes = 256
+)
+
+// ValidateMetadata checks order metadata against the key count and total
+// key plus value size limits.
+func ValidateMetadata(md map[string]string) error {
+	if len(md) > MaxMetadataKeys {
+		return fmt.Errorf("metadata has %d keys, at most %d allowed", len(md), MaxMetadataKeys)
+	}
+	size := 0
+	for k, v := range md {
+		if k == "" {
+			return fmt.Errorf("metadata keys must not be empty")
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataBytes {
+		return fmt.Errorf("metadata is %d bytes, at most %d allowed", size, MaxMetadataBytes)
+	}
+	return nil
 }
 
 func (o *Order) String() string {
-	return fmt.Sprintf("[size: %.2f]", o.Size)
+	return fmt.Sprintf("[size: %d]", o.Size)
 }
 
 func (o *Order) IsFilled() bool {
-	return o.Size == 0.0
+	return o.Size == 0
 }
 
-func NewOrder(bid bool, size float64) *Order {
+// FilledSize is how much of the order has executed so far.
+func (o *Order) FilledSize() Size {
+	return o.OriginalSize - o.Remaining()
+}
+
+// Remaining is the order's unfilled size, an iceberg's hidden part included.
+func (o *Order) Remaining() Size {
+	return o.Size + o.Hidden
+}
+
+// NewOrder returns an order for size. It is given its ID and timestamp by
+// the book it is placed on.
+func NewOrder(bid bool, size Size) *Order {
 	return &Order{
-		Size:      size,
-		Bid:       bid,
-		Timestamp: time.Now().UnixNano(),
+		Size:         size,
+		OriginalSize: size,
+		Bid:          bid,
+	}
+}
+
+// stamp gives o an ID and sets its timestamp to the time it reaches the
+// book, unless the caller already gave it either.
+func (ob *Orderbook) stamp(o *Order) {
+	if o.ID == 0 {
+		o.ID = lastOrderID.Add(1)
+	}
+	if o.Timestamp == 0 {
+		o.Timestamp = ob.clock.Now().UnixNano()
+	}
+}
+
+// lastOrderID is the most recent order ID handed out by any book.
+var lastOrderID atomic.Uint64
+
+// NewOrderID hands out an order ID ahead of the order reaching a book, for
+// orders held elsewhere first, like stop orders waiting for their trigger.
+// The book keeps an ID an order already has.
+func NewOrderID() uint64 {
+	return lastOrderID.Add(1)
+}
+
+// LastOrderID returns the most recent order ID handed out.
+func LastOrderID() uint64 {
+	return lastOrderID.Load()
+}
+
+// ReserveOrderIDs makes sure IDs up to id are never handed out again, for
+// orders that arrive with one, like those in an imported snapshot or
+// replayed from a journal.
+func ReserveOrderIDs(id uint64) {
+	for {
+		last := lastOrderID.Load()
+		if last >= id || lastOrderID.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+var (
+	// ErrOrderNotFound is returned for an ID with no resting order on the
+	// book.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrInsufficientLiquidity is returned for a market order larger than
+	// the opposite side's resting volume.
+	ErrInsufficientLiquidity = errors.New("not enough resting volume for market order")
+	// ErrAuctionInProgress is returned for a market order while the book is
+	// in an auction.
+	ErrAuctionInProgress = errors.New("market orders are not accepted during an auction")
+)
+
+// GetOrder returns the resting order with id.
+func (ob *Orderbook) GetOrder(id uint64) (*Order, bool) {
+	o, ok := ob.orders[id]
+	return o, ok
+}
+
+// CancelOrderByID cancels the resting order with id through CancelOrder and
+// returns it.
+func (ob *Orderbook) CancelOrderByID(id uint64) (*Order, error) {
+	o, ok := ob.orders[id]
+	if !ok {
+		return nil, ErrOrderNotFound
 	}
+	ob.CancelOrder(o)
+	return o, nil
+}
+
+// TimeInForce is how long an order's unfilled remainder stays on the book.
+type TimeInForce string
+
+const (
+	// GoodTillCancel rests the remainder until it fills or is cancelled.
+	GoodTillCancel TimeInForce = "GTC"
+	// ImmediateOrCancel fills what crosses on entry and drops the rest
+	// without it ever resting.
+	ImmediateOrCancel TimeInForce = "IOC"
+	// FillOrKill fills completely on entry or not at all.
+	FillOrKill TimeInForce = "FOK"
+	// GoodTillDate rests the remainder until it fills, is cancelled or
+	// reaches the order's ExpiresAt.
+	GoodTillDate TimeInForce = "GTD"
+)
+
+// Rests reports whether an order's unfilled remainder goes on the book.
+func (t TimeInForce) Rests() bool {
+	return t != ImmediateOrCancel && t != FillOrKill
 }
 
 type Orders []*Order
@@ -49,64 +221,144 @@ func (o Orders) Less(i, j int) bool {
 	return o[i].Timestamp < o[j].Timestamp
 }
 
+// Limit is a price level. TotalVolume is the displayed size of its orders;
+// hidden is what their icebergs hold back. frozen and frozenHidden are the
+// parts of each that belong to frozen orders.
 type Limit struct {
-	Price       float64
-	Orders      Orders
-	TotalVolume float64
+	Price        Price
+	Orders       Orders
+	TotalVolume  Size
+	hidden       Size
+	frozen       Size
+	frozenHidden Size
 }
 
 func (l *Limit) String() string {
-	return fmt.Sprintf("[price: %.2f | volume: %.2f]", l.Price, l.TotalVolume)
+	return fmt.Sprintf("[price: %d | volume: %d]", l.Price, l.TotalVolume)
 }
 func (l *Limit) AddOrder(o *Order) {
 	o.Limit = l
 	l.Orders = append(l.Orders, o)
 	l.TotalVolume += o.Size
+	l.hidden += o.Hidden
+	l.countFrozen(o, 1)
 }
 
 func (l *Limit) DeleteOrder(o *Order) {
 	for index, order := range l.Orders {
 		if order == o {
-			l.Orders[index] = l.Orders[len(l.Orders)-1]
+			// shift left instead of swap-and-sort so time priority is kept
+			copy(l.Orders[index:], l.Orders[index+1:])
+			l.Orders[len(l.Orders)-1] = nil
 			l.Orders = l.Orders[:len(l.Orders)-1]
 			break
 		}
 	}
 	o.Limit = nil
 	l.TotalVolume -= o.Size
-
-	sort.Sort(l.Orders)
+	l.hidden -= o.Hidden
+	l.countFrozen(o, -1)
 }
 
 func (l *Limit) Fill(o *Order) []Match {
-	var (
-		matches        []Match
-		ordersToDelete []*Order
-	)
-	for _, order := range l.Orders {
+	return l.fill(o, make([]Match, 0, len(l.Orders)))
+}
+
+// fill matches o against the resting orders in time priority, passing over
+// frozen ones, appending to matches. Filled orders are compacted out of
+// l.Orders in place.
+func (l *Limit) fill(o *Order, matches []Match) []Match {
+	n := 0
+	for i, order := range l.Orders {
+		if o.IsFilled() {
+			n += copy(l.Orders[n:], l.Orders[i:])
+			break
+		}
+		if order.Frozen {
+			l.Orders[n] = order
+			n++
+			continue
+		}
 
 		match := l.FillOrder(order, o)
 		l.TotalVolume -= match.SizeFilled
 		matches = append(matches, match)
 		if order.IsFilled() {
-			ordersToDelete = append(ordersToDelete, order)
-		}
-		if o.IsFilled() {
-			break
+			order.Limit = nil
+			continue
 		}
+		l.Orders[n] = order
+		n++
 	}
 
-	for _, orderToDelete := range ordersToDelete {
-		l.DeleteOrder(orderToDelete)
+	for i := n; i < len(l.Orders); i++ {
+		l.Orders[i] = nil
 	}
+	l.Orders = l.Orders[:n]
 	return matches
 }
 
+// fillSize fills exactly size between a resting order and an incoming one.
+func (l *Limit) fillSize(existingOrder, newOrder *Order, size Size) Match {
+	ask, bid := newOrder, existingOrder
+	if newOrder.Bid {
+		ask, bid = existingOrder, newOrder
+	}
+
+	existingOrder.Size -= size
+	newOrder.Size -= size
+	l.TotalVolume -= size
+	return Match{Ask: ask, Bid: bid, SizeFilled: size, Price: l.Price}
+}
+
+// shift drops the level's first order, keeping the rest in time priority.
+// The level's volumes are left to the caller.
+func (l *Limit) shift() {
+	l.Orders[0].Limit = nil
+	n := copy(l.Orders, l.Orders[1:])
+	l.Orders[n] = nil
+	l.Orders = l.Orders[:n]
+}
+
+// take drops o from the level like shift, wherever it is in the queue.
+func (l *Limit) take(o *Order) {
+	if i := slices.Index(l.Orders, o); i >= 0 {
+		o.Limit = nil
+		l.Orders = slices.Delete(l.Orders, i, i+1)
+	}
+}
+
+// first is the level's first order that isn't frozen, nil if all are.
+func (l *Limit) first() *Order {
+	for _, order := range l.Orders {
+		if !order.Frozen {
+			return order
+		}
+	}
+	return nil
+}
+
+// removeFilled drops fully filled orders from the level, keeping the rest in
+// time priority.
+func (l *Limit) removeFilled() {
+	n := 0
+	for _, order := range l.Orders {
+		if order.IsFilled() {
+			order.Limit = nil
+			continue
+		}
+		l.Orders[n] = order
+		n++
+	}
+	clear(l.Orders[n:])
+	l.Orders = l.Orders[:n]
+}
+
 func (l *Limit) FillOrder(existingOrder, newOrder *Order) Match {
 	var (
 		bid        *Order
 		ask        *Order
-		sizeFilled float64
+		sizeFilled Size
 	)
 
 	if newOrder.Bid {
@@ -120,11 +372,11 @@ func (l *Limit) FillOrder(existingOrder, newOrder *Order) Match {
 	if existingOrder.Size >= newOrder.Size {
 		existingOrder.Size -= newOrder.Size
 		sizeFilled = newOrder.Size
-		newOrder.Size = 0.0
+		newOrder.Size = 0
 	} else {
 		newOrder.Size -= existingOrder.Size
 		sizeFilled = existingOrder.Size
-		existingOrder.Size = 0.0
+		existingOrder.Size = 0
 	}
 	return Match{Ask: ask, Bid: bid, SizeFilled: sizeFilled, Price: l.Price}
 }
@@ -157,7 +409,8 @@ func (a ByBestBid) Less(i, j int) bool {
 	return a.Limits[i].Price > a.Limits[j].Price
 }
 
-func NewLimit(price float64) *Limit {
+// NewLimit creates an empty level at price.
+func NewLimit(price Price) *Limit {
 	return &Limit{
 		Price:  price,
 		Orders: []*Order{},
@@ -165,106 +418,377 @@ func NewLimit(price float64) *Limit {
 }
 
 type Orderbook struct {
+	// RWMutex is the book's synchronization. Orderbook methods don't lock;
+	// callers sharing a book hold the write lock around mutations and at
+	// least the read lock around reads, including anything derived from
+	// Asks, Bids and the walkers.
+	sync.RWMutex
+
 	asks      []*Limit
 	bids      []*Limit
-	AskLimits map[float64]*Limit
-	BidLimits map[float64]*Limit
+	AskLimits map[Price]*Limit
+	BidLimits map[Price]*Limit
+
+	// seq is bumped on every mutation of the book
+	seq uint64
+	// auction is set while the book is in a call auction, see auction.go
+	auction bool
+	policy  MatchPolicy
+	// counters backs Stats, see stats.go
+	counters counters
+	// lastPrice is the price of the most recent match
+	lastPrice Price
+	// clock stamps orders and trades
+	clock clock.Clock
+	// scale is what the book's prices and sizes are worth, for valuing
+	// them in the quote asset
+	scale Scale
+	// orders indexes the resting orders by ID
+	orders map[uint64]*Order
+	// expiries queues the resting GoodTillDate orders, see expiry.go
+	expiries expiryQueue
 }
 
-func NewOrderbook() *Orderbook {
-	return &Orderbook{
-		bids:      []*Limit{},
-		asks:      []*Limit{},
-		AskLimits: make(map[float64]*Limit),
-		BidLimits: make(map[float64]*Limit),
+type Option func(*Orderbook)
+
+// WithMatchPolicy sets how incoming orders are allocated across a level.
+func WithMatchPolicy(policy MatchPolicy) Option {
+	return func(ob *Orderbook) {
+		ob.policy = policy
 	}
 }
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
-	matches := []Match{}
 
-	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
-		}
-		for _, limit := range ob.Asks() {
+// WithScale sets the scale of the book's prices and sizes; the default is
+// DefaultScale.
+func WithScale(s Scale) Option {
+	return func(ob *Orderbook) {
+		ob.scale = s
+	}
+}
 
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
-			}
-		}
+// WithClock sets the clock the book stamps orders and trades with.
+func WithClock(c clock.Clock) Option {
+	return func(ob *Orderbook) {
+		ob.clock = c
+	}
+}
 
-	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
+func (ob *Orderbook) init() {
+	ob.bids = []*Limit{}
+	ob.asks = []*Limit{}
+	ob.AskLimits = make(map[Price]*Limit)
+	ob.BidLimits = make(map[Price]*Limit)
+	ob.orders = make(map[uint64]*Order)
+	ob.policy = FIFOPolicy{}
+	ob.clock = clock.Real()
+	ob.scale = DefaultScale
+}
+
+// Scale is the scale of the book's prices and sizes.
+func (ob *Orderbook) Scale() Scale {
+	return ob.scale
+}
+
+// NewOrderbook creates an empty book. Without options it matches in
+// price-time priority.
+func NewOrderbook(opts ...Option) *Orderbook {
+	ob := &Orderbook{}
+	ob.init()
+	for _, opt := range opts {
+		opt(ob)
+	}
+	return ob
+}
+
+// PlaceMarketOrder fills o against the opposite side, best price first. It
+// is refused with ErrInsufficientLiquidity if o is larger than everything
+// resting there, and with ErrAuctionInProgress during an auction; a refused
+// order leaves the book as it was.
+func (ob *Orderbook) PlaceMarketOrder(o *Order) ([]Match, error) {
+	if ob.auction {
+		return nil, ErrAuctionInProgress
+	}
+	ob.stamp(o)
+
+	if limit := ob.topOfBook(o); limit != nil {
+		ob.seq++
+		ob.counters.placed++
+		return ob.fillFirst(limit, o), nil
+	}
+
+	limits := ob.Asks()
+	if !o.Bid {
+		limits = ob.Bids()
+	}
+	// hidden size counts towards what the order can fill, but is never
+	// reported
+	volume := Size(0)
+	for _, limit := range limits {
+		volume += limit.volume()
+	}
+	if o.Size > volume {
+		return nil, fmt.Errorf("%w [size: %d]", ErrInsufficientLiquidity, o.Size)
+	}
+	ob.seq++
+	ob.counters.placed++
+
+	// size the result from the orders on the levels the sweep will reach
+	n, remaining := 0, o.Size
+	for _, limit := range limits {
+		n += len(limit.Orders)
+		remaining -= limit.TotalVolume
+		if remaining <= 0 {
+			break
 		}
-		for _, limit := range ob.Bids() {
+	}
+	matches := make([]Match, 0, n)
 
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
-			}
+	swept := 0
+	for _, limit := range limits {
+		matches = ob.fillLevel(limit, o, matches)
+		swept++
+		if o.IsFilled() {
+			break
 		}
 	}
+	ob.clearBest(!o.Bid, swept)
 
-	return matches
+	return matches, nil
+}
+
+// PlaceProtectedMarketOrder fills o like a market order, but only against
+// resting orders priced no worse than worst, and drops whatever is left as
+// ImmediateOrCancel does rather than sweeping further. It is refused with
+// ErrAuctionInProgress during an auction.
+func (ob *Orderbook) PlaceProtectedMarketOrder(o *Order, worst Price) ([]Match, error) {
+	if ob.auction {
+		return nil, ErrAuctionInProgress
+	}
+	tif := o.TimeInForce
+	o.TimeInForce = ImmediateOrCancel
+	matches := ob.PlaceLimitOrder(worst, o)
+	// it never rests, so it never had a limit price of its own
+	o.TimeInForce, o.Price = tif, 0
+	return matches, nil
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.seq++
+
 	limit := o.Limit
 	limit.DeleteOrder(o)
+	delete(ob.orders, o.ID)
+	ob.counters.rest(o.Bid, -1)
+	ob.counters.cancelled++
+	if len(limit.Orders) == 0 {
+		ob.clearLimit(o.Bid, limit)
+	}
 }
-func (ob *Orderbook) BidTotalVolume() float64 {
-	total := 0.0
-	for _, bid := range ob.bids {
-		total += bid.TotalVolume
+
+// ReduceOrder shrinks the resting order o to size in place, keeping its
+// price and its place in the queue. Reducing to zero cancels it. It is
+// strictly a decrement: a size above what remains is an error. For an
+// iceberg size is the whole remainder, taken from the hidden part first.
+// The reduction comes off OriginalSize too, so it isn't counted as filled.
+func (ob *Orderbook) ReduceOrder(o *Order, size Size) error {
+	if o.Limit == nil {
+		return fmt.Errorf("order is not resting")
 	}
-	return total
+	if size < 0 || size > o.Remaining() {
+		return fmt.Errorf("cannot reduce order [size: %d] to %d", o.Remaining(), size)
+	}
+	if size == 0 {
+		ob.CancelOrder(o)
+		return nil
+	}
+
+	ob.seq++
+	limit := o.Limit
+	limit.countFrozen(o, -1)
+	defer limit.countFrozen(o, 1)
+	o.OriginalSize -= o.Remaining() - size
+	hidden := max(size-o.Size, 0)
+	limit.hidden -= o.Hidden - hidden
+	o.Hidden = hidden
+	if visible := size - hidden; visible < o.Size {
+		limit.TotalVolume -= o.Size - visible
+		o.Size = visible
+	}
+	return nil
 }
-func (ob *Orderbook) AskTotalVolume() float64 {
-	total := 0.0
-	for _, ask := range ob.asks {
-		total += ask.TotalVolume
+
+// KeepsPriority reports whether amending o to rest size at price keeps its
+// place in the queue, which only a reduction at the same price does.
+func (o *Order) KeepsPriority(price Price, size Size) bool {
+	return price == o.Price && size <= o.Remaining()
+}
+
+// ModifyOrder amends the resting order with id to size at price, size being
+// what is left of it. An amendment that KeepsPriority goes through
+// ReduceOrder; any other cancels the order and places it again under the
+// same ID, behind whatever already rests at the price and matching if the
+// new price crosses. It returns the replacement's fills.
+func (ob *Orderbook) ModifyOrder(id uint64, price Price, size Size) ([]Match, error) {
+	o, ok := ob.orders[id]
+	if !ok {
+		return nil, ErrOrderNotFound
 	}
-	return total
+	if price <= 0 || size <= 0 {
+		return nil, fmt.Errorf("cannot modify order to [price: %d | size: %d]", price, size)
+	}
+	if o.KeepsPriority(price, size) {
+		return nil, ob.ReduceOrder(o, size)
+	}
+
+	filled := o.FilledSize()
+	ob.CancelOrder(o)
+	o.Size, o.Hidden, o.OriginalSize = size, 0, filled+size
+	// restamped on placement, so it queues as a new order
+	o.Timestamp = 0
+	return ob.PlaceLimitOrder(price, o), nil
 }
 
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
+// CancelRange cancels the resting orders on one side priced within from and
+// to inclusive that keep reports true for (all of them if keep is nil), with
+// the same effects as cancelling each through CancelOrder. It returns the
+// cancelled orders best price first; an empty range cancels nothing. Each
+// level is compacted in one pass and the emptied levels are dropped together
+// at the end, so clearing a whole side is linear in its orders.
+func (ob *Orderbook) CancelRange(side Side, from, to Price, keep func(*Order) bool) []*Order {
+	cancelled := []*Order{}
+	if from > to {
+		return cancelled
+	}
 
-	if o.Bid {
-		for _, limit := range ob.Asks() {
-			if limit.Price > price {
-				break
-			}
+	bid := side == SideBid
+	limits, index := &ob.asks, ob.AskLimits
+	start := sort.Search(len(ob.asks), func(i int) bool { return ob.asks[i].Price >= from })
+	inRange := func(price Price) bool { return price <= to }
+	if bid {
+		limits, index = &ob.bids, ob.BidLimits
+		start = sort.Search(len(ob.bids), func(i int) bool { return ob.bids[i].Price <= to })
+		inRange = func(price Price) bool { return price >= from }
+	}
 
-			limit.Fill(o)
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
-			}
-			if o.IsFilled() {
-				return
+	levels, end := *limits, start
+	for ; end < len(levels) && inRange(levels[end].Price); end++ {
+		limit := levels[end]
+		n := 0
+		for _, order := range limit.Orders {
+			if keep != nil && !keep(order) {
+				limit.Orders[n] = order
+				n++
+				continue
 			}
+			order.Limit = nil
+			limit.TotalVolume -= order.Size
+			limit.hidden -= order.Hidden
+			limit.countFrozen(order, -1)
+			delete(ob.orders, order.ID)
+			cancelled = append(cancelled, order)
+		}
+		clear(limit.Orders[n:])
+		limit.Orders = limit.Orders[:n]
+		if n == 0 {
+			delete(index, limit.Price)
+		}
+	}
+
+	n := start
+	for i := start; i < len(levels); i++ {
+		if i < end && len(levels[i].Orders) == 0 {
+			continue
 		}
+		levels[n] = levels[i]
+		n++
+	}
+	clear(levels[n:])
+	*limits = levels[:n]
+
+	ob.seq += uint64(len(cancelled))
+	ob.counters.rest(bid, -len(cancelled))
+	ob.counters.cancelled += uint64(len(cancelled))
+	return cancelled
+}
+
+// Reset cancels every resting order through CancelRange, leaving the book
+// empty, and returns the cancelled orders, asks first.
+func (ob *Orderbook) Reset() []*Order {
+	cancelled := ob.CancelRange(SideAsk, 0, math.MaxInt64, nil)
+	return append(cancelled, ob.CancelRange(SideBid, 0, math.MaxInt64, nil)...)
+}
+
+// Sequence returns the number of mutations applied to the book.
+func (ob *Orderbook) Sequence() uint64 {
+	return ob.seq
+}
+func (ob *Orderbook) BidTotalVolume() Size {
+	return ob.totalVolume(SideBid)
+}
+func (ob *Orderbook) AskTotalVolume() Size {
+	return ob.totalVolume(SideAsk)
+}
+
+func (ob *Orderbook) totalVolume(side Side) Size {
+	total := Size(0)
+	ob.WalkLimits(side, func(l LimitView) bool {
+		total += l.TotalVolume
+		return true
+	})
+	return total
+}
+
+// PlaceLimitOrder matches o against the opposite side up to price and rests
+// whatever is left, unless o is ImmediateOrCancel. It returns the fills, or
+// nil if the order didn't cross. A FillOrKill order that can't fill
+// completely is killed before it trades, leaving the book as it was.
+func (ob *Orderbook) PlaceLimitOrder(price Price, o *Order) []Match {
+	ob.stamp(o)
+	o.Price = price
+	if o.TimeInForce == FillOrKill && !ob.Fillable(o.Bid, price, o.Size) {
+		return nil
+	}
+	ob.seq++
+	ob.counters.placed++
+
+	if limit := ob.topOfBook(o); limit != nil && (o.Bid && limit.Price <= price || !o.Bid && limit.Price >= price) {
+		return ob.fillFirst(limit, o)
+	}
+
+	scratch := matchPool.Get().(*[]Match)
+	defer func() {
+		*scratch = (*scratch)[:0]
+		matchPool.Put(scratch)
+	}()
+
+	var limits []*Limit
+	if o.Bid {
+		limits = ob.Asks()
 	} else {
-		for _, limit := range ob.Bids() {
-			if limit.Price < price {
-				break
-			}
+		limits = ob.Bids()
+	}
 
-			limit.Fill(o)
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
-			}
-			if o.IsFilled() {
-				return
-			}
+	// orders accumulate without matching while the book is in auction
+	if ob.auction {
+		limits = nil
+	}
+
+	swept := 0
+	for _, limit := range limits {
+		if o.Bid && limit.Price > price || !o.Bid && limit.Price < price {
+			break
+		}
+
+		*scratch = ob.fillLevel(limit, o, *scratch)
+		swept++
+		if o.IsFilled() {
+			break
 		}
 	}
+	ob.clearBest(!o.Bid, swept)
 
 	// If the order is not fully filled, add it to the orderbook
-	if !o.IsFilled() {
+	if !o.IsFilled() && o.TimeInForce.Rests() {
 		var limit *Limit
 		if o.Bid {
 			limit = ob.BidLimits[price]
@@ -274,49 +798,221 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 
 		if limit == nil {
 			limit = NewLimit(price)
-			if o.Bid {
-				ob.bids = append(ob.bids, limit)
-				ob.BidLimits[price] = limit
-			} else {
-				ob.asks = append(ob.asks, limit)
-				ob.AskLimits[price] = limit
-			}
+			ob.insertLimit(o.Bid, limit)
 		}
+		o.hide()
 		limit.AddOrder(o)
+		ob.orders[o.ID] = o
+		ob.counters.rest(o.Bid, 1)
+		ob.queueExpiry(o)
+	}
+
+	if len(*scratch) == 0 {
+		return nil
 	}
+	return slices.Clone(*scratch)
+}
 
+// topOfBook returns the best opposite level when o can take the fast path:
+// FIFO matching outside an auction, and o no larger than the level's first
+// resting order, so a single fill against that order completes it.
+func (ob *Orderbook) topOfBook(o *Order) *Limit {
+	if _, fifo := ob.policy.(FIFOPolicy); !fifo || ob.auction {
+		return nil
+	}
+	limits := ob.asks
+	if !o.Bid {
+		limits = ob.bids
+	}
+	if len(limits) == 0 || o.IsFilled() || limits[0].Orders[0].Frozen || o.Size > limits[0].Orders[0].Size {
+		return nil
+	}
+	return limits[0]
 }
 
+// fillFirst fills o against the first order of limit, the best opposite
+// level, with exactly the effects of the general path: the same match, level
+// volume, counters and last price, clearing the order and level if emptied.
+func (ob *Orderbook) fillFirst(limit *Limit, o *Order) []Match {
+	resting := limit.Orders[0]
+	match := limit.FillOrder(resting, o)
+	limit.TotalVolume -= match.SizeFilled
+	ob.counters.trade(ob.clock.Now(), 1)
+	ob.lastPrice = limit.Price
+
+	if resting.IsFilled() {
+		limit.shift()
+		if ob.replenish(limit, resting) {
+			return []Match{match}
+		}
+		delete(ob.orders, resting.ID)
+		ob.counters.rest(resting.Bid, -1)
+		if len(limit.Orders) == 0 {
+			ob.clearBest(resting.Bid, 1)
+		}
+	}
+	return []Match{match}
+}
+
+// Asks returns the ask levels, best (lowest) price first. The sides are kept
+// sorted as levels are added and cleared, so reading them never mutates the
+// book.
 func (ob *Orderbook) Asks() []*Limit {
-	sort.Sort(ByBestAsk{ob.asks})
 	return ob.asks
 }
+
+// Bids returns the bid levels, best (highest) price first.
 func (ob *Orderbook) Bids() []*Limit {
-	sort.Sort(ByBestBid{ob.bids})
 	return ob.bids
 }
 
+// insertLimit adds a new level at its sorted position.
+func (ob *Orderbook) insertLimit(bid bool, l *Limit) {
+	limits, index := &ob.asks, ob.AskLimits
+	at := sort.Search(len(ob.asks), func(i int) bool { return ob.asks[i].Price > l.Price })
+	if bid {
+		limits, index = &ob.bids, ob.BidLimits
+		at = sort.Search(len(ob.bids), func(i int) bool { return ob.bids[i].Price < l.Price })
+	}
+
+	*limits = slices.Insert(*limits, at, l)
+	index[l.Price] = l
+}
+
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
+	limits, index := &ob.asks, ob.AskLimits
+	if bid {
+		limits, index = &ob.bids, ob.BidLimits
+	}
+
+	delete(index, l.Price)
+	if i := slices.Index(*limits, l); i >= 0 {
+		*limits = slices.Delete(*limits, i, i+1)
+	}
+}
+
+// clearBest removes the emptied levels among the n best of a side. Sweeps
+// reach levels in price order, so the levels they empty are always among
+// those they reached, and are dropped once the sweep is done rather than
+// while ranging over it. Only a level left holding frozen orders survives a
+// sweep that went past it.
+func (ob *Orderbook) clearBest(bid bool, n int) {
+	if n == 0 {
+		return
+	}
 
+	limits, index := &ob.asks, ob.AskLimits
 	if bid {
-		delete(ob.BidLimits, l.Price)
+		limits, index = &ob.bids, ob.BidLimits
+	}
+	kept := 0
+	for _, limit := range (*limits)[:n] {
+		if len(limit.Orders) == 0 {
+			delete(index, limit.Price)
+			continue
+		}
+		(*limits)[kept] = limit
+		kept++
+	}
+	rest := kept + copy((*limits)[kept:], (*limits)[n:])
+	clear((*limits)[rest:])
+	*limits = (*limits)[:rest]
+}
 
-		for index, limit := range ob.bids {
-			if limit == l {
-				ob.bids[index] = ob.bids[len(ob.bids)-1]
-				ob.bids = ob.bids[:len(ob.bids)-1]
-				break
-			}
+// Validate checks the book's structural invariants: every level is indexed
+// and non-empty, level volumes match their orders, orders point back at their
+// level in time priority and are indexed by ID, and the book is not crossed
+// outside of an auction.
+func (ob *Orderbook) Validate() error {
+	sides := []struct {
+		name   string
+		bid    bool
+		limits []*Limit
+		index  map[Price]*Limit
+		orders int
+	}{
+		{"ask", false, ob.Asks(), ob.AskLimits, ob.counters.askOrders},
+		{"bid", true, ob.Bids(), ob.BidLimits, ob.counters.bidOrders},
+	}
+
+	indexed := 0
+	for _, side := range sides {
+		resting := 0
+		for _, limit := range side.limits {
+			resting += len(limit.Orders)
 		}
-	} else {
-		delete(ob.AskLimits, l.Price)
+		if resting != side.orders {
+			return fmt.Errorf("%s side rests %d orders but counts %d", side.name, resting, side.orders)
+		}
+		if len(side.limits) != len(side.index) {
+			return fmt.Errorf("%s side has %d levels but %d indexed", side.name, len(side.limits), len(side.index))
+		}
+		for i, limit := range side.limits {
+			if i > 0 && (side.bid && limit.Price >= side.limits[i-1].Price || !side.bid && limit.Price <= side.limits[i-1].Price) {
+				return fmt.Errorf("%s level %s is out of price order", side.name, limit)
+			}
+			if side.index[limit.Price] != limit {
+				return fmt.Errorf("%s level %s is not indexed by its price", side.name, limit)
+			}
+			if len(limit.Orders) == 0 {
+				return fmt.Errorf("%s level %s has no orders", side.name, limit)
+			}
 
-		for index, limit := range ob.asks {
-			if limit == l {
-				ob.asks[index] = ob.asks[len(ob.asks)-1]
-				ob.asks = ob.asks[:len(ob.asks)-1]
-				break
+			var volume, hidden, frozen, frozenHidden Size
+			for i, order := range limit.Orders {
+				if order.Limit != limit {
+					return fmt.Errorf("order %s on %s level %s points at another level", order, side.name, limit)
+				}
+				if order.Bid != side.bid {
+					return fmt.Errorf("order %s rests on the wrong side at %s level %s", order, side.name, limit)
+				}
+				if order.Size <= 0 {
+					return fmt.Errorf("order %s on %s level %s has no remaining size", order, side.name, limit)
+				}
+				if i > 0 && order.Timestamp < limit.Orders[i-1].Timestamp {
+					return fmt.Errorf("%s level %s is out of time priority", side.name, limit)
+				}
+				if ob.orders[order.ID] != order {
+					return fmt.Errorf("order %s on %s level %s is not indexed by its ID %d", order, side.name, limit, order.ID)
+				}
+				indexed++
+				volume += order.Size
+				hidden += order.Hidden
+				if order.Frozen {
+					frozen += order.Size
+					frozenHidden += order.Hidden
+				}
+			}
+			if volume != limit.TotalVolume {
+				return fmt.Errorf("%s level %s volume does not match its orders [sum: %d]", side.name, limit, volume)
 			}
+			if hidden != limit.hidden {
+				return fmt.Errorf("%s level %s hidden volume does not match its orders", side.name, limit)
+			}
+			if frozen != limit.frozen || frozenHidden != limit.frozenHidden {
+				return fmt.Errorf("%s level %s frozen volume does not match its orders", side.name, limit)
+			}
+		}
+	}
+
+	if indexed != len(ob.orders) {
+		return fmt.Errorf("book rests %d orders but indexes %d by ID", indexed, len(ob.orders))
+	}
+	// an order can rest through levels holding only frozen orders, which
+	// nothing matches
+	ask, bid := bestMatchable(ob.asks), bestMatchable(ob.bids)
+	if !ob.auction && ask != nil && bid != nil && bid.Price >= ask.Price {
+		return fmt.Errorf("book is crossed [bid: %d | ask: %d]", bid.Price, ask.Price)
+	}
+	return nil
+}
+
+// bestMatchable is the best of limits with anything to match against.
+func bestMatchable(limits []*Limit) *Limit {
+	for _, limit := range limits {
+		if limit.volume() > 0 {
+			return limit
 		}
 	}
+	return nil
 }
@@ -1,9 +1,14 @@
 package orderbook
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
 )
 
 func assert(t *testing.T, a, b any) {
@@ -19,8 +24,8 @@ func TestLimit(t *testing.T) {
 	buyOrderC := NewOrder(true, 10)
 
 	// Test initial state
-	assert(t, l.Price, 10_000.0)
-	assert(t, l.TotalVolume, 0.0)
+	assert(t, l.Price, Price(10_000))
+	assert(t, l.TotalVolume, Size(0))
 	assert(t, len(l.Orders), 0)
 
 	// Test adding orders
@@ -28,7 +33,7 @@ func TestLimit(t *testing.T) {
 	l.AddOrder(buyOrderB)
 	l.AddOrder(buyOrderC)
 
-	assert(t, l.TotalVolume, 23.0)
+	assert(t, l.TotalVolume, Size(23))
 	assert(t, len(l.Orders), 3)
 	assert(t, l.Orders[0], buyOrderA)
 	assert(t, l.Orders[1], buyOrderB)
@@ -36,7 +41,7 @@ func TestLimit(t *testing.T) {
 
 	// Test deleting order
 	l.DeleteOrder(buyOrderB)
-	assert(t, l.TotalVolume, 15.0)
+	assert(t, l.TotalVolume, Size(15))
 	assert(t, len(l.Orders), 2)
 	assert(t, l.Orders[0], buyOrderA)
 	assert(t, l.Orders[1], buyOrderC)
@@ -50,18 +55,18 @@ func TestPlaceOrder(t *testing.T) {
 
 	// Test initial state
 	assert(t, len(ob.asks), 0)
-	assert(t, ob.AskTotalVolume(), 0.0)
+	assert(t, ob.AskTotalVolume(), Size(0))
 
 	// Test placing orders
 	ob.PlaceLimitOrder(10_000, sellOrderA)
 	ob.PlaceLimitOrder(20_000, sellOrderB)
 
 	assert(t, len(ob.asks), 2)
-	assert(t, ob.AskTotalVolume(), 25.0)
-	assert(t, ob.asks[0].Price, 10_000.0)
-	assert(t, ob.asks[1].Price, 20_000.0)
-	assert(t, ob.asks[0].TotalVolume, 20.0)
-	assert(t, ob.asks[1].TotalVolume, 5.0)
+	assert(t, ob.AskTotalVolume(), Size(25))
+	assert(t, ob.asks[0].Price, Price(10_000))
+	assert(t, ob.asks[1].Price, Price(20_000))
+	assert(t, ob.asks[0].TotalVolume, Size(20))
+	assert(t, ob.asks[1].TotalVolume, Size(5))
 
 	// Verify order references
 	assert(t, sellOrderA.Limit, ob.asks[0])
@@ -70,45 +75,60 @@ func TestPlaceOrder(t *testing.T) {
 
 func TestPlaceMarketOrder(t *testing.T) {
 	ob := NewOrderbook()
-	sellOrder := NewOrder(false, 2.0)
-	buyOrder := NewOrder(true, 1.5)
+	sellOrder := NewOrder(false, 20)
+	buyOrder := NewOrder(true, 15)
 
 	// Test initial state
 	assert(t, len(ob.asks), 0)
-	assert(t, ob.AskTotalVolume(), 0.0)
+	assert(t, ob.AskTotalVolume(), Size(0))
 
 	// Test placing limit order
 	ob.PlaceLimitOrder(120, sellOrder)
 	assert(t, len(ob.asks), 1)
-	assert(t, ob.AskTotalVolume(), 2.0)
-	assert(t, ob.asks[0].Price, 120.0)
+	assert(t, ob.AskTotalVolume(), Size(20))
+	assert(t, ob.asks[0].Price, Price(120))
 	assert(t, sellOrder.Limit, ob.asks[0])
 
 	// Test placing market order
-	matches := ob.PlaceMarketOrder(buyOrder)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
 	assert(t, len(matches), 1)
 	assert(t, len(ob.asks), 1)
-	assert(t, ob.AskTotalVolume(), 0.5)
-	assert(t, sellOrder.Size, 0.5)
-	assert(t, buyOrder.Size, 0.0)
+	assert(t, ob.AskTotalVolume(), Size(5))
+	assert(t, sellOrder.Size, Size(5))
+	assert(t, buyOrder.Size, Size(0))
 
 	// Verify match details
-	assert(t, matches[0].Price, 120.0)
-	assert(t, matches[0].SizeFilled, 1.5)
+	assert(t, matches[0].Price, Price(120))
+	assert(t, matches[0].SizeFilled, Size(15))
 	assert(t, matches[0].Ask, sellOrder)
 	assert(t, matches[0].Bid, buyOrder)
 
 	// Verify remaining order state
 	assert(t, sellOrder.IsFilled(), false)
 	assert(t, buyOrder.IsFilled(), true)
+
+	// more than the side holds is refused without touching the book
+	seq, placed := ob.Sequence(), ob.Stats().OrdersPlaced
+	matches, err = ob.PlaceMarketOrder(NewOrder(true, 10))
+	assert(t, errors.Is(err, ErrInsufficientLiquidity), true)
+	assert(t, len(matches), 0)
+	assert(t, ob.Sequence(), seq)
+	assert(t, ob.Stats().OrdersPlaced, placed)
+	assert(t, ob.AskTotalVolume(), Size(5))
+
+	ob.StartAuction()
+	_, err = ob.PlaceMarketOrder(NewOrder(true, 5))
+	assert(t, err, ErrAuctionInProgress)
+	assert(t, ob.AskTotalVolume(), Size(5))
 }
 func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	ob := NewOrderbook()
 
-	// Create multiple sell orders at different price levels
-	sellOrderA := NewOrder(false, 2.0) // 2.0 units at 100
-	sellOrderB := NewOrder(false, 3.0) // 3.0 units at 110
-	sellOrderC := NewOrder(false, 1.0) // 1.0 units at 120
+	// Create multiple sell orders across two price levels
+	sellOrderA := NewOrder(false, 20) // 20 units at 100
+	sellOrderB := NewOrder(false, 30) // 30 units at 100
+	sellOrderC := NewOrder(false, 10) // 10 units at 120
 
 	// Place the limit orders
 	ob.PlaceLimitOrder(100, sellOrderA)
@@ -116,50 +136,1115 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	ob.PlaceLimitOrder(120, sellOrderC)
 
 	// Verify initial state
-	assert(t, len(ob.asks), 3)
-	assert(t, ob.AskTotalVolume(), 6.0)
-	assert(t, ob.asks[0].Price, 100.0)
-	assert(t, ob.asks[1].Price, 100.0)
-	assert(t, ob.asks[2].Price, 120.0)
+	assert(t, len(ob.asks), 2)
+	assert(t, ob.AskTotalVolume(), Size(60))
+	assert(t, ob.asks[0].Price, Price(100))
+	assert(t, ob.asks[1].Price, Price(120))
 
 	// Create a buy market order that will be filled by multiple sell orders
-	buyOrder := NewOrder(true, 5.5) // Total buy order size is 5.5 units
+	buyOrder := NewOrder(true, 55) // Total buy order size is 55 units
 
 	// Place the market order
-	matches := ob.PlaceMarketOrder(buyOrder)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
 
 	fmt.Printf("%+v", matches)
 
 	// Verify matches
 	assert(t, len(matches), 3)
-	assert(t, matches[0].Price, 100.0) // First match at lowest price
-	assert(t, matches[1].Price, 100.0) // Second match at middle price
+	assert(t, matches[0].Price, Price(100)) // First match at lowest price, oldest order
+	assert(t, matches[1].Price, Price(100)) // Second match at the same level
+	assert(t, matches[2].Price, Price(120)) // Third match at the next level
 
 	// Verify match sizes
-	assert(t, matches[0].SizeFilled, 2.0) // First order fully filled (2.0 units at 100)
-	assert(t, matches[1].SizeFilled, 3.0) // Second order fully filled (3.0 units at 110)
+	assert(t, matches[0].SizeFilled, Size(20)) // First order fully filled (20 units at 100)
+	assert(t, matches[1].SizeFilled, Size(30)) // Second order fully filled (30 units at 100)
+	assert(t, matches[2].SizeFilled, Size(5))  // Third order partially filled (5 units at 120)
 
 	// Verify remaining volumes
-	assert(t, sellOrderA.Size, 0.0) // First order fully filled
-	assert(t, sellOrderB.Size, 0.0) // Second order fully filled
-	assert(t, sellOrderC.Size, 0.5) // Third order partially filled (0.5 units remaining)
-	assert(t, buyOrder.Size, 0.0)   // Buy order fully filled
+	assert(t, sellOrderA.Size, Size(0)) // First order fully filled
+	assert(t, sellOrderB.Size, Size(0)) // Second order fully filled
+	assert(t, sellOrderC.Size, Size(5)) // Third order partially filled (5 units remaining)
+	assert(t, buyOrder.Size, Size(0))   // Buy order fully filled
 
 	// Verify orderbook state
-	assert(t, ob.AskTotalVolume(), 0.5)    // Only 0.5 units remaining in sellOrderC
-	assert(t, len(ob.asks), 3)             // All price levels should still exist
-	assert(t, ob.asks[2].TotalVolume, 0.5) // Only highest price level has remaining volume
+	assert(t, ob.AskTotalVolume(), Size(5))    // Only 5 units remaining in sellOrderC
+	assert(t, len(ob.asks), 1)                 // The emptied 100 level is cleared
+	assert(t, ob.asks[0].Price, Price(120))    // Only the 120 level remains
+	assert(t, ob.asks[0].TotalVolume, Size(5)) // with sellOrderC's remaining volume
 }
 
 func CancelOrder(t *testing.T) {
 	ob := NewOrderbook()
-	buyOrder := NewOrder(true, 4)
+	buyOrder := NewOrder(true, 40)
 
 	ob.PlaceLimitOrder(2000, buyOrder)
 	assert(t, len(ob.bids), 1)
-	assert(t, ob.bids[0].Price, 2000)
-	assert(t, ob.BidTotalVolume(), 4)
+	assert(t, ob.bids[0].Price, Price(2000))
+	assert(t, ob.BidTotalVolume(), Size(40))
 	ob.CancelOrder(buyOrder)
 	assert(t, len(ob.bids), 0)
 
 }
+
+func TestLimitFillKeepsTimePriority(t *testing.T) {
+	l := NewLimit(100)
+	orderA := NewOrder(false, 10)
+	orderB := NewOrder(false, 20)
+	orderC := NewOrder(false, 30)
+	l.AddOrder(orderA)
+	l.AddOrder(orderB)
+	l.AddOrder(orderC)
+
+	matches := l.Fill(NewOrder(true, 15))
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Ask, orderA)
+	assert(t, matches[1].Ask, orderB)
+	assert(t, len(l.Orders), 2)
+	assert(t, l.Orders[0], orderB)
+	assert(t, l.Orders[1], orderC)
+	assert(t, l.TotalVolume, Size(45))
+	assert(t, orderA.Limit, (*Limit)(nil))
+}
+
+func TestPlaceLimitOrderMatches(t *testing.T) {
+	ob := NewOrderbook()
+	askA := NewOrder(false, 2)
+	askB := NewOrder(false, 3)
+	assert(t, ob.PlaceLimitOrder(101, askA), []Match(nil))
+	assert(t, ob.PlaceLimitOrder(102, askB), []Match(nil))
+
+	bid := NewOrder(true, 4)
+	matches := ob.PlaceLimitOrder(102, bid)
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Ask, askA)
+	assert(t, matches[0].SizeFilled, Size(2))
+	assert(t, matches[0].Price, Price(101))
+	assert(t, matches[1].Ask, askB)
+	assert(t, matches[1].SizeFilled, Size(2))
+	assert(t, matches[1].Price, Price(102))
+}
+
+func BenchmarkPlaceMarketOrder(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ob := NewOrderbook()
+		for j := 0; j < 100; j++ {
+			ob.PlaceLimitOrder(Price(100+j%10), NewOrder(false, 1))
+		}
+		o := NewOrder(true, 100)
+		b.StartTimer()
+
+		ob.PlaceMarketOrder(o)
+	}
+}
+
+func BenchmarkPlaceLimitOrderCrossing(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ob := NewOrderbook()
+		for j := 0; j < 100; j++ {
+			ob.PlaceLimitOrder(Price(100+j%10), NewOrder(false, 1))
+		}
+		o := NewOrder(true, 100)
+		b.StartTimer()
+
+		ob.PlaceLimitOrder(110, o)
+	}
+}
+
+// topOfBookBook builds a book whose best ask is deep enough that small takers
+// never clear it, so every iteration hits the same top-of-book case.
+func topOfBookBook(levels int) *Orderbook {
+	ob := NewOrderbook()
+	for j := 0; j < levels; j++ {
+		for k := 0; k < 10; k++ {
+			ob.PlaceLimitOrder(Price(100+j), NewOrder(false, 1e12))
+		}
+	}
+	return ob
+}
+
+func BenchmarkTopOfBookMarketOrder(b *testing.B) {
+	for _, levels := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("levels=%d", levels), func(b *testing.B) {
+			ob := topOfBookBook(levels)
+			o := NewOrder(true, 1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o.Size = 1
+				ob.PlaceMarketOrder(o)
+			}
+		})
+	}
+}
+
+func BenchmarkTopOfBookLimitOrder(b *testing.B) {
+	for _, levels := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("levels=%d", levels), func(b *testing.B) {
+			ob := topOfBookBook(levels)
+			o := NewOrder(true, 1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o.Size = 1
+				ob.PlaceLimitOrder(100, o)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1))
+	ob.PlaceLimitOrder(100, NewOrder(false, 2))
+	ob.PlaceLimitOrder(110, NewOrder(false, 3))
+	ob.PlaceLimitOrder(90, NewOrder(true, 4))
+	iceberg := NewOrder(true, 10)
+	iceberg.DisplaySize = 2
+	ob.PlaceLimitOrder(90, iceberg)
+	seq := ob.Sequence()
+
+	cancelled := ob.Reset()
+	assert(t, len(cancelled), 5)
+	assert(t, ob.Validate(), nil)
+	assert(t, len(ob.asks), 0)
+	assert(t, len(ob.bids), 0)
+	assert(t, len(ob.AskLimits), 0)
+	assert(t, len(ob.BidLimits), 0)
+	assert(t, ob.AskTotalVolume(), Size(0))
+	assert(t, ob.BidTotalVolume(), Size(0))
+	assert(t, ob.Sequence() > seq, true)
+	for _, o := range cancelled {
+		assert(t, o.Limit, (*Limit)(nil))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1))
+	ob.PlaceLimitOrder(110, NewOrder(false, 2))
+	ob.PlaceLimitOrder(90, NewOrder(true, 3))
+	assert(t, ob.Validate(), nil)
+
+	ob.AskLimits[100].TotalVolume = 5
+	assert(t, ob.Validate() != nil, true)
+	ob.AskLimits[100].TotalVolume = 1
+
+	delete(ob.BidLimits, 90)
+	assert(t, ob.Validate() != nil, true)
+}
+
+func TestOrderMetadata(t *testing.T) {
+	ob := NewOrderbook()
+	sellOrder := NewOrder(false, 10)
+	sellOrder.Metadata = map[string]string{"strategy": "mm-1", "ref": "42"}
+	ob.PlaceLimitOrder(100, sellOrder)
+
+	// partial fill keeps the metadata on the resting remainder
+	ob.PlaceMarketOrder(NewOrder(true, 4))
+	assert(t, sellOrder.Size, Size(6))
+	assert(t, sellOrder.Metadata, map[string]string{"strategy": "mm-1", "ref": "42"})
+
+	ob.CancelOrder(sellOrder)
+	assert(t, sellOrder.Metadata, map[string]string{"strategy": "mm-1", "ref": "42"})
+}
+
+func TestValidateMetadata(t *testing.T) {
+	assert(t, ValidateMetadata(nil), nil)
+	assert(t, ValidateMetadata(map[string]string{"strategy": "mm-1"}), nil)
+
+	tooManyKeys := map[string]string{}
+	for i := 0; i <= MaxMetadataKeys; i++ {
+		tooManyKeys[fmt.Sprintf("k%d", i)] = "v"
+	}
+	assert(t, ValidateMetadata(tooManyKeys) != nil, true)
+
+	tooLarge := map[string]string{"note": string(make([]byte, MaxMetadataBytes))}
+	assert(t, ValidateMetadata(tooLarge) != nil, true)
+
+	assert(t, ValidateMetadata(map[string]string{"": "v"}) != nil, true)
+}
+
+func TestAuction(t *testing.T) {
+	ob := NewOrderbook()
+	ob.StartAuction()
+
+	bidA := NewOrder(true, 10)
+	bidB := NewOrder(true, 5)
+	bidC := NewOrder(true, 10)
+	askA := NewOrder(false, 8)
+	askB := NewOrder(false, 7)
+	askC := NewOrder(false, 12)
+	ob.PlaceLimitOrder(102, bidA)
+	ob.PlaceLimitOrder(101, bidB)
+	ob.PlaceLimitOrder(100, bidC)
+	ob.PlaceLimitOrder(99, askA)
+	ob.PlaceLimitOrder(100, askB)
+	ob.PlaceLimitOrder(101, askC)
+
+	// nothing matches while in auction and the book stays crossed
+	assert(t, ob.BidTotalVolume(), Size(25))
+	assert(t, ob.AskTotalVolume(), Size(27))
+	assert(t, ob.Validate(), nil)
+
+	// 15 executes at both 100 and 101; 100 leaves the smaller imbalance
+	state := ob.IndicativeAuction()
+	assert(t, state, AuctionState{InAuction: true, Price: 100, Volume: 15, Imbalance: 10})
+
+	matches, err := ob.ExecuteAuction()
+	assert(t, err, nil)
+	assert(t, len(matches), 3)
+	assert(t, matches[0], Match{Ask: askA, Bid: bidA, SizeFilled: 8, Price: 100})
+	assert(t, matches[1], Match{Ask: askB, Bid: bidA, SizeFilled: 2, Price: 100})
+	assert(t, matches[2], Match{Ask: askB, Bid: bidB, SizeFilled: 5, Price: 100})
+
+	// residual orders rest and the book is back to continuous trading
+	assert(t, ob.InAuction(), false)
+	assert(t, len(ob.Bids()), 1)
+	assert(t, ob.Bids()[0].Orders[0], bidC)
+	assert(t, len(ob.Asks()), 1)
+	assert(t, ob.Asks()[0].Orders[0], askC)
+	assert(t, ob.Validate(), nil)
+
+	_, err = ob.ExecuteAuction()
+	assert(t, err != nil, true)
+}
+
+func TestProRataPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ProRataPolicy
+		size   Size
+		fills  []Size
+	}{
+		// 250 * 100/600, 200/600, 300/600 = 41.7, 83.3, 125 floored to 40,
+		// 80, 120; the remaining 10 goes to the oldest order
+		{"whole lots", ProRataPolicy{LotSize: 10}, 250, []Size{50, 80, 120}},
+		{"half lots", ProRataPolicy{LotSize: 5}, 250, []Size{45, 80, 125}},
+		// the oldest order's 40 is below the minimum, so it only gets the
+		// 50 remainder through time priority
+		{"minimum fill", ProRataPolicy{LotSize: 10, MinFill: 50}, 250, []Size{50, 80, 120}},
+		{"remainder spills over", ProRataPolicy{LotSize: 10, MinFill: 90}, 250, []Size{100, 30, 120}},
+		{"exact shares", ProRataPolicy{LotSize: 10}, 300, []Size{50, 100, 150}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ob := NewOrderbook(WithMatchPolicy(tt.policy))
+			resting := []*Order{NewOrder(false, 100), NewOrder(false, 200), NewOrder(false, 300)}
+			for _, o := range resting {
+				ob.PlaceLimitOrder(100, o)
+			}
+
+			matches, err := ob.PlaceMarketOrder(NewOrder(true, tt.size))
+			assert(t, err, nil)
+			fills := []Size{}
+			for _, m := range matches {
+				fills = append(fills, m.SizeFilled)
+			}
+			assert(t, fills, tt.fills)
+			assert(t, ob.AskTotalVolume(), 600-tt.size)
+			assert(t, ob.Validate(), nil)
+		})
+	}
+}
+
+func TestProRataPolicyFillsWholeLevel(t *testing.T) {
+	ob := NewOrderbook(WithMatchPolicy(ProRataPolicy{LotSize: 1}))
+	ob.PlaceLimitOrder(100, NewOrder(false, 10))
+	ob.PlaceLimitOrder(100, NewOrder(false, 20))
+	ob.PlaceLimitOrder(110, NewOrder(false, 5))
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 32))
+	assert(t, err, nil)
+	assert(t, len(matches), 3)
+	assert(t, matches[2].Price, Price(110))
+	assert(t, matches[2].SizeFilled, Size(2))
+	assert(t, len(ob.Asks()), 1)
+	assert(t, ob.Validate(), nil)
+}
+
+func TestWalk(t *testing.T) {
+	ob := NewOrderbook()
+	askA := NewOrder(false, 1)
+	askB := NewOrder(false, 2)
+	askC := NewOrder(false, 3)
+	ob.PlaceLimitOrder(110, askA)
+	ob.PlaceLimitOrder(100, askB)
+	ob.PlaceLimitOrder(110, askC)
+	ob.PlaceLimitOrder(90, NewOrder(true, 4))
+	ob.PlaceLimitOrder(95, NewOrder(true, 5))
+
+	levels := []LimitView{}
+	ob.WalkLimits(SideAsk, func(l LimitView) bool {
+		levels = append(levels, l)
+		return true
+	})
+	assert(t, levels, []LimitView{{Price: 100, TotalVolume: 2, Orders: 1}, {Price: 110, TotalVolume: 4, Orders: 2}})
+
+	prices := []Price{}
+	ob.WalkLimits(SideBid, func(l LimitView) bool {
+		prices = append(prices, l.Price)
+		return true
+	})
+	assert(t, prices, []Price{95, 90})
+
+	orders := []OrderView{}
+	ob.WalkOrders(SideAsk, func(o OrderView) bool {
+		orders = append(orders, o)
+		return true
+	})
+	assert(t, orders, []OrderView{
+		{Price: 100, Size: 2, OriginalSize: 2, Timestamp: askB.Timestamp, Position: 0},
+		{Price: 110, Size: 1, OriginalSize: 1, Timestamp: askA.Timestamp, Position: 0},
+		{Price: 110, Size: 3, OriginalSize: 3, Timestamp: askC.Timestamp, Position: 1},
+	})
+
+	// early termination
+	visited := 0
+	ob.WalkOrders(SideAsk, func(o OrderView) bool {
+		visited++
+		return visited < 2
+	})
+	assert(t, visited, 2)
+}
+
+func TestQueuePosition(t *testing.T) {
+	ob := NewOrderbook()
+	first := NewOrder(false, 1)
+	second := NewOrder(false, 2)
+	third := NewOrder(false, 3)
+	for _, o := range []*Order{first, second, third} {
+		ob.PlaceLimitOrder(100, o)
+	}
+	ob.PlaceLimitOrder(110, NewOrder(false, 5))
+
+	position, ahead, err := ob.QueuePosition(third.ID)
+	assert(t, err, nil)
+	assert(t, position, 2)
+	assert(t, ahead, Size(3))
+
+	ob.CancelOrder(first)
+	position, ahead, _ = ob.QueuePosition(second.ID)
+	assert(t, position, 0)
+	assert(t, ahead, Size(0))
+	position, ahead, _ = ob.QueuePosition(third.ID)
+	assert(t, position, 1)
+	assert(t, ahead, Size(2))
+	_, _, err = ob.QueuePosition(first.ID)
+	assert(t, err, ErrOrderNotFound)
+
+	// a frozen order keeps its place but nothing fills against it
+	ob.FreezeOrder(second.ID)
+	position, ahead, _ = ob.QueuePosition(third.ID)
+	assert(t, position, 1)
+	assert(t, ahead, Size(0))
+
+	var queue []QueueView
+	ob.WalkLevel(SideAsk, 100, func(o QueueView) bool {
+		queue = append(queue, o)
+		return true
+	})
+	assert(t, len(queue), 2)
+	assert(t, queue[0].ID, second.ID)
+	assert(t, queue[0].Frozen, true)
+	assert(t, queue[1].ID, third.ID)
+	assert(t, queue[1].Position, 1)
+	assert(t, queue[1].SizeAhead, Size(0))
+
+	visited := 0
+	ob.WalkLevel(SideBid, 100, func(o QueueView) bool {
+		visited++
+		return true
+	})
+	assert(t, visited, 0)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1))
+	ob.PlaceLimitOrder(100, NewOrder(false, 2))
+	ob.PlaceLimitOrder(110, NewOrder(false, 3))
+	bid := NewOrder(true, 4)
+	bid.Metadata = map[string]string{"ref": "7"}
+	ob.PlaceLimitOrder(90, bid)
+
+	data, err := json.Marshal(ob)
+	assert(t, err, nil)
+
+	var restored Orderbook
+	assert(t, json.Unmarshal(data, &restored), nil)
+	assert(t, restored.Checksum(), ob.Checksum())
+	assert(t, restored.Validate(), nil)
+	assert(t, restored.Sequence() > ob.Sequence(), true)
+	assert(t, restored.Bids()[0].Orders[0].Metadata, map[string]string{"ref": "7"})
+	assert(t, restored.Export().Asks, ob.Export().Asks)
+
+	// loading over resting orders is refused
+	assert(t, restored.Import(ob.Export()) != nil, true)
+
+	crossed := Snapshot{
+		Asks: []SnapshotLevel{{Price: 100, Orders: []SnapshotOrder{{Size: 1}}}},
+		Bids: []SnapshotLevel{{Price: 100, Orders: []SnapshotOrder{{Size: 1}}}},
+	}
+	assert(t, NewOrderbook().Import(crossed) != nil, true)
+}
+
+func TestStats(t *testing.T) {
+	ob := NewOrderbook()
+	sellOrderA := NewOrder(false, 2)
+	sellOrderB := NewOrder(false, 3)
+	ob.PlaceLimitOrder(100, sellOrderA)
+	ob.PlaceLimitOrder(100, sellOrderB)
+	ob.PlaceLimitOrder(110, NewOrder(false, 4))
+	buyOrder := NewOrder(true, 1)
+	ob.PlaceLimitOrder(90, buyOrder)
+
+	// fills sellOrderA and part of sellOrderB
+	ob.PlaceMarketOrder(NewOrder(true, 3))
+	ob.CancelOrder(buyOrder)
+
+	stats := ob.Stats()
+	assert(t, stats.AskOrders, 2)
+	assert(t, stats.BidOrders, 0)
+	assert(t, stats.AskLevels, 2)
+	assert(t, stats.BidLevels, 0)
+	assert(t, stats.AskVolume, Size(6))
+	assert(t, stats.BidVolume, Size(0))
+	assert(t, stats.OrdersPlaced, uint64(5))
+	assert(t, stats.OrdersCancelled, uint64(1))
+	assert(t, stats.OrdersMatched, uint64(2))
+	assert(t, stats.TradesLastMinute, uint64(2))
+	assert(t, stats.Sequence, ob.Sequence())
+	assert(t, stats.OldestOrderAge > 0, true)
+	assert(t, stats.MemoryBytes > 0, true)
+	assert(t, ob.Validate(), nil)
+
+	ob.Reset()
+	stats = ob.Stats()
+	assert(t, stats.AskOrders, 0)
+	assert(t, stats.OldestOrderAge, time.Duration(0))
+	assert(t, stats.MemoryBytes, uintptr(0))
+}
+
+func TestStatsClock(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	ob := NewOrderbook(WithClock(clk))
+
+	sellOrder := NewOrder(false, 5)
+	ob.PlaceLimitOrder(100, sellOrder)
+	assert(t, sellOrder.Timestamp, start.UnixNano())
+
+	ob.PlaceMarketOrder(NewOrder(true, 1))
+	clk.Advance(30 * time.Second)
+	ob.PlaceMarketOrder(NewOrder(true, 1))
+
+	stats := ob.Stats()
+	assert(t, stats.TradesLastMinute, uint64(2))
+	assert(t, stats.OldestOrderAge, 30*time.Second)
+
+	// the first trade rolls out of the window a minute after it happened
+	clk.Advance(30 * time.Second)
+	assert(t, ob.Stats().TradesLastMinute, uint64(1))
+	clk.Advance(30 * time.Second)
+	assert(t, ob.Stats().TradesLastMinute, uint64(0))
+	assert(t, ob.Stats().OldestOrderAge, 90*time.Second)
+}
+
+func TestOriginalSize(t *testing.T) {
+	ob := NewOrderbook()
+	sellOrder := NewOrder(false, 10)
+	ob.PlaceLimitOrder(100, sellOrder)
+	assert(t, sellOrder.OriginalSize, Size(10))
+	assert(t, sellOrder.FilledSize(), Size(0))
+
+	ob.PlaceMarketOrder(NewOrder(true, 3))
+	assert(t, sellOrder.OriginalSize, Size(10))
+	assert(t, sellOrder.Size, Size(7))
+	assert(t, sellOrder.FilledSize(), Size(3))
+	assert(t, ob.AskTotalVolume(), Size(7))
+
+	buyOrder := NewOrder(true, 9)
+	ob.PlaceLimitOrder(100, buyOrder)
+	assert(t, sellOrder.Size, Size(0))
+	assert(t, sellOrder.FilledSize(), Size(10))
+	assert(t, buyOrder.OriginalSize, Size(9))
+	assert(t, buyOrder.Size, Size(2))
+	assert(t, buyOrder.FilledSize(), Size(7))
+
+	// the remainder of the crossing order rests with its original size intact
+	assert(t, ob.Bids()[0].Orders[0].OriginalSize, Size(9))
+	assert(t, ob.BidTotalVolume(), Size(2))
+
+	restored := NewOrderbook()
+	assert(t, restored.Import(ob.Export()), nil)
+	assert(t, restored.Bids()[0].Orders[0].OriginalSize, Size(9))
+	assert(t, restored.Bids()[0].Orders[0].FilledSize(), Size(7))
+}
+
+func TestCancelRange(t *testing.T) {
+	ob := NewOrderbook()
+	owned := func(owner string, bid bool, size Size) *Order {
+		o := NewOrder(bid, size)
+		o.Metadata = map[string]string{"owner": owner}
+		return o
+	}
+
+	mine := []*Order{}
+	for _, price := range []Price{2050, 2100, 2150, 2200, 2250} {
+		o := owned("mm", false, 1)
+		mine = append(mine, o)
+		ob.PlaceLimitOrder(price, o)
+	}
+	other := owned("other", false, 2)
+	ob.PlaceLimitOrder(2150, other)
+	ob.PlaceLimitOrder(2000, owned("mm", true, 1))
+
+	isMine := func(o *Order) bool { return o.Metadata["owner"] == "mm" }
+	cancelled := ob.CancelRange(SideAsk, 2100, 2200, isMine)
+	assert(t, cancelled, []*Order{mine[1], mine[2], mine[3]})
+
+	// out of range and other owners' orders survive, emptied levels go
+	prices := []Price{}
+	for _, limit := range ob.Asks() {
+		prices = append(prices, limit.Price)
+	}
+	assert(t, prices, []Price{2050, 2150, 2250})
+	assert(t, ob.AskLimits[2150].Orders, Orders{other})
+	assert(t, ob.BidTotalVolume(), Size(1))
+	assert(t, ob.Validate(), nil)
+
+	assert(t, ob.CancelRange(SideAsk, 2300, 2400, isMine), []*Order{})
+	assert(t, ob.CancelRange(SideAsk, 2200, 2100, nil), []*Order{})
+
+	cancelled = ob.CancelRange(SideBid, 1900, 2000, nil)
+	assert(t, len(cancelled), 1)
+	assert(t, len(ob.Bids()), 0)
+}
+
+func TestReduceOrder(t *testing.T) {
+	ob := NewOrderbook()
+	orderA := NewOrder(false, 5)
+	orderB := NewOrder(false, 3)
+	ob.PlaceLimitOrder(100, orderA)
+	ob.PlaceLimitOrder(100, orderB)
+
+	// shrinking below the next order's size keeps the head of the queue
+	seq := ob.Sequence()
+	assert(t, ob.ReduceOrder(orderA, 2), nil)
+	assert(t, ob.Sequence(), seq+1)
+	assert(t, orderA.Size, Size(2))
+	assert(t, orderA.OriginalSize, Size(2))
+	assert(t, orderA.FilledSize(), Size(0))
+	assert(t, ob.AskLimits[100].TotalVolume, Size(5))
+	assert(t, ob.AskLimits[100].Orders, Orders{orderA, orderB})
+
+	assert(t, ob.ReduceOrder(orderA, 3) != nil, true)
+	assert(t, ob.ReduceOrder(orderA, -1) != nil, true)
+	assert(t, ob.Validate(), nil)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 3))
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Ask, orderA)
+	assert(t, matches[1].Ask, orderB)
+
+	// reducing to zero is a cancel, emptied level included
+	assert(t, ob.ReduceOrder(orderB, 0), nil)
+	assert(t, orderB.Limit, (*Limit)(nil))
+	assert(t, len(ob.Asks()), 0)
+	assert(t, ob.Stats().OrdersCancelled, uint64(1))
+	assert(t, ob.Validate(), nil)
+	assert(t, ob.ReduceOrder(orderB, 0) != nil, true)
+}
+
+func TestOrderIDs(t *testing.T) {
+	ob, other := NewOrderbook(), NewOrderbook()
+	orderA := NewOrder(false, 2)
+	orderB := NewOrder(false, 1)
+	orderC := NewOrder(true, 1)
+	ob.PlaceLimitOrder(100, orderA)
+	ob.PlaceLimitOrder(101, orderB)
+	other.PlaceLimitOrder(100, orderC)
+
+	// IDs are unique across books
+	assert(t, orderA.ID != 0, true)
+	assert(t, orderB.ID != orderA.ID, true)
+	assert(t, orderC.ID != orderA.ID && orderC.ID != orderB.ID, true)
+
+	got, ok := ob.GetOrder(orderA.ID)
+	assert(t, ok, true)
+	assert(t, got, orderA)
+	_, ok = ob.GetOrder(orderC.ID)
+	assert(t, ok, false)
+
+	// a partial fill stays indexed, a full one doesn't
+	ob.PlaceMarketOrder(NewOrder(true, 1))
+	_, ok = ob.GetOrder(orderA.ID)
+	assert(t, ok, true)
+	ob.PlaceMarketOrder(NewOrder(true, 1))
+	_, ok = ob.GetOrder(orderA.ID)
+	assert(t, ok, false)
+	assert(t, ob.Validate(), nil)
+
+	// IDs survive a round trip, and new orders don't reuse them
+	restored := NewOrderbook()
+	assert(t, restored.Import(ob.Export()), nil)
+	got, ok = restored.GetOrder(orderB.ID)
+	assert(t, ok, true)
+	assert(t, got.Size, Size(1))
+	assert(t, restored.Validate(), nil)
+	later := NewOrder(true, 1)
+	restored.PlaceLimitOrder(90, later)
+	assert(t, later.ID > orderC.ID, true)
+
+	cancelled, err := ob.CancelOrderByID(orderB.ID)
+	assert(t, err, nil)
+	assert(t, cancelled, orderB)
+	assert(t, len(ob.Asks()), 0)
+	assert(t, ob.Validate(), nil)
+	_, err = ob.CancelOrderByID(orderB.ID)
+	assert(t, err, ErrOrderNotFound)
+
+	duplicate := Snapshot{Asks: []SnapshotLevel{
+		{Price: 100, Orders: []SnapshotOrder{{ID: 7, Size: 1}}},
+		{Price: 101, Orders: []SnapshotOrder{{ID: 7, Size: 1}}},
+	}}
+	assert(t, NewOrderbook().Import(duplicate) != nil, true)
+}
+
+func TestSizesDoNotDrift(t *testing.T) {
+	ob := NewOrderbook()
+	sz := DefaultScale.SizeOf
+	ob.PlaceLimitOrder(100, NewOrder(false, sz(0.1)))
+	ob.PlaceLimitOrder(100, NewOrder(false, sz(0.2)))
+	assert(t, ob.AskLimits[100].TotalVolume, sz(0.3))
+
+	// in floats 0.3 - 0.1 leaves a hair under 0.2, and the second order
+	// would keep a dust remainder resting
+	taker := NewOrder(true, sz(0.3))
+	matches, err := ob.PlaceMarketOrder(taker)
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, taker.IsFilled(), true)
+	assert(t, matches[1].Ask.IsFilled(), true)
+	assert(t, len(ob.Asks()), 0)
+	assert(t, ob.Validate(), nil)
+
+	// many small fills still add up to the level's volume exactly
+	ob.PlaceLimitOrder(100, NewOrder(false, sz(1)))
+	for i := 0; i < 7; i++ {
+		ob.PlaceMarketOrder(NewOrder(true, sz(0.1)))
+	}
+	assert(t, ob.AskLimits[100].TotalVolume, sz(0.3))
+	assert(t, ob.AskLimits[100].Orders[0].Size, sz(0.3))
+	assert(t, ob.Validate(), nil)
+}
+
+func TestImmediateOrCancel(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1))
+
+	o := NewOrder(true, 3)
+	o.TimeInForce = ImmediateOrCancel
+	matches := ob.PlaceLimitOrder(101, o)
+	assert(t, len(matches), 1)
+	assert(t, o.Size, Size(2))
+	assert(t, o.Limit, (*Limit)(nil))
+	assert(t, len(ob.Bids()), 0)
+	_, ok := ob.GetOrder(o.ID)
+	assert(t, ok, false)
+	assert(t, ob.Validate(), nil)
+
+	// one that doesn't cross is dropped whole
+	o = NewOrder(false, 1)
+	o.TimeInForce = ImmediateOrCancel
+	assert(t, len(ob.PlaceLimitOrder(105, o)), 0)
+	assert(t, len(ob.Asks()), 0)
+}
+
+func TestFillOrKill(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 10))
+	ob.PlaceLimitOrder(101, NewOrder(false, 10))
+	ob.PlaceLimitOrder(103, NewOrder(false, 50))
+
+	// two levels are within the limit, but not enough of them
+	assert(t, ob.Fillable(true, 101, 20), true)
+	assert(t, ob.Fillable(true, 101, 25), false)
+	seq, placed := ob.Sequence(), ob.Stats().OrdersPlaced
+	o := NewOrder(true, 25)
+	o.TimeInForce = FillOrKill
+	assert(t, len(ob.PlaceLimitOrder(101, o)), 0)
+	assert(t, o.Size, Size(25))
+	assert(t, o.Limit, (*Limit)(nil))
+	assert(t, ob.Sequence(), seq)
+	assert(t, ob.Stats().OrdersPlaced, placed)
+	assert(t, ob.AskTotalVolume(), Size(70))
+
+	o = NewOrder(true, 25)
+	o.TimeInForce = FillOrKill
+	matches := ob.PlaceLimitOrder(103, o)
+	assert(t, len(matches), 3)
+	assert(t, o.IsFilled(), true)
+	assert(t, ob.AskTotalVolume(), Size(45))
+	assert(t, ob.Validate(), nil)
+
+	// nothing fills on entry during an auction
+	ob.StartAuction()
+	assert(t, ob.Fillable(true, 103, 10), false)
+}
+
+func TestExpireOrders(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewFake(start)
+	ob := NewOrderbook(WithClock(clk))
+
+	gtd := func(price Price, ttl time.Duration) *Order {
+		o := NewOrder(false, 1)
+		o.TimeInForce = GoodTillDate
+		o.ExpiresAt = start.Add(ttl).UnixNano()
+		ob.PlaceLimitOrder(price, o)
+		return o
+	}
+	late := gtd(101, 2*time.Minute)
+	early := gtd(102, time.Minute)
+	filled := gtd(100, 30*time.Second)
+	ob.PlaceLimitOrder(103, NewOrder(false, 1))
+
+	// a filled order no longer counts towards the next expiry
+	ob.PlaceMarketOrder(NewOrder(true, 1))
+	assert(t, filled.IsFilled(), true)
+	next, ok := ob.NextExpiry()
+	assert(t, ok, true)
+	assert(t, next, early.ExpiresAt)
+
+	assert(t, len(ob.ExpireOrders()), 0)
+	clk.Advance(time.Minute)
+	expired := ob.ExpireOrders()
+	assert(t, len(expired), 1)
+	assert(t, expired[0], early)
+	_, ok = ob.GetOrder(early.ID)
+	assert(t, ok, false)
+
+	// expiry survives a snapshot round trip
+	restored := NewOrderbook(WithClock(clk))
+	assert(t, restored.Import(ob.Export()), nil)
+	clk.Advance(time.Minute)
+	expired = restored.ExpireOrders()
+	assert(t, len(expired), 1)
+	assert(t, expired[0].ID, late.ID)
+	assert(t, expired[0].TimeInForce, GoodTillDate)
+	_, ok = restored.NextExpiry()
+	assert(t, ok, false)
+	assert(t, len(restored.Asks()), 1)
+	assert(t, restored.Validate(), nil)
+}
+
+func TestIceberg(t *testing.T) {
+	ob := NewOrderbook()
+	iceberg := NewOrder(false, 10)
+	iceberg.DisplaySize = 2
+	ob.PlaceLimitOrder(100, iceberg)
+	behind := NewOrder(false, 1)
+	ob.PlaceLimitOrder(100, behind)
+
+	// only the displayed tranche shows, but all of it can be matched
+	assert(t, iceberg.Size, Size(2))
+	assert(t, iceberg.Hidden, Size(8))
+	assert(t, ob.AskTotalVolume(), Size(3))
+	assert(t, ob.MatchableVolume(true, 100), Size(11))
+	ob.WalkOrders(SideAsk, func(o OrderView) bool {
+		assert(t, o.OriginalSize, o.Size)
+		return true
+	})
+	restored := NewOrderbook()
+	assert(t, restored.Import(ob.Export()), nil)
+	assert(t, restored.Asks()[0].Orders[0].Hidden, Size(8))
+	assert(t, restored.Validate(), nil)
+
+	// the next tranche goes to the back of the queue
+	ob.PlaceMarketOrder(NewOrder(true, 2))
+	assert(t, iceberg.Size, Size(2))
+	assert(t, iceberg.Hidden, Size(6))
+	matches, _ := ob.PlaceMarketOrder(NewOrder(true, 1))
+	assert(t, matches[0].Ask, behind)
+	assert(t, ob.Validate(), nil)
+
+	// a sweep keeps filling against the level as it replenishes
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 7))
+	assert(t, err, nil)
+	assert(t, len(matches), 4)
+	assert(t, iceberg.Size, Size(1))
+	assert(t, iceberg.Hidden, Size(0))
+	assert(t, iceberg.FilledSize(), Size(9))
+	assert(t, ob.AskTotalVolume(), Size(1))
+	assert(t, ob.Validate(), nil)
+
+	// reducing takes from the hidden part first
+	iceberg = NewOrder(false, 50)
+	iceberg.DisplaySize = 10
+	ob.PlaceLimitOrder(101, iceberg)
+	assert(t, ob.ReduceOrder(iceberg, 30), nil)
+	assert(t, iceberg.Size, Size(10))
+	assert(t, iceberg.Hidden, Size(20))
+	assert(t, ob.ReduceOrder(iceberg, 5), nil)
+	assert(t, iceberg.Size, Size(5))
+	assert(t, iceberg.Hidden, Size(0))
+	assert(t, ob.Validate(), nil)
+}
+
+func TestFreezeOrder(t *testing.T) {
+	ob := NewOrderbook()
+	frozen := NewOrder(false, 2)
+	ob.PlaceLimitOrder(100, frozen)
+	behind := NewOrder(false, 1)
+	ob.PlaceLimitOrder(100, behind)
+	ob.PlaceLimitOrder(101, NewOrder(false, 3))
+
+	_, err := ob.FreezeOrder(12345)
+	assert(t, err, ErrOrderNotFound)
+	_, err = ob.FreezeOrder(frozen.ID)
+	assert(t, err, nil)
+	assert(t, frozen.Frozen, true)
+
+	// it still shows, but none of it can be filled
+	assert(t, ob.AskTotalVolume(), Size(6))
+	assert(t, ob.MatchableVolume(true, 100), Size(1))
+	assert(t, ob.Fillable(true, 101, 5), false)
+	_, err = ob.PlaceMarketOrder(NewOrder(true, 5))
+	assert(t, errors.Is(err, ErrInsufficientLiquidity), true)
+
+	// a sweep passes over it, keeping its level and its place
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 2))
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Ask, behind)
+	assert(t, matches[1].Price, Price(101))
+	assert(t, frozen.Size, Size(2))
+	assert(t, ob.Asks()[0].Orders[0], frozen)
+	assert(t, ob.Validate(), nil)
+
+	// an order can rest through a level holding only frozen orders
+	bid := NewOrder(true, 1)
+	assert(t, len(ob.PlaceLimitOrder(100, bid)), 0)
+	assert(t, bid.Limit != nil, true)
+	assert(t, ob.Validate(), nil)
+	restored := NewOrderbook()
+	assert(t, restored.Import(ob.Export()), nil)
+	assert(t, restored.Asks()[0].Orders[0].Frozen, true)
+	assert(t, restored.Validate(), nil)
+
+	// it leaves the book as any other order does
+	ob.CancelOrder(frozen)
+	assert(t, ob.MatchableVolume(true, 101), Size(2))
+	assert(t, ob.Validate(), nil)
+}
+
+func TestSizeForNotional(t *testing.T) {
+	scale := Scale{Price: 0, Size: 8}
+	sz := scale.SizeOf
+	ob := NewOrderbook(WithScale(scale))
+	ob.PlaceLimitOrder(100, NewOrder(false, sz(1)))
+	ob.PlaceLimitOrder(110, NewOrder(false, sz(2)))
+	ob.PlaceLimitOrder(90, NewOrder(true, sz(3)))
+
+	for _, tt := range []struct {
+		bid      bool
+		notional float64
+		size     Size
+		ok       bool
+	}{
+		{true, 100, sz(1), true},
+		{true, 155, sz(1.5), true},
+		// rounded down to what the notional can pay for
+		{true, 100 + 100.0/3, sz(1.3030303), true},
+		{true, 1000, sz(3), false},
+		{false, 45, sz(0.5), true},
+	} {
+		size, ok := ob.SizeForNotional(tt.bid, tt.notional)
+		assert(t, size, tt.size)
+		assert(t, ok, tt.ok)
+	}
+}
+
+func TestNotionalForSize(t *testing.T) {
+	scale := Scale{Price: 0, Size: 8}
+	sz := scale.SizeOf
+	ob := NewOrderbook(WithScale(scale))
+	ob.PlaceLimitOrder(100, NewOrder(false, sz(1)))
+	ob.PlaceLimitOrder(110, NewOrder(false, sz(2)))
+	ob.PlaceLimitOrder(90, NewOrder(true, sz(3)))
+
+	for _, tt := range []struct {
+		bid      bool
+		size     Size
+		notional float64
+		ok       bool
+	}{
+		{true, sz(1), 100, true},
+		{true, sz(1.5), 155, true},
+		{true, sz(4), 320, false},
+		{false, sz(0.5), 45, true},
+	} {
+		notional, ok := ob.NotionalForSize(tt.bid, tt.size)
+		assert(t, notional, tt.notional)
+		assert(t, ok, tt.ok)
+	}
+}
+
+func TestPlaceProtectedMarketOrder(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1))
+	ob.PlaceLimitOrder(101, NewOrder(false, 1))
+	ob.PlaceLimitOrder(105, NewOrder(false, 5))
+
+	// fills up to the bound and drops the rest
+	o := NewOrder(true, 4)
+	matches, err := ob.PlaceProtectedMarketOrder(o, 102)
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, o.Size, Size(2))
+	assert(t, o.Price, Price(0))
+	assert(t, o.Limit, (*Limit)(nil))
+	assert(t, len(ob.Bids()), 0)
+	assert(t, ob.AskTotalVolume(), Size(5))
+	assert(t, ob.Validate(), nil)
+
+	ob.StartAuction()
+	_, err = ob.PlaceProtectedMarketOrder(NewOrder(true, 1), 110)
+	assert(t, err, ErrAuctionInProgress)
+}
+
+func TestModifyOrder(t *testing.T) {
+	ob := NewOrderbook()
+	a, b := NewOrder(false, 2), NewOrder(false, 1)
+	ob.PlaceLimitOrder(100, a)
+	ob.PlaceLimitOrder(100, b)
+	ob.PlaceLimitOrder(99, NewOrder(true, 1))
+
+	// a reduction keeps the order's place
+	matches, err := ob.ModifyOrder(a.ID, 100, 1)
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, ob.Asks()[0].Orders[0], a)
+	assert(t, a.Size, Size(1))
+
+	// an increase sends it to the back under the same ID
+	id := a.ID
+	_, err = ob.ModifyOrder(a.ID, 100, 3)
+	assert(t, err, nil)
+	assert(t, ob.Asks()[0].Orders[0], b)
+	assert(t, ob.Asks()[0].Orders[1], a)
+	assert(t, a.ID, id)
+	assert(t, a.Size, Size(3))
+	assert(t, ob.AskTotalVolume(), Size(4))
+
+	// a new price that crosses matches like a new order
+	matches, err = ob.ModifyOrder(b.ID, 99, 1)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, b.IsFilled(), true)
+	_, ok := ob.GetOrder(b.ID)
+	assert(t, ok, false)
+	assert(t, ob.Validate(), nil)
+
+	_, err = ob.ModifyOrder(b.ID, 99, 1)
+	assert(t, err, ErrOrderNotFound)
+	_, err = ob.ModifyOrder(a.ID, 100, 0)
+	assert(t, err != nil, true)
+}
+
+func TestFillsExecuteAtRestingPrice(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(2000, NewOrder(false, 1))
+	ob.PlaceLimitOrder(2050, NewOrder(false, 1))
+	ob.PlaceLimitOrder(2100, NewOrder(false, 1))
+
+	matches := ob.PlaceLimitOrder(2100, NewOrder(true, 3))
+	assert(t, len(matches), 3)
+	for i, price := range []Price{2000, 2050, 2100} {
+		assert(t, matches[i].Price, price)
+	}
+	assert(t, AveragePrice(matches), Price(2050))
+
+	ob.PlaceLimitOrder(1900, NewOrder(true, 2))
+	ob.PlaceLimitOrder(1950, NewOrder(true, 2))
+	matches = ob.PlaceLimitOrder(1800, NewOrder(false, 3))
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Price, Price(1950))
+	assert(t, matches[1].Price, Price(1900))
+	// 1933.33 rounds to the nearest whole unit
+	assert(t, AveragePrice(matches), Price(1933))
+	assert(t, AveragePrice(nil), Price(0))
+}
+
+func TestSummarizeSweep(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(10000, NewOrder(false, 1))
+	ob.PlaceLimitOrder(10000, NewOrder(false, 2))
+	ob.PlaceLimitOrder(10100, NewOrder(false, 1))
+	ob.PlaceLimitOrder(10200, NewOrder(false, 2))
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 5))
+	assert(t, err, nil)
+	assert(t, len(matches), 4)
+
+	ex := Summarize(matches)
+	assert(t, ex.Levels, []LevelFill{
+		{Price: 10000, Size: 3, CumulativeSize: 3, AveragePrice: 10000},
+		{Price: 10100, Size: 1, CumulativeSize: 4, AveragePrice: 10025},
+		{Price: 10200, Size: 1, CumulativeSize: 5, AveragePrice: 10060},
+	})
+	assert(t, ex.Size, Size(5))
+	assert(t, ex.AveragePrice, Price(10060))
+	assert(t, ex.WorstPrice, Price(10200))
+	assert(t, Summarize(nil), Execution{})
+}
+
+func TestScale(t *testing.T) {
+	scale := Scale{Price: 2, Size: 8}
+	for _, tt := range []struct {
+		in    string
+		price Price
+		err   bool
+	}{
+		{"2000.25", 200025, false},
+		{"2000", 200000, false},
+		{"2e3", 200000, false},
+		{"0.1", 10, false},
+		{"2000.255", 0, true},
+		{"1/3", 0, true},
+		{"0x10", 0, true},
+		{"1e30", 0, true},
+	} {
+		price, err := scale.ParsePrice(tt.in)
+		assert(t, err != nil, tt.err)
+		assert(t, price, tt.price)
+	}
+	_, err := scale.ParsePrice("0.001")
+	assert(t, errors.Is(err, ErrPrecision), true)
+
+	size, err := scale.ParseSize("0.00000001")
+	assert(t, err, nil)
+	assert(t, size, Size(1))
+
+	assert(t, scale.FormatPrice(200025, 2), "2000.25")
+	assert(t, scale.FormatPrice(200025, 1), "2000.3")
+	assert(t, scale.FormatPrice(-200025, 1), "-2000.3")
+	assert(t, scale.FormatPrice(5, 4), "0.0500")
+	assert(t, scale.FormatSize(150000000, 0), "2")
+	assert(t, scale.FormatSize(1, 8), "0.00000001")
+	assert(t, scale.Notional(200025, 200000000), 4000.5)
+
+	assert(t, Places(1_000_000, 8), 2)
+	assert(t, Places(1, 8), 8)
+	assert(t, Places(100, 2), 0)
+	assert(t, Scale{Price: -1}.Validate() != nil, true)
+	assert(t, Scale{Price: MaxScale, Size: MaxScale}.Validate(), nil)
+}
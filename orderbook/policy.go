@@ -0,0 +1,76 @@
+package orderbook
+
+import "math/bits"
+
+// MatchPolicy decides how an incoming order's size is distributed across the
+// resting orders of a price level. Implementations append the resulting
+// matches, keep the level's TotalVolume in step, and remove resting orders
+// that become fully filled.
+type MatchPolicy interface {
+	Fill(l *Limit, o *Order, matches []Match) []Match
+}
+
+// FIFOPolicy fills resting orders strictly in time priority.
+type FIFOPolicy struct{}
+
+func (FIFOPolicy) Fill(l *Limit, o *Order, matches []Match) []Match {
+	return l.fill(o, matches)
+}
+
+// ProRataPolicy fills every resting order at the level that isn't frozen in
+// proportion to its size. Each proportional share is floored to LotSize and
+// dropped if below MinFill; the remainder then goes to resting orders in time
+// priority.
+// An incoming order at least as large as the level fills everything.
+type ProRataPolicy struct {
+	LotSize Size
+	MinFill Size
+}
+
+func (p ProRataPolicy) Fill(l *Limit, o *Order, matches []Match) []Match {
+	if o.Size >= l.shown() {
+		return l.fill(o, matches)
+	}
+
+	size, volume := uint64(o.Size), uint64(l.shown())
+	lot, minFill := uint64(max(p.LotSize, 0)), uint64(max(p.MinFill, 0))
+	allocs := make([]uint64, len(l.Orders))
+	allocated := uint64(0)
+	for i, order := range l.Orders {
+		if order.Frozen {
+			continue
+		}
+		// size < volume, so the quotient fits
+		hi, lo := bits.Mul64(size, uint64(order.Size))
+		share, _ := bits.Div64(hi, lo, volume)
+		if lot > 0 {
+			share -= share % lot
+		}
+		if share < minFill {
+			share = 0
+		}
+		allocs[i] = share
+		allocated += share
+	}
+
+	remainder := size - allocated
+	for i, order := range l.Orders {
+		if remainder == 0 {
+			break
+		}
+		if order.Frozen {
+			continue
+		}
+		extra := min(remainder, uint64(order.Size)-allocs[i])
+		allocs[i] += extra
+		remainder -= extra
+	}
+
+	for i, order := range l.Orders {
+		if allocs[i] > 0 {
+			matches = append(matches, l.fillSize(order, o, Size(allocs[i])))
+		}
+	}
+	l.removeFilled()
+	return matches
+}
@@ -0,0 +1,194 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Price is a price in fixed point: a whole number of 10^-Scale.Price of
+// the quote asset, in the scale of the market it is quoted in. Prices from
+// different markets are never compared, so the book doesn't need to know
+// what its units are worth except to value orders in the quote asset.
+type Price int64
+
+// Size is a size or volume in fixed point: a whole number of
+// 10^-Scale.Size of the base asset. The book's sums and differences of
+// sizes are exact, so level volumes always equal the sum of their orders and
+// a fully filled order is left with exactly zero.
+type Size int64
+
+// Scale is a market's precision, the decimal places its prices and sizes
+// are kept to. Prices and sizes are decimals only where they are read and
+// written for clients; everywhere in between they are whole numbers of the
+// smallest units the scale allows.
+type Scale struct {
+	Price int `json:"price"`
+	Size  int `json:"size"`
+}
+
+// DefaultScale is the scale of markets not given one: eight decimal places
+// for prices and sizes.
+var DefaultScale = Scale{Price: 8, Size: 8}
+
+// MaxScale is the most decimal places a price or a size may keep, so that
+// one whole unit of an asset still fits in a Price or a Size with room to
+// spare.
+const MaxScale = 12
+
+// Validate checks that both places are within [0, MaxScale].
+func (s Scale) Validate() error {
+	if s.Price < 0 || s.Price > MaxScale || s.Size < 0 || s.Size > MaxScale {
+		return fmt.Errorf("scale must keep between 0 and %d decimal places", MaxScale)
+	}
+	return nil
+}
+
+// ErrPrecision is returned for a decimal with more places than its scale
+// keeps.
+var ErrPrecision = errors.New("too many decimal places")
+
+// ParsePrice reads a decimal price, such as "2000.25", exactly.
+func (s Scale) ParsePrice(v string) (Price, error) {
+	units, err := parseDecimal(v, s.Price)
+	return Price(units), err
+}
+
+// ParseSize reads a decimal size exactly, as ParsePrice does a price.
+func (s Scale) ParseSize(v string) (Size, error) {
+	units, err := parseDecimal(v, s.Size)
+	return Size(units), err
+}
+
+// FormatPrice writes p as a decimal with places decimal places, rounding
+// half away from zero if that is fewer than the scale keeps.
+func (s Scale) FormatPrice(p Price, places int) string {
+	return formatDecimal(int64(p), s.Price, places)
+}
+
+// FormatSize writes z as a decimal, as FormatPrice does a price.
+func (s Scale) FormatSize(z Size, places int) string {
+	return formatDecimal(int64(z), s.Size, places)
+}
+
+// PriceString writes p with the places it needs, for messages and logs:
+// 2000.5 rather than 2000.50000000.
+func (s Scale) PriceString(p Price) string {
+	return trimDecimal(s.FormatPrice(p, s.Price))
+}
+
+// SizeString writes z with the places it needs, as PriceString does a price.
+func (s Scale) SizeString(z Size) string {
+	return trimDecimal(s.FormatSize(z, s.Size))
+}
+
+// PriceOf rounds v to the nearest Price, for prices worked out in floating
+// point, such as a mid price stepped away from by a fraction of it.
+func (s Scale) PriceOf(v float64) Price {
+	return Price(math.Round(v * math.Pow10(s.Price)))
+}
+
+// SizeOf rounds v to the nearest Size.
+func (s Scale) SizeOf(v float64) Size {
+	return Size(math.Round(v * math.Pow10(s.Size)))
+}
+
+// PriceValue is p in the quote asset, for amounts the ledger keeps.
+func (s Scale) PriceValue(p Price) float64 {
+	return float64(p) / math.Pow10(s.Price)
+}
+
+// SizeValue is z in the base asset, for amounts the ledger keeps.
+func (s Scale) SizeValue(z Size) float64 {
+	return float64(z) / math.Pow10(s.Size)
+}
+
+// Notional is z at p, in the quote asset. The product of the units overflows
+// an int64 well within the prices and sizes markets see, so it is taken in
+// floating point, as the ledger keeps it.
+func (s Scale) Notional(p Price, z Size) float64 {
+	return float64(p) * float64(z) / math.Pow10(s.Price+s.Size)
+}
+
+// Places is the decimal places step needs in the scale's units, for a
+// market's tick or lot: 0.01 needs 2.
+func Places(step int64, scale int) int {
+	places := scale
+	for places > 0 && step != 0 && step%10 == 0 {
+		step /= 10
+		places--
+	}
+	return places
+}
+
+// parseDecimal reads v, a decimal that may have an exponent as JSON numbers
+// can, as a whole number of 10^-places.
+func parseDecimal(v string, places int) (int64, error) {
+	// big.Rat reads fractions and other bases too, which aren't decimals
+	if strings.Trim(v, "0123456789.eE+-") != "" {
+		return 0, fmt.Errorf("invalid decimal %q", v)
+	}
+	r, ok := new(big.Rat).SetString(v)
+	if !ok {
+		return 0, fmt.Errorf("invalid decimal %q", v)
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil)))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%w in %s: at most %d allowed", ErrPrecision, v, places)
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("decimal %s is out of range", v)
+	}
+	return r.Num().Int64(), nil
+}
+
+// formatDecimal writes units of 10^-scale as a decimal with places decimal
+// places.
+func formatDecimal(units int64, scale, places int) string {
+	if places < scale {
+		div := int64(math.Pow10(scale - places))
+		half := div / 2
+		if units < 0 {
+			half = -half
+		}
+		units, scale = (units+half)/div, places
+	}
+	neg := units < 0
+	digits := strconv.FormatUint(absUnits(units), 10)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	s := digits[:len(digits)-scale]
+	if scale > 0 {
+		s += "." + digits[len(digits)-scale:]
+	}
+	if places > scale {
+		if scale == 0 {
+			s += "."
+		}
+		s += strings.Repeat("0", places-scale)
+	}
+	if neg && strings.Trim(s, "0.") != "" {
+		s = "-" + s
+	}
+	return s
+}
+
+// trimDecimal drops the trailing zeros of a decimal's fraction, and its
+// point if they were all it had.
+func trimDecimal(s string) string {
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+func absUnits(units int64) uint64 {
+	if units < 0 {
+		return uint64(-units)
+	}
+	return uint64(units)
+}
@@ -0,0 +1,333 @@
+// Package sim runs seeded, reproducible operation sequences against order
+// books, checking invariants after every step and diffing two books that are
+// fed the same trace. A failing run is shrunk to a minimal trace that still
+// reproduces the failure.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// Book is the surface of an order book the simulator drives. *orderbook.Orderbook
+// implements it; alternative implementations can be diffed against it.
+type Book interface {
+	PlaceLimitOrder(price orderbook.Price, o *orderbook.Order) []orderbook.Match
+	PlaceMarketOrder(o *orderbook.Order) ([]orderbook.Match, error)
+	CancelOrder(o *orderbook.Order)
+	ModifyOrder(id uint64, price orderbook.Price, size orderbook.Size) ([]orderbook.Match, error)
+	Asks() []*orderbook.Limit
+	Bids() []*orderbook.Limit
+	AskTotalVolume() orderbook.Size
+	BidTotalVolume() orderbook.Size
+	Validate() error
+}
+
+type OpKind string
+
+const (
+	OpLimit  OpKind = "LIMIT"
+	OpMarket OpKind = "MARKET"
+	OpCancel OpKind = "CANCEL"
+	OpAmend  OpKind = "AMEND"
+)
+
+// Op is a single step of a trace. Target is the ID of the limit op whose order
+// a cancel or an amend refers to; cancelling or amending an order that is no
+// longer resting is a no-op. An amend moves the order to Size at Price.
+type Op struct {
+	ID     int
+	Kind   OpKind
+	Bid    bool
+	Price  orderbook.Price
+	Size   orderbook.Size
+	Target int
+}
+
+func (op Op) String() string {
+	side := "ask"
+	if op.Bid {
+		side = "bid"
+	}
+	switch op.Kind {
+	case OpLimit:
+		return fmt.Sprintf("#%d limit %s %d @ %d", op.ID, side, op.Size, op.Price)
+	case OpMarket:
+		return fmt.Sprintf("#%d market %s %d", op.ID, side, op.Size)
+	case OpAmend:
+		return fmt.Sprintf("#%d amend #%d to %d @ %d", op.ID, op.Target, op.Size, op.Price)
+	default:
+		return fmt.Sprintf("#%d cancel #%d", op.ID, op.Target)
+	}
+}
+
+type Config struct {
+	// Seed makes the generated trace reproducible.
+	Seed int64
+	// Steps is the number of operations to generate.
+	Steps int
+	// MidPrice and Levels bound generated limit prices to
+	// MidPrice-Levels .. MidPrice+Levels.
+	MidPrice orderbook.Price
+	Levels   int
+	// MaxSize bounds generated order sizes, which are whole units.
+	MaxSize int
+
+	// NewBook builds the book under test.
+	NewBook func() Book
+	// NewReference optionally builds a second book fed the same trace; any
+	// difference in matches or resting state fails the run.
+	NewReference func() Book
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Steps == 0 {
+		cfg.Steps = 1000
+	}
+	if cfg.MidPrice == 0 {
+		cfg.MidPrice = 100
+	}
+	if cfg.Levels == 0 {
+		cfg.Levels = 10
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 10
+	}
+	if cfg.NewBook == nil {
+		cfg.NewBook = func() Book { return orderbook.NewOrderbook() }
+	}
+	return cfg
+}
+
+// Failure describes a failing run. Trace is the shrunk sequence of operations
+// that still reproduces the failure, ending at the failing step.
+type Failure struct {
+	Seed  int64
+	Step  int
+	Err   error
+	Trace []Op
+}
+
+func (f *Failure) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "seed %d failed at op #%d: %v\nminimal trace:", f.Seed, f.Step, f.Err)
+	for _, op := range f.Trace {
+		fmt.Fprintf(&b, "\n  %s", op)
+	}
+	return b.String()
+}
+
+// Run generates cfg.Steps operations from cfg.Seed and replays them. It
+// returns a *Failure with a minimal trace if an invariant breaks, a book
+// panics, or the reference book diverges.
+func Run(cfg Config) error {
+	cfg = cfg.withDefaults()
+	trace := Generate(cfg)
+
+	step, err := Replay(cfg, trace)
+	if err == nil {
+		return nil
+	}
+	trace = Shrink(cfg, trace[:step+1])
+	step, err = Replay(cfg, trace)
+	return &Failure{Seed: cfg.Seed, Step: trace[step].ID, Err: err, Trace: trace}
+}
+
+// Generate builds a trace from cfg.Seed. Market orders never exceed the
+// opposite side's resting volume, tracked with a shadow book.
+func Generate(cfg Config) []Op {
+	cfg = cfg.withDefaults()
+	r := rand.New(rand.NewSource(cfg.Seed))
+	shadow := orderbook.NewOrderbook()
+	orders := make(map[int]*orderbook.Order)
+	var limits []int
+
+	trace := make([]Op, 0, cfg.Steps)
+	for id := 0; id < cfg.Steps; id++ {
+		op := Op{ID: id, Bid: r.Intn(2) == 0, Size: orderbook.Size(1 + r.Intn(cfg.MaxSize))}
+
+		// bids lean below mid and asks above so the book stays two-sided
+		price := func(bid bool) orderbook.Price {
+			offset := orderbook.Price(r.Intn(cfg.Levels+1) - cfg.Levels/4)
+			if bid {
+				return cfg.MidPrice - offset
+			}
+			return cfg.MidPrice + offset
+		}
+		switch n := r.Intn(10); {
+		case n < 5:
+			op.Kind = OpLimit
+			op.Price = price(op.Bid)
+		case n < 7 && len(limits) > 0:
+			op.Kind = OpCancel
+			op.Target = limits[r.Intn(len(limits))]
+		case n < 8 && len(limits) > 0:
+			// on the target's side, so it may reprice through the book
+			op.Kind = OpAmend
+			op.Target = limits[r.Intn(len(limits))]
+			op.Bid = orders[op.Target].Bid
+			op.Price = price(op.Bid)
+		default:
+			op.Kind = OpMarket
+			volume := shadow.AskTotalVolume()
+			if !op.Bid {
+				volume = shadow.BidTotalVolume()
+			}
+			if volume < 1 {
+				op.Kind = OpLimit
+				op.Price = cfg.MidPrice
+				break
+			}
+			op.Size = min(op.Size, volume)
+		}
+
+		if op.Kind == OpLimit {
+			limits = append(limits, id)
+		}
+		apply(shadow, orders, op)
+		trace = append(trace, op)
+	}
+	return trace
+}
+
+// Replay applies trace to a fresh book (and reference, if configured),
+// validating after every step. It returns the index of the failing op.
+func Replay(cfg Config, trace []Op) (int, error) {
+	cfg = cfg.withDefaults()
+	book := newRun(cfg.NewBook())
+	var ref *run
+	if cfg.NewReference != nil {
+		ref = newRun(cfg.NewReference())
+	}
+
+	for i, op := range trace {
+		matches, err := book.step(op)
+		if err != nil {
+			return i, err
+		}
+		if err := book.book.Validate(); err != nil {
+			return i, err
+		}
+		if ref == nil {
+			continue
+		}
+
+		refMatches, err := ref.step(op)
+		if err != nil {
+			return i, fmt.Errorf("reference: %w", err)
+		}
+		if got, want := book.describeMatches(matches), ref.describeMatches(refMatches); got != want {
+			return i, fmt.Errorf("matches differ:\n  book: %s\n  ref:  %s", got, want)
+		}
+		if got, want := book.describeBook(), ref.describeBook(); got != want {
+			return i, fmt.Errorf("book state differs:\n  book: %s\n  ref:  %s", got, want)
+		}
+	}
+	return 0, nil
+}
+
+// Shrink removes operations from a failing trace one at a time for as long as
+// the trace keeps failing, returning a trace where every op is needed.
+func Shrink(cfg Config, trace []Op) []Op {
+	cfg = cfg.withDefaults()
+	for removed := true; removed; {
+		removed = false
+		for i := len(trace) - 1; i >= 0; i-- {
+			candidate := make([]Op, 0, len(trace)-1)
+			candidate = append(candidate, trace[:i]...)
+			candidate = append(candidate, trace[i+1:]...)
+			if step, err := Replay(cfg, candidate); err != nil {
+				trace = candidate[:step+1]
+				removed = true
+				break
+			}
+		}
+	}
+	return trace
+}
+
+// run tracks the orders a trace created on one book, so ops and matches can
+// be expressed in terms of op IDs rather than implementation pointers.
+type run struct {
+	book   Book
+	orders map[int]*orderbook.Order
+	ids    map[*orderbook.Order]int
+}
+
+func newRun(book Book) *run {
+	return &run{
+		book:   book,
+		orders: make(map[int]*orderbook.Order),
+		ids:    make(map[*orderbook.Order]int),
+	}
+}
+
+func (r *run) step(op Op) (matches []orderbook.Match, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic applying %s: %v", op, p)
+		}
+	}()
+
+	matches, err = apply(r.book, r.orders, op)
+	if errors.Is(err, orderbook.ErrInsufficientLiquidity) {
+		// a shrunk trace may no longer have the liquidity the op was
+		// generated against; the book refuses it and the op is skipped
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o, ok := r.orders[op.ID]; ok {
+		r.ids[o] = op.ID
+	}
+	return matches, nil
+}
+
+func apply(book Book, orders map[int]*orderbook.Order, op Op) ([]orderbook.Match, error) {
+	switch op.Kind {
+	case OpLimit:
+		o := orderbook.NewOrder(op.Bid, op.Size)
+		orders[op.ID] = o
+		return book.PlaceLimitOrder(op.Price, o), nil
+	case OpMarket:
+		o := orderbook.NewOrder(op.Bid, op.Size)
+		orders[op.ID] = o
+		return book.PlaceMarketOrder(o)
+	case OpCancel:
+		if o, ok := orders[op.Target]; ok && o.Limit != nil {
+			book.CancelOrder(o)
+		}
+	case OpAmend:
+		if o, ok := orders[op.Target]; ok && o.Limit != nil {
+			return book.ModifyOrder(o.ID, op.Price, op.Size)
+		}
+	}
+	return nil, nil
+}
+
+func (r *run) describeMatches(matches []orderbook.Match) string {
+	var b strings.Builder
+	for _, m := range matches {
+		fmt.Fprintf(&b, "[ask #%d bid #%d %d @ %d]", r.ids[m.Ask], r.ids[m.Bid], m.SizeFilled, m.Price)
+	}
+	return b.String()
+}
+
+func (r *run) describeBook() string {
+	var b strings.Builder
+	for _, side := range [][]*orderbook.Limit{r.book.Asks(), r.book.Bids()} {
+		b.WriteString("|")
+		for _, limit := range side {
+			fmt.Fprintf(&b, " %d:", limit.Price)
+			for _, o := range limit.Orders {
+				fmt.Fprintf(&b, " #%d=%d", r.ids[o], o.Size)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,148 @@
+package sim
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// leakyBook forgets to clear emptied levels on cancel.
+type leakyBook struct{ *orderbook.Orderbook }
+
+func (b leakyBook) CancelOrder(o *orderbook.Order) {
+	o.Limit.DeleteOrder(o)
+}
+
+// stickyBook ignores cancels entirely, which keeps it valid but divergent.
+type stickyBook struct{ *orderbook.Orderbook }
+
+func (b stickyBook) CancelOrder(o *orderbook.Order) {}
+
+// staleBook amends an order's size without the level's volume following.
+type staleBook struct{ *orderbook.Orderbook }
+
+func (b staleBook) ModifyOrder(id uint64, price orderbook.Price, size orderbook.Size) ([]orderbook.Match, error) {
+	if o, ok := b.GetOrder(id); ok {
+		o.Size = size
+	}
+	return nil, nil
+}
+
+func TestRunOrderbook(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		err := Run(Config{
+			Seed:         seed,
+			Steps:        500,
+			NewReference: func() Book { return orderbook.NewOrderbook() },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGenerateIsReproducible(t *testing.T) {
+	a := Generate(Config{Seed: 42, Steps: 200})
+	b := Generate(Config{Seed: 42, Steps: 200})
+	if len(a) != len(b) {
+		t.Fatalf("trace lengths differ: %d != %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("op %d differs: %s != %s", i, a[i], b[i])
+		}
+	}
+}
+
+func TestRunShrinksInvariantFailure(t *testing.T) {
+	err := Run(Config{
+		Seed:    7,
+		Steps:   500,
+		NewBook: func() Book { return leakyBook{orderbook.NewOrderbook()} },
+	})
+
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected a failure, got %v", err)
+	}
+	// placing an order and cancelling it is enough to leave an empty level
+	if len(failure.Trace) != 2 {
+		t.Fatalf("expected a 2 op trace, got %s", failure)
+	}
+	if failure.Trace[0].Kind != OpLimit || failure.Trace[1].Kind != OpCancel {
+		t.Fatalf("unexpected minimal trace %s", failure)
+	}
+}
+
+func TestRunChecksAmends(t *testing.T) {
+	trace := Generate(Config{Seed: 3, Steps: 500})
+	if !slices.ContainsFunc(trace, func(op Op) bool { return op.Kind == OpAmend }) {
+		t.Fatal("expected the trace to amend orders")
+	}
+
+	err := Run(Config{
+		Seed:    3,
+		Steps:   500,
+		NewBook: func() Book { return staleBook{orderbook.NewOrderbook()} },
+	})
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected a failure, got %v", err)
+	}
+	// placing an order and amending it to another size is enough
+	if len(failure.Trace) != 2 || failure.Trace[1].Kind != OpAmend {
+		t.Fatalf("unexpected minimal trace %s", failure)
+	}
+}
+
+func TestRunDiffsAgainstReference(t *testing.T) {
+	err := Run(Config{
+		Seed:         7,
+		Steps:        500,
+		NewReference: func() Book { return stickyBook{orderbook.NewOrderbook()} },
+	})
+
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected a failure, got %v", err)
+	}
+	if len(failure.Trace) != 2 {
+		t.Fatalf("expected a 2 op trace, got %s", failure)
+	}
+}
+
+func TestRunProRata(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		err := Run(Config{
+			Seed:  seed,
+			Steps: 500,
+			NewBook: func() Book {
+				return orderbook.NewOrderbook(orderbook.WithMatchPolicy(orderbook.ProRataPolicy{LotSize: 1}))
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// generalFIFO matches exactly like FIFOPolicy but, not being one, keeps a book
+// off the top-of-book fast path.
+type generalFIFO struct{ orderbook.FIFOPolicy }
+
+func TestRunFastPathMatchesGeneralPath(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		err := Run(Config{
+			Seed:  seed,
+			Steps: 1000,
+			NewReference: func() Book {
+				return orderbook.NewOrderbook(orderbook.WithMatchPolicy(generalFIFO{}))
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
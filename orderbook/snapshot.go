@@ -0,0 +1,279 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Snapshot is the serialized form of a book: every resting order by level in
+// priority order, plus the book's sequence number.
+type Snapshot struct {
+	Sequence uint64          `json:"sequence"`
+	Asks     []SnapshotLevel `json:"asks"`
+	Bids     []SnapshotLevel `json:"bids"`
+}
+
+type SnapshotLevel struct {
+	Price  Price           `json:"price"`
+	Orders []SnapshotOrder `json:"orders"`
+}
+
+// SnapshotOrder is a resting order. OriginalSize defaults to Size when left
+// out; an order without an ID is given a new one on import. An order with an
+// ExpiresAt is imported as GoodTillDate. Size is an iceberg's displayed
+// tranche and Hidden the rest of it.
+type SnapshotOrder struct {
+	ID            uint64            `json:"id,omitempty"`
+	Size          Size              `json:"size"`
+	OriginalSize  Size              `json:"originalSize,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	TimeInForce   TimeInForce       `json:"timeInForce,omitempty"`
+	ExpiresAt     int64             `json:"expiresAt,omitempty"`
+	DisplaySize   Size              `json:"displaySize,omitempty"`
+	Hidden        Size              `json:"hidden,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	ClientOrderID string            `json:"clientOrderId,omitempty"`
+	Owner         uint64            `json:"owner,omitempty"`
+	Frozen        bool              `json:"frozen,omitempty"`
+}
+
+// Export copies the book's resting orders into a Snapshot.
+func (ob *Orderbook) Export() Snapshot {
+	return Snapshot{
+		Sequence: ob.seq,
+		Asks:     exportLevels(ob.Asks()),
+		Bids:     exportLevels(ob.Bids()),
+	}
+}
+
+func exportLevels(limits []*Limit) []SnapshotLevel {
+	levels := make([]SnapshotLevel, 0, len(limits))
+	for _, limit := range limits {
+		level := SnapshotLevel{
+			Price:  limit.Price,
+			Orders: make([]SnapshotOrder, 0, len(limit.Orders)),
+		}
+		for _, order := range limit.Orders {
+			level.Orders = append(level.Orders, SnapshotOrder{
+				ID:            order.ID,
+				Size:          order.Size,
+				OriginalSize:  order.OriginalSize,
+				Timestamp:     order.Timestamp,
+				TimeInForce:   order.TimeInForce,
+				ExpiresAt:     order.ExpiresAt,
+				DisplaySize:   order.DisplaySize,
+				Hidden:        order.Hidden,
+				Metadata:      order.Metadata,
+				ClientOrderID: order.ClientOrderID,
+				Owner:         order.Owner,
+				Frozen:        order.Frozen,
+			})
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// matchable reports whether the level has an order that isn't frozen.
+func (l SnapshotLevel) matchable() bool {
+	for _, order := range l.Orders {
+		if !order.Frozen {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that a snapshot describes a loadable book: unique levels
+// with resting orders of positive size in time priority, no order ID used
+// twice, and no crossed prices.
+func (s Snapshot) Validate() error {
+	ids := make(map[uint64]bool)
+	for _, side := range []struct {
+		name   string
+		levels []SnapshotLevel
+	}{{"ask", s.Asks}, {"bid", s.Bids}} {
+		seen := make(map[Price]bool, len(side.levels))
+		for _, level := range side.levels {
+			if level.Price <= 0 {
+				return fmt.Errorf("%s level has invalid price %d", side.name, level.Price)
+			}
+			if seen[level.Price] {
+				return fmt.Errorf("%s level %d appears twice", side.name, level.Price)
+			}
+			seen[level.Price] = true
+			if len(level.Orders) == 0 {
+				return fmt.Errorf("%s level %d has no orders", side.name, level.Price)
+			}
+			for i, order := range level.Orders {
+				if order.Size <= 0 {
+					return fmt.Errorf("%s level %d has an order with invalid size %d", side.name, level.Price, order.Size)
+				}
+				if order.ID != 0 && ids[order.ID] {
+					return fmt.Errorf("%s level %d has order ID %d twice", side.name, level.Price, order.ID)
+				}
+				ids[order.ID] = true
+				if order.Hidden < 0 || order.Hidden > 0 && order.DisplaySize <= 0 {
+					return fmt.Errorf("%s level %d has an order with invalid hidden size %d", side.name, level.Price, order.Hidden)
+				}
+				if order.OriginalSize != 0 && order.OriginalSize < order.Size+order.Hidden {
+					return fmt.Errorf("%s level %d has an order larger than its original size", side.name, level.Price)
+				}
+				if i > 0 && order.Timestamp < level.Orders[i-1].Timestamp {
+					return fmt.Errorf("%s level %d is out of time priority", side.name, level.Price)
+				}
+				if err := ValidateMetadata(order.Metadata); err != nil {
+					return fmt.Errorf("%s level %d: %w", side.name, level.Price, err)
+				}
+			}
+		}
+	}
+
+	// levels holding only frozen orders may cross, as they do on a book
+	bestBid, bestAsk := Price(0), Price(math.MaxInt64)
+	for _, level := range s.Bids {
+		if level.matchable() {
+			bestBid = max(bestBid, level.Price)
+		}
+	}
+	for _, level := range s.Asks {
+		if level.matchable() {
+			bestAsk = min(bestAsk, level.Price)
+		}
+	}
+	if bestBid >= bestAsk {
+		return fmt.Errorf("snapshot is crossed [bid: %d | ask: %d]", bestBid, bestAsk)
+	}
+	return nil
+}
+
+// Import loads a snapshot into an empty book, rebuilding the level indexes.
+// The sequence number moves past both the book's and the snapshot's so
+// consumers see the load as a new state.
+func (ob *Orderbook) Import(s Snapshot) error {
+	if len(ob.asks) > 0 || len(ob.bids) > 0 {
+		return fmt.Errorf("book has resting orders")
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	ob.counters.askOrders += ob.importLevels(&ob.asks, ob.AskLimits, false, s.Asks)
+	ob.counters.bidOrders += ob.importLevels(&ob.bids, ob.BidLimits, true, s.Bids)
+	sort.Sort(ByBestAsk{ob.asks})
+	sort.Sort(ByBestBid{ob.bids})
+	ob.seq = max(ob.seq, s.Sequence) + 1
+	return nil
+}
+
+func (ob *Orderbook) importLevels(limits *[]*Limit, index map[Price]*Limit, bid bool, levels []SnapshotLevel) int {
+	n := 0
+	for _, level := range levels {
+		n += len(level.Orders)
+		limit := NewLimit(level.Price)
+		for _, order := range level.Orders {
+			o := &Order{
+				ID:            order.ID,
+				Size:          order.Size,
+				OriginalSize:  max(order.OriginalSize, order.Size+order.Hidden),
+				Price:         limit.Price,
+				Bid:           bid,
+				Timestamp:     order.Timestamp,
+				TimeInForce:   order.TimeInForce,
+				ExpiresAt:     order.ExpiresAt,
+				DisplaySize:   order.DisplaySize,
+				Hidden:        order.Hidden,
+				Metadata:      order.Metadata,
+				ClientOrderID: order.ClientOrderID,
+				Owner:         order.Owner,
+				Frozen:        order.Frozen,
+			}
+			if o.ExpiresAt != 0 {
+				o.TimeInForce = GoodTillDate
+			}
+			if o.ID == 0 {
+				o.ID = lastOrderID.Add(1)
+			} else {
+				ReserveOrderIDs(o.ID)
+			}
+			limit.AddOrder(o)
+			ob.orders[o.ID] = o
+			ob.queueExpiry(o)
+		}
+		*limits = append(*limits, limit)
+		index[limit.Price] = limit
+	}
+	return n
+}
+
+// State is everything a book holds, for restoring it exactly: its orders and
+// sequence number, the last trade price and whether it is in an auction.
+// Only its statistics are left out.
+type State struct {
+	Snapshot
+	LastPrice Price `json:"lastPrice,omitempty"`
+	Auction   bool  `json:"auction,omitempty"`
+}
+
+// State copies the book into a State.
+func (ob *Orderbook) State() State {
+	return State{Snapshot: ob.Export(), LastPrice: ob.lastPrice, Auction: ob.auction}
+}
+
+// Restore loads s, taken from a book by State, into an empty book, leaving
+// it as the book it was taken from, sequence number included. Unlike a
+// snapshot being imported, s is trusted: a book in an auction may be
+// crossed.
+func (ob *Orderbook) Restore(s State) error {
+	if len(ob.asks) > 0 || len(ob.bids) > 0 {
+		return fmt.Errorf("book has resting orders")
+	}
+
+	ob.counters.askOrders += ob.importLevels(&ob.asks, ob.AskLimits, false, s.Asks)
+	ob.counters.bidOrders += ob.importLevels(&ob.bids, ob.BidLimits, true, s.Bids)
+	sort.Sort(ByBestAsk{ob.asks})
+	sort.Sort(ByBestBid{ob.bids})
+	ob.seq = s.Sequence
+	ob.lastPrice = s.LastPrice
+	ob.auction = s.Auction
+	return nil
+}
+
+func (ob *Orderbook) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ob.Export())
+}
+
+// UnmarshalJSON loads a serialized book into an empty Orderbook, which may be
+// the zero value.
+func (ob *Orderbook) UnmarshalJSON(data []byte) error {
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if ob.AskLimits == nil {
+		ob.init()
+	}
+	return ob.Import(s)
+}
+
+// Checksum is a CRC32 over every resting order's side, price and size in
+// priority order. Two books with the same checksum rest the same orders.
+func (ob *Orderbook) Checksum() uint32 {
+	var buf []byte
+	for _, side := range []Side{SideAsk, SideBid} {
+		buf = append(buf, side...)
+		ob.WalkOrders(side, func(o OrderView) bool {
+			buf = append(buf, ':')
+			buf = strconv.AppendInt(buf, int64(o.Price), 10)
+			buf = append(buf, '@')
+			buf = strconv.AppendInt(buf, int64(o.Size), 10)
+			return true
+		})
+		buf = append(buf, '|')
+	}
+	return crc32.ChecksumIEEE(buf)
+}
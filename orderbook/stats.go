@@ -0,0 +1,186 @@
+package orderbook
+
+import (
+	"time"
+	"unsafe"
+)
+
+// tradeWindow is the span Stats.TradesLastMinute counts over, kept as one
+// bucket per second.
+const tradeWindow = 60
+
+// counters are maintained on every book mutation so Stats never has to walk
+// the resting orders.
+type counters struct {
+	askOrders int
+	bidOrders int
+	placed    uint64
+	cancelled uint64
+	matched   uint64
+
+	buckets [tradeWindow]struct {
+		second int64
+		trades uint64
+	}
+}
+
+func (c *counters) rest(bid bool, n int) {
+	if bid {
+		c.bidOrders += n
+	} else {
+		c.askOrders += n
+	}
+}
+
+func (c *counters) trade(now time.Time, n int) {
+	c.matched += uint64(n)
+
+	second := now.Unix()
+	bucket := &c.buckets[second%tradeWindow]
+	if bucket.second != second {
+		bucket.second, bucket.trades = second, 0
+	}
+	bucket.trades += uint64(n)
+}
+
+func (c *counters) tradesSince(now time.Time) uint64 {
+	second := now.Unix()
+	total := uint64(0)
+	for _, bucket := range c.buckets {
+		if bucket.second > second-tradeWindow && bucket.second <= second {
+			total += bucket.trades
+		}
+	}
+	return total
+}
+
+// fillLevel fills o against a level through the book's match policy and
+// keeps the counters in step with the orders it consumed. Icebergs whose
+// displayed tranche filled are replenished, and o goes on filling against
+// the level until it is done or the level is empty.
+func (ob *Orderbook) fillLevel(limit *Limit, o *Order, matches []Match) []Match {
+	before := len(matches)
+	for {
+		resting, start, replenished := len(limit.Orders), len(matches), false
+		matches = ob.policy.Fill(limit, o, matches)
+		for _, m := range matches[start:] {
+			filled := m.Ask
+			if filled == o {
+				filled = m.Bid
+			}
+			if !filled.IsFilled() {
+				continue
+			}
+			if ob.replenish(limit, filled) {
+				replenished = true
+				continue
+			}
+			delete(ob.orders, filled.ID)
+		}
+		ob.counters.rest(!o.Bid, len(limit.Orders)-resting)
+		if !replenished || o.IsFilled() {
+			break
+		}
+	}
+	ob.counters.trade(ob.clock.Now(), len(matches)-before)
+	if len(matches) > before {
+		ob.lastPrice = limit.Price
+	}
+	return matches
+}
+
+// LastPrice is the price of the most recent match, or 0 before any.
+func (ob *Orderbook) LastPrice() Price {
+	return ob.lastPrice
+}
+
+// ReferencePrice is the mid price of a two-sided book, otherwise the last
+// trade price. ok is false when the book has neither.
+func (ob *Orderbook) ReferencePrice() (price Price, ok bool) {
+	if len(ob.asks) > 0 && len(ob.bids) > 0 {
+		return (ob.Asks()[0].Price + ob.Bids()[0].Price) / 2, true
+	}
+	return ob.lastPrice, ob.lastPrice > 0
+}
+
+// ResetStats zeroes the placed, cancelled and matched counters, the trade
+// window and the last price. Resting order counts are left alone.
+func (ob *Orderbook) ResetStats() {
+	ob.counters = counters{
+		askOrders: ob.counters.askOrders,
+		bidOrders: ob.counters.bidOrders,
+	}
+	ob.lastPrice = 0
+}
+
+// SideOrders is the number of orders resting on one side.
+func (ob *Orderbook) SideOrders(side Side) int {
+	if side == SideBid {
+		return ob.counters.bidOrders
+	}
+	return ob.counters.askOrders
+}
+
+// RestingOrders is the number of orders resting on both sides.
+func (ob *Orderbook) RestingOrders() int {
+	return ob.counters.askOrders + ob.counters.bidOrders
+}
+
+type Stats struct {
+	AskOrders        int    `json:"askOrders"`
+	BidOrders        int    `json:"bidOrders"`
+	AskLevels        int    `json:"askLevels"`
+	BidLevels        int    `json:"bidLevels"`
+	AskVolume        Size   `json:"askVolume"`
+	BidVolume        Size   `json:"bidVolume"`
+	OrdersPlaced     uint64 `json:"ordersPlaced"`
+	OrdersCancelled  uint64 `json:"ordersCancelled"`
+	OrdersMatched    uint64 `json:"ordersMatched"`
+	TradesLastMinute uint64 `json:"tradesLastMinute"`
+	Sequence         uint64 `json:"sequence"`
+	// OldestOrderAge is zero when nothing rests on the book.
+	OldestOrderAge time.Duration `json:"oldestOrderAge"`
+	// MemoryBytes approximates the memory held by levels and resting orders
+	// from their struct sizes.
+	MemoryBytes uintptr `json:"memoryBytes"`
+}
+
+// Stats reports the book's load. Counts come from counters kept on every
+// mutation; only the volumes and oldest order age look at the levels, reading
+// one value per level.
+func (ob *Orderbook) Stats() Stats {
+	now := ob.clock.Now()
+	levels := len(ob.asks) + len(ob.bids)
+	orders := ob.counters.askOrders + ob.counters.bidOrders
+
+	oldest := int64(0)
+	for _, limits := range [][]*Limit{ob.asks, ob.bids} {
+		for _, limit := range limits {
+			// orders rest in time priority, so the head is the level's oldest
+			if ts := limit.Orders[0].Timestamp; oldest == 0 || ts < oldest {
+				oldest = ts
+			}
+		}
+	}
+	age := time.Duration(0)
+	if oldest != 0 {
+		age = now.Sub(time.Unix(0, oldest))
+	}
+
+	return Stats{
+		AskOrders:        ob.counters.askOrders,
+		BidOrders:        ob.counters.bidOrders,
+		AskLevels:        len(ob.asks),
+		BidLevels:        len(ob.bids),
+		AskVolume:        ob.AskTotalVolume(),
+		BidVolume:        ob.BidTotalVolume(),
+		OrdersPlaced:     ob.counters.placed,
+		OrdersCancelled:  ob.counters.cancelled,
+		OrdersMatched:    ob.counters.matched,
+		TradesLastMinute: ob.counters.tradesSince(now),
+		Sequence:         ob.seq,
+		OldestOrderAge:   age,
+		MemoryBytes: uintptr(orders)*(unsafe.Sizeof(Order{})+unsafe.Sizeof(&Order{})) +
+			uintptr(levels)*(unsafe.Sizeof(Limit{})+unsafe.Sizeof(&Limit{})+unsafe.Sizeof(Price(0))),
+	}
+}
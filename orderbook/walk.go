@@ -0,0 +1,223 @@
+package orderbook
+
+import "math"
+
+type Side string
+
+const (
+	SideBid Side = "bid"
+	SideAsk Side = "ask"
+)
+
+// LimitView is a read-only copy of a price level handed to walkers.
+type LimitView struct {
+	Price       Price
+	TotalVolume Size
+	Orders      int
+}
+
+// OrderView is a read-only copy of a resting order handed to walkers.
+// Position is the order's place in its level's queue, starting at 0. An
+// iceberg's hidden size is left out of both Size and OriginalSize.
+type OrderView struct {
+	Price        Price
+	Size         Size
+	OriginalSize Size
+	Bid          bool
+	Timestamp    int64
+	Position     int
+}
+
+func (ob *Orderbook) side(side Side) []*Limit {
+	if side == SideBid {
+		return ob.Bids()
+	}
+	return ob.Asks()
+}
+
+// WalkLimits visits the levels of a side best price first until fn returns
+// false. fn receives copies and must not call back into the book.
+func (ob *Orderbook) WalkLimits(side Side, fn func(l LimitView) bool) {
+	for _, limit := range ob.side(side) {
+		view := LimitView{
+			Price:       limit.Price,
+			TotalVolume: limit.TotalVolume,
+			Orders:      len(limit.Orders),
+		}
+		if !fn(view) {
+			return
+		}
+	}
+}
+
+// WalkOrders visits the resting orders of a side best price first and in time
+// priority within a level until fn returns false. fn receives copies and must
+// not call back into the book.
+func (ob *Orderbook) WalkOrders(side Side, fn func(o OrderView) bool) {
+	for _, limit := range ob.side(side) {
+		for i, order := range limit.Orders {
+			view := OrderView{
+				Price:        limit.Price,
+				Size:         order.Size,
+				OriginalSize: order.OriginalSize - order.Hidden,
+				Bid:          order.Bid,
+				Timestamp:    order.Timestamp,
+				Position:     i,
+			}
+			if !fn(view) {
+				return
+			}
+		}
+	}
+}
+
+// MatchableVolume is the resting volume an incoming order on the given side
+// could execute against at price or better, icebergs' hidden size included.
+func (ob *Orderbook) MatchableVolume(bid bool, price Price) Size {
+	volume := Size(0)
+	ob.walkMatchable(bid, price, func(l *Limit) bool {
+		volume += l.volume()
+		return true
+	})
+	return volume
+}
+
+// Fillable reports whether an incoming order on the given side for size would
+// fill completely at price or better right now. The walk stops as soon as
+// enough volume is found. Nothing fills on entry during an auction.
+func (ob *Orderbook) Fillable(bid bool, price Price, size Size) bool {
+	if ob.auction {
+		return false
+	}
+	volume := Size(0)
+	ob.walkMatchable(bid, price, func(l *Limit) bool {
+		volume += l.volume()
+		return volume < size
+	})
+	return volume >= size
+}
+
+// SizeForNotional is the base size an incoming market order on the given
+// side fills for notional in quote: spent buying, raised selling. It walks the
+// opposite side best price first, taking levels whole, icebergs' hidden size
+// included, until the last one, which is taken in part and rounded down to a
+// whole Size so the order never goes over. ok is false if the side runs out
+// first.
+func (ob *Orderbook) SizeForNotional(bid bool, notional float64) (size Size, ok bool) {
+	limits := ob.bids
+	if bid {
+		limits = ob.asks
+	}
+	for _, limit := range limits {
+		volume := limit.volume()
+		if cost := ob.scale.Notional(limit.Price, volume); cost < notional {
+			notional -= cost
+			size += volume
+			continue
+		}
+		part := Size(math.Floor(notional / ob.scale.PriceValue(limit.Price) * math.Pow10(ob.scale.Size)))
+		return size + min(part, volume), true
+	}
+	return size, false
+}
+
+// NotionalForSize is what an incoming market order on the given side for size
+// would cost buying or raise selling, in quote. It walks the opposite side
+// like SizeForNotional. ok is false if the side runs out first, and notional
+// is then what the whole side comes to.
+func (ob *Orderbook) NotionalForSize(bid bool, size Size) (notional float64, ok bool) {
+	limits := ob.bids
+	if bid {
+		limits = ob.asks
+	}
+	left := size
+	for _, limit := range limits {
+		take := min(left, limit.volume())
+		notional += ob.scale.Notional(limit.Price, take)
+		if left -= take; left == 0 {
+			return notional, true
+		}
+	}
+	return notional, false
+}
+
+// walkMatchable visits the opposite levels an incoming order on the given
+// side could match at price or better, best first, until fn returns false.
+func (ob *Orderbook) walkMatchable(bid bool, price Price, fn func(l *Limit) bool) {
+	limits := ob.bids
+	if bid {
+		limits = ob.asks
+	}
+	for _, limit := range limits {
+		if bid && limit.Price > price || !bid && limit.Price < price || !fn(limit) {
+			return
+		}
+	}
+}
+
+// QueueView is a resting order as WalkLevel hands it out. SizeAhead is the
+// displayed size of the orders ahead of it in the queue that would fill
+// before it: frozen orders are passed over by matching, and an iceberg's
+// hidden size only shows behind everything resting at the time.
+type QueueView struct {
+	OrderView
+	ID        uint64
+	Owner     uint64
+	Frozen    bool
+	SizeAhead Size
+}
+
+// WalkLevel visits the orders resting on one side at price in time priority
+// until fn returns false. A price with no level visits nothing. fn receives
+// copies and must not call back into the book.
+func (ob *Orderbook) WalkLevel(side Side, price Price, fn func(o QueueView) bool) {
+	limits := ob.AskLimits
+	if side == SideBid {
+		limits = ob.BidLimits
+	}
+	limit, ok := limits[price]
+	if !ok {
+		return
+	}
+	ahead := Size(0)
+	for i, order := range limit.Orders {
+		view := QueueView{
+			OrderView: OrderView{
+				Price:        limit.Price,
+				Size:         order.Size,
+				OriginalSize: order.OriginalSize - order.Hidden,
+				Bid:          order.Bid,
+				Timestamp:    order.Timestamp,
+				Position:     i,
+			},
+			ID:        order.ID,
+			Owner:     order.Owner,
+			Frozen:    order.Frozen,
+			SizeAhead: ahead,
+		}
+		if !fn(view) {
+			return
+		}
+		if !order.Frozen {
+			ahead += order.Size
+		}
+	}
+}
+
+// QueuePosition is the place of the resting order with id in its level's
+// queue, starting at 0, and the size ahead of it as WalkLevel counts it.
+func (ob *Orderbook) QueuePosition(id uint64) (position int, sizeAhead Size, err error) {
+	o, ok := ob.orders[id]
+	if !ok || o.Limit == nil {
+		return 0, 0, ErrOrderNotFound
+	}
+	for i, order := range o.Limit.Orders {
+		if order == o {
+			return i, sizeAhead, nil
+		}
+		if !order.Frozen {
+			sizeAhead += order.Size
+		}
+	}
+	return 0, 0, ErrOrderNotFound
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// depthCache keeps each market's book in Redis as of its last operation, so
+// GET /book/:market and new WebSocket subscribers are served without taking
+// the book's lock or walking it, by the engine's process or any gateway
+// sharing the Redis server.
+type depthCache struct {
+	rdb *redis.Client
+}
+
+// openDepthCache connects to the Redis server at EXCHANGE_REDIS_URL, such as
+// "redis://localhost:6379/0". Without it it returns nil, and books are read
+// from the engine.
+func openDepthCache() *depthCache {
+	url := os.Getenv("EXCHANGE_REDIS_URL")
+	if url == "" {
+		return nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		slog.Error("invalid EXCHANGE_REDIS_URL", "error", err)
+		os.Exit(1)
+	}
+	rdb := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		slog.Error("failed to connect to Redis", "addr", opts.Addr, "error", err)
+		os.Exit(1)
+	}
+	return &depthCache{rdb: rdb}
+}
+
+// withDepthCache serves books from cache rather than the engine.
+func withDepthCache(cache *depthCache) serverOption {
+	return func(s *server) {
+		s.depth = cache
+	}
+}
+
+func bookKey(market exchange.Market) string {
+	return "exchange:book:" + string(market)
+}
+
+// cacheBooks keeps cache up to date with ex's books, writing each market's
+// again after every operation on it. The writes are coalesced while Redis
+// falls behind, since only the latest book matters.
+func cacheBooks(ex *exchange.Exchange, cache *depthCache) {
+	for _, market := range ex.Markets() {
+		cache.write(ex, market)
+	}
+	ex.HandleEventsAsync(func(events []exchange.Event) {
+		var written []exchange.Market
+		for _, event := range events {
+			if !slices.Contains(written, event.Market) {
+				cache.write(ex, event.Market)
+				written = append(written, event.Market)
+			}
+		}
+	}, exchange.AsyncOptions{Name: "redis", Overflow: exchange.OverflowCoalesce})
+}
+
+// write copies market's book from ex to the cache.
+func (c *depthCache) write(ex *exchange.Exchange, market exchange.Market) {
+	book, err := ex.Book(market, nil, nil)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(book)
+	if err != nil {
+		slog.Error("failed to cache book", "market", market, "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.rdb.Set(ctx, bookKey(market), data, 0).Err(); err != nil {
+		slog.Error("failed to cache book", "market", market, "seq", book.Sequence, "error", err)
+	}
+}
+
+// book returns market's cached book, or redis.Nil if none is.
+func (c *depthCache) book(ctx context.Context, market exchange.Market) (exchange.OrderbookData, error) {
+	data, err := c.rdb.Get(ctx, bookKey(market)).Bytes()
+	if err != nil {
+		return exchange.OrderbookData{}, err
+	}
+	var book exchange.OrderbookData
+	err = json.Unmarshal(data, &book)
+	return book, err
+}
+
+func (c *depthCache) Close() error {
+	return c.rdb.Close()
+}
+
+// getBook returns market's book from the depth cache, if there is one and
+// it holds the market, and otherwise from the engine.
+func (s *server) getBook(ctx context.Context, market exchange.Market, asks, bids []exchange.Order) (exchange.OrderbookData, error) {
+	if s.depth != nil {
+		book, err := s.depth.book(ctx, market)
+		if err == nil {
+			return book, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			slog.Warn("failed to read cached book", "market", market, "error", err)
+		}
+	}
+	return s.ex.Book(market, asks, bids)
+}
+
+// snapshotFeed is the engine's SnapshotFeed, taking its snapshot from the
+// depth cache when there is one: the cached book brought up to date by the
+// deltas the feed has published since. If the feed no longer holds them, or
+// the book isn't cached, the engine takes the snapshot.
+func (s *server) snapshotFeed(ctx context.Context, market exchange.Market) (snapshot []exchange.FeedMessage, seq uint64, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error) {
+	if s.depth != nil {
+		book, err := s.depth.book(ctx, market)
+		switch {
+		case err == nil:
+			resume, updates, unsubscribe, err := s.ex.ResumeFeed(market, book.Sequence)
+			if err != nil {
+				return nil, 0, nil, nil, err
+			}
+			if resume.Resumed {
+				snapshot, seq := applyDeltas(market, book, resume.Messages)
+				return snapshot, seq, updates, unsubscribe, nil
+			}
+			unsubscribe()
+		case !errors.Is(err, redis.Nil):
+			slog.Warn("failed to read cached book", "market", market, "error", err)
+		}
+	}
+	return s.ex.SnapshotFeed(market)
+}
+
+// applyDeltas renders book as a feed snapshot, as SnapshotFeed would, once
+// deltas published after it are applied, returning it and the sequence
+// number it is as of.
+func applyDeltas(market exchange.Market, book exchange.OrderbookData, deltas []exchange.FeedMessage) ([]exchange.FeedMessage, uint64) {
+	type level struct {
+		side  orderbook.Side
+		price orderbook.Price
+	}
+	sizes := map[level]orderbook.Size{}
+	for _, o := range book.Asks {
+		sizes[level{orderbook.SideAsk, o.Price}] += o.Size
+	}
+	for _, o := range book.Bids {
+		sizes[level{orderbook.SideBid, o.Price}] += o.Size
+	}
+	seq := book.Sequence
+	for _, msg := range deltas {
+		if msg.Type != exchange.FeedBook {
+			continue
+		}
+		seq = max(seq, msg.Seq)
+		if msg.Size == 0 {
+			delete(sizes, level{msg.Side, msg.Price})
+			continue
+		}
+		sizes[level{msg.Side, msg.Price}] = msg.Size
+	}
+
+	snapshot := make([]exchange.FeedMessage, 0, len(sizes))
+	for l, size := range sizes {
+		snapshot = append(snapshot, exchange.FeedMessage{Type: exchange.FeedBook, Market: market, Seq: seq, Side: l.side, Price: l.price, Size: size})
+	}
+	// asks, then bids, each best price first
+	slices.SortFunc(snapshot, func(a, b exchange.FeedMessage) int {
+		if a.Side != b.Side {
+			if a.Side == orderbook.SideAsk {
+				return -1
+			}
+			return 1
+		}
+		if a.Side == orderbook.SideBid {
+			return cmp.Compare(b.Price, a.Price)
+		}
+		return cmp.Compare(a.Price, b.Price)
+	})
+	return snapshot, seq
+}
@@ -0,0 +1,578 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// ErrUnavailable is returned, wrapped, for a call the engine couldn't be
+// reached for. The call may or may not have been run.
+var ErrUnavailable = errors.New("matching engine unavailable")
+
+// subscriptionBuffer is how many batches a subscriber may fall behind the
+// engine before it is cut off, as it would be on the engine.
+const subscriptionBuffer = 256
+
+// Client is an exchange served by Register in another process. It has the
+// exchange's methods for serving it, and the users of its registry.
+type Client struct {
+	conn    *grpc.ClientConn
+	sandbox bool
+}
+
+// Dial connects to the engine at addr, waiting until it answers or ctx is
+// done. opts are added to the connection's.
+func Dial(ctx context.Context, addr string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codec{}.Name())),
+	}, opts...)
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn}
+	// sandbox mode is fixed when the engine starts, so it is only asked once
+	if err := c.call(ctx, "Sandbox", args{}, &c.sandbox, grpc.WaitForReady(true)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection, ending every subscription.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// call runs method on the engine, decoding its result into v.
+func (c *Client) call(ctx context.Context, method string, a args, v any, opts ...grpc.CallOption) error {
+	var r reply
+	if err := c.conn.Invoke(ctx, callMethod, &call{Method: method, Args: a}, &r, opts...); err != nil {
+		return transportError(err)
+	}
+	if err := r.Error.err(); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, v)
+}
+
+// query is call for the methods that can't fail on the engine. If the engine
+// can't be reached, v is left as it was.
+func (c *Client) query(method string, a args, v any) {
+	if err := c.call(context.Background(), method, a, v); err != nil {
+		slog.Warn("engine call failed", "method", method, "error", err)
+	}
+}
+
+// transportError is what a call that failed in gRPC rather than on the
+// engine returns: the rejections the exchange itself gives a request it
+// ran out of time for, or ErrUnavailable.
+func transportError(err error) error {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		return &exchange.Rejection{
+			Msg:  "engine didn't answer in time",
+			Code: "ENGINE_TIMEOUT",
+		}
+	case codes.Canceled:
+		return &exchange.Rejection{
+			Msg:  "request was cancelled before the engine answered",
+			Code: "REQUEST_CANCELLED",
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnavailable, status.Convert(err).Message())
+}
+
+var subscribeDesc = grpc.StreamDesc{StreamName: "Subscribe", ServerStreams: true}
+
+// subscribe opens a subscription to method, decoding the engine's answer
+// into first, and relays its batches on the returned channel, which is
+// closed once the subscription ends. With latest, the channel only holds
+// the newest batch, as the exchange's tickers do, and isn't closed.
+func subscribe[T any](c *Client, method string, a args, first any, latest bool) (<-chan T, func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.conn.NewStream(ctx, &subscribeDesc, subscribeMethod)
+	if err == nil {
+		err = stream.SendMsg(&call{Method: method, Args: a})
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	var r reply
+	if err == nil {
+		err = stream.RecvMsg(&r)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, transportError(err)
+	}
+	if err := r.Error.err(); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if first != nil {
+		if err := json.Unmarshal(r.Result, first); err != nil {
+			cancel()
+			return nil, nil, err
+		}
+	}
+
+	buffer := subscriptionBuffer
+	if latest {
+		buffer = 1
+	}
+	updates := make(chan T, buffer)
+	go func() {
+		defer cancel()
+		if !latest {
+			defer close(updates)
+		}
+		for {
+			var r reply
+			if err := stream.RecvMsg(&r); err != nil {
+				return
+			}
+			var batch T
+			if err := json.Unmarshal(r.Result, &batch); err != nil {
+				slog.Error("undecodable engine update", "method", method, "error", err)
+				return
+			}
+			if latest {
+				select {
+				case <-updates:
+				default:
+				}
+			}
+			select {
+			case updates <- batch:
+			default:
+				// fallen behind
+				return
+			}
+		}
+	}()
+	return updates, cancel, nil
+}
+
+func (c *Client) PlaceOrder(ctx context.Context, req exchange.PlaceOrderRequest) (exchange.ExecutionReport, error) {
+	var report exchange.ExecutionReport
+	err := c.call(ctx, "PlaceOrder", args{Place: &req}, &report)
+	return report, err
+}
+
+func (c *Client) ModifyOrder(ctx context.Context, user, id uint64, req exchange.ModifyRequest) (exchange.ExecutionReport, error) {
+	var report exchange.ExecutionReport
+	err := c.call(ctx, "ModifyOrder", args{User: user, ID: id, Modify: &req}, &report)
+	return report, err
+}
+
+func (c *Client) ReduceOrder(ctx context.Context, user, id uint64, req exchange.ReduceRequest) (exchange.OrderReduce, error) {
+	var reduce exchange.OrderReduce
+	err := c.call(ctx, "ReduceOrder", args{User: user, ID: id, Reduce: &req}, &reduce)
+	return reduce, err
+}
+
+func (c *Client) Cancel(ctx context.Context, req exchange.CancelRequest) (exchange.CancelResult, error) {
+	var res exchange.CancelResult
+	err := c.call(ctx, "Cancel", args{Cancel: &req}, &res)
+	return res, err
+}
+
+func (c *Client) CancelOrder(ctx context.Context, user, id uint64) (exchange.OrderCancel, error) {
+	var cancel exchange.OrderCancel
+	err := c.call(ctx, "CancelOrder", args{User: user, ID: id}, &cancel)
+	return cancel, err
+}
+
+func (c *Client) CancelOrderByClientID(ctx context.Context, user uint64, clientOrderID string) (exchange.OrderCancel, error) {
+	var cancel exchange.OrderCancel
+	err := c.call(ctx, "CancelOrderByClientID", args{User: user, ClientOrderID: clientOrderID}, &cancel)
+	return cancel, err
+}
+
+func (c *Client) Order(user, id uint64) (exchange.OrderRecord, error) {
+	var record exchange.OrderRecord
+	err := c.call(context.Background(), "Order", args{User: user, ID: id}, &record)
+	return record, err
+}
+
+func (c *Client) OrderByClientID(user uint64, clientOrderID string) (exchange.OrderRecord, error) {
+	var record exchange.OrderRecord
+	err := c.call(context.Background(), "OrderByClientID", args{User: user, ClientOrderID: clientOrderID}, &record)
+	return record, err
+}
+
+func (c *Client) UserOrders(user uint64) []exchange.OrderRecord {
+	var records []exchange.OrderRecord
+	c.query("UserOrders", args{User: user}, &records)
+	return records
+}
+
+func (c *Client) Fills(user uint64) []exchange.Fill {
+	var fills []exchange.Fill
+	c.query("Fills", args{User: user}, &fills)
+	return fills
+}
+
+func (c *Client) UserTrades(user uint64, market exchange.Market, after uint64, limit int) ([]exchange.UserTrade, error) {
+	var trades []exchange.UserTrade
+	err := c.call(context.Background(), "UserTrades", args{User: user, Market: market, ID: after, Limit: limit}, &trades)
+	return trades, err
+}
+
+func (c *Client) Positions(user uint64) []exchange.Position {
+	var positions []exchange.Position
+	c.query("Positions", args{User: user}, &positions)
+	return positions
+}
+
+func (c *Client) Balances(user uint64) map[ledger.Asset]float64 {
+	var balances map[ledger.Asset]float64
+	c.query("Balances", args{User: user}, &balances)
+	return balances
+}
+
+func (c *Client) Held(user uint64) map[ledger.Asset]float64 {
+	var held map[ledger.Asset]float64
+	c.query("Held", args{User: user}, &held)
+	return held
+}
+
+func (c *Client) Deposit(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	var entry ledger.Entry
+	err := c.call(context.Background(), "Deposit", args{User: user, Asset: asset, Amount: amount}, &entry)
+	return entry, err
+}
+
+func (c *Client) Statement(user uint64) []ledger.Line {
+	var lines []ledger.Line
+	c.query("Statement", args{User: user}, &lines)
+	return lines
+}
+
+func (c *Client) Withdraw(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	var entry ledger.Entry
+	err := c.call(context.Background(), "Withdraw", args{User: user, Asset: asset, Amount: amount}, &entry)
+	return entry, err
+}
+
+func (c *Client) Transfer(req exchange.TransferRequest) (exchange.Transfer, error) {
+	var transfer exchange.Transfer
+	err := c.call(context.Background(), "Transfer", args{Transfer: &req}, &transfer)
+	return transfer, err
+}
+
+func (c *Client) Fees() exchange.FeeReport {
+	var report exchange.FeeReport
+	c.query("Fees", args{}, &report)
+	return report
+}
+
+func (c *Client) WithdrawFees(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	var entry ledger.Entry
+	err := c.call(context.Background(), "WithdrawFees", args{User: user, Asset: asset, Amount: amount}, &entry)
+	return entry, err
+}
+
+func (c *Client) Markets() []exchange.Market {
+	var markets []exchange.Market
+	c.query("Markets", args{}, &markets)
+	return markets
+}
+
+// Sandbox reports whether the engine was in sandbox mode when dialed.
+func (c *Client) Sandbox() bool {
+	return c.sandbox
+}
+
+// Ready reports whether the engine is ready for traffic; one that can't be
+// reached isn't.
+func (c *Client) Ready() bool {
+	var ready bool
+	c.query("Ready", args{}, &ready)
+	return ready
+}
+
+func (c *Client) SetReady(ready bool) {
+	c.query("SetReady", args{Ready: ready}, nil)
+}
+
+func (c *Client) Book(market exchange.Market, asks, bids []exchange.Order) (exchange.OrderbookData, error) {
+	var data exchange.OrderbookData
+	err := c.call(context.Background(), "Book", args{Market: market, Asks: asks, Bids: bids}, &data)
+	return data, err
+}
+
+func (c *Client) GetDepth(market exchange.Market, depth int) (exchange.MarketDepth, error) {
+	var d exchange.MarketDepth
+	err := c.call(context.Background(), "GetDepth", args{Market: market, Depth: depth}, &d)
+	return d, err
+}
+
+func (c *Client) RecentTrades(market exchange.Market, limit int) ([]exchange.FeedMessage, error) {
+	var trades []exchange.FeedMessage
+	err := c.call(context.Background(), "RecentTrades", args{Market: market, Limit: limit}, &trades)
+	return trades, err
+}
+
+func (c *Client) GetDepths(markets []exchange.Market, depth int) []exchange.MarketDepth {
+	var depths []exchange.MarketDepth
+	c.query("GetDepths", args{Markets: markets, Depth: depth}, &depths)
+	return depths
+}
+
+func (c *Client) LevelQueue(market exchange.Market, side orderbook.Side, price orderbook.Price) ([]exchange.QueuedOrder, error) {
+	var queue []exchange.QueuedOrder
+	err := c.call(context.Background(), "LevelQueue", args{Market: market, Side: side, Price: price}, &queue)
+	return queue, err
+}
+
+func (c *Client) Ticker(market exchange.Market) (exchange.Ticker, error) {
+	var t exchange.Ticker
+	err := c.call(context.Background(), "Ticker", args{Market: market}, &t)
+	return t, err
+}
+
+func (c *Client) Assets(market exchange.Market) (exchange.MarketAssets, error) {
+	var assets exchange.MarketAssets
+	err := c.call(context.Background(), "Assets", args{Market: market}, &assets)
+	return assets, err
+}
+
+func (c *Client) Increments(market exchange.Market) (exchange.Increments, error) {
+	var inc exchange.Increments
+	err := c.call(context.Background(), "Increments", args{Market: market}, &inc)
+	return inc, err
+}
+
+func (c *Client) Limits(market exchange.Market) (exchange.MarketConfig, error) {
+	var cfg exchange.MarketConfig
+	err := c.call(context.Background(), "Limits", args{Market: market}, &cfg)
+	return cfg, err
+}
+
+func (c *Client) PatchLimits(market exchange.Market, patch exchange.LimitsPatch) (exchange.MarketConfig, error) {
+	var cfg exchange.MarketConfig
+	err := c.call(context.Background(), "PatchLimits", args{Market: market, Patch: &patch}, &cfg)
+	return cfg, err
+}
+
+func (c *Client) UserLimits(user uint64) exchange.UserLimits {
+	var limits exchange.UserLimits
+	c.query("UserLimits", args{User: user}, &limits)
+	return limits
+}
+
+func (c *Client) SetUserLimits(user uint64, limits exchange.UserLimits) (exchange.UserLimits, error) {
+	var set exchange.UserLimits
+	err := c.call(context.Background(), "SetUserLimits", args{User: user, UserLimits: &limits}, &set)
+	return set, err
+}
+
+func (c *Client) SuspendUser(ctx context.Context, user uint64, cancel bool) ([]exchange.OrderCancel, error) {
+	var cancelled []exchange.OrderCancel
+	err := c.call(ctx, "SuspendUser", args{User: user, CancelOrders: cancel}, &cancelled)
+	return cancelled, err
+}
+
+func (c *Client) ResumeUser(user uint64) error {
+	return c.call(context.Background(), "ResumeUser", args{User: user}, nil)
+}
+
+func (c *Client) FreezeOrder(ctx context.Context, id uint64) (exchange.OrderRecord, error) {
+	var record exchange.OrderRecord
+	err := c.call(ctx, "FreezeOrder", args{ID: id}, &record)
+	return record, err
+}
+
+func (c *Client) Quality(market exchange.Market, window time.Duration) (exchange.BookQuality, error) {
+	var q exchange.BookQuality
+	err := c.call(context.Background(), "Quality", args{Market: market, Window: window}, &q)
+	return q, err
+}
+
+func (c *Client) Stats(market exchange.Market) (exchange.MarketStats, error) {
+	var stats exchange.MarketStats
+	err := c.call(context.Background(), "Stats", args{Market: market}, &stats)
+	return stats, err
+}
+
+func (c *Client) Auction(market exchange.Market) (orderbook.AuctionState, error) {
+	var state orderbook.AuctionState
+	err := c.call(context.Background(), "Auction", args{Market: market}, &state)
+	return state, err
+}
+
+func (c *Client) StartAuction(market exchange.Market) (orderbook.AuctionState, error) {
+	var state orderbook.AuctionState
+	err := c.call(context.Background(), "StartAuction", args{Market: market}, &state)
+	return state, err
+}
+
+func (c *Client) ExecuteAuction(market exchange.Market) ([]exchange.AuctionFill, error) {
+	var fills []exchange.AuctionFill
+	err := c.call(context.Background(), "ExecuteAuction", args{Market: market}, &fills)
+	return fills, err
+}
+
+func (c *Client) Reset(market exchange.Market, clearStats bool) (int, uint64, error) {
+	var res resetResult
+	err := c.call(context.Background(), "Reset", args{Market: market, ClearStats: clearStats}, &res)
+	return res.Removed, res.Seq, err
+}
+
+func (c *Client) Export(market exchange.Market) (exchange.MarketExport, error) {
+	var export exchange.MarketExport
+	err := c.call(context.Background(), "Export", args{Market: market}, &export)
+	return export, err
+}
+
+func (c *Client) Import(market exchange.Market, snapshot orderbook.Snapshot, replace bool) (exchange.ImportResult, error) {
+	var res exchange.ImportResult
+	err := c.call(context.Background(), "Import", args{Market: market, Snapshot: &snapshot, Replace: replace}, &res)
+	return res, err
+}
+
+func (c *Client) QueryAudit(q exchange.AuditQuery) ([]exchange.AuditRecord, error) {
+	var records []exchange.AuditRecord
+	err := c.call(context.Background(), "QueryAudit", args{Audit: &q}, &records)
+	return records, err
+}
+
+// RejectInvalid records the request on the engine's audit trail. If the
+// engine can't be reached the request goes unrecorded, but is still
+// rejected.
+func (c *Client) RejectInvalid(action exchange.AuditAction, market exchange.Market, raw []byte, err error) *exchange.Rejection {
+	rejection := &exchange.Rejection{Msg: err.Error(), Code: "INVALID_REQUEST"}
+	c.query("RejectInvalid", args{Action: action, Market: market, Raw: raw, Reason: err.Error()}, rejection)
+	return rejection
+}
+
+// RejectMalformed is RejectInvalid for a request body that isn't the JSON
+// the action takes.
+func (c *Client) RejectMalformed(action exchange.AuditAction, raw []byte, err error) *exchange.Rejection {
+	rejection := &exchange.Rejection{Msg: err.Error(), Code: "MALFORMED_BODY"}
+	c.query("RejectMalformed", args{Action: action, Raw: raw, Reason: err.Error()}, rejection)
+	return rejection
+}
+
+func (c *Client) SandboxSeed(market exchange.Market, seed exchange.SeedRequest) (int, error) {
+	var n int
+	err := c.call(context.Background(), "SandboxSeed", args{Market: market, Seed: &seed}, &n)
+	return n, err
+}
+
+func (c *Client) SandboxReset() error {
+	return c.call(context.Background(), "SandboxReset", args{}, nil)
+}
+
+func (c *Client) SandboxFaucet(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	var entry ledger.Entry
+	err := c.call(context.Background(), "SandboxFaucet", args{User: user, Asset: asset, Amount: amount}, &entry)
+	return entry, err
+}
+
+func (c *Client) Subscribe(market exchange.Market) (updates <-chan exchange.Ticker, unsubscribe func(), err error) {
+	return subscribe[exchange.Ticker](c, "Subscribe", args{Market: market}, nil, true)
+}
+
+func (c *Client) SubscribeFeed(market exchange.Market) (updates <-chan []exchange.FeedMessage, unsubscribe func(), err error) {
+	return subscribe[[]exchange.FeedMessage](c, "SubscribeFeed", args{Market: market}, nil, false)
+}
+
+func (c *Client) SnapshotFeed(market exchange.Market) (snapshot []exchange.FeedMessage, seq uint64, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error) {
+	var res snapshotResult
+	updates, unsubscribe, err = subscribe[[]exchange.FeedMessage](c, "SnapshotFeed", args{Market: market}, &res, false)
+	return res.Snapshot, res.Seq, updates, unsubscribe, err
+}
+
+func (c *Client) ResumeFeed(market exchange.Market, since uint64) (resume exchange.FeedResume, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error) {
+	updates, unsubscribe, err = subscribe[[]exchange.FeedMessage](c, "ResumeFeed", args{Market: market, Seq: since}, &resume, false)
+	return resume, updates, unsubscribe, err
+}
+
+func (c *Client) ResumeTrades(market exchange.Market, after uint64) (missed []exchange.FeedMessage, updates <-chan []exchange.FeedMessage, unsubscribe func(), err error) {
+	updates, unsubscribe, err = subscribe[[]exchange.FeedMessage](c, "ResumeTrades", args{Market: market, Seq: after}, &missed, false)
+	return missed, updates, unsubscribe, err
+}
+
+// SubscribeOrderUpdates streams what happens to owner's orders. If the
+// engine can't be reached the channel is closed straight away, as for a
+// subscriber that was cut off.
+func (c *Client) SubscribeOrderUpdates(owner uint64) (updates <-chan []exchange.OrderUpdate, unsubscribe func()) {
+	updates, unsubscribe, err := subscribe[[]exchange.OrderUpdate](c, "SubscribeOrderUpdates", args{User: owner}, nil, false)
+	if err != nil {
+		slog.Warn("engine subscription failed", "method", "SubscribeOrderUpdates", "error", err)
+		closed := make(chan []exchange.OrderUpdate)
+		close(closed)
+		return closed, func() {}
+	}
+	return updates, unsubscribe
+}
+
+// Users returns the users registered with the engine.
+func (c *Client) Users() *Users {
+	return &Users{c}
+}
+
+// Users is the engine's user registry, with the methods of a
+// user.Registry.
+type Users struct {
+	c *Client
+}
+
+func (u *Users) Register(name, pass string) (user.User, string, error) {
+	var reg registration
+	err := u.c.call(context.Background(), "Register", args{Name: name, Password: pass}, &reg)
+	return reg.User, reg.Key, err
+}
+
+func (u *Users) Login(name, pass string) (user.User, error) {
+	var usr user.User
+	err := u.c.call(context.Background(), "Login", args{Name: name, Password: pass}, &usr)
+	return usr, err
+}
+
+// Authenticate returns the user key belongs to. If the engine can't be
+// reached, no key authenticates.
+func (u *Users) Authenticate(key string) (user.User, bool) {
+	if key == "" {
+		return user.User{}, false
+	}
+	var auth authentication
+	u.c.query("Authenticate", args{Key: key}, &auth)
+	return auth.User, auth.OK
+}
+
+func (u *Users) Get(id uint64) (user.User, error) {
+	var usr user.User
+	err := u.c.call(context.Background(), "GetUser", args{ID: id}, &usr)
+	return usr, err
+}
+
+func (u *Users) KeySettings(key string) (user.KeySettings, error) {
+	var settings user.KeySettings
+	err := u.c.call(context.Background(), "KeySettings", args{Key: key}, &settings)
+	return settings, err
+}
+
+func (u *Users) SetKeySettings(key string, settings user.KeySettings) error {
+	return u.c.call(context.Background(), "SetKeySettings", args{Key: key, Settings: &settings}, nil)
+}
@@ -0,0 +1,206 @@
+// Package remote serves an exchange to processes other than the one running
+// it, so the HTTP, WebSocket, gRPC and FIX gateways can run apart from the
+// matching engine: scaled out, and restarted, without touching the books.
+//
+// The protocol is internal to the exchange's own processes and carried over
+// gRPC with JSON messages. A unary call runs one of the exchange's methods;
+// a streaming call subscribes to one of its feeds, sending the method's
+// result first and then the feed's batches until either side ends it.
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// codec marshals the protocol's messages as JSON.
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (codec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (codec) Name() string                       { return "json" }
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// call asks for Method to be run with Args.
+type call struct {
+	Method string `json:"method"`
+	Args   args   `json:"args"`
+}
+
+// args holds the arguments of every method; each method reads the ones it
+// takes.
+type args struct {
+	Market        exchange.Market      `json:"market,omitempty"`
+	Markets       []exchange.Market    `json:"markets,omitempty"`
+	User          uint64               `json:"user,omitempty"`
+	ID            uint64               `json:"id,omitempty"`
+	ClientOrderID string               `json:"clientOrderId,omitempty"`
+	Asset         ledger.Asset         `json:"asset,omitempty"`
+	Amount        float64              `json:"amount,omitempty"`
+	Depth         int                  `json:"depth,omitempty"`
+	Side          orderbook.Side       `json:"side,omitempty"`
+	Price         orderbook.Price      `json:"price,omitempty"`
+	Limit         int                  `json:"limit,omitempty"`
+	Seq           uint64               `json:"seq,omitempty"`
+	Window        time.Duration        `json:"window,omitempty"`
+	Ready         bool                 `json:"ready,omitempty"`
+	Replace       bool                 `json:"replace,omitempty"`
+	ClearStats    bool                 `json:"clearStats,omitempty"`
+	CancelOrders  bool                 `json:"cancelOrders,omitempty"`
+	Action        exchange.AuditAction `json:"action,omitempty"`
+	Raw           []byte               `json:"raw,omitempty"`
+	Reason        string               `json:"reason,omitempty"`
+	Name          string               `json:"name,omitempty"`
+	Password      string               `json:"password,omitempty"`
+	Key           string               `json:"key,omitempty"`
+
+	Place      *exchange.PlaceOrderRequest `json:"place,omitempty"`
+	Cancel     *exchange.CancelRequest     `json:"cancel,omitempty"`
+	Modify     *exchange.ModifyRequest     `json:"modify,omitempty"`
+	Reduce     *exchange.ReduceRequest     `json:"reduce,omitempty"`
+	Patch      *exchange.LimitsPatch       `json:"patch,omitempty"`
+	UserLimits *exchange.UserLimits        `json:"userLimits,omitempty"`
+	Snapshot   *orderbook.Snapshot         `json:"snapshot,omitempty"`
+	Seed       *exchange.SeedRequest       `json:"seed,omitempty"`
+	Transfer   *exchange.TransferRequest   `json:"transfer,omitempty"`
+	Audit      *exchange.AuditQuery        `json:"audit,omitempty"`
+	Asks       []exchange.Order            `json:"asks,omitempty"`
+	Settings   *user.KeySettings           `json:"settings,omitempty"`
+	Bids       []exchange.Order            `json:"bids,omitempty"`
+}
+
+// reply is a method's result, or a feed's batch, or the error the method
+// failed with.
+type reply struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *callError      `json:"error,omitempty"`
+}
+
+// callError carries an error across: a rejection whole, and any other error
+// as its message and the sentinel it wraps, if it is one of sentinels.
+type callError struct {
+	Rejection *exchange.Rejection `json:"rejection,omitempty"`
+	Sentinel  string              `json:"sentinel,omitempty"`
+	Msg       string              `json:"msg,omitempty"`
+}
+
+// sentinels are the errors callers tell apart with errors.Is, by the name
+// they cross by.
+var sentinels = map[string]error{
+	"exchange.ErrMarketNotFound":         exchange.ErrMarketNotFound,
+	"exchange.ErrMarketNotEmpty":         exchange.ErrMarketNotEmpty,
+	"exchange.ErrSandboxDisabled":        exchange.ErrSandboxDisabled,
+	"exchange.ErrInvalidWindow":          exchange.ErrInvalidWindow,
+	"exchange.ErrInvalidTransfer":        exchange.ErrInvalidTransfer,
+	"exchange.ErrTransferReference":      exchange.ErrTransferReference,
+	"ledger.ErrUnbalanced":               ledger.ErrUnbalanced,
+	"ledger.ErrInsufficientFunds":        ledger.ErrInsufficientFunds,
+	"ledger.ErrInvalidAsset":             ledger.ErrInvalidAsset,
+	"ledger.ErrInvalidAmount":            ledger.ErrInvalidAmount,
+	"orderbook.ErrOrderNotFound":         orderbook.ErrOrderNotFound,
+	"orderbook.ErrInsufficientLiquidity": orderbook.ErrInsufficientLiquidity,
+	"orderbook.ErrAuctionInProgress":     orderbook.ErrAuctionInProgress,
+	"user.ErrInvalidName":                user.ErrInvalidName,
+	"user.ErrNameTaken":                  user.ErrNameTaken,
+	"user.ErrNotFound":                   user.ErrNotFound,
+	"user.ErrWeakPassword":               user.ErrWeakPassword,
+	"user.ErrBadCredentials":             user.ErrBadCredentials,
+	"context.Canceled":                   context.Canceled,
+	"context.DeadlineExceeded":           context.DeadlineExceeded,
+}
+
+func encodeError(err error) *callError {
+	if err == nil {
+		return nil
+	}
+	var rejection *exchange.Rejection
+	if errors.As(err, &rejection) {
+		return &callError{Rejection: rejection}
+	}
+	e := &callError{Msg: err.Error()}
+	for name, sentinel := range sentinels {
+		if errors.Is(err, sentinel) {
+			e.Sentinel = name
+			break
+		}
+	}
+	return e
+}
+
+func (e *callError) err() error {
+	switch {
+	case e == nil:
+		return nil
+	case e.Rejection != nil:
+		return e.Rejection
+	default:
+		return &remoteError{msg: e.Msg, sentinel: sentinels[e.Sentinel]}
+	}
+}
+
+// remoteError is an error the engine returned, which is the sentinel it
+// wrapped there, if any.
+type remoteError struct {
+	msg      string
+	sentinel error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.sentinel }
+
+const serviceName = "exchange.internal.Engine"
+
+// engineServer is what serviceDesc dispatches to.
+type engineServer interface {
+	call(ctx context.Context, c *call) (*reply, error)
+	subscribe(c *call, stream grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*engineServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Call",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			c := new(call)
+			if err := dec(c); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return srv.(engineServer).call(ctx, c)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: callMethod}
+			return interceptor(ctx, c, info, func(ctx context.Context, req any) (any, error) {
+				return srv.(engineServer).call(ctx, req.(*call))
+			})
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Subscribe",
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			c := new(call)
+			if err := stream.RecvMsg(c); err != nil {
+				return err
+			}
+			return srv.(engineServer).subscribe(c, stream)
+		},
+		ServerStreams: true,
+	}},
+}
+
+const (
+	callMethod      = "/" + serviceName + "/Call"
+	subscribeMethod = "/" + serviceName + "/Subscribe"
+)
@@ -0,0 +1,190 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// px and sz are the default scale's units of a decimal price and size.
+func px(v float64) orderbook.Price { return orderbook.DefaultScale.PriceOf(v) }
+func sz(v float64) orderbook.Size  { return orderbook.DefaultScale.SizeOf(v) }
+
+// serve serves ex and its users in memory, returning a client dialed to them
+// and the server.
+func serve(t *testing.T, ex *exchange.Exchange) (*Client, *grpc.Server) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	g := grpc.NewServer()
+	Register(g, ex)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, "passthrough:///engine", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, g
+}
+
+// sameJSON reports whether got and want encode alike, as the gateway
+// answers with their encoding: an empty slice may arrive as nil.
+func sameJSON(got, want any) bool {
+	a, _ := json.Marshal(got)
+	b, _ := json.Marshal(want)
+	return string(a) == string(b)
+}
+
+func TestCalls(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	defer ex.Close()
+	c, _ := serve(t, ex)
+	ctx := context.Background()
+
+	alice, key, err := c.Users().Register("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.Users().Authenticate(key); !ok || got != alice {
+		t.Fatalf("expected the key to authenticate alice, got %+v, %v", got, ok)
+	}
+	if _, _, err := c.Users().Register("alice", ""); !errors.Is(err, user.ErrNameTaken) {
+		t.Fatalf("expected the name to be taken, got %v", err)
+	}
+	bob, _, _ := ex.Users().Register("bob", "")
+
+	if _, err := c.Deposit(alice.ID, ledger.USD, 1000); err != nil {
+		t.Fatal(err)
+	}
+	c.Deposit(bob.ID, ledger.ETH, 5)
+	if _, err := c.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(101), User: bob.ID, Market: exchange.MarketEth}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(102), User: alice.ID, Market: exchange.MarketEth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, _ := ex.Order(alice.ID, report.OrderID)
+	if got, err := c.Order(alice.ID, report.OrderID); err != nil || !sameJSON(got, direct) {
+		t.Fatalf("got order %+v, %v, want %+v", got, err, direct)
+	}
+
+	// the engine's answers arrive as they are
+	for _, id := range []uint64{alice.ID, bob.ID} {
+		if got, want := c.Balances(id), ex.Balances(id); !sameJSON(got, want) {
+			t.Errorf("user %d has balances %v, want %v", id, got, want)
+		}
+		if got, want := c.UserOrders(id), ex.UserOrders(id); !sameJSON(got, want) {
+			t.Errorf("user %d has orders %+v, want %+v", id, got, want)
+		}
+		if got, want := c.Fills(id), ex.Fills(id); !sameJSON(got, want) {
+			t.Errorf("user %d has fills %+v, want %+v", id, got, want)
+		}
+	}
+	gotDepth, err := c.GetDepth(exchange.MarketEth, 10)
+	wantDepth, _ := ex.GetDepth(exchange.MarketEth, 10)
+	if err != nil || !sameJSON(gotDepth, wantDepth) {
+		t.Errorf("got depth %+v, %v, want %+v", gotDepth, err, wantDepth)
+	}
+	gotAssets, err := c.Assets(exchange.MarketEth)
+	wantAssets, _ := ex.Assets(exchange.MarketEth)
+	if err != nil || !sameJSON(gotAssets, wantAssets) {
+		t.Errorf("got assets %+v, %v, want %+v", gotAssets, err, wantAssets)
+	}
+	gotTrades, err := c.RecentTrades(exchange.MarketEth, 10)
+	wantTrades, _ := ex.RecentTrades(exchange.MarketEth, 10)
+	if err != nil || len(gotTrades) != 1 || !sameJSON(gotTrades, wantTrades) {
+		t.Errorf("got trades %+v, %v, want %+v", gotTrades, err, wantTrades)
+	}
+	gotExport, err := c.Export(exchange.MarketEth)
+	wantExport, _ := ex.Export(exchange.MarketEth)
+	if err != nil || !sameJSON(gotExport, wantExport) {
+		t.Errorf("got export %+v, %v, want %+v", gotExport, err, wantExport)
+	}
+
+	// and so do its errors
+	if _, err := c.GetDepth("DOGE", 10); !errors.Is(err, exchange.ErrMarketNotFound) {
+		t.Errorf("expected an unknown market, got %v", err)
+	}
+	_, err = c.CancelOrder(ctx, alice.ID, 12345)
+	var rejection *exchange.Rejection
+	if !errors.As(err, &rejection) || rejection.Code != "ORDER_NOT_FOUND" {
+		t.Errorf("expected the cancel to be rejected, got %v", err)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	defer ex.Close()
+	c, _ := serve(t, ex)
+	ctx := context.Background()
+
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(101), Market: exchange.MarketEth})
+	snapshot, seq, updates, unsubscribe, err := c.SnapshotFeed(exchange.MarketEth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSnapshot, wantSeq, _, stop, _ := ex.SnapshotFeed(exchange.MarketEth)
+	stop()
+	if !sameJSON(snapshot, wantSnapshot) || seq != wantSeq {
+		t.Fatalf("got snapshot %+v at %d, want %+v at %d", snapshot, seq, wantSnapshot, wantSeq)
+	}
+
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(101), Market: exchange.MarketEth})
+	select {
+	case batch := <-updates:
+		if len(batch) == 0 || batch[0].Type != exchange.FeedTrade || batch[0].Seq != seq+1 {
+			t.Fatalf("expected the trade, got %+v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update")
+	}
+
+	unsubscribe()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			// at most the batch in flight
+			<-updates
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unsubscribing didn't close the updates")
+	}
+
+	if _, _, err := c.SubscribeFeed("DOGE"); !errors.Is(err, exchange.ErrMarketNotFound) {
+		t.Errorf("expected an unknown market, got %v", err)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	defer ex.Close()
+	ex.SetReady(true)
+	c, g := serve(t, ex)
+	if !c.Ready() {
+		t.Fatal("expected the engine to be ready")
+	}
+
+	g.Stop()
+	if _, err := c.Deposit(1, ledger.USD, 1); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected the engine to be unavailable, got %v", err)
+	}
+	if c.Ready() {
+		t.Error("expected a gateway without its engine not to be ready")
+	}
+}
@@ -0,0 +1,285 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Register serves ex and its users on g, for gateways to reach with Dial.
+// The protocol doesn't authenticate its callers, so g must only be
+// reachable by the exchange's own processes.
+func Register(g *grpc.Server, ex *exchange.Exchange) {
+	g.RegisterService(&serviceDesc, &server{ex: ex, users: ex.Users()})
+}
+
+type server struct {
+	ex    *exchange.Exchange
+	users *exchange.Users
+}
+
+// result is the reply carrying v, or err if the method failed.
+func result(v any, err error) (*reply, error) {
+	if err != nil {
+		return &reply{Error: encodeError(err)}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &reply{Result: data}, nil
+}
+
+func (s *server) call(ctx context.Context, c *call) (*reply, error) {
+	ex, a := s.ex, c.Args
+	switch c.Method {
+	case "PlaceOrder":
+		if a.Place == nil {
+			break
+		}
+		return result(ex.PlaceOrder(ctx, *a.Place))
+	case "ModifyOrder":
+		if a.Modify == nil {
+			break
+		}
+		return result(ex.ModifyOrder(ctx, a.User, a.ID, *a.Modify))
+	case "ReduceOrder":
+		if a.Reduce == nil {
+			break
+		}
+		return result(ex.ReduceOrder(ctx, a.User, a.ID, *a.Reduce))
+	case "Cancel":
+		if a.Cancel == nil {
+			break
+		}
+		return result(ex.Cancel(ctx, *a.Cancel))
+	case "CancelOrder":
+		return result(ex.CancelOrder(ctx, a.User, a.ID))
+	case "CancelOrderByClientID":
+		return result(ex.CancelOrderByClientID(ctx, a.User, a.ClientOrderID))
+	case "Order":
+		return result(ex.Order(a.User, a.ID))
+	case "OrderByClientID":
+		return result(ex.OrderByClientID(a.User, a.ClientOrderID))
+	case "UserOrders":
+		return result(ex.UserOrders(a.User), nil)
+	case "Fills":
+		return result(ex.Fills(a.User), nil)
+	case "UserTrades":
+		return result(ex.UserTrades(a.User, a.Market, a.ID, a.Limit))
+	case "Positions":
+		return result(ex.Positions(a.User), nil)
+	case "Balances":
+		return result(ex.Balances(a.User), nil)
+	case "Held":
+		return result(ex.Held(a.User), nil)
+	case "Deposit":
+		return result(ex.Deposit(a.User, a.Asset, a.Amount))
+	case "Statement":
+		return result(ex.Statement(a.User), nil)
+	case "Withdraw":
+		return result(ex.Withdraw(a.User, a.Asset, a.Amount))
+	case "Transfer":
+		if a.Transfer == nil {
+			break
+		}
+		return result(ex.Transfer(*a.Transfer))
+	case "Fees":
+		return result(ex.Fees(), nil)
+	case "WithdrawFees":
+		return result(ex.WithdrawFees(a.User, a.Asset, a.Amount))
+	case "Markets":
+		return result(ex.Markets(), nil)
+	case "Sandbox":
+		return result(ex.Sandbox(), nil)
+	case "Ready":
+		return result(ex.Ready(), nil)
+	case "SetReady":
+		ex.SetReady(a.Ready)
+		return result(nil, nil)
+	case "Book":
+		return result(ex.Book(a.Market, a.Asks, a.Bids))
+	case "GetDepth":
+		return result(ex.GetDepth(a.Market, a.Depth))
+	case "GetDepths":
+		return result(ex.GetDepths(a.Markets, a.Depth), nil)
+	case "LevelQueue":
+		return result(ex.LevelQueue(a.Market, a.Side, a.Price))
+	case "RecentTrades":
+		return result(ex.RecentTrades(a.Market, a.Limit))
+	case "Ticker":
+		return result(ex.Ticker(a.Market))
+	case "Assets":
+		return result(ex.Assets(a.Market))
+	case "Increments":
+		return result(ex.Increments(a.Market))
+	case "Limits":
+		return result(ex.Limits(a.Market))
+	case "PatchLimits":
+		if a.Patch == nil {
+			break
+		}
+		return result(ex.PatchLimits(a.Market, *a.Patch))
+	case "UserLimits":
+		return result(ex.UserLimits(a.User), nil)
+	case "SetUserLimits":
+		if a.UserLimits == nil {
+			break
+		}
+		return result(ex.SetUserLimits(a.User, *a.UserLimits))
+	case "SuspendUser":
+		return result(ex.SuspendUser(ctx, a.User, a.CancelOrders))
+	case "ResumeUser":
+		return result(nil, ex.ResumeUser(a.User))
+	case "FreezeOrder":
+		return result(ex.FreezeOrder(ctx, a.ID))
+	case "Quality":
+		return result(ex.Quality(a.Market, a.Window))
+	case "Stats":
+		return result(ex.Stats(a.Market))
+	case "Auction":
+		return result(ex.Auction(a.Market))
+	case "StartAuction":
+		return result(ex.StartAuction(a.Market))
+	case "ExecuteAuction":
+		return result(ex.ExecuteAuction(a.Market))
+	case "Reset":
+		removed, seq, err := ex.Reset(a.Market, a.ClearStats)
+		return result(resetResult{removed, seq}, err)
+	case "Export":
+		return result(ex.Export(a.Market))
+	case "Import":
+		if a.Snapshot == nil {
+			break
+		}
+		return result(ex.Import(a.Market, *a.Snapshot, a.Replace))
+	case "QueryAudit":
+		if a.Audit == nil {
+			break
+		}
+		return result(ex.QueryAudit(*a.Audit))
+	case "RejectInvalid":
+		return result(ex.RejectInvalid(a.Action, a.Market, a.Raw, errors.New(a.Reason)), nil)
+	case "RejectMalformed":
+		return result(ex.RejectMalformed(a.Action, a.Raw, errors.New(a.Reason)), nil)
+	case "SandboxSeed":
+		if a.Seed == nil {
+			break
+		}
+		return result(ex.SandboxSeed(a.Market, *a.Seed))
+	case "SandboxReset":
+		return result(nil, ex.SandboxReset())
+	case "SandboxFaucet":
+		return result(ex.SandboxFaucet(a.User, a.Asset, a.Amount))
+
+	case "Register":
+		u, key, err := s.users.Register(a.Name, a.Password)
+		return result(registration{u, key}, err)
+	case "Login":
+		return result(s.users.Login(a.Name, a.Password))
+	case "Authenticate":
+		u, ok := s.users.Authenticate(a.Key)
+		return result(authentication{u, ok}, nil)
+	case "GetUser":
+		return result(s.users.Get(a.ID))
+	case "KeySettings":
+		return result(s.users.KeySettings(a.Key))
+	case "SetKeySettings":
+		if a.Settings == nil {
+			break
+		}
+		return result(nil, s.users.SetKeySettings(a.Key, *a.Settings))
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unknown method %q", c.Method)
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "%s is missing its request", c.Method)
+}
+
+// resetResult is what Reset returns.
+type resetResult struct {
+	Removed int    `json:"removed"`
+	Seq     uint64 `json:"seq"`
+}
+
+// registration is what Registry.Register returns.
+type registration struct {
+	User user.User `json:"user"`
+	Key  string    `json:"key"`
+}
+
+// authentication is what Registry.Authenticate returns.
+type authentication struct {
+	User user.User `json:"user"`
+	OK   bool      `json:"ok"`
+}
+
+// snapshotResult is what SnapshotFeed returns besides its updates.
+type snapshotResult struct {
+	Snapshot []exchange.FeedMessage `json:"snapshot"`
+	Seq      uint64                 `json:"seq"`
+}
+
+func (s *server) subscribe(c *call, stream grpc.ServerStream) error {
+	ex, a := s.ex, c.Args
+	switch c.Method {
+	case "Subscribe":
+		updates, unsubscribe, err := ex.Subscribe(a.Market)
+		return forward(stream, nil, updates, unsubscribe, err)
+	case "SubscribeFeed":
+		updates, unsubscribe, err := ex.SubscribeFeed(a.Market)
+		return forward(stream, nil, updates, unsubscribe, err)
+	case "SnapshotFeed":
+		snapshot, seq, updates, unsubscribe, err := ex.SnapshotFeed(a.Market)
+		return forward(stream, snapshotResult{snapshot, seq}, updates, unsubscribe, err)
+	case "ResumeFeed":
+		resume, updates, unsubscribe, err := ex.ResumeFeed(a.Market, a.Seq)
+		return forward(stream, resume, updates, unsubscribe, err)
+	case "ResumeTrades":
+		missed, updates, unsubscribe, err := ex.ResumeTrades(a.Market, a.Seq)
+		return forward(stream, missed, updates, unsubscribe, err)
+	case "SubscribeOrderUpdates":
+		updates, unsubscribe := ex.SubscribeOrderUpdates(a.User)
+		return forward(stream, nil, updates, unsubscribe, nil)
+	default:
+		return status.Errorf(codes.Unimplemented, "unknown subscription %q", c.Method)
+	}
+}
+
+// forward sends first, or err if subscribing failed, then each batch from
+// updates until the exchange closes it or the gateway goes.
+func forward[T any](stream grpc.ServerStream, first any, updates <-chan T, unsubscribe func(), err error) error {
+	if err != nil {
+		return stream.SendMsg(&reply{Error: encodeError(err)})
+	}
+	defer unsubscribe()
+	r, err := result(first, nil)
+	if err == nil {
+		err = stream.SendMsg(r)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case batch, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			r, err := result(batch, nil)
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(r); err != nil {
+				return err
+			}
+		}
+	}
+}
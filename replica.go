@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/thenaveensharma/exchange/replica"
+)
+
+// newReplica sets up this process's node of a Raft cluster, named id, from
+// EXCHANGE_RAFT_ADDR, the address the other nodes reach it at,
+// EXCHANGE_RAFT_DIR, where it keeps its log and snapshots, and
+// EXCHANGE_RAFT_PEERS, the nodes the cluster starts with. Without peers it
+// is a cluster of one.
+func newReplica(id string) *replica.Node {
+	addr := os.Getenv("EXCHANGE_RAFT_ADDR")
+	dir := os.Getenv("EXCHANGE_RAFT_DIR")
+	if addr == "" || dir == "" {
+		slog.Error("EXCHANGE_RAFT_ADDR and EXCHANGE_RAFT_DIR are required with EXCHANGE_RAFT_ID")
+		os.Exit(1)
+	}
+	peers, err := parsePeers(os.Getenv("EXCHANGE_RAFT_PEERS"))
+	if err != nil {
+		slog.Error("invalid EXCHANGE_RAFT_PEERS", "error", err)
+		os.Exit(1)
+	}
+	if _, ok := peers[id]; !ok {
+		peers[id] = addr
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		slog.Error("invalid EXCHANGE_RAFT_ADDR", "addr", addr, "error", err)
+		os.Exit(1)
+	}
+	transport, err := raft.NewTCPTransport(addr, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		slog.Error("failed to listen on EXCHANGE_RAFT_ADDR", "addr", addr, "error", err)
+		os.Exit(1)
+	}
+	return replica.New(replica.Config{ID: id, Dir: dir, Transport: transport, Peers: peers})
+}
+
+// parsePeers parses a comma-separated list of id=address pairs.
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	if s == "" {
+		return peers, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("%q is not id=address", pair)
+		}
+		if _, ok := peers[id]; ok {
+			return nil, fmt.Errorf("peer %q is listed twice", id)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
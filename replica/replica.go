@@ -0,0 +1,268 @@
+// Package replica replicates an exchange across nodes with Raft. The leader
+// journals each command to the Raft log before applying it, as it would to
+// a write-ahead log, and the other nodes stand by, applying each command
+// once the cluster commits it, so whichever takes over when the leader
+// fails has the same books, balances and holds the leader had.
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// ErrLeadershipLost is sent on Failed when a leading node stops leading.
+var ErrLeadershipLost = errors.New("replica: leadership lost")
+
+// Config configures a Node.
+type Config struct {
+	// ID names the node in the cluster.
+	ID string
+	// Dir is where the node keeps its log, its vote and its snapshots.
+	Dir string
+	// Transport carries Raft's messages between the nodes, such as a
+	// raft.NetworkTransport.
+	Transport raft.Transport
+	// Peers are the nodes the cluster starts with, this one included, by ID
+	// to address. A node with state from an earlier start ignores them.
+	Peers map[string]string
+	// Raft tunes Raft's timeouts and snapshots. Nil is raft.DefaultConfig.
+	Raft *raft.Config
+}
+
+// Node is an exchange's place in the cluster, and the journal it journals
+// commands to. Create it, give it to the exchange as Config.Journal, then
+// Start it with the exchange.
+type Node struct {
+	cfg   Config
+	raft  *raft.Raft
+	store *logStore
+	ex    *exchange.Exchange
+	// leading is set once the node leads with its exchange caught up; the
+	// commands committed from then on are its own, already applied
+	leading atomic.Bool
+	failed  chan error
+	fail    sync.Once
+	done    chan struct{}
+	closed  sync.Once
+}
+
+// New returns a node configured by cfg.
+func New(cfg Config) *Node {
+	return &Node{cfg: cfg, failed: make(chan error, 1), done: make(chan struct{})}
+}
+
+// Start joins the cluster with ex standing by: ex follows the commands the
+// cluster commits, starting from the node's latest snapshot, until Lead
+// makes it lead. ex must be new, and journal to n.
+func (n *Node) Start(ex *exchange.Exchange) error {
+	conf := raft.DefaultConfig()
+	if n.cfg.Raft != nil {
+		conf = n.cfg.Raft
+	} else {
+		conf.LogLevel = "WARN"
+	}
+	conf.LocalID = raft.ServerID(n.cfg.ID)
+
+	store, err := openLogStore(n.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(n.cfg.Dir, 2, os.Stderr)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	started, err := raft.HasExistingState(store, store, snapshots)
+	if err == nil && !started {
+		err = raft.BootstrapCluster(conf, store, store, snapshots, n.cfg.Transport, n.configuration())
+	}
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	n.ex, n.store = ex, store
+	ex.Follow()
+	if n.raft, err = raft.NewRaft(conf, (*fsm)(n), store, store, snapshots, n.cfg.Transport); err != nil {
+		store.Close()
+		return err
+	}
+	return nil
+}
+
+// configuration is the cluster Peers start it with.
+func (n *Node) configuration() raft.Configuration {
+	var conf raft.Configuration
+	for _, id := range slices.Sorted(maps.Keys(n.cfg.Peers)) {
+		conf.Servers = append(conf.Servers, raft.Server{
+			ID:      raft.ServerID(id),
+			Address: raft.ServerAddress(n.cfg.Peers[id]),
+		})
+	}
+	return conf
+}
+
+// Lead waits until the node is elected leader and its exchange has applied
+// every command committed before, then makes the exchange lead: it takes
+// requests from then on and journals them through the node. If the node
+// stops leading afterwards, ErrLeadershipLost is sent on Failed.
+func (n *Node) Lead(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-n.failed:
+			n.failed <- err
+			return err
+		case leader := <-n.raft.LeaderCh():
+			if !leader {
+				continue
+			}
+		}
+		// the commands earlier leaders had committed are applied first
+		err := n.raft.Barrier(0).Error()
+		if errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrNotLeader) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	n.leading.Store(true)
+	n.ex.Lead()
+	go n.watchLeadership()
+	return nil
+}
+
+func (n *Node) watchLeadership() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case leader := <-n.raft.LeaderCh():
+			if !leader {
+				n.stop(ErrLeadershipLost)
+				return
+			}
+		}
+	}
+}
+
+// Failed delivers why the node can't go on: its leadership was lost, or a
+// command or snapshot couldn't be applied. Its exchange can no longer be
+// trusted to match the cluster's, so the process should stop; started
+// again, the node stands by and catches up.
+func (n *Node) Failed() <-chan error {
+	return n.failed
+}
+
+func (n *Node) stop(err error) {
+	n.fail.Do(func() { n.failed <- err })
+}
+
+// Leader returns the address of the cluster's leader, if it knows it.
+func (n *Node) Leader() string {
+	addr, _ := n.raft.LeaderWithID()
+	return string(addr)
+}
+
+// Append journals cmd to the Raft log, returning once the cluster has
+// committed it. It fails with raft.ErrNotLeader on a node that doesn't
+// lead. Failing any other way, cmd may still be committed, but the node has
+// stopped leading and reports it on Failed.
+func (n *Node) Append(cmd exchange.Command) error {
+	if n.raft == nil {
+		return errors.New("replica: node not started")
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return n.raft.Apply(data, 0).Error()
+}
+
+// Shutdown leaves the cluster and closes the node's log.
+func (n *Node) Shutdown() error {
+	n.closed.Do(func() { close(n.done) })
+	if n.raft == nil {
+		return nil
+	}
+	err := n.raft.Shutdown().Error()
+	if closeErr := n.store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fsm is the node as Raft's state machine: its exchange.
+type fsm Node
+
+func (f *fsm) Apply(log *raft.Log) any {
+	n := (*Node)(f)
+	if n.leading.Load() {
+		return nil
+	}
+	var cmd exchange.Command
+	err := json.Unmarshal(log.Data, &cmd)
+	if err == nil {
+		_, err = n.ex.Apply(cmd)
+	}
+	if err != nil {
+		err = fmt.Errorf("entry %d: %w", log.Index, err)
+		slog.Error("failed to apply replicated command", "error", err)
+		n.stop(err)
+	}
+	return err
+}
+
+// Snapshot defers taking the exchange's checkpoint to Persist, which runs
+// alongside the commands that follow. The checkpoint may so include more
+// commands than the snapshot's entries, which is no harm: restoring it
+// skips them.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return checkpointSnapshot{(*Node)(f).ex}, nil
+}
+
+// Restore loads a snapshot into the exchange. Only a new exchange can be
+// restored into, so a standby that has fallen too far behind to catch up
+// by commands fails, and is restored from the snapshot when started again.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	n := (*Node)(f)
+	var cp exchange.Checkpoint
+	err := json.NewDecoder(r).Decode(&cp)
+	if err == nil {
+		err = n.ex.Restore(cp)
+	}
+	if err != nil {
+		n.stop(fmt.Errorf("restoring snapshot: %w", err))
+	}
+	return err
+}
+
+type checkpointSnapshot struct {
+	ex *exchange.Exchange
+}
+
+func (s checkpointSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.ex.Checkpoint()); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (checkpointSnapshot) Release() {}
@@ -0,0 +1,161 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// px and sz are the default scale's units of a decimal price and size.
+func px(v float64) orderbook.Price { return orderbook.DefaultScale.PriceOf(v) }
+func sz(v float64) orderbook.Size  { return orderbook.DefaultScale.SizeOf(v) }
+
+type testNode struct {
+	node      *Node
+	ex        *exchange.Exchange
+	transport *raft.InmemTransport
+}
+
+// startCluster starts n nodes connected in memory, each with a new exchange
+// standing by.
+func startCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	peers := make(map[string]string)
+	transports := make([]*raft.InmemTransport, n)
+	for i := range transports {
+		id := fmt.Sprintf("node%d", i)
+		_, transports[i] = raft.NewInmemTransport(raft.ServerAddress(id))
+		peers[id] = id
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		conf := raft.DefaultConfig()
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogOutput = io.Discard
+		node := New(Config{ID: fmt.Sprintf("node%d", i), Dir: t.TempDir(), Transport: transports[i], Peers: peers, Raft: conf})
+		ex := exchange.New(exchange.Config{AnonymousOrders: true, Journal: node})
+		if err := node.Start(ex); err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = &testNode{node, ex, transports[i]}
+		t.Cleanup(func() {
+			node.Shutdown()
+			ex.Close()
+		})
+	}
+	return nodes
+}
+
+// elect waits for one of nodes to lead, and returns it.
+func elect(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	led := make(chan *testNode, len(nodes))
+	for _, n := range nodes {
+		go func() {
+			if n.node.Lead(ctx) == nil {
+				led <- n
+			}
+		}()
+	}
+	select {
+	case n := <-led:
+		// the others give up waiting
+		cancel()
+		return n
+	case <-ctx.Done():
+		t.Fatal("no node was elected")
+		return nil
+	}
+}
+
+// waitForState waits for follower's exchange to apply every command
+// leader's has.
+func waitForState(t *testing.T, leader, follower *exchange.Exchange) {
+	t.Helper()
+	want := leader.Checkpoint()
+	want.Time = 0
+	var got exchange.Checkpoint
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got = follower.Checkpoint()
+		got.Time = 0
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Fatalf("follower has\n%+v\nwant\n%+v", got, want)
+}
+
+func TestFailover(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := elect(t, nodes)
+	ctx := context.Background()
+	const alice, bob = 1, 2
+
+	leader.ex.Deposit(alice, ledger.USD, 1000)
+	leader.ex.Deposit(bob, ledger.ETH, 5)
+	leader.ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(101), User: bob, Market: exchange.MarketEth})
+	leader.ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(99), User: alice, Market: exchange.MarketEth})
+	leader.ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(0.5), User: alice, Market: exchange.MarketEth})
+	var standbys []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			standbys = append(standbys, n)
+			waitForState(t, leader.ex, n.ex)
+		}
+	}
+
+	// a standby refuses requests of its own
+	if err := standbys[0].node.Append(exchange.Command{Type: exchange.CommandDeposit}); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected a standby to refuse commands, got %v", err)
+	}
+
+	// cut off from the others, the leader stops leading and one of the
+	// standbys takes over with the same state, and carries on
+	want := leader.ex.Checkpoint()
+	leader.transport.DisconnectAll()
+	for _, n := range standbys {
+		n.transport.Disconnect(leader.transport.LocalAddr())
+	}
+	next := elect(t, standbys)
+	got := next.ex.Checkpoint()
+	got.Time, want.Time = 0, 0
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("new leader has\n%+v\nwant\n%+v", got, want)
+	}
+	if _, err := next.ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(102), User: bob, Market: exchange.MarketEth}); err != nil {
+		t.Fatalf("new leader refused an order: %v", err)
+	}
+	for _, n := range standbys {
+		if n != next {
+			waitForState(t, next.ex, n.ex)
+		}
+	}
+	select {
+	case err := <-leader.node.Failed():
+		if !errors.Is(err, ErrLeadershipLost) {
+			t.Fatalf("old leader failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("old leader didn't report losing leadership")
+	}
+}
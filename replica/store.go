@@ -0,0 +1,201 @@
+package replica
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/thenaveensharma/exchange/internal/atomicfile"
+	"github.com/thenaveensharma/exchange/wal"
+)
+
+// errNotFound is what Raft expects of a StableStore asked for a key it
+// doesn't have.
+var errNotFound = errors.New("not found")
+
+// logStore keeps a node's Raft log in a write-ahead log, and in memory to
+// read it back, and its term and vote in a file beside it. It is Raft's
+// LogStore and StableStore.
+type logStore struct {
+	mu  sync.RWMutex
+	wal *wal.Log
+	// entries are the log's entries, by consecutive index
+	entries []*raft.Log
+
+	statePath string
+	state     map[string][]byte
+}
+
+func openLogStore(dir string) (*logStore, error) {
+	log, err := wal.Open(filepath.Join(dir, "raft.wal"))
+	if err != nil {
+		return nil, err
+	}
+	s := &logStore{wal: log, statePath: filepath.Join(dir, "raft-state.json"), state: make(map[string][]byte)}
+	for data, err := range log.Records() {
+		entry := &raft.Log{}
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		if err != nil {
+			log.Close()
+			return nil, err
+		}
+		s.entries = append(s.entries, entry)
+	}
+	data, err := os.ReadFile(s.statePath)
+	if err == nil {
+		err = json.Unmarshal(data, &s.state)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *logStore) FirstIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return 0, nil
+	}
+	return s.entries[0].Index, nil
+}
+
+func (s *logStore) LastIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return 0, nil
+	}
+	return s.entries[len(s.entries)-1].Index, nil
+}
+
+func (s *logStore) GetLog(index uint64, log *raft.Log) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 || index < s.entries[0].Index || index > s.entries[len(s.entries)-1].Index {
+		return raft.ErrLogNotFound
+	}
+	*log = *s.entries[index-s.entries[0].Index]
+	return nil
+}
+
+func (s *logStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs appends logs, which follow the log's last entry, or start it
+// if it is empty.
+func (s *logStore) StoreLogs(logs []*raft.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, log := range logs {
+		if n := len(s.entries); n > 0 && log.Index != s.entries[n-1].Index+1 {
+			return fmt.Errorf("entry %d doesn't follow entry %d", log.Index, s.entries[n-1].Index)
+		}
+		data, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		if err := s.wal.Append(data); err != nil {
+			return err
+		}
+		s.entries = append(s.entries, log)
+	}
+	return nil
+}
+
+// DeleteRange deletes the entries from lo to hi. Raft only deletes from
+// the front of the log, once a snapshot covers the entries, or from the
+// back, when a new leader's log replaces them.
+func (s *logStore) DeleteRange(lo, hi uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil
+	}
+	first, last := s.entries[0].Index, s.entries[len(s.entries)-1].Index
+	if hi < first || lo > last {
+		return nil
+	}
+	switch {
+	case lo <= first:
+		n := int(min(hi, last) - first + 1)
+		if err := s.wal.TrimFront(n); err != nil {
+			return err
+		}
+		s.entries = slices.Delete(s.entries, 0, n)
+	case hi >= last:
+		n := int(last - lo + 1)
+		if err := s.wal.TrimBack(n); err != nil {
+			return err
+		}
+		s.entries = s.entries[:len(s.entries)-n]
+	default:
+		return fmt.Errorf("can't delete entries %d to %d from the middle of the log", lo, hi)
+	}
+	return nil
+}
+
+// Set stores val under key, rewriting the state file, which is only done
+// when the node's term or vote changes.
+func (s *logStore) Set(key, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := maps.Clone(s.state)
+	state[string(key)] = slices.Clone(val)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(s.statePath, data); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+func (s *logStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val, ok := s.state[string(key)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return val, nil
+}
+
+func (s *logStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, val))
+}
+
+func (s *logStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("%s is not a uint64", key)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+func (s *logStore) Close() error {
+	return s.wal.Close()
+}
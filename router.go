@@ -0,0 +1,594 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// errDepositMarket is returned by router.Deposit for an asset traded on
+// markets running on different engines, which each hold funds of their own.
+var errDepositMarket = errors.New("asset is traded on more than one engine: deposit it for a market")
+
+// router is an engine whose markets run on several engines, each market on
+// one of them, so a busy market only slows its own engine and markets can
+// be spread across as many as load requires.
+//
+// Each engine settles its markets against balances of its own: an order is
+// backed by funds deposited to the engine running its market, and a user's
+// balance is the sum of theirs on every engine. Order IDs must not repeat
+// between engines, which EXCHANGE_SHARD_ID sees to.
+type router struct {
+	// engines are the engines in the order they were given; the first one
+	// answers for markets none of them runs, so the answer is the usual
+	// one
+	engines  []engine
+	markets  []exchange.Market
+	byMarket map[exchange.Market]engine
+}
+
+var _ engine = (*router)(nil)
+
+// newRouter routes to engines the markets each runs. A market may only run
+// on one of them.
+func newRouter(engines []engine) (*router, error) {
+	r := &router{engines: engines, byMarket: make(map[exchange.Market]engine)}
+	for _, e := range engines {
+		for _, market := range e.Markets() {
+			if _, ok := r.byMarket[market]; ok {
+				return nil, fmt.Errorf("market %s runs on more than one engine", market)
+			}
+			r.byMarket[market] = e
+			r.markets = append(r.markets, market)
+		}
+	}
+	if len(r.markets) == 0 {
+		return nil, errors.New("no engine runs any markets")
+	}
+	return r, nil
+}
+
+// engine returns the engine running market.
+func (r *router) engine(market exchange.Market) engine {
+	if e, ok := r.byMarket[market]; ok {
+		return e
+	}
+	return r.engines[0]
+}
+
+// orderEngine returns the engine with user's order with id, or the first
+// one, to refuse the request as any would, if none has it. Looking the
+// order up first keeps the other engines' audit trails free of requests
+// that were never theirs.
+func (r *router) orderEngine(user, id uint64) engine {
+	for _, e := range r.engines {
+		if _, err := e.Order(user, id); err == nil {
+			return e
+		}
+	}
+	return r.engines[0]
+}
+
+// clientOrderEngine is orderEngine for the order user gave clientOrderID.
+func (r *router) clientOrderEngine(user uint64, clientOrderID string) engine {
+	for _, e := range r.engines {
+		if _, err := e.OrderByClientID(user, clientOrderID); err == nil {
+			return e
+		}
+	}
+	return r.engines[0]
+}
+
+func (r *router) PlaceOrder(ctx context.Context, req exchange.PlaceOrderRequest) (exchange.ExecutionReport, error) {
+	return r.engine(req.Market).PlaceOrder(ctx, req)
+}
+
+func (r *router) ModifyOrder(ctx context.Context, user, id uint64, req exchange.ModifyRequest) (exchange.ExecutionReport, error) {
+	return r.orderEngine(user, id).ModifyOrder(ctx, user, id, req)
+}
+
+func (r *router) ReduceOrder(ctx context.Context, user, id uint64, req exchange.ReduceRequest) (exchange.OrderReduce, error) {
+	return r.orderEngine(user, id).ReduceOrder(ctx, user, id, req)
+}
+
+func (r *router) Cancel(ctx context.Context, req exchange.CancelRequest) (exchange.CancelResult, error) {
+	return r.engine(req.Market).Cancel(ctx, req)
+}
+
+func (r *router) CancelOrder(ctx context.Context, user, id uint64) (exchange.OrderCancel, error) {
+	return r.orderEngine(user, id).CancelOrder(ctx, user, id)
+}
+
+func (r *router) CancelOrderByClientID(ctx context.Context, user uint64, clientOrderID string) (exchange.OrderCancel, error) {
+	return r.clientOrderEngine(user, clientOrderID).CancelOrderByClientID(ctx, user, clientOrderID)
+}
+
+func (r *router) Order(user, id uint64) (exchange.OrderRecord, error) {
+	return r.orderEngine(user, id).Order(user, id)
+}
+
+func (r *router) OrderByClientID(user uint64, clientOrderID string) (exchange.OrderRecord, error) {
+	return r.clientOrderEngine(user, clientOrderID).OrderByClientID(user, clientOrderID)
+}
+
+// UserOrders returns user's orders on every engine, by ID.
+func (r *router) UserOrders(user uint64) []exchange.OrderRecord {
+	records := []exchange.OrderRecord{}
+	for _, e := range r.engines {
+		records = append(records, e.UserOrders(user)...)
+	}
+	slices.SortFunc(records, func(a, b exchange.OrderRecord) int { return cmp.Compare(a.ID, b.ID) })
+	return records
+}
+
+// Fills returns user's recent fills on every engine, oldest first.
+func (r *router) Fills(user uint64) []exchange.Fill {
+	fills := []exchange.Fill{}
+	for _, e := range r.engines {
+		fills = append(fills, e.Fills(user)...)
+	}
+	slices.SortStableFunc(fills, func(a, b exchange.Fill) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+	return fills
+}
+
+// Positions returns user's positions on every engine, each engine's markets
+// in its order.
+func (r *router) Positions(user uint64) []exchange.Position {
+	positions := []exchange.Position{}
+	for _, e := range r.engines {
+		positions = append(positions, e.Positions(user)...)
+	}
+	return positions
+}
+
+// Balances returns what user has free on every engine together.
+func (r *router) Balances(user uint64) map[ledger.Asset]float64 {
+	return r.sum(func(e engine) map[ledger.Asset]float64 { return e.Balances(user) })
+}
+
+// Held returns what user's open orders hold on every engine together.
+func (r *router) Held(user uint64) map[ledger.Asset]float64 {
+	return r.sum(func(e engine) map[ledger.Asset]float64 { return e.Held(user) })
+}
+
+func (r *router) sum(balances func(engine) map[ledger.Asset]float64) map[ledger.Asset]float64 {
+	total := make(map[ledger.Asset]float64)
+	for _, e := range r.engines {
+		for asset, amount := range balances(e) {
+			total[asset] += amount
+		}
+	}
+	return total
+}
+
+// Deposit credits user on the engine whose markets trade asset. An asset
+// traded on more than one engine must be deposited with DepositFor.
+func (r *router) Deposit(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	target, err := r.assetEngine(asset)
+	if err != nil {
+		return ledger.Entry{}, err
+	}
+	return target.Deposit(user, asset, amount)
+}
+
+// Transfer moves funds between users on the engine keeping balances in the
+// asset moved.
+func (r *router) Transfer(req exchange.TransferRequest) (exchange.Transfer, error) {
+	target, err := r.assetEngine(req.Asset)
+	if err != nil {
+		return exchange.Transfer{}, err
+	}
+	return target.Transfer(req)
+}
+
+// Withdraw debits user on the engine keeping balances in asset.
+func (r *router) Withdraw(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	target, err := r.assetEngine(asset)
+	if err != nil {
+		return ledger.Entry{}, err
+	}
+	return target.Withdraw(user, asset, amount)
+}
+
+// Fees merges the engines' fee reports: what their fee accounts hold
+// together, and each one's markets.
+func (r *router) Fees() exchange.FeeReport {
+	report := exchange.FeeReport{Markets: make(map[exchange.Market]map[ledger.Asset]float64)}
+	report.Balances = r.sum(func(e engine) map[ledger.Asset]float64 {
+		fees := e.Fees()
+		maps.Copy(report.Markets, fees.Markets)
+		return fees.Balances
+	})
+	return report
+}
+
+// WithdrawFees pays fees out on the engine keeping balances in asset.
+func (r *router) WithdrawFees(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	target, err := r.assetEngine(asset)
+	if err != nil {
+		return ledger.Entry{}, err
+	}
+	return target.WithdrawFees(user, asset, amount)
+}
+
+// Statement merges user's statements on every engine, oldest first. Each
+// engine numbers its own entries.
+func (r *router) Statement(user uint64) []ledger.Line {
+	var lines []ledger.Line
+	for _, e := range r.engines {
+		lines = append(lines, e.Statement(user)...)
+	}
+	slices.SortStableFunc(lines, func(a, b ledger.Line) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+	return lines
+}
+
+// assetEngine is the engine keeping balances in asset: the one running the
+// markets trading it or, if none does, the first.
+func (r *router) assetEngine(asset ledger.Asset) (engine, error) {
+	var target engine
+	for _, market := range r.markets {
+		assets, err := r.byMarket[market].Assets(market)
+		if err != nil {
+			return nil, err
+		}
+		if assets.Base != asset && assets.Quote != asset {
+			continue
+		}
+		if target != nil && target != r.byMarket[market] {
+			return nil, fmt.Errorf("%w: %s", errDepositMarket, asset)
+		}
+		target = r.byMarket[market]
+	}
+	if target == nil {
+		// an asset no market trades is kept by the first engine
+		target = r.engines[0]
+	}
+	return target, nil
+}
+
+// DepositFor credits user on the engine running market, to back orders on
+// it.
+func (r *router) DepositFor(market exchange.Market, user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	e, ok := r.byMarket[market]
+	if !ok {
+		return ledger.Entry{}, exchange.ErrMarketNotFound
+	}
+	return e.Deposit(user, asset, amount)
+}
+
+func (r *router) Markets() []exchange.Market {
+	return slices.Clone(r.markets)
+}
+
+func (r *router) Sandbox() bool {
+	return r.engines[0].Sandbox()
+}
+
+// Ready reports whether every engine is ready for traffic.
+func (r *router) Ready() bool {
+	for _, e := range r.engines {
+		if !e.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *router) SetReady(ready bool) {
+	for _, e := range r.engines {
+		e.SetReady(ready)
+	}
+}
+
+func (r *router) Book(market exchange.Market, asks, bids []exchange.Order) (exchange.OrderbookData, error) {
+	return r.engine(market).Book(market, asks, bids)
+}
+
+func (r *router) GetDepth(market exchange.Market, depth int) (exchange.MarketDepth, error) {
+	return r.engine(market).GetDepth(market, depth)
+}
+
+func (r *router) UserTrades(user uint64, market exchange.Market, after uint64, limit int) ([]exchange.UserTrade, error) {
+	return r.engine(market).UserTrades(user, market, after, limit)
+}
+
+func (r *router) RecentTrades(market exchange.Market, limit int) ([]exchange.FeedMessage, error) {
+	return r.engine(market).RecentTrades(market, limit)
+}
+
+func (r *router) LevelQueue(market exchange.Market, side orderbook.Side, price orderbook.Price) ([]exchange.QueuedOrder, error) {
+	return r.engine(market).LevelQueue(market, side, price)
+}
+
+// GetDepths asks each engine for the depths of its markets at once, in
+// parallel.
+func (r *router) GetDepths(markets []exchange.Market, depth int) []exchange.MarketDepth {
+	type batch struct {
+		indexes []int
+		markets []exchange.Market
+	}
+	batches := make(map[engine]*batch)
+	for i, market := range markets {
+		e := r.engine(market)
+		if batches[e] == nil {
+			batches[e] = &batch{}
+		}
+		batches[e].indexes = append(batches[e].indexes, i)
+		batches[e].markets = append(batches[e].markets, market)
+	}
+	depths := make([]exchange.MarketDepth, len(markets))
+	var wg sync.WaitGroup
+	for e, b := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, d := range e.GetDepths(b.markets, depth) {
+				depths[b.indexes[i]] = d
+			}
+		}()
+	}
+	wg.Wait()
+	return depths
+}
+
+func (r *router) Ticker(market exchange.Market) (exchange.Ticker, error) {
+	return r.engine(market).Ticker(market)
+}
+
+func (r *router) Assets(market exchange.Market) (exchange.MarketAssets, error) {
+	return r.engine(market).Assets(market)
+}
+
+func (r *router) Increments(market exchange.Market) (exchange.Increments, error) {
+	return r.engine(market).Increments(market)
+}
+
+func (r *router) Limits(market exchange.Market) (exchange.MarketConfig, error) {
+	return r.engine(market).Limits(market)
+}
+
+func (r *router) PatchLimits(market exchange.Market, patch exchange.LimitsPatch) (exchange.MarketConfig, error) {
+	return r.engine(market).PatchLimits(market, patch)
+}
+
+// UserLimits returns user's limits as the first engine has them; every
+// engine has the same ones.
+func (r *router) UserLimits(user uint64) exchange.UserLimits {
+	return r.engines[0].UserLimits(user)
+}
+
+// SetUserLimits sets user's limits on every engine, stopping at the first
+// that fails.
+func (r *router) SetUserLimits(user uint64, limits exchange.UserLimits) (exchange.UserLimits, error) {
+	for _, e := range r.engines {
+		if _, err := e.SetUserLimits(user, limits); err != nil {
+			return exchange.UserLimits{}, err
+		}
+	}
+	return limits, nil
+}
+
+// SuspendUser suspends user on every engine, stopping at the first that
+// fails, and returns the orders cancelled on all of them.
+func (r *router) SuspendUser(ctx context.Context, user uint64, cancel bool) ([]exchange.OrderCancel, error) {
+	cancelled := []exchange.OrderCancel{}
+	for _, e := range r.engines {
+		orders, err := e.SuspendUser(ctx, user, cancel)
+		cancelled = append(cancelled, orders...)
+		if err != nil {
+			return cancelled, err
+		}
+	}
+	return cancelled, nil
+}
+
+// ResumeUser resumes user on every engine, stopping at the first that
+// fails.
+func (r *router) ResumeUser(user uint64) error {
+	for _, e := range r.engines {
+		if err := e.ResumeUser(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FreezeOrder freezes the order with id on whichever engine has it.
+func (r *router) FreezeOrder(ctx context.Context, id uint64) (exchange.OrderRecord, error) {
+	var err error
+	for _, e := range r.engines {
+		var record exchange.OrderRecord
+		record, err = e.FreezeOrder(ctx, id)
+		var rejection *exchange.Rejection
+		if !errors.As(err, &rejection) || rejection.Code != "ORDER_NOT_FOUND" {
+			return record, err
+		}
+	}
+	return exchange.OrderRecord{}, err
+}
+
+func (r *router) Quality(market exchange.Market, window time.Duration) (exchange.BookQuality, error) {
+	return r.engine(market).Quality(market, window)
+}
+
+func (r *router) Stats(market exchange.Market) (exchange.MarketStats, error) {
+	return r.engine(market).Stats(market)
+}
+
+func (r *router) Auction(market exchange.Market) (orderbook.AuctionState, error) {
+	return r.engine(market).Auction(market)
+}
+
+func (r *router) StartAuction(market exchange.Market) (orderbook.AuctionState, error) {
+	return r.engine(market).StartAuction(market)
+}
+
+func (r *router) ExecuteAuction(market exchange.Market) ([]exchange.AuctionFill, error) {
+	return r.engine(market).ExecuteAuction(market)
+}
+
+func (r *router) Reset(market exchange.Market, clearStats bool) (int, uint64, error) {
+	return r.engine(market).Reset(market, clearStats)
+}
+
+func (r *router) Export(market exchange.Market) (exchange.MarketExport, error) {
+	return r.engine(market).Export(market)
+}
+
+func (r *router) Import(market exchange.Market, snapshot orderbook.Snapshot, replace bool) (exchange.ImportResult, error) {
+	return r.engine(market).Import(market, snapshot, replace)
+}
+
+// QueryAudit queries the engine running q.Market, or every engine for a
+// query across markets, merging their records by time.
+func (r *router) QueryAudit(q exchange.AuditQuery) ([]exchange.AuditRecord, error) {
+	if q.Market != "" {
+		return r.engine(q.Market).QueryAudit(q)
+	}
+	var records []exchange.AuditRecord
+	for _, e := range r.engines {
+		found, err := e.QueryAudit(q)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	slices.SortStableFunc(records, func(a, b exchange.AuditRecord) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+	return records, nil
+}
+
+func (r *router) RejectInvalid(action exchange.AuditAction, market exchange.Market, raw []byte, err error) *exchange.Rejection {
+	return r.engine(market).RejectInvalid(action, market, raw, err)
+}
+
+func (r *router) RejectMalformed(action exchange.AuditAction, raw []byte, err error) *exchange.Rejection {
+	return r.engines[0].RejectMalformed(action, raw, err)
+}
+
+func (r *router) SandboxSeed(market exchange.Market, seed exchange.SeedRequest) (int, error) {
+	return r.engine(market).SandboxSeed(market, seed)
+}
+
+// SandboxReset resets every engine, stopping at the first that fails.
+func (r *router) SandboxReset() error {
+	for _, e := range r.engines {
+		if err := e.SandboxReset(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *router) SandboxFaucet(user uint64, asset ledger.Asset, amount float64) (ledger.Entry, error) {
+	target, err := r.assetEngine(asset)
+	if err != nil {
+		return ledger.Entry{}, err
+	}
+	return target.SandboxFaucet(user, asset, amount)
+}
+
+func (r *router) Subscribe(market exchange.Market) (<-chan exchange.Ticker, func(), error) {
+	return r.engine(market).Subscribe(market)
+}
+
+func (r *router) SubscribeFeed(market exchange.Market) (<-chan []exchange.FeedMessage, func(), error) {
+	return r.engine(market).SubscribeFeed(market)
+}
+
+func (r *router) SnapshotFeed(market exchange.Market) ([]exchange.FeedMessage, uint64, <-chan []exchange.FeedMessage, func(), error) {
+	return r.engine(market).SnapshotFeed(market)
+}
+
+func (r *router) ResumeFeed(market exchange.Market, since uint64) (exchange.FeedResume, <-chan []exchange.FeedMessage, func(), error) {
+	return r.engine(market).ResumeFeed(market, since)
+}
+
+func (r *router) ResumeTrades(market exchange.Market, after uint64) ([]exchange.FeedMessage, <-chan []exchange.FeedMessage, func(), error) {
+	return r.engine(market).ResumeTrades(market, after)
+}
+
+// SubscribeOrderUpdates merges owner's updates from every engine. Cut off
+// by one engine, the subscriber is cut off from all of them.
+func (r *router) SubscribeOrderUpdates(owner uint64) (<-chan []exchange.OrderUpdate, func()) {
+	updates := make(chan []exchange.OrderUpdate)
+	done := make(chan struct{})
+	var once sync.Once
+	unsubscribe := func() { once.Do(func() { close(done) }) }
+	var wg sync.WaitGroup
+	for _, e := range r.engines {
+		sub, stop := e.SubscribeOrderUpdates(owner)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stop()
+			for {
+				select {
+				case <-done:
+					return
+				case batch, ok := <-sub:
+					if !ok {
+						unsubscribe()
+						return
+					}
+					select {
+					case updates <- batch:
+					case <-done:
+						return
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(updates)
+	}()
+	return updates, unsubscribe
+}
+
+// parseEngineAddrs parses EXCHANGE_ENGINE_ADDR, a comma-separated list of
+// engine addresses.
+func parseEngineAddrs(s string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			return nil, fmt.Errorf("%q has an empty address", s)
+		}
+		if slices.Contains(addrs, addr) {
+			return nil, fmt.Errorf("engine %s is listed twice", addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// parseMarkets parses EXCHANGE_MARKETS, a comma-separated list of the
+// markets an engine runs out of those known, the built-in ones when known
+// is empty.
+func parseMarkets(s string, known []exchange.Market) ([]exchange.Market, error) {
+	if len(known) == 0 {
+		known = []exchange.Market{exchange.MarketEth, exchange.MarketBtc}
+	}
+	var markets []exchange.Market
+	for _, name := range strings.Split(s, ",") {
+		market := exchange.Market(strings.TrimSpace(name))
+		if !slices.Contains(known, market) {
+			return nil, fmt.Errorf("%w: %q", exchange.ErrMarketNotFound, market)
+		}
+		if !slices.Contains(markets, market) {
+			markets = append(markets, market)
+		}
+	}
+	return markets, nil
+}
@@ -0,0 +1,70 @@
+package sbe
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+func TestRoundTrip(t *testing.T) {
+	delta := exchange.FeedMessage{Type: exchange.FeedBook, Market: "ETH", Seq: 7, Side: orderbook.SideBid, Price: 9950, Size: 25}
+	trade := exchange.FeedMessage{Type: exchange.FeedTrade, Market: "ETH", Seq: 8, Side: orderbook.SideAsk, Price: 100, Size: 1, TradeID: 3, Timestamp: 1_700_000_000_000_000_000}
+
+	var b []byte
+	b = AppendSnapshot(b, "ETH", 6, 1)
+	b = AppendFeedMessage(b, delta, 6)
+	b = AppendFeedMessage(b, trade, 0)
+	if len(b) != 24+45+53 {
+		t.Fatalf("expected 122 bytes, got %d", len(b))
+	}
+	if want := "0c00010001000200060000000000000001000000034554482100020001000200"; hex.EncodeToString(b[:32]) != want {
+		t.Fatalf("expected %s, got %s", want, hex.EncodeToString(b[:32]))
+	}
+
+	want := []Message{
+		{Template: TemplateSnapshot, FeedMessage: exchange.FeedMessage{Market: "ETH", Seq: 6}, Levels: 1},
+		{Template: TemplateBookDelta, FeedMessage: delta, PrevSeq: 6},
+		{Template: TemplateTrade, FeedMessage: trade},
+	}
+	for _, w := range want {
+		m, n, err := Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != w {
+			t.Fatalf("expected %+v, got %+v", w, m)
+		}
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("expected nothing left, got %d bytes", len(b))
+	}
+}
+
+func TestDecodeSkipsNewFields(t *testing.T) {
+	b := AppendFeedMessage(nil, exchange.FeedMessage{Type: exchange.FeedBook, Market: "BTC", Seq: 2, Price: 1, Size: 2}, 1)
+	// a later version with four more bytes in the block
+	longer := append([]byte{}, b[:8+bookDeltaLength]...)
+	longer = append(longer, 0xde, 0xad, 0xbe, 0xef)
+	longer = append(longer, b[8+bookDeltaLength:]...)
+	longer[0] += 4
+
+	m, n, err := Decode(longer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(longer) || m.Market != "BTC" || m.Seq != 2 || m.PrevSeq != 1 || m.Size != 2 {
+		t.Fatalf("unexpected message %+v of %d bytes", m, n)
+	}
+
+	if _, _, err := Decode(b[:len(b)-1]); !errors.Is(err, ErrShort) {
+		t.Fatalf("expected a truncated message, got %v", err)
+	}
+	b[2] = 9
+	if _, _, err := Decode(b); !errors.Is(err, ErrSchema) {
+		t.Fatalf("expected an unknown template, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/chain"
+)
+
+// withSettler reports the on-chain transfers settling users' trades from
+// st. Without it the settlement route isn't registered.
+func withSettler(st *chain.Settler) serverOption {
+	return func(s *server) {
+		s.settler = st
+	}
+}
+
+// handleGetMySettlements lists the on-chain transfers to and from the
+// caller settling their trades.
+func (s *server) handleGetMySettlements(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"settlements": s.settler.Transfers(callerID(c)),
+	})
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// auditTimeout bounds each of the audit trail's statements, whose callers
+// have no context to give.
+const auditTimeout = 30 * time.Second
+
+// Append stores records, all or none of them, making the store an
+// exchange.AuditStore that keeps the audit trail beyond the process.
+func (s sqlStore) Append(records []exchange.AuditRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range records {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO audit_records (recorded_at, action, market, owner, order_id, request, result, code, msg, seq)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			r.Timestamp, r.Action, r.Market, r.User, r.OrderID, string(r.Request), r.Result, r.Code, r.Msg, r.Seq)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Query returns the records q selects, oldest first.
+func (s sqlStore) Query(q exchange.AuditQuery) ([]exchange.AuditRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	where, args := bounds(nil, nil, "recorded_at", q.Market, q.From, q.To)
+	for _, eq := range []struct {
+		column string
+		value  any
+		set    bool
+	}{
+		{"owner", q.User, q.User != 0},
+		{"action", q.Action, q.Action != ""},
+		{"result", q.Result, q.Result != ""},
+	} {
+		if eq.set {
+			args = append(args, eq.value)
+			where = append(where, fmt.Sprintf("%s = $%d", eq.column, len(args)))
+		}
+	}
+	query := `SELECT recorded_at, action, market, owner, order_id, request, result, code, msg, seq FROM audit_records`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []exchange.AuditRecord{}
+	for rows.Next() {
+		var r exchange.AuditRecord
+		var request string
+		if err := rows.Scan(&r.Timestamp, &r.Action, &r.Market, &r.User, &r.OrderID, &request, &r.Result, &r.Code, &r.Msg, &r.Seq); err != nil {
+			return nil, err
+		}
+		r.Request = json.RawMessage(request)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// migrations are the schema's changes, one directory per database, each
+// file applied once and in name order.
+//
+//go:embed migrations
+var migrations embed.FS
+
+// migrate brings db's schema up to date with the files in dir, recording
+// those applied in schema_migrations. lock, run first in the same
+// transaction, keeps other processes from migrating db at the same time.
+func migrate(ctx context.Context, db *sql.DB, dir, lock string) error {
+	names, err := fs.Glob(migrations, path.Join("migrations", dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if lock != "" {
+		if _, err := tx.ExecContext(ctx, lock); err != nil {
+			return fmt.Errorf("locking schema: %w", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version TEXT PRIMARY KEY)`); err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		version := strings.TrimSuffix(path.Base(name), ".sql")
+		if applied[version] {
+			continue
+		}
+		schema, err := migrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(schema)); err != nil {
+			return fmt.Errorf("applying migration %s: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,52 @@
+-- orders of registered users, as last updated
+CREATE TABLE orders (
+	id              BIGINT PRIMARY KEY,
+	market          TEXT NOT NULL,
+	owner           BIGINT NOT NULL,
+	client_order_id TEXT NOT NULL DEFAULT '',
+	bid             BOOLEAN NOT NULL,
+	price           DOUBLE PRECISION NOT NULL,
+	size            DOUBLE PRECISION NOT NULL,
+	remaining       DOUBLE PRECISION NOT NULL,
+	status          TEXT NOT NULL,
+	created_at      BIGINT NOT NULL,
+	updated_at      BIGINT NOT NULL
+);
+
+CREATE INDEX orders_owner_created_at ON orders (owner, created_at DESC);
+
+-- every update of those orders; an operation updates an order at most once
+-- for each trade
+CREATE TABLE order_updates (
+	id              BIGSERIAL PRIMARY KEY,
+	order_id        BIGINT NOT NULL,
+	seq             BIGINT NOT NULL,
+	type            TEXT NOT NULL,
+	trade_id        BIGINT NOT NULL DEFAULT 0,
+	market          TEXT NOT NULL,
+	owner           BIGINT NOT NULL,
+	client_order_id TEXT NOT NULL DEFAULT '',
+	bid             BOOLEAN NOT NULL,
+	price           DOUBLE PRECISION NOT NULL,
+	remaining       DOUBLE PRECISION NOT NULL,
+	fill_price      DOUBLE PRECISION NOT NULL DEFAULT 0,
+	fill_size       DOUBLE PRECISION NOT NULL DEFAULT 0,
+	maker           BOOLEAN NOT NULL DEFAULT FALSE,
+	happened_at     BIGINT NOT NULL,
+	UNIQUE (order_id, seq, type, trade_id)
+);
+
+-- every trade, anonymous orders' included
+CREATE TABLE trades (
+	market         TEXT NOT NULL,
+	id             BIGINT NOT NULL,
+	taker_order_id BIGINT NOT NULL,
+	maker_order_id BIGINT NOT NULL,
+	bid            BOOLEAN NOT NULL,
+	price          DOUBLE PRECISION NOT NULL,
+	size           DOUBLE PRECISION NOT NULL,
+	executed_at    BIGINT NOT NULL,
+	PRIMARY KEY (market, id)
+);
+
+CREATE INDEX trades_market_executed_at ON trades (market, executed_at DESC);
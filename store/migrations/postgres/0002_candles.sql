@@ -0,0 +1,14 @@
+-- each market's candles, the live ones as last updated
+CREATE TABLE candles (
+	market        TEXT NOT NULL,
+	resolution    TEXT NOT NULL,
+	start_at      BIGINT NOT NULL,
+	open          DOUBLE PRECISION NOT NULL,
+	high          DOUBLE PRECISION NOT NULL,
+	low           DOUBLE PRECISION NOT NULL,
+	close         DOUBLE PRECISION NOT NULL,
+	volume        DOUBLE PRECISION NOT NULL,
+	trades        BIGINT NOT NULL,
+	last_trade_id BIGINT NOT NULL,
+	PRIMARY KEY (market, resolution, start_at)
+);
@@ -0,0 +1,17 @@
+-- every order entry attempt, rejected ones included
+CREATE TABLE audit_records (
+	id          BIGSERIAL PRIMARY KEY,
+	recorded_at BIGINT NOT NULL,
+	action      TEXT NOT NULL,
+	market      TEXT NOT NULL DEFAULT '',
+	owner       BIGINT NOT NULL DEFAULT 0,
+	order_id    BIGINT NOT NULL DEFAULT 0,
+	request     TEXT NOT NULL,
+	result      TEXT NOT NULL,
+	code        TEXT NOT NULL DEFAULT '',
+	msg         TEXT NOT NULL DEFAULT '',
+	seq         BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX audit_records_recorded_at ON audit_records (recorded_at);
+CREATE INDEX audit_records_owner ON audit_records (owner, recorded_at);
@@ -0,0 +1,4 @@
+-- the fees each side of a trade paid: the bid's in the base asset, the
+-- ask's in the quote asset
+ALTER TABLE trades ADD COLUMN taker_fee DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE trades ADD COLUMN maker_fee DOUBLE PRECISION NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- for the updates of a day, as summaries count them
+CREATE INDEX order_updates_happened_at ON order_updates (happened_at);
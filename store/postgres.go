@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/thenaveensharma/exchange/exchange"
+
+	// registers the "pgx" driver
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres keeps history and the audit trail in a PostgreSQL database.
+type Postgres struct {
+	sqlStore
+}
+
+var (
+	_ Repository          = (*Postgres)(nil)
+	_ exchange.AuditStore = (*Postgres)(nil)
+)
+
+// postgresLock is the advisory lock held while migrating, so processes
+// starting together take turns.
+const postgresLock = `SELECT pg_advisory_xact_lock(7450284261)`
+
+// OpenPostgres connects to the database at url, a postgres:// URL or
+// key=value connection string, and brings its schema up to date.
+func OpenPostgres(ctx context.Context, url string) (*Postgres, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(ctx, db, "postgres", postgresLock); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating schema: %w", err)
+	}
+	return &Postgres{sqlStore{db: db}}, nil
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+const (
+	// saveTimeout is how long saving one batch may take before it is tried
+	// again.
+	saveTimeout = 30 * time.Second
+	// retryDelay is how long a batch that failed to save waits to be tried
+	// again.
+	retryDelay = time.Second
+)
+
+// Recorder saves what the exchange does to a repository off the matching
+// path. The exchange hands it each operation's updates and fills, which it
+// queues in memory and saves in batches, in order, from a goroutine of its
+// own. While the repository can't be reached the queue grows and the
+// batch is tried again until it can.
+type Recorder struct {
+	repo Repository
+	// candles is nil unless trades are aggregated into candles
+	candles *candle.Aggregator
+	// scales are the scales of the markets recorded, to turn their units
+	// into the assets the history keeps
+	scales map[exchange.Market]orderbook.Scale
+
+	mu      sync.Mutex
+	pending Batch
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewRecorder starts saving to repo. Close stops it.
+func NewRecorder(repo Repository) *Recorder {
+	r := &Recorder{
+		repo:    repo,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Candles has r aggregate the trades it records into agg's candles, saving
+// them as they change. It is called before Record.
+func (r *Recorder) Candles(agg *candle.Aggregator) {
+	r.candles = agg
+}
+
+// Record registers r to record ex's order updates and trades.
+func (r *Recorder) Record(ex *exchange.Exchange) {
+	r.scales = make(map[exchange.Market]orderbook.Scale)
+	for _, market := range ex.Markets() {
+		cfg, _ := ex.Limits(market)
+		r.scales[market] = cfg.Scale
+	}
+	ex.HandleOrderUpdates(r.updates)
+	ex.HandleEvents(r.fills, exchange.EventFill)
+}
+
+func (r *Recorder) updates(updates []exchange.OrderUpdate) {
+	r.mu.Lock()
+	for _, u := range updates {
+		r.pending.Updates = append(r.pending.Updates, newOrderUpdate(u, r.scales[u.Market]))
+	}
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *Recorder) fills(events []exchange.Event) {
+	r.mu.Lock()
+	for _, e := range events {
+		scale := r.scales[e.Market]
+		price, size := scale.PriceValue(e.Price), scale.SizeValue(e.Size)
+		r.pending.Trades = append(r.pending.Trades, Trade{
+			ID:           e.TradeID,
+			Market:       e.Market,
+			TakerOrderID: e.OrderID,
+			MakerOrderID: e.MakerOrderID,
+			Bid:          e.Bid,
+			Price:        price,
+			Size:         size,
+			TakerFee:     e.TakerFee,
+			MakerFee:     e.MakerFee,
+			Timestamp:    e.Timestamp,
+		})
+		if r.candles != nil {
+			r.pending.Candles = r.candles.Add(e.Market, e.TradeID, price, size, e.Timestamp, r.pending.Candles)
+		}
+	}
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *Recorder) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	var failed Batch
+	for {
+		select {
+		case <-r.wake:
+		case <-r.closing:
+			r.save(&failed)
+			return
+		}
+		if !r.save(&failed) {
+			select {
+			case <-time.After(retryDelay):
+				r.signal()
+			case <-r.closing:
+				r.save(&failed)
+				return
+			}
+		}
+	}
+}
+
+// save saves failed, the batch that couldn't be saved last time, with what
+// has been queued since, reporting whether it could. If not, failed keeps
+// them for the next try.
+func (r *Recorder) save(failed *Batch) bool {
+	r.mu.Lock()
+	b := Batch{
+		Updates: append(failed.Updates, r.pending.Updates...),
+		Trades:  append(failed.Trades, r.pending.Trades...),
+		Candles: latestCandles(append(failed.Candles, r.pending.Candles...)),
+	}
+	r.pending = Batch{}
+	r.mu.Unlock()
+	if len(b.Updates) == 0 && len(b.Trades) == 0 && len(b.Candles) == 0 {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+	defer cancel()
+	if err := r.repo.Save(ctx, b); err != nil {
+		slog.Error("failed to save order history, retrying", "updates", len(b.Updates), "trades", len(b.Trades), "error", err)
+		*failed = b
+		return false
+	}
+	*failed = Batch{}
+	return true
+}
+
+// latestCandles drops the candles a later one in candles replaces, keeping
+// the order of those left.
+func latestCandles(candles []candle.Candle) []candle.Candle {
+	type key struct {
+		market   exchange.Market
+		interval candle.Interval
+		start    int64
+	}
+	latest := make(map[key]int, len(candles))
+	for i, c := range candles {
+		latest[key{c.Market, c.Interval, c.Start}] = i
+	}
+	kept := candles[:0]
+	for i, c := range candles {
+		if latest[key{c.Market, c.Interval, c.Start}] == i {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// Close saves what is queued, trying once more if need be, and stops. The
+// exchange must not be handing r anything by then.
+func (r *Recorder) Close() {
+	close(r.closing)
+	<-r.done
+}
@@ -0,0 +1,320 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// sqlStore is a Repository on a database/sql database understanding the
+// SQL its queries share, numbering placeholders from $1.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func (s sqlStore) Save(ctx context.Context, b Batch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, u := range b.Updates {
+		if err := s.saveUpdate(ctx, tx, u); err != nil {
+			return err
+		}
+	}
+	for _, t := range b.Trades {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO trades (market, id, taker_order_id, maker_order_id, bid, price, size, taker_fee, maker_fee, executed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT DO NOTHING`,
+			t.Market, t.ID, t.TakerOrderID, t.MakerOrderID, t.Bid, t.Price, t.Size, t.TakerFee, t.MakerFee, t.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range b.Candles {
+		// a candle saved again with no more trades leaves it as it is
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO candles (market, resolution, start_at, open, high, low, close, volume, trades, last_trade_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (market, resolution, start_at) DO UPDATE SET
+				open = excluded.open, high = excluded.high, low = excluded.low, close = excluded.close,
+				volume = excluded.volume, trades = excluded.trades, last_trade_id = excluded.last_trade_id
+			WHERE candles.last_trade_id < excluded.last_trade_id`,
+			c.Market, c.Interval, c.Start, c.Open, c.High, c.Low, c.Close, c.Volume, c.Trades, c.LastTradeID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// saveUpdate records u and brings its order up to date with it, unless it
+// has been recorded before.
+func (s sqlStore) saveUpdate(ctx context.Context, tx *sql.Tx, u OrderUpdate) error {
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO order_updates (order_id, seq, type, trade_id, market, owner, client_order_id, bid, price, remaining, fill_price, fill_size, maker, happened_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT DO NOTHING`,
+		u.OrderID, u.Seq, u.Type, u.TradeID, u.Market, u.Owner, u.ClientOrderID, u.Bid, u.Price, u.Remaining, u.FillPrice, u.FillSize, u.Maker, u.Timestamp)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if u.Type == exchange.OrderUpdateAccepted {
+		// an amendment that places the order again accepts it anew
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO orders (id, market, owner, client_order_id, bid, price, size, remaining, status, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, $9, $9)
+			ON CONFLICT (id) DO UPDATE SET price = $6, size = $7, remaining = $7, status = $8, updated_at = $9`,
+			u.OrderID, u.Market, u.Owner, u.ClientOrderID, u.Bid, u.Price, u.Remaining, orderStatus(u.Type), u.Timestamp)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders SET price = $2, remaining = $3, status = COALESCE(NULLIF($4, ''), status), updated_at = $5
+		WHERE id = $1`,
+		u.OrderID, u.Price, u.Remaining, string(orderStatus(u.Type)), u.Timestamp)
+	return err
+}
+
+const orderColumns = `id, market, owner, client_order_id, bid, price, size, remaining, status, created_at, updated_at`
+
+func scanOrder(row interface{ Scan(...any) error }) (Order, error) {
+	var o Order
+	err := row.Scan(&o.ID, &o.Market, &o.Owner, &o.ClientOrderID, &o.Bid, &o.Price, &o.Size, &o.Remaining, &o.Status, &o.CreatedAt, &o.UpdatedAt)
+	return o, err
+}
+
+func (s sqlStore) Orders(ctx context.Context, q OrderQuery) ([]Order, error) {
+	where, args := []string{"owner = $1"}, []any{q.Owner}
+	where, args = bounds(where, args, "created_at", q.Market, q.From, q.To)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE `+strings.Join(where, " AND ")+
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args)+1), append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func (s sqlStore) Order(ctx context.Context, owner, id uint64) (Order, []OrderUpdate, error) {
+	o, err := scanOrder(s.db.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = $1 AND owner = $2`, id, owner))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return Order{}, nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT type, market, seq, order_id, client_order_id, owner, bid, price, remaining, trade_id, fill_price, fill_size, maker, happened_at
+		FROM order_updates WHERE order_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return Order{}, nil, err
+	}
+	defer rows.Close()
+	updates := []OrderUpdate{}
+	for rows.Next() {
+		var u OrderUpdate
+		if err := rows.Scan(&u.Type, &u.Market, &u.Seq, &u.OrderID, &u.ClientOrderID, &u.Owner, &u.Bid, &u.Price, &u.Remaining, &u.TradeID, &u.FillPrice, &u.FillSize, &u.Maker, &u.Timestamp); err != nil {
+			return Order{}, nil, err
+		}
+		updates = append(updates, u)
+	}
+	return o, updates, rows.Err()
+}
+
+func (s sqlStore) Trades(ctx context.Context, q TradeQuery) ([]Trade, error) {
+	where, args := bounds(nil, nil, "executed_at", q.Market, q.From, q.To)
+	if q.User != 0 {
+		args = append(args, q.User)
+		where = append(where, fmt.Sprintf("(taker_order_id IN (SELECT id FROM orders WHERE owner = $%[1]d) OR maker_order_id IN (SELECT id FROM orders WHERE owner = $%[1]d))", len(args)))
+	}
+	if q.Before != 0 {
+		args = append(args, q.Before)
+		where = append(where, fmt.Sprintf("id < $%d", len(args)))
+	}
+	if q.After != 0 {
+		args = append(args, q.After)
+		where = append(where, fmt.Sprintf("id > $%d", len(args)))
+	}
+	query := `SELECT market, id, taker_order_id, maker_order_id, bid, price, size, taker_fee, maker_fee, executed_at FROM trades`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	order := ` ORDER BY executed_at DESC, id DESC`
+	if q.OldestFirst {
+		order = ` ORDER BY executed_at, id`
+	}
+	rows, err := s.db.QueryContext(ctx, query+order+fmt.Sprintf(` LIMIT $%d`, len(args)+1), append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trades := []Trade{}
+	for rows.Next() {
+		var t Trade
+		if err := rows.Scan(&t.Market, &t.ID, &t.TakerOrderID, &t.MakerOrderID, &t.Bid, &t.Price, &t.Size, &t.TakerFee, &t.MakerFee, &t.Timestamp); err != nil {
+			return nil, err
+		}
+		trades = append(trades, t)
+	}
+	return trades, rows.Err()
+}
+
+func (s sqlStore) Candles(ctx context.Context, q CandleQuery) ([]candle.Candle, error) {
+	where, args := []string{"resolution = $1"}, []any{q.Interval}
+	where, args = bounds(where, args, "start_at", q.Market, q.From, q.To)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT market, resolution, start_at, open, high, low, close, volume, trades, last_trade_id
+		FROM candles WHERE `+strings.Join(where, " AND ")+
+		fmt.Sprintf(` ORDER BY start_at DESC LIMIT $%d`, len(args)+1), append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	candles := []candle.Candle{}
+	for rows.Next() {
+		var c candle.Candle
+		if err := rows.Scan(&c.Market, &c.Interval, &c.Start, &c.Open, &c.High, &c.Low, &c.Close, &c.Volume, &c.Trades, &c.LastTradeID); err != nil {
+			return nil, err
+		}
+		candles = append(candles, c)
+	}
+	return candles, rows.Err()
+}
+
+func (s sqlStore) Summary(ctx context.Context, from, to int64) (Summary, error) {
+	summary := Summary{Markets: make(map[exchange.Market]MarketSummary)}
+	market := func(m exchange.Market) MarketSummary {
+		if ms, ok := summary.Markets[m]; ok {
+			return ms
+		}
+		return MarketSummary{Market: m}
+	}
+
+	// the bid's fee is in the base asset and the ask's in the quote asset,
+	// and Bid is the taker's side
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT market, COUNT(*), SUM(size), SUM(price * size), MAX(price), MIN(price),
+			SUM(CASE WHEN bid THEN taker_fee ELSE maker_fee END),
+			SUM(CASE WHEN bid THEN maker_fee ELSE taker_fee END)
+		FROM trades WHERE executed_at >= $1 AND executed_at < $2
+		GROUP BY market`, from, to)
+	if err != nil {
+		return Summary{}, err
+	}
+	for rows.Next() {
+		var ms MarketSummary
+		if err := rows.Scan(&ms.Market, &ms.Trades, &ms.BaseVolume, &ms.QuoteVolume, &ms.High, &ms.Low, &ms.BaseFees, &ms.QuoteFees); err != nil {
+			rows.Close()
+			return Summary{}, err
+		}
+		summary.Markets[ms.Market] = ms
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Summary{}, err
+	}
+	for m, ms := range summary.Markets {
+		for _, q := range []struct {
+			order string
+			dst   *float64
+		}{{"", &ms.Open}, {" DESC", &ms.Close}} {
+			err := s.db.QueryRowContext(ctx, `
+				SELECT price FROM trades WHERE market = $1 AND executed_at >= $2 AND executed_at < $3
+				ORDER BY executed_at`+q.order+`, id`+q.order+` LIMIT 1`, m, from, to).Scan(q.dst)
+			if err != nil {
+				return Summary{}, err
+			}
+		}
+		summary.Markets[m] = ms
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT market, COUNT(DISTINCT CASE WHEN trade_id <> 0 THEN owner END),
+			SUM(CASE WHEN type = $3 THEN 1 ELSE 0 END), SUM(CASE WHEN type = $4 THEN 1 ELSE 0 END)
+		FROM order_updates WHERE happened_at >= $1 AND happened_at < $2
+		GROUP BY market`, from, to, exchange.OrderUpdateAccepted, exchange.OrderUpdateCancelled)
+	if err != nil {
+		return Summary{}, err
+	}
+	for rows.Next() {
+		var m exchange.Market
+		var traders, orders, cancels int
+		if err := rows.Scan(&m, &traders, &orders, &cancels); err != nil {
+			rows.Close()
+			return Summary{}, err
+		}
+		ms := market(m)
+		ms.Traders, ms.Orders, ms.Cancels = traders, orders, cancels
+		summary.Markets[m] = ms
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Summary{}, err
+	}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(DISTINCT owner) FROM order_updates
+		WHERE trade_id <> 0 AND happened_at >= $1 AND happened_at < $2`, from, to).Scan(&summary.Traders)
+	if err != nil {
+		return Summary{}, err
+	}
+	return summary, nil
+}
+
+func (s sqlStore) LastIDs(ctx context.Context, markets []exchange.Market) (uint64, map[exchange.Market]uint64, error) {
+	var orderID uint64
+	tradeIDs := make(map[exchange.Market]uint64, len(markets))
+	for _, market := range markets {
+		var ids [4]uint64
+		err := s.db.QueryRowContext(ctx, `
+			SELECT COALESCE(MAX(id), 0), COALESCE(MAX(taker_order_id), 0), COALESCE(MAX(maker_order_id), 0),
+				(SELECT COALESCE(MAX(id), 0) FROM orders WHERE market = $1)
+			FROM trades WHERE market = $1`, market).Scan(&ids[0], &ids[1], &ids[2], &ids[3])
+		if err != nil {
+			return 0, nil, err
+		}
+		tradeIDs[market] = ids[0]
+		orderID = max(orderID, ids[1], ids[2], ids[3])
+	}
+	return orderID, tradeIDs, nil
+}
+
+func (s sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// bounds adds to where the conditions narrowing rows to market, if set, and
+// to times in timeColumn within [from, to], for those set, numbering their
+// placeholders after args'.
+func bounds(where []string, args []any, timeColumn string, market exchange.Market, from, to int64) ([]string, []any) {
+	if market != "" {
+		args = append(args, market)
+		where = append(where, fmt.Sprintf("market = $%d", len(args)))
+	}
+	if from != 0 {
+		args = append(args, from)
+		where = append(where, fmt.Sprintf("%s >= $%d", timeColumn, len(args)))
+	}
+	if to != 0 {
+		args = append(args, to)
+		where = append(where, fmt.Sprintf("%s <= $%d", timeColumn, len(args)))
+	}
+	return where, args
+}
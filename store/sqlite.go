@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/thenaveensharma/exchange/exchange"
+
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// SQLite keeps history and the audit trail in an SQLite database file, for a single node or
+// development, where running PostgreSQL isn't worth it.
+type SQLite struct {
+	sqlStore
+}
+
+var (
+	_ Repository          = (*SQLite)(nil)
+	_ exchange.AuditStore = (*SQLite)(nil)
+)
+
+// OpenSQLite opens the database file at path, creating it if need be, and
+// brings its schema up to date.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	// readers, gateways' included, don't hold up the engine's writes, and a
+	// writer waits its turn rather than failing while another writes
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)"}}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(ctx, db, "sqlite", ""); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating schema: %w", err)
+	}
+	return &SQLite{sqlStore{db: db}}, nil
+}
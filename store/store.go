@@ -0,0 +1,205 @@
+// Package store keeps the exchange's order and trade history in a database,
+// so it can be queried long after the exchange's own recent history has
+// moved on and survives the process. The history has its prices and sizes
+// in the markets' quote and base assets, as clients read them, rather than
+// in the units of the markets' scales.
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// ErrNotFound is returned for an order the repository has no record of.
+var ErrNotFound = errors.New("order not found")
+
+// Order is an order as last recorded: its size when it was accepted, or
+// last placed again by an amendment, what was left of it and its status.
+// Times are unix nanoseconds.
+type Order struct {
+	ID            uint64               `json:"id"`
+	Market        exchange.Market      `json:"market"`
+	Owner         uint64               `json:"owner"`
+	ClientOrderID string               `json:"clientOrderId,omitempty"`
+	Bid           bool                 `json:"bid"`
+	Price         float64              `json:"price"`
+	Size          float64              `json:"size"`
+	Remaining     float64              `json:"remaining"`
+	Status        exchange.OrderStatus `json:"status"`
+	CreatedAt     int64                `json:"createdAt"`
+	UpdatedAt     int64                `json:"updatedAt"`
+}
+
+// OrderUpdate is an exchange.OrderUpdate as the history keeps it, with its
+// prices and sizes in the market's assets.
+type OrderUpdate struct {
+	Type          exchange.OrderUpdateType `json:"type"`
+	Market        exchange.Market          `json:"market"`
+	Seq           uint64                   `json:"seq"`
+	OrderID       uint64                   `json:"orderId"`
+	ClientOrderID string                   `json:"clientOrderId,omitempty"`
+	Owner         uint64                   `json:"owner"`
+	Bid           bool                     `json:"bid"`
+	Price         float64                  `json:"price"`
+	Remaining     float64                  `json:"remaining"`
+	TradeID       uint64                   `json:"tradeId,omitempty"`
+	FillPrice     float64                  `json:"fillPrice,omitempty"`
+	FillSize      float64                  `json:"fillSize,omitempty"`
+	Maker         bool                     `json:"maker,omitempty"`
+	Timestamp     int64                    `json:"timestamp"`
+}
+
+// newOrderUpdate is u in the assets of its market, whose scale is scale.
+func newOrderUpdate(u exchange.OrderUpdate, scale orderbook.Scale) OrderUpdate {
+	return OrderUpdate{
+		Type:          u.Type,
+		Market:        u.Market,
+		Seq:           u.Seq,
+		OrderID:       u.OrderID,
+		ClientOrderID: u.ClientOrderID,
+		Owner:         u.Owner,
+		Bid:           u.Bid,
+		Price:         scale.PriceValue(u.Price),
+		Remaining:     scale.SizeValue(u.Remaining),
+		TradeID:       u.TradeID,
+		FillPrice:     scale.PriceValue(u.FillPrice),
+		FillSize:      scale.SizeValue(u.FillSize),
+		Maker:         u.Maker,
+		Timestamp:     u.Timestamp,
+	}
+}
+
+// Trade is a match between two orders. TakerOrderID is the incoming
+// order's, and Bid its side; in an auction they are the bid's and true.
+// TakerFee and MakerFee are what each order's user paid for it, in the
+// base asset for the bid and the quote asset for the ask.
+type Trade struct {
+	ID           uint64          `json:"id"`
+	Market       exchange.Market `json:"market"`
+	TakerOrderID uint64          `json:"takerOrderId"`
+	MakerOrderID uint64          `json:"makerOrderId"`
+	Bid          bool            `json:"bid"`
+	Price        float64         `json:"price"`
+	Size         float64         `json:"size"`
+	TakerFee     float64         `json:"takerFee"`
+	MakerFee     float64         `json:"makerFee"`
+	Timestamp    int64           `json:"timestamp"`
+}
+
+// Batch is what some operations did: the updates of users' orders and the
+// trades, each in the order they happened, and the candles the trades left.
+type Batch struct {
+	Updates []OrderUpdate
+	Trades  []Trade
+	Candles []candle.Candle
+}
+
+// OrderQuery selects an owner's orders. Market, if set, narrows them to
+// one market, and From and To, if set, to those created in [From, To].
+// Limit caps how many are returned, newest first.
+type OrderQuery struct {
+	Owner  uint64
+	Market exchange.Market
+	From   int64
+	To     int64
+	Limit  int
+}
+
+// TradeQuery selects a market's trades, From and To bounding their time as
+// in OrderQuery. User, if set, narrows them to those one of the user's
+// orders was in, and Before and After to the market's trades with lower or
+// higher IDs. Limit caps how many are returned, newest first, or oldest
+// first with OldestFirst set.
+type TradeQuery struct {
+	Market      exchange.Market
+	User        uint64
+	From        int64
+	To          int64
+	Before      uint64
+	After       uint64
+	OldestFirst bool
+	Limit       int
+}
+
+// CandleQuery selects a market's candles at one interval, From and To
+// bounding their start as in OrderQuery. Limit caps how many are returned,
+// newest first.
+type CandleQuery struct {
+	Market   exchange.Market
+	Interval candle.Interval
+	From     int64
+	To       int64
+	Limit    int
+}
+
+// MarketSummary is a market's trading over a period: how many trades it
+// had, their volume in the base and the quote asset, their opening,
+// highest, lowest and closing prices and the fees paid in each asset. Only
+// registered users' orders are kept, so Traders, Orders and Cancels count
+// the users who traded and the orders placed and cancelled among theirs.
+type MarketSummary struct {
+	Market      exchange.Market `json:"market"`
+	Trades      int             `json:"trades"`
+	BaseVolume  float64         `json:"baseVolume"`
+	QuoteVolume float64         `json:"quoteVolume"`
+	Open        float64         `json:"open"`
+	High        float64         `json:"high"`
+	Low         float64         `json:"low"`
+	Close       float64         `json:"close"`
+	BaseFees    float64         `json:"baseFees"`
+	QuoteFees   float64         `json:"quoteFees"`
+	Traders     int             `json:"traders"`
+	Orders      int             `json:"orders"`
+	Cancels     int             `json:"cancels"`
+}
+
+// Summary is the trading over a period of each market that had any, by
+// market, and Traders the users who traded in any of them.
+type Summary struct {
+	Markets map[exchange.Market]MarketSummary
+	Traders int
+}
+
+// Repository is where history is kept.
+type Repository interface {
+	// Save records a batch at once. Saving a batch again, as replaying the
+	// journal on startup does, leaves the history as it was.
+	Save(ctx context.Context, b Batch) error
+	// Orders returns the orders q selects.
+	Orders(ctx context.Context, q OrderQuery) ([]Order, error)
+	// Order returns owner's order with id and its updates, oldest first,
+	// or ErrNotFound.
+	Order(ctx context.Context, owner, id uint64) (Order, []OrderUpdate, error)
+	// Trades returns the trades q selects.
+	Trades(ctx context.Context, q TradeQuery) ([]Trade, error)
+	// Candles returns the candles q selects.
+	Candles(ctx context.Context, q CandleQuery) ([]candle.Candle, error)
+	// Summary returns the trading in [from, to), in unix nanoseconds.
+	Summary(ctx context.Context, from, to int64) (Summary, error)
+	// LastIDs returns the highest order ID and each market's highest trade
+	// ID kept for markets, for a process starting without them to carry on
+	// after.
+	LastIDs(ctx context.Context, markets []exchange.Market) (orderID uint64, tradeIDs map[exchange.Market]uint64, err error)
+	Close() error
+}
+
+// orderStatus is the status an update leaves its order in; an amendment
+// leaves it as it was.
+func orderStatus(t exchange.OrderUpdateType) exchange.OrderStatus {
+	switch t {
+	case exchange.OrderUpdateAccepted:
+		return exchange.OrderNew
+	case exchange.OrderUpdatePartialFill:
+		return exchange.OrderPartiallyFilled
+	case exchange.OrderUpdateFill:
+		return exchange.OrderFilled
+	case exchange.OrderUpdateCancelled:
+		return exchange.OrderCancelled
+	default:
+		return ""
+	}
+}
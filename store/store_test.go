@@ -0,0 +1,328 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/clock"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// px and sz are the default scale's units of a decimal price and size.
+func px(v float64) orderbook.Price { return orderbook.DefaultScale.PriceOf(v) }
+func sz(v float64) orderbook.Size  { return orderbook.DefaultScale.SizeOf(v) }
+
+// flakyRepo is a repository failing its first saves, keeping what it is
+// then given.
+type flakyRepo struct {
+	Repository
+	mu       sync.Mutex
+	failures int
+	saved    []Batch
+}
+
+func (r *flakyRepo) Save(ctx context.Context, b Batch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("unreachable")
+	}
+	r.saved = append(r.saved, b)
+	return nil
+}
+
+func TestRecorder(t *testing.T) {
+	ex := exchange.New(exchange.Config{AnonymousOrders: true})
+	repo := &flakyRepo{failures: 1}
+	rec := NewRecorder(repo)
+	rec.Record(ex)
+	ctx := context.Background()
+
+	ex.Deposit(1, ledger.ETH, 1)
+	ask, _ := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(100), User: 1, Market: exchange.MarketEth})
+	// an anonymous taker has no updates, but its trade is kept
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.MarketOrder, Bid: true, Size: sz(1), Market: exchange.MarketEth})
+	// saved once the repository is back
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		repo.mu.Lock()
+		n := len(repo.saved)
+		repo.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nothing saved")
+		}
+	}
+	ex.Close()
+	rec.Close()
+
+	var updates []exchange.OrderUpdateType
+	var trades []Trade
+	for _, b := range repo.saved {
+		for _, u := range b.Updates {
+			if u.OrderID != ask.OrderID {
+				t.Fatalf("expected only the ask's updates, got %+v", u)
+			}
+			updates = append(updates, u.Type)
+		}
+		trades = append(trades, b.Trades...)
+	}
+	if want := []exchange.OrderUpdateType{exchange.OrderUpdateAccepted, exchange.OrderUpdateFill}; !reflect.DeepEqual(updates, want) {
+		t.Fatalf("expected updates %v saved despite the failures, got %v", want, updates)
+	}
+	if len(trades) != 1 || trades[0].MakerOrderID != ask.OrderID || trades[0].Size != 1 || trades[0].Price != 100 || !trades[0].Bid {
+		t.Fatalf("expected the trade saved, got %+v", trades)
+	}
+}
+
+// TestPostgres runs against the database at EXCHANGE_TEST_POSTGRES_URL,
+// which it adds its tables to.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("EXCHANGE_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("EXCHANGE_TEST_POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	repo, err := OpenPostgres(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	// and again, finding it migrated
+	again, err := OpenPostgres(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+	testRepository(t, repo)
+}
+
+// testRepository checks repo keeps what an exchange does.
+func testRepository(t *testing.T, repo Repository) {
+	t.Helper()
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, Clock: clk})
+	ctx := context.Background()
+	var saved Batch
+	ex.HandleOrderUpdates(func(updates []exchange.OrderUpdate) {
+		for _, u := range updates {
+			saved.Updates = append(saved.Updates, newOrderUpdate(u, orderbook.DefaultScale))
+		}
+	})
+	rec := NewRecorder(repo)
+	rec.Candles(candle.NewAggregator())
+	rec.Record(ex)
+	// runs against one database carry on after each other's trades, and
+	// have users of their own
+	_, tradeIDs, err := repo.LastIDs(ctx, ex.Markets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.ReserveTradeIDs(exchange.MarketEth, tradeIDs[exchange.MarketEth])
+	alice, bob := uint64(time.Now().UnixNano()), uint64(time.Now().UnixNano()+1)
+	ex.Deposit(alice, ledger.USD, 1000)
+	ex.Deposit(bob, ledger.ETH, 2)
+	ask, _ := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(2), Price: px(100), User: bob, Market: exchange.MarketEth})
+	clk.Advance(time.Second)
+	bid, _ := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(3), Price: px(100), User: alice, ClientOrderID: "a1", Market: exchange.MarketEth})
+	clk.Advance(time.Second)
+	if _, err := ex.CancelOrder(ctx, alice, bid.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	ex.Close()
+	rec.Close()
+
+	orders, err := repo.Orders(ctx, OrderQuery{Owner: alice, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placed := clk.Now().Add(-time.Second).UnixNano()
+	want := Order{ID: bid.OrderID, Market: exchange.MarketEth, Owner: alice, ClientOrderID: "a1", Bid: true, Price: 100, Size: 3, Remaining: 1, Status: exchange.OrderCancelled, CreatedAt: placed, UpdatedAt: clk.Now().UnixNano()}
+	if len(orders) != 1 || orders[0] != want {
+		t.Fatalf("expected alice's order\n%+v\ngot\n%+v", want, orders)
+	}
+	order, updates, err := repo.Order(ctx, alice, bid.OrderID)
+	if err != nil || order != want {
+		t.Fatalf("expected the order, got %+v, %v", order, err)
+	}
+	var types []exchange.OrderUpdateType
+	for _, u := range updates {
+		types = append(types, u.Type)
+	}
+	if want := []exchange.OrderUpdateType{exchange.OrderUpdateAccepted, exchange.OrderUpdatePartialFill, exchange.OrderUpdateCancelled}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected updates %v, got %v", want, types)
+	}
+	if _, _, err := repo.Order(ctx, bob, bid.OrderID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected alice's order hidden from bob, got %v", err)
+	}
+	if orders, _ := repo.Orders(ctx, OrderQuery{Owner: bob, Market: exchange.MarketEth, From: placed, Limit: 10}); len(orders) != 0 {
+		t.Fatalf("expected bob's order placed before from left out, got %+v", orders)
+	}
+	if orders, _ := repo.Orders(ctx, OrderQuery{Owner: bob, Limit: 10}); len(orders) != 1 || orders[0].ID != ask.OrderID || orders[0].Status != exchange.OrderFilled {
+		t.Fatalf("expected bob's order filled, got %+v", orders)
+	}
+
+	trades, err := repo.Trades(ctx, TradeQuery{Market: exchange.MarketEth, From: placed, To: placed, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) == 0 || trades[0].ID != tradeIDs[exchange.MarketEth]+1 || trades[0].TakerOrderID != bid.OrderID || trades[0].MakerOrderID != ask.OrderID || trades[0].Size != 2 {
+		t.Fatalf("expected the trade, got %+v", trades)
+	}
+	if older, err := repo.Trades(ctx, TradeQuery{Market: exchange.MarketEth, Before: trades[0].ID, Limit: 10}); err != nil || len(older) != 0 && older[0].ID >= trades[0].ID {
+		t.Fatalf("expected only trades before the last, got %+v, %v", older, err)
+	}
+	if orderID, last, err := repo.LastIDs(ctx, []exchange.Market{exchange.MarketEth}); err != nil || orderID < bid.OrderID || last[exchange.MarketEth] != trades[0].ID {
+		t.Fatalf("expected the last IDs to be the bid's and its trade's, got %d, %v, %v", orderID, last, err)
+	}
+
+	candles, err := repo.Candles(ctx, CandleQuery{Market: exchange.MarketEth, Interval: candle.Minute, From: candle.Minute.Start(placed), To: placed, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCandle := candle.Candle{Market: exchange.MarketEth, Interval: candle.Minute, Start: candle.Minute.Start(placed), Open: 100, High: 100, Low: 100, Close: 100, Volume: 2, Trades: 1, LastTradeID: trades[0].ID}
+	if len(candles) != 1 || candles[0] != wantCandle {
+		t.Fatalf("expected the trade's candle\n%+v\ngot\n%+v", wantCandle, candles)
+	}
+	// a candle saved again with fewer trades, as a replay from part way
+	// through it would, is left as it was
+	stale := wantCandle
+	stale.Volume, stale.Trades, stale.LastTradeID = 1, 0, stale.LastTradeID-1
+	if err := repo.Save(ctx, Batch{Candles: []candle.Candle{stale}}); err != nil {
+		t.Fatal(err)
+	}
+	if candles, _ := repo.Candles(ctx, CandleQuery{Market: exchange.MarketEth, Interval: candle.Minute, From: wantCandle.Start, To: placed, Limit: 10}); len(candles) != 1 || candles[0] != wantCandle {
+		t.Fatalf("expected the candle left as it was, got %+v", candles)
+	}
+
+	// saving it all again, as a replay would, changes nothing
+	if err := repo.Save(ctx, saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, again, _ := repo.Order(ctx, alice, bid.OrderID); len(again) != len(updates) {
+		t.Fatalf("expected saving again to leave %d updates, got %d", len(updates), len(again))
+	}
+	if orders, _ := repo.Orders(ctx, OrderQuery{Owner: alice, Limit: 10}); len(orders) != 1 || orders[0] != want {
+		t.Fatalf("expected saving again to leave the order as it was, got %+v", orders)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "history.db")
+	repo, err := OpenSQLite(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRepository(t, repo)
+	repo.Close()
+
+	// what was kept outlives the process keeping it
+	repo, err = OpenSQLite(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if trades, err := repo.Trades(ctx, TradeQuery{Limit: 10}); err != nil || len(trades) != 1 {
+		t.Fatalf("expected the trade kept, got %+v, %v", trades, err)
+	}
+}
+
+func TestSQLiteAuditStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "history.db")
+	repo, err := OpenSQLite(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exchange.New(exchange.Config{AnonymousOrders: true, AuditStore: repo})
+	ex.Deposit(1, ledger.ETH, 1)
+	placed, _ := ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(100), User: 1, Market: exchange.MarketEth})
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Size: sz(1), Price: px(110), User: 1, Market: exchange.MarketEth})
+	ex.PlaceOrder(ctx, exchange.PlaceOrderRequest{Type: exchange.LimitOrder, Bid: true, Size: sz(1), Price: px(90), Market: exchange.MarketEth})
+	ex.Close()
+	repo.Close()
+
+	// the trail outlives the process keeping it
+	repo, err = OpenSQLite(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	records, err := repo.Query(exchange.AuditQuery{User: 1})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("expected user 1's two records, got %+v, %v", records, err)
+	}
+	if r := records[0]; r.Result != exchange.AuditAccepted || r.OrderID != placed.OrderID || r.Market != exchange.MarketEth || r.Seq == 0 {
+		t.Fatalf("unexpected accepted record %+v", r)
+	}
+	if r := records[1]; r.Result != exchange.AuditRejected || r.Code != "INSUFFICIENT_FUNDS" || string(r.Request) == "" {
+		t.Fatalf("unexpected rejected record %+v", r)
+	}
+	if records, _ := repo.Query(exchange.AuditQuery{Result: exchange.AuditAccepted}); len(records) != 2 {
+		t.Fatalf("expected two accepted records, got %+v", records)
+	}
+}
+
+func TestSQLiteSummary(t *testing.T) {
+	ctx := context.Background()
+	repo, err := OpenSQLite(ctx, filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	at := func(hour int) int64 { return day + int64(hour)*int64(time.Hour) }
+	update := func(typ exchange.OrderUpdateType, id, owner, trade uint64, hour int) OrderUpdate {
+		return OrderUpdate{Type: typ, Market: exchange.MarketEth, OrderID: id, Owner: owner, TradeID: trade, Price: 100, Remaining: 1, Timestamp: at(hour)}
+	}
+	err = repo.Save(ctx, Batch{
+		Updates: []OrderUpdate{
+			update(exchange.OrderUpdateAccepted, 1, 1, 0, 1),
+			update(exchange.OrderUpdateAccepted, 2, 2, 0, 1),
+			update(exchange.OrderUpdatePartialFill, 1, 1, 1, 2),
+			update(exchange.OrderUpdatePartialFill, 1, 1, 2, 3),
+			update(exchange.OrderUpdateCancelled, 2, 2, 0, 4),
+			// the next day's
+			update(exchange.OrderUpdateAccepted, 3, 3, 0, 25),
+		},
+		Trades: []Trade{
+			// a bid taker pays in the base asset and its maker in the quote
+			{ID: 1, Market: exchange.MarketEth, Bid: true, Price: 100, Size: 1, TakerFee: 0.002, MakerFee: 0.1, Timestamp: at(2)},
+			{ID: 2, Market: exchange.MarketEth, Price: 120, Size: 2, TakerFee: 0.48, MakerFee: 0.002, Timestamp: at(3)},
+			{ID: 3, Market: exchange.MarketEth, Bid: true, Price: 90, Size: 1, Timestamp: at(2) + 1},
+			{ID: 4, Market: exchange.MarketEth, Price: 500, Size: 1, Timestamp: at(25)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := repo.Summary(ctx, day, at(24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MarketSummary{
+		Market: exchange.MarketEth, Trades: 3, BaseVolume: 4, QuoteVolume: 430,
+		Open: 100, High: 120, Low: 90, Close: 120, BaseFees: 0.004, QuoteFees: 0.58,
+		Traders: 1, Orders: 2, Cancels: 1,
+	}
+	if got := summary.Markets[exchange.MarketEth]; got != want || len(summary.Markets) != 1 || summary.Traders != 1 {
+		t.Fatalf("expected %+v and one trader, got %+v", want, summary)
+	}
+	if summary, err := repo.Summary(ctx, at(48), at(72)); err != nil || len(summary.Markets) != 0 || summary.Traders != 0 {
+		t.Fatalf("expected an empty day, got %+v, %v", summary, err)
+	}
+}
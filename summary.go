@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/store"
+)
+
+// summarySettle is how long after a day ends its summary is cached, giving
+// the recorder the time to save the day's last trades.
+const summarySettle = time.Minute
+
+// daySummary is the trading of a UTC day, across the exchange: its markets,
+// every one listed, and their totals. Partial is set while the day isn't
+// over.
+type daySummary struct {
+	Date    string                `json:"date"`
+	Partial bool                  `json:"partial"`
+	Markets []store.MarketSummary `json:"markets"`
+	Total   summaryTotal          `json:"total"`
+}
+
+// summaryTotal adds up a day's markets. Volumes are in the quote asset, by
+// asset, and fees in the asset paid in.
+type summaryTotal struct {
+	Trades      int                      `json:"trades"`
+	QuoteVolume map[ledger.Asset]float64 `json:"quoteVolume"`
+	Fees        map[ledger.Asset]float64 `json:"fees"`
+	Traders     int                      `json:"traders"`
+	Orders      int                      `json:"orders"`
+	Cancels     int                      `json:"cancels"`
+}
+
+// summaryCache keeps the summaries of days over, which don't change, by
+// date.
+type summaryCache struct {
+	mu   sync.Mutex
+	days map[string]daySummary
+}
+
+func (sc *summaryCache) get(date string) (daySummary, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	summary, ok := sc.days[date]
+	return summary, ok
+}
+
+func (sc *summaryCache) put(summary daySummary) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.days == nil {
+		sc.days = make(map[string]daySummary)
+	}
+	sc.days[summary.Date] = summary
+}
+
+// handleGetSummary returns the trading of the UTC day the date query
+// parameter names (YYYY-MM-DD), today by default, in every market and
+// across the exchange. Markets without trades that day have zeroed rows.
+func (s *server) handleGetSummary(c echo.Context) error {
+	now := s.clock.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+	if v := c.QueryParam("date"); v != "" {
+		var err error
+		if day, err = time.Parse(time.DateOnly, v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "date must be YYYY-MM-DD",
+			})
+		}
+	}
+	if day.After(now) {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "date is in the future",
+		})
+	}
+	date := day.Format(time.DateOnly)
+	if summary, ok := s.summaries.get(date); ok {
+		return c.JSON(http.StatusOK, summary)
+	}
+
+	end := day.AddDate(0, 0, 1)
+	traded, err := s.history.Summary(c.Request().Context(), day.UnixNano(), end.UnixNano())
+	if err != nil {
+		return historyError(c, err)
+	}
+	summary := daySummary{
+		Date:    date,
+		Partial: now.Before(end),
+		Markets: []store.MarketSummary{},
+		Total: summaryTotal{
+			QuoteVolume: make(map[ledger.Asset]float64),
+			Fees:        make(map[ledger.Asset]float64),
+			Traders:     traded.Traders,
+		},
+	}
+	for _, market := range s.ex.Markets() {
+		ms, ok := traded.Markets[market]
+		if !ok {
+			ms = store.MarketSummary{Market: market}
+		}
+		summary.Markets = append(summary.Markets, ms)
+		assets, err := s.ex.Assets(market)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		total := &summary.Total
+		total.Trades += ms.Trades
+		total.Orders += ms.Orders
+		total.Cancels += ms.Cancels
+		total.QuoteVolume[assets.Quote] += ms.QuoteVolume
+		total.Fees[assets.Base] += ms.BaseFees
+		total.Fees[assets.Quote] += ms.QuoteFees
+	}
+	if !now.Before(end.Add(summarySettle)) {
+		s.summaries.put(summary)
+	}
+	return c.JSON(http.StatusOK, summary)
+}
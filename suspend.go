@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// handleSuspendUser stops a user placing orders in any market until they
+// are resumed. cancel=true also cancels their resting orders and stops.
+func (s *server) handleSuspendUser(c echo.Context) error {
+	user, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || user == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be a user ID",
+		})
+	}
+
+	cancelled, err := s.ex.SuspendUser(c.Request().Context(), user, c.QueryParam("cancel") == "true")
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":       "user suspended",
+		"cancelled": cancelled,
+	})
+}
+
+// handleResumeUser lets a suspended user place orders again.
+func (s *server) handleResumeUser(c echo.Context) error {
+	user, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || user == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be a user ID",
+		})
+	}
+
+	if err := s.ex.ResumeUser(user); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg": "user resumed",
+	})
+}
+
+// handleFreezeOrder leaves a resting order on the book but out of matching,
+// such as while a compliance hold is looked into.
+func (s *server) handleFreezeOrder(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be an order ID",
+		})
+	}
+
+	order, err := s.ex.FreezeOrder(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	format, err := s.exactFormat(order.Market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"msg":   "order frozen",
+		"order": orderRecordResponse{OrderRecord: order, format: format},
+	})
+}
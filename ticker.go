@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+func (s *server) handleGetBBO(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	ticker, err := s.ex.Ticker(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, tickerResponse{Ticker: ticker, format: format})
+}
+
+// handleStreamTicker streams conflated ticker updates as server-sent events.
+func (s *server) handleStreamTicker(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	updates, unsubscribe, err := s.ex.Subscribe(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case t := <-updates:
+			data, err := json.Marshal(tickerResponse{Ticker: t, format: format})
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// handleStreamMarket streams a market's ticker and trades as server-sent
+// events, for clients that can't use the WebSocket. It starts with the
+// current ticker, then sends conflated ticker events as /ticker/:market/stream
+// does and a trade event per trade, identified by its trade ID. A client
+// reconnecting with Last-Event-ID, as EventSource does, is first sent the
+// trades after it that are still held. The stream ends if the client falls
+// too far behind, for it to reconnect the same way.
+func (s *server) handleStreamMarket(c echo.Context) error {
+	market := exchange.Market(c.Param("symbol"))
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	var (
+		missed      []exchange.FeedMessage
+		trades      <-chan []exchange.FeedMessage
+		unsubscribe func()
+	)
+	if v := c.Request().Header.Get("Last-Event-ID"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "Last-Event-ID must be a trade ID",
+			})
+		}
+		missed, trades, unsubscribe, err = s.ex.ResumeTrades(market, after)
+	} else {
+		trades, unsubscribe, err = s.ex.SubscribeFeed(market)
+	}
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	defer unsubscribe()
+	tickers, unsubscribeTicker, err := s.ex.Subscribe(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	defer unsubscribeTicker()
+	ticker, err := s.ex.Ticker(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := writeTrades(w, missed, format); err != nil {
+		return err
+	}
+	if err := writeTicker(w, ticker, format); err != nil {
+		return err
+	}
+	w.Flush()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case t := <-tickers:
+			if err := writeTicker(w, t, format); err != nil {
+				return err
+			}
+		case msgs, ok := <-trades:
+			if !ok {
+				return nil
+			}
+			if err := writeTrades(w, msgs, format); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+	}
+}
+
+// writeTicker writes t as a ticker event. As with writeFeedMessages, a
+// client that has gone away is not an error.
+func writeTicker(w io.Writer, t exchange.Ticker, format numberFormat) error {
+	data, err := json.Marshal(tickerResponse{Ticker: t, format: format})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "event: ticker\ndata: %s\n\n", data)
+	return nil
+}
+
+// writeTrades writes the trades among msgs as one trade event each.
+func writeTrades(w io.Writer, msgs []exchange.FeedMessage, format numberFormat) error {
+	for _, msg := range msgs {
+		if msg.Type != exchange.FeedTrade {
+			continue
+		}
+		data, err := json.Marshal(feedMessageResponse{FeedMessage: msg, format: format})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: trade\nid: %d\ndata: %s\n\n", msg.TradeID, data); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
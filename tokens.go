@@ -0,0 +1,43 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/thenaveensharma/exchange/chain"
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// loadMarketAssets reads the assets of the markets to run from the JSON
+// file at path, an object from market to its assets, such as
+//
+//	{"LINK": {"base": "LINK", "quote": "USD", "baseToken": {"contract": "0x…", "decimals": 18}}}
+func loadMarketAssets(path string) (map[exchange.Market]exchange.MarketAssets, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var assets map[exchange.Market]exchange.MarketAssets
+	if err := json.Unmarshal(raw, &assets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return assets, nil
+}
+
+// chainTokens is the tokens ex's markets register, for the deposit watcher
+// and withdrawals.
+func chainTokens(ex *exchange.Exchange) ([]chain.Token, error) {
+	var tokens []chain.Token
+	for asset, token := range ex.Tokens() {
+		contract, err := chain.ParseAddress(token.Contract)
+		if err != nil {
+			return nil, fmt.Errorf("token %s: %w", asset, err)
+		}
+		tokens = append(tokens, chain.Token{Asset: asset, Contract: contract, Decimals: token.Decimals})
+	}
+	slices.SortFunc(tokens, func(a, b chain.Token) int { return cmp.Compare(a.Asset, b.Asset) })
+	return tokens, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+	"github.com/thenaveensharma/exchange/orderbook"
+	"github.com/thenaveensharma/exchange/store"
+)
+
+// handleGetTrades lists market's latest trades, newest first and at most
+// limit of them. The engine holds the last thousand or so; older ones come
+// from the order history database, if there is one.
+func (s *server) handleGetTrades(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+
+	format, err := s.numberFormat(c, market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	limit, ok := queryLimit(c)
+	if !ok {
+		return badLimit(c)
+	}
+	trades, err := s.ex.RecentTrades(market, limit)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if len(trades) < limit && s.history != nil {
+		q := store.TradeQuery{Market: market, Limit: limit - len(trades)}
+		if len(trades) > 0 {
+			// the database may not have the engine's latest yet, so it only
+			// picks up where they leave off
+			q.Before = trades[len(trades)-1].TradeID
+		}
+		older, err := s.history.Trades(c.Request().Context(), q)
+		if err != nil {
+			return historyError(c, err)
+		}
+		for _, t := range older {
+			trades = append(trades, tradeMessage(t, format.scale))
+		}
+	}
+
+	resp := make([]tradeResponse, len(trades))
+	for i, t := range trades {
+		resp[i] = tradeResponse{FeedMessage: t, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"trades": resp,
+	})
+}
+
+// exportPage is how many trades an export reads from the database at a
+// time, flushing them to the client before it reads more.
+const exportPage = 1000
+
+// exportColumns are the columns of a trade export, in order.
+var exportColumns = []string{"trade_id", "timestamp", "market", "price", "size", "notional", "taker_side", "maker_order_id", "taker_order_id", "maker_fee", "taker_fee"}
+
+// handleExportTrades streams market's trades from the order history
+// database as CSV, oldest first, bounded by the from and to query
+// parameters (RFC 3339). user narrows them to one user's: operators may
+// export anyone's or every trade, users only their own, which user
+// defaults to for them. The trades go out a page at a time, so the export
+// holds no more than a page in memory however long it is, and stops as
+// soon as the client goes away.
+func (s *server) handleExportTrades(c echo.Context) error {
+	market := exchange.Market(c.Param("market"))
+	if format := c.QueryParam("format"); format != "" && format != "csv" {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "format must be csv",
+		})
+	}
+	q := store.TradeQuery{Market: market, OldestFirst: true, Limit: exportPage}
+	if err := queryBounds(c, &q.From, &q.To); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	if v := c.QueryParam("user"); v != "" {
+		user, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "user must be a user ID",
+			})
+		}
+		q.User = user
+	}
+	if !isAdmin(c, s.adminKey) && q.User == 0 {
+		q.User = callerID(c)
+	}
+	if !isAdmin(c, s.adminKey) && q.User != callerID(c) {
+		return c.JSON(http.StatusForbidden, map[string]any{
+			"msg": "users may only export their own trades",
+		})
+	}
+	if _, err := s.ex.Assets(market); err != nil {
+		return errorResponse(c, err)
+	}
+
+	ctx := c.Request().Context()
+	trades, err := s.history.Trades(ctx, q)
+	if err != nil {
+		return historyError(c, err)
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, exportName(market, q.User, time.Now())))
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write(exportColumns)
+	for {
+		for _, t := range trades {
+			w.Write(exportRow(t))
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil
+		}
+		res.Flush()
+		if len(trades) < exportPage {
+			return nil
+		}
+		q.After = trades[len(trades)-1].ID
+		if trades, err = s.history.Trades(ctx, q); err != nil {
+			// the status is out with the first page, so all there is left
+			// to do is to cut the export short
+			if ctx.Err() == nil {
+				slog.Error("failed to export trades", "market", market, "error", err)
+			}
+			return nil
+		}
+	}
+}
+
+// exportName is the file name an export of market's trades, or user's in
+// it, made at now is offered as.
+func exportName(market exchange.Market, user uint64, now time.Time) string {
+	name := "trades-" + string(market)
+	if user != 0 {
+		name += "-user" + strconv.FormatUint(user, 10)
+	}
+	return name + "-" + now.UTC().Format("20060102T150405Z") + ".csv"
+}
+
+// exportRow is t as a row of exportColumns.
+func exportRow(t store.Trade) []string {
+	side := exchange.SideSell
+	if t.Bid {
+		side = exchange.SideBuy
+	}
+	number := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return []string{
+		strconv.FormatUint(t.ID, 10),
+		time.Unix(0, t.Timestamp).UTC().Format(time.RFC3339Nano),
+		string(t.Market),
+		number(t.Price),
+		number(t.Size),
+		number(ledger.Notional(t.Price, t.Size)),
+		string(side),
+		strconv.FormatUint(t.MakerOrderID, 10),
+		strconv.FormatUint(t.TakerOrderID, 10),
+		number(t.MakerFee),
+		number(t.TakerFee),
+	}
+}
+
+// tradeMessage is t as the feed publishes it, in the units of its market's
+// scale.
+func tradeMessage(t store.Trade, scale orderbook.Scale) exchange.FeedMessage {
+	side := orderbook.SideAsk
+	if t.Bid {
+		side = orderbook.SideBid
+	}
+	return exchange.FeedMessage{Type: exchange.FeedTrade, Market: t.Market, Side: side, Price: scale.PriceOf(t.Price), Size: scale.SizeOf(t.Size), TradeID: t.ID, Timestamp: t.Timestamp}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// handleTransfer moves funds from one user's free balance to another's.
+// Users may only send their own, and From defaults to the caller; operators
+// may move anyone's. A retry repeating the sender's reference answers with
+// the transfer already made, with 200 rather than 201.
+func (s *server) handleTransfer(c echo.Context) error {
+	var req exchange.TransferRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	if !isAdmin(c, s.adminKey) {
+		if req.From == 0 {
+			req.From = callerID(c)
+		}
+		if req.From != callerID(c) {
+			return c.JSON(http.StatusForbidden, map[string]any{
+				"msg": "users may only transfer their own funds",
+			})
+		}
+	}
+	for _, id := range []uint64{req.From, req.To} {
+		if _, err := s.users.Get(id); errors.Is(err, user.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]any{
+				"msg": err.Error(),
+			})
+		}
+	}
+	transfer, err := s.ex.Transfer(req)
+	switch {
+	case errors.Is(err, exchange.ErrTransferReference):
+		return c.JSON(http.StatusConflict, map[string]any{
+			"msg": err.Error(),
+		})
+	case err != nil:
+		return errorResponse(c, err)
+	}
+	status := http.StatusCreated
+	if transfer.Repeated {
+		status = http.StatusOK
+	}
+	return c.JSON(status, transfer)
+}
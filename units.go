@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/orderbook"
+)
+
+// Clients send prices and sizes as decimals, JSON numbers, which the
+// exchange keeps as whole numbers of each market's units. The bodies here
+// shadow the exchange requests' price and size fields with the decimals as
+// sent, which units reads with the market's scale: exactly, so a price with
+// more places than the market keeps is refused rather than rounded.
+
+// number is a JSON number as it was written. Unlike json.Number it refuses a
+// string, as the float64 fields it stands in for did.
+type number string
+
+func (n *number) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	// a valid JSON value starting with a minus or a digit is a number
+	if !json.Valid(data) || !strings.ContainsRune("-0123456789", rune(data[0])) {
+		return fmt.Errorf("%s is not a number", data)
+	}
+	*n = number(data)
+	return nil
+}
+
+// unitParser reads a request's decimals with scale, keeping the first error.
+type unitParser struct {
+	scale orderbook.Scale
+	err   error
+}
+
+func (p *unitParser) price(field string, v number) orderbook.Price {
+	if v == "" || p.err != nil {
+		return 0
+	}
+	price, err := p.scale.ParsePrice(string(v))
+	if err != nil {
+		p.err = fmt.Errorf("%s: %w", field, err)
+	}
+	return price
+}
+
+func (p *unitParser) size(field string, v number) orderbook.Size {
+	if v == "" || p.err != nil {
+		return 0
+	}
+	size, err := p.scale.ParseSize(string(v))
+	if err != nil {
+		p.err = fmt.Errorf("%s: %w", field, err)
+	}
+	return size
+}
+
+// optSize is size for a field that may be left out.
+func (p *unitParser) optSize(field string, v *number) *orderbook.Size {
+	if v == nil {
+		return nil
+	}
+	size := p.size(field, *v)
+	return &size
+}
+
+// placeOrderBody is the body of POST /order.
+type placeOrderBody struct {
+	exchange.PlaceOrderRequest
+	Size        number `json:"size"`
+	WorstPrice  number `json:"worstPrice,omitempty"`
+	Price       number `json:"price"`
+	DisplaySize number `json:"displaySize,omitempty"`
+	StopPrice   number `json:"stopPrice,omitempty"`
+}
+
+func (b placeOrderBody) units(scale orderbook.Scale) (exchange.PlaceOrderRequest, error) {
+	p := unitParser{scale: scale}
+	req := b.PlaceOrderRequest
+	req.Size = p.size("size", b.Size)
+	req.WorstPrice = p.price("worstPrice", b.WorstPrice)
+	req.Price = p.price("price", b.Price)
+	req.DisplaySize = p.size("displaySize", b.DisplaySize)
+	req.StopPrice = p.price("stopPrice", b.StopPrice)
+	return req, p.err
+}
+
+// modifyBody is the body of PUT /order/:id.
+type modifyBody struct {
+	Price number `json:"price"`
+	Size  number `json:"size"`
+}
+
+func (b modifyBody) units(scale orderbook.Scale) (exchange.ModifyRequest, error) {
+	p := unitParser{scale: scale}
+	req := exchange.ModifyRequest{
+		Price: p.price("price", b.Price),
+		Size:  p.size("size", b.Size),
+	}
+	return req, p.err
+}
+
+// reduceBody is the body of POST /order/:id/reduce.
+type reduceBody struct {
+	exchange.ReduceRequest
+	By number  `json:"by,omitempty"`
+	To *number `json:"to,omitempty"`
+}
+
+func (b reduceBody) units(scale orderbook.Scale) (exchange.ReduceRequest, error) {
+	p := unitParser{scale: scale}
+	req := b.ReduceRequest
+	req.By = p.size("by", b.By)
+	req.To = p.optSize("to", b.To)
+	return req, p.err
+}
+
+// seedBody is the body of POST /sandbox/seed/:market.
+type seedBody struct {
+	exchange.SeedRequest
+	Mid  number `json:"mid"`
+	Step number `json:"step"`
+	Size number `json:"size"`
+}
+
+func (b seedBody) units(scale orderbook.Scale) (exchange.SeedRequest, error) {
+	p := unitParser{scale: scale}
+	req := b.SeedRequest
+	req.Mid = p.price("mid", b.Mid)
+	req.Step = p.price("step", b.Step)
+	req.Size = p.size("size", b.Size)
+	return req, p.err
+}
+
+// limitsPatchBody is the body of PATCH /markets/:symbol/limits.
+type limitsPatchBody struct {
+	exchange.LimitsPatch
+	MaxOrderSize *number `json:"maxOrderSize"`
+}
+
+func (b limitsPatchBody) units(scale orderbook.Scale) (exchange.LimitsPatch, error) {
+	p := unitParser{scale: scale}
+	patch := b.LimitsPatch
+	patch.MaxOrderSize = p.optSize("maxOrderSize", b.MaxOrderSize)
+	return patch, p.err
+}
+
+// exportBody is the body of POST /admin/markets/:symbol/import, a book as
+// GET /admin/markets/:symbol/export writes it.
+type exportBody struct {
+	exchange.MarketExport
+	Asks []snapshotLevelBody `json:"asks"`
+	Bids []snapshotLevelBody `json:"bids"`
+}
+
+type snapshotLevelBody struct {
+	Price  number              `json:"price"`
+	Orders []snapshotOrderBody `json:"orders"`
+}
+
+type snapshotOrderBody struct {
+	orderbook.SnapshotOrder
+	Size         number `json:"size"`
+	OriginalSize number `json:"originalSize,omitempty"`
+	DisplaySize  number `json:"displaySize,omitempty"`
+	Hidden       number `json:"hidden,omitempty"`
+}
+
+func (b exportBody) units(scale orderbook.Scale) (orderbook.Snapshot, error) {
+	p := unitParser{scale: scale}
+	levels := func(src []snapshotLevelBody) []orderbook.SnapshotLevel {
+		if src == nil {
+			return nil
+		}
+		dst := make([]orderbook.SnapshotLevel, len(src))
+		for i, l := range src {
+			dst[i].Price = p.price("price", l.Price)
+			dst[i].Orders = make([]orderbook.SnapshotOrder, len(l.Orders))
+			for j, o := range l.Orders {
+				order := o.SnapshotOrder
+				order.Size = p.size("size", o.Size)
+				order.OriginalSize = p.size("originalSize", o.OriginalSize)
+				order.DisplaySize = p.size("displaySize", o.DisplaySize)
+				order.Hidden = p.size("hidden", o.Hidden)
+				dst[i].Orders[j] = order
+			}
+		}
+		return dst
+	}
+	snapshot := orderbook.Snapshot{
+		Sequence: b.Sequence,
+		Asks:     levels(b.Asks),
+		Bids:     levels(b.Bids),
+	}
+	return snapshot, p.err
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+// DefaultSessionTTL is how long a session token lasts when NewSessions is
+// given no TTL.
+const DefaultSessionTTL = 15 * time.Minute
+
+// ErrInvalidToken is returned by Verify for a token that is malformed, not
+// signed with the sessions' secret, or expired.
+var ErrInvalidToken = errors.New("invalid or expired session token")
+
+// jwtHeader is the header of every token issued: HMAC-SHA256, the only
+// algorithm Verify accepts.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// claims is the payload of a session token. Subject is the user ID;
+// IssuedAt and ExpiresAt are in unix seconds, as JWTs have them.
+type claims struct {
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Sessions issues and verifies short-lived session tokens, JWTs signed with
+// HMAC-SHA256, for clients such as browsers that shouldn't hold an API key.
+// Tokens are not stored: any token signed with the secret is good until it
+// expires.
+type Sessions struct {
+	secret []byte
+	ttl    time.Duration
+	clock  clock.Clock
+}
+
+// NewSessions returns sessions signing with secret that last ttl, or
+// DefaultSessionTTL if it is zero.
+func NewSessions(secret []byte, ttl time.Duration, clk clock.Clock) *Sessions {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &Sessions{secret: secret, ttl: ttl, clock: clk}
+}
+
+// Issue returns a token for u and when it expires, in unix nanoseconds.
+func (s *Sessions) Issue(u User) (string, int64) {
+	now := s.clock.Now()
+	expires := now.Add(s.ttl)
+	payload, _ := json.Marshal(claims{
+		Subject:   strconv.FormatUint(u.ID, 10),
+		Name:      u.Name,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + s.sign(signed), expires.UnixNano()
+}
+
+// Verify returns the ID of the user token was issued to.
+func (s *Sessions) Verify(token string) (uint64, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return 0, ErrInvalidToken
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(header+"."+payload))) {
+		return 0, ErrInvalidToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	var c claims
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return 0, ErrInvalidToken
+	}
+	if s.clock.Now().Unix() >= c.ExpiresAt {
+		return 0, ErrInvalidToken
+	}
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, ErrInvalidToken
+	}
+	return id, nil
+}
+
+func (s *Sessions) sign(signed string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
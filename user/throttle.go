@@ -0,0 +1,77 @@
+package user
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+// Throttle limits how often something may be tried for each key, such as
+// logging in as one name or from one address: burst tries at once, then
+// one more each interval. Its methods are safe for concurrent use.
+type Throttle struct {
+	mu       sync.Mutex
+	clock    clock.Clock
+	burst    float64
+	interval time.Duration
+	buckets  map[string]*bucket
+	// swept is when the keys with all their tries back were last dropped
+	swept time.Time
+}
+
+// bucket is the tries a key has left as of at.
+type bucket struct {
+	tries float64
+	at    time.Time
+}
+
+// NewThrottle returns a throttle allowing burst tries for each key, then
+// one more each interval.
+func NewThrottle(burst int, interval time.Duration, clk clock.Clock) *Throttle {
+	return &Throttle{
+		clock:    clk,
+		burst:    float64(burst),
+		interval: interval,
+		buckets:  make(map[string]*bucket),
+		swept:    clk.Now(),
+	}
+}
+
+// Allow takes a try for key. If key has none left it takes nothing and
+// returns false, with how long until it has one.
+func (t *Throttle) Allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	t.sweep(now)
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tries: t.burst, at: now}
+		t.buckets[key] = b
+	}
+	b.tries = min(t.burst, b.tries+float64(now.Sub(b.at))/float64(t.interval))
+	b.at = now
+	if b.tries < 1 {
+		return false, time.Duration((1 - b.tries) * float64(t.interval))
+	}
+	b.tries--
+	return true, 0
+}
+
+// sweep drops the keys that have had the time to get all their tries back,
+// as many as it takes, so the throttle doesn't grow with every key it has
+// seen. The caller holds t.mu.
+func (t *Throttle) sweep(now time.Time) {
+	full := time.Duration(t.burst * float64(t.interval))
+	if now.Sub(t.swept) < full {
+		return
+	}
+	for key, b := range t.buckets {
+		if now.Sub(b.at) >= full {
+			delete(t.buckets, key)
+		}
+	}
+	t.swept = now
+}
@@ -0,0 +1,321 @@
+// Package user keeps the exchange's registered users and the API keys they
+// authenticate with.
+package user
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+var (
+	// ErrInvalidName is returned by Register for a name that doesn't match
+	// NamePattern.
+	ErrInvalidName = errors.New("name must be 3 to 32 letters, digits, '-' or '_'")
+	ErrNameTaken   = errors.New("name is already registered")
+	ErrNotFound    = errors.New("user not found")
+	// ErrWeakPassword is returned by Register for a password shorter than
+	// MinPasswordLength.
+	ErrWeakPassword   = errors.New("password must be at least 8 characters")
+	ErrBadCredentials = errors.New("wrong name or password")
+)
+
+// MinPasswordLength is the shortest password Register accepts, in bytes.
+const MinPasswordLength = 8
+
+// passwordIterations is the PBKDF2 work factor for stored passwords.
+const passwordIterations = 600_000
+
+// NamePattern is what a user name may look like.
+var NamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+// User is a registered user. IDs start at 1; zero is left to mean no user,
+// as on anonymous orders.
+type User struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	// CreatedAt is when the user registered, in unix nanoseconds.
+	CreatedAt int64 `json:"createdAt"`
+}
+
+// Registry holds the registered users. Its methods are safe for concurrent
+// use.
+type Registry struct {
+	mu     sync.RWMutex
+	clock  clock.Clock
+	users  map[uint64]User
+	byName map[string]uint64
+	// byKey is keyed by HashKey of each API key, so the keys themselves are
+	// never kept
+	byKey map[string]uint64
+	// settings holds the keys whose settings were changed, by the same hash
+	settings map[string]KeySettings
+	// passwords holds the users who set one, salted and stretched
+	passwords map[uint64]password
+	last      uint64
+}
+
+// password is a stored password: its PBKDF2-SHA256 hash and the salt it was
+// hashed with.
+type password struct {
+	salt []byte
+	hash []byte
+}
+
+// Registration is a user as the registry keeps them, for recording a
+// registration and adding it again: their API key only as HashKey of it,
+// and their password, if they set one, only salted and stretched. User's ID
+// and CreatedAt are given by Add.
+type Registration struct {
+	User         User   `json:"user"`
+	KeyHash      string `json:"keyHash"`
+	PasswordSalt []byte `json:"passwordSalt,omitempty"`
+	PasswordHash []byte `json:"passwordHash,omitempty"`
+}
+
+// Snapshot is everything a registry holds: its users, oldest first, and the
+// settings of the keys whose settings were changed, by HashKey of the key.
+type Snapshot struct {
+	Users    []Registration         `json:"users,omitempty"`
+	Settings map[string]KeySettings `json:"settings,omitempty"`
+}
+
+// NewRegistry returns an empty registry dating registrations by clk.
+func NewRegistry(clk clock.Clock) *Registry {
+	return &Registry{
+		clock:  clk,
+		users:  make(map[uint64]User),
+		byName: make(map[string]uint64),
+		byKey:  make(map[string]uint64),
+
+		settings: make(map[string]KeySettings),
+
+		passwords: make(map[uint64]password),
+	}
+}
+
+// Register adds a user called name and returns it with its API key. The key
+// is only ever handed out here. A user who gives a password can also log in
+// with it; one who doesn't only has the key.
+func (r *Registry) Register(name, pass string) (User, string, error) {
+	reg, key, err := NewRegistration(name, pass)
+	if err != nil {
+		return User{}, "", err
+	}
+	u, err := r.Add(reg)
+	if err != nil {
+		return User{}, "", err
+	}
+	return u, key, nil
+}
+
+// NewRegistration checks name and pass as Register does, and returns the
+// registration of a user called name with a new API key, and the key. It
+// adds no one: Add does.
+func NewRegistration(name, pass string) (Registration, string, error) {
+	if !NamePattern.MatchString(name) {
+		return Registration{}, "", ErrInvalidName
+	}
+	if pass != "" && len(pass) < MinPasswordLength {
+		return Registration{}, "", ErrWeakPassword
+	}
+	key := newKey()
+	reg := Registration{User: User{Name: name}, KeyHash: HashKey(key)}
+	if pass != "" {
+		stored := hashPassword(pass, nil)
+		reg.PasswordSalt, reg.PasswordHash = stored.salt, stored.hash
+	}
+	return reg, key, nil
+}
+
+// Add adds the user reg registers, with the next ID, registered now, and
+// returns them. It returns ErrNameTaken if their name is.
+func (r *Registry) Add(reg Registration) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byName[reg.User.Name]; ok {
+		return User{}, ErrNameTaken
+	}
+	reg.User.ID = r.last + 1
+	reg.User.CreatedAt = r.clock.Now().UnixNano()
+	r.add(reg)
+	return reg.User, nil
+}
+
+// add adds reg as it is. The caller holds r.mu.
+func (r *Registry) add(reg Registration) {
+	u := reg.User
+	r.users[u.ID] = u
+	r.byName[u.Name] = u.ID
+	r.byKey[reg.KeyHash] = u.ID
+	if reg.PasswordHash != nil {
+		r.passwords[u.ID] = password{salt: reg.PasswordSalt, hash: reg.PasswordHash}
+	}
+	r.last = max(r.last, u.ID)
+}
+
+// Registered reports whether a user called name is.
+func (r *Registry) Registered(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.byName[name]
+	return ok
+}
+
+// Login returns the user called name if pass is their password. It returns
+// ErrBadCredentials alike for an unknown name, a user without a password and
+// a wrong one.
+func (r *Registry) Login(name, pass string) (User, error) {
+	r.mu.RLock()
+	id, ok := r.byName[name]
+	stored, hasPassword := r.passwords[id]
+	u := r.users[id]
+	r.mu.RUnlock()
+
+	if !ok || !hasPassword {
+		return User{}, ErrBadCredentials
+	}
+	if subtle.ConstantTimeCompare(hashPassword(pass, stored.salt).hash, stored.hash) != 1 {
+		return User{}, ErrBadCredentials
+	}
+	return u, nil
+}
+
+// Authenticate returns the user key belongs to.
+func (r *Registry) Authenticate(key string) (User, bool) {
+	if key == "" {
+		return User{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byKey[HashKey(key)]
+	if !ok {
+		return User{}, false
+	}
+	return r.users[id], true
+}
+
+// KeySettings are the defaults an API key applies to the orders placed with
+// it.
+type KeySettings struct {
+	// SelfTradePrevention is the self-trade prevention mode of orders that
+	// don't name one, the exchange's default if empty.
+	SelfTradePrevention string `json:"selfTradePrevention,omitempty"`
+}
+
+// KeySettings returns the settings of key, which are zero until set.
+func (r *Registry) KeySettings(key string) (KeySettings, error) {
+	return r.HashedKeySettings(HashKey(key))
+}
+
+// HashedKeySettings returns the settings of the key hash is HashKey of.
+func (r *Registry) HashedKeySettings(hash string) (KeySettings, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.byKey[hash]; !ok {
+		return KeySettings{}, ErrNotFound
+	}
+	return r.settings[hash], nil
+}
+
+// SetKeySettings replaces the settings of key.
+func (r *Registry) SetKeySettings(key string, settings KeySettings) error {
+	return r.SetHashedKeySettings(HashKey(key), settings)
+}
+
+// SetHashedKeySettings replaces the settings of the key hash is HashKey of.
+func (r *Registry) SetHashedKeySettings(hash string, settings KeySettings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byKey[hash]; !ok {
+		return ErrNotFound
+	}
+	r.settings[hash] = settings
+	return nil
+}
+
+// Get returns the user with id.
+func (r *Registry) Get(id uint64) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// Snapshot returns everything r holds.
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snap := Snapshot{Users: make([]Registration, 0, len(r.users))}
+	keys := make(map[uint64]string, len(r.byKey))
+	for hash, id := range r.byKey {
+		keys[id] = hash
+	}
+	for _, id := range slices.Sorted(maps.Keys(r.users)) {
+		reg := Registration{User: r.users[id], KeyHash: keys[id]}
+		if stored, ok := r.passwords[id]; ok {
+			reg.PasswordSalt, reg.PasswordHash = stored.salt, stored.hash
+		}
+		snap.Users = append(snap.Users, reg)
+	}
+	if len(r.settings) > 0 {
+		snap.Settings = maps.Clone(r.settings)
+	}
+	return snap
+}
+
+// Restore loads what a Snapshot kept. Users registered after it are given
+// the IDs that follow theirs.
+func (r *Registry) Restore(snap Snapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, reg := range snap.Users {
+		r.add(reg)
+	}
+	maps.Copy(r.settings, snap.Settings)
+}
+
+// HashKey is the SHA-256 of key, in hex: what a registry keeps of it.
+func HashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// hashPassword stretches pass with salt, or with a new random salt if salt
+// is nil.
+func hashPassword(pass string, salt []byte) password {
+	if salt == nil {
+		salt = make([]byte, 16)
+		rand.Read(salt)
+	}
+	// pbkdf2.Key only fails for key lengths SHA-256 can't produce
+	hash, _ := pbkdf2.Key(sha256.New, pass, salt, passwordIterations, sha256.Size)
+	return password{salt: salt, hash: hash}
+}
+
+func newKey() string {
+	b := make([]byte, 32)
+	// crypto/rand.Read never fails
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
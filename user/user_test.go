@@ -0,0 +1,193 @@
+package user
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thenaveensharma/exchange/clock"
+)
+
+func TestRegistry(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	r := NewRegistry(clock.NewFake(start))
+
+	alice, key, err := r.Register("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.ID != 1 || alice.Name != "alice" || alice.CreatedAt != start.UnixNano() || len(key) != 64 {
+		t.Fatalf("unexpected user %+v with key %q", alice, key)
+	}
+	bob, bobKey, err := r.Register("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.ID != 2 || bobKey == key {
+		t.Fatalf("unexpected user %+v with key %q", bob, bobKey)
+	}
+
+	if u, ok := r.Authenticate(key); !ok || u != alice {
+		t.Fatalf("expected alice, got %+v, %v", u, ok)
+	}
+	for _, bad := range []string{"", "nope", key[:63]} {
+		if _, ok := r.Authenticate(bad); ok {
+			t.Fatalf("expected %q to be refused", bad)
+		}
+	}
+	if u, err := r.Get(bob.ID); err != nil || u != bob {
+		t.Fatalf("expected bob, got %+v, %v", u, err)
+	}
+	if _, err := r.Get(3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if _, _, err := r.Register("alice", ""); !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("expected ErrNameTaken, got %v", err)
+	}
+	for _, name := range []string{"", "al", "alice smith", "alice!"} {
+		if _, _, err := r.Register(name, ""); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("expected ErrInvalidName for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	r := NewRegistry(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	alice, _, err := r.Register("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Register("bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Register("carol", "short"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("expected ErrWeakPassword, got %v", err)
+	}
+
+	if u, err := r.Login("alice", "correct horse"); err != nil || u != alice {
+		t.Fatalf("expected alice, got %+v, %v", u, err)
+	}
+	for _, c := range []struct{ name, pass string }{
+		{"alice", "wrong horse"},
+		{"alice", ""},
+		// bob has no password and can only use his key
+		{"bob", ""},
+		{"carol", "short"},
+	} {
+		if _, err := r.Login(c.name, c.pass); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("expected ErrBadCredentials for %q, got %v", c.name, err)
+		}
+	}
+}
+
+func TestKeySettings(t *testing.T) {
+	r := NewRegistry(clock.NewFake(time.Unix(1_700_000_000, 0)))
+	_, key, err := r.Register("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings, err := r.KeySettings(key); err != nil || settings != (KeySettings{}) {
+		t.Fatalf("expected no settings, got %+v, %v", settings, err)
+	}
+	want := KeySettings{SelfTradePrevention: "DECREMENT"}
+	if err := r.SetKeySettings(key, want); err != nil {
+		t.Fatal(err)
+	}
+	if settings, err := r.KeySettings(key); err != nil || settings != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, settings, err)
+	}
+	if err := r.SetKeySettings("unknown", want); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	s := NewSessions([]byte("secret"), time.Minute, clk)
+	u := User{ID: 7, Name: "alice"}
+
+	token, expiresAt := s.Issue(u)
+	if expiresAt != clk.Now().Add(time.Minute).UnixNano() {
+		t.Fatalf("unexpected expiry %d", expiresAt)
+	}
+	if id, err := s.Verify(token); err != nil || id != u.ID {
+		t.Fatalf("expected user 7, got %d, %v", id, err)
+	}
+
+	other := NewSessions([]byte("other secret"), time.Minute, clk)
+	forged, _ := other.Issue(u)
+	header, rest, _ := strings.Cut(token, ".")
+	_, sig, _ := strings.Cut(rest, ".")
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","exp":9999999999}`)) + "." + sig
+	for _, bad := range []string{"", "a.b.c", forged, unsigned, token + "x"} {
+		if _, err := s.Verify(bad); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected ErrInvalidToken for %q, got %v", bad, err)
+		}
+	}
+
+	clk.Advance(time.Minute)
+	if _, err := s.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected an expired token to be refused, got %v", err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	th := NewThrottle(2, 10*time.Second, clk)
+
+	for range 2 {
+		if ok, _ := th.Allow("alice"); !ok {
+			t.Fatal("expected a try within the burst to be allowed")
+		}
+	}
+	if ok, wait := th.Allow("alice"); ok || wait != 10*time.Second {
+		t.Fatalf("expected to wait 10s, got %v, %v", ok, wait)
+	}
+	if ok, _ := th.Allow("bob"); !ok {
+		t.Fatal("expected another key to have its own tries")
+	}
+	clk.Advance(4 * time.Second)
+	if ok, wait := th.Allow("alice"); ok || wait != 6*time.Second {
+		t.Fatalf("expected to wait 6s, got %v, %v", ok, wait)
+	}
+	clk.Advance(6 * time.Second)
+	if ok, _ := th.Allow("alice"); !ok {
+		t.Fatal("expected a try back after 10s")
+	}
+	if ok, _ := th.Allow("alice"); ok {
+		t.Fatal("expected only one try back")
+	}
+
+	// keys with all their tries back are forgotten
+	clk.Advance(time.Minute)
+	th.Allow("carol")
+	if n := len(th.buckets); n != 1 {
+		t.Fatalf("expected 1 key kept, got %d", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	r := NewRegistry(clk)
+	alice, aliceKey, _ := r.Register("alice", "correct horse")
+	_, bobKey, _ := r.Register("bob", "")
+	r.SetKeySettings(bobKey, KeySettings{SelfTradePrevention: "CANCEL_NEWEST"})
+
+	restored := NewRegistry(clk)
+	restored.Restore(r.Snapshot())
+	if u, ok := restored.Authenticate(aliceKey); !ok || u != alice {
+		t.Fatalf("expected alice's key to authenticate them, got %+v, %v", u, ok)
+	}
+	if u, err := restored.Login("alice", "correct horse"); err != nil || u != alice {
+		t.Fatalf("expected alice to log in, got %+v, %v", u, err)
+	}
+	if settings, _ := restored.KeySettings(bobKey); settings.SelfTradePrevention != "CANCEL_NEWEST" {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	if carol, _, _ := restored.Register("carol", ""); carol.ID != 3 {
+		t.Fatalf("expected carol to be user 3, got %d", carol.ID)
+	}
+}
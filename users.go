@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/user"
+)
+
+// userContextKey is where authenticate leaves the caller in the request's
+// echo.Context.
+const userContextKey = "user"
+
+// Each login checks a password stretched by PBKDF2, so logins are
+// throttled before it is checked: a name may be tried loginNameBurst times
+// at once and a client address loginAddressBurst times, then each once
+// more every loginInterval.
+const (
+	loginNameBurst    = 5
+	loginAddressBurst = 20
+	loginInterval     = 10 * time.Second
+)
+
+// authenticate resolves the API key in the X-API-Key header, or the session
+// token in a bearer Authorization header, to its user. Requests with
+// neither go on anonymously; credentials that match no user are refused
+// rather than downgraded, so a client with a stale key or an expired
+// session finds out.
+func (s *server) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u, ok, err := s.credentials(c.Request().Header.Get("X-API-Key"), c.Request().Header.Get(echo.HeaderAuthorization))
+		if err != nil {
+			return unauthorized(c)
+		}
+		if ok {
+			c.Set(userContextKey, u)
+		}
+		return next(c)
+	}
+}
+
+var errBadCredentials = errors.New("unauthorized")
+
+// credentials resolves an API key, or failing that a bearer authorization,
+// to its user. ok is false when there are neither; credentials that match
+// no user are errBadCredentials.
+func (s *server) credentials(key, auth string) (u user.User, ok bool, err error) {
+	if key != "" {
+		u, ok := s.users.Authenticate(key)
+		if !ok {
+			return user.User{}, false, errBadCredentials
+		}
+		return u, true, nil
+	}
+
+	if auth == "" {
+		return user.User{}, false, nil
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return user.User{}, false, errBadCredentials
+	}
+	id, err := s.sessions.Verify(token)
+	if err != nil {
+		return user.User{}, false, errBadCredentials
+	}
+	u, err = s.users.Get(id)
+	if err != nil {
+		return user.User{}, false, errBadCredentials
+	}
+	return u, true, nil
+}
+
+// caller returns the user the request authenticated as, if any.
+func caller(c echo.Context) (user.User, bool) {
+	u, ok := c.Get(userContextKey).(user.User)
+	return u, ok
+}
+
+// callerID is the caller's user ID, zero for an anonymous request.
+func callerID(c echo.Context) uint64 {
+	u, _ := caller(c)
+	return u.ID
+}
+
+// requireUser guards routes that only make sense for a user.
+func requireUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, ok := caller(c); !ok {
+			return unauthorized(c)
+		}
+		return next(c)
+	}
+}
+
+// adminOrUser guards routes open to operators, with the admin key, and to
+// users acting on their own behalf.
+func adminOrUser(adminKey string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := caller(c); !ok && !isAdmin(c, adminKey) {
+				return unauthorized(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// adminOrSelf guards routes on the user with :id, open to operators, with
+// the admin key, and to that user.
+func adminOrSelf(adminKey string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err != nil || id == 0 {
+				return c.JSON(http.StatusBadRequest, map[string]any{
+					"msg": "id must be a user ID",
+				})
+			}
+			if !isAdmin(c, adminKey) && callerID(c) != id {
+				return unauthorized(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// pathUser is the user :id names, which adminOrSelf has checked.
+func pathUser(c echo.Context) uint64 {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	return id
+}
+
+// isAdmin reports whether the request carries key in X-Admin-Key. With no
+// key configured nobody is.
+func isAdmin(c echo.Context, key string) bool {
+	got := c.Request().Header.Get("X-Admin-Key")
+	return key != "" && subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1
+}
+
+func unauthorized(c echo.Context) error {
+	return c.JSON(http.StatusUnauthorized, map[string]any{
+		"msg": "unauthorized",
+	})
+}
+
+// registerRequest is the body of POST /users. Password is optional and
+// only needed for POST /login.
+type registerRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+}
+
+// handleRegister signs up a user and hands back its API key, which is never
+// shown again.
+func (s *server) handleRegister(c echo.Context) error {
+	var req registerRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+
+	u, key, err := s.users.Register(req.Name, req.Password)
+	switch {
+	case errors.Is(err, user.ErrNameTaken):
+		return c.JSON(http.StatusConflict, map[string]any{
+			"msg": err.Error(),
+		})
+	case err != nil:
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"user":   u,
+		"apiKey": key,
+	})
+}
+
+// loginRequest is the body of POST /login.
+type loginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// handleLogin trades a user's name and password for a short-lived session
+// token, for clients like browsers that shouldn't keep an API key. The
+// token goes in the Authorization header as a bearer token.
+func (s *server) handleLogin(c echo.Context) error {
+	var req loginRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	for _, try := range []struct {
+		throttle *user.Throttle
+		key      string
+	}{{s.loginAddresses, c.RealIP()}, {s.loginNames, req.Name}} {
+		if ok, wait := try.throttle.Allow(try.key); !ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return c.JSON(http.StatusTooManyRequests, map[string]any{
+				"msg": "too many login attempts, try again later",
+			})
+		}
+	}
+
+	u, err := s.users.Login(req.Name, req.Password)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	token, expiresAt := s.sessions.Issue(u)
+	return c.JSON(http.StatusOK, map[string]any{
+		"token":     token,
+		"expiresAt": expiresAt,
+	})
+}
+
+func (s *server) handleGetMe(c echo.Context) error {
+	u, _ := caller(c)
+	return c.JSON(http.StatusOK, u)
+}
+
+// handleGetMyOrders lists the caller's orders, resting and recently
+// finished.
+func (s *server) handleGetMyOrders(c echo.Context) error {
+	orders := s.ex.UserOrders(callerID(c))
+	responses := make([]orderRecordResponse, len(orders))
+	for i, order := range orders {
+		format, err := s.exactFormat(order.Market)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		responses[i] = orderRecordResponse{OrderRecord: order, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"orders": responses,
+	})
+}
+
+// handleGetMyTrades lists the caller's most recent fills.
+func (s *server) handleGetMyTrades(c echo.Context) error {
+	fills := s.ex.Fills(callerID(c))
+	responses := make([]fillResponse, len(fills))
+	for i, fill := range fills {
+		format, err := s.exactFormat(fill.Market)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		responses[i] = fillResponse{Fill: fill, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"trades": responses,
+	})
+}
+
+// handleGetUserTrades lists the trades of the user in the path in the
+// market query parameter, oldest first, with their role, side, fee and
+// running totals. A page holds at most limit of them; from pages on past
+// a trade ID, and next, set when the page is full, is the one to pass for
+// the page after it.
+func (s *server) handleGetUserTrades(c echo.Context) error {
+	market := exchange.Market(c.QueryParam("market"))
+	if market == "" {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "market is required",
+		})
+	}
+	limit, ok := queryLimit(c)
+	if !ok {
+		return badLimit(c)
+	}
+	var from uint64
+	if v := c.QueryParam("from"); v != "" {
+		var err error
+		if from, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"msg": "from must be a trade ID",
+			})
+		}
+	}
+
+	trades, err := s.ex.UserTrades(pathUser(c), market, from, limit)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	format, err := s.exactFormat(market)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	responses := make([]userTradeResponse, len(trades))
+	for i, t := range trades {
+		responses[i] = userTradeResponse{UserTrade: t, format: format}
+	}
+	page := map[string]any{
+		"trades": responses,
+	}
+	if len(trades) == limit {
+		page["next"] = trades[len(trades)-1].TradeID
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// handleGetUserPositions lists the positions of the user in the path in
+// each market they have traded in, with their realized and unrealized PnL.
+func (s *server) handleGetUserPositions(c echo.Context) error {
+	positions := s.ex.Positions(pathUser(c))
+	responses := make([]positionResponse, len(positions))
+	for i, p := range positions {
+		format, err := s.exactFormat(p.Market)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		responses[i] = positionResponse{Position: p, format: format}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"positions": responses,
+	})
+}
+
+// callerKey is the API key the request authenticated with. It is empty for
+// a session, whose settings are those of no key.
+func callerKey(c echo.Context) (string, bool) {
+	key := c.Request().Header.Get("X-API-Key")
+	if key == "" {
+		return "", false
+	}
+	return key, true
+}
+
+// handleGetKeySettings shows the defaults of the API key the caller
+// authenticated with.
+func (s *server) handleGetKeySettings(c echo.Context) error {
+	key, ok := callerKey(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "key settings are only for requests made with an API key",
+		})
+	}
+	settings, err := s.users.KeySettings(key)
+	if err != nil {
+		return unauthorized(c)
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+// handlePutKeySettings replaces the defaults of the API key the caller
+// authenticated with.
+func (s *server) handlePutKeySettings(c echo.Context) error {
+	key, ok := callerKey(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "key settings are only for requests made with an API key",
+		})
+	}
+	var settings user.KeySettings
+	if _, err := decodeBody(c, &settings); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	if !exchange.SelfTradePrevention(settings.SelfTradePrevention).Valid() {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "selfTradePrevention must be CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT",
+		})
+	}
+	if err := s.users.SetKeySettings(key, settings); err != nil {
+		return unauthorized(c)
+	}
+	return c.JSON(http.StatusOK, settings)
+}
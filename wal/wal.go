@@ -0,0 +1,304 @@
+// Package wal keeps an append-only log of records on disk, each synced
+// before Append returns, so a record once appended survives the process
+// exiting, or the machine losing power, and can be read back in order.
+//
+// A record is its length as a u32, the CRC-32C of its data as a u32, both
+// little-endian, then the data. A crash part way through appending leaves
+// a record cut short, or one whose data doesn't match its checksum, at the
+// end of the file; Open drops it, as it was never reported appended. A bad
+// record anywhere else is corruption and Open refuses the file.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const headerLength = 8
+
+var (
+	// ErrCorrupt is returned by Open for a file with a bad record before
+	// its last one.
+	ErrCorrupt = errors.New("wal: corrupt record")
+	// ErrClosed is returned by Append after Close.
+	ErrClosed = errors.New("wal: log closed")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Log is an open write-ahead log. Its methods are safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// size is the length of the file up to the end of its last whole
+	// record
+	size    int64
+	records int
+	closed  bool
+}
+
+// Open opens the log at path, creating it if it doesn't exist, and drops
+// the record a crash cut short at its end, if there is one.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{path: path, f: f}
+	if err := l.recover(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+// recover finds the end of the last whole record and truncates the file
+// there.
+func (l *Log) recover() error {
+	info, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := io.NewSectionReader(l.f, 0, info.Size())
+	var buf []byte
+	for {
+		data, n, err := readRecord(r, l.size, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorrupt) && l.size+n == r.Size() {
+			// a record cut short by a crash, or whose data only partly
+			// reached the disk, and so never reported appended
+			if err := l.f.Truncate(l.size); err != nil {
+				return err
+			}
+			if err := l.f.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", l.size, err)
+		}
+		buf = data
+		l.size += n
+		l.records++
+	}
+	_, err = l.f.Seek(l.size, io.SeekStart)
+	return err
+}
+
+// readRecord reads the record at off in r, into buf if it is large enough,
+// and returns its data and its length on disk. A record running past the end
+// of r is io.ErrUnexpectedEOF; one whose data doesn't match its checksum is
+// ErrCorrupt, with the length it claims.
+func readRecord(r *io.SectionReader, off int64, buf []byte) ([]byte, int64, error) {
+	var header [headerLength]byte
+	if _, err := r.ReadAt(header[:], off); err != nil {
+		if errors.Is(err, io.EOF) && off < r.Size() {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	length := int64(binary.LittleEndian.Uint32(header[:4]))
+	n := headerLength + length
+	if off+n > r.Size() {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if int64(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	data := buf[:length]
+	if _, err := r.ReadAt(data, off+headerLength); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, n, ErrCorrupt
+	}
+	return data, n, nil
+}
+
+// Append adds a record holding data to the end of the log and syncs it to
+// disk. A record that couldn't be written whole is left out of the log.
+func (l *Log) Append(data []byte) error {
+	if len(data) > math.MaxUint32-headerLength {
+		return fmt.Errorf("wal: record of %d bytes is too large", len(data))
+	}
+	record := make([]byte, headerLength+len(data))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(data, crcTable))
+	copy(record[headerLength:], data)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if _, err := l.f.Write(record); err != nil {
+		l.rollBack()
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		l.rollBack()
+		return err
+	}
+	l.size += int64(len(record))
+	l.records++
+	return nil
+}
+
+// rollBack truncates whatever part of a failed append reached the file, so
+// the next record follows the last whole one. The caller holds l.mu.
+func (l *Log) rollBack() {
+	l.f.Truncate(l.size)
+	l.f.Seek(l.size, io.SeekStart)
+}
+
+// Records reads the log's records back, oldest first, as they stand when it
+// is called. Each record's data is only valid until the next is read.
+func (l *Log) Records() iter.Seq2[[]byte, error] {
+	l.mu.Lock()
+	r := io.NewSectionReader(l.f, 0, l.size)
+	l.mu.Unlock()
+
+	return func(yield func([]byte, error) bool) {
+		var buf []byte
+		for off := int64(0); off < r.Size(); {
+			data, n, err := readRecord(r, off, buf)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(data, nil) {
+				return
+			}
+			buf, off = data, off+n
+		}
+	}
+}
+
+// TrimFront drops the log's first n records, or all of them if it holds
+// fewer, such as once a checkpoint covers them. The records left are
+// copied to a new file that replaces the log's, so a crash part way
+// through leaves the log whole, with or without them.
+func (l *Log) TrimFront(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	n = min(n, l.records)
+	if n <= 0 {
+		return nil
+	}
+	r := io.NewSectionReader(l.f, 0, l.size)
+	var off int64
+	var buf []byte
+	for range n {
+		data, length, err := readRecord(r, off, buf)
+		if err != nil {
+			return err
+		}
+		buf, off = data, off+length
+	}
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(l.f, off, l.size-off))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	l.size -= off
+	l.records -= n
+	return syncDir(filepath.Dir(l.path))
+}
+
+// TrimBack drops the log's last n records, or all of them if it holds
+// fewer, such as records a replica has to give up to follow another's log.
+func (l *Log) TrimBack(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	n = min(n, l.records)
+	if n <= 0 {
+		return nil
+	}
+	r := io.NewSectionReader(l.f, 0, l.size)
+	var off int64
+	var buf []byte
+	for range l.records - n {
+		data, length, err := readRecord(r, off, buf)
+		if err != nil {
+			return err
+		}
+		buf, off = data, off+length
+	}
+	if err := l.f.Truncate(off); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.size = off
+	l.records -= n
+	_, err := l.f.Seek(l.size, io.SeekStart)
+	return err
+}
+
+// syncDir syncs the directory at path, so a file renamed into it stays
+// renamed.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Len returns how many records the log holds.
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.records
+}
+
+// Close closes the log's file. Append fails with ErrClosed afterwards.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.f.Close()
+}
@@ -0,0 +1,181 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func records(t *testing.T, l *Log) []string {
+	t.Helper()
+	var got []string
+	for data, err := range l.Records() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(data))
+	}
+	return got
+}
+
+func TestAppendAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"one", "", "three"} {
+		if err := l.Append([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := records(t, l); !slices.Equal(got, []string{"one", "", "three"}) {
+		t.Fatalf("records = %q", got)
+	}
+	l.Close()
+	if err := l.Append([]byte("four")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("append after close: %v", err)
+	}
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Append([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(t, l); !slices.Equal(got, []string{"one", "", "three", "four"}) {
+		t.Fatalf("records after reopening = %q", got)
+	}
+	if l.Len() != 4 {
+		t.Fatalf("len = %d, want 4", l.Len())
+	}
+}
+
+func TestTornTailIsDropped(t *testing.T) {
+	for name, tear := range map[string]func(b []byte) []byte{
+		"partial header": func(b []byte) []byte { return append(b, 5, 0) },
+		"partial data":   func(b []byte) []byte { return b[:len(b)-2] },
+		"bad checksum":   func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b },
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal")
+			l, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Append([]byte("kept"))
+			l.Append([]byte("torn"))
+			l.Close()
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tear(b), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			want := []string{"kept", "torn"}
+			if name != "partial header" {
+				want = want[:1]
+			}
+			if got := records(t, l); !slices.Equal(got, want) {
+				t.Fatalf("records = %q, want %q", got, want)
+			}
+			// the next record follows the last whole one
+			l.Append([]byte("next"))
+			if got := records(t, l); !slices.Equal(got, append(want, "next")) {
+				t.Fatalf("records after appending = %q", got)
+			}
+		})
+	}
+}
+
+func TestCorruptionBeforeTheTailIsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append([]byte("first"))
+	l.Append([]byte("second"))
+	l.Close()
+	b, _ := os.ReadFile(path)
+	b[headerLength] ^= 0xff
+	os.WriteFile(path, b, 0o644)
+
+	if _, err := Open(path); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("open = %v, want ErrCorrupt", err)
+	}
+}
+
+func TestTrimFront(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"one", "two", "three"} {
+		if err := l.Append([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.TrimFront(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(t, l); !slices.Equal(got, []string{"three", "four"}) || l.Len() != 2 {
+		t.Fatalf("records after trimming = %q", got)
+	}
+	l.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := records(t, l); !slices.Equal(got, []string{"three", "four"}) {
+		t.Fatalf("records after reopening = %q", got)
+	}
+	if err := l.TrimFront(5); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(t, l); len(got) != 0 || l.Len() != 0 {
+		t.Fatalf("records after trimming everything = %q", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+}
+
+func TestTrimBack(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, data := range []string{"one", "two", "three"} {
+		if err := l.Append([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.TrimBack(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(t, l); !slices.Equal(got, []string{"one", "four"}) || l.Len() != 2 {
+		t.Fatalf("records after trimming = %q", got)
+	}
+}
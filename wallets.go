@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/chain"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// withSweeper reports the exchange's wallets from sw. Without it the wallet
+// routes aren't registered.
+func withSweeper(sw *chain.Sweeper) serverOption {
+	return func(s *server) {
+		s.sweeper = sw
+	}
+}
+
+// parseHotCeilings parses hot wallet ceilings written as comma-separated
+// ASSET=amount pairs.
+func parseHotCeilings(s string) (map[ledger.Asset]float64, error) {
+	ceilings := make(map[ledger.Asset]float64)
+	if s == "" {
+		return ceilings, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		asset, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !ledger.AssetPattern.MatchString(asset) {
+			return nil, fmt.Errorf("%q is not ASSET=amount", pair)
+		}
+		amount, err := strconv.ParseFloat(v, 64)
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("%q is not ASSET=amount", pair)
+		}
+		ceilings[ledger.Asset(asset)] = amount
+	}
+	return ceilings, nil
+}
+
+// handleGetWallets reports what the deposit addresses, the hot wallet and
+// cold storage hold on chain, as the node sees it now.
+func (s *server) handleGetWallets(c echo.Context) error {
+	balances, err := s.sweeper.Balances(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"balances": balances,
+	})
+}
+
+// handleGetSweeps lists the sweeps from deposit addresses so far.
+func (s *server) handleGetSweeps(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"sweeps": s.sweeper.Sweeps(),
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/thenaveensharma/exchange/exchange"
+)
+
+// warmUp loads every market's book from peer, the base URL of a live
+// exchange, through its admin export endpoint, and checks each import
+// against the checksum the peer reported. It runs before the listener is
+// bound. If any market fails, every market is left empty and the exchange is
+// marked not ready until an operator overrides it.
+func warmUp(ctx context.Context, ex *exchange.Exchange, client *http.Client, peer, adminKey string) error {
+	for _, market := range ex.Markets() {
+		if err := warmUpMarket(ctx, ex, client, peer, adminKey, market); err != nil {
+			for _, market := range ex.Markets() {
+				ex.Reset(market, false)
+			}
+			ex.SetReady(false)
+			return fmt.Errorf("warming up %s: %w", market, err)
+		}
+	}
+	return nil
+}
+
+func warmUpMarket(ctx context.Context, ex *exchange.Exchange, client *http.Client, peer, adminKey string, market exchange.Market) error {
+	endpoint, err := url.JoinPath(peer, "admin/markets", string(market), "export")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Admin-Key", adminKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+
+	var export exportBody
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		return fmt.Errorf("decoding export: %w", err)
+	}
+	limits, err := ex.Limits(market)
+	if err != nil {
+		return err
+	}
+	snapshot, err := export.units(limits.Scale)
+	if err != nil {
+		return fmt.Errorf("decoding export: %w", err)
+	}
+	result, err := ex.Import(market, snapshot, true)
+	if err != nil {
+		return err
+	}
+	if result.Checksum != export.Checksum {
+		return fmt.Errorf("checksum mismatch: peer %d, imported %d", export.Checksum, result.Checksum)
+	}
+	slog.Info("market warmed up", "market", market, "peer", peer, "checksum", result.Checksum)
+	return nil
+}
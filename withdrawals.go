@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/chain"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/ledger"
+)
+
+// withWithdrawals queues users' withdrawals on w. Without it the
+// withdrawal routes aren't registered.
+func withWithdrawals(w *chain.Withdrawals) serverOption {
+	return func(s *server) {
+		s.withdrawals = w
+	}
+}
+
+// withdrawalRequest is the body of POST /withdrawals.
+type withdrawalRequest struct {
+	Asset   ledger.Asset `json:"asset"`
+	Amount  float64      `json:"amount"`
+	Address string       `json:"address"`
+}
+
+// handleRequestWithdrawal holds what the caller asks to withdraw and queues
+// it to be sent. It answers 202: the withdrawal goes out later, and
+// GET /withdrawals/:id follows it.
+func (s *server) handleRequestWithdrawal(c echo.Context) error {
+	var req withdrawalRequest
+	if _, err := decodeBody(c, &req); err != nil {
+		return bodyErrorResponse(c, err)
+	}
+	to, err := chain.ParseAddress(req.Address)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+
+	withdrawal, err := s.withdrawals.Request(callerID(c), req.Asset, to, req.Amount)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusAccepted, withdrawal)
+}
+
+// handleGetWithdrawals lists the caller's withdrawals.
+func (s *server) handleGetWithdrawals(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"withdrawals": s.withdrawals.List(callerID(c)),
+	})
+}
+
+// handleGetWithdrawal reports one of the caller's withdrawals by ID.
+func (s *server) handleGetWithdrawal(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "id must be a withdrawal ID",
+		})
+	}
+
+	withdrawal, err := s.withdrawals.Get(callerID(c), id)
+	if errors.Is(err, exchange.ErrWithdrawalNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, withdrawal)
+}
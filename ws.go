@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/thenaveensharma/exchange/candle"
+	"github.com/thenaveensharma/exchange/exchange"
+	"github.com/thenaveensharma/exchange/sbe"
+	"github.com/thenaveensharma/exchange/user"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsMaxMessage bounds what a WebSocket client may send in one message,
+	// in bytes.
+	wsMaxMessage = 4 << 10
+	// wsSendBuffer is how many messages a WebSocket connection queues
+	// before the client is deemed too slow and disconnected.
+	wsSendBuffer = 256
+	// defaultHeartbeat is how often WebSocket clients are pinged.
+	defaultHeartbeat = 30 * time.Second
+)
+
+// withHeartbeat sets how often WebSocket clients are pinged; the default
+// is defaultHeartbeat.
+func withHeartbeat(interval time.Duration) serverOption {
+	return func(s *server) {
+		s.heartbeat = interval
+	}
+}
+
+// wsChannel is a stream a WebSocket client subscribes to per market.
+type wsChannel string
+
+const (
+	// wsChannelBook carries the market's book deltas.
+	wsChannelBook wsChannel = "book"
+	// wsChannelTrades carries the market's trades, each with its ID, time
+	// and aggressor side.
+	wsChannelTrades wsChannel = "trades"
+	// wsChannelOrders carries what happens to the authenticated user's
+	// orders on every market; it takes no market.
+	wsChannelOrders wsChannel = "orders"
+	// wsChannelCandles carries the market's live candle at an interval,
+	// 1m unless the subscription names another, as each trade changes it,
+	// and the candle once its interval is over.
+	wsChannelCandles wsChannel = "candles"
+)
+
+// feedType is the kind of feed message ch carries.
+func (ch wsChannel) feedType() (exchange.FeedMessageType, bool) {
+	switch ch {
+	case wsChannelBook:
+		return exchange.FeedBook, true
+	case wsChannelTrades:
+		return exchange.FeedTrade, true
+	}
+	return "", false
+}
+
+// wsRequest is a message from a WebSocket client, such as
+//
+//	{"op": "subscribe", "channel": "trades", "market": "ETH"}
+//
+// or, for candles, at an interval:
+//
+//	{"op": "subscribe", "channel": "candles", "market": "ETH", "interval": "5m"}
+//
+// A client that couldn't authenticate the upgrade request with the usual
+// headers, as browsers can't, sends an API key or session token instead:
+//
+//	{"op": "auth", "token": "…"}
+//
+// The server sends {"type": "ping"} every heartbeat, and drops a client it
+// hasn't heard from in two: one with nothing else to say answers with
+// {"op": "pong"}. A client may check on the server with {"op": "ping"}.
+//
+// An authenticated client may turn on cancel-on-disconnect with
+//
+//	{"op": "cancelOnDisconnect", "enabled": true}
+//
+// so that its user's resting orders on every market are cancelled when the
+// connection ends, however it does; those too young to cancel yet are
+// cancelled once their market's minimum resting time is up.
+type wsRequest struct {
+	Op       string          `json:"op"`
+	Channel  wsChannel       `json:"channel"`
+	Market   exchange.Market `json:"market"`
+	Interval candle.Interval `json:"interval"`
+	APIKey   string          `json:"apiKey"`
+	Token    string          `json:"token"`
+	Enabled  bool            `json:"enabled"`
+}
+
+// wsMessage is a message to a WebSocket client. Type is "subscribed",
+// "unsubscribed" or "authenticated" acknowledging a request, "update"
+// carrying one operation's messages on a channel in Data, or "error" with
+// Msg saying why a request was refused. A subscription the server ends itself, because the client
+// fell behind, is "unsubscribed" with a Msg.
+//
+// The book channel starts with a "snapshot" of every level as of the book's
+// sequence number Seq. Each update after it carries the sequence number of
+// the operation it reports in Seq and that of the update before it, or of
+// the snapshot, in PrevSeq: a client applying updates whose PrevSeq is the
+// Seq it last applied keeps an exact copy of the book.
+//
+// The candles channel's updates carry the live candle at Interval, and
+// "closed" the candle whose interval is over, trade or no trade to start
+// the next one.
+//
+// "cancelOnDisconnect" acknowledges the flag being set to Enabled.
+type wsMessage struct {
+	Type     string          `json:"type"`
+	Channel  wsChannel       `json:"channel,omitempty"`
+	Market   exchange.Market `json:"market,omitempty"`
+	Interval candle.Interval `json:"interval,omitempty"`
+	Seq      *uint64         `json:"seq,omitempty"`
+	PrevSeq  *uint64         `json:"prevSeq,omitempty"`
+	Enabled  *bool           `json:"enabled,omitempty"`
+	Data     any             `json:"data,omitempty"`
+	Msg      string          `json:"msg,omitempty"`
+	// frame, when set, is sent as a binary frame instead
+	frame []byte
+}
+
+// wsKey identifies a subscription on a connection.
+type wsKey struct {
+	channel  wsChannel
+	market   exchange.Market
+	interval candle.Interval
+}
+
+// wsSubscription is a channel of a market a connection streams. done is
+// closed once its last update has been queued.
+type wsSubscription struct {
+	unsubscribe func()
+	done        chan struct{}
+}
+
+// handleWebSocket upgrades to a WebSocket over which the client subscribes
+// to markets' book, trade and candle channels, and a user to their orders. The
+// format query parameter renders market data numbers as on the HTTP routes.
+// Any origin may connect: users authenticate with credentials a page from
+// another origin doesn't have, never with cookies.
+//
+// With encoding=binary the book and trade channels' snapshots and updates
+// come as binary frames of sbe messages instead, a snapshot's starting with
+// the snapshot message; everything else stays JSON.
+func (s *server) handleWebSocket(c echo.Context) error {
+	switch c.QueryParam("format") {
+	case "", "string", "number":
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": errInvalidFormat.Error(),
+		})
+	}
+	var binary bool
+	switch c.QueryParam("encoding") {
+	case "", "json":
+	case "binary":
+		binary = true
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"msg": "encoding must be json or binary",
+		})
+	}
+
+	websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = wsMaxMessage
+			session := &wsSession{
+				s:      s,
+				c:      c,
+				conn:   conn,
+				user:   callerID(c),
+				binary: binary,
+				out:    make(chan wsMessage, wsSendBuffer),
+				done:   make(chan struct{}),
+				subs:   make(map[wsKey]*wsSubscription),
+			}
+			session.serve()
+		},
+	}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// wsSession is one WebSocket connection and its subscriptions.
+type wsSession struct {
+	s    *server
+	c    echo.Context
+	conn *websocket.Conn
+	// binary sends market data as sbe messages
+	binary bool
+	// out queues messages for the writer, and done is closed when the
+	// connection ends
+	out  chan wsMessage
+	done chan struct{}
+
+	mu sync.Mutex
+	// user is who the connection authenticated as, zero until it does
+	user uint64
+	// cancelOnDisconnect has user's orders cancelled when the connection
+	// ends
+	cancelOnDisconnect bool
+	subs               map[wsKey]*wsSubscription
+}
+
+// serve reads the client's requests until it goes away or misses two
+// heartbeats, then ends its subscriptions.
+func (ws *wsSession) serve() {
+	defer ws.conn.Close()
+	defer ws.disconnected()
+	defer ws.unsubscribeAll()
+	defer close(ws.done)
+	go ws.write()
+
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(2 * ws.s.heartbeat))
+		var req wsRequest
+		err := websocket.JSON.Receive(ws.conn, &req)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+			ws.send(wsMessage{Type: "error", Msg: "requests must be JSON objects"})
+			continue
+		case err != nil:
+			return
+		}
+
+		switch req.Op {
+		case "subscribe":
+			ws.subscribe(req.Channel, req.Market, req.Interval)
+		case "unsubscribe":
+			ws.unsubscribe(req.Channel, req.Market, req.Interval)
+		case "auth":
+			ws.authenticate(req.APIKey, req.Token)
+		case "cancelOnDisconnect":
+			ws.setCancelOnDisconnect(req.Enabled)
+		case "ping":
+			ws.send(wsMessage{Type: "pong"})
+		case "pong":
+		default:
+			ws.send(wsMessage{Type: "error", Msg: "op must be subscribe, unsubscribe, auth, cancelOnDisconnect, ping or pong"})
+		}
+	}
+}
+
+// write sends the queued messages, and a ping every heartbeat, until the
+// connection ends.
+func (ws *wsSession) write() {
+	ticker := time.NewTicker(ws.s.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		var msg wsMessage
+		select {
+		case <-ws.done:
+			return
+		case msg = <-ws.out:
+		case <-ticker.C:
+			msg = wsMessage{Type: "ping"}
+		}
+		var err error
+		if msg.frame != nil {
+			err = websocket.Message.Send(ws.conn, msg.frame)
+		} else {
+			err = websocket.JSON.Send(ws.conn, msg)
+		}
+		if err != nil {
+			ws.conn.Close()
+			return
+		}
+	}
+}
+
+// send queues msg. A client too slow to keep its queue from filling up is
+// disconnected rather than left to hold up the feed.
+func (ws *wsSession) send(msg wsMessage) {
+	select {
+	case ws.out <- msg:
+	case <-ws.done:
+	default:
+		ws.conn.Close()
+	}
+}
+
+// authenticate makes the connection the user with apiKey or the session
+// token.
+func (ws *wsSession) authenticate(apiKey, token string) {
+	var u user.User
+	ok := false
+	switch {
+	case apiKey != "":
+		u, ok = ws.s.users.Authenticate(apiKey)
+	case token != "":
+		if id, err := ws.s.sessions.Verify(token); err == nil {
+			u, err = ws.s.users.Get(id)
+			ok = err == nil
+		}
+	}
+	if !ok {
+		ws.send(wsMessage{Type: "error", Msg: "unauthorized"})
+		return
+	}
+
+	ws.mu.Lock()
+	if ws.user != 0 && ws.user != u.ID {
+		ws.mu.Unlock()
+		ws.send(wsMessage{Type: "error", Msg: "already authenticated as another user"})
+		return
+	}
+	ws.user = u.ID
+	ws.mu.Unlock()
+	ws.send(wsMessage{Type: "authenticated"})
+}
+
+// setCancelOnDisconnect sets whether the user's orders are cancelled when
+// the connection ends.
+func (ws *wsSession) setCancelOnDisconnect(enabled bool) {
+	ws.mu.Lock()
+	ok := ws.user != 0
+	if ok {
+		ws.cancelOnDisconnect = enabled
+	}
+	ws.mu.Unlock()
+	if !ok {
+		ws.send(wsMessage{Type: "error", Msg: "unauthorized"})
+		return
+	}
+	ws.send(wsMessage{Type: "cancelOnDisconnect", Enabled: &enabled})
+}
+
+// disconnected cancels the user's resting orders on every market if the
+// client asked for it. Orders that haven't rested for their market's
+// minimum resting time are left resting until they have, and cancelled
+// then.
+func (ws *wsSession) disconnected() {
+	ws.mu.Lock()
+	owner, cancel := ws.user, ws.cancelOnDisconnect
+	ws.mu.Unlock()
+	if !cancel {
+		return
+	}
+
+	cancelled, kept := 0, 0
+	for _, market := range ws.s.ex.Markets() {
+		result, err := ws.s.ex.Cancel(context.Background(), exchange.CancelRequest{Market: market, Owner: owner})
+		if err != nil {
+			slog.Error("cancel on disconnect failed", "user", owner, "market", market, "error", err)
+			continue
+		}
+		cancelled += len(result.Cancelled)
+		kept += len(result.Kept)
+		for _, o := range result.Kept {
+			ws.cancelLater(owner, o)
+		}
+	}
+	slog.Info("orders cancelled on disconnect", "user", owner, "count", cancelled, "deferred", kept)
+}
+
+// cancelLater cancels owner's order o once it may be cancelled. One that
+// has left the book by then is no longer there to cancel.
+func (ws *wsSession) cancelLater(owner uint64, o exchange.KeptOrder) {
+	time.AfterFunc(time.Until(time.Unix(0, o.EarliestCancel)), func() {
+		_, err := ws.s.ex.CancelOrder(context.Background(), owner, o.ID)
+		var rejection *exchange.Rejection
+		if errors.As(err, &rejection) && rejection.Code == "ORDER_NOT_FOUND" {
+			return
+		}
+		if err != nil {
+			slog.Error("deferred cancel on disconnect failed", "user", owner, "order", o.ID, "error", err)
+		}
+	})
+}
+
+func (ws *wsSession) subscribe(channel wsChannel, market exchange.Market, interval candle.Interval) {
+	key, err := subscriptionKey(channel, market, interval)
+	if err != nil {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: market, Interval: interval, Msg: err.Error()})
+		return
+	}
+	ws.mu.Lock()
+	_, subscribed := ws.subs[key]
+	ws.mu.Unlock()
+	if subscribed {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: key.market, Interval: key.interval, Msg: "already subscribed"})
+		return
+	}
+	switch channel {
+	case wsChannelOrders:
+		ws.subscribeOrders(key)
+		return
+	case wsChannelCandles:
+		ws.subscribeCandles(key)
+		return
+	}
+	feedType, ok := channel.feedType()
+	if !ok {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: market, Msg: "channel must be book, trades, candles or orders"})
+		return
+	}
+	format, err := ws.s.numberFormat(ws.c, market)
+	if err != nil {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: market, Msg: err.Error()})
+		return
+	}
+	var (
+		snapshot    []exchange.FeedMessage
+		seq         uint64
+		updates     <-chan []exchange.FeedMessage
+		unsubscribe func()
+	)
+	if channel == wsChannelBook {
+		snapshot, seq, updates, unsubscribe, err = ws.s.snapshotFeed(ws.c.Request().Context(), market)
+	} else {
+		updates, unsubscribe, err = ws.s.ex.SubscribeFeed(market)
+	}
+	if err != nil {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: market, Msg: err.Error()})
+		return
+	}
+
+	sub := &wsSubscription{unsubscribe: unsubscribe, done: make(chan struct{})}
+	ws.mu.Lock()
+	ws.subs[key] = sub
+	ws.mu.Unlock()
+	ws.send(wsMessage{Type: "subscribed", Channel: channel, Market: market})
+	if channel == wsChannelBook {
+		snapshotSeq := seq
+		if ws.binary {
+			frame := sbe.AppendSnapshot(nil, market, seq, len(snapshot))
+			for _, msg := range snapshot {
+				frame = sbe.AppendFeedMessage(frame, msg, 0)
+			}
+			ws.send(wsMessage{frame: frame})
+		} else {
+			ws.send(wsMessage{Type: "snapshot", Channel: channel, Market: market, Seq: &snapshotSeq, Data: feedMessageResponses(snapshot, format)})
+		}
+	}
+
+	go func() {
+		defer close(sub.done)
+		for msgs := range updates {
+			var data []exchange.FeedMessage
+			for _, msg := range msgs {
+				if msg.Type == feedType {
+					data = append(data, msg)
+				}
+			}
+			if len(data) == 0 {
+				continue
+			}
+			prev := seq
+			if channel == wsChannelBook {
+				seq = data[0].Seq
+			}
+			if ws.binary {
+				var frame []byte
+				for _, msg := range data {
+					frame = sbe.AppendFeedMessage(frame, msg, prev)
+				}
+				ws.send(wsMessage{frame: frame})
+				continue
+			}
+			update := wsMessage{Type: "update", Channel: channel, Market: market, Data: feedMessageResponses(data, format)}
+			if channel == wsChannelBook {
+				next := seq
+				update.Seq, update.PrevSeq = &next, &prev
+			}
+			ws.send(update)
+		}
+		ws.ended(key, sub)
+	}()
+}
+
+// subscribeOrders streams the user's order updates.
+func (ws *wsSession) subscribeOrders(key wsKey) {
+	ws.mu.Lock()
+	owner := ws.user
+	ws.mu.Unlock()
+	if owner == 0 {
+		ws.send(wsMessage{Type: "error", Channel: key.channel, Msg: "unauthorized"})
+		return
+	}
+
+	updates, unsubscribe := ws.s.ex.SubscribeOrderUpdates(owner)
+	sub := &wsSubscription{unsubscribe: unsubscribe, done: make(chan struct{})}
+	ws.mu.Lock()
+	ws.subs[key] = sub
+	ws.mu.Unlock()
+	ws.send(wsMessage{Type: "subscribed", Channel: key.channel})
+
+	go func() {
+		defer close(sub.done)
+		for batch := range updates {
+			data := make([]orderUpdateResponse, len(batch))
+			for i, u := range batch {
+				// a market's scale is already known once it has an order
+				format, _ := ws.s.exactFormat(u.Market)
+				data[i] = orderUpdateResponse{OrderUpdate: u, format: format}
+			}
+			ws.send(wsMessage{Type: "update", Channel: key.channel, Data: data})
+		}
+		ws.ended(key, sub)
+	}()
+}
+
+// ended tells the client a subscription's stream has closed, unless it
+// unsubscribed: the feed cut it off for falling behind.
+func (ws *wsSession) ended(key wsKey, sub *wsSubscription) {
+	ws.mu.Lock()
+	current := ws.subs[key] == sub
+	if current {
+		delete(ws.subs, key)
+	}
+	ws.mu.Unlock()
+	if current {
+		ws.send(wsMessage{Type: "unsubscribed", Channel: key.channel, Market: key.market, Interval: key.interval, Msg: "fell behind the feed"})
+	}
+}
+
+// unsubscribe ends a subscription, acknowledging it once its last update
+// has been queued so none follows the acknowledgement.
+func (ws *wsSession) unsubscribe(channel wsChannel, market exchange.Market, interval candle.Interval) {
+	key, err := subscriptionKey(channel, market, interval)
+	if err != nil {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: market, Interval: interval, Msg: err.Error()})
+		return
+	}
+	ws.mu.Lock()
+	sub, ok := ws.subs[key]
+	delete(ws.subs, key)
+	ws.mu.Unlock()
+	if !ok {
+		ws.send(wsMessage{Type: "error", Channel: channel, Market: key.market, Interval: key.interval, Msg: "not subscribed"})
+		return
+	}
+	sub.unsubscribe()
+	<-sub.done
+	ws.send(wsMessage{Type: "unsubscribed", Channel: channel, Market: key.market, Interval: key.interval})
+}
+
+// subscriptionKey is the key of the subscription to channel of market at
+// interval: the orders channel takes no market, and only the candles
+// channel an interval, 1m by default.
+func subscriptionKey(channel wsChannel, market exchange.Market, interval candle.Interval) (wsKey, error) {
+	switch channel {
+	case wsChannelOrders:
+		return wsKey{channel: channel}, nil
+	case wsChannelCandles:
+		if interval == "" {
+			return wsKey{channel, market, candle.Minute}, nil
+		}
+		if _, err := candle.ParseInterval(string(interval)); err != nil {
+			return wsKey{}, err
+		}
+		return wsKey{channel, market, interval}, nil
+	}
+	return wsKey{channel: channel, market: market}, nil
+}
+
+func (ws *wsSession) unsubscribeAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for key, sub := range ws.subs {
+		delete(ws.subs, key)
+		sub.unsubscribe()
+	}
+}
+
+// feedMessageResponses renders msgs in format.
+func feedMessageResponses(msgs []exchange.FeedMessage, format numberFormat) []feedMessageResponse {
+	responses := make([]feedMessageResponse, len(msgs))
+	for i, msg := range msgs {
+		responses[i] = feedMessageResponse{FeedMessage: msg, format: format}
+	}
+	return responses
+}